@@ -0,0 +1,5 @@
+// Package admin contains the gRPC API for controlling a running thestral2
+// app, which is generated from admin.proto.
+package admin
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative admin.proto
@@ -0,0 +1,794 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.36.11
+// 	protoc        (unknown)
+// source: admin.proto
+
+package admin
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	reflect "reflect"
+	sync "sync"
+	unsafe "unsafe"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+type ListTunnelsRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ListTunnelsRequest) Reset() {
+	*x = ListTunnelsRequest{}
+	mi := &file_admin_proto_msgTypes[0]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ListTunnelsRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ListTunnelsRequest) ProtoMessage() {}
+
+func (x *ListTunnelsRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_admin_proto_msgTypes[0]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ListTunnelsRequest.ProtoReflect.Descriptor instead.
+func (*ListTunnelsRequest) Descriptor() ([]byte, []int) {
+	return file_admin_proto_rawDescGZIP(), []int{0}
+}
+
+type ListTunnelsResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Tunnels       []*Tunnel              `protobuf:"bytes,1,rep,name=tunnels,proto3" json:"tunnels,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ListTunnelsResponse) Reset() {
+	*x = ListTunnelsResponse{}
+	mi := &file_admin_proto_msgTypes[1]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ListTunnelsResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ListTunnelsResponse) ProtoMessage() {}
+
+func (x *ListTunnelsResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_admin_proto_msgTypes[1]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ListTunnelsResponse.ProtoReflect.Descriptor instead.
+func (*ListTunnelsResponse) Descriptor() ([]byte, []int) {
+	return file_admin_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *ListTunnelsResponse) GetTunnels() []*Tunnel {
+	if x != nil {
+		return x.Tunnels
+	}
+	return nil
+}
+
+// Tunnel is the report of an active tunnel.
+type Tunnel struct {
+	state                  protoimpl.MessageState `protogen:"open.v1"`
+	RequestId              string                 `protobuf:"bytes,1,opt,name=request_id,json=requestId,proto3" json:"request_id,omitempty"`
+	Rule                   string                 `protobuf:"bytes,2,opt,name=rule,proto3" json:"rule,omitempty"`
+	EstablishedSinceUnixMs int64                  `protobuf:"varint,3,opt,name=established_since_unix_ms,json=establishedSinceUnixMs,proto3" json:"established_since_unix_ms,omitempty"`
+	ElapsedTimeSecs        float64                `protobuf:"fixed64,4,opt,name=elapsed_time_secs,json=elapsedTimeSecs,proto3" json:"elapsed_time_secs,omitempty"`
+	Downstream             string                 `protobuf:"bytes,5,opt,name=downstream,proto3" json:"downstream,omitempty"`
+	ClientAddr             string                 `protobuf:"bytes,6,opt,name=client_addr,json=clientAddr,proto3" json:"client_addr,omitempty"`
+	ClientIds              []string               `protobuf:"bytes,7,rep,name=client_ids,json=clientIds,proto3" json:"client_ids,omitempty"`
+	TargetAddr             string                 `protobuf:"bytes,8,opt,name=target_addr,json=targetAddr,proto3" json:"target_addr,omitempty"`
+	Upstream               string                 `protobuf:"bytes,9,opt,name=upstream,proto3" json:"upstream,omitempty"`
+	BoundAddr              string                 `protobuf:"bytes,10,opt,name=bound_addr,json=boundAddr,proto3" json:"bound_addr,omitempty"`
+	ConnLatencyMs          float32                `protobuf:"fixed32,11,opt,name=conn_latency_ms,json=connLatencyMs,proto3" json:"conn_latency_ms,omitempty"`
+	UploadSpeed            float32                `protobuf:"fixed32,12,opt,name=upload_speed,json=uploadSpeed,proto3" json:"upload_speed,omitempty"`
+	DownloadSpeed          float32                `protobuf:"fixed32,13,opt,name=download_speed,json=downloadSpeed,proto3" json:"download_speed,omitempty"`
+	BytesUploaded          uint64                 `protobuf:"varint,14,opt,name=bytes_uploaded,json=bytesUploaded,proto3" json:"bytes_uploaded,omitempty"`
+	BytesDownloaded        uint64                 `protobuf:"varint,15,opt,name=bytes_downloaded,json=bytesDownloaded,proto3" json:"bytes_downloaded,omitempty"`
+	Tags                   []string               `protobuf:"bytes,16,rep,name=tags,proto3" json:"tags,omitempty"` // of the rule
+	// the breakdown of conn_latency_ms
+	ResolveLatencyMs   float32 `protobuf:"fixed32,17,opt,name=resolve_latency_ms,json=resolveLatencyMs,proto3" json:"resolve_latency_ms,omitempty"`
+	DialLatencyMs      float32 `protobuf:"fixed32,18,opt,name=dial_latency_ms,json=dialLatencyMs,proto3" json:"dial_latency_ms,omitempty"`
+	HandshakeLatencyMs float32 `protobuf:"fixed32,19,opt,name=handshake_latency_ms,json=handshakeLatencyMs,proto3" json:"handshake_latency_ms,omitempty"`
+	unknownFields      protoimpl.UnknownFields
+	sizeCache          protoimpl.SizeCache
+}
+
+func (x *Tunnel) Reset() {
+	*x = Tunnel{}
+	mi := &file_admin_proto_msgTypes[2]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Tunnel) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Tunnel) ProtoMessage() {}
+
+func (x *Tunnel) ProtoReflect() protoreflect.Message {
+	mi := &file_admin_proto_msgTypes[2]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Tunnel.ProtoReflect.Descriptor instead.
+func (*Tunnel) Descriptor() ([]byte, []int) {
+	return file_admin_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *Tunnel) GetRequestId() string {
+	if x != nil {
+		return x.RequestId
+	}
+	return ""
+}
+
+func (x *Tunnel) GetRule() string {
+	if x != nil {
+		return x.Rule
+	}
+	return ""
+}
+
+func (x *Tunnel) GetEstablishedSinceUnixMs() int64 {
+	if x != nil {
+		return x.EstablishedSinceUnixMs
+	}
+	return 0
+}
+
+func (x *Tunnel) GetElapsedTimeSecs() float64 {
+	if x != nil {
+		return x.ElapsedTimeSecs
+	}
+	return 0
+}
+
+func (x *Tunnel) GetDownstream() string {
+	if x != nil {
+		return x.Downstream
+	}
+	return ""
+}
+
+func (x *Tunnel) GetClientAddr() string {
+	if x != nil {
+		return x.ClientAddr
+	}
+	return ""
+}
+
+func (x *Tunnel) GetClientIds() []string {
+	if x != nil {
+		return x.ClientIds
+	}
+	return nil
+}
+
+func (x *Tunnel) GetTargetAddr() string {
+	if x != nil {
+		return x.TargetAddr
+	}
+	return ""
+}
+
+func (x *Tunnel) GetUpstream() string {
+	if x != nil {
+		return x.Upstream
+	}
+	return ""
+}
+
+func (x *Tunnel) GetBoundAddr() string {
+	if x != nil {
+		return x.BoundAddr
+	}
+	return ""
+}
+
+func (x *Tunnel) GetConnLatencyMs() float32 {
+	if x != nil {
+		return x.ConnLatencyMs
+	}
+	return 0
+}
+
+func (x *Tunnel) GetUploadSpeed() float32 {
+	if x != nil {
+		return x.UploadSpeed
+	}
+	return 0
+}
+
+func (x *Tunnel) GetDownloadSpeed() float32 {
+	if x != nil {
+		return x.DownloadSpeed
+	}
+	return 0
+}
+
+func (x *Tunnel) GetBytesUploaded() uint64 {
+	if x != nil {
+		return x.BytesUploaded
+	}
+	return 0
+}
+
+func (x *Tunnel) GetBytesDownloaded() uint64 {
+	if x != nil {
+		return x.BytesDownloaded
+	}
+	return 0
+}
+
+func (x *Tunnel) GetTags() []string {
+	if x != nil {
+		return x.Tags
+	}
+	return nil
+}
+
+func (x *Tunnel) GetResolveLatencyMs() float32 {
+	if x != nil {
+		return x.ResolveLatencyMs
+	}
+	return 0
+}
+
+func (x *Tunnel) GetDialLatencyMs() float32 {
+	if x != nil {
+		return x.DialLatencyMs
+	}
+	return 0
+}
+
+func (x *Tunnel) GetHandshakeLatencyMs() float32 {
+	if x != nil {
+		return x.HandshakeLatencyMs
+	}
+	return 0
+}
+
+type CloseTunnelRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	RequestId     string                 `protobuf:"bytes,1,opt,name=request_id,json=requestId,proto3" json:"request_id,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *CloseTunnelRequest) Reset() {
+	*x = CloseTunnelRequest{}
+	mi := &file_admin_proto_msgTypes[3]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *CloseTunnelRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*CloseTunnelRequest) ProtoMessage() {}
+
+func (x *CloseTunnelRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_admin_proto_msgTypes[3]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use CloseTunnelRequest.ProtoReflect.Descriptor instead.
+func (*CloseTunnelRequest) Descriptor() ([]byte, []int) {
+	return file_admin_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *CloseTunnelRequest) GetRequestId() string {
+	if x != nil {
+		return x.RequestId
+	}
+	return ""
+}
+
+type CloseTunnelResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *CloseTunnelResponse) Reset() {
+	*x = CloseTunnelResponse{}
+	mi := &file_admin_proto_msgTypes[4]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *CloseTunnelResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*CloseTunnelResponse) ProtoMessage() {}
+
+func (x *CloseTunnelResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_admin_proto_msgTypes[4]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use CloseTunnelResponse.ProtoReflect.Descriptor instead.
+func (*CloseTunnelResponse) Descriptor() ([]byte, []int) {
+	return file_admin_proto_rawDescGZIP(), []int{4}
+}
+
+type ReloadRulesRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ReloadRulesRequest) Reset() {
+	*x = ReloadRulesRequest{}
+	mi := &file_admin_proto_msgTypes[5]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ReloadRulesRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ReloadRulesRequest) ProtoMessage() {}
+
+func (x *ReloadRulesRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_admin_proto_msgTypes[5]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ReloadRulesRequest.ProtoReflect.Descriptor instead.
+func (*ReloadRulesRequest) Descriptor() ([]byte, []int) {
+	return file_admin_proto_rawDescGZIP(), []int{5}
+}
+
+type ReloadRulesResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ReloadRulesResponse) Reset() {
+	*x = ReloadRulesResponse{}
+	mi := &file_admin_proto_msgTypes[6]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ReloadRulesResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ReloadRulesResponse) ProtoMessage() {}
+
+func (x *ReloadRulesResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_admin_proto_msgTypes[6]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ReloadRulesResponse.ProtoReflect.Descriptor instead.
+func (*ReloadRulesResponse) Descriptor() ([]byte, []int) {
+	return file_admin_proto_rawDescGZIP(), []int{6}
+}
+
+type SetUpstreamEnabledRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Upstream      string                 `protobuf:"bytes,1,opt,name=upstream,proto3" json:"upstream,omitempty"`
+	Enabled       bool                   `protobuf:"varint,2,opt,name=enabled,proto3" json:"enabled,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *SetUpstreamEnabledRequest) Reset() {
+	*x = SetUpstreamEnabledRequest{}
+	mi := &file_admin_proto_msgTypes[7]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *SetUpstreamEnabledRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*SetUpstreamEnabledRequest) ProtoMessage() {}
+
+func (x *SetUpstreamEnabledRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_admin_proto_msgTypes[7]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use SetUpstreamEnabledRequest.ProtoReflect.Descriptor instead.
+func (*SetUpstreamEnabledRequest) Descriptor() ([]byte, []int) {
+	return file_admin_proto_rawDescGZIP(), []int{7}
+}
+
+func (x *SetUpstreamEnabledRequest) GetUpstream() string {
+	if x != nil {
+		return x.Upstream
+	}
+	return ""
+}
+
+func (x *SetUpstreamEnabledRequest) GetEnabled() bool {
+	if x != nil {
+		return x.Enabled
+	}
+	return false
+}
+
+type SetUpstreamEnabledResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *SetUpstreamEnabledResponse) Reset() {
+	*x = SetUpstreamEnabledResponse{}
+	mi := &file_admin_proto_msgTypes[8]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *SetUpstreamEnabledResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*SetUpstreamEnabledResponse) ProtoMessage() {}
+
+func (x *SetUpstreamEnabledResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_admin_proto_msgTypes[8]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use SetUpstreamEnabledResponse.ProtoReflect.Descriptor instead.
+func (*SetUpstreamEnabledResponse) Descriptor() ([]byte, []int) {
+	return file_admin_proto_rawDescGZIP(), []int{8}
+}
+
+type GetStatsRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *GetStatsRequest) Reset() {
+	*x = GetStatsRequest{}
+	mi := &file_admin_proto_msgTypes[9]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *GetStatsRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*GetStatsRequest) ProtoMessage() {}
+
+func (x *GetStatsRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_admin_proto_msgTypes[9]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use GetStatsRequest.ProtoReflect.Descriptor instead.
+func (*GetStatsRequest) Descriptor() ([]byte, []int) {
+	return file_admin_proto_rawDescGZIP(), []int{9}
+}
+
+type GetStatsResponse struct {
+	state           protoimpl.MessageState `protogen:"open.v1"`
+	ActiveTunnels   uint32                 `protobuf:"varint,1,opt,name=active_tunnels,json=activeTunnels,proto3" json:"active_tunnels,omitempty"`
+	ErrorCount      uint32                 `protobuf:"varint,2,opt,name=error_count,json=errorCount,proto3" json:"error_count,omitempty"`
+	UploadSpeed     float32                `protobuf:"fixed32,3,opt,name=upload_speed,json=uploadSpeed,proto3" json:"upload_speed,omitempty"`
+	DownloadSpeed   float32                `protobuf:"fixed32,4,opt,name=download_speed,json=downloadSpeed,proto3" json:"download_speed,omitempty"`
+	BytesUploaded   uint64                 `protobuf:"varint,5,opt,name=bytes_uploaded,json=bytesUploaded,proto3" json:"bytes_uploaded,omitempty"`
+	BytesDownloaded uint64                 `protobuf:"varint,6,opt,name=bytes_downloaded,json=bytesDownloaded,proto3" json:"bytes_downloaded,omitempty"`
+	// the full report in the JSON served by the monitor
+	ReportJson    string `protobuf:"bytes,7,opt,name=report_json,json=reportJson,proto3" json:"report_json,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *GetStatsResponse) Reset() {
+	*x = GetStatsResponse{}
+	mi := &file_admin_proto_msgTypes[10]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *GetStatsResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*GetStatsResponse) ProtoMessage() {}
+
+func (x *GetStatsResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_admin_proto_msgTypes[10]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use GetStatsResponse.ProtoReflect.Descriptor instead.
+func (*GetStatsResponse) Descriptor() ([]byte, []int) {
+	return file_admin_proto_rawDescGZIP(), []int{10}
+}
+
+func (x *GetStatsResponse) GetActiveTunnels() uint32 {
+	if x != nil {
+		return x.ActiveTunnels
+	}
+	return 0
+}
+
+func (x *GetStatsResponse) GetErrorCount() uint32 {
+	if x != nil {
+		return x.ErrorCount
+	}
+	return 0
+}
+
+func (x *GetStatsResponse) GetUploadSpeed() float32 {
+	if x != nil {
+		return x.UploadSpeed
+	}
+	return 0
+}
+
+func (x *GetStatsResponse) GetDownloadSpeed() float32 {
+	if x != nil {
+		return x.DownloadSpeed
+	}
+	return 0
+}
+
+func (x *GetStatsResponse) GetBytesUploaded() uint64 {
+	if x != nil {
+		return x.BytesUploaded
+	}
+	return 0
+}
+
+func (x *GetStatsResponse) GetBytesDownloaded() uint64 {
+	if x != nil {
+		return x.BytesDownloaded
+	}
+	return 0
+}
+
+func (x *GetStatsResponse) GetReportJson() string {
+	if x != nil {
+		return x.ReportJson
+	}
+	return ""
+}
+
+var File_admin_proto protoreflect.FileDescriptor
+
+const file_admin_proto_rawDesc = "" +
+	"\n" +
+	"\vadmin.proto\x12\x0fthestral2.admin\"\x14\n" +
+	"\x12ListTunnelsRequest\"H\n" +
+	"\x13ListTunnelsResponse\x121\n" +
+	"\atunnels\x18\x01 \x03(\v2\x17.thestral2.admin.TunnelR\atunnels\"\xbe\x05\n" +
+	"\x06Tunnel\x12\x1d\n" +
+	"\n" +
+	"request_id\x18\x01 \x01(\tR\trequestId\x12\x12\n" +
+	"\x04rule\x18\x02 \x01(\tR\x04rule\x129\n" +
+	"\x19established_since_unix_ms\x18\x03 \x01(\x03R\x16establishedSinceUnixMs\x12*\n" +
+	"\x11elapsed_time_secs\x18\x04 \x01(\x01R\x0felapsedTimeSecs\x12\x1e\n" +
+	"\n" +
+	"downstream\x18\x05 \x01(\tR\n" +
+	"downstream\x12\x1f\n" +
+	"\vclient_addr\x18\x06 \x01(\tR\n" +
+	"clientAddr\x12\x1d\n" +
+	"\n" +
+	"client_ids\x18\a \x03(\tR\tclientIds\x12\x1f\n" +
+	"\vtarget_addr\x18\b \x01(\tR\n" +
+	"targetAddr\x12\x1a\n" +
+	"\bupstream\x18\t \x01(\tR\bupstream\x12\x1d\n" +
+	"\n" +
+	"bound_addr\x18\n" +
+	" \x01(\tR\tboundAddr\x12&\n" +
+	"\x0fconn_latency_ms\x18\v \x01(\x02R\rconnLatencyMs\x12!\n" +
+	"\fupload_speed\x18\f \x01(\x02R\vuploadSpeed\x12%\n" +
+	"\x0edownload_speed\x18\r \x01(\x02R\rdownloadSpeed\x12%\n" +
+	"\x0ebytes_uploaded\x18\x0e \x01(\x04R\rbytesUploaded\x12)\n" +
+	"\x10bytes_downloaded\x18\x0f \x01(\x04R\x0fbytesDownloaded\x12\x12\n" +
+	"\x04tags\x18\x10 \x03(\tR\x04tags\x12,\n" +
+	"\x12resolve_latency_ms\x18\x11 \x01(\x02R\x10resolveLatencyMs\x12&\n" +
+	"\x0fdial_latency_ms\x18\x12 \x01(\x02R\rdialLatencyMs\x120\n" +
+	"\x14handshake_latency_ms\x18\x13 \x01(\x02R\x12handshakeLatencyMs\"3\n" +
+	"\x12CloseTunnelRequest\x12\x1d\n" +
+	"\n" +
+	"request_id\x18\x01 \x01(\tR\trequestId\"\x15\n" +
+	"\x13CloseTunnelResponse\"\x14\n" +
+	"\x12ReloadRulesRequest\"\x15\n" +
+	"\x13ReloadRulesResponse\"Q\n" +
+	"\x19SetUpstreamEnabledRequest\x12\x1a\n" +
+	"\bupstream\x18\x01 \x01(\tR\bupstream\x12\x18\n" +
+	"\aenabled\x18\x02 \x01(\bR\aenabled\"\x1c\n" +
+	"\x1aSetUpstreamEnabledResponse\"\x11\n" +
+	"\x0fGetStatsRequest\"\x97\x02\n" +
+	"\x10GetStatsResponse\x12%\n" +
+	"\x0eactive_tunnels\x18\x01 \x01(\rR\ractiveTunnels\x12\x1f\n" +
+	"\verror_count\x18\x02 \x01(\rR\n" +
+	"errorCount\x12!\n" +
+	"\fupload_speed\x18\x03 \x01(\x02R\vuploadSpeed\x12%\n" +
+	"\x0edownload_speed\x18\x04 \x01(\x02R\rdownloadSpeed\x12%\n" +
+	"\x0ebytes_uploaded\x18\x05 \x01(\x04R\rbytesUploaded\x12)\n" +
+	"\x10bytes_downloaded\x18\x06 \x01(\x04R\x0fbytesDownloaded\x12\x1f\n" +
+	"\vreport_json\x18\a \x01(\tR\n" +
+	"reportJson2\xd5\x03\n" +
+	"\x05Admin\x12X\n" +
+	"\vListTunnels\x12#.thestral2.admin.ListTunnelsRequest\x1a$.thestral2.admin.ListTunnelsResponse\x12X\n" +
+	"\vCloseTunnel\x12#.thestral2.admin.CloseTunnelRequest\x1a$.thestral2.admin.CloseTunnelResponse\x12X\n" +
+	"\vReloadRules\x12#.thestral2.admin.ReloadRulesRequest\x1a$.thestral2.admin.ReloadRulesResponse\x12m\n" +
+	"\x12SetUpstreamEnabled\x12*.thestral2.admin.SetUpstreamEnabledRequest\x1a+.thestral2.admin.SetUpstreamEnabledResponse\x12O\n" +
+	"\bGetStats\x12 .thestral2.admin.GetStatsRequest\x1a!.thestral2.admin.GetStatsResponseB(Z&github.com/richardtsai/thestral2/adminb\x06proto3"
+
+var (
+	file_admin_proto_rawDescOnce sync.Once
+	file_admin_proto_rawDescData []byte
+)
+
+func file_admin_proto_rawDescGZIP() []byte {
+	file_admin_proto_rawDescOnce.Do(func() {
+		file_admin_proto_rawDescData = protoimpl.X.CompressGZIP(unsafe.Slice(unsafe.StringData(file_admin_proto_rawDesc), len(file_admin_proto_rawDesc)))
+	})
+	return file_admin_proto_rawDescData
+}
+
+var file_admin_proto_msgTypes = make([]protoimpl.MessageInfo, 11)
+var file_admin_proto_goTypes = []any{
+	(*ListTunnelsRequest)(nil),         // 0: thestral2.admin.ListTunnelsRequest
+	(*ListTunnelsResponse)(nil),        // 1: thestral2.admin.ListTunnelsResponse
+	(*Tunnel)(nil),                     // 2: thestral2.admin.Tunnel
+	(*CloseTunnelRequest)(nil),         // 3: thestral2.admin.CloseTunnelRequest
+	(*CloseTunnelResponse)(nil),        // 4: thestral2.admin.CloseTunnelResponse
+	(*ReloadRulesRequest)(nil),         // 5: thestral2.admin.ReloadRulesRequest
+	(*ReloadRulesResponse)(nil),        // 6: thestral2.admin.ReloadRulesResponse
+	(*SetUpstreamEnabledRequest)(nil),  // 7: thestral2.admin.SetUpstreamEnabledRequest
+	(*SetUpstreamEnabledResponse)(nil), // 8: thestral2.admin.SetUpstreamEnabledResponse
+	(*GetStatsRequest)(nil),            // 9: thestral2.admin.GetStatsRequest
+	(*GetStatsResponse)(nil),           // 10: thestral2.admin.GetStatsResponse
+}
+var file_admin_proto_depIdxs = []int32{
+	2,  // 0: thestral2.admin.ListTunnelsResponse.tunnels:type_name -> thestral2.admin.Tunnel
+	0,  // 1: thestral2.admin.Admin.ListTunnels:input_type -> thestral2.admin.ListTunnelsRequest
+	3,  // 2: thestral2.admin.Admin.CloseTunnel:input_type -> thestral2.admin.CloseTunnelRequest
+	5,  // 3: thestral2.admin.Admin.ReloadRules:input_type -> thestral2.admin.ReloadRulesRequest
+	7,  // 4: thestral2.admin.Admin.SetUpstreamEnabled:input_type -> thestral2.admin.SetUpstreamEnabledRequest
+	9,  // 5: thestral2.admin.Admin.GetStats:input_type -> thestral2.admin.GetStatsRequest
+	1,  // 6: thestral2.admin.Admin.ListTunnels:output_type -> thestral2.admin.ListTunnelsResponse
+	4,  // 7: thestral2.admin.Admin.CloseTunnel:output_type -> thestral2.admin.CloseTunnelResponse
+	6,  // 8: thestral2.admin.Admin.ReloadRules:output_type -> thestral2.admin.ReloadRulesResponse
+	8,  // 9: thestral2.admin.Admin.SetUpstreamEnabled:output_type -> thestral2.admin.SetUpstreamEnabledResponse
+	10, // 10: thestral2.admin.Admin.GetStats:output_type -> thestral2.admin.GetStatsResponse
+	6,  // [6:11] is the sub-list for method output_type
+	1,  // [1:6] is the sub-list for method input_type
+	1,  // [1:1] is the sub-list for extension type_name
+	1,  // [1:1] is the sub-list for extension extendee
+	0,  // [0:1] is the sub-list for field type_name
+}
+
+func init() { file_admin_proto_init() }
+func file_admin_proto_init() {
+	if File_admin_proto != nil {
+		return
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: unsafe.Slice(unsafe.StringData(file_admin_proto_rawDesc), len(file_admin_proto_rawDesc)),
+			NumEnums:      0,
+			NumMessages:   11,
+			NumExtensions: 0,
+			NumServices:   1,
+		},
+		GoTypes:           file_admin_proto_goTypes,
+		DependencyIndexes: file_admin_proto_depIdxs,
+		MessageInfos:      file_admin_proto_msgTypes,
+	}.Build()
+	File_admin_proto = out.File
+	file_admin_proto_goTypes = nil
+	file_admin_proto_depIdxs = nil
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+
+	"github.com/pkg/errors"
+	"github.com/richardtsai/thestral2/admin"
+	. "github.com/richardtsai/thestral2/lib"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/status"
+)
+
+// newAdminTransport creates the transport the gRPC admin API listens with.
+func newAdminTransport(config AdminGRPCConfig) (Transport, error) {
+	if config.Address == "" {
+		return nil, errors.New("'address' is required for 'admin_grpc'")
+	} else if config.TLS == nil {
+		return TCPTransport{}, nil
+	}
+	tlsConfig := *config.TLS
+	if len(tlsConfig.ALPN) == 0 {
+		tlsConfig.ALPN = []string{"h2"} // required by gRPC clients
+	}
+	transport, err := NewTLSTransport(tlsConfig, TCPTransport{})
+	if err != nil {
+		return nil, errors.WithMessage(err, "invalid tls config of admin_grpc")
+	}
+	return transport, nil
+}
+
+// newAdminGRPCServer creates the gRPC server of the admin API, with the
+// reflection service enabled for debugging. Every call (including the streams
+// of the reflection service) requires the token as a bearer token if it's set.
+func (t *Thestral) newAdminGRPCServer(token string) *grpc.Server {
+	var opts []grpc.ServerOption
+	if token != "" {
+		opts = append(opts,
+			grpc.UnaryInterceptor(adminAuthInterceptor(token)),
+			grpc.StreamInterceptor(adminStreamAuthInterceptor(token)))
+	}
+	svr := grpc.NewServer(opts...)
+	admin.RegisterAdminServer(svr, &adminServer{app: t})
+	reflection.Register(svr)
+	return svr
+}
+
+func adminAuthInterceptor(token string) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{},
+		info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (
+		interface{}, error) {
+		if err := checkAdminToken(ctx, token); err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+func adminStreamAuthInterceptor(token string) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream,
+		info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if err := checkAdminToken(ss.Context(), token); err != nil {
+			return err
+		}
+		return handler(srv, ss)
+	}
+}
+
+// checkAdminToken checks the bearer token in the metadata of a call.
+func checkAdminToken(ctx context.Context, token string) error {
+	expected := []byte("Bearer " + token)
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, auth := range md.Get("authorization") {
+		if subtle.ConstantTimeCompare([]byte(auth), expected) == 1 {
+			return nil
+		}
+	}
+	return status.Error(codes.Unauthenticated, "invalid token")
+}
+
+// adminServer implements the admin API by the same methods of the app and its
+// monitor as the HTTP monitor and the reloading on SIGHUP.
+type adminServer struct {
+	admin.UnimplementedAdminServer
+	app *Thestral
+}
+
+func (s *adminServer) ListTunnels(context.Context, *admin.ListTunnelsRequest) (
+	*admin.ListTunnelsResponse, error) {
+	resp := &admin.ListTunnelsResponse{}
+	for _, r := range s.app.monitor.TunnelReports() {
+		tunnel := &admin.Tunnel{
+			RequestId:              r.RequestID,
+			Rule:                   r.Rule,
+			EstablishedSinceUnixMs: r.EstablishedSince.UnixNano() / 1e6,
+			ElapsedTimeSecs:        r.ElapsedTimeSecs,
+			Downstream:             r.Downstream,
+			ClientAddr:             r.ClientAddr,
+			TargetAddr:             r.TargetAddr,
+			Upstream:               r.Upstream,
+			BoundAddr:              r.BoundAddr,
+			ConnLatencyMs:          r.ConnLatencyMs,
+			UploadSpeed:            r.UploadSpeed,
+			DownloadSpeed:          r.DownloadSpeed,
+			BytesUploaded:          r.BytesUploaded,
+			BytesDownloaded:        r.BytesDownloaded,
+			Tags:                   r.Tags,
+			ResolveLatencyMs:       r.ResolveLatencyMs,
+			DialLatencyMs:          r.DialLatencyMs,
+			HandshakeLatencyMs:     r.HandshakeLatencyMs,
+		}
+		for _, id := range r.ClientIDs {
+			tunnel.ClientIds = append(
+				tunnel.ClientIds, id.Scope+"/"+id.UniqueID)
+		}
+		resp.Tunnels = append(resp.Tunnels, tunnel)
+	}
+	return resp, nil
+}
+
+func (s *adminServer) CloseTunnel(
+	_ context.Context, req *admin.CloseTunnelRequest) (
+	*admin.CloseTunnelResponse, error) {
+	if !s.app.monitor.CloseTunnel(req.RequestId) {
+		return nil, status.Errorf(
+			codes.NotFound, "tunnel %s not found", req.RequestId)
+	}
+	return &admin.CloseTunnelResponse{}, nil
+}
+
+func (s *adminServer) ReloadRules(context.Context, *admin.ReloadRulesRequest) (
+	*admin.ReloadRulesResponse, error) {
+	config, err := ParseConfigFile(s.app.configFile)
+	if err == nil {
+		err = s.app.ReloadRules(config.Rules)
+	}
+	if err != nil {
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	}
+	return &admin.ReloadRulesResponse{}, nil
+}
+
+func (s *adminServer) SetUpstreamEnabled(
+	_ context.Context, req *admin.SetUpstreamEnabledRequest) (
+	*admin.SetUpstreamEnabledResponse, error) {
+	r := s.app.getRouting()
+	if _, ok := r.upstreamConfigs[req.Upstream]; !ok &&
+		!r.disabled[req.Upstream] {
+		return nil, status.Errorf(
+			codes.NotFound, "upstream %s not found", req.Upstream)
+	}
+	err := s.app.SetUpstreamEnabled(req.Upstream, req.Enabled)
+	if err != nil {
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	}
+	return &admin.SetUpstreamEnabledResponse{}, nil
+}
+
+func (s *adminServer) GetStats(context.Context, *admin.GetStatsRequest) (
+	*admin.GetStatsResponse, error) {
+	report := s.app.monitor.Report()
+	reportJSON, err := json.Marshal(report)
+	if err != nil {
+		return nil, status.Error(codes.Internal, fmt.Sprintf(
+			"failed to generate monitor report: %s", err.Error()))
+	}
+	return &admin.GetStatsResponse{
+		ActiveTunnels:   uint32(len(report.Tunnels)),
+		ErrorCount:      report.ErrorCount,
+		UploadSpeed:     report.UploadSpeed,
+		DownloadSpeed:   report.DownloadSpeed,
+		BytesUploaded:   report.BytesUploaded,
+		BytesDownloaded: report.BytesDownloaded,
+		ReportJson:      string(reportJSON),
+	}, nil
+}
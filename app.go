@@ -3,8 +3,11 @@ package main
 import (
 	"context"
 	"io"
-	"math/rand"
+	"net"
+	"net/http"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/pkg/errors"
@@ -14,23 +17,64 @@ import (
 )
 
 const (
-	defaultConnectTimeout = time.Minute * 1
-	relayBufferSize       = 32 * 1024
+	defaultConnectTimeout  = time.Minute * 1
+	minConnectAttemptTime  = time.Second * 5
+	defaultRelayBufferSize = 32 * 1024
+	minRelayBufferSize     = 2 * 1024
+	maxRelayBufferSize     = 4 * 1024 * 1024
+	maxRelayWatermark      = 64 * 1024 * 1024
+	minBufPoolMaxSize      = 16
+	maxBufPoolMaxSize      = 4 * 1024 * 1024
+	relaySpliceChunkSize   = 64 * 1024 // bytes spliced between the reports
+	defaultMaxConns        = 64 * 1024 // of downstreams, to bound goroutines
+	defaultMaxRelayHops    = 8
 )
 
 // Thestral is the main thestral app.
 type Thestral struct {
 	log            *zap.SugaredLogger
+	accessLog      *zap.Logger // nil if disabled
+	config         Config      // the configuration being applied
 	downstreams    map[string]ProxyServer
-	upstreams      map[string]ProxyClient
-	upstreamNames  []string
-	ruleMatcher    *RuleMatcher
-	connectTimeout time.Duration
+	dsLimits       map[string]*ConnLimiter
+	dsQueues       map[string]*ConnLimiter // nil if requests are not queued
+	dsRateLimits   map[string]*ClientRateLimiter
+	dsBoundAddrs   map[string]Address
+	dsBoundTarget  map[string]bool // reporting the targets as bound addresses
+	routing        *routing        // protected by routingLock
+	routingLock    sync.RWMutex
+	routingChanged chan struct{}
+	reloadLock     sync.Mutex
+	geoIP          *GeoIPDB
+	geoIPReload    time.Duration // no periodic reload if 0
+	relayBufSize   uint
+	relayWatermark uint // synchronous relays if 0
+	maxRelayHops   int
+	halfClose      bool
+	metricsAddr    string
+	adminTransport Transport     // nil if the admin API is not served
+	configFile     string        // see SetConfigFile
+	quota          *QuotaTracker // nil if no database
 	monitor        AppMonitor
+	rand           *LockedRand // for selecting upstreams
 }
 
 // NewThestralApp creates a Thestral app object from the given configuration.
-func NewThestralApp(config Config) (app *Thestral, err error) {
+func NewThestralApp(config Config) (*Thestral, error) {
+	return newThestralApp(config, false, NewLockedRand(time.Now().UnixNano()))
+}
+
+// ValidateConfig performs all the checks of NewThestralApp on the given
+// configuration, without touching the database, the log file or the monitor.
+func ValidateConfig(config Config) error {
+	_, err := newThestralApp(config, true, nil)
+	return err
+}
+
+// newThestralApp creates the app, whose upstreams are selected randomly with
+// rnd (the global source of math/rand if nil) by the random strategy.
+func newThestralApp(config Config, dryRun bool, rnd *LockedRand) (
+	app *Thestral, err error) {
 	if len(config.Downstreams) == 0 {
 		err = errors.New("no downstream server defined")
 	}
@@ -39,88 +83,215 @@ func NewThestralApp(config Config) (app *Thestral, err error) {
 	}
 
 	app = &Thestral{
-		downstreams: make(map[string]ProxyServer),
-		upstreams:   make(map[string]ProxyClient),
+		config:         config,
+		downstreams:    make(map[string]ProxyServer),
+		dsLimits:       make(map[string]*ConnLimiter),
+		dsQueues:       make(map[string]*ConnLimiter),
+		dsRateLimits:   make(map[string]*ClientRateLimiter),
+		dsBoundAddrs:   make(map[string]Address),
+		dsBoundTarget:  make(map[string]bool),
+		routingChanged: make(chan struct{}, 1),
+		rand:           rnd,
 	}
 
 	// create logger
 	if err == nil {
-		app.log, err = CreateLogger(config.Logging)
+		logConfig := config.Logging
+		if dryRun { // log to stderr only
+			logConfig.File = ""
+			logConfig.Syslog = nil
+		}
+		app.log, err = CreateLogger(logConfig)
 		if err != nil {
 			err = errors.WithMessage(err, "failed to create logger")
 		}
 	}
+	if err == nil && config.Logging.AccessLog != nil {
+		accessConfig := *config.Logging.AccessLog
+		if dryRun && accessConfig.File != "" { // log to stderr only
+			accessConfig.File = "stderr"
+		}
+		app.accessLog, err = CreateAccessLogger(accessConfig)
+		if err != nil {
+			err = errors.WithMessage(err, "failed to create access logger")
+		}
+	}
 
 	// init db
 	if err == nil && config.DB != nil {
-		err = db.InitDB(*config.DB)
+		if dryRun && db.Configured() {
+			// validated only, not to disturb the database in use, e.g. when
+			// validating a configuration to be reloaded
+			dbConfig := *config.DB
+			err = db.ValidateConfig(&dbConfig)
+		} else if dryRun { // without connecting, for the checks of users
+			err = db.SetConfig(*config.DB)
+		} else {
+			err = db.InitDB(*config.DB)
+		}
+	}
+	if err == nil && config.DB != nil {
+		var interval time.Duration
+		if config.Misc.QuotaFlushInterval != "" {
+			interval, err = time.ParseDuration(config.Misc.QuotaFlushInterval)
+			if err != nil {
+				err = errors.WithStack(err)
+			} else if interval <= 0 {
+				err = errors.New(
+					"'quota_flush_interval' should be greater than 0")
+			}
+		}
+		app.quota = NewQuotaTracker(app.log.Named("quota"), interval)
 	}
 
 	// create downstream servers
 	if err == nil {
 		dsLogger := app.log.Named("downstreams")
 		for k, v := range config.Downstreams {
+			if !v.IsEnabled() {
+				continue
+			}
 			app.downstreams[k], err = CreateProxyServer(dsLogger.Named(k), v)
 			if err != nil {
 				err = errors.WithMessage(
 					err, "failed to create downstream server: "+k)
 				break
 			}
-		}
-	}
-
-	// create upstream clients
-	if err == nil {
-		for k, v := range config.Upstreams {
-			app.upstreams[k], err = CreateProxyClient(v)
+			if v.MaxConns < 0 {
+				err = errors.Errorf("negative max_conns of downstream: %s", k)
+				break
+			} else if v.MaxConns > 0 {
+				app.dsLimits[k] = NewConnLimiter(v.MaxConns)
+			} else {
+				app.dsLimits[k] = NewConnLimiter(defaultMaxConns)
+			}
+			if v.MaxQueued < 0 {
+				err = errors.Errorf("negative max_queued of downstream: %s", k)
+				break
+			} else if v.MaxQueued > 0 {
+				app.dsQueues[k] = NewConnLimiter(v.MaxQueued)
+			}
+			if v.RateLimit != nil {
+				app.dsRateLimits[k], err = NewClientRateLimiter(*v.RateLimit)
+				if err != nil {
+					err = errors.WithMessage(
+						err, "invalid rate_limit of downstream: "+k)
+					break
+				}
+			}
+			switch v.BoundAddr {
+			case "", boundAddrUpstream:
+			case boundAddrTarget:
+				app.dsBoundTarget[k] = true
+			default:
+				app.dsBoundAddrs[k], err = ParseAddress(v.BoundAddr)
+				if err != nil {
+					err = errors.WithMessage(
+						err, "invalid bound_addr of downstream: "+k)
+				}
+			}
 			if err != nil {
-				err = errors.WithMessage(
-					err, "failed to create upstream client: "+k)
 				break
 			}
-			app.upstreamNames = append(app.upstreamNames, k)
+		}
+		if err == nil && len(app.downstreams) == 0 {
+			err = errors.New("no downstream server enabled")
 		}
 	}
 
-	// create rule matcher
-	if err == nil {
-		app.ruleMatcher, err = NewRuleMatcher(config.Rules)
-		if err != nil {
-			err = errors.WithMessage(err, "failed to create rule matcher")
+	// open GeoIP database
+	if err == nil && config.GeoIP != nil {
+		if config.GeoIP.ReloadInterval != "" {
+			app.geoIPReload, err = time.ParseDuration(
+				config.GeoIP.ReloadInterval)
+			if err != nil {
+				err = errors.WithStack(err)
+			} else if app.geoIPReload <= 0 {
+				err = errors.New("'reload_interval' should be greater than 0")
+			}
 		}
-	}
-	if err == nil {
-		for _, ruleUpstream := range app.ruleMatcher.AllUpstreams {
-			if _, ok := app.upstreams[ruleUpstream]; !ok {
-				err = errors.Errorf(
-					"undefined upstream '%s' used in the rule set",
-					ruleUpstream)
+		if err == nil {
+			var geoErr error
+			app.geoIP, geoErr = OpenGeoIPDB(config.GeoIP.Database)
+			if geoErr != nil {
+				app.log.Warnw(
+					"GeoIP database unavailable, country rules are skipped",
+					"error", geoErr)
 			}
 		}
 	}
 
+	// create upstream clients and rule matcher
+	if err == nil {
+		app.routing, err = app.newRouting(config)
+	}
+
 	// parse other settings
 	if err == nil {
-		if config.Misc.ConnectTimeout != "" {
-			app.connectTimeout, err = time.ParseDuration(
-				config.Misc.ConnectTimeout)
-			if err != nil {
-				err = errors.WithStack(err)
+		app.relayBufSize = defaultRelayBufferSize
+		if config.Misc.RelayBufferSize != "" {
+			var size uint64
+			size, err = ParseByteSize(config.Misc.RelayBufferSize)
+			if err == nil && (size < minRelayBufferSize ||
+				size > maxRelayBufferSize) {
+				err = errors.New(
+					"'relay_buffer_size' should be within [2KB, 4MB]")
 			}
-			if err == nil && app.connectTimeout <= 0 {
-				err = errors.New("'connect_timeout' should be greater than 0")
-			}
-		} else {
-			app.connectTimeout = defaultConnectTimeout
+			app.relayBufSize = uint(size)
 		}
 	}
-	if err == nil && config.Misc.EnableMonitor {
-		app.monitor.Start(config.Misc.MonitorPath)
+	if err == nil && config.Misc.RelayWatermark != "" {
+		var size uint64
+		size, err = ParseByteSize(config.Misc.RelayWatermark)
+		if err == nil && size > maxRelayWatermark {
+			err = errors.New("'relay_watermark' should be within [0, 64MB]")
+		}
+		app.relayWatermark = uint(size)
+	}
+	if err == nil && config.Misc.BufPoolMaxSize != "" {
+		var size uint64
+		size, err = ParseByteSize(config.Misc.BufPoolMaxSize)
+		if err == nil && (size < minBufPoolMaxSize ||
+			size > maxBufPoolMaxSize) {
+			err = errors.New("'buf_pool_max_size' should be within [16B, 4MB]")
+		}
+		if err == nil && !dryRun {
+			GlobalBufPool.SetMaxSize(uint(size))
+		}
+	}
+	app.maxRelayHops = defaultMaxRelayHops
+	if err == nil && config.Misc.MaxRelayHops < 0 {
+		err = errors.New("'max_relay_hops' should not be negative")
+	} else if config.Misc.MaxRelayHops > 0 {
+		app.maxRelayHops = config.Misc.MaxRelayHops
+	}
+	app.halfClose = config.Misc.HalfClose
+	app.metricsAddr = config.Misc.MetricsAddr
+	if err == nil && config.Misc.AdminGRPC != nil {
+		app.adminTransport, err = newAdminTransport(*config.Misc.AdminGRPC)
+	}
+	if err == nil && config.Misc.MonitorAuth != nil {
+		err = app.monitor.SetAuth(*config.Misc.MonitorAuth)
+	} else if err == nil && !dryRun && (config.Misc.MetricsAddr != "" ||
+		config.Misc.EnableMonitor &&
+			!strings.HasPrefix(config.Misc.MonitorPath, "unix:")) {
+		// the Unix domain socket is accessible to the owner only
+		app.log.Warnw("the monitor is served without authentication, " +
+			"see monitor_auth")
+	}
+	if err == nil && config.Misc.EnableMonitor && !dryRun {
+		err = app.monitor.Start(config.Misc.MonitorPath)
 	}
 
 	return
 }
 
+// SetConfigFile sets the configuration file the rules are reloaded from via
+// the admin API.
+func (t *Thestral) SetConfigFile(configFile string) {
+	t.configFile = configFile
+}
+
 // Run starts the thestral app and blocks until the context is canceled.
 func (t *Thestral) Run(ctx context.Context) error {
 	var wg sync.WaitGroup
@@ -145,159 +316,878 @@ func (t *Thestral) Run(ctx context.Context) error {
 		}(reqCh, dsName, server)
 	}
 
+	if t.metricsAddr != "" {
+		listener, err := net.Listen("tcp", t.metricsAddr)
+		if err != nil {
+			t.log.Errorw("failed to start metrics server", "error", err)
+			return errors.WithStack(err)
+		}
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", t.monitor.MetricsHandler())
+		svr := &http.Server{Handler: mux}
+		go func() { _ = svr.Serve(listener) }()
+		go func() {
+			<-ctx.Done()
+			_ = svr.Close()
+		}()
+	}
+
+	if t.adminTransport != nil {
+		adminConfig := t.config.Misc.AdminGRPC
+		listener, err := t.adminTransport.Listen(adminConfig.Address)
+		if err != nil {
+			t.log.Errorw("failed to start admin gRPC server", "error", err)
+			return err
+		}
+		svr := t.newAdminGRPCServer(adminConfig.Token)
+		go func() { _ = svr.Serve(listener) }()
+		go func() {
+			<-ctx.Done()
+			svr.Stop()
+		}()
+	}
+
+	wg.Add(1)
+	go func() {
+		t.runHealthCheckers(ctx) // blocks
+		wg.Done()
+	}()
+
+	if t.quota != nil {
+		wg.Add(1)
+		go func() {
+			t.quota.Run(ctx) // blocks
+			wg.Done()
+		}()
+	}
+
+	if t.geoIP != nil && t.geoIPReload > 0 {
+		wg.Add(1)
+		go func() {
+			t.reloadGeoIPPeriodically(ctx) // blocks
+			wg.Done()
+		}()
+	}
+
 	t.log.Info("thestral app started")
 	wg.Wait()
+	// like on reloads, the upstream clients (e.g. their pools of connections)
+	// are closed once the tunnels via them are done
+	go t.closeStaleUpstreams(t.getRouting(), &routing{})
+	t.monitor.Stop()
 	return nil
 }
 
+func (t *Thestral) reloadGeoIPPeriodically(ctx context.Context) {
+	ticker := time.NewTicker(t.geoIPReload)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if reloaded, err := t.geoIP.Reload(); err != nil {
+				t.log.Warnw("failed to reload GeoIP database", "error", err)
+			} else if reloaded {
+				t.log.Info("GeoIP database reloaded")
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// processRequests processes the requests from a downstream. Requests beyond
+// the max_conns of the downstream wait in a queue of max_queued ones, and
+// those beyond the queue or the rate_limit are rejected.
 func (t *Thestral) processRequests(
 	ctx context.Context, dsName string, reqCh <-chan ProxyRequest) {
+	limiter := t.dsLimits[dsName]
+	queue := t.dsQueues[dsName]
+	rateLimiter := t.dsRateLimits[dsName]
 	for {
 		select {
 		case req := <-reqCh:
-			peerIDs, err := req.GetPeerIdentifiers()
-			if err != nil {
-				req.Logger().Warnw(
-					"failed to get peer identifiers", "error", err)
+			if !rateLimiter.Allow(req.PeerAddr()) {
+				req.Logger().Warnw("request rejected: connection rate exceeded",
+					"downstream", dsName, "clientAddr", req.PeerAddr())
+				req.Fail(&ProxyError{
+					Error:   errors.New("connection rate exceeded"),
+					ErrType: ProxyGeneralErr,
+				})
+				continue
+			}
+			if limiter.TryAcquire() {
+				go t.processAcquiredRequest(ctx, req, dsName, limiter)
+			} else if queue != nil && queue.TryAcquire() {
+				go func(req ProxyRequest) {
+					t.monitor.AddDownstreamQueued(dsName, 1)
+					acquired := t.waitInQueue(ctx, req, limiter)
+					queue.Release()
+					t.monitor.AddDownstreamQueued(dsName, -1)
+					if acquired {
+						t.processAcquiredRequest(ctx, req, dsName, limiter)
+					}
+				}(req)
+			} else {
+				req.Logger().Warnw("request rejected: too many connections",
+					"downstream", dsName, "clientAddr", req.PeerAddr())
+				req.Fail(&ProxyError{
+					Error:   errors.New("too many connections"),
+					ErrType: ProxyGeneralErr,
+				})
 			}
-			req.Logger().Infow("request accepted",
-				"downstream", dsName,
-				"clientAddr", req.PeerAddr(),
-				"target", req.TargetAddr(),
-				"userIDs", peerIDs)
-			go t.processOneRequest(ctx, req, dsName)
 		case <-ctx.Done():
 			return
 		}
 	}
 }
 
+// waitInQueue waits for a slot of the limiter for a queued request, for no
+// longer than the connect_timeout. The request fails if it gets no slot.
+func (t *Thestral) waitInQueue(
+	ctx context.Context, req ProxyRequest, limiter *ConnLimiter) bool {
+	waitCtx, cancelFunc := context.WithTimeout(
+		ctx, t.getRouting().connectTimeout)
+	defer cancelFunc()
+	if limiter.Acquire(waitCtx) {
+		return true
+	}
+	req.Logger().Warnw("request rejected: timed out in queue",
+		"clientAddr", req.PeerAddr())
+	req.Fail(&ProxyError{
+		Error:   errors.New("too many connections"),
+		ErrType: ProxyGeneralErr,
+	})
+	return false
+}
+
+// processAcquiredRequest processes a request which has acquired a slot of the
+// limiter, and releases the slot at the end.
+func (t *Thestral) processAcquiredRequest(ctx context.Context,
+	req ProxyRequest, dsName string, limiter *ConnLimiter) {
+	t.monitor.IncRequests(dsName)
+	t.monitor.AddDownstreamConns(dsName, 1)
+	peerIDs, err := req.GetPeerIdentifiers()
+	if err != nil {
+		req.Logger().Warnw(
+			"failed to get peer identifiers", "error", err)
+	}
+	req.Logger().Infow("request accepted",
+		"downstream", dsName,
+		"clientAddr", req.PeerAddr(),
+		"target", req.TargetAddr(),
+		"userIDs", peerIDs)
+	hops := RelayHopsOf(peerIDs)
+	if err = CheckRelayHops(hops, t.maxRelayHops); err != nil {
+		req.Logger().Errorw("request rejected: relayed in a loop",
+			"hops", hops, "error", err)
+		req.Fail(&ProxyError{Error: err, ErrType: ProxyRelayLoop})
+	} else {
+		// passed on by the upstreams sending PROXY protocol headers
+		t.processOneRequest(WithRelayHops(ctx, hops), req, dsName) // block
+	}
+	limiter.Release()
+	t.monitor.AddDownstreamConns(dsName, -1)
+}
+
 func (t *Thestral) processOneRequest(
 	ctx context.Context, req ProxyRequest, dsName string) {
 	// match against rule set
 	ruleName := ""
 	var upstreams []string
-	switch addr := req.TargetAddr().(type) {
+	r := t.acquireRouting()
+	defer r.inUse.Done()
+	ruleMatcher := r.ruleMatcher
+	target := req.TargetAddr()
+	switch addr := target.(type) {
 	case *TCP4Addr:
-		ruleName, upstreams = t.ruleMatcher.MatchIP(addr.IP)
+		ruleName, upstreams = ruleMatcher.MatchIP(addr.IP)
 	case *TCP6Addr:
-		ruleName, upstreams = t.ruleMatcher.MatchIP(addr.IP)
+		ruleName, upstreams = ruleMatcher.MatchIP(addr.IP)
 	case *DomainNameAddr:
-		ruleName, upstreams = t.ruleMatcher.MatchDomain(addr.DomainName)
+		resolveCtx, cancelFunc := context.WithTimeout(ctx, r.connectTimeout)
+		var ip net.IP
+		ruleName, upstreams, ip = ruleMatcher.MatchResolvedDomain(
+			resolveCtx, addr.DomainName)
+		cancelFunc()
+		if ip != nil && r.dnsConfig != nil && r.dnsConfig.DialByIP {
+			target, _ = FromNetAddr(&net.TCPAddr{IP: ip, Port: int(addr.Port)})
+			req.Logger().Debugw("domain resolved locally",
+				"domain", addr.DomainName, "ip", ip)
+		}
 	default:
 		req.Logger().Errorw("unknown target address", "addr", addr)
 		req.Fail(&ProxyError{Error: nil, ErrType: ProxyAddrUnsupported})
 		return
 	}
 
-	// select an upstream
-	if ruleName == "" { // unmatch and no default rule, allow all
-		upstreams = t.upstreamNames
-	} else if len(upstreams) == 0 { // no upstream, reject
+	// find candidate upstreams
+	if dsDefaults, ok := r.dsDefaults[dsName]; ok &&
+		(ruleName == "" || ruleName == DefaultRuleName) {
+		// unmatched, overriding the global default
+		upstreams = dsDefaults
+	} else if ruleName == "" { // unmatch and no default rule, allow all
+		upstreams = r.upstreamNames
+	} else if ruleMatcher.Denies(ruleName) {
+		req.Logger().Infow("request blocked by policy",
+			"rule", ruleName, "addr", req.TargetAddr())
+		req.Fail(&ProxyError{Error: nil, ErrType: ProxyBlocked})
+		return
+	} else if len(upstreams) == 0 { // no upstream, reject (deprecated)
 		req.Logger().Errorw(
-			"request rejected by rule",
+			"request rejected by rule without upstreams",
 			"rule", ruleName, "addr", req.TargetAddr())
-		req.Fail(&ProxyError{Error: nil, ErrType: ProxyNotAllowed})
+		req.Fail(&ProxyError{Error: nil, ErrType: ProxyBlocked})
+		return
+	}
+
+	// restrict to the upstreams allowed for the client
+	if len(r.scopeUpstreams) > 0 {
+		peerIDs, err := req.GetPeerIdentifiers()
+		if err == nil {
+			upstreams = r.allowedUpstreams(peerIDs, upstreams)
+		} else { // the scopes are unknown
+			upstreams = nil
+		}
+		if len(upstreams) == 0 {
+			req.Logger().Warnw("request rejected: no upstream allowed",
+				"rule", ruleName, "userIDs", peerIDs, "error", err)
+			req.Fail(&ProxyError{Error: nil, ErrType: ProxyNotAllowed})
+			return
+		}
+	}
+
+	// restrict to the healthy upstreams
+	upstreams, policy := r.healthyUpstreams(req, ruleName, upstreams)
+	if policy != "" {
+		req.Logger().Warnw("all upstreams unhealthy", "rule", ruleName,
+			"policy", policy, "upstreams", upstreams)
+	}
+	if len(upstreams) == 0 {
+		req.Fail(&ProxyError{
+			Error:   errors.New("all upstreams are unhealthy"),
+			ErrType: ProxyNotAllowed,
+		})
+		return
+	}
+
+	// check traffic quota
+	quotaUser, ok := t.checkQuota(req)
+	if !ok {
+		req.Fail(&ProxyError{Error: nil, ErrType: ProxyQuotaExceeded})
 		return
 	}
-	//TODO: the selection is not actually uniform, fix it
-	selected := upstreams[rand.Intn(len(upstreams))]
-	req.Logger().Debugw(
-		"upstream selected",
-		"rule", ruleName, "upstream", selected, "addr", req.TargetAddr())
-	upstream := t.upstreams[selected]
 
 	// make request
-	reqCtx, cancelFunc := context.WithTimeout(ctx, t.connectTimeout)
+	var timings ConnTimings
+	reqCtx, cancelFunc := context.WithTimeout(WithConnTimings(
+		WithClientAddr(ctx, req.PeerAddr()), &timings),
+		r.connectTimeoutOf(ruleName))
 	defer cancelFunc()
 	startTime := time.Now()
-	upConn, boundAddr, pErr := upstream.Request(reqCtx, req.TargetAddr())
+	bindReq, isBind := req.(BindRequest)
+	var selected string
+	var upConn io.ReadWriteCloser
+	var boundAddr Address
+	var pErr *ProxyError
+	if isBind {
+		selected, upConn, boundAddr, pErr = t.bindUpstream(
+			reqCtx, r, bindReq, target, ruleName, upstreams)
+	} else {
+		selected, upConn, boundAddr, pErr = t.connectUpstream(
+			reqCtx, r, req, target, ruleName, upstreams)
+	}
 	if pErr != nil {
-		req.Logger().Errorw(
-			"connection failed", "addr", req.TargetAddr(),
-			"error", pErr.Error, "errType", pErr.ErrType, "upstream", selected)
 		req.Fail(pErr)
-		t.monitor.AddError(selected)
 		return
 	}
+	defer t.releaseUpstream(r, selected)
 	connLatency := time.Since(startTime)
 
 	var peerIDs []*PeerIdentifier
 	if wpi, ok := upConn.(WithPeerIdentifiers); ok {
 		peerIDs, _ = wpi.GetPeerIdentifiers()
 	}
+	tags := ruleMatcher.Tags(ruleName)
 	req.Logger().Infow(
 		"connection established",
 		"addr", req.TargetAddr(), "boundAddr", boundAddr, "upstream", selected,
-		"serverIDs", peerIDs)
-	downRWC := req.Success(boundAddr)
+		"serverIDs", peerIDs, "tags", tags, "latency", connLatency,
+		"resolveLatency", timings.Resolve, "dialLatency", timings.Dial,
+		"handshakeLatency", timings.Handshake,
+		"resolvePath", r.resolvePathOf(selected, target),
+		"compression", compressionMethodOf(upConn))
+	replyAddr := boundAddr // the peer of BIND, which is not overridden
+	if !isBind {
+		replyAddr = t.reportedBoundAddr(dsName, req, boundAddr)
+	}
+	downRWC := req.Success(replyAddr)
 	relayCtx, cancelFunc := context.WithCancel(ctx)
 	tunnelMonitor := t.monitor.OpenTunnelMonitor(
-		req, ruleName, dsName, selected, peerIDs, boundAddr.String(),
-		connLatency, cancelFunc)
-	t.doRelay(relayCtx, cancelFunc, tunnelMonitor, req, downRWC, upConn) // block
+		req, ruleName, tags, dsName, selected, peerIDs, boundAddr.String(),
+		connLatency, timings, cancelFunc)
+	t.doRelay(relayCtx, cancelFunc, r.idleTimeout, r.firstByteTimeout,
+		r.progressInterval, r.ioTimeouts, r.ruleMatcher.Bandwidth(ruleName),
+		tunnelMonitor, quotaUser, req, downRWC, upConn) // block
+}
+
+// checkQuota finds the database user of a request and checks whether the user
+// is still within the traffic quota. The user is nil if quotas do not apply.
+func (t *Thestral) checkQuota(req ProxyRequest) (*QuotaUser, bool) {
+	if t.quota == nil {
+		return nil, true
+	}
+	peerIDs, err := req.GetPeerIdentifiers()
+	if err != nil || len(peerIDs) == 0 {
+		return nil, true
+	}
+	user, err := t.quota.UserOf(peerIDs)
+	if err != nil {
+		req.Logger().Warnw("failed to look up user for quota", "error", err)
+		return nil, true
+	} else if user == nil {
+		return nil, true
+	}
+	over, err := t.quota.OverQuota(*user)
+	if err != nil {
+		req.Logger().Warnw("failed to check quota", "error", err)
+		return user, true
+	} else if over {
+		req.Logger().Warnw("request rejected: traffic quota exceeded",
+			"scope", user.Scope, "user", user.Name)
+		return user, false
+	}
+	return user, true
+}
+
+// stickyKeyOf returns the host of the client or the target of the request as
+// the key for the sticky selector.
+func stickyKeyOf(r *routing, req ProxyRequest) string {
+	var addr string
+	switch r.stickyKey {
+	case "client":
+		addr = req.PeerAddr()
+	case "target":
+		addr = req.TargetAddr().String()
+	default:
+		return ""
+	}
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+// connectUpstream tries the given upstreams in the order of selection to
+// connect to the target, which may be the resolved one of the request, until
+// one of them succeeds, or all of them fail, or the context is done. Busy
+// upstreams are skipped, unless all of the remaining ones are busy. On
+// failure, the error of the last attempt is returned, unless it is a general
+// error and a more specific one has been seen.
+//
+// The selected upstream must be released after use.
+func (t *Thestral) connectUpstream(
+	ctx context.Context, r *routing, req ProxyRequest, target Address,
+	ruleName string, upstreams []string) (selected string,
+	upConn io.ReadWriteCloser, boundAddr Address, pErr *ProxyError) {
+	// fast path for the common case of a single upstream without a limit,
+	// e.g. the direct one, which needs neither selection nor failover
+	if len(upstreams) == 1 && r.upstreamLimits[upstreams[0]] == nil {
+		selected = upstreams[0]
+		t.monitor.AddUpstreamConns(selected, 1)
+		req.Logger().Debugw(
+			"upstream selected",
+			"rule", ruleName, "upstream", selected, "addr", target)
+		attemptCtx, cancelAttempt := r.attemptContext(ctx, 1)
+		defer cancelAttempt()
+		upConn, boundAddr, pErr = r.upstreams[selected].Request(
+			attemptCtx, target)
+		if pErr != nil {
+			t.releaseUpstream(r, selected)
+			req.Logger().Errorw(
+				"connection failed", "addr", target, "error", pErr.Error,
+				"errType", pErr.ErrType, "upstream", selected)
+			t.monitor.AddError(selected)
+		} else {
+			t.monitor.AddSuccess(selected)
+		}
+		return
+	}
+
+	key := stickyKeyOf(r, req)
+	candidates := append([]string{}, upstreams...)
+	var busy []string
+	for {
+		if len(candidates) > 0 {
+			selected = r.selector.Select(ruleName, key, candidates)
+			candidates = removeUpstream(candidates, selected)
+			if !r.upstreamLimits[selected].TryAcquire() {
+				busy = append(busy, selected)
+				continue
+			}
+		} else if len(busy) > 0 { // wait for one of the busy upstreams
+			selected = r.selector.Select(ruleName, key, busy)
+			busy = removeUpstream(busy, selected)
+			if !r.upstreamLimits[selected].Acquire(ctx) {
+				if pErr == nil {
+					pErr = &ProxyError{
+						Error:   errors.New("all upstreams are busy"),
+						ErrType: ProxyUpstreamBusy,
+					}
+				}
+				break
+			}
+		} else {
+			break
+		}
+		t.monitor.AddUpstreamConns(selected, 1)
+
+		req.Logger().Debugw(
+			"upstream selected",
+			"rule", ruleName, "upstream", selected, "addr", target)
+		attemptCtx, cancelAttempt := r.attemptContext(
+			ctx, 1+len(candidates)+len(busy))
+		var err *ProxyError
+		upConn, boundAddr, err = r.upstreams[selected].Request(
+			attemptCtx, target)
+		cancelAttempt()
+		if err == nil {
+			t.monitor.AddSuccess(selected)
+			return selected, upConn, boundAddr, nil
+		}
+
+		t.releaseUpstream(r, selected)
+		req.Logger().Errorw(
+			"connection failed", "addr", target,
+			"error", err.Error, "errType", err.ErrType, "upstream", selected)
+		t.monitor.AddError(selected)
+		// a general error is less informative than a more specific one
+		if pErr == nil || err.ErrType != ProxyGeneralErr {
+			pErr = err
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return
+}
+
+// bindUpstream waits for a connection from the target of a BIND request via
+// one of the upstreams capable of it (see ProxyBinder), which is selected as
+// usual but without failover, since the address listened on is told to the
+// client at once. The waiting is bounded by the context. The address of the
+// peer is returned in place of the bound one.
+//
+// The selected upstream must be released after use.
+func (t *Thestral) bindUpstream(
+	ctx context.Context, r *routing, req BindRequest, target Address,
+	ruleName string, upstreams []string) (selected string,
+	upConn io.ReadWriteCloser, peerAddr Address, pErr *ProxyError) {
+	var binders []string
+	for _, upstream := range upstreams {
+		if _, ok := r.upstreams[upstream].(ProxyBinder); ok {
+			binders = append(binders, upstream)
+		}
+	}
+	if len(binders) == 0 {
+		req.Logger().Warnw("BIND rejected: unsupported by the upstreams",
+			"rule", ruleName, "upstreams", upstreams)
+		return "", nil, nil, &ProxyError{
+			Error:   errors.New("no upstream supports BIND"),
+			ErrType: ProxyCmdUnsupported,
+		}
+	}
+	selected = r.selector.Select(ruleName, stickyKeyOf(r, req), binders)
+	if !r.upstreamLimits[selected].Acquire(ctx) {
+		return "", nil, nil, &ProxyError{
+			Error:   errors.New("upstream is busy"),
+			ErrType: ProxyUpstreamBusy,
+		}
+	}
+	t.monitor.AddUpstreamConns(selected, 1)
+	req.Logger().Debugw("upstream selected for BIND",
+		"rule", ruleName, "upstream", selected, "addr", target)
+
+	boundAddr, accept, pErr := r.upstreams[selected].(ProxyBinder).Bind(
+		ctx, target)
+	if pErr == nil {
+		req.Logger().Debugw("listening for BIND", "boundAddr", boundAddr)
+		if err := req.Bound(boundAddr); err != nil {
+			pErr = &ProxyError{Error: err, ErrType: ProxyGeneralErr}
+		} else {
+			upConn, peerAddr, pErr = accept()
+		}
+	}
+	if pErr != nil {
+		t.releaseUpstream(r, selected)
+		req.Logger().Errorw(
+			"BIND failed", "addr", target, "error", pErr.Error,
+			"errType", pErr.ErrType, "upstream", selected)
+		t.monitor.AddError(selected)
+		return selected, nil, nil, pErr
+	}
+	t.monitor.AddSuccess(selected)
+	return
+}
+
+// connectTimeoutOf returns the timeout of connecting the requests matching the
+// given rule, which is the connect_timeout of the rule if set.
+func (r *routing) connectTimeoutOf(rule string) time.Duration {
+	if timeout := r.ruleMatcher.ConnectTimeout(rule); timeout > 0 {
+		return timeout
+	}
+	return r.connectTimeout
+}
+
+// attemptContext derives the context of a connection attempt from that of
+// all the attempts, so that the remaining time is shared by the remaining
+// attempts, but each of them gets at least minConnectAttemptTime (unless
+// there's not that much time left) and at most the connect_attempt_timeout.
+func (r *routing) attemptContext(ctx context.Context, attemptsLeft int) (
+	context.Context, context.CancelFunc) {
+	timeout := r.attemptTimeout
+	if deadline, ok := ctx.Deadline(); ok {
+		share := time.Until(deadline) / time.Duration(attemptsLeft)
+		if share < minConnectAttemptTime {
+			share = minConnectAttemptTime // bounded by the deadline anyway
+		}
+		if timeout == 0 || share < timeout {
+			timeout = share
+		}
+	}
+	if timeout == 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+func (t *Thestral) releaseUpstream(r *routing, upstream string) {
+	r.upstreamLimits[upstream].Release()
+	t.monitor.AddUpstreamConns(upstream, -1)
+}
+
+func removeUpstream(upstreams []string, upstream string) []string {
+	for i, u := range upstreams {
+		if u == upstream {
+			return append(upstreams[:i], upstreams[i+1:]...)
+		}
+	}
+	return upstreams
 }
 
 func (t *Thestral) doRelay(
 	relayCtx context.Context, cancelFunc context.CancelFunc,
-	tunnelMonitor *TunnelMonitor, req ProxyRequest,
+	idleTimeout, firstByteTimeout, progressInterval time.Duration,
+	ioTimeouts relayTimeouts, bandwidth uint64,
+	tunnelMonitor *TunnelMonitor, quotaUser *QuotaUser, req ProxyRequest,
 	downRWC io.ReadWriteCloser, upRWC io.ReadWriteCloser) {
 	defer tunnelMonitor.Close()
-	relay := func(dst, src io.ReadWriteCloser, srcName string,
-		reportBytesTransfered func(uint32)) {
-		defer cancelFunc()
+	sinkhole, sinkholed := upRWC.(*SinkholeConn)
+	if sinkholed {
+		tunnelMonitor.SetCloseReason(TunnelSinkholed)
+	}
+	// the timeouts need the bytes transferred to be reported timely
+	spliceable := idleTimeout == 0 && firstByteTimeout == 0 &&
+		ioTimeouts == relayTimeouts{}
+	var halfClosed int32 // directions ended with the other end half-closed
+	relay := func(dst io.Writer, src io.Reader, srcName string,
+		srcClosed TunnelCloseReason, reportBytesTransfered func(uint32)) {
 		var n int64
 		var err error
-		n, err = t.relayHalf(dst, src, reportBytesTransfered)
+		dstTCP, dstOK := dst.(*net.TCPConn)
+		srcTCP, srcOK := src.(*net.TCPConn)
+		if dstOK && srcOK && spliceable {
+			n, err = relaySpliced(dstTCP, srcTCP, reportBytesTransfered)
+		} else {
+			n, err = t.relayHalf(dst, src, ioTimeouts, reportBytesTransfered)
+		}
 		if err == nil { // src closed
+			tunnelMonitor.SetCloseReason(srcClosed)
 			req.Logger().Infow(
 				"connection closed", "src", srcName, "bytesTransferred", n)
+			if t.halfClose && closeWrite(dst) &&
+				atomic.AddInt32(&halfClosed, 1) < 2 {
+				// the other direction is still draining
+				return
+			}
 		} else if relayCtx.Err() == context.Canceled { // other direction closed
 			req.Logger().Infow(
 				"relay ended", "src", srcName, "bytesTransferred", n)
+		} else if _, ok := errors.Cause(err).(*relayTimeoutError); ok {
+			tunnelMonitor.SetCloseReason(TunnelIOTimeout)
+			req.Logger().Warnw(
+				"tunnel closed: I/O timeout",
+				"error", err, "src", srcName, "bytesTransferred", n)
+		} else if _, ok := errors.Cause(err).(*DecompressionError); ok {
+			tunnelMonitor.SetCloseReason(TunnelDecompressionError)
+			req.Logger().Warnw(
+				"failed to decompress data",
+				"error", err, "src", srcName, "bytesTransferred", n)
 		} else { // error
+			tunnelMonitor.SetCloseReason(TunnelError)
 			req.Logger().Warnw(
 				"error occurred",
 				"error", err, "src", srcName, "bytesTransferred", n)
 		}
+		cancelFunc()
+	}
+
+	reportUploaded := tunnelMonitor.IncBytesUploaded
+	reportDownloaded := tunnelMonitor.IncBytesDownloaded
+	if quotaUser != nil {
+		reportUploaded = func(n uint32) {
+			t.quota.AddUsage(*quotaUser, n)
+			tunnelMonitor.IncBytesUploaded(n)
+		}
+		reportDownloaded = func(n uint32) {
+			t.quota.AddUsage(*quotaUser, n)
+			tunnelMonitor.IncBytesDownloaded(n)
+		}
+	}
+	if idleTimeout > 0 {
+		lastActive := time.Now().UnixNano()
+		markActive := func() {
+			atomic.StoreInt64(&lastActive, time.Now().UnixNano())
+		}
+		upload, download := reportUploaded, reportDownloaded
+		reportUploaded = func(n uint32) {
+			markActive()
+			upload(n)
+		}
+		reportDownloaded = func(n uint32) {
+			markActive()
+			download(n)
+		}
+		go func() {
+			timer := time.NewTimer(idleTimeout)
+			defer timer.Stop()
+			for {
+				select {
+				case <-timer.C:
+				case <-relayCtx.Done():
+					return
+				}
+				idle := time.Since(
+					time.Unix(0, atomic.LoadInt64(&lastActive)))
+				if idle >= idleTimeout {
+					tunnelMonitor.SetCloseReason(TunnelIdleTimeout)
+					req.Logger().Infow(
+						"tunnel closed: idle timeout", "idleTime", idle)
+					cancelFunc()
+					return
+				}
+				timer.Reset(idleTimeout - idle)
+			}
+		}()
+	}
+	if firstByteTimeout > 0 {
+		var transferred int32
+		upload, download := reportUploaded, reportDownloaded
+		reportUploaded = func(n uint32) {
+			atomic.StoreInt32(&transferred, 1)
+			upload(n)
+		}
+		reportDownloaded = func(n uint32) {
+			atomic.StoreInt32(&transferred, 1)
+			download(n)
+		}
+		go func() {
+			timer := time.NewTimer(firstByteTimeout)
+			defer timer.Stop()
+			select {
+			case <-timer.C:
+			case <-relayCtx.Done():
+				return
+			}
+			if atomic.LoadInt32(&transferred) == 0 {
+				tunnelMonitor.SetCloseReason(TunnelFirstByteTimeout)
+				req.Logger().Infow("tunnel closed: first-byte timeout",
+					"firstByteTimeout", firstByteTimeout)
+				cancelFunc()
+			}
+		}()
+	}
+
+	if progressInterval > 0 {
+		go func() {
+			ticker := time.NewTicker(progressInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+				case <-relayCtx.Done():
+					return
+				}
+				up, down := tunnelMonitor.BytesTransferred()
+				req.Logger().Infow("tunnel progress",
+					"bytesUploaded", up, "bytesDownloaded", down)
+			}
+		}()
 	}
 
-	go relay(upRWC, downRWC, "downstream", tunnelMonitor.IncBytesUploaded)
-	go relay(downRWC, upRWC, "upstream", tunnelMonitor.IncBytesDownloaded)
+	var fromDown, fromUp io.Reader = downRWC, upRWC
+	if bandwidth > 0 {
+		fromDown = NewThrottledReader(relayCtx, downRWC, bandwidth)
+		fromUp = NewThrottledReader(relayCtx, upRWC, bandwidth)
+	}
+	go relay(upRWC, fromDown, "downstream", TunnelClientClosed,
+		reportUploaded)
+	go relay(downRWC, fromUp, "upstream", TunnelServerClosed,
+		reportDownloaded)
 
 	<-relayCtx.Done() // block until done/canceled
+	tunnelMonitor.SetCloseReason(TunnelCanceled)
 	if err := upRWC.Close(); err != nil {
 		req.Logger().Warnw(
 			"error occurred when closing upstream", "error", err)
 	}
+	if sinkholed && sinkhole.Resets() {
+		// an RST is sent on close without lingering
+		if l, ok := downRWC.(interface{ SetLinger(int) error }); ok {
+			_ = l.SetLinger(0)
+		}
+	}
 	if err := downRWC.Close(); err != nil {
 		req.Logger().Warnw(
 			"error occurred when closing downstream", "error", err)
 	}
+	t.logAccess(tunnelMonitor)
 }
 
+// closeWrite half-closes a connection (i.e. shutdown for writing), and tells
+// whether it's supported and succeeded.
+func closeWrite(w io.Writer) bool {
+	cw, ok := w.(interface{ CloseWrite() error })
+	return ok && cw.CloseWrite() == nil
+}
+
+// The special values of 'bound_addr' of downstreams, see ProxyConfig.
+const (
+	boundAddrUpstream = "upstream"
+	boundAddrTarget   = "target"
+)
+
+// compressionMethodOf returns the compression method negotiated by the
+// transport of a connection (see WithCompressionMethod), or an empty string
+// if it's not negotiated.
+func compressionMethodOf(conn io.ReadWriteCloser) string {
+	if wcm, ok := conn.(WithCompressionMethod); ok {
+		if method, err := wcm.CompressionMethod(); err == nil {
+			return method
+		}
+	}
+	return ""
+}
+
+// reportedBoundAddr returns the bound address to be reported to the client,
+// according to the 'bound_addr' of the downstream.
+func (t *Thestral) reportedBoundAddr(
+	dsName string, req ProxyRequest, boundAddr Address) Address {
+	if addr, ok := t.dsBoundAddrs[dsName]; ok {
+		return addr
+	} else if t.dsBoundTarget[dsName] {
+		return req.TargetAddr()
+	}
+	return boundAddr
+}
+
+// logAccess writes the access log record of a tunnel that has been closed.
+func (t *Thestral) logAccess(tunnelMonitor *TunnelMonitor) {
+	if t.accessLog == nil {
+		return
+	}
+	report := tunnelMonitor.Report()
+	t.accessLog.Info("",
+		zap.String("requestID", report.RequestID),
+		zap.String("clientAddr", report.ClientAddr),
+		zap.Any("userIDs", report.ClientIDs),
+		zap.String("target", report.TargetAddr),
+		zap.String("downstream", report.Downstream),
+		zap.String("rule", report.Rule),
+		zap.Strings("tags", report.Tags),
+		zap.String("upstream", report.Upstream),
+		zap.Uint64("bytesUploaded", report.BytesUploaded),
+		zap.Uint64("bytesDownloaded", report.BytesDownloaded),
+		zap.Float64("durationSecs", report.ElapsedTimeSecs),
+		zap.Float32("connLatencyMs", report.ConnLatencyMs),
+		zap.Float32("resolveLatencyMs", report.ResolveLatencyMs),
+		zap.Float32("dialLatencyMs", report.DialLatencyMs),
+		zap.Float32("handshakeLatencyMs", report.HandshakeLatencyMs),
+		zap.String("closeReason", string(report.CloseReason)),
+	)
+}
+
+// relaySpliced relays between two raw TCP connections, letting the kernel
+// move the data (by splice on Linux) without copying it into user space. The
+// bytes transferred are reported per relaySpliceChunkSize bytes, and at the
+// end of the relay.
+func relaySpliced(dst, src *net.TCPConn,
+	reportBytesTransfered func(uint32)) (n int64, err error) {
+	for {
+		var nw int64
+		nw, err = dst.ReadFrom(
+			&io.LimitedReader{R: src, N: relaySpliceChunkSize})
+		n += nw
+		if nw > 0 {
+			reportBytesTransfered(uint32(nw))
+		}
+		if err != nil || nw < relaySpliceChunkSize { // EOF or error occurred
+			break
+		}
+	}
+
+	err = errors.WithStack(err)
+	return
+}
+
+// relayTimeouts bounds each single read and write of a relay, if they are
+// non-zero and the source and the destination support deadlines.
+type relayTimeouts struct {
+	read, write time.Duration
+}
+
+// relayTimeoutError is returned by relayHalf if a single read or write
+// exceeds its timeout.
+type relayTimeoutError struct {
+	op  string // "read" or "write"
+	err error
+}
+
+func (e *relayTimeoutError) Error() string {
+	return e.op + " timed out: " + e.err.Error()
+}
+
+func isTimeoutError(err error) bool {
+	te, ok := errors.Cause(err).(interface{ Timeout() bool })
+	return ok && te.Timeout()
+}
+
+// relayHalf copies the data from src to dst until src ends (with a nil error)
+// or either of them fails. The bytes are reported once written. The reads are
+// decoupled from the writes by a buffer if relay_watermark is set (see
+// relayBuffered), otherwise each read waits for its data to be written.
 func (t *Thestral) relayHalf(
-	dst io.Writer, src io.Reader,
+	dst io.Writer, src io.Reader, timeouts relayTimeouts,
 	reportBytesTransfered func(uint32)) (n int64, err error) {
-	buf := GlobalBufPool.Get(relayBufferSize)
+	if t.relayWatermark > 0 {
+		return t.relayBuffered(dst, src, timeouts, reportBytesTransfered)
+	}
+	buf := GlobalBufPool.Get(t.relayBufSize)
 	defer GlobalBufPool.Free(buf)
+	rdDeadliner, wrDeadliner := relayDeadliners(dst, src, timeouts)
 	for {
-		var nr, nw int
-		if nr, err = src.Read(buf); err == nil { // data read from src
-			nw, err = dst.Write(buf[:nr])
-			n += int64(nw)
-			reportBytesTransfered(uint32(nw))
-			if err != nil { // write failed
-				break
-			}
-			if nw < nr {
-				err = io.ErrShortWrite
-				break
-			}
-		} else { // EOF or error occurred
-			if err == io.EOF { // ended
-				err = nil
-			}
+		var nr int
+		if rdDeadliner != nil {
+			_ = rdDeadliner.SetReadDeadline(time.Now().Add(timeouts.read))
+		}
+		if nr, err = src.Read(buf); err != nil { // EOF or error occurred
+			err = relayReadError(err, rdDeadliner != nil)
+			break
+		}
+		var nw int64
+		nw, err = relayWrite(dst, wrDeadliner, timeouts.write, buf[:nr],
+			reportBytesTransfered)
+		n += nw
+		if err != nil { // write failed
 			break
 		}
 	}
@@ -305,3 +1195,68 @@ func (t *Thestral) relayHalf(
 	err = errors.WithStack(err)
 	return
 }
+
+type readDeadliner interface {
+	SetReadDeadline(time.Time) error
+}
+
+type writeDeadliner interface {
+	SetWriteDeadline(time.Time) error
+}
+
+// relayDeadliners returns the deadline setters of the source and the
+// destination of a relay, or nil if they are unsupported or the timeout is 0.
+func relayDeadliners(dst io.Writer, src io.Reader, timeouts relayTimeouts) (
+	rdDeadliner readDeadliner, wrDeadliner writeDeadliner) {
+	if timeouts.read != 0 {
+		rdDeadliner, _ = src.(readDeadliner)
+	}
+	if timeouts.write != 0 {
+		wrDeadliner, _ = dst.(writeDeadliner)
+	}
+	return
+}
+
+// relayReadError converts the error of a read of a relay, which is nil if the
+// source has ended.
+func relayReadError(err error, hasDeadline bool) error {
+	if err == io.EOF { // ended
+		return nil
+	} else if hasDeadline && isTimeoutError(err) {
+		return &relayTimeoutError{"read", err}
+	}
+	return err
+}
+
+// relayWrite writes the data read by a relay. Short writes are retried with
+// the rest, as long as there's some progress.
+func relayWrite(dst io.Writer, wrDeadliner writeDeadliner,
+	timeout time.Duration, data []byte,
+	reportBytesTransfered func(uint32)) (n int64, err error) {
+	for written := 0; written < len(data) && err == nil; {
+		var nw int
+		if wrDeadliner != nil {
+			_ = wrDeadliner.SetWriteDeadline(time.Now().Add(timeout))
+		}
+		nw, err = dst.Write(data[written:])
+		if nw < 0 || nw > len(data)-written {
+			nw, err = 0, errors.New("invalid write result")
+		} else if nw == 0 && err == nil {
+			err = io.ErrShortWrite
+		}
+		written += nw
+		n += int64(nw)
+		if nw > 0 {
+			reportBytesTransfered(uint32(nw))
+		}
+	}
+	if wrDeadliner != nil {
+		// not to fail the writes of others to the destination, e.g. the
+		// keep-alive signals of KCP, while waiting for the source
+		_ = wrDeadliner.SetWriteDeadline(time.Time{})
+		if err != nil && isTimeoutError(err) {
+			err = &relayTimeoutError{"write", err}
+		}
+	}
+	return
+}
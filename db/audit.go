@@ -0,0 +1,75 @@
+package db
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
+)
+
+// nolint: golint
+const (
+	AuditAdd    = "add"
+	AuditDelete = "delete"
+	AuditUpdate = "update"
+	AuditRename = "rename"
+)
+
+// AuditEntry is a record of a mutation of the users made via UserDAO. It is
+// stored in the database as table `audit_entries`.
+type AuditEntry struct {
+	ID        uint      `gorm:"primary_key"`
+	CreatedAt time.Time `gorm:"index"`
+	Operator  string    // see UserDAO.SetOperator
+	Operation string    // one of the Audit* constants
+	Scope     string
+	Name      string
+	Detail    string // e.g. the new scope/name of a rename
+}
+
+// SetOperator sets the identity of who makes the mutations with the DAO,
+// e.g. the OS user running a tool, for the audit log.
+func (d *UserDAO) SetOperator(operator string) {
+	d.operator = operator
+}
+
+// mutate makes a mutation by f and records it in the audit log, in the same
+// transaction, which is retried on transient errors. The cached auth lookups
+// of the user are invalidated.
+func (d *UserDAO) mutate(entry AuditEntry, f func(tx *gorm.DB) error) error {
+	defer userAuthCache.invalidate(authKey{entry.Scope, entry.Name})
+	return withRetry(func() error { return d.mutateOnce(entry, f) })
+}
+
+func (d *UserDAO) mutateOnce(
+	entry AuditEntry, f func(tx *gorm.DB) error) error {
+	tx := d.db.Begin()
+	if tx.Error != nil {
+		return errors.Wrap(tx.Error, "failed to begin transaction")
+	}
+	if err := f(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	entry.Operator = d.operator
+	if err := tx.Create(&entry).Error; err != nil {
+		tx.Rollback()
+		return errors.Wrap(err, "failed to write audit log")
+	}
+	return errors.Wrap(tx.Commit().Error, "failed to commit transaction")
+}
+
+// ListAudit returns the latest entries of the audit log, the latest first. If
+// scope and name are given, only the entries of that user are returned.
+func (d *UserDAO) ListAudit(
+	scope, name string, limit int) ([]*AuditEntry, error) {
+	db := d.db
+	if scope != "" || name != "" {
+		db = db.Where("scope = ? AND name = ?", scope, name)
+	}
+	results := []*AuditEntry{}
+	err := withRetry(func() error {
+		return db.Order("id DESC").Limit(limit).Find(&results).Error
+	})
+	return results, errors.Wrap(err, "error occurred when querying db")
+}
@@ -0,0 +1,142 @@
+package db
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultAuthCacheTTL        = time.Second * 5
+	defaultAuthCacheMaxEntries = 4096
+)
+
+// AuthCacheStats is the statistics of the cache of the auth lookups.
+type AuthCacheStats struct {
+	Entries int
+	Hits    uint64
+	Misses  uint64
+}
+
+type authKey struct {
+	scope, name string
+}
+
+// authEntry holds what the auth lookups need only, rather than the users.
+type authEntry struct {
+	found     bool
+	id        uint
+	pwHash    []byte // nil if not set
+	tokenHash []byte // nil if not set
+	expiry    time.Time
+}
+
+// authCache caches the results of the auth lookups, which are made for each
+// connection of the proxies requiring authentication, for a short TTL. The
+// mutations made by the DAOs of this process invalidate the users affected
+// at once, while the ones made by other processes, e.g. the users tool, take
+// effect once the TTL expires.
+type authCache struct {
+	hits   uint64 // accessed atomically
+	misses uint64 // accessed atomically
+
+	lock    sync.Mutex
+	entries map[authKey]authEntry
+}
+
+var userAuthCache = &authCache{entries: make(map[authKey]authEntry)}
+
+// GetAuthCacheStats returns the statistics of the cache of the auth lookups.
+func GetAuthCacheStats() AuthCacheStats {
+	userAuthCache.lock.Lock()
+	entries := len(userAuthCache.entries)
+	userAuthCache.lock.Unlock()
+	return AuthCacheStats{
+		Entries: entries,
+		Hits:    atomic.LoadUint64(&userAuthCache.hits),
+		Misses:  atomic.LoadUint64(&userAuthCache.misses),
+	}
+}
+
+func (c *authCache) get(key authKey, now time.Time) (authEntry, bool) {
+	c.lock.Lock()
+	entry, ok := c.entries[key]
+	c.lock.Unlock()
+	if ok && now.Before(entry.expiry) {
+		atomic.AddUint64(&c.hits, 1)
+		return entry, true
+	}
+	atomic.AddUint64(&c.misses, 1)
+	return authEntry{}, false
+}
+
+// put caches an entry. If the cache is full, the expired entries are
+// removed, and then some arbitrary ones if it's still full.
+func (c *authCache) put(
+	key authKey, entry authEntry, now time.Time, maxEntries int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if len(c.entries) >= maxEntries {
+		for k, v := range c.entries {
+			if !now.Before(v.expiry) {
+				delete(c.entries, k)
+			}
+		}
+		for k := range c.entries {
+			if len(c.entries) < maxEntries {
+				break
+			}
+			delete(c.entries, k)
+		}
+	}
+	c.entries[key] = entry
+}
+
+func (c *authCache) invalidate(keys ...authKey) {
+	c.lock.Lock()
+	for _, key := range keys {
+		delete(c.entries, key)
+	}
+	c.lock.Unlock()
+}
+
+func (c *authCache) purge() {
+	c.lock.Lock()
+	c.entries = make(map[authKey]authEntry)
+	c.lock.Unlock()
+}
+
+// lookupAuth returns what the auth lookups need of a user, from the cache if
+// possible.
+func (d *UserDAO) lookupAuth(scope, name string) (authEntry, error) {
+	key, now := authKey{scope, name}, time.Now()
+	if dbConfig.authCacheTTL > 0 {
+		if entry, ok := userAuthCache.get(key, now); ok {
+			return entry, nil
+		}
+	}
+
+	u := User{}
+	query := retryQuery(func() *gorm.DB {
+		return d.db.Where("scope = ? AND name = ?", scope, name).First(&u)
+	})
+	if query.Error != nil && !query.RecordNotFound() {
+		return authEntry{}, errors.Wrap(
+			query.Error, "error occurred when querying db")
+	}
+	entry := authEntry{found: query.Error == nil, id: u.ID,
+		expiry: now.Add(dbConfig.authCacheTTL)}
+	if u.PWHash != nil {
+		entry.pwHash = *u.PWHash
+	}
+	if u.TokenHash != nil {
+		entry.tokenHash = *u.TokenHash
+	}
+	if dbConfig.authCacheTTL > 0 {
+		userAuthCache.put(key, entry, now, dbConfig.authCacheMaxEntries)
+	}
+	return entry, nil
+}
@@ -0,0 +1,66 @@
+package db
+
+import (
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+)
+
+// maxPasswordClasses is the number of character classes, which are lowercase
+// letters, uppercase letters, digits and the others.
+const maxPasswordClasses = 4
+
+// PasswordPolicy contains the requirements of the new passwords. An empty
+// password is not subject to it, as it means the user has no password.
+type PasswordPolicy struct {
+	MinLength  int `yaml:"min_length"`  // in characters
+	MinClasses int `yaml:"min_classes"` // see maxPasswordClasses
+}
+
+func (p PasswordPolicy) validate() error {
+	if p.MinLength < 0 {
+		return errors.New("'min_length' of 'password_policy' should be >= 0")
+	} else if p.MinClasses < 0 || p.MinClasses > maxPasswordClasses {
+		return errors.Errorf(
+			"'min_classes' of 'password_policy' should be within [0, %d]",
+			maxPasswordClasses)
+	}
+	return nil
+}
+
+// Check checks whether a password complies with the policy.
+func (p PasswordPolicy) Check(password string) error {
+	if utf8.RuneCountInString(password) < p.MinLength {
+		return errors.Errorf(
+			"password should have at least %d characters", p.MinLength)
+	}
+	var lower, upper, digit, other int
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			lower = 1
+		case unicode.IsUpper(r):
+			upper = 1
+		case unicode.IsDigit(r):
+			digit = 1
+		default:
+			other = 1
+		}
+	}
+	if lower+upper+digit+other < p.MinClasses {
+		return errors.Errorf("password should have at least %d of lowercase "+
+			"letters, uppercase letters, digits and other characters",
+			p.MinClasses)
+	}
+	return nil
+}
+
+// CheckNewPassword checks a password to be set against the policy of the
+// database configuration, if any.
+func CheckNewPassword(password string) error {
+	if dbConfig == nil || password == "" {
+		return nil
+	}
+	return dbConfig.PWPolicy.Check(password)
+}
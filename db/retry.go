@@ -0,0 +1,92 @@
+package db
+
+import (
+	"database/sql/driver"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultMaxRetries = 2
+	minRetryDelay     = time.Millisecond * 20
+)
+
+// messages of the transient errors of the drivers, which are matched instead
+// of the error types as the drivers are optional
+var transientErrorMessages = []string{
+	"database is locked",       // SQLITE_BUSY
+	"database table is locked", // SQLITE_LOCKED
+	"deadlock",                 // MySQL 1213, PostgreSQL 40P01
+	"lock wait timeout",        // MySQL 1205
+	"could not serialize",      // PostgreSQL 40001
+	"connection reset",
+	"broken pipe",
+	"bad connection",
+}
+
+func maxRetries() int {
+	if dbConfig == nil || dbConfig.MaxRetries == 0 {
+		return defaultMaxRetries
+	} else if dbConfig.MaxRetries < 0 {
+		return 0
+	}
+	return dbConfig.MaxRetries
+}
+
+// isTransientError tells whether an error (possibly wrapped) is a transient
+// one, e.g. the database is busy or the connection is broken, after which
+// the operation may succeed if retried.
+func isTransientError(err error) bool {
+	if err == nil {
+		return false
+	}
+	cause := errors.Cause(err)
+	if errs, ok := cause.(gorm.Errors); ok {
+		for _, e := range errs {
+			if isTransientError(e) {
+				return true
+			}
+		}
+		return false
+	}
+	if cause == driver.ErrBadConn {
+		return true
+	}
+	if ne, ok := cause.(net.Error); ok && (ne.Timeout() || ne.Temporary()) {
+		return true
+	}
+	msg := strings.ToLower(cause.Error())
+	for _, m := range transientErrorMessages {
+		if strings.Contains(msg, m) {
+			return true
+		}
+	}
+	return false
+}
+
+// withRetry calls f until it succeeds, fails with a non-transient error, or
+// runs out of retries, backing off between the attempts.
+func withRetry(f func() error) error {
+	delay := minRetryDelay
+	for retries := maxRetries(); ; retries-- {
+		err := f()
+		if retries <= 0 || !isTransientError(err) {
+			return err
+		}
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// retryQuery is withRetry for a query returning the DB with its result.
+func retryQuery(f func() *gorm.DB) (q *gorm.DB) {
+	_ = withRetry(func() error {
+		q = f()
+		return q.Error
+	})
+	return
+}
@@ -1,22 +1,102 @@
 package db
 
 import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"strings"
+	"time"
+
 	"github.com/jinzhu/gorm"
 	"github.com/pkg/errors"
 	"golang.org/x/crypto/bcrypt"
 )
 
-const pwhashCost = 10
+const defaultPWHashCost = 10
+
+// pwhashSchemes verify the password hashes of each scheme, dispatched by the
+// prefixes of the hashes. Only the first one is used to generate new hashes.
+var pwhashSchemes = []struct {
+	prefixes []string
+	verify   func(hash []byte, password string) bool
+}{
+	{[]string{"$2a$", "$2b$", "$2y$"}, verifyBcryptHash},
+}
+
+func pwhashCost() int {
+	if dbConfig != nil && dbConfig.PWHashCost != 0 {
+		return dbConfig.PWHashCost
+	}
+	return defaultPWHashCost
+}
 
 // HashUserPass returns the hash bytes of the password for password storage.
+// The hash is prefixed by the identifier of its scheme.
 func HashUserPass(password string) []byte {
-	result, err := bcrypt.GenerateFromPassword([]byte(password), pwhashCost)
+	result, err := bcrypt.GenerateFromPassword([]byte(password), pwhashCost())
 	if err != nil {
 		panic("failed to generate pwhash: " + err.Error())
 	}
 	return result
 }
 
+// VerifyPWHash checks a password against a hash generated by HashUserPass. It
+// also reports whether the hash should be regenerated with the current scheme
+// and settings.
+func VerifyPWHash(hash []byte, password string) (ok, outdated bool) {
+	idx := findPWHashScheme(hash)
+	if idx < 0 || !pwhashSchemes[idx].verify(hash, password) {
+		return false, false
+	}
+	return true, PWHashOutdated(hash)
+}
+
+// PWHashOutdated checks whether a hash should be regenerated with the current
+// scheme and settings.
+func PWHashOutdated(hash []byte) bool {
+	if findPWHashScheme(hash) != 0 {
+		return true
+	}
+	cost, err := bcrypt.Cost(hash)
+	return err != nil || cost != pwhashCost()
+}
+
+func findPWHashScheme(hash []byte) int {
+	for i, scheme := range pwhashSchemes {
+		for _, prefix := range scheme.prefixes {
+			if bytes.HasPrefix(hash, []byte(prefix)) {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+func verifyBcryptHash(hash []byte, password string) bool {
+	return bcrypt.CompareHashAndPassword(hash, []byte(password)) == nil
+}
+
+const apiTokenBytes = 24
+
+// GenerateAPIToken generates a random API token and its hash for storage. The
+// token itself is not stored and should be shown to the user only once.
+func GenerateAPIToken() (token string, hash []byte, err error) {
+	raw := make([]byte, apiTokenBytes)
+	if _, err = rand.Read(raw); err != nil {
+		return "", nil, errors.Wrap(err, "failed to generate API token")
+	}
+	token = base64.RawURLEncoding.EncodeToString(raw)
+	return token, hashAPIToken(token), nil
+}
+
+// API tokens are random enough to be hashed without salting and stretching.
+func hashAPIToken(token string) []byte {
+	hash := sha256.Sum256([]byte(token))
+	return hash[:]
+}
+
 // User contains the information of a user. It is stored in the database
 // as table `users`.
 type User struct {
@@ -24,11 +104,32 @@ type User struct {
 	Scope  string `gorm:"unique_index:idx_scope_name"`
 	Name   string `gorm:"unique_index:idx_scope_name"`
 	PWHash *[]byte
+	// SHA-256 hash of the API token, which is an alternative to the password
+	TokenHash *[]byte
+
+	// traffic quota
+	Quota       uint64 // bytes per month, 0 for unlimited
+	UsedBytes   uint64 // bytes used in UsagePeriod
+	UsagePeriod string // the month in which UsedBytes are used, see UsagePeriodOf
+}
+
+// UsagePeriodOf returns the usage period (i.e. the month in UTC) of a time.
+func UsagePeriodOf(t time.Time) string {
+	return t.UTC().Format("2006-01")
+}
+
+// Usage returns the bytes used by the user in the current usage period.
+func (u *User) Usage() uint64 {
+	if u.UsagePeriod != UsagePeriodOf(time.Now()) {
+		return 0
+	}
+	return u.UsedBytes
 }
 
 // UserDAO is the DAO for User.
 type UserDAO struct {
-	db *gorm.DB
+	db       *gorm.DB
+	operator string
 }
 
 // NewUserDAO creates a UserDAO.
@@ -37,47 +138,84 @@ func NewUserDAO() (*UserDAO, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &UserDAO{db}, nil
+	return &UserDAO{db: db}, nil
 }
 
-// Close the db connection of this DAO.
+// Close releases the DAO. The connection pool is shared and kept open.
 func (d *UserDAO) Close() error {
-	return errors.WithStack(d.db.Close())
+	return nil
 }
 
 // Add a new user in the database.
 func (d *UserDAO) Add(user *User) error {
-	if err := d.db.Create(user).Error; err != nil {
-		return errors.Wrap(err, "failed to add new user")
-	}
-	return nil
+	entry := AuditEntry{Operation: AuditAdd, Scope: user.Scope, Name: user.Name}
+	return d.mutate(entry, func(tx *gorm.DB) error {
+		if err := tx.Create(user).Error; err != nil {
+			return errors.Wrap(err, "failed to add new user")
+		}
+		return nil
+	})
 }
 
 // Delete a user of the given scope and name.
 func (d *UserDAO) Delete(scope, name string) error {
-	q := d.db.Delete(&User{}, "scope = ? AND name = ?", scope, name)
-	if q.Error != nil {
-		return errors.Wrapf(
-			q.Error, "failed to delete user '%s/%s'", scope, name)
-	}
-	if q.RowsAffected == 0 {
-		return errors.New("user not found")
-	}
-	return nil
+	entry := AuditEntry{Operation: AuditDelete, Scope: scope, Name: name}
+	return d.mutate(entry, func(tx *gorm.DB) error {
+		q := tx.Delete(&User{}, "scope = ? AND name = ?", scope, name)
+		if q.Error != nil {
+			return errors.Wrapf(
+				q.Error, "failed to delete user '%s/%s'", scope, name)
+		}
+		if q.RowsAffected == 0 {
+			return errors.New("user not found")
+		}
+		return nil
+	})
 }
 
 // Update saves the user to the database.
 func (d *UserDAO) Update(user *User) error {
-	if q := d.db.Save(user); q.Error != nil {
-		return errors.Wrap(q.Error, "failed to update user")
+	entry := AuditEntry{
+		Operation: AuditUpdate, Scope: user.Scope, Name: user.Name}
+	return d.mutate(entry, func(tx *gorm.DB) error {
+		if q := tx.Save(user); q.Error != nil {
+			return errors.Wrap(q.Error, "failed to update user")
+		}
+		return nil
+	})
+}
+
+// Rename changes the scope and name of a user in place, preserving the other
+// fields such as the ID. It fails if the destination user already exists.
+func (d *UserDAO) Rename(scope, name, newScope, newName string) error {
+	if d.CheckExists(newScope, newName) {
+		return errors.Errorf("user '%s/%s' already exists", newScope, newName)
 	}
-	return nil
+	entry := AuditEntry{Operation: AuditRename, Scope: scope, Name: name,
+		Detail: newScope + "/" + newName}
+	defer userAuthCache.invalidate(authKey{newScope, newName})
+	return d.mutate(entry, func(tx *gorm.DB) error {
+		q := tx.Model(&User{}).
+			Where("scope = ? AND name = ?", scope, name).
+			UpdateColumns(map[string]interface{}{
+				"scope": newScope, "name": newName})
+		if q.Error != nil {
+			return errors.Wrapf(
+				q.Error, "failed to rename user '%s/%s'", scope, name)
+		}
+		if q.RowsAffected == 0 {
+			return errors.Errorf("user '%s/%s' not found", scope, name)
+		}
+		return nil
+	})
 }
 
 // Get the user of the given scope and name.
 func (d *UserDAO) Get(scope, name string) (*User, error) {
 	u := User{}
-	query := d.db.Where("scope = ? AND name = ?", scope, name).First(&u)
+	query := retryQuery(func() *gorm.DB {
+		return d.db.Where("scope = ? AND name = ?", scope, name).First(&u)
+	})
 	if query.Error != nil {
 		if query.RecordNotFound() {
 			return nil, errors.Errorf("user '%s/%s' not found", scope, name)
@@ -90,7 +228,9 @@ func (d *UserDAO) Get(scope, name string) (*User, error) {
 // List returns an ordered list of all the users in a scope.
 func (d *UserDAO) List(scope string) ([]*User, error) {
 	results := []*User{}
-	query := d.db.Where("scope = ?", scope).Order("name").Find(&results)
+	query := retryQuery(func() *gorm.DB {
+		return d.db.Where("scope = ?", scope).Order("name").Find(&results)
+	})
 	if query.Error != nil {
 		if query.RecordNotFound() {
 			return nil, errors.Errorf("scope '%s' not found", scope)
@@ -103,25 +243,157 @@ func (d *UserDAO) List(scope string) ([]*User, error) {
 // ListAll returns an ordered list of all the users.
 func (d *UserDAO) ListAll() ([]*User, error) {
 	results := []*User{}
-	query := d.db.Order("scope, name").Find(&results)
+	query := retryQuery(func() *gorm.DB {
+		return d.db.Order("scope, name").Find(&results)
+	})
 	if query.Error != nil {
 		return nil, errors.Wrap(query.Error, "error occurred when querying db")
 	}
 	return results, nil
 }
 
+// UserQuery selects and orders the users returned by UserDAO.Query.
+type UserQuery struct {
+	Scope        string // all the scopes if empty
+	NameContains string // case-insensitively
+	HasPassword  *bool  // regardless of the passwords if nil
+	OrderBy      string // "id", "name" or "created_at", scope and name if empty
+}
+
+// userOrders maps the orders of UserQuery to the columns.
+var userOrders = map[string]string{
+	"":           "scope, name",
+	"id":         "id",
+	"name":       "name, scope",
+	"created_at": "created_at, id",
+}
+
+// likeEscaper escapes the wildcards of a LIKE pattern with '!', which unlike
+// the backslash is not special in the string literals of any SQL dialect.
+var likeEscaper = strings.NewReplacer("!", "!!", "%", "!%", "_", "!_")
+
+// Query returns a list of the users selected and ordered by the query, which
+// is done by the database.
+func (d *UserDAO) Query(q UserQuery) ([]*User, error) {
+	order, ok := userOrders[q.OrderBy]
+	if !ok {
+		return nil, errors.Errorf("unknown order of users: %s", q.OrderBy)
+	}
+	db := d.db
+	if q.Scope != "" {
+		db = db.Where("scope = ?", q.Scope)
+	}
+	if q.NameContains != "" {
+		db = db.Where("LOWER(name) LIKE ? ESCAPE '!'",
+			"%"+likeEscaper.Replace(strings.ToLower(q.NameContains))+"%")
+	}
+	if q.HasPassword != nil && *q.HasPassword {
+		db = db.Where("pw_hash IS NOT NULL")
+	} else if q.HasPassword != nil {
+		db = db.Where("pw_hash IS NULL")
+	}
+	results := []*User{}
+	err := withRetry(func() error {
+		return db.Order(order).Find(&results).Error
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "error occurred when querying db")
+	}
+	return results, nil
+}
+
+// AddUsage adds the bytes used by a user in the current usage period. The
+// usage of previous periods is discarded.
+func (d *UserDAO) AddUsage(scope, name string, bytes uint64) error {
+	period := UsagePeriodOf(time.Now())
+	q := retryQuery(func() *gorm.DB {
+		return d.db.Model(&User{}).
+			Where("scope = ? AND name = ? AND usage_period = ?",
+				scope, name, period).
+			UpdateColumn("used_bytes", gorm.Expr("used_bytes + ?", bytes))
+	})
+	if q.Error == nil && q.RowsAffected == 0 { // in a new period
+		q = retryQuery(func() *gorm.DB {
+			return d.db.Model(&User{}).
+				Where("scope = ? AND name = ?", scope, name).
+				UpdateColumns(map[string]interface{}{
+					"used_bytes": bytes, "usage_period": period})
+		})
+		if q.Error == nil && q.RowsAffected == 0 {
+			return errors.Errorf("user '%s/%s' not found", scope, name)
+		}
+	}
+	return errors.Wrapf(
+		q.Error, "failed to add usage of user '%s/%s'", scope, name)
+}
+
+// SetQuota sets the monthly traffic quota of a user (0 for unlimited) without
+// touching the other fields, e.g. the usage being added concurrently.
+func (d *UserDAO) SetQuota(scope, name string, quota uint64) error {
+	entry := AuditEntry{Operation: AuditUpdate, Scope: scope, Name: name,
+		Detail: "quota"}
+	return d.updateColumns(entry, map[string]interface{}{"quota": quota})
+}
+
+// ResetUsage discards the usage of a user in the current usage period.
+func (d *UserDAO) ResetUsage(scope, name string) error {
+	entry := AuditEntry{Operation: AuditUpdate, Scope: scope, Name: name,
+		Detail: "usage reset"}
+	return d.updateColumns(entry, map[string]interface{}{
+		"used_bytes": 0, "usage_period": UsagePeriodOf(time.Now())})
+}
+
+// updateColumns updates only the given columns of a user.
+func (d *UserDAO) updateColumns(
+	entry AuditEntry, columns map[string]interface{}) error {
+	return d.mutate(entry, func(tx *gorm.DB) error {
+		q := tx.Model(&User{}).
+			Where("scope = ? AND name = ?", entry.Scope, entry.Name).
+			UpdateColumns(columns)
+		if q.Error != nil {
+			return errors.Wrapf(q.Error, "failed to update user '%s/%s'",
+				entry.Scope, entry.Name)
+		}
+		if q.RowsAffected == 0 {
+			return errors.Errorf(
+				"user '%s/%s' not found", entry.Scope, entry.Name)
+		}
+		return nil
+	})
+}
+
 // CheckExists return a boolean value indicating the existence of the user.
+// The result may be cached, see Config.AuthCacheTTL.
 func (d *UserDAO) CheckExists(scope, name string) bool {
-	_, err := d.Get(scope, name)
-	return err == nil
+	entry, err := d.lookupAuth(scope, name)
+	return err == nil && entry.found
 }
 
-// CheckPassword checks if the given password is correct for the user.
+// CheckAPIToken checks if the given API token is correct for the user. The
+// token hash may be cached.
+func (d *UserDAO) CheckAPIToken(scope, name, token string) bool {
+	entry, err := d.lookupAuth(scope, name)
+	if err != nil || entry.tokenHash == nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare(
+		entry.tokenHash, hashAPIToken(token)) == 1
+}
+
+// CheckPassword checks if the given password is correct for the user. On
+// success, an outdated password hash is regenerated. The password hash may be
+// cached.
 func (d *UserDAO) CheckPassword(scope, name, password string) bool {
-	u, err := d.Get(scope, name)
-	if err != nil || u.PWHash == nil {
+	entry, err := d.lookupAuth(scope, name)
+	if err != nil || entry.pwHash == nil {
 		return false
 	}
-	err = bcrypt.CompareHashAndPassword(*u.PWHash, []byte(password))
-	return err == nil
+	ok, outdated := VerifyPWHash(entry.pwHash, password)
+	if ok && outdated {
+		// failing to rehash is harmless as it will be retried next time
+		_ = d.db.Model(&User{}).Where("id = ?", entry.id).
+			UpdateColumn("pw_hash", HashUserPass(password))
+		userAuthCache.invalidate(authKey{scope, name})
+	}
+	return ok
 }
@@ -1,13 +1,19 @@
 package db
 
 import (
+	"database/sql/driver"
 	"io/ioutil"
 	"os"
 	"path"
 	"strconv"
 	"testing"
+	"time"
 
+	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/suite"
+	"golang.org/x/crypto/bcrypt"
 )
 
 type UsersTestSuite struct {
@@ -104,6 +110,80 @@ func (s *UsersTestSuite) TestList() {
 	s.Empty(users)
 }
 
+func (s *UsersTestSuite) TestQuery() {
+	pwhash := []byte("hash")
+	for _, u := range []*User{
+		{Scope: "s2", Name: "bob", PWHash: &pwhash},
+		{Scope: "s1", Name: "Alice"},
+		{Scope: "s1", Name: "bobby", PWHash: &pwhash},
+		{Scope: "s1", Name: "100%_sure"},
+		{Scope: "s2", Name: "100 percent"},
+	} {
+		s.Require().NoError(s.dao.Add(u))
+	}
+	names := func(q UserQuery) (names []string) {
+		users, err := s.dao.Query(q)
+		s.Require().NoError(err)
+		for _, u := range users {
+			names = append(names, u.Scope+"/"+u.Name)
+		}
+		return
+	}
+	yes, no := true, false
+
+	s.Equal([]string{"s1/100%_sure", "s1/Alice", "s1/bobby",
+		"s2/100 percent", "s2/bob"}, names(UserQuery{}))
+	s.Equal([]string{"s1/100%_sure", "s1/Alice", "s1/bobby"},
+		names(UserQuery{Scope: "s1"}))
+	s.Equal([]string{"s2/bob", "s1/bobby"},
+		names(UserQuery{NameContains: "BOB", OrderBy: "name"}))
+	s.Equal([]string{"s1/100%_sure"}, names(UserQuery{NameContains: "%_"}))
+	s.Equal([]string{"s2/bob", "s1/bobby"},
+		names(UserQuery{HasPassword: &yes, OrderBy: "id"}))
+	s.Equal([]string{"s1/Alice", "s1/100%_sure"},
+		names(UserQuery{Scope: "s1", HasPassword: &no, OrderBy: "created_at"}))
+	s.Empty(names(UserQuery{Scope: "s3"}))
+
+	_, err := s.dao.Query(UserQuery{OrderBy: "password"})
+	s.Error(err)
+}
+
+func (s *UsersTestSuite) TestAudit() {
+	s.dao.SetOperator("admin")
+	s.Require().NoError(s.dao.Add(&User{Scope: "test", Name: "user"}))
+	u, err := s.dao.Get("test", "user")
+	s.Require().NoError(err)
+	u.Quota = 100
+	s.Require().NoError(s.dao.Update(u))
+	s.Require().NoError(s.dao.Rename("test", "user", "test", "user2"))
+	s.dao.SetOperator("")
+	s.Require().NoError(s.dao.Delete("test", "user2"))
+	// failed mutations are not recorded
+	s.Error(s.dao.Delete("test", "user2"))
+	s.Error(s.dao.Rename("test", "user", "test", "user3"))
+
+	entries, err := s.dao.ListAudit("", "", 10)
+	s.Require().NoError(err)
+	var records []string
+	for _, e := range entries {
+		records = append(records, e.Operator+" "+e.Operation+" "+
+			e.Scope+"/"+e.Name+" "+e.Detail)
+		s.WithinDuration(time.Now(), e.CreatedAt, time.Minute)
+	}
+	s.Equal([]string{
+		" delete test/user2 ",
+		"admin rename test/user test/user2",
+		"admin update test/user ",
+		"admin add test/user ",
+	}, records)
+
+	entries, err = s.dao.ListAudit("test", "user", 1)
+	s.Require().NoError(err)
+	if s.Len(entries, 1) {
+		s.Equal(AuditRename, entries[0].Operation)
+	}
+}
+
 func (s *UsersTestSuite) TestDelete() {
 	s.Require().NoError(s.dao.Add(&User{Scope: "test1", Name: "user"}))
 	s.Require().NoError(s.dao.Add(&User{Scope: "test1", Name: "user2"}))
@@ -130,6 +210,22 @@ func (s *UsersTestSuite) TestUpdate() {
 	s.True(s.dao.CheckPassword("test", "user", "password"))
 }
 
+func (s *UsersTestSuite) TestRename() {
+	s.Require().NoError(s.dao.Add(&User{Scope: "test1", Name: "user"}))
+	s.Require().NoError(s.dao.Add(&User{Scope: "test2", Name: "user"}))
+	u, err := s.dao.Get("test1", "user")
+	s.Require().NoError(err)
+
+	s.Error(s.dao.Rename("test1", "user", "test2", "user"))
+	s.Error(s.dao.Rename("not", "exists", "test3", "user"))
+	s.NoError(s.dao.Rename("test1", "user", "test3", "user2"))
+	s.False(s.dao.CheckExists("test1", "user"))
+	moved, err := s.dao.Get("test3", "user2")
+	s.Require().NoError(err)
+	s.Equal(u.ID, moved.ID)
+	s.Equal(u.CreatedAt.Unix(), moved.CreatedAt.Unix())
+}
+
 func (s *UsersTestSuite) TestCheckUser() {
 	pwhash := HashUserPass("password")
 	s.Require().NoError(s.dao.Add(&User{Scope: "nopass", Name: "user"}))
@@ -146,6 +242,160 @@ func (s *UsersTestSuite) TestCheckUser() {
 	s.False(s.dao.CheckPassword("haspass", "not_exists", "password"))
 }
 
+func (s *UsersTestSuite) TestAuthCache() {
+	pwhash := HashUserPass("password")
+	s.Require().NoError(s.dao.Add(&User{
+		Scope: "test", Name: "user", PWHash: &pwhash}))
+	stats := GetAuthCacheStats()
+	s.True(s.dao.CheckPassword("test", "user", "password"))
+	s.True(s.dao.CheckPassword("test", "user", "password"))
+	s.False(s.dao.CheckExists("test", "not_exists"))
+	s.False(s.dao.CheckExists("test", "not_exists"))
+	newStats := GetAuthCacheStats()
+	s.Equal(stats.Hits+2, newStats.Hits)
+	s.Equal(stats.Misses+2, newStats.Misses)
+	s.Equal(2, newStats.Entries)
+
+	// changes made by others are not seen until expired
+	newHash := HashUserPass("new_pass")
+	s.Require().NoError(s.dao.db.Model(&User{}).
+		Where("scope = ? AND name = ?", "test", "user").
+		UpdateColumn("pw_hash", newHash).Error)
+	s.True(s.dao.CheckPassword("test", "user", "password"))
+	// while the ones via the DAOs take effect at once
+	u, err := s.dao.Get("test", "user")
+	s.Require().NoError(err)
+	s.Require().NoError(s.dao.Update(u))
+	s.False(s.dao.CheckPassword("test", "user", "password"))
+	s.True(s.dao.CheckPassword("test", "user", "new_pass"))
+	s.Require().NoError(s.dao.Add(&User{Scope: "test", Name: "not_exists"}))
+	s.True(s.dao.CheckExists("test", "not_exists"))
+	s.Require().NoError(s.dao.Rename("test", "user", "test", "user2"))
+	s.False(s.dao.CheckExists("test", "user"))
+	s.True(s.dao.CheckPassword("test", "user2", "new_pass"))
+	s.Require().NoError(s.dao.Delete("test", "user2"))
+	s.False(s.dao.CheckPassword("test", "user2", "new_pass"))
+
+	s.Require().NoError(InitDB(Config{
+		Driver:       "sqlite3",
+		DSN:          path.Join(s.tmpDir, "test.db"),
+		AuthCacheTTL: "0s",
+	}))
+	s.Equal(0, GetAuthCacheStats().Entries)
+	s.dao, err = NewUserDAO()
+	s.Require().NoError(err)
+	s.True(s.dao.CheckExists("test", "not_exists"))
+	s.Equal(0, GetAuthCacheStats().Entries)
+}
+
+func (s *UsersTestSuite) TestAPIToken() {
+	pwhash := HashUserPass("password")
+	s.Require().NoError(s.dao.Add(&User{
+		Scope: "test", Name: "user", PWHash: &pwhash}))
+	s.False(s.dao.CheckAPIToken("test", "user", ""))
+
+	token, hash, err := GenerateAPIToken()
+	s.Require().NoError(err)
+	s.NotContains(string(hash), token)
+	u, err := s.dao.Get("test", "user")
+	s.Require().NoError(err)
+	u.TokenHash = &hash
+	s.Require().NoError(s.dao.Update(u))
+
+	s.True(s.dao.CheckAPIToken("test", "user", token))
+	s.False(s.dao.CheckAPIToken("test", "user", token+"x"))
+	s.False(s.dao.CheckAPIToken("test", "user", "password"))
+	s.False(s.dao.CheckAPIToken("test", "not_exists", token))
+	s.False(s.dao.CheckPassword("test", "user", token))
+
+	token2, _, err := GenerateAPIToken()
+	s.Require().NoError(err)
+	s.NotEqual(token, token2)
+}
+
+func (s *UsersTestSuite) TestRehash() {
+	oldHash, err := bcrypt.GenerateFromPassword(
+		[]byte("password"), bcrypt.MinCost)
+	s.Require().NoError(err)
+	unknownHash := []byte("$unknown$password")
+	s.Require().NoError(s.dao.Add(&User{
+		Scope: "test", Name: "old", PWHash: &oldHash}))
+	s.Require().NoError(s.dao.Add(&User{
+		Scope: "test", Name: "unknown", PWHash: &unknownHash}))
+	s.True(PWHashOutdated(oldHash))
+	s.True(PWHashOutdated(unknownHash))
+	s.False(PWHashOutdated(HashUserPass("password")))
+
+	// not rehashed on failure
+	s.False(s.dao.CheckPassword("test", "old", "wrong_pass"))
+	u, err := s.dao.Get("test", "old")
+	s.Require().NoError(err)
+	s.Equal(oldHash, *u.PWHash)
+
+	s.True(s.dao.CheckPassword("test", "old", "password"))
+	u, err = s.dao.Get("test", "old")
+	s.Require().NoError(err)
+	s.False(PWHashOutdated(*u.PWHash))
+	s.True(s.dao.CheckPassword("test", "old", "password"))
+
+	s.False(s.dao.CheckPassword("test", "unknown", "password"))
+}
+
+func (s *UsersTestSuite) TestUsage() {
+	s.Require().NoError(s.dao.Add(&User{Scope: "test", Name: "user"}))
+	s.Error(s.dao.AddUsage("test", "not_exists", 1))
+
+	s.Require().NoError(s.dao.AddUsage("test", "user", 100))
+	s.Require().NoError(s.dao.AddUsage("test", "user", 23))
+	u, err := s.dao.Get("test", "user")
+	s.Require().NoError(err)
+	s.Equal(uint64(123), u.Usage())
+
+	// usage of previous periods is discarded
+	u.UsagePeriod = "2000-01"
+	s.Require().NoError(s.dao.Update(u))
+	s.Equal(uint64(0), u.Usage())
+	s.Require().NoError(s.dao.AddUsage("test", "user", 5))
+	u, err = s.dao.Get("test", "user")
+	s.Require().NoError(err)
+	s.Equal(uint64(5), u.Usage())
+	s.Equal(UsagePeriodOf(time.Now()), u.UsagePeriod)
+
+	// the quota is set without overwriting the usage
+	s.Require().NoError(s.dao.SetQuota("test", "user", 1000))
+	u, err = s.dao.Get("test", "user")
+	s.Require().NoError(err)
+	s.Equal(uint64(1000), u.Quota)
+	s.Equal(uint64(5), u.Usage())
+	s.Require().NoError(s.dao.ResetUsage("test", "user"))
+	u, err = s.dao.Get("test", "user")
+	s.Require().NoError(err)
+	s.Equal(uint64(1000), u.Quota)
+	s.Equal(uint64(0), u.Usage())
+	s.Error(s.dao.SetQuota("test", "not_exists", 1))
+	s.Error(s.dao.ResetUsage("test", "not_exists"))
+}
+
+func (s *UsersTestSuite) TestPool() {
+	s.Require().NoError(InitDB(Config{
+		Driver:          "sqlite3",
+		DSN:             path.Join(s.tmpDir, "test.db"),
+		MaxOpenConns:    3,
+		MaxIdleConns:    1,
+		ConnMaxLifetime: "1m",
+	}))
+	dao, err := NewUserDAO()
+	s.Require().NoError(err)
+	dao2, err := NewUserDAO()
+	s.Require().NoError(err)
+	s.True(dao.db == dao2.db, "the pool should be shared")
+	s.Equal(3, dao.db.DB().Stats().MaxOpenConnections)
+	s.NoError(dao.Close())
+	s.NoError(dao2.Add(&User{Scope: "test", Name: "user"}))
+	s.True(dao2.CheckExists("test", "user"))
+	s.NoError(dao2.Close())
+}
+
 func TestUsersTestSuite(t *testing.T) {
 	if CheckDriver("sqlite3") {
 		suite.Run(t, new(UsersTestSuite))
@@ -154,6 +404,110 @@ func TestUsersTestSuite(t *testing.T) {
 	}
 }
 
+func TestPasswordPolicy(t *testing.T) {
+	policy := PasswordPolicy{MinLength: 8, MinClasses: 3}
+	assert.NoError(t, policy.validate())
+	assert.NoError(t, policy.Check("Passw0rd"))
+	assert.NoError(t, policy.Check("pässwörd-1"))
+	assert.Error(t, policy.Check("Pass0rd"))   // too short
+	assert.Error(t, policy.Check("password1")) // two classes
+	assert.Error(t, policy.Check(""))
+	assert.NoError(t, PasswordPolicy{}.Check(""))
+
+	for _, invalid := range []PasswordPolicy{
+		{MinLength: -1}, {MinClasses: -1}, {MinClasses: 5},
+	} {
+		assert.Error(t, invalid.validate(), "%+v", invalid)
+	}
+
+	// empty passwords are exempted for the users without one
+	oldConfig := dbConfig
+	defer func() { dbConfig = oldConfig }()
+	dbConfig = &Config{PWPolicy: policy}
+	assert.NoError(t, CheckNewPassword(""))
+	assert.Error(t, CheckNewPassword("password"))
+	dbConfig = nil
+	assert.NoError(t, CheckNewPassword("password"))
+}
+
+func TestPoolConfig(t *testing.T) {
+	for _, valid := range []Config{
+		{}, {MaxOpenConns: 4, MaxIdleConns: 4}, {MaxIdleConns: 4},
+		{ConnMaxLifetime: "5m"},
+	} {
+		assert.NoError(t, valid.validatePool(), "%+v", valid)
+	}
+	for _, invalid := range []Config{
+		{MaxOpenConns: -1}, {MaxIdleConns: -1},
+		{MaxOpenConns: 2, MaxIdleConns: 3},
+		{ConnMaxLifetime: "5"}, {ConnMaxLifetime: "-1s"},
+	} {
+		assert.Error(t, invalid.validatePool(), "%+v", invalid)
+	}
+
+	for _, invalid := range []Config{
+		{AuthCacheTTL: "5"}, {AuthCacheTTL: "-1s"}, {AuthCacheMaxEntries: -1},
+	} {
+		assert.Error(t, invalid.validateAuthCache(), "%+v", invalid)
+	}
+}
+
+func TestAuthCacheEviction(t *testing.T) {
+	c := &authCache{entries: make(map[authKey]authEntry)}
+	now := time.Now()
+	c.put(authKey{"test", "expired"}, authEntry{expiry: now}, now, 2)
+	c.put(authKey{"test", "user1"}, authEntry{expiry: now.Add(time.Second)},
+		now, 2)
+	c.put(authKey{"test", "user2"}, authEntry{expiry: now.Add(time.Second)},
+		now, 2)
+	assert.Len(t, c.entries, 2)
+	assert.NotContains(t, c.entries, authKey{"test", "expired"})
+	c.put(authKey{"test", "user3"}, authEntry{expiry: now.Add(time.Second)},
+		now, 2)
+	assert.Len(t, c.entries, 2)
+	assert.Contains(t, c.entries, authKey{"test", "user3"})
+	_, ok := c.get(authKey{"test", "user3"}, now.Add(time.Second))
+	assert.False(t, ok)
+}
+
+func TestRetry(t *testing.T) {
+	oldConfig := dbConfig
+	defer func() { dbConfig = oldConfig }()
+	dbConfig = &Config{}
+
+	busy := errors.New("database is locked")
+	calls := 0
+	err := withRetry(func() error {
+		if calls++; calls < 3 {
+			return errors.Wrap(busy, "error occurred when querying db")
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, calls)
+
+	calls = 0
+	err = withRetry(func() error { calls++; return busy })
+	assert.Equal(t, busy, err)
+	assert.Equal(t, 1+defaultMaxRetries, calls)
+
+	calls = 0
+	notFound := errors.New("user 'test/user' not found")
+	err = withRetry(func() error { calls++; return notFound })
+	assert.Equal(t, notFound, err)
+	assert.Equal(t, 1, calls)
+
+	dbConfig.MaxRetries = -1
+	calls = 0
+	_ = withRetry(func() error { calls++; return busy })
+	assert.Equal(t, 1, calls)
+
+	assert.True(t, isTransientError(driver.ErrBadConn))
+	assert.True(t, isTransientError(gorm.Errors{notFound, busy}))
+	assert.False(t, isTransientError(gorm.ErrRecordNotFound))
+	assert.False(t, isTransientError(nil))
+}
+
 func BenchmarkHashUserPass(b *testing.B) {
 	pass := "some pass word"
 	for i := 0; i < b.N; i++ {
@@ -1,19 +1,42 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"math/rand"
 	"net"
+	"net/http"
 	"os"
 	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
 
+	"github.com/pkg/errors"
+	"github.com/richardtsai/thestral2/admin"
 	"github.com/richardtsai/thestral2/db"
 	. "github.com/richardtsai/thestral2/lib"
 	"github.com/stretchr/testify/suite"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/reflection/grpc_reflection_v1"
+	"google.golang.org/grpc/status"
+	"gopkg.in/yaml.v2"
 )
 
 type E2ETestSuite struct {
@@ -73,6 +96,7 @@ func (s *E2ETestSuite) SetupSuite() {
 		}},
 		DB:      s.dbCfg,
 		Logging: LoggingConfig{Level: "fatal"},
+		Misc:    MiscConfig{IdleTimeout: "500ms"},
 	}
 	s.svrConfig = &Config{
 		Downstreams: map[string]ProxyConfig{"proxy": {
@@ -98,6 +122,7 @@ func (s *E2ETestSuite) SetupSuite() {
 			"reject": {Domains: []string{"will.be.rejected"}},
 		},
 		Logging: LoggingConfig{Level: "fatal"},
+		Misc:    MiscConfig{RelayBufferSize: "64KB"},
 	}
 
 	tgtAddr, err := net.ResolveTCPAddr("tcp", "127.0.0.1:0")
@@ -197,6 +222,650 @@ func (s *E2ETestSuite) TestRelay() {
 	s.Assert().NoError(conn.Close())
 }
 
+// shortWriter writes at most 3 bytes each time.
+type shortWriter struct {
+	bytes.Buffer
+	writes int
+}
+
+func (w *shortWriter) Write(b []byte) (int, error) {
+	w.writes++
+	if len(b) > 3 {
+		b = b[:3]
+	}
+	return w.Buffer.Write(b)
+}
+
+type stuckWriter struct{}
+
+func (stuckWriter) Write(b []byte) (int, error) {
+	return 0, nil
+}
+
+func (s *E2ETestSuite) TestRelayHalfShortWrites() {
+	app := &Thestral{relayBufSize: 8}
+	data := "0123456789abcdefghij"
+	var reported []uint32
+	dst := &shortWriter{}
+	n, err := app.relayHalf(dst, strings.NewReader(data), relayTimeouts{},
+		func(n uint32) { reported = append(reported, n) })
+	s.NoError(err)
+	s.EqualValues(len(data), n)
+	s.Equal(data, dst.String())
+	s.Equal(len(reported), dst.writes)
+	var total uint32
+	for _, n := range reported {
+		s.True(n <= 3)
+		total += n
+	}
+	s.EqualValues(len(data), total)
+
+	// no progress at all
+	_, err = app.relayHalf(stuckWriter{}, strings.NewReader(data),
+		relayTimeouts{}, func(uint32) {})
+	s.Equal(io.ErrShortWrite, errors.Cause(err))
+}
+
+// gatedWriter blocks the writes until the gate is closed.
+type gatedWriter chan struct{}
+
+func (w gatedWriter) Write(b []byte) (int, error) {
+	<-w
+	return len(b), nil
+}
+
+type countingReader struct {
+	io.Reader
+	n int64 // accessed atomically
+}
+
+func (r *countingReader) Read(b []byte) (int, error) {
+	n, err := r.Reader.Read(b)
+	atomic.AddInt64(&r.n, int64(n))
+	return n, err
+}
+
+func (s *E2ETestSuite) TestRelayHalfBuffered() {
+	config := *s.svrConfig
+	config.Misc.RelayWatermark = "100MB"
+	s.Error(ValidateConfig(config))
+	config.Misc.RelayWatermark = "64KB"
+	app, err := newThestralApp(config, true, nil)
+	s.Require().NoError(err)
+	s.EqualValues(64*1024, app.relayWatermark)
+
+	app = &Thestral{relayBufSize: 8, relayWatermark: 16}
+	data := "0123456789abcdefghij"
+	var reported uint32
+	dst := &shortWriter{}
+	n, err := app.relayHalf(dst, strings.NewReader(data), relayTimeouts{},
+		func(n uint32) { reported += n })
+	s.NoError(err)
+	s.EqualValues(len(data), n)
+	s.Equal(data, dst.String())
+	s.EqualValues(len(data), reported)
+	_, err = app.relayHalf(stuckWriter{}, strings.NewReader(data),
+		relayTimeouts{}, func(uint32) {})
+	s.Equal(io.ErrShortWrite, errors.Cause(err))
+
+	// the reads stop once the watermark is reached while the writes block
+	src := &countingReader{Reader: io.LimitReader(zeroReader{}, 1024)}
+	gated := make(gatedWriter)
+	done := make(chan int64)
+	go func() {
+		n, _ := app.relayHalf(gated, src, relayTimeouts{}, func(uint32) {})
+		done <- n
+	}()
+	time.Sleep(time.Millisecond * 100)
+	// a chunk being written, the ones up to the watermark and one more read
+	s.True(atomic.LoadInt64(&src.n) <= 8+16+8+8, atomic.LoadInt64(&src.n))
+	close(gated)
+	s.EqualValues(1024, <-done)
+
+	// small chunks are counted by the buffers they hold
+	buffer := newRelayBuffer(32)
+	defer buffer.Close()
+	s.True(buffer.Push(GlobalBufPool.Get(16)[:1]))
+	s.True(buffer.Push(GlobalBufPool.Get(16)[:1]))
+	pushed := make(chan bool)
+	go func() { pushed <- buffer.Push(GlobalBufPool.Get(16)[:1]) }()
+	select {
+	case <-pushed:
+		s.Fail("pushed over the watermark")
+	case <-time.After(time.Millisecond * 50):
+	}
+	chunk, err := buffer.Pop()
+	s.NoError(err)
+	GlobalBufPool.Free(chunk)
+	s.True(<-pushed)
+}
+
+// tcpConnPair returns both ends of a loopback TCP connection.
+func tcpConnPair() (*net.TCPConn, *net.TCPConn, error) {
+	listener, err := net.ListenTCP(
+		"tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		return nil, nil, err
+	}
+	defer listener.Close() // nolint: errcheck
+	client, err := net.DialTCP("tcp", nil, listener.Addr().(*net.TCPAddr))
+	if err != nil {
+		return nil, nil, err
+	}
+	server, err := listener.AcceptTCP()
+	if err != nil {
+		_ = client.Close()
+		return nil, nil, err
+	}
+	return client, server, nil
+}
+
+func (s *E2ETestSuite) TestRelaySpliced() {
+	srcW, src, err := tcpConnPair()
+	s.Require().NoError(err)
+	defer srcW.Close() // nolint: errcheck
+	dst, dstR, err := tcpConnPair()
+	s.Require().NoError(err)
+	defer dstR.Close() // nolint: errcheck
+
+	data := make([]byte, relaySpliceChunkSize*2+100)
+	rand.Read(data) // nolint: errcheck
+	go func() {
+		_, _ = srcW.Write(data)
+		_ = srcW.Close()
+	}()
+	var reported []uint32
+	n, err := relaySpliced(dst, src,
+		func(n uint32) { reported = append(reported, n) })
+	s.NoError(err)
+	s.EqualValues(len(data), n)
+	s.Equal([]uint32{relaySpliceChunkSize, relaySpliceChunkSize, 100},
+		reported)
+	s.NoError(dst.Close())
+	received, err := ioutil.ReadAll(dstR)
+	s.NoError(err)
+	s.Equal(data, received)
+}
+
+func (s *E2ETestSuite) TestIdleTimeout() {
+	conn, _, pErr := s.cli.Request(context.Background(), s.targetAddr)
+	s.Require().Nil(pErr)
+
+	// keep it active for a while
+	buf := make([]byte, 1)
+	for i := 0; i < 4; i++ {
+		time.Sleep(time.Millisecond * 200)
+		_, err := conn.Write(buf)
+		s.Require().NoError(err)
+		_, err = io.ReadFull(conn, buf)
+		s.Require().NoError(err)
+	}
+
+	// then it should be closed after being idle
+	_, err := ioutil.ReadAll(conn)
+	s.NoError(err)
+	_ = conn.Close()
+}
+
+func (s *E2ETestSuite) TestFirstByteTimeout() {
+	config := *s.svrConfig
+	config.Misc.FirstByteTimeout = "-1s"
+	_, err := s.svrApp.newRouting(config)
+	s.Error(err)
+
+	config.Misc.FirstByteTimeout = "100ms"
+	r, err := s.svrApp.newRouting(config)
+	s.Require().NoError(err)
+	s.svrApp.setRouting(r)
+
+	// the tunnel is closed as nothing is sent in time
+	conn, _, pErr := s.cli.Request(context.Background(), s.targetAddr)
+	s.Require().Nil(pErr)
+	start := time.Now()
+	_, err = ioutil.ReadAll(conn)
+	s.NoError(err)
+	s.True(time.Since(start) < time.Millisecond*400) // before idle timeout
+	_ = conn.Close()
+
+	// but not after some data is transferred
+	conn, _, pErr = s.cli.Request(context.Background(), s.targetAddr)
+	s.Require().Nil(pErr)
+	buf := make([]byte, 1)
+	for i := 0; i < 2; i++ {
+		_, err = conn.Write(buf)
+		s.Require().NoError(err)
+		_, err = io.ReadFull(conn, buf)
+		s.Require().NoError(err)
+		time.Sleep(time.Millisecond * 200)
+	}
+	_ = conn.Close()
+}
+
+func (s *E2ETestSuite) TestIOTimeouts() {
+	config := *s.svrConfig
+	config.Misc.ReadTimeout = "0s"
+	_, err := s.svrApp.newRouting(config)
+	s.Error(err)
+	config.Misc.ReadTimeout = ""
+	config.Misc.WriteTimeout = "x"
+	_, err = s.svrApp.newRouting(config)
+	s.Error(err)
+
+	// a read waits for no longer than the timeout, which is reset by data
+	app := &Thestral{relayBufSize: defaultRelayBufferSize}
+	timeouts := relayTimeouts{read: time.Millisecond * 100}
+	srcW, src, err := tcpConnPair()
+	s.Require().NoError(err)
+	defer srcW.Close() // nolint: errcheck
+	go func() {
+		for i := 0; i < 3; i++ {
+			_, _ = srcW.Write([]byte("x"))
+			time.Sleep(time.Millisecond * 60)
+		}
+	}()
+	start := time.Now()
+	n, err := app.relayHalf(ioutil.Discard, src, timeouts, func(uint32) {})
+	s.EqualValues(3, n)
+	s.Require().IsType(&relayTimeoutError{}, errors.Cause(err))
+	s.Equal("read", errors.Cause(err).(*relayTimeoutError).op)
+	s.True(time.Since(start) > time.Millisecond*200)
+
+	// and so does a write to a peer not reading
+	timeouts = relayTimeouts{write: time.Millisecond * 100}
+	dst, dstR, err := tcpConnPair()
+	s.Require().NoError(err)
+	defer dstR.Close() // nolint: errcheck
+	_, err = app.relayHalf(dst, zeroReader{}, timeouts, func(uint32) {})
+	s.Require().IsType(&relayTimeoutError{}, errors.Cause(err))
+	s.Equal("write", errors.Cause(err).(*relayTimeoutError).op)
+	_ = dst.Close()
+
+	// the tunnel is closed as the client sends nothing in time
+	config.Misc.WriteTimeout = ""
+	config.Misc.ReadTimeout = "100ms"
+	r, err := s.svrApp.newRouting(config)
+	s.Require().NoError(err)
+	s.svrApp.setRouting(r)
+	conn, _, pErr := s.cli.Request(context.Background(), s.targetAddr)
+	s.Require().Nil(pErr)
+	start = time.Now()
+	_, err = ioutil.ReadAll(conn)
+	s.NoError(err)
+	s.True(time.Since(start) < time.Millisecond*400) // before idle timeout
+	_ = conn.Close()
+	time.Sleep(time.Millisecond * 100) // ensure the tunnel is closed
+	s.NotZero(s.svrApp.monitor.Report().ClosedTunnels[TunnelIOTimeout])
+}
+
+func (s *E2ETestSuite) TestSinkhole() {
+	config := *s.locConfig
+	setResponse := func(response string) {
+		config.Upstreams = map[string]ProxyConfig{"sinkhole": {
+			Protocol: "sinkhole",
+			Settings: map[string]interface{}{"response": response},
+		}}
+		config.Rules = map[string]RuleConfig{"blocked": {
+			IPs: []string{"127.0.0.1"}, Upstreams: []string{"sinkhole"}}}
+		r, err := s.locApp.newRouting(config)
+		s.Require().NoError(err)
+		s.locApp.setRouting(r)
+	}
+
+	// closed at once
+	setResponse("empty")
+	conn, _, pErr := s.cli.Request(context.Background(), s.targetAddr)
+	s.Require().Nil(pErr)
+	data, err := ioutil.ReadAll(conn)
+	s.NoError(err)
+	s.Empty(data)
+	_ = conn.Close()
+
+	// a null response to HTTP requests
+	setResponse("http_204")
+	conn, _, pErr = s.cli.Request(context.Background(), s.targetAddr)
+	s.Require().Nil(pErr)
+	_, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: ads.example\r\n\r\n"))
+	s.NoError(err)
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if s.NoError(err) {
+		s.Equal(http.StatusNoContent, resp.StatusCode)
+		_ = resp.Body.Close()
+	}
+	_ = conn.Close()
+
+	// reset
+	setResponse("reset")
+	conn, _, pErr = s.cli.Request(context.Background(), s.targetAddr)
+	s.Require().Nil(pErr)
+	_, err = ioutil.ReadAll(conn)
+	if s.Error(err) {
+		s.Contains(err.Error(), syscall.ECONNRESET.Error())
+	}
+	_ = conn.Close()
+
+	time.Sleep(time.Millisecond * 100) // ensure the tunnels are closed
+	s.EqualValues(3,
+		s.locApp.monitor.Report().ClosedTunnels[TunnelSinkholed])
+}
+
+func (s *E2ETestSuite) TestRuleDeny() {
+	config := *s.locConfig
+	config.Rules = map[string]RuleConfig{"denied": {
+		IPs: []string{"127.0.0.1"}, Action: "deny"}}
+	r, err := s.locApp.newRouting(config)
+	s.Require().NoError(err)
+	s.locApp.setRouting(r)
+	_, _, pErr := s.cli.Request(context.Background(), s.targetAddr)
+	s.Require().NotNil(pErr)
+	s.EqualValues(ProxyNotAllowed, pErr.ErrType)
+
+	// rejected as well by a rule without upstreams, which is deprecated, as
+	// warned by an app not running, whose logger can be replaced safely
+	config.Rules = map[string]RuleConfig{"legacy": {
+		IPs: []string{"127.0.0.1"}}}
+	app, err := NewThestralApp(config)
+	s.Require().NoError(err)
+	core, logs := observer.New(zap.WarnLevel)
+	app.log = zap.New(core).Sugar()
+	_, err = app.newRouting(config)
+	s.Require().NoError(err)
+	s.Equal(1, logs.FilterField(zap.String("rule", "legacy")).Len())
+	r, err = s.locApp.newRouting(config)
+	s.Require().NoError(err)
+	s.locApp.setRouting(r)
+	_, _, pErr = s.cli.Request(context.Background(), s.targetAddr)
+	s.Require().NotNil(pErr)
+	s.EqualValues(ProxyNotAllowed, pErr.ErrType)
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(b []byte) (int, error) {
+	return len(b), nil
+}
+
+func (s *E2ETestSuite) TestProgressLog() {
+	config := *s.svrConfig
+	config.Misc.ProgressLogInterval = "0s"
+	_, err := s.svrApp.newRouting(config)
+	s.Error(err)
+
+	config.Misc.ProgressLogInterval = "50ms"
+	r, err := s.svrApp.newRouting(config)
+	s.Require().NoError(err)
+	s.Equal(time.Millisecond*50, r.progressInterval)
+	s.svrApp.setRouting(r)
+
+	// logged along the relay without disturbing it
+	conn, _, pErr := s.cli.Request(context.Background(), s.targetAddr)
+	s.Require().Nil(pErr)
+	buf := []byte("hello")
+	for i := 0; i < 3; i++ {
+		_, err = conn.Write(buf)
+		s.Require().NoError(err)
+		_, err = io.ReadFull(conn, buf)
+		s.Require().NoError(err)
+		time.Sleep(time.Millisecond * 60)
+	}
+	s.NoError(conn.Close())
+}
+
+func (s *E2ETestSuite) TestAccessLog() {
+	tmpDir, err := ioutil.TempDir("", "thestral2_TestAccessLog")
+	s.Require().NoError(err)
+	defer func() { _ = os.RemoveAll(tmpDir) }()
+	logFile := path.Join(tmpDir, "access.log")
+	s.svrApp.accessLog, err = CreateAccessLogger(
+		AccessLogConfig{File: logFile})
+	s.Require().NoError(err)
+
+	conn, _, pErr := s.cli.Request(context.Background(), s.targetAddr)
+	s.Require().Nil(pErr)
+	buf := []byte("hello")
+	_, err = conn.Write(buf)
+	s.Require().NoError(err)
+	_, err = io.ReadFull(conn, buf)
+	s.Require().NoError(err)
+	s.NoError(conn.Close())
+	time.Sleep(time.Millisecond * 100) // ensure the tunnel is closed
+
+	data, err := ioutil.ReadFile(logFile)
+	s.Require().NoError(err)
+	var record map[string]interface{}
+	s.Require().NoError(json.Unmarshal(data, &record))
+	s.Equal("proxy", record["downstream"])
+	s.Equal(s.targetAddr.String(), record["target"])
+	s.Equal("client_closed", record["closeReason"])
+	s.EqualValues(5, record["bytesUploaded"])
+	s.EqualValues(5, record["bytesDownloaded"])
+	s.NotEmpty(record["userIDs"])
+}
+
+func (s *E2ETestSuite) TestRuleBandwidth() {
+	const bandwidth = 64 * 1024
+	config := *s.svrConfig
+	config.Rules = map[string]RuleConfig{"target": {
+		IPs: []string{"127.0.0.1"}, Upstreams: []string{"direct"},
+		Bandwidth: "64KB"}}
+	r, err := s.svrApp.newRouting(config)
+	s.Require().NoError(err)
+	s.svrApp.setRouting(r)
+
+	conn, _, pErr := s.cli.Request(context.Background(), s.targetAddr)
+	s.Require().Nil(pErr)
+	data := make([]byte, bandwidth)
+	start := time.Now()
+	go func() { _, _ = conn.Write(data) }()
+	_, err = io.ReadFull(conn, data)
+	s.Require().NoError(err)
+	// the burst and the debt of the next read cover about 200ms, and only the
+	// lower bound is checked, as a loaded machine can take much longer
+	s.True(time.Since(start) >= time.Millisecond*600, "%v", time.Since(start))
+	s.NoError(conn.Close())
+}
+
+func (s *E2ETestSuite) TestRuleConnectTimeout() {
+	config := *s.svrConfig
+	config.Misc.ConnectTimeout = "10s"
+	config.Rules = map[string]RuleConfig{
+		"satellite": {
+			IPs: []string{"127.0.0.1"}, Upstreams: []string{"direct"},
+			ConnectTimeout: "3m"},
+		"default": {Upstreams: []string{"direct"}},
+	}
+	r, err := s.svrApp.newRouting(config)
+	s.Require().NoError(err)
+
+	rule, _ := r.ruleMatcher.MatchIP(net.ParseIP("127.0.0.1"))
+	s.Equal("satellite", rule)
+	s.Equal(time.Minute*3, r.connectTimeoutOf(rule))
+	s.Equal(time.Second*10, r.connectTimeoutOf("default"))
+}
+
+func (s *E2ETestSuite) TestBuiltinDirectUpstream() {
+	config := *s.svrConfig
+	config.Upstreams = map[string]ProxyConfig{"dead": {
+		Protocol: "socks5",
+		Settings: map[string]interface{}{"address": "127.0.0.1:64891"},
+	}}
+	config.Rules = map[string]RuleConfig{"target": {
+		IPs: []string{"127.0.0.1"}, Upstreams: []string{"direct"}}}
+	r, err := s.svrApp.newRouting(config)
+	s.Require().NoError(err)
+	s.Equal([]string{"dead"}, r.upstreamNames) // not for unmatched requests
+	s.svrApp.setRouting(r)
+
+	conn, _, pErr := s.cli.Request(context.Background(), s.targetAddr)
+	s.Require().Nil(pErr)
+	_, err = conn.Write([]byte("hello"))
+	s.NoError(err)
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(conn, buf)
+	s.NoError(err)
+	s.Equal("hello", string(buf))
+	var direct *UpstreamMonitorReport
+	for _, report := range s.svrApp.monitor.Report().Upstreams {
+		if report.Name == "direct" {
+			direct = report
+		}
+	}
+	if s.NotNil(direct) {
+		s.EqualValues(1, direct.ConnsInUse)
+	}
+	s.NoError(conn.Close())
+
+	// shadowed by a configured one
+	config.Upstreams = map[string]ProxyConfig{"direct": {
+		Protocol: "socks5",
+		Settings: map[string]interface{}{"address": "127.0.0.1:64891"},
+	}}
+	r, err = s.svrApp.newRouting(config)
+	s.Require().NoError(err)
+	_, ok := r.upstreams["direct"].(DirectTCPClient)
+	s.False(ok)
+}
+
+func (s *E2ETestSuite) TestFailover() {
+	address := "127.0.0.1:64905"
+	config := *s.locConfig
+	config.Downstreams = map[string]ProxyConfig{"local": {
+		Protocol: "socks5",
+		Settings: map[string]interface{}{"address": address},
+	}}
+	config.Upstreams = map[string]ProxyConfig{
+		"proxy": s.locConfig.Upstreams["proxy"],
+		"dead": { // nothing is listening on this address
+			Protocol: "socks5",
+			Settings: map[string]interface{}{"address": "127.0.0.1:64891"},
+		},
+	}
+	config.Misc.UpstreamStrategy = "round_robin"
+	app, err := NewThestralApp(config)
+	s.Require().NoError(err)
+	go func() { _ = app.Run(s.appCtx) }()
+	time.Sleep(time.Millisecond * 100) // ensure the server is started
+	cli, err := CreateProxyClient(ProxyConfig{
+		Protocol: "socks5", Settings: map[string]interface{}{"address": address},
+	})
+	s.Require().NoError(err)
+
+	// the 'dead' upstream is selected first by one of the requests (or both,
+	// as the failover advances the round-robin too), which fail over
+	for i := 0; i < 2; i++ {
+		conn, _, pErr := cli.Request(context.Background(), s.targetAddr)
+		if s.Nil(pErr) {
+			s.NoError(conn.Close())
+		}
+	}
+	reports := make(map[string]*UpstreamMonitorReport)
+	for _, report := range app.monitor.Report().Upstreams {
+		reports[report.Name] = report
+	}
+	s.Require().Contains(reports, "dead")
+	s.Require().Contains(reports, "proxy")
+	s.True(reports["dead"].ErrorCount >= 1, reports["dead"].ErrorCount)
+	s.Zero(reports["dead"].SuccessCount)
+	s.Zero(reports["proxy"].ErrorCount)
+	s.EqualValues(2, reports["proxy"].SuccessCount)
+}
+
+func (s *E2ETestSuite) TestUnhealthyPolicy() {
+	config := *s.svrConfig
+	sick := ProxyConfig{
+		Protocol: "socks5",
+		Settings: map[string]interface{}{"address": "127.0.0.1:64891"},
+		HealthCheck: &HealthCheckConfig{Target: s.targetAddr.String(),
+			Interval: "10ms", FailureThreshold: 1},
+	}
+	config.Upstreams = map[string]ProxyConfig{
+		"direct": {Protocol: "direct"}, "sick1": sick, "sick2": sick}
+	sickUpstreams := []string{"sick1", "sick2"}
+	newRouting := func(policy string) *routing {
+		config.Rules = map[string]RuleConfig{
+			"target": {IPs: []string{"127.0.0.1"}, Upstreams: sickUpstreams,
+				UnhealthyPolicy: policy},
+			"default": {Upstreams: []string{"direct"}},
+		}
+		r, err := s.svrApp.newRouting(config)
+		s.Require().NoError(err)
+		s.svrApp.setRouting(r)
+		for i := 0; i < 100 && (r.healthChecker.IsHealthy("sick1") ||
+			r.healthChecker.IsHealthy("sick2")); i++ {
+			time.Sleep(time.Millisecond * 10)
+		}
+		s.Require().False(r.healthChecker.IsHealthy("sick1"))
+		s.Require().False(r.healthChecker.IsHealthy("sick2"))
+		return r
+	}
+	config.Rules = map[string]RuleConfig{"target": {
+		Upstreams: sickUpstreams, UnhealthyPolicy: "anyway"}}
+	_, err := s.svrApp.newRouting(config)
+	s.Error(err)
+
+	// the request is rejected by default
+	r := newRouting("")
+	upstreams, policy := r.healthyUpstreams(nil, "target", sickUpstreams)
+	s.Empty(upstreams)
+	s.Equal(UnhealthyFailFast, policy)
+	upstreams, policy = r.healthyUpstreams(nil, "default", []string{"direct"})
+	s.Equal([]string{"direct"}, upstreams)
+	s.Empty(policy)
+	_, _, pErr := s.cli.Request(context.Background(), s.targetAddr)
+	s.Require().NotNil(pErr)
+	s.EqualValues(ProxyNotAllowed, pErr.ErrType)
+
+	// or relayed via the default rule
+	r = newRouting("default")
+	upstreams, policy = r.healthyUpstreams(nil, "target", sickUpstreams)
+	s.Equal([]string{"direct"}, upstreams)
+	s.Equal(UnhealthyFallbackDefault, policy)
+	conn, _, pErr := s.cli.Request(context.Background(), s.targetAddr)
+	if s.Nil(pErr) {
+		s.NoError(conn.Close())
+	}
+
+	// or tried anyway
+	r = newRouting("least_recently_failed")
+	upstreams, policy = r.healthyUpstreams(nil, "target", sickUpstreams)
+	s.Len(upstreams, 1)
+	s.Subset(sickUpstreams, upstreams)
+	s.Equal(UnhealthyLeastRecentlyFailed, policy)
+	_, _, pErr = s.cli.Request(context.Background(), s.targetAddr)
+	s.Require().NotNil(pErr)
+	s.NotEqual(ProxyNotAllowed, pErr.ErrType)
+}
+
+func (s *E2ETestSuite) TestAttemptContext() {
+	timeoutOf := func(ctx context.Context, r *routing, attemptsLeft int) (
+		timeout time.Duration) {
+		attemptCtx, cancel := r.attemptContext(ctx, attemptsLeft)
+		defer cancel()
+		if deadline, ok := attemptCtx.Deadline(); ok {
+			timeout = time.Until(deadline)
+		}
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	r := &routing{}
+	s.InDelta(time.Second*20, timeoutOf(ctx, r, 3), float64(time.Second))
+	s.InDelta(time.Minute, timeoutOf(ctx, r, 1), float64(time.Second))
+	s.InDelta(minConnectAttemptTime, timeoutOf(ctx, r, 100),
+		float64(time.Second))
+	s.Zero(timeoutOf(context.Background(), r, 3))
+
+	r.attemptTimeout = time.Second * 10
+	s.InDelta(time.Second*10, timeoutOf(ctx, r, 3), float64(time.Second))
+	s.InDelta(time.Second*10, timeoutOf(context.Background(), r, 3),
+		float64(time.Second))
+
+	// the minimum is bounded by the deadline of all the attempts
+	shortCtx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	s.InDelta(time.Second, timeoutOf(shortCtx, r, 3), float64(time.Second))
+}
+
 func (s *E2ETestSuite) TestNoUserPass() {
 	if s.dbCfg == nil {
 		s.T().Skip("database driver 'sqlite3' is not enabled")
@@ -210,7 +879,7 @@ func (s *E2ETestSuite) TestNoUserPass() {
 	_, _, pErr := cli.Request(context.Background(), s.targetAddr)
 	if s.NotNil(pErr) {
 		s.Error(pErr.Error)
-		s.Equal(ProxyGeneralErr, pErr.ErrType)
+		s.Equal(ProxyAuthFailed, pErr.ErrType)
 	}
 }
 
@@ -229,7 +898,73 @@ func (s *E2ETestSuite) TestWrongUserPass() {
 	_, _, pErr := cli.Request(context.Background(), s.targetAddr)
 	if s.NotNil(pErr) {
 		s.Error(pErr.Error)
-		s.Equal(ProxyGeneralErr, pErr.ErrType)
+		s.Equal(ProxyAuthFailed, pErr.ErrType)
+	}
+}
+
+func (s *E2ETestSuite) TestAPIToken() {
+	if s.dbCfg == nil {
+		s.T().Skip("database driver 'sqlite3' is not enabled")
+	}
+	setTokenHash := func(hash *[]byte) {
+		dao, err := db.NewUserDAO()
+		s.Require().NoError(err)
+		defer func() { s.NoError(dao.Close()) }()
+		user, err := dao.Get("proxy.socks5", "user")
+		s.Require().NoError(err)
+		user.TokenHash = hash
+		s.Require().NoError(dao.Update(user))
+	}
+	token, hash, err := db.GenerateAPIToken()
+	s.Require().NoError(err)
+	setTokenHash(&hash)
+	defer setTokenHash(nil)
+
+	cli, err := CreateProxyClient(ProxyConfig{
+		Protocol: "socks5",
+		Settings: map[string]interface{}{
+			"address": s.locAddr, "username": "user", "password": token,
+		},
+	})
+	s.Require().NoError(err)
+	conn, _, pErr := cli.Request(context.Background(), s.targetAddr)
+	if s.Nil(pErr) {
+		s.NoError(conn.Close())
+	}
+
+	// the password still works
+	conn, _, pErr = s.cli.Request(context.Background(), s.targetAddr)
+	if s.Nil(pErr) {
+		s.NoError(conn.Close())
+	}
+}
+
+func (s *E2ETestSuite) TestQuotaExceeded() {
+	if s.dbCfg == nil {
+		s.T().Skip("database driver 'sqlite3' is not enabled")
+	}
+	setQuota := func(quota, used uint64) {
+		dao, err := db.NewUserDAO()
+		s.Require().NoError(err)
+		defer func() { s.NoError(dao.Close()) }()
+		user, err := dao.Get("proxy.socks5", "user")
+		s.Require().NoError(err)
+		user.Quota = quota
+		user.UsedBytes = used
+		user.UsagePeriod = db.UsagePeriodOf(time.Now())
+		s.Require().NoError(dao.Update(user))
+	}
+	setQuota(1024, 1024)
+	defer setQuota(0, 0)
+
+	_, _, pErr := s.cli.Request(context.Background(), s.targetAddr)
+	s.Require().NotNil(pErr)
+	s.EqualValues(ProxyNotAllowed, pErr.ErrType)
+
+	setQuota(1024, 0)
+	conn, _, pErr := s.cli.Request(context.Background(), s.targetAddr)
+	if s.Nil(pErr) {
+		s.NoError(conn.Close())
 	}
 }
 
@@ -241,14 +976,909 @@ func (s *E2ETestSuite) TestRejectByRule() {
 	s.Assert().Error(pErr.Error)
 }
 
+func (s *E2ETestSuite) TestReloadRules() {
+	addr := &DomainNameAddr{DomainName: "will.be.rejected", Port: 12345}
+
+	// invalid rule sets are not applied
+	s.Error(s.svrApp.ReloadRules(map[string]RuleConfig{
+		"reject": {Domains: []string{"("}}}))
+	s.Error(s.svrApp.ReloadRules(map[string]RuleConfig{
+		"reject": {Upstreams: []string{"undefined"}}}))
+	_, _, pErr := s.cli.Request(context.Background(), addr)
+	s.Require().NotNil(pErr)
+	s.EqualValues(ProxyNotAllowed, pErr.ErrType)
+
+	s.Require().NoError(s.svrApp.ReloadRules(map[string]RuleConfig{
+		"reject": {Domains: []string{`.*\.rejected`}}}))
+	_, _, pErr = s.cli.Request(context.Background(), addr)
+	s.Require().NotNil(pErr)
+	s.EqualValues(ProxyNotAllowed, pErr.ErrType)
+	conn, _, pErr := s.cli.Request(context.Background(), s.targetAddr)
+	if s.Nil(pErr) {
+		s.NoError(conn.Close())
+	}
+
+	s.Require().NoError(s.svrApp.ReloadRules(nil))
+	_, _, pErr = s.cli.Request(context.Background(), addr)
+	s.Require().NotNil(pErr)
+	s.NotEqual(ProxyNotAllowed, pErr.ErrType)
+}
+
+func (s *E2ETestSuite) TestReload() {
+	configFile, err := ioutil.TempFile("", "thestral2_TestReload")
+	s.Require().NoError(err)
+	_ = configFile.Close()
+	defer func() { _ = os.Remove(configFile.Name()) }()
+	writeConfig := func(config Config) {
+		data, err := yaml.Marshal(config)
+		s.Require().NoError(err)
+		s.Require().NoError(ioutil.WriteFile(configFile.Name(), data, 0600))
+	}
+	rejected := &DomainNameAddr{DomainName: "will.be.rejected", Port: 12345}
+	newRejected := &DomainNameAddr{DomainName: "new.rejected", Port: 12345}
+
+	config := *s.svrConfig
+	config.Rules = map[string]RuleConfig{
+		"reject": {Domains: []string{"new.rejected"}},
+		"direct": {Upstreams: []string{"undefined"}},
+	}
+	writeConfig(config)
+	s.Error(s.svrApp.Reload(configFile.Name()))
+	_, _, pErr := s.cli.Request(context.Background(), rejected)
+	s.Require().NotNil(pErr)
+	s.EqualValues(ProxyNotAllowed, pErr.ErrType)
+
+	config.Upstreams = map[string]ProxyConfig{
+		"direct":    {Protocol: "direct"},
+		"undefined": {Protocol: "direct"},
+	}
+	config.Misc.ConnectTimeout = "10s"
+	writeConfig(config)
+
+	// an existing tunnel should survive the reloading
+	conn, _, pErr := s.cli.Request(context.Background(), s.targetAddr)
+	s.Require().Nil(pErr)
+	defer func() { _ = conn.Close() }()
+	s.Require().NoError(s.svrApp.Reload(configFile.Name()))
+	buf := []byte("ping")
+	_, err = conn.Write(buf)
+	s.Require().NoError(err)
+	_, err = io.ReadFull(conn, buf)
+	s.NoError(err)
+	s.Equal("ping", string(buf))
+
+	_, _, pErr = s.cli.Request(context.Background(), rejected)
+	s.Require().NotNil(pErr)
+	s.NotEqual(ProxyNotAllowed, pErr.ErrType)
+	_, _, pErr = s.cli.Request(context.Background(), newRejected)
+	s.Require().NotNil(pErr)
+	s.EqualValues(ProxyNotAllowed, pErr.ErrType)
+
+	// the reloaded timeouts are kept when an upstream is toggled afterwards
+	config.Misc.ReadTimeout = "5s"
+	config.Misc.WriteTimeout = "6s"
+	writeConfig(config)
+	s.Require().NoError(s.svrApp.Reload(configFile.Name()))
+	s.Require().NoError(s.svrApp.SetUpstreamEnabled("direct", false))
+	s.Equal(relayTimeouts{read: time.Second * 5, write: time.Second * 6},
+		s.svrApp.getRouting().ioTimeouts)
+
+	// the clients no longer used are closed once their requests are done
+	stale, kept := &closableClient{}, &closableClient{}
+	replaced := &routing{inUse: new(sync.WaitGroup),
+		upstreams: map[string]ProxyClient{"stale": stale, "kept": kept}}
+	current := &routing{upstreams: map[string]ProxyClient{"kept": kept}}
+	replaced.inUse.Add(1)
+	done := make(chan struct{})
+	go func() {
+		s.svrApp.closeStaleUpstreams(replaced, current)
+		close(done)
+	}()
+	time.Sleep(time.Millisecond * 50)
+	s.Zero(atomic.LoadInt32(&stale.closed))
+	replaced.inUse.Done()
+	<-done
+	s.EqualValues(1, atomic.LoadInt32(&stale.closed))
+	s.Zero(atomic.LoadInt32(&kept.closed))
+}
+
+type closableClient struct {
+	ProxyClient
+	closed int32 // accessed atomically
+}
+
+func (c *closableClient) Close() error {
+	atomic.AddInt32(&c.closed, 1)
+	return nil
+}
+
+func (s *E2ETestSuite) TestScopeUpstreams() {
+	r := &routing{scopeUpstreams: map[string]map[string]bool{
+		"scope1": {"up1": true, "up2": true},
+		"scope2": {"up2": true, "up3": true},
+	}}
+	ids := func(scopes ...string) (peerIDs []*PeerIdentifier) {
+		for _, scope := range scopes {
+			peerIDs = append(peerIDs, &PeerIdentifier{Scope: scope})
+		}
+		return
+	}
+	upstreams := []string{"up1", "up2", "up3"}
+	s.Equal(upstreams, r.allowedUpstreams(nil, upstreams))
+	s.Equal(upstreams, r.allowedUpstreams(ids("scope3"), upstreams))
+	s.Equal([]string{"up1", "up2"},
+		r.allowedUpstreams(ids("scope1", "scope3"), upstreams))
+	s.Equal([]string{"up2"},
+		r.allowedUpstreams(ids("scope1", "scope2"), upstreams))
+	s.Empty(r.allowedUpstreams(ids("scope1"), []string{"up3"}))
+
+	// the clients of the server are identified by their TLS certificates
+	config := *s.svrConfig
+	config.Upstreams = map[string]ProxyConfig{
+		"direct": {Protocol: "direct"},
+		"other":  {Protocol: "direct"},
+	}
+	config.Rules = map[string]RuleConfig{
+		"target": {IPs: []string{"127.0.0.1"}, Upstreams: []string{"direct"}},
+	}
+	config.Scopes = map[string][]string{"transport.tls": {"undefined"}}
+	_, err := s.svrApp.newRouting(config)
+	s.Error(err)
+
+	config.Scopes = map[string][]string{"transport.tls": {"other"}}
+	r, err = s.svrApp.newRouting(config)
+	s.Require().NoError(err)
+	s.svrApp.setRouting(r)
+	_, _, pErr := s.cli.Request(context.Background(), s.targetAddr)
+	s.Require().NotNil(pErr)
+	s.EqualValues(ProxyNotAllowed, pErr.ErrType)
+
+	config.Scopes = map[string][]string{"transport.tls": {"direct", "other"}}
+	r, err = s.svrApp.newRouting(config)
+	s.Require().NoError(err)
+	s.svrApp.setRouting(r)
+	conn, _, pErr := s.cli.Request(context.Background(), s.targetAddr)
+	if s.Nil(pErr) {
+		s.NoError(conn.Close())
+	}
+}
+
+func (s *E2ETestSuite) TestDownstreamDefaultUpstreams() {
+	disabled := false
+	config := *s.svrConfig
+	config.Upstreams = map[string]ProxyConfig{
+		"direct": {Protocol: "direct"},
+		"dead": {Protocol: "socks5", Settings: map[string]interface{}{
+			"address": "127.0.0.1:64891"}},
+		"other": {Protocol: "direct", Enabled: &disabled},
+	}
+	config.Rules = nil // all the requests are unmatched
+	downstream := config.Downstreams["proxy"]
+	config.Downstreams = map[string]ProxyConfig{"proxy": downstream}
+	downstream.DefaultUpstreams = []string{"undefined"}
+	config.Downstreams["proxy"] = downstream
+	_, err := s.svrApp.newRouting(config)
+	s.Error(err)
+	downstream.DefaultUpstreams = []string{"other"}
+	config.Downstreams["proxy"] = downstream
+	_, err = s.svrApp.newRouting(config)
+	s.Error(err) // all disabled
+
+	downstream.DefaultUpstreams = []string{"dead", "other"}
+	config.Downstreams["proxy"] = downstream
+	r, err := s.svrApp.newRouting(config)
+	s.Require().NoError(err)
+	s.Equal(map[string][]string{"proxy": {"dead"}}, r.dsDefaults)
+	s.svrApp.setRouting(r)
+	_, _, pErr := s.cli.Request(context.Background(), s.targetAddr)
+	s.NotNil(pErr)
+
+	// the global default applies again without the downstream one
+	config.Downstreams = s.svrConfig.Downstreams
+	r, err = s.svrApp.newRouting(config)
+	s.Require().NoError(err)
+	s.Empty(r.dsDefaults)
+	s.svrApp.setRouting(r)
+	conn, _, pErr := s.cli.Request(context.Background(), s.targetAddr)
+	if s.Nil(pErr) {
+		s.NoError(conn.Close())
+	}
+}
+
+func (s *E2ETestSuite) TestResolveVia() {
+	config := *s.svrConfig
+	config.Upstreams = map[string]ProxyConfig{
+		"direct": {Protocol: "direct"},
+		"dead": {Protocol: "socks5", Settings: map[string]interface{}{
+			"address": "127.0.0.1:64891"}},
+		"proxied": {Protocol: "direct", Settings: map[string]interface{}{
+			"resolve_via": "undefined"}},
+	}
+	config.Rules = map[string]RuleConfig{"target": {
+		Domains: []string{"thestral.test"}, Upstreams: []string{"proxied"}}}
+	_, err := s.svrApp.newRouting(config)
+	s.Error(err)
+	config.Upstreams["proxied"] = ProxyConfig{Protocol: "direct",
+		Settings: map[string]interface{}{"resolve_via": "proxied"}}
+	_, err = s.svrApp.newRouting(config)
+	s.Error(err) // resolving via itself
+
+	config.Upstreams["proxied"] = ProxyConfig{Protocol: "direct",
+		Settings: map[string]interface{}{"resolve_via": "dead"}}
+	r, err := s.svrApp.newRouting(config)
+	s.Require().NoError(err)
+	domainTarget := &DomainNameAddr{
+		DomainName: "thestral.test", Port: s.targetAddr.(*TCP4Addr).Port}
+	s.Equal("via:dead", r.resolvePathOf("proxied", domainTarget))
+	s.Equal("local", r.resolvePathOf("direct", domainTarget))
+	s.Equal("remote", r.resolvePathOf("dead", domainTarget))
+	s.Empty(r.resolvePathOf("proxied", s.targetAddr))
+	s.svrApp.setRouting(r)
+	_, _, pErr := s.cli.Request(context.Background(), domainTarget)
+	s.NotNil(pErr) // the upstream resolving the domain is dead
+}
+
+func (s *E2ETestSuite) TestDisabledProxies() {
+	disabled := false
+	config := *s.svrConfig
+	config.Upstreams = map[string]ProxyConfig{
+		"direct": {Protocol: "direct"},
+		"other":  {Protocol: "direct", Enabled: &disabled},
+	}
+	config.Rules = map[string]RuleConfig{
+		"target": {IPs: []string{"127.0.0.1"}, Upstreams: []string{"other"}},
+	}
+	_, err := s.svrApp.newRouting(config)
+	s.Error(err) // no enabled upstream for the rule
+
+	config.Rules = map[string]RuleConfig{"target": {
+		IPs: []string{"127.0.0.1"}, Upstreams: []string{"direct", "other"}}}
+	config.Scopes = map[string][]string{"transport.tls": {"other"}}
+	r, err := s.svrApp.newRouting(config)
+	s.Require().NoError(err)
+	s.Equal([]string{"direct"}, r.upstreamNames)
+	_, upstreams := r.ruleMatcher.MatchIP(net.IPv4(127, 0, 0, 1))
+	s.Equal([]string{"direct"}, upstreams)
+
+	config.Upstreams["direct"] = ProxyConfig{
+		Protocol: "direct", Enabled: &disabled}
+	_, err = s.svrApp.newRouting(config)
+	s.Error(err) // no enabled upstream at all
+
+	config = Config{
+		Downstreams: map[string]ProxyConfig{
+			"enabled": {Protocol: "socks5", Settings: map[string]interface{}{
+				"address": "127.0.0.1:0"}},
+			"disabled": {Protocol: "socks5", Enabled: &disabled},
+		},
+		Upstreams: map[string]ProxyConfig{"direct": {Protocol: "direct"}},
+		Logging:   LoggingConfig{Level: "fatal"},
+	}
+	app, err := NewThestralApp(config)
+	s.Require().NoError(err)
+	s.Len(app.downstreams, 1)
+	s.Contains(app.downstreams, "enabled")
+
+	delete(config.Downstreams, "enabled")
+	_, err = NewThestralApp(config)
+	s.Error(err)
+}
+
+func (s *E2ETestSuite) TestSeededUpstreamSelection() {
+	config := *s.svrConfig
+	weight := 2
+	config.Upstreams = map[string]ProxyConfig{
+		"a": {Protocol: "direct", Weight: &weight},
+		"b": {Protocol: "direct"},
+		"c": {Protocol: "direct"},
+	}
+	selectAll := func(seed int64) (selected []string) {
+		app, err := newThestralApp(config, true, NewLockedRand(seed))
+		s.Require().NoError(err)
+		for i := 0; i < 100; i++ {
+			selected = append(selected, app.routing.selector.Select(
+				"", "", []string{"a", "b", "c"}))
+		}
+		return
+	}
+	s.Equal(selectAll(1), selectAll(1))
+	s.NotEqual(selectAll(1), selectAll(2))
+}
+
+func (s *E2ETestSuite) TestUpstreamWeights() {
+	config := *s.svrConfig
+	drained, negative := 0, -1
+	config.Upstreams = map[string]ProxyConfig{
+		"a": {Protocol: "direct", Weight: &drained},
+		"b": {Protocol: "direct"},
+	}
+	app, err := NewThestralApp(config)
+	s.Require().NoError(err)
+	for i := 0; i < 100; i++ {
+		s.Equal("b", app.routing.selector.Select("", "", []string{"a", "b"}))
+	}
+
+	config.Upstreams["a"] = ProxyConfig{Protocol: "direct", Weight: &negative}
+	_, err = NewThestralApp(config)
+	s.Error(err)
+}
+
+func (s *E2ETestSuite) TestBoundAddr() {
+	downstream := func(port int, boundAddr string) ProxyConfig {
+		return ProxyConfig{
+			Protocol:  "socks5",
+			BoundAddr: boundAddr,
+			Settings: map[string]interface{}{
+				"address": fmt.Sprintf("127.0.0.1:%d", port)},
+		}
+	}
+	config := Config{
+		Downstreams: map[string]ProxyConfig{"invalid": downstream(0, "x")},
+		Upstreams:   map[string]ProxyConfig{"direct": {Protocol: "direct"}},
+		Logging:     LoggingConfig{Level: "fatal"},
+	}
+	_, err := NewThestralApp(config)
+	s.Error(err)
+
+	config.Downstreams = map[string]ProxyConfig{
+		"default": downstream(64897, ""),
+		"target":  downstream(64898, "target"),
+		"fixed":   downstream(64899, "203.0.113.1:1080"),
+	}
+	app, err := NewThestralApp(config)
+	s.Require().NoError(err)
+	go func() { _ = app.Run(s.appCtx) }()
+	time.Sleep(time.Millisecond * 100) // ensure the servers are started
+
+	for port, expected := range map[int]string{
+		64897: "", // the local address of the direct connection
+		64898: s.targetAddr.String(),
+		64899: "203.0.113.1:1080",
+	} {
+		cli, err := CreateProxyClient(downstream(port, ""))
+		s.Require().NoError(err)
+		conn, boundAddr, pErr := cli.Request(
+			context.Background(), s.targetAddr)
+		s.Require().Nil(pErr)
+		_ = conn.Close()
+		if expected == "" {
+			s.NotEqual(s.targetAddr.String(), boundAddr.String())
+		} else {
+			s.Equal(expected, boundAddr.String())
+		}
+	}
+}
+
+func (s *E2ETestSuite) TestDownstreamMaxConns() {
+	address := "127.0.0.1:64894"
+	app, err := NewThestralApp(Config{
+		Downstreams: map[string]ProxyConfig{"limited": {
+			Protocol: "socks5",
+			MaxConns: 1,
+			Settings: map[string]interface{}{"address": address},
+		}},
+		Upstreams: map[string]ProxyConfig{"direct": {Protocol: "direct"}},
+		Logging:   LoggingConfig{Level: "fatal"},
+	})
+	s.Require().NoError(err)
+	go func() { _ = app.Run(s.appCtx) }()
+	time.Sleep(time.Millisecond * 100) // ensure the server is started
+	cli, err := CreateProxyClient(ProxyConfig{
+		Protocol: "socks5", Settings: map[string]interface{}{"address": address},
+	})
+	s.Require().NoError(err)
+
+	conn, _, pErr := cli.Request(context.Background(), s.targetAddr)
+	s.Require().Nil(pErr)
+	s.EqualValues(1, app.monitor.Report().DownstreamConns["limited"])
+	_, _, pErr = cli.Request(context.Background(), s.targetAddr)
+	s.Require().NotNil(pErr)
+	s.EqualValues(ProxyGeneralErr, pErr.ErrType)
+
+	s.NoError(conn.Close())
+	time.Sleep(time.Millisecond * 100) // ensure the tunnel is closed
+	s.EqualValues(0, app.monitor.Report().DownstreamConns["limited"])
+	conn, _, pErr = cli.Request(context.Background(), s.targetAddr)
+	if s.Nil(pErr) {
+		s.NoError(conn.Close())
+	}
+}
+
+func (s *E2ETestSuite) TestDownstreamQueue() {
+	address := "127.0.0.1:64896"
+	config := Config{
+		Downstreams: map[string]ProxyConfig{"limited": {
+			Protocol:  "socks5",
+			MaxQueued: -1,
+			Settings:  map[string]interface{}{"address": address},
+		}},
+		Upstreams: map[string]ProxyConfig{"direct": {Protocol: "direct"}},
+		Logging:   LoggingConfig{Level: "fatal"},
+	}
+	_, err := NewThestralApp(config)
+	s.Error(err)
+
+	config.Downstreams["limited"] = ProxyConfig{
+		Protocol:  "socks5",
+		MaxConns:  1,
+		MaxQueued: 1,
+		Settings:  map[string]interface{}{"address": address},
+	}
+	app, err := NewThestralApp(config)
+	s.Require().NoError(err)
+	go func() { _ = app.Run(s.appCtx) }()
+	time.Sleep(time.Millisecond * 100) // ensure the server is started
+	cli, err := CreateProxyClient(ProxyConfig{
+		Protocol: "socks5", Settings: map[string]interface{}{"address": address},
+	})
+	s.Require().NoError(err)
+
+	conn, _, pErr := cli.Request(context.Background(), s.targetAddr)
+	s.Require().Nil(pErr)
+	queuedErr := make(chan *ProxyError, 1)
+	go func() {
+		queuedConn, _, pErr := cli.Request(context.Background(), s.targetAddr)
+		if pErr == nil {
+			_ = queuedConn.Close()
+		}
+		queuedErr <- pErr
+	}()
+	time.Sleep(time.Millisecond * 100) // ensure the request is queued
+	s.EqualValues(1, app.monitor.Report().DownstreamQueued["limited"])
+
+	// the queue is full
+	_, _, pErr = cli.Request(context.Background(), s.targetAddr)
+	s.Require().NotNil(pErr)
+	s.EqualValues(ProxyGeneralErr, pErr.ErrType)
+
+	s.NoError(conn.Close())
+	s.Nil(<-queuedErr)
+	s.EqualValues(0, app.monitor.Report().DownstreamQueued["limited"])
+}
+
+func (s *E2ETestSuite) TestDownstreamRateLimit() {
+	address := "127.0.0.1:64895"
+	config := Config{
+		Downstreams: map[string]ProxyConfig{"limited": {
+			Protocol:  "socks5",
+			RateLimit: &RateLimitConfig{Rate: -1},
+			Settings:  map[string]interface{}{"address": address},
+		}},
+		Upstreams: map[string]ProxyConfig{"direct": {Protocol: "direct"}},
+		Logging:   LoggingConfig{Level: "fatal"},
+	}
+	_, err := NewThestralApp(config)
+	s.Error(err)
+
+	config.Downstreams["limited"] = ProxyConfig{
+		Protocol:  "socks5",
+		RateLimit: &RateLimitConfig{Rate: 0.001, Burst: 2},
+		Settings:  map[string]interface{}{"address": address},
+	}
+	app, err := NewThestralApp(config)
+	s.Require().NoError(err)
+	go func() { _ = app.Run(s.appCtx) }()
+	time.Sleep(time.Millisecond * 100) // ensure the server is started
+	cli, err := CreateProxyClient(ProxyConfig{
+		Protocol: "socks5", Settings: map[string]interface{}{"address": address},
+	})
+	s.Require().NoError(err)
+
+	for i := 0; i < 2; i++ {
+		conn, _, pErr := cli.Request(context.Background(), s.targetAddr)
+		if s.Nil(pErr) {
+			s.NoError(conn.Close())
+		}
+	}
+	_, _, pErr := cli.Request(context.Background(), s.targetAddr)
+	s.Require().NotNil(pErr)
+	s.EqualValues(ProxyGeneralErr, pErr.ErrType)
+}
+
+// connTransport "dials" a connection made beforehand.
+type connTransport struct {
+	TCPTransport
+	conn net.Conn
+}
+
+func (t connTransport) Dial(context.Context, string) (net.Conn, error) {
+	return t.conn, nil
+}
+
+func (s *E2ETestSuite) TestRelayLoop() {
+	address := "127.0.0.1:64901"
+	config := Config{
+		Downstreams: map[string]ProxyConfig{"proxy": {
+			Protocol:  "socks5",
+			Transport: &TransportConfig{ProxyProtocol: true},
+			Settings:  map[string]interface{}{"address": address},
+		}},
+		Upstreams: map[string]ProxyConfig{"direct": {
+			Protocol: "direct",
+			Settings: map[string]interface{}{"send_proxy_protocol": true},
+		}},
+		Logging: LoggingConfig{Level: "fatal"},
+		Misc:    MiscConfig{MaxRelayHops: -1},
+	}
+	_, err := NewThestralApp(config)
+	s.Error(err)
+
+	config.Misc.MaxRelayHops = 0
+	app, err := NewThestralApp(config)
+	s.Require().NoError(err)
+	go func() { _ = app.Run(s.appCtx) }()
+	time.Sleep(time.Millisecond * 100) // ensure the server is started
+
+	// a header without the relay hops, e.g. from a load balancer
+	conn, err := net.Dial("tcp", address)
+	s.Require().NoError(err)
+	defer conn.Close() // nolint: errcheck
+	_, err = io.WriteString(
+		conn, "PROXY TCP4 127.0.0.1 127.0.0.1 1234 64901\r\n")
+	s.Require().NoError(err)
+	cli := &SOCKS5Client{Transport: connTransport{conn: conn}, Addr: address}
+	loopAddr, err := ParseAddress(address)
+	s.Require().NoError(err)
+	tunnel, _, pErr := cli.Request(context.Background(), loopAddr)
+	s.Require().Nil(pErr)
+
+	// the request relayed back to the app through the tunnel is rejected
+	cli = &SOCKS5Client{
+		Transport: connTransport{conn: tunnel.(net.Conn)}, Addr: address}
+	_, _, pErr = cli.Request(context.Background(), s.targetAddr)
+	s.Require().NotNil(pErr)
+	s.EqualValues(ProxyNotAllowed, pErr.ErrType)
+}
+
+func (s *E2ETestSuite) TestHalfClose() {
+	// the target responds after reading the whole request
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	s.Require().NoError(err)
+	defer target.Close() // nolint: errcheck
+	go func() {
+		for {
+			conn, err := target.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close() // nolint: errcheck
+				request, _ := ioutil.ReadAll(conn)
+				time.Sleep(time.Millisecond * 100) // after the half-close
+				_, _ = conn.Write(append([]byte("re: "), request...))
+			}()
+		}
+	}()
+	targetAddr, err := FromNetAddr(target.Addr())
+	s.Require().NoError(err)
+
+	address := "127.0.0.1:64902"
+	config := Config{
+		Downstreams: map[string]ProxyConfig{"proxy": {
+			Protocol: "socks5",
+			Settings: map[string]interface{}{"address": address},
+		}},
+		Upstreams: map[string]ProxyConfig{"direct": {Protocol: "direct"}},
+		Logging:   LoggingConfig{Level: "fatal"},
+		Misc:      MiscConfig{HalfClose: true},
+	}
+	app, err := NewThestralApp(config)
+	s.Require().NoError(err)
+	go func() { _ = app.Run(s.appCtx) }()
+	time.Sleep(time.Millisecond * 100) // ensure the server is started
+	cli, err := CreateProxyClient(ProxyConfig{
+		Protocol: "socks5", Settings: map[string]interface{}{"address": address},
+	})
+	s.Require().NoError(err)
+
+	conn, _, pErr := cli.Request(context.Background(), targetAddr)
+	s.Require().Nil(pErr)
+	defer conn.Close() // nolint: errcheck
+	_, err = io.WriteString(conn, "hello")
+	s.Require().NoError(err)
+	s.Require().NoError(conn.(*net.TCPConn).CloseWrite())
+	response, err := ioutil.ReadAll(conn)
+	s.NoError(err)
+	s.Equal("re: hello", string(response))
+	time.Sleep(time.Millisecond * 100) // ensure the tunnel is closed
+	s.EqualValues(1,
+		app.monitor.Report().ClosedTunnels[TunnelClientClosed])
+}
+
+func (s *E2ETestSuite) TestSOCKS5Bind() {
+	bindAddr, plainAddr := "127.0.0.1:64903", "127.0.0.1:64904"
+	config := Config{
+		Downstreams: map[string]ProxyConfig{
+			"bind": {Protocol: "socks5", Settings: map[string]interface{}{
+				"address": bindAddr, "bind": true}},
+			"plain": {Protocol: "socks5", Settings: map[string]interface{}{
+				"address": plainAddr}},
+		},
+		Upstreams: map[string]ProxyConfig{"direct": {Protocol: "direct"}},
+		Logging:   LoggingConfig{Level: "fatal"},
+	}
+	app, err := NewThestralApp(config)
+	s.Require().NoError(err)
+	go func() { _ = app.Run(s.appCtx) }()
+	time.Sleep(time.Millisecond * 100) // ensure the server is started
+
+	// the replies with IPv4 addresses, i.e. VER, REP, RSV, ATYP, ADDR and PORT
+	readReply := func(conn net.Conn) (byte, string) {
+		reply := make([]byte, 10)
+		_, err := io.ReadFull(conn, reply)
+		s.Require().NoError(err)
+		return reply[1], (&TCP4Addr{IP: net.IP(reply[4:8]),
+			Port: binary.BigEndian.Uint16(reply[8:])}).String()
+	}
+	// a BIND request expecting the connection from 127.0.0.1
+	request := func(address string) (net.Conn, byte, string) {
+		conn, err := net.Dial("tcp", address)
+		s.Require().NoError(err)
+		_, err = conn.Write([]byte{5, 1, 0, 5, 2, 0, 1, 127, 0, 0, 1, 0, 0})
+		s.Require().NoError(err)
+		hello := make([]byte, 2)
+		_, err = io.ReadFull(conn, hello)
+		s.Require().NoError(err)
+		rep, addr := readReply(conn)
+		return conn, rep, addr
+	}
+
+	conn, rep, _ := request(plainAddr)
+	s.NoError(conn.Close())
+	s.EqualValues(ProxyCmdUnsupported, rep)
+
+	conn, rep, boundAddr := request(bindAddr)
+	defer conn.Close() // nolint: errcheck
+	s.Require().EqualValues(0, rep)
+	peer, err := net.Dial("tcp", boundAddr)
+	s.Require().NoError(err)
+	defer peer.Close() // nolint: errcheck
+	rep, peerAddr := readReply(conn)
+	s.Require().EqualValues(0, rep)
+	s.Equal(peer.LocalAddr().String(), peerAddr)
+
+	_, err = io.WriteString(peer, "hello")
+	s.Require().NoError(err)
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(conn, buf)
+	s.NoError(err)
+	s.Equal("hello", string(buf))
+	_, err = io.WriteString(conn, "world")
+	s.Require().NoError(err)
+	_, err = io.ReadFull(peer, buf)
+	s.NoError(err)
+	s.Equal("world", string(buf))
+}
+
+func (s *E2ETestSuite) TestAdminGRPC() {
+	_, err := newAdminTransport(AdminGRPCConfig{})
+	s.Error(err)
+	transport, err := newAdminTransport(AdminGRPCConfig{
+		Address: "127.0.0.1:64900",
+		TLS: &TLSConfig{
+			Cert: "test_files/test.server.pem",
+			Key:  "test_files/test.server.key.pem",
+		},
+	})
+	s.Require().NoError(err)
+	listener, err := transport.Listen("127.0.0.1:64900")
+	s.Require().NoError(err)
+	svr := s.svrApp.newAdminGRPCServer("secret")
+	go func() { _ = svr.Serve(listener) }()
+	defer svr.Stop()
+
+	pool := x509.NewCertPool()
+	caPEM, err := ioutil.ReadFile("test_files/ca.pem")
+	s.Require().NoError(err)
+	s.Require().True(pool.AppendCertsFromPEM(caPEM))
+	cc, err := grpc.NewClient("127.0.0.1:64900", grpc.WithTransportCredentials(
+		credentials.NewTLS(&tls.Config{RootCAs: pool})))
+	s.Require().NoError(err)
+	defer cc.Close() // nolint: errcheck
+	cli := admin.NewAdminClient(cc)
+
+	_, err = cli.GetStats(context.Background(), &admin.GetStatsRequest{})
+	s.Equal(codes.Unauthenticated, status.Code(err))
+	ctx := metadata.AppendToOutgoingContext(
+		context.Background(), "authorization", "Bearer secret")
+
+	// tunnels
+	conn, _, pErr := s.cli.Request(context.Background(), s.targetAddr)
+	s.Require().Nil(pErr)
+	defer conn.Close() // nolint: errcheck
+	buf := []byte("hello")
+	_, err = conn.Write(buf)
+	s.Require().NoError(err)
+	_, err = io.ReadFull(conn, buf)
+	s.Require().NoError(err)
+	tunnels, err := cli.ListTunnels(ctx, &admin.ListTunnelsRequest{})
+	s.Require().NoError(err)
+	s.Require().Len(tunnels.Tunnels, 1)
+	tunnel := tunnels.Tunnels[0]
+	s.Equal(s.targetAddr.String(), tunnel.TargetAddr)
+	s.Equal("direct", tunnel.Upstream)
+	s.EqualValues(5, tunnel.BytesUploaded)
+	s.NotEmpty(tunnel.ClientIds)
+
+	stats, err := cli.GetStats(ctx, &admin.GetStatsRequest{})
+	s.Require().NoError(err)
+	s.EqualValues(1, stats.ActiveTunnels)
+	var report AppMonitorReport
+	s.NoError(json.Unmarshal([]byte(stats.ReportJson), &report))
+	s.Len(report.Tunnels, 1)
+
+	_, err = cli.CloseTunnel(ctx, &admin.CloseTunnelRequest{RequestId: "x"})
+	s.Equal(codes.NotFound, status.Code(err))
+	_, err = cli.CloseTunnel(
+		ctx, &admin.CloseTunnelRequest{RequestId: tunnel.RequestId})
+	s.NoError(err)
+	_, err = ioutil.ReadAll(conn)
+	s.NoError(err)
+
+	// upstreams
+	_, err = cli.SetUpstreamEnabled(ctx, &admin.SetUpstreamEnabledRequest{
+		Upstream: "not_exists", Enabled: false})
+	s.Equal(codes.NotFound, status.Code(err))
+	_, err = cli.SetUpstreamEnabled(ctx, &admin.SetUpstreamEnabledRequest{
+		Upstream: "direct", Enabled: false})
+	s.Equal(codes.FailedPrecondition, status.Code(err)) // no upstream left
+	_, err = cli.SetUpstreamEnabled(ctx, &admin.SetUpstreamEnabledRequest{
+		Upstream: "direct", Enabled: true})
+	s.NoError(err)
+
+	// rules
+	tmpDir, err := ioutil.TempDir("", "thestral2_TestAdminGRPC")
+	s.Require().NoError(err)
+	defer func() { _ = os.RemoveAll(tmpDir) }()
+	configFile := path.Join(tmpDir, "config.yml")
+	s.Require().NoError(ioutil.WriteFile(configFile, []byte(
+		"rules:\n  reloaded:\n    domains: [reloaded.example]\n"), 0600))
+	s.svrApp.SetConfigFile(configFile)
+	_, err = cli.ReloadRules(ctx, &admin.ReloadRulesRequest{})
+	s.Require().NoError(err)
+	s.Contains(s.svrApp.config.Rules, "reloaded")
+
+	// reflection
+	reflectionCli := grpc_reflection_v1.NewServerReflectionClient(cc)
+	listReq := &grpc_reflection_v1.ServerReflectionRequest_ListServices{}
+	stream, err := reflectionCli.ServerReflectionInfo(context.Background())
+	s.Require().NoError(err)
+	_ = stream.Send(
+		&grpc_reflection_v1.ServerReflectionRequest{MessageRequest: listReq})
+	_, err = stream.Recv()
+	s.Equal(codes.Unauthenticated, status.Code(err))
+	stream, err = reflectionCli.ServerReflectionInfo(ctx)
+	s.Require().NoError(err)
+	s.Require().NoError(stream.Send(
+		&grpc_reflection_v1.ServerReflectionRequest{MessageRequest: listReq}))
+	resp, err := stream.Recv()
+	s.Require().NoError(err)
+	var services []string
+	for _, svc := range resp.GetListServicesResponse().GetService() {
+		services = append(services, svc.Name)
+	}
+	s.Contains(services, "thestral2.admin.Admin")
+}
+
+func (s *E2ETestSuite) TestCompressionMethodOf() {
+	trans, err := CreateTransport(&TransportConfig{
+		Compression: "zstd", CompressionNegotiation: true})
+	s.Require().NoError(err)
+	listener, err := trans.Listen("127.0.0.1:0")
+	s.Require().NoError(err)
+	defer listener.Close() // nolint: errcheck
+	go func() {
+		if conn, err := listener.Accept(); err == nil {
+			_, _ = conn.Read(make([]byte, 1)) // negotiates
+			_ = conn.Close()
+		}
+	}()
+
+	conn, err := trans.Dial(context.Background(), listener.Addr().String())
+	s.Require().NoError(err)
+	defer conn.Close() // nolint: errcheck
+	s.Equal("zstd", compressionMethodOf(conn))
+	client, server := net.Pipe()
+	defer client.Close() // nolint: errcheck
+	defer server.Close() // nolint: errcheck
+	s.Empty(compressionMethodOf(client))
+}
+
 func (s *E2ETestSuite) TestConnectFailed() {
 	addr := &DomainNameAddr{DomainName: "does.not.exist", Port: 80}
 	_, _, pErr := s.cli.Request(context.Background(), addr)
 	s.Require().NotNil(pErr)
-	s.Assert().EqualValues(ProxyConnectFailed, pErr.ErrType)
+	s.Assert().EqualValues(ProxyHostUnreachable, pErr.ErrType)
 	s.Assert().Error(pErr.Error)
 }
 
 func TestE2ETestSuite(t *testing.T) {
 	suite.Run(t, new(E2ETestSuite))
 }
+
+func BenchmarkRelay(b *testing.B) {
+	app := &Thestral{relayBufSize: defaultRelayBufferSize}
+	for _, c := range []struct {
+		name  string
+		relay func(dst, src *net.TCPConn) (int64, error)
+	}{
+		{"buffered", func(dst, src *net.TCPConn) (int64, error) {
+			return app.relayHalf(dst, src, relayTimeouts{}, func(uint32) {})
+		}},
+		{"spliced", func(dst, src *net.TCPConn) (int64, error) {
+			return relaySpliced(dst, src, func(uint32) {})
+		}},
+	} {
+		b.Run(c.name, func(b *testing.B) {
+			srcW, src, err := tcpConnPair()
+			if err != nil {
+				b.Fatal(err)
+			}
+			dst, dstR, err := tcpConnPair()
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer dstR.Close() // nolint: errcheck
+
+			go io.Copy(ioutil.Discard, dstR) // nolint: errcheck
+
+			chunk := make([]byte, 1024*1024)
+			b.SetBytes(int64(len(chunk)))
+			b.ResetTimer()
+			go func() {
+				for i := 0; i < b.N; i++ {
+					_, _ = srcW.Write(chunk)
+				}
+				_ = srcW.Close()
+			}()
+			if _, err = c.relay(dst, src); err != nil {
+				b.Fatal(err)
+			}
+			_ = dst.Close()
+			_ = src.Close()
+		})
+	}
+}
+
+// burstyReader reads bursts of 1MB, each after a pause of 10ms.
+type burstyReader struct {
+	left int // of the current burst
+}
+
+func (r *burstyReader) Read(b []byte) (int, error) {
+	if r.left == 0 {
+		time.Sleep(time.Millisecond * 10)
+		r.left = 1024 * 1024
+	}
+	if len(b) > r.left {
+		b = b[:r.left]
+	}
+	r.left -= len(b)
+	return len(b), nil
+}
+
+// slowWriter writes at about 100MB/s.
+type slowWriter struct{}
+
+func (slowWriter) Write(b []byte) (int, error) {
+	time.Sleep(time.Duration(len(b)) * 10)
+	return len(b), nil
+}
+
+// BenchmarkRelayAsymmetric relays from a bursty source to a slow destination,
+// which could take the bursts in the pauses if they were buffered.
+func BenchmarkRelayAsymmetric(b *testing.B) {
+	for _, watermark := range []uint{0, 1024 * 1024, 4 * 1024 * 1024} {
+		app := &Thestral{
+			relayBufSize: defaultRelayBufferSize, relayWatermark: watermark}
+		b.Run(fmt.Sprintf("watermark=%d", watermark), func(b *testing.B) {
+			b.SetBytes(1024 * 1024)
+			src := io.LimitReader(&burstyReader{}, int64(b.N)*1024*1024)
+			_, err := app.relayHalf(
+				slowWriter{}, src, relayTimeouts{}, func(uint32) {})
+			if err != nil {
+				b.Fatal(err)
+			}
+		})
+	}
+}
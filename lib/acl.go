@@ -0,0 +1,146 @@
+package lib
+
+import (
+	"context"
+	"net"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// IPACL is an access control list of the client IPs. The deny list takes
+// precedence over the allow list, and an IP matching neither of them is only
+// allowed if the allow list is empty. A nil IPACL allows all IPs.
+type IPACL struct {
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+// NewIPACL creates an IPACL from the given configuration. Both CIDRs and
+// single IPs are accepted.
+func NewIPACL(config ACLConfig) (*IPACL, error) {
+	acl := &IPACL{}
+	var err error
+	if acl.allow, err = parseIPNets(config.Allow); err != nil {
+		return nil, errors.WithMessage(err, "invalid 'allow' list")
+	}
+	if acl.deny, err = parseIPNets(config.Deny); err != nil {
+		return nil, errors.WithMessage(err, "invalid 'deny' list")
+	}
+	return acl, nil
+}
+
+func parseIPNets(patterns []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(patterns))
+	for _, pattern := range patterns {
+		_, ipNet, err := net.ParseCIDR(pattern)
+		if err != nil {
+			ip := net.ParseIP(pattern)
+			if ip == nil {
+				return nil, errors.New("failed to parse ip pattern: " + pattern)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			ipNet = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+// Allows checks whether the given IP is allowed by the list.
+func (a *IPACL) Allows(ip net.IP) bool {
+	if a == nil {
+		return true
+	}
+	for _, ipNet := range a.deny {
+		if ipNet.Contains(ip) {
+			return false
+		}
+	}
+	if len(a.allow) == 0 {
+		return true
+	}
+	for _, ipNet := range a.allow {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowsAddr checks whether the IP in the given "host:port" address is
+// allowed by the list. Addresses without a valid IP are not allowed unless
+// the list is nil.
+func (a *IPACL) AllowsAddr(addr string) bool {
+	if a == nil {
+		return true
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	if i := len(host) - 1; i >= 0 && host[0] == '[' && host[i] == ']' {
+		host = host[1:i]
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && a.Allows(ip)
+}
+
+// WrapTransACL wraps a Transport so that the connections from the clients
+// denied by the ACL are closed right after being accepted, before any
+// handshake of the upper layers.
+func WrapTransACL(logger *zap.SugaredLogger, inner Transport,
+	config ACLConfig) (Transport, error) {
+	acl, err := NewIPACL(config)
+	if err != nil {
+		return nil, err
+	}
+	return &aclTransWrapper{inner, acl, logger}, nil
+}
+
+type aclTransWrapper struct {
+	inner Transport
+	acl   *IPACL
+	log   *zap.SugaredLogger
+}
+
+// Close closes the inner transport, see closeTransport.
+func (w *aclTransWrapper) Close() error {
+	return closeTransport(w.inner)
+}
+
+func (w *aclTransWrapper) Dial(
+	ctx context.Context, address string) (net.Conn, error) {
+	return w.inner.Dial(ctx, address)
+}
+
+func (w *aclTransWrapper) Listen(address string) (net.Listener, error) {
+	listener, err := w.inner.Listen(address)
+	if err == nil {
+		listener = &aclListenerWrapper{listener, w}
+	}
+	return listener, err
+}
+
+type aclListenerWrapper struct {
+	net.Listener
+	trans *aclTransWrapper
+}
+
+func (w *aclListenerWrapper) Accept() (net.Conn, error) {
+	for {
+		conn, err := w.Listener.Accept()
+		if err != nil {
+			return conn, err
+		}
+		clientAddr := conn.RemoteAddr().String()
+		if w.trans.acl.AllowsAddr(clientAddr) {
+			return conn, nil
+		}
+		w.trans.log.Warnw("connection rejected by acl", "clientAddr", clientAddr)
+		_ = conn.Close()
+	}
+}
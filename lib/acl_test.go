@@ -0,0 +1,91 @@
+package lib
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestIPACL(t *testing.T) {
+	allowOnly, err := NewIPACL(ACLConfig{
+		Allow: []string{"10.0.0.0/8", "2001:db8::/32", "192.168.1.1"}})
+	require.NoError(t, err)
+	denyOnly, err := NewIPACL(ACLConfig{
+		Deny: []string{"10.0.0.0/8", "::1"}})
+	require.NoError(t, err)
+	both, err := NewIPACL(ACLConfig{
+		Allow: []string{"10.0.0.0/8"}, Deny: []string{"10.1.0.0/16"}})
+	require.NoError(t, err)
+
+	for _, c := range []struct {
+		acl     *IPACL
+		addr    string
+		allowed bool
+	}{
+		{nil, "1.2.3.4:1080", true},
+		{allowOnly, "10.2.3.4:1080", true},
+		{allowOnly, "[2001:db8::1]:1080", true},
+		{allowOnly, "192.168.1.1:1080", true},
+		{allowOnly, "192.168.1.2:1080", false},
+		{allowOnly, "[2001:db9::1]:1080", false},
+		{denyOnly, "10.2.3.4:1080", false},
+		{denyOnly, "[::1]:1080", false},
+		{denyOnly, "127.0.0.1:1080", true},
+		{both, "10.2.3.4:1080", true},
+		{both, "10.1.3.4:1080", false},
+		{both, "11.2.3.4:1080", false},
+		{denyOnly, "not an address", false},
+	} {
+		assert.Equal(t, c.allowed, c.acl.AllowsAddr(c.addr), c.addr)
+	}
+
+	_, err = NewIPACL(ACLConfig{Allow: []string{"10.0.0.0/33"}})
+	assert.Error(t, err)
+	_, err = NewIPACL(ACLConfig{Deny: []string{"localhost"}})
+	assert.Error(t, err)
+}
+
+func TestACLTransport(t *testing.T) {
+	for _, c := range []struct {
+		config  ACLConfig
+		allowed bool
+	}{
+		{ACLConfig{Allow: []string{"127.0.0.0/8"}}, true},
+		{ACLConfig{Deny: []string{"127.0.0.1"}}, false},
+	} {
+		trans, err := WrapTransACL(zap.NewNop().Sugar(), TCPTransport{}, c.config)
+		require.NoError(t, err)
+		listener, err := trans.Listen("127.0.0.1:0")
+		require.NoError(t, err)
+		go func() {
+			for {
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				_, _ = conn.Write([]byte("hello"))
+				_ = conn.Close()
+			}
+		}()
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		conn, err := trans.Dial(ctx, listener.Addr().String())
+		require.NoError(t, err)
+		buf := make([]byte, 5)
+		_, err = io.ReadFull(conn, buf)
+		if c.allowed {
+			assert.NoError(t, err)
+			assert.EqualValues(t, "hello", buf)
+		} else {
+			assert.Error(t, err)
+		}
+		_ = conn.Close()
+		_ = listener.Close()
+		cancel()
+	}
+}
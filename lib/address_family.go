@@ -0,0 +1,179 @@
+package lib
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// AddressFamily is the preference of a DirectTCPClient between the IPv4 and
+// the IPv6 addresses of the targets.
+type AddressFamily string
+
+// nolint: golint
+const (
+	AddrFamilyAuto       AddressFamily = "auto" // per RFC 6724, or the resolver
+	AddrFamilyPreferIPv4 AddressFamily = "prefer_ipv4"
+	AddrFamilyPreferIPv6 AddressFamily = "prefer_ipv6"
+	AddrFamilyIPv4Only   AddressFamily = "ipv4_only"
+	AddrFamilyIPv6Only   AddressFamily = "ipv6_only"
+)
+
+// parseAddressFamily parses the 'address_family' setting of a direct client.
+func parseAddressFamily(v interface{}) (AddressFamily, error) {
+	s, _ := v.(string)
+	switch f := AddressFamily(s); f {
+	case AddrFamilyAuto, AddrFamilyPreferIPv4, AddrFamilyPreferIPv6,
+		AddrFamilyIPv4Only, AddrFamilyIPv6Only:
+		return f, nil
+	default:
+		return "", errors.Errorf("invalid value for 'address_family': %v", v)
+	}
+}
+
+// isPreference tells whether both families are allowed but one goes first.
+func (f AddressFamily) isPreference() bool {
+	return f == AddrFamilyPreferIPv4 || f == AddrFamilyPreferIPv6
+}
+
+// network returns the network to dial with for the allowed families.
+func (f AddressFamily) network() string {
+	switch f {
+	case AddrFamilyIPv4Only:
+		return "tcp4"
+	case AddrFamilyIPv6Only:
+		return "tcp6"
+	default:
+		return "tcp"
+	}
+}
+
+// allows tells whether an IP is of an allowed family.
+func (f AddressFamily) allows(ip net.IP) bool {
+	switch f {
+	case AddrFamilyIPv4Only:
+		return ip.To4() != nil
+	case AddrFamilyIPv6Only:
+		return ip.To4() == nil
+	default:
+		return true
+	}
+}
+
+// sortIPs splits the allowed IPs into the ones to try first and the ones to
+// fall back to, keeping the order within each of them.
+func (f AddressFamily) sortIPs(ips []net.IP) (primaries, fallbacks []net.IP) {
+	for _, ip := range ips {
+		switch {
+		case !f.allows(ip):
+		case f == AddrFamilyPreferIPv4 && ip.To4() == nil,
+			f == AddrFamilyPreferIPv6 && ip.To4() != nil:
+			fallbacks = append(fallbacks, ip)
+		default:
+			primaries = append(primaries, ip)
+		}
+	}
+	return
+}
+
+// minDialAttemptTimeout is the least time given to each IP dialed by
+// dialSerial, unless the context has less than that left.
+const minDialAttemptTimeout = time.Second * 2
+
+// dialSerial dials the IPs in order until a connection is established. If
+// the context has a deadline, the time left is split among the IPs left, so
+// that an unresponsive one does not use up the time of the others.
+func dialSerial(ctx context.Context, dialer *net.Dialer, ips []net.IP,
+	port string) (conn net.Conn, err error) {
+	for i, ip := range ips {
+		attemptCtx, cancel := ctx, context.CancelFunc(func() {})
+		if deadline, ok := ctx.Deadline(); ok {
+			attemptCtx, cancel = context.WithDeadline(ctx,
+				partialDeadline(time.Now(), deadline, len(ips)-i))
+		}
+		conn, err = dialer.DialContext(
+			attemptCtx, "tcp", net.JoinHostPort(ip.String(), port))
+		cancel()
+		if err == nil || ctx.Err() != nil {
+			break
+		}
+	}
+	return
+}
+
+// partialDeadline returns the deadline of dialing one of the addresses left,
+// which is an equal share of the time left but no less than
+// minDialAttemptTimeout, and never beyond the whole deadline.
+func partialDeadline(now, deadline time.Time, addrsLeft int) time.Time {
+	timeLeft := deadline.Sub(now)
+	timeout := timeLeft / time.Duration(addrsLeft)
+	if timeout < minDialAttemptTimeout {
+		timeout = minDialAttemptTimeout
+	}
+	if timeout >= timeLeft {
+		return deadline
+	}
+	return now.Add(timeout)
+}
+
+// dialHappyEyeballs dials the primary IPs in order, and races the fallback
+// ones after a head start of the FallbackDelay of the dialer, or as soon as
+// all the primary ones fail. The fallback ones are only tried after the
+// primary ones if the FallbackDelay is negative.
+func dialHappyEyeballs(ctx context.Context, dialer *net.Dialer,
+	primaries, fallbacks []net.IP, port string) (net.Conn, error) {
+	if len(primaries) == 0 || len(fallbacks) == 0 || dialer.FallbackDelay < 0 {
+		return dialSerial(ctx, dialer, append(primaries, fallbacks...), port)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	type dialResult struct {
+		conn    net.Conn
+		err     error
+		primary bool
+	}
+	results := make(chan dialResult, 2)
+	dial := func(ips []net.IP, primary bool) {
+		conn, err := dialSerial(ctx, dialer, ips, port)
+		results <- dialResult{conn, err, primary}
+	}
+	go dial(primaries, true)
+	pending := 1
+	timer := time.NewTimer(dialer.FallbackDelay)
+	defer timer.Stop()
+	fallbackCh := timer.C
+
+	var firstErr error
+	for {
+		select {
+		case <-fallbackCh:
+		case result := <-results:
+			pending--
+			if result.err == nil {
+				// the loser, if any, is closed once established
+				go func(pending int) {
+					for ; pending > 0; pending-- {
+						if r := <-results; r.conn != nil {
+							_ = r.conn.Close()
+						}
+					}
+				}(pending)
+				return result.conn, nil
+			}
+			if firstErr == nil || result.primary {
+				firstErr = result.err
+			}
+			if fallbackCh == nil && pending == 0 {
+				return nil, firstErr
+			}
+		}
+		if fallbackCh != nil { // the head start is over
+			fallbackCh = nil
+			go dial(fallbacks, false)
+			pending++
+		}
+	}
+}
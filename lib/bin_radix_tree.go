@@ -3,6 +3,7 @@ package lib
 import (
 	"bytes"
 	"fmt"
+	"math/bits"
 )
 
 const bitStrWordSize = 32
@@ -33,7 +34,7 @@ func bitStrFromBytes(b []byte, n uint) bitStr {
 		shift := uint(16)
 		for i := uint(1); i < nTailingBytes; i++ {
 			lastWord |= uint32(b[nFullWord*4+i]) << shift
-			shift >>= 1
+			shift -= 8
 		}
 		str.Words[nw-1] = lastWord
 	}
@@ -118,6 +119,35 @@ func (s bitStr) CommPfxLen(o bitStr) uint {
 	return l
 }
 
+// wordAt returns the 32 bits starting from the given offset, padded with
+// zeros if there are not enough bits.
+func (s bitStr) wordAt(off uint) uint32 {
+	i, shift := off/bitStrWordSize, off%bitStrWordSize
+	w := s.Words[i] << shift
+	if shift != 0 && i+1 < uint(len(s.Words)) {
+		w |= s.Words[i+1] >> (bitStrWordSize - shift)
+	}
+	return w
+}
+
+// commPfxLenAt is equivalent to s.Substr(off, ...).CommPfxLen(o), but without
+// allocating a new bitStr.
+func (s bitStr) commPfxLenAt(off uint, o bitStr) uint {
+	n := s.BitLen - off
+	if n > o.BitLen {
+		n = o.BitLen
+	}
+	for l := uint(0); l < n; l += bitStrWordSize {
+		if m := s.wordAt(off+l) ^ o.Words[l/bitStrWordSize]; m != 0 {
+			if l += uint(bits.LeadingZeros32(m)); l < n {
+				return l
+			}
+			break
+		}
+	}
+	return n
+}
+
 func (s bitStr) Format(f fmt.State, c rune) {
 	fmt.Fprintf(f, "[%d]", s.BitLen)
 	if s.BitLen > 0 {
@@ -140,25 +170,21 @@ type brtNode struct {
 
 func (n *brtNode) FindPrefix(str bitStr) interface{} {
 	var lastHasData *brtNode
-	for str.BitLen > 0 && n != nil {
+	var off uint // bits of str consumed
+	for off < str.BitLen && n != nil {
 		if n.data != nil {
 			lastHasData = n
 		}
-		if str.Bit(0) { // 1
-			l := n.oPfx.BitLen
-			if str.CommPfxLen(n.oPfx) != l {
-				break
-			}
-			n = n.oChild
-			str = str.Substr(l, str.BitLen-l)
-		} else { // 0
-			l := n.zPfx.BitLen
-			if str.CommPfxLen(n.zPfx) != l {
-				break
-			}
-			n = n.zChild
-			str = str.Substr(l, str.BitLen-l)
+		pfx, child := &n.zPfx, n.zChild
+		if str.Bit(off) { // 1
+			pfx, child = &n.oPfx, n.oChild
+		}
+		l := pfx.BitLen
+		if str.commPfxLenAt(off, *pfx) != l {
+			break
 		}
+		n = child
+		off += l
 	}
 
 	if n != nil && n.data != nil {
@@ -175,8 +201,12 @@ func (n *brtNode) Insert(str bitStr, data interface{}) {
 	var prev *brtNode
 	key := str
 	for {
-		if str.BitLen == 0 {
-			panic("duplicated key found: " + fmt.Sprint(key))
+		if str.BitLen == 0 { // an existing node, which may be a split point
+			if n.data != nil {
+				panic("duplicated key found: " + fmt.Sprint(key))
+			}
+			n.data = data
+			return
 		}
 		if n == nil {
 			if str.Bit(0) { // 1
@@ -16,6 +16,11 @@ func TestBitStrFromBytes(t *testing.T) {
 	b2 := []byte{0x12, 0x34, 0x56, 0x78, 0x9a, 0xbc, 0xde, 0xf0, 0x87, 0x67}
 	a2 := bitStrFromBytes(b2, 78)
 	assert.True(t, e2.Equal(a2))
+
+	e3 := bitStr{[]uint32{0x12345678}, 31}
+	b3 := []byte{0x12, 0x34, 0x56, 0x78}
+	a3 := bitStrFromBytes(b3, 31)
+	assert.True(t, e3.Equal(a3))
 }
 
 func TestBitStrEqual(t *testing.T) {
@@ -80,6 +85,18 @@ func TestBitStrCommPfxLen(t *testing.T) {
 	assert.EqualValues(t, 49, d.CommPfxLen(a))
 }
 
+func TestBitStrCommPfxLenAt(t *testing.T) {
+	a := bitStr{[]uint32{0x12345678, 0xaaaaaaaa, 0x9abcdef0}, 96}
+	c := bitStr{[]uint32{0x12345678, 0xaaaaaaaa}, 60}
+	d := bitStr{[]uint32{0x12345678, 0xaaaafaaa, 0x9abcdef0, 0x55555555}, 128}
+	for _, o := range []bitStr{{}, c, d, a.Substr(7, 50), d.Substr(33, 70)} {
+		for off := uint(0); off <= a.BitLen; off++ {
+			expected := a.Substr(off, a.BitLen-off).CommPfxLen(o)
+			assert.Equal(t, expected, a.commPfxLenAt(off, o), "%v@%d", o, off)
+		}
+	}
+}
+
 func TestBinRadixTree(t *testing.T) {
 	mappings := []struct {
 		pfx  bitStr
@@ -96,6 +113,8 @@ func TestBinRadixTree(t *testing.T) {
 		{bitStr{[]uint32{0x5aef002b, 0x00000000}, 32}, 4},
 		{bitStr{[]uint32{0x5aef002b, 0x7c1fabc0}, 58}, 31},
 		{bitStr{[]uint32{0x5aef002b, 0x7c1fab80}, 58}, 32},
+		// at the split point of the above two
+		{bitStr{[]uint32{0x5aef002b, 0x7c1fab80}, 57}, 33},
 	}
 
 	queries := []struct {
@@ -117,6 +136,7 @@ func TestBinRadixTree(t *testing.T) {
 		{bitStr{[]uint32{0x5aef002b, 0xffffffff}, 64}, 4},
 		{bitStr{[]uint32{0x5aef002b, 0x7c1fabcf}, 64}, 31},
 		{bitStr{[]uint32{0x5aef002b, 0x7c1fab8f}, 64}, 32},
+		{bitStr{[]uint32{0x5aef002b, 0x7c1fab00}, 57}, 3},
 	}
 
 	root := &brtNode{}
@@ -0,0 +1,15 @@
+// +build !linux
+
+package lib
+
+import (
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// bindToDevice is only supported on Linux.
+func bindToDevice(iface string) (func(string, string, syscall.RawConn) error,
+	error) {
+	return nil, errors.New("binding to an interface is only supported on Linux")
+}
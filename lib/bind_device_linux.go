@@ -0,0 +1,23 @@
+package lib
+
+import (
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// bindToDevice returns a dialer control function binding the sockets to the
+// given network interface.
+func bindToDevice(iface string) (func(string, string, syscall.RawConn) error,
+	error) {
+	return func(_, _ string, c syscall.RawConn) error {
+		var err error
+		cErr := c.Control(func(fd uintptr) {
+			err = syscall.BindToDevice(int(fd), iface)
+		})
+		if cErr != nil {
+			err = cErr
+		}
+		return errors.Wrapf(err, "failed to bind to interface %s", iface)
+	}, nil
+}
@@ -1,18 +1,37 @@
 package lib
 
-import "sync"
+import (
+	"sync"
+	"sync/atomic"
+)
 
 // GlobalBufPool is a globally available BufFreeList for buffers of sizes
-// between 16B and 16K.
-var GlobalBufPool = NewBufFreeList(4, 16) // 16B -> 64K
+// between 16B and 4M, which are shared by the relays (see relay_buffer_size)
+// and the KCP transports. The max size of the buffers pooled can be lowered
+// by buf_pool_max_size to save memory, in which case the larger buffers are
+// allocated on each use, which is counted as misses in its stats.
+var GlobalBufPool = NewBufFreeList(4, 22) // 16B -> 4M
 
-// BufFreeList is a bucketing free list for byte buffers.
+// BufFreeList is a bucketing free list for byte buffers. Each bucket pools
+// the buffers of a power-of-2 size, so that buffers of different sizes, e.g.
+// the relay buffers and the small ones of the KCP frames, don't share one.
 type BufFreeList struct {
+	// accessed atomically, placed first for the 64-bit alignment
+	gets, puts, misses uint64
+	maxSize            uint64 // of the buffers pooled
+
 	minN  uint
 	maxN  uint
 	pools []*sync.Pool
 }
 
+// BufPoolStats is the statistics of a BufFreeList.
+type BufPoolStats struct {
+	Gets   uint64
+	Puts   uint64
+	Misses uint64 // gets allocating new buffers
+}
+
 // NewBufFreeList creates a BufFreeList for buffers of sizes in
 // [2^minN, 2^maxN] bytes.
 func NewBufFreeList(minN, maxN uint) *BufFreeList {
@@ -25,11 +44,13 @@ func NewBufFreeList(minN, maxN uint) *BufFreeList {
 
 	l := &BufFreeList{
 		minN: minN, maxN: maxN, pools: make([]*sync.Pool, maxN-minN+1),
+		maxSize: 1 << maxN,
 	}
 	for i := minN; i <= maxN; i++ {
 		size := 1 << i
 		l.pools[i-minN] = &sync.Pool{
 			New: func() interface{} {
+				atomic.AddUint64(&l.misses, 1)
 				return make([]byte, size)
 			},
 		}
@@ -37,24 +58,49 @@ func NewBufFreeList(minN, maxN uint) *BufFreeList {
 	return l
 }
 
+// SetMaxSize sets the max size of the buffers pooled, which is rounded up to
+// a power of 2 within [2^minN, 2^maxN]. Larger buffers are allocated by Get
+// and dropped by Free.
+func (l *BufFreeList) SetMaxSize(size uint) {
+	n := l.maxN
+	if size < 1<<l.maxN {
+		n = l.minN + l.getBucketIdx(size)
+	}
+	atomic.StoreUint64(&l.maxSize, 1<<n)
+}
+
 // Get return a byte slice of the given size.
 func (l *BufFreeList) Get(size uint) []byte {
 	if size == 0 {
 		return nil
 	}
-	if size > (1 << l.maxN) {
+	atomic.AddUint64(&l.gets, 1)
+	if uint64(size) > atomic.LoadUint64(&l.maxSize) {
+		atomic.AddUint64(&l.misses, 1)
 		return make([]byte, size)
 	}
 	p := l.pools[l.getBucketIdx(size)]
 	return p.Get().([]byte)[:size]
 }
 
-// Free puts back the given byte slice to the free list.
+// Free puts back the given byte slice to the free list. The ones not from
+// the buckets, e.g. allocated beyond the max size, are dropped.
 func (l *BufFreeList) Free(buf []byte) {
 	size := cap(buf)
-	if size > 0 && size <= (1<<l.maxN) {
+	if size >= 1<<l.minN && size&(size-1) == 0 &&
+		uint64(size) <= atomic.LoadUint64(&l.maxSize) {
 		idx := l.getBucketIdx(uint(size))
 		l.pools[idx].Put(buf)
+		atomic.AddUint64(&l.puts, 1)
+	}
+}
+
+// Stats returns the statistics of the free list so far.
+func (l *BufFreeList) Stats() BufPoolStats {
+	return BufPoolStats{
+		Gets:   atomic.LoadUint64(&l.gets),
+		Puts:   atomic.LoadUint64(&l.puts),
+		Misses: atomic.LoadUint64(&l.misses),
 	}
 }
 
@@ -0,0 +1,43 @@
+package lib
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBufFreeList(t *testing.T) {
+	l := NewBufFreeList(4, 10) // 16B -> 1K
+	for _, c := range []struct {
+		size, cap int
+	}{{1, 16}, {5, 16}, {16, 16}, {17, 32}, {1000, 1024}, {1025, 1025}} {
+		buf := l.Get(uint(c.size))
+		assert.Len(t, buf, c.size)
+		assert.Equal(t, c.cap, cap(buf), "%d", c.size)
+		l.Free(buf)
+	}
+	assert.Nil(t, l.Get(0))
+	stats := l.Stats()
+	assert.Equal(t, uint64(6), stats.Gets)
+	assert.Equal(t, uint64(5), stats.Puts) // the 1025B one is dropped
+	assert.True(t, stats.Misses >= 1 && stats.Misses <= 6)
+
+	// buffers of other sizes are dropped
+	l.Free(make([]byte, 8))
+	l.Free(make([]byte, 100))
+	assert.Equal(t, uint64(5), l.Stats().Puts)
+
+	l.SetMaxSize(100) // rounded up to 128B
+	misses := l.Stats().Misses
+	buf := l.Get(200)
+	assert.Equal(t, misses+1, l.Stats().Misses)
+	l.Free(l.Get(256)[:200]) // no longer pooled
+	l.Free(buf)
+	assert.Len(t, l.Get(128), 128)
+	assert.Equal(t, uint64(5), l.Stats().Puts)
+
+	l.SetMaxSize(1)
+	assert.Equal(t, 16, cap(l.Get(16)))
+	l.SetMaxSize(1 << 20)
+	assert.Equal(t, 1024, cap(l.Get(1024)))
+}
@@ -6,11 +6,14 @@ import (
 	"os"
 	"runtime"
 	"strconv"
+	"strings"
 	"sync/atomic"
+	"time"
 
 	"github.com/pkg/errors"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
+	"gopkg.in/natefinch/lumberjack.v2"
 )
 
 // ThestralVersion is an external string variable identifying the version
@@ -58,12 +61,17 @@ func (a *TCP4Addr) String() string {
 type TCP6Addr struct {
 	IP   net.IP
 	Port uint16
+	Zone string // the zone of a scoped address, e.g. "eth0" for fe80::1%eth0
 }
 
 func (*TCP6Addr) isAddress() {}
 
 func (a *TCP6Addr) String() string {
-	return net.JoinHostPort(a.IP.String(), strconv.Itoa(int(a.Port)))
+	host := a.IP.String()
+	if a.Zone != "" {
+		host += "%" + a.Zone
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(a.Port)))
 }
 
 // DomainNameAddr is an Address of an endpoint using a domain name.
@@ -91,7 +99,8 @@ func FromNetAddr(netAddr net.Addr) (Address, error) {
 	if ip := tcpAddr.IP.To4(); ip != nil {
 		return &TCP4Addr{IP: ip, Port: uint16(tcpAddr.Port)}, nil
 	}
-	return &TCP6Addr{IP: tcpAddr.IP, Port: uint16(tcpAddr.Port)}, nil
+	return &TCP6Addr{
+		IP: tcpAddr.IP, Port: uint16(tcpAddr.Port), Zone: tcpAddr.Zone}, nil
 }
 
 // ParseAddress tries to parse a string into an Address.
@@ -109,20 +118,41 @@ func ParseAddress(s string) (Address, error) {
 		return nil, errors.WithStack(err)
 	}
 
-	if ip := net.ParseIP(h); ip != nil {
+	if ip, zone := ParseIPZone(h); ip != nil {
 		if ip.To4() != nil {
 			return &TCP4Addr{ip, uint16(port)}, nil
 		}
-		return &TCP6Addr{ip, uint16(port)}, nil
+		return &TCP6Addr{ip, uint16(port), zone}, nil
 	}
 	return &DomainNameAddr{h, uint16(port)}, nil
 }
 
+// ParseIPZone parses an IP address with an optional zone, e.g. fe80::1%eth0.
+// Only IPv6 addresses may have zones. It returns a nil IP if s is invalid.
+func ParseIPZone(s string) (ip net.IP, zone string) {
+	if i := strings.LastIndexByte(s, '%'); i >= 0 {
+		s, zone = s[:i], s[i+1:]
+		if zone == "" {
+			return nil, ""
+		}
+	}
+	ip = net.ParseIP(s)
+	if ip == nil || (zone != "" && ip.To4() != nil) {
+		return nil, ""
+	}
+	return ip, zone
+}
+
 // CreateLogger creates a zap SugaredLogger from given configuration.
 func CreateLogger(config LoggingConfig) (*zap.SugaredLogger, error) {
+	rotator, err := newLogRotator(config)
+	if err != nil {
+		return nil, err
+	}
+
 	zapCfg := zap.NewProductionConfig()
 	zapCfg.Sampling = nil // disable sampling as it is useless in our scale
-	if config.File != "" {
+	if config.File != "" && rotator == nil {
 		zapCfg.OutputPaths = []string{config.File}
 	}
 	if config.Format != "" {
@@ -152,13 +182,111 @@ func CreateLogger(config LoggingConfig) (*zap.SugaredLogger, error) {
 		return nil, errors.New("unknown logging level: " + config.Level)
 	}
 
-	logger, err := zapCfg.Build()
+	var opts []zap.Option
+	var cores []zapcore.Core // replacing the default one if not empty
+	if rotator != nil {
+		var encoder zapcore.Encoder
+		if zapCfg.Encoding == "json" {
+			encoder = zapcore.NewJSONEncoder(zapCfg.EncoderConfig)
+		} else {
+			encoder = zapcore.NewConsoleEncoder(zapCfg.EncoderConfig)
+		}
+		// lumberjack writes synchronously and is safe for concurrent use
+		cores = append(cores, zapcore.NewCore(
+			encoder, zapcore.AddSync(rotator), zapCfg.Level))
+	}
+	if config.Syslog != nil {
+		syslogCore, err := newSyslogCore(*config.Syslog, zapCfg.Level)
+		if err != nil {
+			return nil, err
+		}
+		cores = append(cores, syslogCore)
+	}
+	if len(cores) > 0 {
+		opts = append(opts, zap.WrapCore(func(core zapcore.Core) zapcore.Core {
+			if config.File != "" && rotator == nil {
+				cores = append(cores, core) // the plain log file
+			}
+			return zapcore.NewTee(cores...)
+		}))
+	}
+	logger, err := zapCfg.Build(opts...)
 	if err != nil {
 		return nil, err
 	}
 	return logger.Sugar(), nil
 }
 
+// CreateAccessLogger creates a zap Logger writing the access log, whose
+// records are JSON lines with neither levels nor messages.
+func CreateAccessLogger(config AccessLogConfig) (*zap.Logger, error) {
+	if config.File == "" {
+		return nil, errors.New("'file' of the access log is required")
+	}
+	rotator, err := newLogRotator(LoggingConfig{
+		File:       config.File,
+		MaxSize:    config.MaxSize,
+		MaxAge:     config.MaxAge,
+		MaxBackups: config.MaxBackups,
+	})
+	if err != nil {
+		return nil, err
+	}
+	var sink zapcore.WriteSyncer
+	if rotator != nil {
+		sink = zapcore.AddSync(rotator)
+	} else if sink, _, err = zap.Open(config.File); err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	encoder := zapcore.NewJSONEncoder(zapcore.EncoderConfig{
+		TimeKey:        "ts",
+		EncodeTime:     zapcore.ISO8601TimeEncoder,
+		EncodeDuration: zapcore.SecondsDurationEncoder,
+	})
+	return zap.New(zapcore.NewCore(encoder, sink, zap.InfoLevel)), nil
+}
+
+// newLogRotator creates a rotating log file writer if any of the rotation
+// options is set, or returns nil otherwise.
+func newLogRotator(config LoggingConfig) (*lumberjack.Logger, error) {
+	if config.MaxSize == "" && config.MaxAge == "" && config.MaxBackups == 0 {
+		return nil, nil
+	}
+
+	rotator := &lumberjack.Logger{
+		Filename:   config.File,
+		MaxBackups: config.MaxBackups,
+		LocalTime:  true,
+	}
+	if config.MaxSize != "" {
+		size, err := ParseByteSize(config.MaxSize)
+		if err != nil {
+			return nil, err
+		} else if size == 0 {
+			return nil, errors.New("'max_size' should be greater than 0")
+		}
+		rotator.MaxSize = int((size-1)>>20 + 1) // in megabytes, rounded up
+	}
+	if config.MaxAge != "" {
+		age, err := time.ParseDuration(config.MaxAge)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		} else if age <= 0 {
+			return nil, errors.New("'max_age' should be greater than 0")
+		}
+		const day = time.Hour * 24
+		rotator.MaxAge = int((age + day - 1) / day) // in days, rounded up
+	}
+	if config.MaxBackups < 0 {
+		return nil, errors.New("'max_backups' should not be negative")
+	}
+	if config.File == "" {
+		return nil, nil // nothing to rotate
+	}
+	return rotator, nil
+}
+
 // GetHomePath returns the home path of the current user.
 func GetHomePath() string {
 	if runtime.GOOS == "windows" {
@@ -195,6 +323,42 @@ func BytesHumanized(bytes uint64) string {
 	return fmt.Sprintf(format, number)
 }
 
+// ParseByteSize parses a human-friendly byte size such as "64KB" or "4MiB".
+// Units are case-insensitive and always binary, i.e. "1KB" == "1KiB" == 1024.
+// A plain number is treated as a number of bytes.
+func ParseByteSize(s string) (uint64, error) {
+	str := strings.ToUpper(strings.TrimSpace(s))
+	i := strings.IndexFunc(str, func(r rune) bool {
+		return (r < '0' || r > '9') && r != '.'
+	})
+	numPart, unitPart := str, ""
+	if i >= 0 {
+		numPart, unitPart = str[:i], strings.TrimSpace(str[i:])
+	}
+
+	var multiplier float64
+	switch unitPart {
+	case "", "B":
+		multiplier = 1
+	case "K", "KB", "KIB":
+		multiplier = 1 << 10
+	case "M", "MB", "MIB":
+		multiplier = 1 << 20
+	case "G", "GB", "GIB":
+		multiplier = 1 << 30
+	case "T", "TB", "TIB":
+		multiplier = 1 << 40
+	default:
+		return 0, errors.Errorf("unknown unit in byte size: %s", s)
+	}
+
+	num, err := strconv.ParseFloat(numPart, 64)
+	if err != nil || num < 0 {
+		return 0, errors.Errorf("invalid byte size: %s", s)
+	}
+	return uint64(num * multiplier), nil
+}
+
 // SpinMutex is a spin mutex as its name suggests.
 type SpinMutex struct {
 	locked uint32
@@ -0,0 +1,122 @@
+package lib
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestParseByteSize(t *testing.T) {
+	cases := []struct {
+		str      string
+		expected uint64
+	}{
+		{"0", 0},
+		{"512", 512},
+		{"512B", 512},
+		{"64KB", 64 * 1024},
+		{"64k", 64 * 1024},
+		{"4MiB", 4 * 1024 * 1024},
+		{" 1.5 MB ", 1536 * 1024},
+		{"2GB", 2 * 1024 * 1024 * 1024},
+	}
+	for _, c := range cases {
+		size, err := ParseByteSize(c.str)
+		if assert.NoError(t, err, c.str) {
+			assert.Equal(t, c.expected, size, c.str)
+		}
+	}
+
+	for _, s := range []string{"", "KB", "-1KB", "12XB", "1.2.3MB"} {
+		_, err := ParseByteSize(s)
+		assert.Error(t, err, s)
+	}
+}
+
+func TestParseAddressZone(t *testing.T) {
+	addr, err := ParseAddress("[fe80::1%eth0]:80")
+	require.NoError(t, err)
+	assert.Equal(t, &TCP6Addr{net.ParseIP("fe80::1"), 80, "eth0"}, addr)
+	assert.Equal(t, "[fe80::1%eth0]:80", addr.String())
+
+	addr, err = FromNetAddr(&net.TCPAddr{
+		IP: net.ParseIP("fe80::1"), Port: 80, Zone: "eth0"})
+	require.NoError(t, err)
+	assert.Equal(t, "[fe80::1%eth0]:80", addr.String())
+
+	for _, s := range []string{"fe80::1%", "1.2.3.4%eth0", "x%eth0"} {
+		ip, zone := ParseIPZone(s)
+		assert.Nil(t, ip, s)
+		assert.Empty(t, zone, s)
+	}
+}
+
+func TestCreateLoggerRotation(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "thestral2_TestCreateLoggerRotation")
+	require.NoError(t, err)
+	defer func() { _ = os.RemoveAll(tmpDir) }()
+	logFile := filepath.Join(tmpDir, "test.log")
+
+	rotator, err := newLogRotator(LoggingConfig{File: logFile})
+	assert.NoError(t, err)
+	assert.Nil(t, rotator)
+	rotator, err = newLogRotator(LoggingConfig{
+		File: logFile, MaxSize: "1.5MB", MaxAge: "25h", MaxBackups: 2})
+	require.NoError(t, err)
+	assert.Equal(t, 2, rotator.MaxSize)
+	assert.Equal(t, 2, rotator.MaxAge)
+	assert.Equal(t, 2, rotator.MaxBackups)
+	for _, config := range []LoggingConfig{
+		{File: logFile, MaxSize: "0"},
+		{File: logFile, MaxSize: "1XB"},
+		{File: logFile, MaxAge: "-1h"},
+		{File: logFile, MaxBackups: -1},
+	} {
+		_, err = newLogRotator(config)
+		assert.Error(t, err, "%+v", config)
+	}
+
+	logger, err := CreateLogger(LoggingConfig{
+		File: logFile, Format: "json", MaxSize: "1MB", MaxBackups: 1})
+	require.NoError(t, err)
+	line := strings.Repeat("x", 1024)
+	for i := 0; i < 1100; i++ {
+		logger.Info(line)
+	}
+	files, err := filepath.Glob(filepath.Join(tmpDir, "test*.log"))
+	require.NoError(t, err)
+	assert.Len(t, files, 2)
+}
+
+func TestCreateAccessLogger(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "thestral2_TestCreateAccessLogger")
+	require.NoError(t, err)
+	defer func() { _ = os.RemoveAll(tmpDir) }()
+	logFile := filepath.Join(tmpDir, "access.log")
+
+	_, err = CreateAccessLogger(AccessLogConfig{})
+	assert.Error(t, err)
+	_, err = CreateAccessLogger(AccessLogConfig{File: logFile, MaxSize: "0"})
+	assert.Error(t, err)
+
+	logger, err := CreateAccessLogger(AccessLogConfig{File: logFile})
+	require.NoError(t, err)
+	logger.Info("", zap.String("target", "example.com:80"),
+		zap.Uint64("bytesUploaded", 42))
+	data, err := ioutil.ReadFile(logFile)
+	require.NoError(t, err)
+	var record map[string]interface{}
+	require.NoError(t, json.Unmarshal(data, &record))
+	assert.Contains(t, record, "ts")
+	delete(record, "ts")
+	assert.Equal(t, map[string]interface{}{
+		"target": "example.com:80", "bytesUploaded": 42.0}, record)
+}
@@ -1,35 +1,153 @@
 package lib
 
 import (
+	"bufio"
+	"bytes"
 	"compress/flate"
+	"compress/gzip"
 	"context"
+	"encoding/binary"
 	"io"
 	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
 	"github.com/pkg/errors"
 )
 
-// WrapTransCompression wraps a Transport with a given compression method.
-func WrapTransCompression(inner Transport, method string) (Transport, error) {
-	switch method {
-	case "snappy", "deflate":
-		return &compTransWrapper{inner, method}, nil
+// DefaultCompressionThreshold is the default minimum size of a write to be
+// compressed.
+const DefaultCompressionThreshold = 64
+
+// LegacyCompressionThreshold makes every write compressed into an unframed
+// stream, which is compatible with the peers not supporting the threshold.
+const LegacyCompressionThreshold = -1
+
+// compEndTimeout is the timeout of sending the end of an unframed stream.
+const compEndTimeout = time.Second
+
+// Types of the frames written by compConnWrapper.
+const (
+	compFrameRaw        byte = 0
+	compFrameCompressed byte = 1
+)
+
+// DecompressionError is returned by reading a compressed connection whose
+// stream cannot be decoded, e.g. corrupted by a middlebox, which tells it
+// apart from the errors of the underlying connection.
+type DecompressionError struct {
+	Err error
+}
+
+func (e *DecompressionError) Error() string {
+	return "failed to decompress: " + e.Err.Error()
+}
+
+// CompressionMethods specifies the compression method of each direction. A
+// method may be followed by a compression level, e.g. "deflate:9". An empty
+// method or "none" disables the compression in that direction.
+type CompressionMethods struct {
+	Up   string // from the dialer to the listener
+	Down string // from the listener to the dialer
+}
+
+// WrapTransCompression wraps a Transport with the given compression methods.
+// Writes smaller than threshold bytes are sent without compression, in frames
+// telling them apart from the compressed ones. A negative threshold, e.g.
+// LegacyCompressionThreshold, compresses everything without the framing, as
+// the peers of the versions before the threshold do. If both methods are
+// "none", the inner Transport is returned unchanged.
+func WrapTransCompression(inner Transport, methods CompressionMethods,
+	threshold int) (Transport, error) {
+	if methods.Up == "" && methods.Down == "" {
+		return nil, errors.New("no compression method specified")
+	}
+	w := &compTransWrapper{inner: inner, threshold: threshold}
+	var err error
+	if methods.Up != "" {
+		if w.up, err = parseCompressionSpec(methods.Up); err != nil {
+			return nil, err
+		}
+	}
+	if methods.Down != "" {
+		if w.down, err = parseCompressionSpec(methods.Down); err != nil {
+			return nil, err
+		}
+	}
+	if w.up.method == "" && w.down.method == "" {
+		return inner, nil
+	}
+	return w, nil
+}
+
+// compressionSpec is a compression method along with its level. The zero
+// value stands for no compression.
+type compressionSpec struct {
+	method string
+	level  int
+}
+
+func parseCompressionSpec(s string) (spec compressionSpec, err error) {
+	spec.method = s
+	levelStr, hasLevel := "", false
+	if i := strings.IndexByte(s, ':'); i >= 0 {
+		spec.method, levelStr, hasLevel = s[:i], s[i+1:], true
+	}
+
+	var minLevel, maxLevel int
+	switch spec.method {
+	case "none":
+		if hasLevel {
+			return spec, errors.New("'none' does not support levels")
+		}
+		return compressionSpec{}, nil
+	case "snappy":
+		if hasLevel {
+			return spec, errors.New("'snappy' does not support levels")
+		}
+		return spec, nil
+	case "deflate", "gzip":
+		spec.level = flate.DefaultCompression
+		minLevel, maxLevel = flate.HuffmanOnly, flate.BestCompression
+	case "zstd":
+		spec.level = 3 // the default level of zstd
+		minLevel, maxLevel = 1, 22
 	default:
-		return nil, errors.New("unknown compression method: " + method)
+		return spec, errors.New("unknown compression method: " + spec.method)
 	}
+
+	if hasLevel {
+		if spec.level, err = strconv.Atoi(levelStr); err != nil {
+			return spec, errors.Errorf("invalid compression level: %s", s)
+		} else if spec.level < minLevel || spec.level > maxLevel {
+			return spec, errors.Errorf(
+				"compression level of '%s' should be within [%d, %d]",
+				spec.method, minLevel, maxLevel)
+		}
+	}
+	return spec, nil
 }
 
 type compTransWrapper struct {
-	inner  Transport
-	method string
+	inner     Transport
+	up, down  compressionSpec
+	threshold int
+}
+
+// Close closes the inner transport, see closeTransport.
+func (w *compTransWrapper) Close() error {
+	return closeTransport(w.inner)
 }
 
 func (w *compTransWrapper) Dial(
 	ctx context.Context, address string) (net.Conn, error) {
 	conn, err := w.inner.Dial(ctx, address)
 	if err == nil {
-		conn, err = compWrapConn(conn, w.method)
+		conn, err = compWrapConn(conn, w.down, w.up, w.threshold)
 	}
 	return conn, err
 }
@@ -37,15 +155,37 @@ func (w *compTransWrapper) Dial(
 func (w *compTransWrapper) Listen(address string) (net.Listener, error) {
 	listener, err := w.inner.Listen(address)
 	if err == nil {
-		listener = &compListenerWrapper{Listener: listener, method: w.method}
+		listener = &compListenerWrapper{listener, w}
 	}
 	return listener, err
 }
 
+// compConnWrapper sends each Write as a frame, which is either compressed or
+// raw depending on its size. A frame starts with its type and the length of
+// its payload as an uvarint. The payload of a compressed frame is preceded by
+// another uvarint indicating the size of the data after decompression.
+//
+// Compressed payloads are pieces of a single compressed stream, so that the
+// compression context is preserved across frames.
+//
+// With a negative threshold, the compressed stream itself is sent instead,
+// and the decompressor reads from the connection directly.
 type compConnWrapper struct {
 	net.Conn
-	compReader io.Reader
-	compWriter writeCloseFlusher
+	threshold  int // negative for no framing
+	rSpec      compressionSpec
+	wSpec      compressionSpec
+	rMtx, wMtx sync.Mutex // guard compReader & compWriter against Close
+
+	compWriter compressor // writing into compBuf
+	compBuf    bytes.Buffer
+	frameBuf   []byte
+
+	compReader io.Reader // reading from compSrc, or connReader if not framed
+	compSrc    *compSource
+	connReader *bufio.Reader
+	rawLeft    uint64 // remaining bytes of the current raw frame
+	compLeft   uint64 // remaining bytes of the current compressed frame
 }
 
 type compConnWithPeerIDs struct {
@@ -56,20 +196,37 @@ func (w *compConnWithPeerIDs) GetPeerIdentifiers() ([]*PeerIdentifier, error) {
 	return w.Conn.(WithPeerIdentifiers).GetPeerIdentifiers()
 }
 
-func compWrapConn(inner net.Conn, method string) (net.Conn, error) {
-	var wrapper *compConnWrapper
-	switch method {
-	case "snappy":
-		wrapper = &compConnWrapper{
-			inner, snappy.NewReader(inner), snappy.NewBufferedWriter(inner)}
-	case "deflate":
-		w, e := flate.NewWriter(inner, flate.DefaultCompression)
-		if e != nil {
-			return nil, errors.WithStack(e)
+// compWrapConn wraps a connection with the decompressor of rSpec and the
+// compressor of wSpec.
+func compWrapConn(inner net.Conn, rSpec, wSpec compressionSpec,
+	threshold int) (net.Conn, error) {
+	wrapper := &compConnWrapper{
+		Conn:       inner,
+		threshold:  threshold,
+		rSpec:      rSpec,
+		wSpec:      wSpec,
+		compSrc:    newCompSource(),
+		connReader: bufio.NewReader(inner),
+	}
+	var err error
+	if wSpec.method != "" {
+		wrapper.compWriter, err = getCompressor(wSpec, &wrapper.compBuf)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if rSpec.method != "" {
+		var src io.Reader = wrapper.compSrc
+		if threshold < 0 {
+			src = wrapper.connReader
+		}
+		wrapper.compReader, err = getDecompressor(rSpec, src)
+		if err != nil {
+			if wrapper.compWriter != nil && wrapper.compWriter.Close() == nil {
+				putCompressor(wSpec, wrapper.compWriter)
+			}
+			return nil, err
 		}
-		wrapper = &compConnWrapper{inner, flate.NewReader(inner), w}
-	default:
-		return nil, errors.New("unknown compression method: " + method)
 	}
 
 	if _, withPIDs := inner.(WithPeerIdentifiers); withPIDs {
@@ -78,42 +235,357 @@ func compWrapConn(inner net.Conn, method string) (net.Conn, error) {
 	return wrapper, nil
 }
 
-func (w *compConnWrapper) Read(b []byte) (int, error) {
+func newCompressor(spec compressionSpec, w io.Writer) (compressor, error) {
+	switch spec.method {
+	case "snappy":
+		return snappy.NewBufferedWriter(w), nil
+	case "deflate":
+		cw, err := flate.NewWriter(w, spec.level)
+		return cw, errors.WithStack(err)
+	case "gzip":
+		cw, err := gzip.NewWriterLevel(w, spec.level)
+		return cw, errors.WithStack(err)
+	case "zstd":
+		// a single goroutine is enough as each Write is flushed immediately
+		cw, err := zstd.NewWriter(w, zstd.WithEncoderConcurrency(1),
+			zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(spec.level)))
+		return cw, errors.WithStack(err)
+	default:
+		return nil, errors.New("unknown compression method: " + spec.method)
+	}
+}
+
+func newDecompressor(spec compressionSpec, r io.Reader) (io.Reader, error) {
+	switch spec.method {
+	case "snappy":
+		return snappy.NewReader(r), nil
+	case "deflate":
+		return flate.NewReader(r), nil
+	case "gzip":
+		return &gzipLazyReader{src: r}, nil
+	case "zstd":
+		dr, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		return zstdReader{dr}, nil
+	default:
+		return nil, errors.New("unknown compression method: " + spec.method)
+	}
+}
+
+func (w *compConnWrapper) Read(b []byte) (n int, err error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+	if w.threshold < 0 {
+		return w.readUnframed(b)
+	}
+	for {
+		switch {
+		case w.rawLeft > 0:
+			if uint64(len(b)) > w.rawLeft {
+				b = b[:w.rawLeft]
+			}
+			n, err = w.connReader.Read(b)
+			w.rawLeft -= uint64(n)
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return
+		case w.compLeft > 0:
+			if uint64(len(b)) > w.compLeft {
+				b = b[:w.compLeft]
+			}
+			w.rMtx.Lock()
+			if w.compReader == nil { // closed
+				w.rMtx.Unlock()
+				return 0, io.ErrClosedPipe
+			}
+			n, err = w.compReader.Read(b)
+			w.rMtx.Unlock()
+			w.compLeft -= uint64(n)
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			if err != nil && err != io.ErrClosedPipe {
+				// the payload has been buffered, so it's never a network error
+				err = &DecompressionError{err}
+			}
+			return
+		default:
+			if err = w.readFrameHeader(); err != nil {
+				w.compSrc.closeWithError(err)
+				return
+			}
+		}
+	}
+}
+
+// readUnframed reads from the stream not framed, whose errors of the
+// decompressor cannot be told apart from those of the connection.
+func (w *compConnWrapper) readUnframed(b []byte) (int, error) {
+	if w.rSpec.method == "" {
+		return w.connReader.Read(b)
+	}
+	w.rMtx.Lock()
+	defer w.rMtx.Unlock()
+	if w.compReader == nil { // closed
+		return 0, io.ErrClosedPipe
+	}
 	return w.compReader.Read(b)
 }
 
-func (w *compConnWrapper) Write(b []byte) (int, error) {
-	n, err := w.compWriter.Write(b)
+func (w *compConnWrapper) readFrameHeader() error {
+	frameType, err := w.connReader.ReadByte()
+	if err != nil {
+		return err // a clean EOF is only allowed here
+	}
+	size, err := binary.ReadUvarint(w.connReader)
 	if err == nil {
-		err = w.compWriter.Flush()
+		switch frameType {
+		case compFrameRaw:
+			w.rawLeft = size
+		case compFrameCompressed:
+			if w.rSpec.method == "" {
+				return &DecompressionError{
+					errors.New("unexpected compressed frame")}
+			}
+			if w.compLeft, err = binary.ReadUvarint(w.connReader); err == nil {
+				_, err = io.CopyN(w.compSrc, w.connReader, int64(size))
+			}
+		default:
+			return &DecompressionError{errors.Errorf(
+				"unknown compression frame type: %d", frameType)}
+		}
 	}
-	return n, err
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return err
 }
 
-func (w *compConnWrapper) Close() (err error) {
-	err = w.compWriter.Close()
+func (w *compConnWrapper) Write(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+	// the buffers are reused by the next Write, so they are written within
+	// the lock as well
+	w.wMtx.Lock()
+	defer w.wMtx.Unlock()
+	data, err := w.encode(b)
 	if err == nil {
-		err = w.Conn.Close()
+		_, err = w.Conn.Write(data)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// encode returns the data of a Write to be sent, i.e. a frame in frameBuf, or
+// the compressed data only if not framed. It must be called with wMtx held.
+func (w *compConnWrapper) encode(b []byte) ([]byte, error) {
+	if w.wSpec.method != "" && w.compWriter == nil {
+		return nil, io.ErrClosedPipe // released by Close
+	}
+	if w.threshold < 0 {
+		if w.compWriter == nil {
+			return b, nil
+		}
+		err := w.compress(b)
+		return w.compBuf.Bytes(), err
+	}
+
+	var hdr [1 + 2*binary.MaxVarintLen64]byte
+	var payload []byte
+	hdrLen := 1
+	if w.compWriter == nil || len(b) < w.threshold {
+		hdr[0] = compFrameRaw
+		hdrLen += binary.PutUvarint(hdr[hdrLen:], uint64(len(b)))
+		payload = b
 	} else {
-		_ = w.Conn.Close()
+		if err := w.compress(b); err != nil {
+			return nil, err
+		}
+		hdr[0] = compFrameCompressed
+		hdrLen += binary.PutUvarint(hdr[hdrLen:], uint64(w.compBuf.Len()))
+		hdrLen += binary.PutUvarint(hdr[hdrLen:], uint64(len(b)))
+		payload = w.compBuf.Bytes()
+	}
+	w.frameBuf = append(append(w.frameBuf[:0], hdr[:hdrLen]...), payload...)
+	return w.frameBuf, nil
+}
+
+// compress compresses the data of a Write into compBuf.
+func (w *compConnWrapper) compress(b []byte) error {
+	w.compBuf.Reset()
+	if _, err := w.compWriter.Write(b); err != nil {
+		return err
 	}
-	return
+	return w.compWriter.Flush()
+}
+
+// Close closes the connection and releases the compressor & decompressor once
+// the ongoing Read & Write are done with them.
+func (w *compConnWrapper) Close() error {
+	// the peers of the earlier versions expect the end of an unframed stream,
+	// which is skipped if it has been interrupted by an ongoing Write anyway
+	var endErr error
+	if w.threshold < 0 && w.wMtx.TryLock() {
+		endErr = w.endUnframed()
+		w.wMtx.Unlock()
+	}
+	// to unblock the Read & Write, which may be reading from or writing to the
+	// connection with the locks held
+	err := w.Conn.Close()
+	if endErr != nil {
+		err = endErr
+	}
+	w.compSrc.closeWithError(io.ErrClosedPipe)
+	w.rMtx.Lock()
+	if w.compReader != nil {
+		putDecompressor(w.rSpec, w.compReader)
+		w.compReader = nil
+	}
+	w.rMtx.Unlock()
+	// nothing written by the compressor is needed by the peer at this point
+	w.wMtx.Lock()
+	if w.compWriter != nil {
+		if cErr := w.compWriter.Close(); cErr == nil {
+			putCompressor(w.wSpec, w.compWriter)
+		} else if err == nil {
+			err = cErr
+		}
+		w.compWriter = nil
+	}
+	w.wMtx.Unlock()
+	return err
+}
+
+// endUnframed closes the compressor of an unframed stream and sends what it
+// writes on closing. It must be called with wMtx held.
+func (w *compConnWrapper) endUnframed() error {
+	if w.compWriter == nil {
+		return nil
+	}
+	w.compBuf.Reset()
+	err := w.compWriter.Close()
+	if err == nil {
+		putCompressor(w.wSpec, w.compWriter)
+		// not to be blocked by a peer not reading
+		_ = w.Conn.SetWriteDeadline(time.Now().Add(compEndTimeout))
+		_, err = w.Conn.Write(w.compBuf.Bytes())
+	}
+	w.compWriter = nil
+	return err
 }
 
 type compListenerWrapper struct {
 	net.Listener
-	method string
+	trans *compTransWrapper
 }
 
 func (w *compListenerWrapper) Accept() (net.Conn, error) {
 	conn, err := w.Listener.Accept()
 	if err == nil {
-		conn, err = compWrapConn(conn, w.method)
+		t := w.trans
+		conn, err = compWrapConn(conn, t.up, t.down, t.threshold)
 	}
 	return conn, err
 }
 
-type writeCloseFlusher interface {
+// compSource feeds the compressed payloads to a decompressor. Reading from an
+// empty compSource blocks until more payloads arrive, as some decompressors
+// may read ahead from another goroutine.
+type compSource struct {
+	lock sync.Mutex
+	cond *sync.Cond
+	buf  bytes.Buffer
+	err  error
+}
+
+func newCompSource() *compSource {
+	s := &compSource{}
+	s.cond = sync.NewCond(&s.lock)
+	return s
+}
+
+func (s *compSource) Read(b []byte) (int, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for s.buf.Len() == 0 && s.err == nil {
+		s.cond.Wait()
+	}
+	if s.buf.Len() > 0 {
+		return s.buf.Read(b)
+	}
+	return 0, s.err
+}
+
+func (s *compSource) Write(b []byte) (int, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.err != nil {
+		return 0, s.err
+	}
+	s.cond.Broadcast()
+	return s.buf.Write(b)
+}
+
+func (s *compSource) closeWithError(err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.err == nil {
+		s.err = err
+		s.cond.Broadcast()
+	}
+}
+
+// zstdReader releases the resources held by the zstd decoder as soon as the
+// stream ends. It is done in Read rather than Close, as the decoder must not
+// be closed concurrently with an ongoing Read.
+type zstdReader struct {
+	*zstd.Decoder
+}
+
+func (r zstdReader) Read(b []byte) (int, error) {
+	n, err := r.Decoder.Read(b)
+	if err != nil {
+		r.Decoder.Close()
+	}
+	return n, err
+}
+
+// gzipLazyReader creates or resets the gzip.Reader on the first Read, as the
+// gzip header is not available until the peer writes something.
+type gzipLazyReader struct {
+	src     io.Reader
+	r       *gzip.Reader
+	started bool
+}
+
+func (r *gzipLazyReader) Read(b []byte) (int, error) {
+	if !r.started {
+		var err error
+		if r.r == nil {
+			r.r, err = gzip.NewReader(r.src)
+		} else {
+			err = r.r.Reset(r.src)
+		}
+		if err != nil {
+			r.r = nil
+			return 0, err
+		}
+		r.started = true
+	}
+	return r.r.Read(b)
+}
+
+// compressor is implemented by the compressors, which can be reset to write
+// into another io.Writer.
+type compressor interface {
 	io.WriteCloser
 	Flush() error
+	Reset(w io.Writer)
 }
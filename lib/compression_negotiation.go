@@ -0,0 +1,254 @@
+package lib
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const compNegotiationTimeout = time.Second * 30
+
+// compMethodIDs are the IDs of the compression methods used in negotiation.
+// ID 0 stands for no compression.
+var compMethodIDs = map[string]byte{
+	"snappy":  1,
+	"deflate": 2,
+	"gzip":    3,
+	"zstd":    4,
+}
+
+// WithCompressionMethod is implemented by connections whose compression
+// method is negotiated with the peer.
+type WithCompressionMethod interface {
+	// CompressionMethod returns the negotiated method, or "none" if the
+	// connection is not compressed.
+	CompressionMethod() (string, error)
+}
+
+// WrapTransNegotiatedCompression wraps a Transport whose compression method is
+// negotiated with the peer. The dialer sends the methods in the order of its
+// preference, and the listener picks the first one it also supports, or falls
+// back to no compression. Both sides must enable the negotiation.
+func WrapTransNegotiatedCompression(
+	inner Transport, methods []string, threshold int) (Transport, error) {
+	if len(methods) == 0 {
+		return nil, errors.New("no compression method to negotiate")
+	}
+	if threshold < 0 {
+		return nil, errors.New("compression threshold must not be negative")
+	}
+	specs := make([]compressionSpec, len(methods))
+	for i, method := range methods {
+		spec, err := parseCompressionSpec(method)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := compMethodIDs[spec.method]; !ok {
+			return nil, errors.New(
+				"compression method cannot be negotiated: " + method)
+		}
+		specs[i] = spec
+	}
+	return &compNegoTransWrapper{inner, specs, threshold}, nil
+}
+
+type compNegoTransWrapper struct {
+	inner     Transport
+	specs     []compressionSpec
+	threshold int
+}
+
+// Close closes the inner transport, see closeTransport.
+func (w *compNegoTransWrapper) Close() error {
+	return closeTransport(w.inner)
+}
+
+func (w *compNegoTransWrapper) Dial(
+	ctx context.Context, address string) (net.Conn, error) {
+	conn, err := w.inner.Dial(ctx, address)
+	if err != nil {
+		return nil, err
+	}
+
+	wrapper := &compNegoConn{
+		Conn: conn, isServer: false, specs: w.specs, threshold: w.threshold}
+	deadline := time.Now().Add(compNegotiationTimeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	if err = wrapper.negotiate(deadline); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return wrapper.withPeerIDs(), nil
+}
+
+func (w *compNegoTransWrapper) Listen(address string) (net.Listener, error) {
+	listener, err := w.inner.Listen(address)
+	if err == nil {
+		listener = &compNegoListenerWrapper{listener, w}
+	}
+	return listener, err
+}
+
+type compNegoListenerWrapper struct {
+	net.Listener
+	trans *compNegoTransWrapper
+}
+
+// Accept returns the connection without waiting for the negotiation, which is
+// done on the first Read or Write.
+func (l *compNegoListenerWrapper) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	wrapper := &compNegoConn{
+		Conn:      conn,
+		isServer:  true,
+		specs:     l.trans.specs,
+		threshold: l.trans.threshold,
+	}
+	return wrapper.withPeerIDs(), nil
+}
+
+type compNegoConn struct {
+	net.Conn  // the underlying connection
+	isServer  bool
+	specs     []compressionSpec
+	threshold int
+
+	inited  sync.Once
+	err     error
+	method  string
+	wrapped net.Conn
+}
+
+type compNegoConnWithPeerIDs struct {
+	*compNegoConn
+}
+
+func (c *compNegoConnWithPeerIDs) GetPeerIdentifiers() (
+	[]*PeerIdentifier, error) {
+	return c.Conn.(WithPeerIdentifiers).GetPeerIdentifiers()
+}
+
+func (c *compNegoConn) withPeerIDs() net.Conn {
+	if _, withPIDs := c.Conn.(WithPeerIdentifiers); withPIDs {
+		return &compNegoConnWithPeerIDs{c}
+	}
+	return c
+}
+
+func (c *compNegoConn) negotiate(deadline time.Time) error {
+	c.inited.Do(func() {
+		_ = c.Conn.SetDeadline(deadline)
+		var id byte
+		if c.isServer {
+			id, c.err = c.serverHandshake()
+		} else {
+			id, c.err = c.clientHandshake()
+		}
+		_ = c.Conn.SetDeadline(time.Time{})
+		if c.err != nil {
+			c.err = errors.WithMessage(c.err, "compression negotiation failed")
+			return
+		}
+
+		if id == 0 {
+			c.method, c.wrapped = "none", c.Conn
+			return
+		}
+		for _, spec := range c.specs {
+			if compMethodIDs[spec.method] == id {
+				c.method = spec.method
+				c.wrapped, c.err = compWrapConn(
+					c.Conn, spec, spec, c.threshold)
+				return
+			}
+		}
+		c.err = errors.Errorf("unexpected compression method ID: %d", id)
+	})
+	return c.err
+}
+
+func (c *compNegoConn) clientHandshake() (byte, error) {
+	msg := make([]byte, len(c.specs)+1)
+	msg[0] = byte(len(c.specs))
+	for i, spec := range c.specs {
+		msg[i+1] = compMethodIDs[spec.method]
+	}
+	if _, err := c.Conn.Write(msg); err != nil {
+		return 0, errors.WithStack(err)
+	}
+	if _, err := io.ReadFull(c.Conn, msg[:1]); err != nil {
+		return 0, errors.WithStack(err)
+	}
+	return msg[0], nil
+}
+
+func (c *compNegoConn) serverHandshake() (byte, error) {
+	var buf [256]byte
+	if _, err := io.ReadFull(c.Conn, buf[:1]); err != nil {
+		return 0, errors.WithStack(err)
+	}
+	offered := buf[1 : int(buf[0])+1]
+	if _, err := io.ReadFull(c.Conn, offered); err != nil {
+		return 0, errors.WithStack(err)
+	}
+
+	var chosen byte
+	supported := make(map[byte]bool, len(c.specs))
+	for _, spec := range c.specs {
+		supported[compMethodIDs[spec.method]] = true
+	}
+	for _, id := range offered {
+		if supported[id] {
+			chosen = id
+			break
+		}
+	}
+	_, err := c.Conn.Write([]byte{chosen})
+	return chosen, errors.WithStack(err)
+}
+
+func (c *compNegoConn) init() error {
+	return c.negotiate(time.Now().Add(compNegotiationTimeout))
+}
+
+// CompressionMethod returns the negotiated compression method.
+func (c *compNegoConn) CompressionMethod() (string, error) {
+	if err := c.init(); err != nil {
+		return "", err
+	}
+	return c.method, nil
+}
+
+func (c *compNegoConn) Read(b []byte) (int, error) {
+	if err := c.init(); err != nil {
+		return 0, err
+	}
+	return c.wrapped.Read(b)
+}
+
+func (c *compNegoConn) Write(b []byte) (int, error) {
+	if err := c.init(); err != nil {
+		return 0, err
+	}
+	return c.wrapped.Write(b)
+}
+
+func (c *compNegoConn) Close() error {
+	// closing the underlying connection first interrupts an ongoing
+	// negotiation, if any
+	err := c.Conn.Close()
+	c.inited.Do(func() { c.err = errors.New("connection closed") })
+	if c.wrapped != nil && c.wrapped != c.Conn {
+		_ = c.wrapped.Close()
+	}
+	return err
+}
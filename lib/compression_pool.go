@@ -0,0 +1,70 @@
+package lib
+
+import (
+	"compress/flate"
+	"io"
+	"sync"
+
+	"github.com/golang/snappy"
+)
+
+// The compressors and decompressors released by closed connections are kept
+// for reuse, as their allocations are significant for short-lived
+// connections. Compressors are keyed by their compressionSpec, and
+// decompressors by their methods only. zstd decoders are closed rather than
+// pooled since they hold goroutines until closed.
+var (
+	compressorPools   sync.Map // compressionSpec -> *sync.Pool
+	decompressorPools sync.Map // method -> *sync.Pool
+)
+
+func loadPool(pools *sync.Map, key interface{}) *sync.Pool {
+	if pool, ok := pools.Load(key); ok {
+		return pool.(*sync.Pool)
+	}
+	pool, _ := pools.LoadOrStore(key, new(sync.Pool))
+	return pool.(*sync.Pool)
+}
+
+// getCompressor returns a compressor of the spec writing into w, which is
+// reused if possible.
+func getCompressor(spec compressionSpec, w io.Writer) (compressor, error) {
+	if cw, ok := loadPool(&compressorPools, spec).Get().(compressor); ok {
+		cw.Reset(w)
+		return cw, nil
+	}
+	return newCompressor(spec, w)
+}
+
+// putCompressor releases a compressor which has been closed.
+func putCompressor(spec compressionSpec, cw compressor) {
+	loadPool(&compressorPools, spec).Put(cw)
+}
+
+// getDecompressor returns a decompressor of the spec reading from r, which is
+// reused if possible.
+func getDecompressor(spec compressionSpec, r io.Reader) (io.Reader, error) {
+	if dr := loadPool(&decompressorPools, spec.method).Get(); dr != nil {
+		switch d := dr.(type) {
+		case *snappy.Reader:
+			d.Reset(r)
+		case flate.Resetter:
+			if err := d.Reset(r, nil); err != nil {
+				return newDecompressor(spec, r)
+			}
+		case *gzipLazyReader:
+			d.src, d.started = r, false
+		}
+		return dr.(io.Reader), nil
+	}
+	return newDecompressor(spec, r)
+}
+
+// putDecompressor releases a decompressor which won't be read any more.
+func putDecompressor(spec compressionSpec, dr io.Reader) {
+	if zr, isZstd := dr.(zstdReader); isZstd {
+		zr.Decoder.Close()
+	} else {
+		loadPool(&decompressorPools, spec.method).Put(dr)
+	}
+}
@@ -0,0 +1,382 @@
+package lib
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompressionRoundTrip(t *testing.T) {
+	methods := []string{
+		"snappy", "deflate", "deflate:-2", "deflate:9", "gzip", "gzip:1",
+		"zstd", "zstd:19"}
+	for _, method := range methods {
+		for _, threshold := range []int{LegacyCompressionThreshold, 0, 32} {
+			testCompressionRoundTrip(t, method, threshold)
+		}
+	}
+}
+
+func testCompressionRoundTrip(t *testing.T, method string, threshold int) {
+	name := fmt.Sprintf("%s/threshold-%d", method, threshold)
+	t.Run(name, func(t *testing.T) {
+		spec, err := parseCompressionSpec(method)
+		require.NoError(t, err)
+		cliConn, svrConn := net.Pipe()
+		cli, err := compWrapConn(cliConn, spec, spec, threshold)
+		require.NoError(t, err)
+		svr, err := compWrapConn(svrConn, spec, spec, threshold)
+		require.NoError(t, err)
+
+		var expected bytes.Buffer
+		doneCh := make(chan struct{})
+		go func() {
+			defer close(doneCh)
+			for i := 0; i < 1000; i++ {
+				data := make([]byte, rand.Intn(64)+1)
+				_, _ = rand.Read(data[:len(data)/2]) // half compressible
+				expected.Write(data)
+				_, err := cli.Write(data)
+				if !assert.NoError(t, err) {
+					break
+				}
+			}
+			assert.NoError(t, cli.Close())
+		}()
+
+		received, err := ioutil.ReadAll(svr)
+		<-doneCh
+		assert.NoError(t, err)
+		assert.Equal(t, expected.Bytes(), received)
+		_ = svr.Close()
+	})
+}
+
+func TestCompressionPool(t *testing.T) {
+	for _, method := range []string{"snappy", "deflate", "gzip", "zstd"} {
+		// the compressors & decompressors released are reused by the next
+		for i := 0; i < 3; i++ {
+			testCompressionRoundTrip(t, method, 0)
+		}
+		spec, err := parseCompressionSpec(method)
+		require.NoError(t, err)
+
+		// closed during Read & Write
+		for _, threshold := range []int{LegacyCompressionThreshold, 0} {
+			testCompressionClosed(t, spec, threshold)
+		}
+	}
+}
+
+func testCompressionClosed(t *testing.T, spec compressionSpec, threshold int) {
+	cliConn, svrConn := net.Pipe()
+	cli, err := compWrapConn(cliConn, spec, spec, threshold)
+	require.NoError(t, err)
+	svr, err := compWrapConn(svrConn, spec, spec, threshold)
+	require.NoError(t, err)
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		data := bytes.Repeat([]byte(spec.method), 16)
+		for {
+			if _, err := cli.Write(data); err != nil {
+				return
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		_, _ = io.Copy(ioutil.Discard, svr)
+	}()
+	time.Sleep(time.Millisecond * 10)
+	_ = cli.Close()
+	_ = svr.Close()
+	wg.Wait()
+}
+
+func BenchmarkCompWrapConn(b *testing.B) {
+	// run with -benchtime=10000x for 10k connection setups
+	conn, _ := net.Pipe()
+	for _, method := range []string{"snappy", "deflate", "gzip", "zstd"} {
+		spec, err := parseCompressionSpec(method)
+		require.NoError(b, err)
+		b.Run(method+"/new", func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				cw, err := newCompressor(spec, ioutil.Discard)
+				require.NoError(b, err)
+				src := newCompSource()
+				dr, err := newDecompressor(spec, src)
+				require.NoError(b, err)
+				_ = cw.Close()
+				src.closeWithError(io.ErrClosedPipe)
+				if zr, ok := dr.(zstdReader); ok {
+					zr.Decoder.Close()
+				}
+			}
+		})
+		b.Run(method+"/pooled", func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				wrapped, err := compWrapConn(conn, spec, spec, 0)
+				require.NoError(b, err)
+				_ = wrapped.Close()
+			}
+		})
+	}
+}
+
+func TestCompressionSmallPayload(t *testing.T) {
+	spec, err := parseCompressionSpec("deflate")
+	require.NoError(t, err)
+	data := []byte("0123456789abcdef")
+
+	// capture what is written on the wire
+	cliConn, wireConn := net.Pipe()
+	cli, err := compWrapConn(cliConn, spec, spec, DefaultCompressionThreshold)
+	require.NoError(t, err)
+	go func() {
+		_, err := cli.Write(data)
+		assert.NoError(t, err)
+		_ = cli.Close()
+	}()
+	wire, err := ioutil.ReadAll(wireConn)
+	require.NoError(t, err)
+	require.Equal(t, 2+len(data), len(wire))
+	assert.Equal(t, compFrameRaw, wire[0])
+	assert.Equal(t, byte(len(data)), wire[1])
+	assert.Equal(t, data, wire[2:])
+
+	// then replay it to the reader side
+	wireConn, svrConn := net.Pipe()
+	svr, err := compWrapConn(svrConn, spec, spec, DefaultCompressionThreshold)
+	require.NoError(t, err)
+	go func() {
+		_, err := wireConn.Write(wire)
+		assert.NoError(t, err)
+		_ = wireConn.Close()
+	}()
+	received, err := ioutil.ReadAll(svr)
+	require.NoError(t, err)
+	assert.Equal(t, data, received)
+}
+
+func TestCompressionUnframed(t *testing.T) {
+	spec, err := parseCompressionSpec("deflate")
+	require.NoError(t, err)
+	data := []byte("0123456789abcdef")
+
+	// nothing but the compressed stream, ended on closing, is on the wire
+	cliConn, wireConn := net.Pipe()
+	cli, err := compWrapConn(cliConn, spec, spec, LegacyCompressionThreshold)
+	require.NoError(t, err)
+	go func() {
+		_, err := cli.Write(data)
+		assert.NoError(t, err)
+		_ = cli.Close()
+	}()
+	wire, err := ioutil.ReadAll(wireConn)
+	require.NoError(t, err)
+	decompressed, err := ioutil.ReadAll(flate.NewReader(bytes.NewReader(wire)))
+	assert.NoError(t, err)
+	assert.Equal(t, data, decompressed)
+
+	// the static methods are only framed if the threshold is set
+	trans, err := CreateTransport(&TransportConfig{Compression: "deflate"})
+	require.NoError(t, err)
+	assert.Equal(t, LegacyCompressionThreshold,
+		trans.(*compTransWrapper).threshold)
+	threshold := 0
+	trans, err = CreateTransport(&TransportConfig{
+		Compression: "deflate", CompressionThreshold: &threshold})
+	require.NoError(t, err)
+	assert.Equal(t, 0, trans.(*compTransWrapper).threshold)
+}
+
+func TestCompressionCorrupted(t *testing.T) {
+	readWire := func(spec compressionSpec, wire []byte) error {
+		wireConn, conn := net.Pipe()
+		wrapped, err := compWrapConn(conn, spec, spec, 0)
+		require.NoError(t, err)
+		go func() {
+			_, _ = wireConn.Write(wire)
+			_ = wireConn.Close()
+		}()
+		_, err = ioutil.ReadAll(wrapped)
+		_ = wrapped.Close()
+		return err
+	}
+
+	// an invalid block type of deflate, or a reserved chunk type of snappy
+	garbage := bytes.Repeat([]byte{0x07}, 64)
+	for _, method := range []string{"snappy", "deflate", "gzip", "zstd"} {
+		spec, err := parseCompressionSpec(method)
+		require.NoError(t, err)
+		wire := append([]byte{compFrameCompressed, 64, 100}, garbage...)
+		err = readWire(spec, wire)
+		assert.IsType(t, &DecompressionError{}, err, method)
+	}
+
+	// corrupted frame headers
+	err := readWire(compressionSpec{}, []byte{0xff, 0})
+	assert.IsType(t, &DecompressionError{}, err)
+	err = readWire(compressionSpec{}, []byte{compFrameCompressed, 1, 1, 0})
+	assert.IsType(t, &DecompressionError{}, err)
+
+	// connection closed in the middle of a frame
+	err = readWire(compressionSpec{}, []byte{compFrameRaw, 8, 0})
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+}
+
+func TestParseCompressionSpec(t *testing.T) {
+	spec, err := parseCompressionSpec("deflate")
+	require.NoError(t, err)
+	assert.Equal(t, compressionSpec{"deflate", flate.DefaultCompression}, spec)
+	spec, err = parseCompressionSpec("deflate:0")
+	require.NoError(t, err)
+	assert.Equal(t, compressionSpec{"deflate", 0}, spec)
+	spec, err = parseCompressionSpec("none")
+	require.NoError(t, err)
+	assert.Equal(t, compressionSpec{}, spec)
+
+	for _, s := range []string{
+		"unknown", "deflate:10", "deflate:-3", "deflate:x", "deflate:",
+		"snappy:1", "gzip:10", "zstd:0", "zstd:23", "none:1", "None",
+	} {
+		_, err = parseCompressionSpec(s)
+		assert.Error(t, err, s)
+	}
+}
+
+func TestCompressionNegotiation(t *testing.T) {
+	cases := []struct {
+		cliMethods, svrMethods []string
+		expected               string
+	}{
+		{[]string{"zstd", "deflate"}, []string{"snappy", "deflate:9"},
+			"deflate"},
+		{[]string{"zstd", "gzip"}, []string{"gzip", "zstd"}, "zstd"},
+		{[]string{"snappy"}, []string{"zstd"}, "none"},
+	}
+	for _, c := range cases {
+		cliTrans, err := WrapTransNegotiatedCompression(
+			nil, c.cliMethods, DefaultCompressionThreshold)
+		require.NoError(t, err)
+		svrTrans, err := WrapTransNegotiatedCompression(
+			nil, c.svrMethods, DefaultCompressionThreshold)
+		require.NoError(t, err)
+
+		cliConn, svrConn := net.Pipe()
+		cli := &compNegoConn{
+			Conn:      cliConn,
+			specs:     cliTrans.(*compNegoTransWrapper).specs,
+			threshold: DefaultCompressionThreshold,
+		}
+		svr := &compNegoConn{
+			Conn:      svrConn,
+			isServer:  true,
+			specs:     svrTrans.(*compNegoTransWrapper).specs,
+			threshold: DefaultCompressionThreshold,
+		}
+
+		data := bytes.Repeat([]byte("thestral"), 1024)
+		go func() {
+			_, err := cli.Write(data)
+			assert.NoError(t, err)
+			_ = cli.Close()
+		}()
+		received, err := ioutil.ReadAll(svr)
+		assert.NoError(t, err)
+		assert.Equal(t, data, received)
+		for _, conn := range []*compNegoConn{cli, svr} {
+			method, err := conn.CompressionMethod()
+			assert.NoError(t, err)
+			assert.Equal(t, c.expected, method)
+		}
+		_ = svr.Close()
+	}
+
+	_, err := WrapTransNegotiatedCompression(nil, nil, 0)
+	assert.Error(t, err)
+	_, err = WrapTransNegotiatedCompression(nil, []string{"unknown"}, 0)
+	assert.Error(t, err)
+	_, err = CreateTransport(&TransportConfig{
+		Compression: "zstd", CompressionUp: "snappy",
+		CompressionNegotiation: true})
+	assert.Error(t, err)
+	_, err = CreateTransport(&TransportConfig{
+		CompressionDown: "zstd", CompressionNegotiation: true})
+	assert.Error(t, err)
+}
+
+func TestCompressionPerDirection(t *testing.T) {
+	trans, err := WrapTransCompression(
+		nil, CompressionMethods{Down: "zstd"}, 0)
+	require.NoError(t, err)
+	up, down := trans.(*compTransWrapper).up, trans.(*compTransWrapper).down
+	assert.Equal(t, "", up.method)
+	assert.Equal(t, "zstd", down.method)
+
+	data := bytes.Repeat([]byte("thestral"), 128)
+	for _, isDialer := range []bool{true, false} {
+		// the dialer reads with down and writes with up
+		rSpec, wSpec := down, up
+		if !isDialer {
+			rSpec, wSpec = up, down
+		}
+		conn, wireConn := net.Pipe()
+		wrapped, err := compWrapConn(conn, rSpec, wSpec, 0)
+		require.NoError(t, err)
+		go func() {
+			_, err := wrapped.Write(data)
+			assert.NoError(t, err)
+			_ = wrapped.Close()
+		}()
+		wire, err := ioutil.ReadAll(wireConn)
+		require.NoError(t, err)
+		if isDialer {
+			assert.Equal(t, compFrameRaw, wire[0])
+		} else {
+			assert.Equal(t, compFrameCompressed, wire[0])
+			assert.True(t, len(wire) < len(data))
+		}
+	}
+
+	_, err = WrapTransCompression(nil, CompressionMethods{}, 0)
+	assert.Error(t, err)
+}
+
+func TestCompressionNone(t *testing.T) {
+	inner := TCPTransport{}
+	trans, err := WrapTransCompression(
+		inner, CompressionMethods{"none", "none"}, 0)
+	require.NoError(t, err)
+	assert.Equal(t, inner, trans)
+
+	trans, err = WrapTransCompression(
+		inner, CompressionMethods{"none", "snappy"}, 0)
+	require.NoError(t, err)
+	assert.Equal(t, "", trans.(*compTransWrapper).up.method)
+	assert.Equal(t, "snappy", trans.(*compTransWrapper).down.method)
+
+	trans, err = CreateTransport(&TransportConfig{Compression: "none"})
+	require.NoError(t, err)
+	assert.Equal(t, inner, trans)
+
+	_, err = WrapTransCompression(
+		inner, CompressionMethods{"none", "unknown"}, 0)
+	assert.Error(t, err)
+	_, err = WrapTransNegotiatedCompression(inner, []string{"none"}, 0)
+	assert.Error(t, err)
+}
@@ -4,7 +4,10 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"reflect"
+	"regexp"
 	"runtime"
+	"strings"
 
 	"github.com/pkg/errors"
 	"github.com/richardtsai/thestral2/db"
@@ -16,9 +19,13 @@ type Config struct {
 	Downstreams map[string]ProxyConfig `yaml:"downstreams"`
 	Upstreams   map[string]ProxyConfig `yaml:"upstreams"`
 	Rules       map[string]RuleConfig  `yaml:"rules"`
+	Scopes      map[string][]string    `yaml:"scopes"` // scope -> upstreams
 	Logging     LoggingConfig          `yaml:"logging"`
 	DB          *db.Config             `yaml:"db"`
+	GeoIP       *GeoIPConfig           `yaml:"geoip"`
+	DNS         *DNSConfig             `yaml:"dns"`
 	Misc        MiscConfig             `yaml:"misc"`
+	Include     []string               `yaml:"include"` // see ParseConfigFile
 
 	// DEFAULTS field allows the users to define arbitrary data that can be
 	// referenced elsewhere. It is not used by the program directly.
@@ -26,22 +33,136 @@ type Config struct {
 }
 
 // ProxyConfig describes a proxy protocol.
+//
+// The 'bound_addr' of a downstream decides the bound address reported to the
+// clients, e.g. in SOCKS5 replies:
+//   - "upstream" (the default) reports the one reported by the upstream. It's
+//     the address of an intermediate proxy if they are chained, which may be
+//     neither reachable nor meaningful to the clients.
+//   - "target" echoes the target address requested by the client, which
+//     satisfies the clients validating the bound address, though nothing is
+//     actually bound on it.
+//   - an address (e.g. "203.0.113.1:0") is reported as-is, such as the public
+//     address of the server.
+//
+// The overrides hide the addresses of the upstreams from the clients, but
+// protocols relying on the bound address (e.g. to accept connections or send
+// datagrams on it) only work if it's actually reachable by the clients.
+//
+// The 'weight' of an upstream (1 if unset) weighs it in the 'random'
+// strategy, and a weight of 0 drains it, i.e. it's only selected if all the
+// other candidates are drained too.
+//
+// The 'default_upstreams' of a downstream are used for its requests matching
+// no rule other than the default one, in place of the upstreams of the
+// default rule (or all of them if there's none), e.g. for the guests on a
+// separate listener to default to a restricted upstream.
 type ProxyConfig struct {
-	Protocol  string                 `yaml:"protocol"`
-	Transport *TransportConfig       `yaml:"transport"`
-	Settings  map[string]interface{} `yaml:",inline"`
+	Protocol    string                 `yaml:"protocol"`
+	Enabled     *bool                  `yaml:"enabled"` // true if unset
+	Transport   *TransportConfig       `yaml:"transport"`
+	Weight      *int                   `yaml:"weight"`       // upstreams only
+	MaxConns    int                    `yaml:"max_conns"`    // concurrent requests
+	MaxQueued   int                    `yaml:"max_queued"`   // beyond max_conns
+	HealthCheck *HealthCheckConfig     `yaml:"health_check"` // upstreams only
+	ACL         *ACLConfig             `yaml:"acl"`          // downstreams only
+	RateLimit   *RateLimitConfig       `yaml:"rate_limit"`   // downstreams only
+	Blocked     *BlockedConfig         `yaml:"blocked"`      // downstreams only
+	BoundAddr   string                 `yaml:"bound_addr"`   // downstreams only
+	Settings    map[string]interface{} `yaml:",inline"`
+	// downstreams only, see above
+	DefaultUpstreams []string `yaml:"default_upstreams"`
+}
+
+// IsEnabled returns whether the proxy is enabled. A disabled one is skipped
+// as if it's not defined, while its configuration is kept.
+func (c ProxyConfig) IsEnabled() bool {
+	return c.Enabled == nil || *c.Enabled
+}
+
+// ACLConfig describes the client IPs allowed to access a downstream. Denied
+// IPs take precedence, and other IPs are denied if any allowed one is given.
+type ACLConfig struct {
+	Allow []string `yaml:"allow"`
+	Deny  []string `yaml:"deny"`
+}
+
+// RateLimitConfig limits the rate of new connections from each client IP.
+type RateLimitConfig struct {
+	Rate       float64 `yaml:"rate"`        // connections per second
+	Burst      int     `yaml:"burst"`       // the rate (at least 1) by default
+	MaxClients int     `yaml:"max_clients"` // IPs tracked, 4096 by default
+}
+
+// BlockedConfig describes the responses to the requests rejected by rules.
+// The status and the message are used by HTTP downstreams, and the reply by
+// SOCKS5 ones.
+type BlockedConfig struct {
+	Status  int    `yaml:"status"`  // 403 by default
+	Message string `yaml:"message"` // response body, empty by default
+	Reply   int    `yaml:"reply"`   // reply code, 0x02 (not allowed) by default
+}
+
+// HealthCheckConfig describes how to check the health of an upstream.
+type HealthCheckConfig struct {
+	Target           string `yaml:"target"`
+	Interval         string `yaml:"interval"`
+	Timeout          string `yaml:"timeout"`
+	FailureThreshold int    `yaml:"failure_threshold"`
+	// the upstream is degraded, i.e. treated as unhealthy, while more than
+	// failure_rate (0 for never) of the connections via it fail within the
+	// failure_rate_window, if there are at least failure_rate_min_conns
+	FailureRate         float64 `yaml:"failure_rate"`
+	FailureRateWindow   string  `yaml:"failure_rate_window"`    // 1m by default
+	FailureRateMinConns int     `yaml:"failure_rate_min_conns"` // 10 by default
 }
 
 // TransportConfig describes a transport layer.
 type TransportConfig struct {
-	Compression string         `yaml:"compression"`
-	TLS         *TLSConfig     `yaml:"tls"`
-	KCP         *KCPConfig     `yaml:"kcp"`
-	Proxied     *ProxyConfig   `yaml:"proxied"`
-	PreConn     *PreConnConfig `yaml:"pre_conn"`
+	// writes smaller than compression_threshold bytes are sent uncompressed
+	// in frames, which the peers of the earlier versions can't read, so the
+	// methods not negotiated are only framed if it is set, while the
+	// negotiated ones are always framed, with a threshold of 64 by default
+	Compression            string           `yaml:"compression"`
+	CompressionUp          string           `yaml:"compression_up"`
+	CompressionDown        string           `yaml:"compression_down"`
+	CompressionThreshold   *int             `yaml:"compression_threshold"`
+	CompressionNegotiation bool             `yaml:"compression_negotiation"`
+	TLS                    *TLSConfig       `yaml:"tls"`
+	KCP                    *KCPConfig       `yaml:"kcp"`
+	Proxied                *ProxyConfig     `yaml:"proxied"`
+	WebSocket              *WebSocketConfig `yaml:"websocket"`
+	Obfs                   *ObfsConfig      `yaml:"obfs"`
+	PreConn                *PreConnConfig   `yaml:"pre_conn"`
+	TCP                    *TCPConfig       `yaml:"tcp"`
+	ProxyProtocol          bool             `yaml:"proxy_protocol"` // servers
+}
+
+// TCPConfig contains the socket options of the TCP connections, which is the
+// only transport setting allowed for the direct upstreams. The keep-alive
+// probes only detect dead peers, and they don't count as activities against
+// the idle_timeout of the tunnels.
+type TCPConfig struct {
+	NoDelay   *bool  `yaml:"no_delay"`   // true by default
+	KeepAlive string `yaml:"keep_alive"` // period, 0 disables, default if empty
+	// of the wildcard addresses of servers, see TCPOptions.Family
+	Family string `yaml:"listen_family"`
+	// per address of servers, see TCPOptions.Listeners (1 by default)
+	Listeners int `yaml:"listeners"`
 }
 
 // TLSConfig contains the TLS configuration on some transport.
+//
+// The servers are verified against the system CAs plus the ExtraCAs, or the
+// CAs only if specified, each of which is a PEM file of one or more (i.e. a
+// bundle) certificates, e.g. those of a private CA.
+//
+// PinnedCerts are the SHA-256 fingerprints (in hex, colons allowed as printed
+// by "openssl x509 -fingerprint -sha256") of the server certificates that a
+// client accepts, in addition to the verification against the CAs. Pinning
+// defeats the MITM with any certificate issued by a trusted CA, at the cost
+// of the flexibility of the CA chain: the servers can't renew or replace
+// their certificates without the pins updated first.
 type TLSConfig struct {
 	Cert             string   `yaml:"cert"`
 	Key              string   `yaml:"key"`
@@ -51,6 +172,9 @@ type TLSConfig struct {
 	ClientCAs        []string `yaml:"client_cas"`
 	SessionCacheSize int      `yaml:"session_cache_size"`
 	HandshakeTimeout string   `yaml:"handshake_timeout"`
+	ServerName       string   `yaml:"server_name"` // SNI, the host by default
+	ALPN             []string `yaml:"alpn"`        // required if specified
+	PinnedCerts      []string `yaml:"pinned_certs"`
 }
 
 // KCPConfig contains configuration about the KCP protocol.
@@ -61,11 +185,45 @@ type KCPConfig struct {
 	FECDist           string `yaml:"fec_dist"`
 	KeepAliveInterval string `yaml:"keep_alive_interval"`
 	KeepAliveTimeout  string `yaml:"keep_alive_timeout"`
+	KeepAliveCheck    string `yaml:"keep_alive_check"` // interval / 4 by default
+	SockBuf           string `yaml:"sock_buf"`
+	DialRetries       int    `yaml:"dial_retries"`     // no retry by default
+	DialRetryDelay    string `yaml:"dial_retry_delay"` // doubled each retry
+	MaxSessions       int    `yaml:"max_sessions"`     // no limit by default
+	// randomizes each keep-alive interval by up to this percentage of it,
+	// and pads the keep-alive signals with up to this many random bytes, so
+	// that they are less recognizable. Both are off by default. The padded
+	// signals are only understood by the peers supporting them.
+	KeepAliveJitter  int `yaml:"keep_alive_jitter"`  // [0, 100)
+	KeepAlivePadding int `yaml:"keep_alive_padding"` // [0, 255]
+	// how long a closing connection waits for room in the send window for
+	// the close signal (dropped if 0), and then how long the session lingers
+	// for the signal to be delivered (closed at once if 0), 10s by default
+	CloseSendTimeout string `yaml:"close_send_timeout"`
+	CloseLinger      string `yaml:"close_linger"`
 }
 
-// PreConnConfig contains configuration for pre-connect transport wrapper.
+// WebSocketConfig contains configuration about the WebSocket transport, which
+// is wss if TLS is also configured.
+type WebSocketConfig struct {
+	Path string `yaml:"path"` // "/" by default
+	Host string `yaml:"host"` // Host header, the dialed address by default
+}
+
+// ObfsConfig contains configuration about the obfuscation layer.
+type ObfsConfig struct {
+	Mode       string `yaml:"mode"`        // http_simple or random_padding
+	Host       string `yaml:"host"`        // http_simple, the address by default
+	MinPadding int    `yaml:"min_padding"` // random_padding, in bytes
+	MaxPadding int    `yaml:"max_padding"` // random_padding, 255 by default
+}
+
+// PreConnConfig contains configuration for pre-connect transport wrapper. It
+// is only supported by the upstreams using transports (socks5 and trojan), as
+// the connections are established before the targets are known.
 type PreConnConfig struct {
 	MaxPoolSize int    `yaml:"max_pool_size"`
+	IdleSize    int    `yaml:"idle_size"` // kept warm, 2 by default
 	Lifetime    string `yaml:"lifetime"`
 }
 
@@ -74,6 +232,45 @@ type RuleConfig struct {
 	Upstreams []string `yaml:"upstreams"`
 	IPs       []string `yaml:"ips"`
 	Domains   []string `yaml:"domains"`
+	Countries []string `yaml:"countries"` // ISO 3166-1 alpha-2 codes
+	Files     []string `yaml:"files"`     // paths, globs or http(s) URLs
+	Bandwidth string   `yaml:"bandwidth"` // bytes/s of each tunnel direction
+	// overrides the connect_timeout of misc for the targets matched
+	ConnectTimeout string `yaml:"connect_timeout"`
+	// attached to the tunnels matched, e.g. "metered", which are reported
+	// by the monitor and logged
+	Tags []string `yaml:"tags"`
+	// what to do if all the upstreams are unhealthy, see UnhealthyPolicy
+	UnhealthyPolicy string `yaml:"unhealthy_policy"`
+	// "proxy" (via the upstreams) or "deny", see RuleAction
+	Action string `yaml:"action"`
+}
+
+// GeoIPConfig contains configuration about the GeoIP database used by the
+// country rules.
+type GeoIPConfig struct {
+	Database       string `yaml:"database"` // path to a MaxMind .mmdb file
+	ReloadInterval string `yaml:"reload_interval"`
+}
+
+// DNSConfig contains configuration about resolving the target domains locally
+// for matching them against the IP and country rules, and for dialing them
+// by the direct upstreams.
+type DNSConfig struct {
+	Server      string `yaml:"server"`       // "8.8.8.8:53", the system's if empty
+	CacheTTL    string `yaml:"cache_ttl"`    // 5m by default, 0 to disable
+	NegativeTTL string `yaml:"negative_ttl"` // failures not cached by default
+	MaxEntries  int    `yaml:"max_entries"`  // 4096 by default
+	DialByIP    bool   `yaml:"dial_by_ip"`   // or the name is sent upstream
+	// DNS-over-HTTPS, which cannot be used along with 'server'
+	DoH *DoHConfig `yaml:"doh"`
+}
+
+// DoHConfig contains configuration about resolving via DNS-over-HTTPS.
+type DoHConfig struct {
+	URL       string   `yaml:"url"`       // e.g. https://1.1.1.1/dns-query
+	Bootstrap []string `yaml:"bootstrap"` // IPs of the host in the URL
+	Fallback  bool     `yaml:"fallback"`  // to the system resolver on errors
 }
 
 // LoggingConfig contains configuration about logging.
@@ -81,20 +278,122 @@ type LoggingConfig struct {
 	File   string `yaml:"file"`
 	Level  string `yaml:"level"`
 	Format string `yaml:"format"`
+
+	// rotation of the log file, which is disabled if none of them is set
+	MaxSize    string `yaml:"max_size"`    // rounded up to MB, default 100MB
+	MaxAge     string `yaml:"max_age"`     // e.g. "168h", rounded up to days
+	MaxBackups int    `yaml:"max_backups"` // 0 for unlimited
+
+	Syslog *SyslogConfig `yaml:"syslog"` // in addition to the file if any
+
+	// a JSON record per tunnel, written separately from the logs above
+	AccessLog *AccessLogConfig `yaml:"access_log"`
+}
+
+// AccessLogConfig describes the destination of the access log.
+type AccessLogConfig struct {
+	File string `yaml:"file"` // may be "stdout" or "stderr"
+
+	// rotation of the log file, the same as those of LoggingConfig
+	MaxSize    string `yaml:"max_size"`
+	MaxAge     string `yaml:"max_age"`
+	MaxBackups int    `yaml:"max_backups"`
+}
+
+// SyslogConfig contains configuration about logging to syslog.
+type SyslogConfig struct {
+	Network  string `yaml:"network"` // udp or tcp, local syslog if empty
+	Address  string `yaml:"address"`
+	Facility string `yaml:"facility"` // user by default
+	Tag      string `yaml:"tag"`      // thestral2 by default
 }
 
 // MiscConfig contains configuration that doesn't fall into any of above.
 type MiscConfig struct {
-	ConnectTimeout string `yaml:"connect_timeout"`
-	MonitorPath    string `yaml:"monitor_path"`
-	EnableMonitor  bool   `yaml:"enable_monitor"`
-	PProfAddr      string `yaml:"pprof_addr"` // deprecated
-	DebugAddr      string `yaml:"debug_addr"` // in favor of this
+	ConnectTimeout   string `yaml:"connect_timeout"`
+	IdleTimeout      string `yaml:"idle_timeout"`
+	UpstreamStrategy string `yaml:"upstream_strategy"` // random/round_robin/sticky
+	StickyKey        string `yaml:"sticky_key"`        // client (default)/target
+	RelayBufferSize  string `yaml:"relay_buffer_size"`
+	MonitorPath      string `yaml:"monitor_path"` // or "unix:<socket path>"
+	EnableMonitor    bool   `yaml:"enable_monitor"`
+	MetricsAddr      string `yaml:"metrics_addr"` // serves /metrics if set
+	PProfAddr        string `yaml:"pprof_addr"`   // deprecated
+	DebugAddr        string `yaml:"debug_addr"`   // in favor of this
+	// interval of persisting the traffic usage of users
+	QuotaFlushInterval string `yaml:"quota_flush_interval"`
+	// timeout of each connection attempt via an upstream, in addition to its
+	// share of the connect_timeout of all the attempts
+	ConnectAttemptTimeout string `yaml:"connect_attempt_timeout"`
+	// closes a tunnel if no data is transferred in either direction within
+	// this duration after it's established, e.g. for stalled handshakes
+	FirstByteTimeout string `yaml:"first_byte_timeout"`
+	// closes a tunnel if a single read from either end of it or write to it
+	// blocks longer than these, e.g. for wedged sockets, regardless of the
+	// idle_timeout. Disabled if empty.
+	ReadTimeout  string `yaml:"read_timeout"`
+	WriteTimeout string `yaml:"write_timeout"`
+	// logs the bytes transferred by each tunnel at this interval while it's
+	// open, e.g. for stalled transfers, which is disabled if empty
+	ProgressLogInterval string `yaml:"progress_log_interval"`
+	// max size of the buffers pooled for the relays and the KCP frames, 4MB
+	// by default. Lowering it saves memory at the cost of allocating the
+	// larger buffers on each use, which are counted as misses of BufPool in
+	// the monitor report.
+	BufPoolMaxSize string `yaml:"buf_pool_max_size"`
+	// serves the gRPC admin API (see admin/admin.proto) if set
+	AdminGRPC *AdminGRPCConfig `yaml:"admin_grpc"`
+	// required by the monitor and the metrics if set, which are otherwise
+	// open to anyone reaching them
+	MonitorAuth *MonitorAuthConfig `yaml:"monitor_auth"`
+	// rejects the requests relayed by more instances than this (8 by
+	// default), which are told by the PROXY protocol headers sent by them
+	// (see DirectTCPClient). The ones relayed by this instance are always
+	// rejected as loops.
+	MaxRelayHops int `yaml:"max_relay_hops"`
+	// half-closes the other end of a tunnel (i.e. shutdown for writing) when
+	// one end closes, so that the other direction keeps draining until it
+	// closes too, like the usual TCP proxies. Otherwise both ends are closed
+	// at once, which truncates the responses to the clients half-closing
+	// after sending the requests. The ends that can't be half-closed (e.g.
+	// over KCP or compression) are always closed at once.
+	HalfClose bool `yaml:"half_close"`
+	// buffers up to this many bytes read in each direction of a tunnel (plus
+	// a read, and counted by the buffers held rather than the bytes read in
+	// them), so that a burst from one end is absorbed while the other end
+	// is slow to take it, and the reads stop only once it's reached. The
+	// reads wait for each write by default, and the relays spliced by the
+	// kernel (between TCP connections without any timeout) are unaffected.
+	RelayWatermark string `yaml:"relay_watermark"`
+}
+
+// AdminGRPCConfig contains configuration about the gRPC admin API.
+type AdminGRPCConfig struct {
+	Address string     `yaml:"address"`
+	TLS     *TLSConfig `yaml:"tls"`   // plaintext if not set
+	Token   string     `yaml:"token"` // required as a bearer token if set
+}
+
+// MonitorAuthConfig contains the credentials required by the monitor, i.e.
+// HTTP Basic auth and/or a bearer token, either of which is accepted.
+type MonitorAuthConfig struct {
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	Token    string `yaml:"token"`
 }
 
 // ParseConfigFile parses a given configuration file into a Config struct.
 // If an empty string is given, the configuration file will be searched
-// in some default locations.
+// in some default locations. Environment variables are expanded in the string
+// values of the file after parsing (see expandEnvVarsIn). Hence they can't be
+// used for the numbers or the booleans, e.g. "weight: ${W}" fails to parse,
+// and "port: ${P}" in the settings is always a string.
+//
+// The files listed in 'include' are parsed and merged in order before the
+// including file, so that later files override the earlier ones. Entries of
+// maps such as upstreams are overridden by key, and so are the fields of
+// logging and misc (with non-zero values only). Relative paths are resolved
+// against the directory of the including file.
 func ParseConfigFile(configFile string) (*Config, error) {
 	var err error
 	if configFile == "" {
@@ -102,6 +401,21 @@ func ParseConfigFile(configFile string) (*Config, error) {
 			return nil, err
 		}
 	}
+	return parseConfigFile(configFile, nil)
+}
+
+func parseConfigFile(configFile string, including []string) (*Config, error) {
+	absPath, err := filepath.Abs(configFile)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	for _, path := range including {
+		if path == absPath {
+			return nil, errors.Errorf("include cycle: %s -> %s",
+				strings.Join(including, " -> "), absPath)
+		}
+	}
+	including = append(including[:len(including):len(including)], absPath)
 
 	configData, err := ioutil.ReadFile(configFile)
 	if err != nil {
@@ -113,8 +427,155 @@ func ParseConfigFile(configFile string) (*Config, error) {
 	if err != nil {
 		return nil, err
 	}
+	if err = expandEnvVarsIn(reflect.ValueOf(&config)); err != nil {
+		return nil, errors.WithMessage(err, "failed to parse "+configFile)
+	}
+	if len(config.Include) == 0 {
+		return &config, nil
+	}
 
-	return &config, nil
+	var merged Config
+	for _, include := range config.Include {
+		if !filepath.IsAbs(include) {
+			include = filepath.Join(filepath.Dir(configFile), include)
+		}
+		included, err := parseConfigFile(include, including)
+		if err != nil {
+			return nil, errors.WithMessage(
+				err, "failed to include file in "+configFile)
+		}
+		mergeConfig(&merged, included)
+	}
+	mergeConfig(&merged, &config)
+	merged.Include = nil
+	return &merged, nil
+}
+
+// mergeConfig overrides the settings in dst with those in src.
+func mergeConfig(dst, src *Config) {
+	mergeMap(&dst.Downstreams, src.Downstreams)
+	mergeMap(&dst.Upstreams, src.Upstreams)
+	mergeMap(&dst.Rules, src.Rules)
+	mergeMap(&dst.Scopes, src.Scopes)
+	mergeMap(&dst.DEFAULTS, src.DEFAULTS)
+	overrideNonZero(&dst.Logging, &src.Logging)
+	overrideNonZero(&dst.Misc, &src.Misc)
+	if src.DB != nil {
+		dst.DB = src.DB
+	}
+	if src.GeoIP != nil {
+		dst.GeoIP = src.GeoIP
+	}
+	if src.DNS != nil {
+		dst.DNS = src.DNS
+	}
+}
+
+// mergeMap copies the entries of src into *dst, which is a pointer to a map of
+// the same type.
+func mergeMap(dst, src interface{}) {
+	d, s := reflect.ValueOf(dst).Elem(), reflect.ValueOf(src)
+	if s.Len() == 0 {
+		return
+	} else if d.IsNil() {
+		d.Set(reflect.MakeMap(s.Type()))
+	}
+	for _, key := range s.MapKeys() {
+		d.SetMapIndex(key, s.MapIndex(key))
+	}
+}
+
+// overrideNonZero copies the non-zero fields of *src to *dst, which are
+// structs of the same type.
+func overrideNonZero(dst, src interface{}) {
+	d, s := reflect.ValueOf(dst).Elem(), reflect.ValueOf(src).Elem()
+	for i := 0; i < s.NumField(); i++ {
+		if !s.Field(i).IsZero() {
+			d.Field(i).Set(s.Field(i))
+		}
+	}
+}
+
+var envVarRe = regexp.MustCompile(
+	`\$\$|\$\{([A-Za-z_][0-9A-Za-z_]*)(:-([^}]*))?\}`)
+
+// expandEnvVars replaces ${VAR} with the value of the environment variable VAR,
+// and ${VAR:-default} with the default value if VAR is unset or empty. "$$"
+// is an escape of a literal "$". It fails if any variable without a default
+// value is unset.
+func expandEnvVars(s string) (string, error) {
+	var missing []string
+	result := envVarRe.ReplaceAllStringFunc(s, func(match string) string {
+		if match == "$$" {
+			return "$"
+		}
+		groups := envVarRe.FindStringSubmatch(match)
+		if value, ok := os.LookupEnv(groups[1]); ok && value != "" {
+			return value
+		} else if groups[2] != "" {
+			return groups[3]
+		} else if !ok {
+			missing = append(missing, groups[1])
+		}
+		return ""
+	})
+	if len(missing) > 0 {
+		return "", errors.Errorf(
+			"environment variable not set: %s", strings.Join(missing, ", "))
+	}
+	return result, nil
+}
+
+// expandEnvVarsIn expands the environment variables (see expandEnvVars) in
+// all the strings held by v, i.e. the scalar values parsed from a file. Thus
+// the comments, the keys and the non-string values are left as they are.
+func expandEnvVarsIn(v reflect.Value) error {
+	switch v.Kind() {
+	case reflect.String:
+		s, err := expandEnvVars(v.String())
+		if err != nil {
+			return err
+		}
+		v.SetString(s)
+	case reflect.Ptr:
+		if !v.IsNil() {
+			return expandEnvVarsIn(v.Elem())
+		}
+	case reflect.Interface:
+		if !v.IsNil() { // the value held is not addressable
+			elem := reflect.New(v.Elem().Type()).Elem()
+			elem.Set(v.Elem())
+			if err := expandEnvVarsIn(elem); err != nil {
+				return err
+			}
+			v.Set(elem)
+		}
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if v.Type().Field(i).PkgPath != "" { // unexported
+				continue
+			}
+			if err := expandEnvVarsIn(v.Field(i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			if err := expandEnvVarsIn(v.Index(i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		for _, key := range v.MapKeys() {
+			elem := reflect.New(v.Type().Elem()).Elem()
+			elem.Set(v.MapIndex(key))
+			if err := expandEnvVarsIn(elem); err != nil {
+				return err
+			}
+			v.SetMapIndex(key, elem)
+		}
+	}
+	return nil
 }
 
 func getDefaultConfigFile() (string, error) {
@@ -0,0 +1,152 @@
+package lib
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExpandEnvVars(t *testing.T) {
+	require.NoError(t, os.Setenv("THESTRAL_TEST_SET", "value"))
+	require.NoError(t, os.Setenv("THESTRAL_TEST_EMPTY", ""))
+	require.NoError(t, os.Unsetenv("THESTRAL_TEST_UNSET"))
+	defer func() {
+		_ = os.Unsetenv("THESTRAL_TEST_SET")
+		_ = os.Unsetenv("THESTRAL_TEST_EMPTY")
+	}()
+
+	cases := map[string]string{
+		"dsn: ${THESTRAL_TEST_SET}":                "dsn: value",
+		"${THESTRAL_TEST_SET}${THESTRAL_TEST_SET}": "valuevalue",
+		"${THESTRAL_TEST_UNSET:-default}":          "default",
+		"${THESTRAL_TEST_UNSET:-}":                 "",
+		"${THESTRAL_TEST_EMPTY:-default}":          "default",
+		"${THESTRAL_TEST_EMPTY}":                   "",
+		"${THESTRAL_TEST_SET:-default}":            "value",
+		"$$":                                       "$",
+		"$${THESTRAL_TEST_SET}":                    "${THESTRAL_TEST_SET}",
+		"$THESTRAL_TEST_SET $":                     "$THESTRAL_TEST_SET $",
+	}
+	for input, expected := range cases {
+		result, err := expandEnvVars(input)
+		if assert.NoError(t, err, input) {
+			assert.Equal(t, expected, result, input)
+		}
+	}
+
+	_, err := expandEnvVars("${THESTRAL_TEST_UNSET}")
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "THESTRAL_TEST_UNSET")
+	}
+}
+
+func TestParseConfigFileEnvVars(t *testing.T) {
+	require.NoError(t, os.Setenv("THESTRAL_TEST_SET", "value"))
+	require.NoError(t, os.Unsetenv("THESTRAL_TEST_UNSET"))
+	defer func() { _ = os.Unsetenv("THESTRAL_TEST_SET") }()
+	tmpFile, err := ioutil.TempFile("", "thestral2_TestParseConfigFileEnvVars")
+	require.NoError(t, err)
+	defer func() { _ = os.Remove(tmpFile.Name()) }()
+	parse := func(content string) (*Config, error) {
+		require.NoError(t, ioutil.WriteFile(
+			tmpFile.Name(), []byte(content), 0600))
+		return ParseConfigFile(tmpFile.Name())
+	}
+
+	// only the values are expanded, not the comments
+	config, err := parse(`
+# the user is ${THESTRAL_TEST_UNSET}
+upstreams:
+  u: {protocol: socks5, address: "${THESTRAL_TEST_SET}:1080", n: [$$1]}
+db: {driver: sqlite3, dsn: '${THESTRAL_TEST_UNSET:-default}'}
+`)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{
+		"address": "value:1080", "n": []interface{}{"$1"}},
+		config.Upstreams["u"].Settings)
+	assert.Equal(t, "default", config.DB.DSN)
+
+	_, err = parse("db: {driver: sqlite3, dsn: '${THESTRAL_TEST_UNSET}'}\n")
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "THESTRAL_TEST_UNSET")
+	}
+
+	// only the strings are expanded, so the numbers can't be set
+	require.NoError(t, os.Setenv("THESTRAL_TEST_SET", "1080"))
+	config, err = parse(`
+upstreams:
+  u:
+    protocol: socks5
+    port: ${THESTRAL_TEST_SET}
+`)
+	require.NoError(t, err)
+	assert.Equal(t, "1080", config.Upstreams["u"].Settings["port"])
+	_, err = parse(`
+upstreams:
+  u:
+    protocol: socks5
+    weight: ${THESTRAL_TEST_SET}
+`)
+	assert.Error(t, err)
+}
+
+func TestParseConfigFileInclude(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "thestral2_TestParseConfigFileInclude")
+	require.NoError(t, err)
+	defer func() { _ = os.RemoveAll(tmpDir) }()
+
+	files := map[string]string{
+		"main.yml": `
+include: [parts/a.yml, parts/b.yml]
+upstreams:
+  u2: {protocol: socks5, address: "main"}
+logging: {level: info}
+`,
+		"parts/a.yml": `
+include: [c.yml]
+upstreams:
+  u1: {protocol: direct}
+  u2: {protocol: direct}
+logging: {level: debug, format: json}
+misc: {connect_timeout: 10s}
+`,
+		"parts/b.yml": `
+upstreams:
+  u1: {protocol: socks5, address: "b"}
+`,
+		"parts/c.yml": `
+rules:
+  r: {domains: [example.com]}
+db: {driver: sqlite3}
+`,
+		"cycle1.yml": "include: [cycle2.yml]\n",
+		"cycle2.yml": "include: [cycle1.yml]\n",
+	}
+	require.NoError(t, os.Mkdir(filepath.Join(tmpDir, "parts"), 0700))
+	for name, content := range files {
+		require.NoError(t, ioutil.WriteFile(
+			filepath.Join(tmpDir, name), []byte(content), 0600))
+	}
+
+	config, err := ParseConfigFile(filepath.Join(tmpDir, "main.yml"))
+	require.NoError(t, err)
+	assert.Nil(t, config.Include)
+	assert.Equal(t, "b", config.Upstreams["u1"].Settings["address"])
+	assert.Equal(t, "main", config.Upstreams["u2"].Settings["address"])
+	assert.Equal(t, []string{"example.com"}, config.Rules["r"].Domains)
+	assert.Equal(t,
+		LoggingConfig{Level: "info", Format: "json"}, config.Logging)
+	assert.Equal(t, "10s", config.Misc.ConnectTimeout)
+	if assert.NotNil(t, config.DB) {
+		assert.Equal(t, "sqlite3", config.DB.Driver)
+	}
+
+	_, err = ParseConfigFile(filepath.Join(tmpDir, "cycle1.yml"))
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "include cycle")
+	}
+}
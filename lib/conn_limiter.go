@@ -0,0 +1,51 @@
+package lib
+
+import (
+	"context"
+)
+
+// ConnLimiter limits the number of concurrent connections. A nil ConnLimiter
+// imposes no limit.
+type ConnLimiter struct {
+	slots chan struct{}
+}
+
+// NewConnLimiter creates a ConnLimiter allowing at most max connections.
+func NewConnLimiter(max int) *ConnLimiter {
+	return &ConnLimiter{make(chan struct{}, max)}
+}
+
+// TryAcquire acquires a connection slot without blocking. It returns false if
+// no slot is available.
+func (l *ConnLimiter) TryAcquire() bool {
+	if l == nil {
+		return true
+	}
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// Acquire acquires a connection slot, blocking until one is available or the
+// context is done. It returns false in the latter case.
+func (l *ConnLimiter) Acquire(ctx context.Context) bool {
+	if l == nil {
+		return true
+	}
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// Release releases a connection slot acquired before.
+func (l *ConnLimiter) Release() {
+	if l != nil {
+		<-l.slots
+	}
+}
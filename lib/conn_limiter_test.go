@@ -0,0 +1,32 @@
+package lib
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConnLimiter(t *testing.T) {
+	var unlimited *ConnLimiter
+	for i := 0; i < 10; i++ {
+		assert.True(t, unlimited.TryAcquire())
+	}
+
+	limiter := NewConnLimiter(2)
+	assert.True(t, limiter.TryAcquire())
+	assert.True(t, limiter.Acquire(context.Background()))
+	assert.False(t, limiter.TryAcquire())
+
+	ctx, cancelFunc := context.WithTimeout(
+		context.Background(), time.Millisecond*10)
+	defer cancelFunc()
+	assert.False(t, limiter.Acquire(ctx))
+
+	go func() {
+		time.Sleep(time.Millisecond * 10)
+		limiter.Release()
+	}()
+	assert.True(t, limiter.Acquire(context.Background()))
+}
@@ -0,0 +1,128 @@
+package lib
+
+import (
+	"context"
+	"io"
+	"net"
+
+	"github.com/pkg/errors"
+)
+
+// Bind listens for a connection from the target (see ProxyBinder) on the
+// BindAddr, or the local address routed to the target, so that the address
+// returned is reachable by it. Only the connections from the IPs of the target
+// are accepted, and thus an unspecified target (e.g. 0.0.0.0), which would let
+// anyone connect to the client, is rejected.
+func (c DirectTCPClient) Bind(ctx context.Context, addr Address) (
+	Address, func() (io.ReadWriteCloser, Address, *ProxyError), *ProxyError) {
+	var ips []net.IP
+	switch a := addr.(type) {
+	case *TCP4Addr:
+		ips = []net.IP{a.IP}
+	case *TCP6Addr:
+		ips = []net.IP{a.IP}
+	case *DomainNameAddr:
+		var err error
+		if c.Resolver != nil {
+			ips, err = c.Resolver.LookupIP(ctx, a.DomainName)
+		} else {
+			ips, err = net.DefaultResolver.LookupIP(ctx, "ip", a.DomainName)
+		}
+		if err != nil {
+			return nil, nil, wrapAsProxyError(
+				errors.WithStack(err), ProxyHostUnreachable)
+		}
+	default:
+		return nil, nil, wrapAsProxyError(
+			errors.Errorf("unsupported address for DirectTCPClient: %s", addr),
+			ProxyAddrUnsupported)
+	}
+	for _, ip := range ips {
+		if ip.IsUnspecified() {
+			return nil, nil, wrapAsProxyError(errors.Errorf(
+				"unspecified target to bind for: %s", addr), ProxyNotAllowed)
+		}
+	}
+	if len(ips) == 0 {
+		return nil, nil, wrapAsProxyError(&net.DNSError{
+			Err: "no such host", Name: addr.String()}, ProxyHostUnreachable)
+	}
+
+	localIP := c.BindAddr
+	if localIP == nil {
+		localIP = localIPRoutedTo(ips[0])
+	}
+	lc := net.ListenConfig{}
+	if c.BindInterface != "" {
+		var err error
+		if lc.Control, err = bindToDevice(c.BindInterface); err != nil {
+			return nil, nil, wrapAsProxyError(err, ProxyGeneralErr)
+		}
+	}
+	listener, err := lc.Listen(ctx, "tcp", (&net.TCPAddr{
+		IP: localIP, Zone: c.BindZone}).String())
+	if err != nil {
+		return nil, nil, wrapAsProxyError(
+			errors.WithStack(err), ProxyGeneralErr)
+	}
+	boundAddr, err := FromNetAddr(listener.Addr())
+	if err != nil {
+		_ = listener.Close()
+		return nil, nil, wrapAsProxyError(err, ProxyGeneralErr)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-done:
+		}
+		_ = listener.Close()
+	}()
+	accept := func() (io.ReadWriteCloser, Address, *ProxyError) {
+		defer close(done)
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				if ctx.Err() != nil {
+					err = ctx.Err()
+				}
+				return nil, nil, wrapAsProxyError(
+					errors.WithStack(err), dialErrorType(err))
+			}
+			peer := conn.RemoteAddr().(*net.TCPAddr)
+			if !containsIP(ips, peer.IP) {
+				_ = conn.Close() // not from the target
+				continue
+			}
+			if err = c.TCPOptions.Apply(conn); err != nil {
+				_ = conn.Close()
+				return nil, nil, wrapAsProxyError(err, ProxyGeneralErr)
+			}
+			peerAddr, err := FromNetAddr(peer)
+			return conn, peerAddr, wrapAsProxyError(err, ProxyGeneralErr)
+		}
+	}
+	return boundAddr, accept, nil
+}
+
+// localIPRoutedTo finds the local IP the packets to the given one are sent
+// from, or nil if there's no route. Nothing is sent at all.
+func localIPRoutedTo(ip net.IP) net.IP {
+	conn, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: ip, Port: 9})
+	if err != nil {
+		return nil
+	}
+	defer conn.Close() // nolint: errcheck
+	return conn.LocalAddr().(*net.UDPAddr).IP
+}
+
+// containsIP tells whether the IP is one of the given ones.
+func containsIP(ips []net.IP, ip net.IP) bool {
+	for _, i := range ips {
+		if i.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
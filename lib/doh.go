@@ -0,0 +1,199 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	dohContentType     = "application/dns-message"
+	maxDoHResponseSize = 64 * 1024
+	dohIdleConnTimeout = time.Minute * 5
+)
+
+// DoHResolver is a DomainResolver querying a DNS-over-HTTPS (RFC 8484)
+// server, which avoids the answers poisoned by the local network.
+type DoHResolver struct {
+	url      string
+	client   *http.Client
+	fallback func(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+// NewDoHResolver creates a DoHResolver from the given configuration. If any
+// bootstrap IP is given, the host in the URL is connected via them instead of
+// being resolved.
+func NewDoHResolver(config DoHConfig) (*DoHResolver, error) {
+	u, err := url.Parse(config.URL)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid DoH url")
+	} else if u.Scheme != "https" || u.Host == "" {
+		return nil, errors.New("an https url is required for DoH")
+	}
+
+	var bootstrap []string
+	for _, s := range config.Bootstrap {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, errors.New("invalid bootstrap IP of DoH: " + s)
+		}
+		bootstrap = append(bootstrap, ip.String())
+	}
+	transport := &http.Transport{
+		DialContext:         new(net.Dialer).DialContext,
+		TLSHandshakeTimeout: defaultTLSHandshakeTimeout,
+		IdleConnTimeout:     dohIdleConnTimeout,
+		ForceAttemptHTTP2:   true,
+	}
+	if len(bootstrap) > 0 {
+		transport.DialContext = func(
+			ctx context.Context, network, address string) (net.Conn, error) {
+			_, port, err := net.SplitHostPort(address)
+			if err != nil {
+				return nil, errors.WithStack(err)
+			}
+			var conn net.Conn
+			for _, ip := range bootstrap {
+				conn, err = new(net.Dialer).DialContext(
+					ctx, network, net.JoinHostPort(ip, port))
+				if err == nil || ctx.Err() != nil {
+					break
+				}
+			}
+			return conn, err
+		}
+	}
+
+	r := &DoHResolver{url: u.String(), client: &http.Client{Transport: transport}}
+	if config.Fallback {
+		r.fallback = net.DefaultResolver.LookupIPAddr
+	}
+	return r, nil
+}
+
+// LookupIP resolves a domain name by querying both the A and AAAA records.
+// The system resolver is used instead if the queries fail and the fallback is
+// enabled.
+func (r *DoHResolver) LookupIP(
+	ctx context.Context, domain string) ([]net.IP, error) {
+	ips, err := r.lookup(ctx, domain)
+	if err != nil && r.fallback != nil && ctx.Err() == nil {
+		if _, notFound := errors.Cause(err).(*net.DNSError); !notFound {
+			addrs, fbErr := r.fallback(ctx, domain)
+			if fbErr != nil {
+				return nil, errors.WithStack(fbErr)
+			}
+			ips = make([]net.IP, len(addrs))
+			for i := range addrs {
+				ips[i] = addrs[i].IP
+			}
+			return ips, nil
+		}
+	}
+	return ips, err
+}
+
+func (r *DoHResolver) lookup(
+	ctx context.Context, domain string) ([]net.IP, error) {
+	type result struct {
+		ips []net.IP
+		err error
+	}
+	qTypes := []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA}
+	resultCh := make(chan result, len(qTypes))
+	for _, qType := range qTypes {
+		go func(qType dnsmessage.Type) {
+			ips, err := r.query(ctx, domain, qType)
+			resultCh <- result{ips, err}
+		}(qType)
+	}
+
+	var ips []net.IP
+	var err error
+	for range qTypes {
+		res := <-resultCh
+		ips = append(ips, res.ips...)
+		if res.err != nil && err == nil {
+			err = res.err
+		}
+	}
+	if len(ips) > 0 {
+		return ips, nil // one of the families is enough
+	} else if err == nil {
+		err = &net.DNSError{Err: "no such host", Name: domain}
+	}
+	return nil, err
+}
+
+// query sends a DNS query for the given type of records in the POST way.
+func (r *DoHResolver) query(ctx context.Context, domain string,
+	qType dnsmessage.Type) ([]net.IP, error) {
+	if !strings.HasSuffix(domain, ".") {
+		domain += "."
+	}
+	name, err := dnsmessage.NewName(domain)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	// the ID should be 0 for the cache friendliness (RFC 8484, 4.1)
+	query := dnsmessage.Message{
+		Header: dnsmessage.Header{RecursionDesired: true},
+		Questions: []dnsmessage.Question{
+			{Name: name, Type: qType, Class: dnsmessage.ClassINET}},
+	}
+	packed, err := query.Pack()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, r.url, bytes.NewReader(packed))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	req.Header.Set("Content-Type", dohContentType)
+	req.Header.Set("Accept", dohContentType)
+	resp, err := r.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, errors.WithMessage(err, "DoH request failed")
+	}
+	defer resp.Body.Close() // nolint: errcheck
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("DoH server responded: " + resp.Status)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxDoHResponseSize))
+	if err != nil {
+		return nil, errors.WithMessage(err, "failed to read DoH response")
+	}
+
+	var answer dnsmessage.Message
+	if err = answer.Unpack(body); err != nil {
+		return nil, errors.WithMessage(err, "invalid DoH response")
+	}
+	switch answer.RCode {
+	case dnsmessage.RCodeSuccess:
+	case dnsmessage.RCodeNameError:
+		return nil, errors.WithStack(
+			&net.DNSError{Err: "no such host", Name: domain})
+	default:
+		return nil, errors.New("DoH query failed: " + answer.RCode.String())
+	}
+	var ips []net.IP
+	for _, rr := range answer.Answers {
+		switch body := rr.Body.(type) {
+		case *dnsmessage.AResource:
+			ips = append(ips, net.IP(body.A[:]))
+		case *dnsmessage.AAAAResource:
+			ips = append(ips, net.IP(body.AAAA[:]))
+		}
+	}
+	return ips, nil
+}
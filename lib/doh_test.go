@@ -0,0 +1,127 @@
+package lib
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func startMockDoHServer(t *testing.T) *httptest.Server {
+	return httptest.NewTLSServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			body, _ := ioutil.ReadAll(r.Body)
+			if r.Header.Get("Content-Type") != dohContentType {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			packed := mockDNSResponse(t, body)
+			if packed == nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			w.Header().Set("Content-Type", dohContentType)
+			_, _ = w.Write(packed)
+		}))
+}
+
+// mockDNSResponse answers a DNS query, with 1.2.3.4 and 2001:db8::1 for
+// example.com, or NXDOMAIN for the others. It returns nil on a bad query.
+func mockDNSResponse(t *testing.T, packedQuery []byte) []byte {
+	var query dnsmessage.Message
+	if query.Unpack(packedQuery) != nil || len(query.Questions) != 1 {
+		return nil
+	}
+	q := query.Questions[0]
+	resp := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: query.ID, Response: true},
+		Questions: query.Questions,
+	}
+	hdr := dnsmessage.ResourceHeader{
+		Name: q.Name, Type: q.Type, Class: q.Class}
+	switch {
+	case q.Name.String() != "example.com.":
+		resp.RCode = dnsmessage.RCodeNameError
+	case q.Type == dnsmessage.TypeA:
+		resp.Answers = append(resp.Answers, dnsmessage.Resource{
+			Header: hdr, Body: &dnsmessage.AResource{
+				A: [4]byte{1, 2, 3, 4}}})
+	case q.Type == dnsmessage.TypeAAAA:
+		resp.Answers = append(resp.Answers, dnsmessage.Resource{
+			Header: hdr, Body: &dnsmessage.AAAAResource{
+				AAAA: [16]byte{0x20, 0x01, 0x0d, 0xb8, 15: 1}}})
+	}
+	packed, err := resp.Pack()
+	require.NoError(t, err)
+	return packed
+}
+
+func TestDoHResolver(t *testing.T) {
+	server := startMockDoHServer(t)
+	defer server.Close()
+	_, port, err := net.SplitHostPort(server.Listener.Addr().String())
+	require.NoError(t, err)
+
+	// the certificate of the test server is valid for example.com
+	r, err := NewDoHResolver(DoHConfig{
+		URL:       "https://example.com:" + port + "/dns-query",
+		Bootstrap: []string{"127.0.0.1"},
+	})
+	require.NoError(t, err)
+	r.client.Transport.(*http.Transport).TLSClientConfig =
+		server.Client().Transport.(*http.Transport).TLSClientConfig
+
+	ips, err := r.LookupIP(context.Background(), "example.com")
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []net.IP{
+		net.IPv4(1, 2, 3, 4).To4(), net.ParseIP("2001:db8::1")}, ips)
+
+	_, err = r.LookupIP(context.Background(), "not.found")
+	if assert.Error(t, err) {
+		assert.IsType(t, &net.DNSError{}, errors.Cause(err))
+	}
+}
+
+func TestDoHResolverFallback(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	u := url.URL{Scheme: "https", Host: l.Addr().String(), Path: "/dns-query"}
+	_ = l.Close()
+
+	r, err := NewDoHResolver(DoHConfig{URL: u.String()})
+	require.NoError(t, err)
+	_, err = r.LookupIP(context.Background(), "example.com")
+	assert.Error(t, err)
+
+	r, err = NewDoHResolver(DoHConfig{URL: u.String(), Fallback: true})
+	require.NoError(t, err)
+	r.fallback = func(ctx context.Context, host string) ([]net.IPAddr, error) {
+		return []net.IPAddr{{IP: net.ParseIP("5.6.7.8")}}, nil
+	}
+	ips, err := r.LookupIP(context.Background(), "example.com")
+	assert.NoError(t, err)
+	assert.Equal(t, []net.IP{net.ParseIP("5.6.7.8")}, ips)
+}
+
+func TestDoHConfig(t *testing.T) {
+	for _, config := range []DNSConfig{
+		{DoH: &DoHConfig{URL: "http://1.1.1.1/dns-query"}},
+		{DoH: &DoHConfig{URL: "https:///dns-query"}},
+		{DoH: &DoHConfig{URL: "https://a.b/dns-query", Bootstrap: []string{"x"}}},
+		{DoH: &DoHConfig{URL: "https://1.1.1.1/dns-query"}, Server: "8.8.8.8"},
+	} {
+		_, err := NewCachingResolver(config)
+		assert.Error(t, err, "%+v", config.DoH)
+	}
+	_, err := NewCachingResolver(
+		DNSConfig{DoH: &DoHConfig{URL: "https://1.1.1.1/dns-query"}})
+	assert.NoError(t, err)
+}
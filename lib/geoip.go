@@ -0,0 +1,94 @@
+package lib
+
+import (
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/oschwald/maxminddb-golang"
+	"github.com/pkg/errors"
+)
+
+// CountryLookup finds the country of an IP address.
+type CountryLookup interface {
+	// Country returns the ISO 3166-1 alpha-2 code of the country where the
+	// given IP is located, or an empty string if it is unknown.
+	Country(ip net.IP) string
+}
+
+// GeoIPDB is a CountryLookup backed by a MaxMind GeoIP2/GeoLite2 database.
+type GeoIPDB struct {
+	path    string
+	lock    sync.RWMutex
+	reader  *maxminddb.Reader
+	modTime time.Time
+}
+
+type geoIPRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+}
+
+// OpenGeoIPDB opens the MaxMind database (.mmdb) at the given path.
+func OpenGeoIPDB(path string) (*GeoIPDB, error) {
+	db := &GeoIPDB{path: path}
+	if _, err := db.Reload(); err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+// Reload reopens the database if it has been modified since the last load.
+// It reports whether the database is actually reloaded. The previous one is
+// kept if the new one cannot be opened.
+func (db *GeoIPDB) Reload() (bool, error) {
+	info, err := os.Stat(db.path)
+	if err != nil {
+		return false, errors.WithStack(err)
+	}
+	db.lock.RLock()
+	unchanged := db.reader != nil && info.ModTime().Equal(db.modTime)
+	db.lock.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	reader, err := maxminddb.Open(db.path)
+	if err != nil {
+		return false, errors.Wrap(err, "failed to open GeoIP database")
+	}
+	db.lock.Lock()
+	old := db.reader
+	db.reader, db.modTime = reader, info.ModTime()
+	db.lock.Unlock()
+	if old != nil {
+		_ = old.Close()
+	}
+	return true, nil
+}
+
+// Country implements CountryLookup.
+func (db *GeoIPDB) Country(ip net.IP) string {
+	var record geoIPRecord
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+	if db.reader == nil || db.reader.Lookup(ip, &record) != nil {
+		return ""
+	}
+	return strings.ToUpper(record.Country.ISOCode)
+}
+
+// Close closes the database.
+func (db *GeoIPDB) Close() error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	if db.reader == nil {
+		return nil
+	}
+	err := db.reader.Close()
+	db.reader = nil
+	return errors.WithStack(err)
+}
@@ -0,0 +1,253 @@
+package lib
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultHealthCheckInterval  = time.Second * 30
+	defaultHealthCheckThreshold = 3
+	defaultFailureRateWindow    = time.Minute
+	defaultFailureRateMinConns  = 10
+)
+
+// HealthChecker probes upstreams periodically and tracks their health.
+type HealthChecker struct {
+	log      *zap.SugaredLogger
+	monitor  *AppMonitor
+	checkers map[string]*upstreamHealthChecker
+}
+
+type upstreamHealthChecker struct {
+	lastFailure int64 // UNIX ns time, accessed atomically
+
+	name      string
+	client    ProxyClient
+	target    Address
+	interval  time.Duration
+	timeout   time.Duration
+	threshold int
+	failures  int32  // consecutive, accessed atomically
+	unhealthy uint32 // accessed atomically
+	// of the connections via the upstream, see HealthCheckConfig
+	failureRate       float64
+	failureRateWindow time.Duration
+	failureRateMin    uint32
+	degraded          uint32 // accessed atomically
+}
+
+// NewHealthChecker creates an empty HealthChecker. The health states are
+// reported to the given monitor.
+func NewHealthChecker(
+	log *zap.SugaredLogger, monitor *AppMonitor) *HealthChecker {
+	return &HealthChecker{
+		log:      log,
+		monitor:  monitor,
+		checkers: make(map[string]*upstreamHealthChecker),
+	}
+}
+
+// AddUpstream enables health checking on the given upstream. This must be
+// called before Run.
+func (h *HealthChecker) AddUpstream(
+	name string, client ProxyClient, config HealthCheckConfig) error {
+	target, err := ParseAddress(config.Target)
+	if err != nil {
+		return errors.WithMessage(err, "invalid health check target")
+	}
+	checker := &upstreamHealthChecker{
+		name:      name,
+		client:    client,
+		target:    target,
+		interval:  defaultHealthCheckInterval,
+		threshold: defaultHealthCheckThreshold,
+	}
+	if config.Interval != "" {
+		if checker.interval, err = time.ParseDuration(
+			config.Interval); err != nil {
+			return errors.WithStack(err)
+		} else if checker.interval <= 0 {
+			return errors.New("health check interval should be greater than 0")
+		}
+	}
+	checker.timeout = checker.interval
+	if config.Timeout != "" {
+		if checker.timeout, err = time.ParseDuration(
+			config.Timeout); err != nil {
+			return errors.WithStack(err)
+		} else if checker.timeout <= 0 {
+			return errors.New("health check timeout should be greater than 0")
+		}
+	}
+	if config.FailureThreshold < 0 {
+		return errors.New("health check failure threshold should not be negative")
+	} else if config.FailureThreshold > 0 {
+		checker.threshold = config.FailureThreshold
+	}
+	if err = checker.setFailureRate(config); err != nil {
+		return err
+	}
+	h.checkers[name] = checker
+	return nil
+}
+
+// InheritState takes over the health state of an upstream from the checker
+// being replaced (e.g. on reloading), if the upstream is checked by both, so
+// that it's not considered healthy again until probed. This must be called
+// after AddUpstream and before Run.
+func (h *HealthChecker) InheritState(upstream string, prev *HealthChecker) {
+	c, ok := h.checkers[upstream]
+	old, oldOk := prev.checkers[upstream]
+	if !ok || !oldOk {
+		return
+	}
+	atomic.StoreInt64(&c.lastFailure, atomic.LoadInt64(&old.lastFailure))
+	atomic.StoreInt32(&c.failures, atomic.LoadInt32(&old.failures))
+	atomic.StoreUint32(&c.unhealthy, atomic.LoadUint32(&old.unhealthy))
+	atomic.StoreUint32(&c.degraded, atomic.LoadUint32(&old.degraded))
+}
+
+// Run starts probing the upstreams and blocks until the context is done.
+func (h *HealthChecker) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, checker := range h.checkers {
+		wg.Add(1)
+		go func(c *upstreamHealthChecker) {
+			defer wg.Done()
+			h.runChecker(ctx, c)
+		}(checker)
+	}
+	wg.Wait()
+}
+
+func (c *upstreamHealthChecker) setFailureRate(config HealthCheckConfig) error {
+	if config.FailureRate < 0 || config.FailureRate >= 1 {
+		return errors.New("health check failure rate should be in [0, 1)")
+	}
+	c.failureRate = config.FailureRate
+	c.failureRateWindow = defaultFailureRateWindow
+	if config.FailureRateWindow != "" {
+		var err error
+		if c.failureRateWindow, err = time.ParseDuration(
+			config.FailureRateWindow); err != nil {
+			return errors.WithStack(err)
+		} else if c.failureRateWindow < time.Second ||
+			c.failureRateWindow > outcomeWindowSlots*time.Second {
+			return errors.Errorf(
+				"health check failure rate window should be in [1s, %s]",
+				outcomeWindowSlots*time.Second)
+		}
+	}
+	c.failureRateMin = defaultFailureRateMinConns
+	if config.FailureRateMinConns < 0 {
+		return errors.New(
+			"health check failure rate min conns should not be negative")
+	} else if config.FailureRateMinConns > 0 {
+		c.failureRateMin = uint32(config.FailureRateMinConns)
+	}
+	return nil
+}
+
+// IsHealthy checks if an upstream is healthy, i.e. neither unhealthy by the
+// health checks nor degraded by its recent failure rate. Upstreams without
+// health checking are always considered healthy.
+func (h *HealthChecker) IsHealthy(upstream string) bool {
+	if checker, ok := h.checkers[upstream]; ok {
+		return atomic.LoadUint32(&checker.unhealthy) == 0 &&
+			!h.updateDegraded(checker, time.Now())
+	}
+	return true
+}
+
+// updateDegraded checks whether an upstream is degraded at the given time,
+// which recovers as soon as the failures slide out of the window, so that it
+// is tried again.
+func (h *HealthChecker) updateDegraded(
+	c *upstreamHealthChecker, now time.Time) bool {
+	if c.failureRate == 0 {
+		return false
+	}
+	successes, failures := h.monitor.upstreamOutcomes(
+		c.name, now, c.failureRateWindow)
+	total := successes + failures
+	degraded := total >= c.failureRateMin &&
+		float64(failures) > c.failureRate*float64(total)
+	if degraded && atomic.SwapUint32(&c.degraded, 1) == 0 {
+		h.log.Warnw("upstream became degraded", "upstream", c.name,
+			"failures", failures, "conns", total)
+		h.monitor.SetUpstreamDegraded(c.name, true)
+	} else if !degraded && atomic.SwapUint32(&c.degraded, 0) != 0 {
+		h.log.Infow("upstream recovered from degradation", "upstream", c.name)
+		h.monitor.SetUpstreamDegraded(c.name, false)
+	}
+	return degraded
+}
+
+// LeastRecentlyFailed returns the one of the given upstreams whose health
+// check failed least recently, e.g. as the last resort if all of them are
+// unhealthy. Upstreams without health checking or any failure come first.
+func (h *HealthChecker) LeastRecentlyFailed(upstreams []string) string {
+	selected, selectedFailure := "", int64(0)
+	for _, upstream := range upstreams {
+		var lastFailure int64
+		if checker, ok := h.checkers[upstream]; ok {
+			lastFailure = atomic.LoadInt64(&checker.lastFailure)
+		}
+		if selected == "" || lastFailure < selectedFailure {
+			selected, selectedFailure = upstream, lastFailure
+		}
+	}
+	return selected
+}
+
+func (h *HealthChecker) runChecker(
+	ctx context.Context, c *upstreamHealthChecker) {
+	h.monitor.SetUpstreamHealth(
+		c.name, atomic.LoadUint32(&c.unhealthy) == 0)
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+	for {
+		h.probe(ctx, c)
+		h.updateDegraded(c, time.Now()) // even if no request is routed
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (h *HealthChecker) probe(ctx context.Context, c *upstreamHealthChecker) {
+	probeCtx, cancelFunc := context.WithTimeout(ctx, c.timeout)
+	defer cancelFunc()
+	conn, _, pErr := c.client.Request(probeCtx, c.target)
+	if pErr == nil {
+		_ = conn.Close()
+		atomic.StoreInt32(&c.failures, 0)
+		if atomic.SwapUint32(&c.unhealthy, 0) != 0 {
+			h.log.Infow("upstream became healthy", "upstream", c.name)
+			h.monitor.SetUpstreamHealth(c.name, true)
+		}
+		return
+	}
+
+	if ctx.Err() != nil { // shutting down
+		return
+	}
+	failures := atomic.AddInt32(&c.failures, 1)
+	atomic.StoreInt64(&c.lastFailure, time.Now().UnixNano())
+	h.log.Debugw("health check failed", "upstream", c.name,
+		"error", pErr.Error, "errType", pErr.ErrType, "failures", failures)
+	if int(failures) >= c.threshold &&
+		atomic.SwapUint32(&c.unhealthy, 1) == 0 {
+		h.log.Warnw("upstream became unhealthy", "upstream", c.name,
+			"error", pErr.Error, "errType", pErr.ErrType)
+		h.monitor.SetUpstreamHealth(c.name, false)
+	}
+}
@@ -0,0 +1,153 @@
+package lib
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+type stubProxyClient struct {
+	failing uint32 // accessed atomically
+}
+
+func (c *stubProxyClient) Request(ctx context.Context, addr Address) (
+	io.ReadWriteCloser, Address, *ProxyError) {
+	if atomic.LoadUint32(&c.failing) != 0 {
+		return nil, nil, &ProxyError{
+			Error: io.ErrUnexpectedEOF, ErrType: ProxyConnectFailed}
+	}
+	conn, peer := net.Pipe()
+	_ = peer.Close()
+	return conn, addr, nil
+}
+
+func TestHealthChecker(t *testing.T) {
+	var monitor AppMonitor
+	checker := NewHealthChecker(zap.NewNop().Sugar(), &monitor)
+	client := &stubProxyClient{}
+	require.NoError(t, checker.AddUpstream("up", client, HealthCheckConfig{
+		Target: "127.0.0.1:80", Interval: "10ms", FailureThreshold: 2}))
+	require.Error(t, checker.AddUpstream("bad", client, HealthCheckConfig{
+		Target: "127.0.0.1:80", Interval: "-1s"}))
+
+	upstreamHealth := func() string {
+		for _, r := range monitor.Report().Upstreams {
+			if r.Name == "up" {
+				return r.Health
+			}
+		}
+		return ""
+	}
+
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	doneCh := make(chan struct{})
+	go func() {
+		checker.Run(ctx)
+		close(doneCh)
+	}()
+
+	assert.True(t, checker.IsHealthy("up"))
+	assert.True(t, checker.IsHealthy("unchecked"))
+
+	atomic.StoreUint32(&client.failing, 1)
+	assert.True(t, waitUntil(func() bool { return !checker.IsHealthy("up") }))
+	assert.Equal(t, "unhealthy", upstreamHealth())
+
+	atomic.StoreUint32(&client.failing, 0)
+	assert.True(t, waitUntil(func() bool { return checker.IsHealthy("up") }))
+	assert.Equal(t, "healthy", upstreamHealth())
+
+	cancelFunc()
+	<-doneCh
+}
+
+func TestHealthCheckerLeastRecentlyFailed(t *testing.T) {
+	var monitor AppMonitor
+	checker := NewHealthChecker(zap.NewNop().Sugar(), &monitor)
+	for _, name := range []string{"up1", "up2"} {
+		require.NoError(t, checker.AddUpstream(name, &stubProxyClient{1},
+			HealthCheckConfig{Target: "127.0.0.1:80"}))
+	}
+	ctx := context.Background()
+	checker.probe(ctx, checker.checkers["up2"])
+	time.Sleep(time.Millisecond)
+	checker.probe(ctx, checker.checkers["up1"])
+	assert.Equal(t, "up2", checker.LeastRecentlyFailed([]string{"up1", "up2"}))
+	assert.Equal(t, "up3",
+		checker.LeastRecentlyFailed([]string{"up1", "up2", "up3"}))
+	assert.Empty(t, checker.LeastRecentlyFailed(nil))
+}
+
+func TestHealthCheckerInheritState(t *testing.T) {
+	var monitor AppMonitor
+	config := HealthCheckConfig{Target: "127.0.0.1:80", FailureThreshold: 2}
+	prev := NewHealthChecker(zap.NewNop().Sugar(), &monitor)
+	require.NoError(t, prev.AddUpstream("up", &stubProxyClient{1}, config))
+	ctx := context.Background()
+	prev.probe(ctx, prev.checkers["up"])
+	prev.probe(ctx, prev.checkers["up"])
+	require.False(t, prev.IsHealthy("up"))
+
+	checker := NewHealthChecker(zap.NewNop().Sugar(), &monitor)
+	require.NoError(t, checker.AddUpstream("up", &stubProxyClient{}, config))
+	require.NoError(t, checker.AddUpstream("new", &stubProxyClient{}, config))
+	checker.InheritState("up", prev)
+	checker.InheritState("new", prev)
+	assert.False(t, checker.IsHealthy("up"))
+	assert.True(t, checker.IsHealthy("new"))
+	checker.probe(ctx, checker.checkers["up"])
+	assert.True(t, checker.IsHealthy("up"))
+}
+
+func TestHealthCheckerFailureRate(t *testing.T) {
+	var monitor AppMonitor
+	checker := NewHealthChecker(zap.NewNop().Sugar(), &monitor)
+	config := HealthCheckConfig{Target: "127.0.0.1:80", FailureRate: 0.5,
+		FailureRateWindow: "10s", FailureRateMinConns: 4}
+	require.NoError(t, checker.AddUpstream("up", &stubProxyClient{}, config))
+	for _, invalid := range []HealthCheckConfig{
+		{Target: "127.0.0.1:80", FailureRate: 1},
+		{Target: "127.0.0.1:80", FailureRate: 0.5, FailureRateWindow: "1h"},
+		{Target: "127.0.0.1:80", FailureRate: 0.5, FailureRateMinConns: -1},
+	} {
+		require.Error(t, checker.AddUpstream("bad", nil, invalid))
+	}
+	monitor.SetUpstreamHealth("up", true)
+
+	monitor.AddError("up")
+	monitor.AddError("up")
+	monitor.AddError("up")
+	assert.True(t, checker.IsHealthy("up")) // too few to tell
+	monitor.AddSuccess("up")
+	assert.False(t, checker.IsHealthy("up"))
+	assert.Equal(t, "degraded", monitor.Report().Upstreams[0].Health)
+	monitor.AddSuccess("up")
+	monitor.AddSuccess("up")
+	assert.True(t, checker.IsHealthy("up")) // 50% is not more than that
+	monitor.AddError("up")
+	assert.False(t, checker.IsHealthy("up"))
+
+	// recovered once the failures slide out of the window
+	c := checker.checkers["up"]
+	assert.False(t, checker.updateDegraded(
+		c, time.Now().Add(c.failureRateWindow)))
+	assert.Equal(t, "healthy", monitor.Report().Upstreams[0].Health)
+}
+
+// waitUntil waits for at most one second until cond returns true.
+func waitUntil(cond func() bool) bool {
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); {
+		if cond() {
+			return true
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	return cond()
+}
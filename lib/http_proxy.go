@@ -0,0 +1,404 @@
+package lib
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/richardtsai/thestral2/db"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultHTTPProxySvrHSTimeout = time.Minute * 3
+	httpProxyScope               = "proxy.http"
+	httpProxyRealm               = "thestral"
+)
+
+// HTTPProxyServer is a proxy server on HTTP protocol. It supports both the
+// CONNECT method and the plain requests with absolute URLs (http only).
+type HTTPProxyServer struct {
+	transport Transport
+	addrs     []string
+	checkUser CheckUserFunc
+	isRunning uint32 // should be used with atomic operations
+	listener  net.Listener
+	reqCh     chan ProxyRequest
+	log       *zap.SugaredLogger
+	hsTimeout time.Duration
+	blocked   BlockedConfig // Status is always set
+}
+
+// NewHTTPProxyServer creates a HTTPProxyServer from the given configuration.
+func NewHTTPProxyServer(
+	logger *zap.SugaredLogger,
+	config ProxyConfig) (*HTTPProxyServer, error) {
+	var addrs []string
+	var checkUser bool
+	hsTimeout := defaultHTTPProxySvrHSTimeout
+	var ok bool
+	var err error
+	for k, v := range config.Settings {
+		switch k {
+		case "address":
+			var e error
+			if addrs, e = parseListenAddrs(v); e != nil {
+				err = e
+			}
+		case "check_users":
+			if checkUser, ok = v.(bool); !ok {
+				err = errors.New("invalid value for 'check_users'")
+			}
+		case "handshake_timeout":
+			s, ok := v.(string)
+			if !ok {
+				err = errors.New("invalid value for 'handshake_timeout'")
+			} else if hsTimeout, err = time.ParseDuration(s); err != nil {
+				err = errors.Wrap(err, "invalid value for 'handshake_timeout'")
+			} else if hsTimeout <= 0 {
+				err = errors.New("'handshake_timeout' must be > 0")
+			}
+		default:
+			err = errors.New("unknown setting of 'http' protocol: " + k)
+		}
+	}
+	if err == nil && (len(addrs) == 0 || addrs[0] == "") {
+		err = errors.New("a valid 'address' must be specified for http protocol")
+	}
+	if err == nil && checkUser && !db.Configured() {
+		err = errors.New("user checking requires a database specified")
+	}
+	blocked := BlockedConfig{Status: http.StatusForbidden}
+	if err == nil && config.Blocked != nil {
+		if config.Blocked.Status != 0 {
+			blocked.Status = config.Blocked.Status
+		}
+		blocked.Message = config.Blocked.Message
+		if blocked.Status < 400 || blocked.Status > 599 {
+			err = errors.New("'status' of 'blocked' must be within [400, 599]")
+		}
+	}
+	if err != nil {
+		return nil, errors.WithMessage(err, "failed to create HTTP proxy server")
+	}
+
+	transport, err := CreateTransport(config.Transport)
+	if err != nil {
+		return nil, errors.WithMessage(err, "failed to create HTTP proxy server")
+	}
+	if config.ACL != nil {
+		transport, err = WrapTransACL(logger, transport, *config.ACL)
+		if err != nil {
+			return nil, errors.WithMessage(err, "failed to create HTTP proxy server")
+		}
+	}
+
+	var checkUserFunc CheckUserFunc
+	if checkUser {
+		checkUserFunc = func(user, password string) bool {
+			if dao, err := db.NewUserDAO(); err != nil {
+				logger.Errorw("failed to open user database", "error", err)
+				return false
+			} else { // nolint: golint
+				defer dao.Close() // nolint: errcheck
+				// an API token is accepted in place of the password
+				return dao.CheckAPIToken(httpProxyScope, user, password) ||
+					dao.CheckPassword(httpProxyScope, user, password)
+			}
+		}
+	}
+	server := newHTTPProxyServer(
+		logger, transport, addrs, checkUserFunc, hsTimeout)
+	server.blocked = blocked
+	return server, nil
+}
+
+// newHTTPProxyServer creates a HTTPProxyServer. It is used internally.
+func newHTTPProxyServer(
+	logger *zap.SugaredLogger, transport Transport, addrs []string,
+	checkUser CheckUserFunc, hsTimeout time.Duration) *HTTPProxyServer {
+	return &HTTPProxyServer{
+		transport: transport,
+		addrs:     addrs,
+		checkUser: checkUser,
+		log:       logger,
+		hsTimeout: hsTimeout,
+		blocked:   BlockedConfig{Status: http.StatusForbidden},
+	}
+}
+
+// Start fires up the HTTPProxyServer and returns a channel of client requests.
+func (s *HTTPProxyServer) Start() (<-chan ProxyRequest, error) {
+	s.reqCh = make(chan ProxyRequest, 1)
+
+	var err error
+	if s.listener, err = listenAll(s.transport, s.addrs); err != nil {
+		s.log.Errorw(
+			"failed to start HTTP proxy server", "addrs", s.addrs, "error", err)
+		return nil, errors.WithMessage(err, "failed to start HTTP proxy server")
+	}
+	s.log.Infow("HTTP proxy server started", "addrs", s.addrs)
+
+	atomic.StoreUint32(&s.isRunning, 1)
+	go func() {
+		for {
+			conn, err := acceptRetrying(s.listener, s.log)
+			if err != nil {
+				if atomic.LoadUint32(&s.isRunning) > 0 { // still running
+					s.log.Errorw("permanent accept error",
+						"error", err, "class", errorClass(err))
+				}
+				break
+			}
+
+			reqID := GetNextRequestID()
+			cliLogger := s.log.With("reqID", reqID).Named("client")
+			cliLogger.Debugw(
+				"client connection accepted", "addr", conn.RemoteAddr())
+			req := &httpProxyRequest{
+				id: reqID, conn: conn, br: bufio.NewReader(conn), log: cliLogger,
+				blocked: &s.blocked}
+
+			go s.handshake(req)
+		}
+		s.log.Infow("HTTP proxy server exited")
+	}()
+
+	return s.reqCh, nil
+}
+
+// Stop kill the server.
+func (s *HTTPProxyServer) Stop() {
+	s.log.Infow("stopping HTTP proxy server")
+	atomic.StoreUint32(&s.isRunning, 0)
+	err := s.listener.Close()
+	if err != nil {
+		s.log.Warnw("error occurred when closing listener", "error", err)
+	}
+}
+
+func (s *HTTPProxyServer) handshake(cli *httpProxyRequest) {
+	_ = cli.conn.SetDeadline(time.Now().Add(s.hsTimeout))
+	defer cli.conn.SetDeadline(time.Time{}) // nolint: errcheck
+	req, err := http.ReadRequest(cli.br)
+	if err != nil {
+		err = errors.Wrap(err, "failed to read HTTP request")
+		cli.respond(http.StatusBadRequest, nil)
+	}
+
+	if err == nil && s.checkUser != nil {
+		var ok bool
+		cli.user, ok = s.authUser(cli, req)
+		if !ok {
+			err = errors.New("user authentication failed")
+			cli.respond(http.StatusProxyAuthRequired, http.Header{
+				"Proxy-Authenticate": {`Basic realm="` + httpProxyRealm + `"`},
+			})
+		}
+	}
+
+	if err == nil {
+		cli.req = req
+		hostPort := req.Host
+		if req.Method == http.MethodConnect {
+			cli.connect = true
+		} else if req.URL.IsAbs() && req.URL.Scheme == "http" {
+			hostPort = req.URL.Host
+			if req.URL.Port() == "" {
+				hostPort = net.JoinHostPort(req.URL.Hostname(), "80")
+			}
+		} else {
+			err = errors.Errorf(
+				"client sent unsupported request: %s %s", req.Method, req.URL)
+			cli.respond(http.StatusBadRequest, nil)
+		}
+		if err == nil {
+			if cli.targetAddr, err = ParseAddress(hostPort); err != nil {
+				err = errors.WithMessage(err, "invalid target address")
+				cli.respond(http.StatusBadRequest, nil)
+			}
+		}
+	}
+
+	var peerIDs []*PeerIdentifier
+	if err == nil {
+		peerIDs, err = cli.GetPeerIdentifiers()
+	}
+	if err == nil {
+		cli.log.Debugw(
+			"handshake with HTTP proxy client succeeded",
+			"target", cli.targetAddr, "userIDs", peerIDs)
+		s.reqCh <- cli
+	} else {
+		cli.log.Warnw(
+			"handshake with HTTP proxy client failed",
+			"error", err, "userIDs", peerIDs, "clientAddr", cli.PeerAddr())
+		_ = cli.conn.Close()
+	}
+}
+
+func (s *HTTPProxyServer) authUser(
+	cli *httpProxyRequest, req *http.Request) (user string, ok bool) {
+	cli.log.Debugw("start basic authentication")
+	auth := req.Header.Get("Proxy-Authorization")
+	const prefix = "Basic "
+	if len(auth) < len(prefix) ||
+		!strings.EqualFold(auth[:len(prefix)], prefix) {
+		return "", false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(auth[len(prefix):])
+	if err != nil {
+		return "", false
+	}
+	parts := strings.SplitN(string(decoded), ":", 2)
+	if len(parts) != 2 {
+		return "", false
+	}
+	if !s.checkUser(parts[0], parts[1]) {
+		cli.log.Warnw("user authentication failed", "user", parts[0])
+		return parts[0], false
+	}
+	return parts[0], true
+}
+
+type httpProxyRequest struct {
+	id         string
+	log        *zap.SugaredLogger
+	conn       net.Conn
+	br         *bufio.Reader
+	user       string
+	req        *http.Request
+	connect    bool
+	targetAddr Address
+	blocked    *BlockedConfig
+}
+
+func (r *httpProxyRequest) respond(code int, header http.Header) {
+	r.respondWithBody(code, header, "")
+}
+
+func (r *httpProxyRequest) respondWithBody(
+	code int, header http.Header, body string) {
+	var buf bytes.Buffer
+	_, _ = fmt.Fprintf(
+		&buf, "HTTP/1.1 %d %s\r\n", code, http.StatusText(code))
+	if body != "" {
+		_, _ = buf.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	}
+	_ = header.Write(&buf)
+	_, _ = fmt.Fprintf(&buf,
+		"Connection: close\r\nContent-Length: %d\r\n\r\n%s", len(body), body)
+	if _, err := buf.WriteTo(r.conn); err != nil {
+		r.log.Warnw("failed to write response", "error", err)
+	}
+}
+
+// GetPeerIdentifiers returns a list of peer identifiers of this client.
+func (r *httpProxyRequest) GetPeerIdentifiers() ([]*PeerIdentifier, error) {
+	var ids []*PeerIdentifier
+	if r.user != "" {
+		ids = append(ids, &PeerIdentifier{
+			Scope:    httpProxyScope,
+			UniqueID: r.user,
+			Name:     r.user,
+		})
+	}
+	if withID, ok := r.conn.(WithPeerIdentifiers); ok {
+		connIDs, err := withID.GetPeerIdentifiers()
+		if err != nil {
+			return nil, errors.WithMessage(err, "failed to get peerIDs")
+		}
+		ids = append(ids, connIDs...)
+	}
+	return ids, nil
+}
+
+// PeerAddr returns the address of the client.
+func (r *httpProxyRequest) PeerAddr() string {
+	return r.conn.RemoteAddr().String()
+}
+
+// TargetAddr returns the address the client wants to connect to.
+func (r *httpProxyRequest) TargetAddr() Address {
+	return r.targetAddr
+}
+
+// Success notifies the client that the connection is established. For the
+// plain requests, the request is forwarded to the target (in origin-form) with
+// the hop-by-hop proxy headers removed and the connection is closed after the
+// response, since the following requests may be sent to different targets.
+func (r *httpProxyRequest) Success(addr Address) io.ReadWriteCloser {
+	var buf bytes.Buffer
+	if r.connect {
+		_, _ = buf.WriteString("HTTP/1.1 200 Connection established\r\n\r\n")
+		if _, err := buf.WriteTo(r.conn); err != nil {
+			r.log.Warnw("failed to write response", "error", err)
+		}
+		return &bufReadRWC{r.conn, r.br}
+	}
+
+	req := r.req
+	header := req.Header
+	header.Del("Proxy-Authorization")
+	header.Del("Proxy-Connection")
+	header.Set("Connection", "close")
+	if len(req.TransferEncoding) > 0 { // removed by http.ReadRequest
+		header.Set("Transfer-Encoding", strings.Join(req.TransferEncoding, ","))
+	}
+	_, _ = fmt.Fprintf(&buf, "%s %s HTTP/%d.%d\r\nHost: %s\r\n",
+		req.Method, req.URL.RequestURI(), req.ProtoMajor, req.ProtoMinor,
+		req.Host)
+	_ = header.Write(&buf)
+	_, _ = buf.WriteString("\r\n")
+	return &prefixedConn{r.conn, io.MultiReader(&buf, r.br)}
+}
+
+// Fail notifies the client that the connection is not able to be established.
+func (r *httpProxyRequest) Fail(proxyErr *ProxyError) {
+	code, body := http.StatusBadGateway, ""
+	switch proxyErr.ErrType {
+	case ProxyNotAllowed, ProxyQuotaExceeded:
+		code = http.StatusForbidden
+	case ProxyBlocked:
+		code, body = r.blocked.Status, r.blocked.Message
+	case ProxyTTLExpired:
+		code = http.StatusGatewayTimeout
+	case ProxyRelayLoop:
+		code = http.StatusLoopDetected
+	case ProxyUpstreamBusy:
+		code = http.StatusServiceUnavailable
+	}
+	r.respondWithBody(code, nil, body)
+	if err := r.conn.Close(); err != nil {
+		r.log.Warnw("failed to close client connection", "error", err)
+	}
+}
+
+// Logger returns a logger of this client.
+func (r *httpProxyRequest) Logger() *zap.SugaredLogger {
+	return r.log
+}
+
+// ID returns the identifier of this client.
+func (r *httpProxyRequest) ID() string {
+	return r.id
+}
+
+// prefixedConn reads the data from the given reader, which usually returns
+// some buffered data before the ones from the connection.
+type prefixedConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *prefixedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
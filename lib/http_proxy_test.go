@@ -0,0 +1,216 @@
+package lib
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func startHTTPProxyServer(
+	t *testing.T, checkUser CheckUserFunc) (*HTTPProxyServer, string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	address := l.Addr().String()
+	_ = l.Close()
+	svr := newHTTPProxyServer(zap.NewNop().Sugar(), &TCPTransport{},
+		[]string{address}, checkUser, time.Second*10)
+	return svr, address
+}
+
+func TestHTTPProxyConnect(t *testing.T) {
+	svr, address := startHTTPProxyServer(t, nil)
+	reqCh, err := svr.Start()
+	require.NoError(t, err)
+	defer svr.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	go func() {
+		select {
+		case req := <-reqCh:
+			if assert.Equal(t, "target.server:443", req.TargetAddr().String()) {
+				conn := req.Success(&TCP4Addr{net.IPv4zero, 0})
+				_, _ = io.Copy(conn, conn) // echo
+				_ = conn.Close()
+			} else {
+				req.Fail(wrapAsProxyError(
+					errors.New("mismatch"), ProxyGeneralErr))
+			}
+		case <-ctx.Done():
+		}
+	}()
+
+	cli := HTTPTunnelClient{Addr: address}
+	conn, _, pErr := cli.Request(ctx, &DomainNameAddr{"target.server", 443})
+	require.Nil(t, pErr)
+	defer conn.Close() // nolint: errcheck
+	_, err = conn.Write([]byte("hello"))
+	require.NoError(t, err)
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(conn, buf)
+	assert.NoError(t, err)
+	assert.EqualValues(t, "hello", buf)
+}
+
+func TestHTTPProxyPlainRequest(t *testing.T) {
+	svr, address := startHTTPProxyServer(t, func(user, pass string) bool {
+		return user == "USERNAME" && pass == "PASSWORD"
+	})
+	reqCh, err := svr.Start()
+	require.NoError(t, err)
+	defer svr.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	go func() {
+		select {
+		case req := <-reqCh:
+			ids, err := req.GetPeerIdentifiers()
+			assert.NoError(t, err)
+			if assert.Len(t, ids, 1) {
+				assert.Equal(t, httpProxyScope, ids[0].Scope)
+				assert.Equal(t, "USERNAME", ids[0].UniqueID)
+			}
+			assert.Equal(t, "target.server:80", req.TargetAddr().String())
+			conn := req.Success(&TCP4Addr{net.IPv4zero, 0})
+			defer conn.Close() // nolint: errcheck
+			forwarded, err := http.ReadRequest(bufio.NewReader(conn))
+			if !assert.NoError(t, err) {
+				return
+			}
+			assert.Equal(t, "/path?q=1", forwarded.RequestURI)
+			assert.Equal(t, "target.server", forwarded.Host)
+			assert.Empty(t, forwarded.Header.Get("Proxy-Authorization"))
+			body, _ := ioutil.ReadAll(forwarded.Body)
+			assert.EqualValues(t, "request body", body)
+			_, _ = io.WriteString(conn, "HTTP/1.1 200 OK\r\n"+
+				"Content-Length: 5\r\nConnection: close\r\n\r\nhello")
+		case <-ctx.Done():
+		}
+	}()
+
+	proxyURL, err := url.Parse("http://USERNAME:PASSWORD@" + address)
+	require.NoError(t, err)
+	client := http.Client{
+		Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)},
+		Timeout:   time.Second,
+	}
+	resp, err := client.Post("http://target.server/path?q=1",
+		"text/plain", strings.NewReader("request body"))
+	require.NoError(t, err)
+	defer resp.Body.Close() // nolint: errcheck
+	body, err := ioutil.ReadAll(resp.Body)
+	assert.NoError(t, err)
+	assert.EqualValues(t, "hello", body)
+
+	// wrong password
+	proxyURL.User = url.UserPassword("USERNAME", "WRONG")
+	client.Transport = &http.Transport{Proxy: http.ProxyURL(proxyURL)}
+	resp, err = client.Get("http://target.server/")
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	assert.Equal(t, http.StatusProxyAuthRequired, resp.StatusCode)
+	assert.NotEmpty(t, resp.Header.Get("Proxy-Authenticate"))
+}
+
+func TestHTTPProxyFail(t *testing.T) {
+	svr, address := startHTTPProxyServer(t, nil)
+	reqCh, err := svr.Start()
+	require.NoError(t, err)
+	defer svr.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	go func() {
+		for {
+			select {
+			case req := <-reqCh:
+				req.Fail(wrapAsProxyError(
+					errors.New("failed"), ProxyConnectFailed))
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	cli := HTTPTunnelClient{Addr: address}
+	_, _, pErr := cli.Request(ctx, &DomainNameAddr{"target.server", 443})
+	require.NotNil(t, pErr)
+	assert.Contains(t, pErr.Error.Error(), "502")
+
+	// relative URLs are not acceptable for a proxy
+	conn, err := net.Dial("tcp", address)
+	require.NoError(t, err)
+	defer conn.Close() // nolint: errcheck
+	_, err = io.WriteString(conn, "GET / HTTP/1.1\r\nHost: a.b\r\n\r\n")
+	require.NoError(t, err)
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+func TestHTTPProxyBlocked(t *testing.T) {
+	doRequest := func(
+		blocked *BlockedConfig, errType ProxyErrorType) (int, string) {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		address := l.Addr().String()
+		_ = l.Close()
+		svr, err := NewHTTPProxyServer(zap.NewNop().Sugar(), ProxyConfig{
+			Protocol: "http",
+			Settings: map[string]interface{}{"address": address},
+			Blocked:  blocked,
+		})
+		require.NoError(t, err)
+		reqCh, err := svr.Start()
+		require.NoError(t, err)
+		defer svr.Stop()
+		go func() {
+			if req, ok := <-reqCh; ok {
+				req.Fail(&ProxyError{ErrType: errType})
+			}
+		}()
+
+		conn, err := net.Dial("tcp", address)
+		require.NoError(t, err)
+		defer conn.Close() // nolint: errcheck
+		_, err = io.WriteString(
+			conn, "CONNECT a.b:443 HTTP/1.1\r\nHost: a.b:443\r\n\r\n")
+		require.NoError(t, err)
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		require.NoError(t, err)
+		body, err := ioutil.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp.StatusCode, string(body)
+	}
+
+	code, body := doRequest(nil, ProxyBlocked)
+	assert.Equal(t, http.StatusForbidden, code)
+	assert.Empty(t, body)
+	code, body = doRequest(&BlockedConfig{
+		Status: http.StatusUnavailableForLegalReasons, Message: "blocked"},
+		ProxyBlocked)
+	assert.Equal(t, http.StatusUnavailableForLegalReasons, code)
+	assert.Equal(t, "blocked", body)
+	code, _ = doRequest(nil, ProxyUpstreamBusy)
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+
+	_, err := NewHTTPProxyServer(zap.NewNop().Sugar(), ProxyConfig{
+		Protocol: "http",
+		Settings: map[string]interface{}{"address": "127.0.0.1:0"},
+		Blocked:  &BlockedConfig{Status: http.StatusOK},
+	})
+	assert.Error(t, err)
+}
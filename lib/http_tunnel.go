@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"encoding/base64"
 	"fmt"
 	"io"
 	"net"
@@ -22,18 +23,58 @@ func init() {
 		runtime.GOOS, runtime.GOARCH, runtime.Version(), ThestralVersion)
 }
 
-// HTTPTunnelClient is a proxy client for HTTP tunnel protocol.
+// HTTPTunnelClient is a proxy client for HTTP tunnel protocol. The Basic
+// authentication is used if Username is not empty.
 type HTTPTunnelClient struct {
-	Addr string
+	Addr     string
+	Username string
+	Password string
+}
+
+// NewHTTPTunnelClient creates a HTTPTunnelClient from the given configuration.
+func NewHTTPTunnelClient(config ProxyConfig) (*HTTPTunnelClient, error) {
+	if config.Transport != nil {
+		return nil, errors.New(
+			"'http' protocol should not have any transport setting")
+	}
+	client := &HTTPTunnelClient{}
+	var ok bool
+	for k, v := range config.Settings {
+		switch k {
+		case "address":
+			if client.Addr, ok = v.(string); !ok {
+				return nil, errors.New("a valid 'address' must be supplied")
+			}
+		case "username":
+			if client.Username, ok = v.(string); !ok {
+				return nil, errors.New("a string is required for 'username'")
+			}
+		case "password":
+			if client.Password, ok = v.(string); !ok {
+				return nil, errors.New("a string is required for 'password'")
+			}
+		default:
+			return nil, errors.New("unknown setting of 'http' protocol: " + k)
+		}
+	}
+	if client.Addr == "" {
+		return nil, errors.New("a valid 'address' must be supplied")
+	}
+	if client.Username == "" && client.Password != "" {
+		return nil, errors.New("a password must be used with a username")
+	}
+	return client, nil
 }
 
 // Request establish a connection via the HTTP tunnel proxy.
 func (c HTTPTunnelClient) Request(ctx context.Context, addr Address) (
 	io.ReadWriteCloser, Address, *ProxyError) {
+	startTime := time.Now()
 	conn, err := TCPTransport{}.Dial(ctx, c.Addr)
 	if err != nil {
 		return nil, nil, wrapAsProxyError(err, ProxyGeneralErr)
 	}
+	timings := ConnTimings{Dial: time.Since(startTime)}
 	if ddl, hasDDL := ctx.Deadline(); hasDDL {
 		_ = conn.SetDeadline(ddl.Add(-time.Millisecond))
 	}
@@ -54,14 +95,24 @@ func (c HTTPTunnelClient) Request(ctx context.Context, addr Address) (
 	case err := <-errCh:
 		if err != nil {
 			_ = brc.Close()
+			ne, ok := errors.Cause(err.Error).(net.Error)
+			if ok && ne.Timeout() {
+				err.ErrType = ProxyTTLExpired
+			}
 			return nil, nil, err
 		}
 		_ = conn.SetDeadline(time.Time{})
+		timings.Handshake = time.Since(startTime) - timings.Dial
+		recordConnTimings(ctx, timings)
 		return brc, &TCP4Addr{net.IPv4zero, 0}, nil
 	case <-ctx.Done():
 		_ = brc.Close()
+		errType := ProxyGeneralErr
+		if ctx.Err() == context.DeadlineExceeded {
+			errType = ProxyTTLExpired
+		}
 		return nil, nil, wrapAsProxyError(
-			errors.WithStack(ctx.Err()), ProxyGeneralErr)
+			errors.WithStack(ctx.Err()), errType)
 	}
 }
 
@@ -72,6 +123,11 @@ func (c HTTPTunnelClient) sendRequest(w io.Writer, addr Address) *ProxyError {
 	_, _ = buf.WriteString(addrStr)
 	_, _ = buf.WriteString(" HTTP/1.1\r\nHost: ")
 	_, _ = buf.WriteString(addrStr)
+	if c.Username != "" {
+		_, _ = buf.WriteString("\r\nProxy-Authorization: Basic ")
+		_, _ = buf.WriteString(base64.StdEncoding.EncodeToString(
+			[]byte(c.Username + ":" + c.Password)))
+	}
 	_, _ = buf.WriteString("\r\nProxy-Connection: keep-alive\r\nUser-Agent: ")
 	_, _ = buf.WriteString(httpUserAgent)
 	_, _ = buf.WriteString("\r\n\r\n")
@@ -104,9 +160,14 @@ func (c HTTPTunnelClient) readResponse(brc *bufReadRWC) *ProxyError {
 	}
 
 	if code != 200 {
-		if code/100 == 4 {
+		switch {
+		case code == 403 || code == 407: // forbidden or unauthorized
+			errType = ProxyNotAllowed
+		case code == 504:
+			errType = ProxyTTLExpired
+		case code/100 == 4:
 			errType = ProxyCmdUnsupported // maybe...
-		} else if code/100 == 5 {
+		case code/100 == 5:
 			errType = ProxyConnectFailed
 		}
 		err = errors.New("proxy server responses: " + heading)
@@ -8,7 +8,10 @@ import (
 	"net"
 	"sync"
 	"testing"
+	"time"
 
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"github.com/stretchr/testify/suite"
 )
 
@@ -144,3 +147,70 @@ func (s *HTTPTunnelTestSuite) TestOtherError() {
 func TestHTTPTunnelSuite(t *testing.T) {
 	suite.Run(t, new(HTTPTunnelTestSuite))
 }
+
+func TestHTTPTunnelClientAuth(t *testing.T) {
+	svr, address := startHTTPProxyServer(t, func(user, pass string) bool {
+		return user == "USERNAME" && pass == "PASSWORD"
+	})
+	reqCh, err := svr.Start()
+	require.NoError(t, err)
+	defer svr.Stop()
+	go func() {
+		for req := range reqCh {
+			_ = req.Success(&TCP4Addr{net.IPv4zero, 0}).Close()
+		}
+	}()
+
+	newClient := func(settings map[string]interface{}) ProxyClient {
+		settings["address"] = address
+		cli, err := CreateProxyClient(
+			ProxyConfig{Protocol: "http", Settings: settings})
+		require.NoError(t, err)
+		return cli
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	target := &DomainNameAddr{"target.server", 443}
+
+	cli := newClient(map[string]interface{}{
+		"username": "USERNAME", "password": "PASSWORD"})
+	rwc, _, pErr := cli.Request(ctx, target)
+	if assert.Nil(t, pErr) {
+		_ = rwc.Close()
+	}
+	cli = newClient(map[string]interface{}{
+		"username": "USERNAME", "password": "WRONG"})
+	_, _, pErr = cli.Request(ctx, target)
+	if assert.NotNil(t, pErr) {
+		assert.Equal(t, ProxyNotAllowed, pErr.ErrType)
+	}
+
+	_, err = CreateProxyClient(ProxyConfig{Protocol: "http",
+		Settings: map[string]interface{}{
+			"address": address, "password": "PASSWORD"}})
+	assert.Error(t, err)
+}
+
+func TestHTTPTunnelClientTimeout(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close() // nolint: errcheck
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close() // nolint: errcheck
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(
+		context.Background(), time.Millisecond*100)
+	defer cancel()
+	cli := HTTPTunnelClient{Addr: l.Addr().String()}
+	_, _, pErr := cli.Request(ctx, &DomainNameAddr{"target.server", 443})
+	if assert.NotNil(t, pErr) {
+		assert.Equal(t, ProxyTTLExpired, pErr.ErrType)
+	}
+}
@@ -0,0 +1,112 @@
+package lib
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// The listeners of the downstreams can be inherited from the parent process
+// instead of being created, so that a new process takes over the sockets of
+// the old one without dropping any connections, e.g. on upgrades. The
+// address of such a downstream is either:
+//   - "fd://<n>": the socket of the file descriptor n
+//   - "fd://<name>": the socket named so by the systemd socket activation,
+//     i.e. the FileDescriptorName of the socket unit (see sd_listen_fds(3))
+//
+// The handoff from the old process goes as follows:
+//  1. the old process starts the new one with the listening sockets as the
+//     extra files (e.g. ExtraFiles of exec.Cmd, which become the file
+//     descriptors 3, 4, ... of the new one), and the addresses of the
+//     downstreams set to them in the configuration of the new one
+//  2. both of the processes accept connections from the shared sockets until
+//     the new one is started, so that none of them are refused
+//  3. the old process closes its listeners, which leaves the sockets open in
+//     the new one, and exits once its tunnels are finished
+//
+// With the systemd socket activation, the sockets are held by systemd across
+// the restarts instead, and the connections are queued by the kernel while
+// the new process is starting.
+//
+// Each inherited file descriptor is closed once it's listened on, so it can
+// only be used by a single downstream.
+const inheritedAddrPrefix = "fd://"
+
+// sdListenFDsStart is the first file descriptor passed by systemd.
+const sdListenFDsStart = 3
+
+// IsInheritedAddr tells whether an address is of an inherited socket.
+func IsInheritedAddr(address string) bool {
+	return strings.HasPrefix(address, inheritedAddrPrefix)
+}
+
+// inheritListener creates a TCP listener on an inherited socket.
+func inheritListener(address string) (*net.TCPListener, error) {
+	file, err := inheritedFile(address)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close() // nolint: errcheck
+	listener, err := net.FileListener(file)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to inherit listener "+address)
+	}
+	tcpListener, ok := listener.(*net.TCPListener)
+	if !ok {
+		_ = listener.Close()
+		return nil, errors.Errorf("%s is not a TCP listener", address)
+	}
+	return tcpListener, nil
+}
+
+// inheritPacketConn creates a UDP socket on an inherited one.
+func inheritPacketConn(address string) (*net.UDPConn, error) {
+	file, err := inheritedFile(address)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close() // nolint: errcheck
+	conn, err := net.FilePacketConn(file)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to inherit socket "+address)
+	}
+	udpConn, ok := conn.(*net.UDPConn)
+	if !ok {
+		_ = conn.Close()
+		return nil, errors.Errorf("%s is not a UDP socket", address)
+	}
+	return udpConn, nil
+}
+
+// inheritedFile returns the file of the socket of an inherited address.
+func inheritedFile(address string) (*os.File, error) {
+	target := strings.TrimPrefix(address, inheritedAddrPrefix)
+	fd, err := strconv.ParseUint(target, 10, 31)
+	if err != nil {
+		if fd, err = lookupSystemdFD(target); err != nil {
+			return nil, err
+		}
+	} else if fd < sdListenFDsStart { // stdin, stdout or stderr
+		return nil, errors.New("invalid inherited address: " + address)
+	}
+	return os.NewFile(uintptr(fd), address), nil
+}
+
+// lookupSystemdFD looks up the file descriptor of a socket passed by systemd
+// by its name, according to LISTEN_PID, LISTEN_FDS and LISTEN_FDNAMES.
+func lookupSystemdFD(name string) (uint64, error) {
+	pid, _ := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	n, _ := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if pid == os.Getpid() && name != "" {
+		names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+		for i := 0; i < n && i < len(names); i++ {
+			if names[i] == name {
+				return uint64(sdListenFDsStart + i), nil
+			}
+		}
+	}
+	return 0, errors.Errorf("socket '%s' is not passed by systemd", name)
+}
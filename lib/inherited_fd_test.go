@@ -0,0 +1,129 @@
+// +build !windows
+
+package lib
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func fdAddr(fd int) string {
+	return "fd://" + strconv.Itoa(fd)
+}
+
+// inheritFD duplicates the file descriptor of a socket as passed by the old
+// process, which is owned by the listener created on it.
+func inheritFD(t *testing.T, conn interface {
+	File() (*os.File, error)
+	Close() error
+}) int {
+	file, err := conn.File()
+	require.NoError(t, err)
+	defer file.Close() // nolint: errcheck
+	fd, err := syscall.Dup(int(file.Fd()))
+	require.NoError(t, err)
+	_ = conn.Close()
+	return fd
+}
+
+func TestInheritTCPListener(t *testing.T) {
+	orig, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	addr := orig.Addr().String()
+	listener, err := TCPTransport{}.Listen(fdAddr(inheritFD(t, orig)))
+	require.NoError(t, err)
+	defer listener.Close() // nolint: errcheck
+	assert.Equal(t, addr, listener.Addr().String())
+
+	go func() {
+		if conn, err := listener.Accept(); err == nil {
+			_, _ = conn.Write([]byte("hello"))
+			_ = conn.Close()
+		}
+	}()
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close() // nolint: errcheck
+	data, err := ioutil.ReadAll(conn)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(data))
+}
+
+func TestInheritKCPListener(t *testing.T) {
+	orig, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	addr := orig.LocalAddr().String()
+	trans, err := NewKCPTransport(KCPConfig{})
+	require.NoError(t, err)
+	listener, err := trans.Listen(fdAddr(inheritFD(t, orig)))
+	require.NoError(t, err)
+	defer listener.Close() // nolint: errcheck
+	go func() {
+		if conn, err := listener.Accept(); err == nil {
+			_, _ = io.Copy(conn, conn)
+			_ = conn.Close()
+		}
+	}()
+	conn, err := trans.Dial(context.Background(), addr)
+	require.NoError(t, err)
+	defer conn.Close() // nolint: errcheck
+	_, err = conn.Write([]byte("hello"))
+	require.NoError(t, err)
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(conn, buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(buf))
+}
+
+func TestInheritInvalidSockets(t *testing.T) {
+	// sockets of other types are rejected
+	for _, typ := range []int{syscall.SOCK_STREAM, syscall.SOCK_DGRAM} {
+		fds, err := syscall.Socketpair(syscall.AF_UNIX, typ, 0)
+		require.NoError(t, err)
+		defer syscall.Close(fds[1]) // nolint: errcheck
+		if typ == syscall.SOCK_STREAM {
+			_, err = TCPTransport{}.Listen(fdAddr(fds[0]))
+		} else {
+			var trans *KCPTransport
+			trans, err = NewKCPTransport(KCPConfig{})
+			require.NoError(t, err)
+			_, err = trans.Listen(fdAddr(fds[0]))
+		}
+		assert.Error(t, err, "type %d", typ)
+	}
+
+	for _, addr := range []string{"fd://", "fd://1", "fd://-1", "fd://x"} {
+		_, err := TCPTransport{}.Listen(addr)
+		assert.Error(t, err, addr)
+	}
+}
+
+func TestLookupSystemdFD(t *testing.T) {
+	for key, value := range map[string]string{
+		"LISTEN_PID":     strconv.Itoa(os.Getpid()),
+		"LISTEN_FDS":     "2",
+		"LISTEN_FDNAMES": "socks:http",
+	} {
+		require.NoError(t, os.Setenv(key, value))
+		defer os.Unsetenv(key) // nolint: errcheck
+	}
+	fd, err := lookupSystemdFD("http")
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(4), fd)
+	_, err = lookupSystemdFD("other")
+	assert.Error(t, err)
+
+	// passed to another process
+	require.NoError(t, os.Setenv("LISTEN_PID", "1"))
+	_, err = lookupSystemdFD("socks")
+	assert.Error(t, err)
+}
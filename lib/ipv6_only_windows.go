@@ -0,0 +1,21 @@
+package lib
+
+import (
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// setIPv6Only is a listener control function setting IPV6_V6ONLY, so that an
+// IPv6 socket doesn't accept IPv4 connections.
+func setIPv6Only(_, _ string, c syscall.RawConn) error {
+	var err error
+	cErr := c.Control(func(fd uintptr) {
+		err = syscall.SetsockoptInt(
+			syscall.Handle(fd), syscall.IPPROTO_IPV6, syscall.IPV6_V6ONLY, 1)
+	})
+	if cErr != nil {
+		err = cErr
+	}
+	return errors.Wrap(err, "failed to set IPV6_V6ONLY")
+}
@@ -1,11 +1,11 @@
 package lib
 
 import (
-	"container/list"
 	"context"
 	"encoding/binary"
 	"fmt"
 	"io"
+	"math/rand"
 	"net"
 	"os"
 	"sync"
@@ -29,22 +29,69 @@ type KCPTransport struct {
 	parityShards      int
 	keepAliveInterval time.Duration
 	keepAliveTimeout  time.Duration
-
-	conns    *list.List
-	connsMtx sync.Mutex
+	keepAliveCheck    time.Duration
+	keepAliveJitter   float64 // the ratio to the interval
+	keepAlivePadding  int     // max bytes
+	sockBuf           int
+	dialRetries       int
+	dialRetryDelay    time.Duration
+	maxSessions       int
+	closeSendTimeout  time.Duration
+	closeLinger       time.Duration
+
+	// the sessions tracked for keep-alive
+	sessions  kcpSessionHeap
+	connsMtx  sync.Mutex
+	connsCond *sync.Cond // signaled when sessions are untracked
+
+	closed    chan struct{} // stops the keep-alive manager once closed
+	closeOnce sync.Once
 }
 
-// kcpCloseSendTimeout is the timeout for sending the kcpClose signal
-// when closing a connection. This is a variable so that it can be altered
-// in tests, but it should be considered as a constant in the production code.
-var kcpCloseSendTimeout = time.Second * 10
+// kcpMaxFrameSize is the max size of the data in a kcpDataPacket frame. Larger
+// writes are split into multiple frames so that the buffer of each of them
+// fits in the GlobalBufPool.
+const kcpMaxFrameSize = 1<<22 - 5
+
+// kcpNewConn creates the KCP sessions for dialing. It's replaced in tests.
+var kcpNewConn = kcp.NewConn
 
-var kcpCloseLingerTimeout = time.Second * 10
+const (
+	defaultKCPSockBuf        = 4 * 1024 * 1024
+	defaultKCPDialRetryDelay = time.Millisecond * 200
+	defaultKCPCloseTimeout   = time.Second * 10 // both send and linger
+)
+
+// kcpInUse is set to 1 once a KCPTransport has been created, so that the
+// monitor only reports KCP statistics when KCP is actually used.
+var kcpInUse uint32
+
+// KCPStats is a snapshot of the aggregated statistics of all KCP sessions
+// in this process.
+type KCPStats struct {
+	CurrEstab       uint64
+	InSegs          uint64
+	OutSegs         uint64
+	RetransSegs     uint64
+	FastRetransSegs uint64
+	LostSegs        uint64
+	RepeatSegs      uint64
+	FECRecovered    uint64
+	FECErrs         uint64
+	// RetransmitRate is the ratio of retransmitted segments to all
+	// outgoing segments.
+	RetransmitRate float32
+	// LossRate is the ratio of segments inferred as lost to all
+	// outgoing segments.
+	LossRate float32
+}
 
 // NewKCPTransport creates KCPTransport with a given configuration.
 func NewKCPTransport(config KCPConfig) (*KCPTransport, error) {
 	// var transport *KCPTransport
 	t := new(KCPTransport)
+	t.connsCond = sync.NewCond(&t.connsMtx)
+	t.closed = make(chan struct{})
 	switch config.Mode {
 	case "", "normal":
 		t.noDelay, t.interval, t.resend, t.nc = 0, 25, 0, 0
@@ -84,9 +131,35 @@ func NewKCPTransport(config KCPConfig) (*KCPTransport, error) {
 		}
 	}
 
+	if config.SockBuf == "" {
+		t.sockBuf = defaultKCPSockBuf
+	} else if sockBuf, err := ParseByteSize(config.SockBuf); err != nil {
+		return nil, errors.WithMessage(err, "invalid 'sock_buf'")
+	} else if sockBuf == 0 || sockBuf > 0x7fffffff {
+		return nil, errors.New("'sock_buf' should be in (0, 2GiB)")
+	} else {
+		t.sockBuf = int(sockBuf)
+	}
+
+	if config.DialRetries < 0 {
+		return nil, errors.New("'dial_retries' should not be negative")
+	}
+	t.dialRetries = config.DialRetries
+	t.dialRetryDelay = defaultKCPDialRetryDelay
+	if config.DialRetryDelay != "" {
+		var err error
+		t.dialRetryDelay, err = time.ParseDuration(config.DialRetryDelay)
+		if err != nil || t.dialRetryDelay <= 0 {
+			return nil, errors.New("invalid 'dial_retry_delay'")
+		}
+	}
+
 	if (config.KeepAliveInterval == "") != (config.KeepAliveTimeout == "") {
 		return nil, errors.New(
 			"'keep_alive_interval' must be used with 'keep_alive_timeout'")
+	} else if config.KeepAliveCheck != "" && config.KeepAliveInterval == "" {
+		return nil, errors.New(
+			"'keep_alive_check' must be used with 'keep_alive_interval'")
 	}
 	if config.KeepAliveInterval != "" {
 		var err error
@@ -98,17 +171,98 @@ func NewKCPTransport(config KCPConfig) (*KCPTransport, error) {
 		if err != nil || t.keepAliveTimeout <= 0 {
 			return nil, errors.New("invalid 'keep_alive_timeout'")
 		}
-		t.conns = list.New()
+		t.keepAliveCheck = t.keepAliveInterval / 4
+		if config.KeepAliveCheck != "" {
+			t.keepAliveCheck, err = time.ParseDuration(config.KeepAliveCheck)
+			if err != nil || t.keepAliveCheck <= 0 ||
+				t.keepAliveCheck > t.keepAliveTimeout {
+				return nil, errors.New("'keep_alive_check' should be " +
+					"within (0, keep_alive_timeout]")
+			}
+		}
+		if config.KeepAliveJitter < 0 || config.KeepAliveJitter >= 100 {
+			return nil, errors.New(
+				"'keep_alive_jitter' should be within [0, 100)")
+		} else if config.KeepAlivePadding < 0 ||
+			config.KeepAlivePadding > 255 {
+			return nil, errors.New(
+				"'keep_alive_padding' should be within [0, 255]")
+		}
+		t.keepAliveJitter = float64(config.KeepAliveJitter) / 100
+		t.keepAlivePadding = config.KeepAlivePadding
 		go t.runKeepAliveManager()
-	} else {
-		t.conns = nil
+	} else if config.KeepAliveJitter != 0 || config.KeepAlivePadding != 0 {
+		return nil, errors.New("'keep_alive_jitter' and 'keep_alive_padding' " +
+			"must be used with 'keep_alive_interval'")
 	}
 
+	if config.MaxSessions < 0 {
+		return nil, errors.New("'max_sessions' should not be negative")
+	} else if config.MaxSessions > 0 && t.keepAliveInterval == 0 {
+		// otherwise the sessions lost would never be released
+		return nil, errors.New(
+			"'max_sessions' must be used with 'keep_alive_interval'")
+	}
+	t.maxSessions = config.MaxSessions
+
+	t.closeSendTimeout = defaultKCPCloseTimeout
+	if config.CloseSendTimeout != "" {
+		var err error
+		t.closeSendTimeout, err = time.ParseDuration(config.CloseSendTimeout)
+		if err != nil || t.closeSendTimeout < 0 {
+			return nil, errors.New("invalid 'close_send_timeout'")
+		}
+	}
+	t.closeLinger = defaultKCPCloseTimeout
+	if config.CloseLinger != "" {
+		var err error
+		t.closeLinger, err = time.ParseDuration(config.CloseLinger)
+		if err != nil || t.closeLinger < 0 {
+			return nil, errors.New("invalid 'close_linger'")
+		}
+	}
+
+	atomic.StoreUint32(&kcpInUse, 1)
 	return t, nil
 }
 
-// Dial creates a KCP connection to a remote host.
+// Dial creates a KCP connection to a remote host. Transient failures are
+// retried with exponential backoff for up to dial_retries times, as long as
+// the context is not done.
 func (t *KCPTransport) Dial(
+	ctx context.Context, address string) (net.Conn, error) {
+	delay := t.dialRetryDelay
+	for retries := 0; ; retries++ {
+		conn, err := t.dial(ctx, address)
+		if err == nil || retries >= t.dialRetries ||
+			ctx.Err() != nil || !isTransientDialError(err) {
+			return conn, err
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, errors.WithStack(ctx.Err())
+		}
+		delay *= 2
+	}
+}
+
+// isTransientDialError returns false for the errors which won't be different
+// on retrying, such as invalid addresses.
+func isTransientDialError(err error) bool {
+	switch e := errors.Cause(err).(type) {
+	case *net.AddrError, *net.ParseError:
+		return false
+	case *net.DNSError:
+		return e.IsTimeout || e.IsTemporary
+	default:
+		return true
+	}
+}
+
+func (t *KCPTransport) dial(
 	ctx context.Context, address string) (net.Conn, error) {
 	type result struct {
 		conn net.Conn
@@ -118,10 +272,25 @@ func (t *KCPTransport) Dial(
 	resultCh := make(chan result, 1)
 
 	go func() {
-		kcpConn, err := kcp.DialWithOptions(
-			address, nil, t.dataShards, t.parityShards)
+		udpAddr, err := net.ResolveUDPAddr("udp", address)
 		if err != nil {
 			resultCh <- result{nil, err}
+			return
+		}
+		network := "udp4"
+		if udpAddr.IP.To4() == nil {
+			network = "udp"
+		}
+		udpConn, err := t.listenUDP(network, nil)
+		if err != nil {
+			resultCh <- result{nil, err}
+			return
+		}
+		kcpConn, err := kcpNewConn(
+			address, nil, t.dataShards, t.parityShards, udpConn)
+		if err != nil {
+			_ = udpConn.Close()
+			resultCh <- result{nil, err}
 		} else {
 			resultCh <- result{t.wrapKCPConn(kcpConn), nil}
 		}
@@ -138,14 +307,103 @@ func (t *KCPTransport) Dial(
 	}
 }
 
-// Listen creates a KCP listener on a given address.
+// Listen creates a KCP listener on a given address, or on an inherited UDP
+// socket (see IsInheritedAddr).
 func (t *KCPTransport) Listen(address string) (net.Listener, error) {
-	listener, err := kcp.ListenWithOptions(
-		address, nil, t.dataShards, t.parityShards)
+	// all the sessions accepted by the listener share the same socket,
+	// so the buffer sizes are set only once here
+	var udpConn *net.UDPConn
+	if IsInheritedAddr(address) {
+		conn, err := inheritPacketConn(address)
+		if err != nil {
+			return nil, err
+		}
+		if err = t.setSockBuf(conn); err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+		udpConn = conn
+	} else {
+		udpAddr, err := net.ResolveUDPAddr("udp", address)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		if udpConn, err = t.listenUDP("udp", udpAddr); err != nil {
+			return nil, err
+		}
+	}
+	listener, err := kcp.ServeConn(
+		nil, t.dataShards, t.parityShards, udpConn)
 	if err != nil {
+		_ = udpConn.Close()
 		return nil, errors.WithStack(err)
 	}
-	return &kcpListenerWrapper{listener, t}, nil
+	return &kcpListenerWrapper{Listener: listener, kcpTransport: t}, nil
+}
+
+// listenUDP creates a UDP socket with the configured buffer sizes.
+func (t *KCPTransport) listenUDP(
+	network string, laddr *net.UDPAddr) (*net.UDPConn, error) {
+	conn, err := net.ListenUDP(network, laddr)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if err = t.setSockBuf(conn); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// setSockBuf sets the configured buffer sizes of a UDP socket.
+func (t *KCPTransport) setSockBuf(conn *net.UDPConn) error {
+	err := conn.SetReadBuffer(t.sockBuf)
+	if err == nil {
+		err = conn.SetWriteBuffer(t.sockBuf)
+	}
+	if err != nil {
+		return errors.Wrap(err, "failed to set socket buffer size")
+	}
+
+	// the OS may silently clamp the buffer sizes (e.g. to rmem_max/wmem_max
+	// on Linux), in which case we warn the users
+	if rd, wr, err := getSockBufSizes(conn); err == nil {
+		if rd < t.sockBuf || wr < t.sockBuf {
+			_, _ = fmt.Fprintf(os.Stderr,
+				"Warning: KCP socket buffer size %d was clamped by the OS "+
+					"(read: %d, write: %d)\n", t.sockBuf, rd, wr)
+		}
+	}
+	return nil
+}
+
+// Stats returns a snapshot of the KCP statistics. Note that the statistics
+// are collected by kcp-go globally, so they are aggregated over all the KCP
+// transports rather than specific to this one. Smoothed RTT is not included
+// as kcp-go does not expose it.
+func (t *KCPTransport) Stats() *KCPStats {
+	return getKCPStats()
+}
+
+func getKCPStats() *KCPStats {
+	snmp := kcp.DefaultSnmp.Copy()
+	stats := &KCPStats{
+		CurrEstab:       snmp.CurrEstab,
+		InSegs:          snmp.InSegs,
+		OutSegs:         snmp.OutSegs,
+		RetransSegs:     snmp.RetransSegs,
+		FastRetransSegs: snmp.FastRetransSegs,
+		LostSegs:        snmp.LostSegs,
+		RepeatSegs:      snmp.RepeatSegs,
+		FECRecovered:    snmp.FECRecovered,
+		FECErrs:         snmp.FECErrs,
+	}
+	if snmp.OutSegs > 0 {
+		stats.RetransmitRate =
+			float32(snmp.RetransSegs) / float32(snmp.OutSegs)
+		stats.LossRate = float32(snmp.LostSegs) / float32(snmp.OutSegs)
+	}
+	return stats
 }
 
 func (t *KCPTransport) runKeepAliveManager() {
@@ -158,37 +416,25 @@ func (t *KCPTransport) runKeepAliveManager() {
 		}
 	}()
 
-	ticker := time.NewTicker(t.keepAliveInterval / 4)
-	timeout := t.keepAliveTimeout.Nanoseconds()
-	interval := t.keepAliveInterval.Nanoseconds()
+	ticker := time.NewTicker(t.keepAliveCheck)
+	defer ticker.Stop()
 	for {
-		now := (<-ticker.C).UnixNano()
-		t.connsMtx.Lock()
-		for e := t.conns.Front(); e != nil; {
-			next := e.Next()
-			conn := e.Value.(*kcpConnWrapper)
-			lastSend := atomic.LoadInt64(&conn.lastSend)
-			lastReadStart := atomic.LoadInt64(&conn.lastReadStart)
-			lastWriteStart := atomic.LoadInt64(&conn.lastWriteStart)
-			if lastSend == 0 { // closed
-				t.conns.Remove(e)
-			} else if lastReadStart > 0 && now-lastReadStart > timeout {
-				// read time out, lost
-				t.conns.Remove(e)
-				go conn.Close() // nolint: errcheck
-			} else if lastWriteStart > 0 && now-lastWriteStart > timeout {
-				// write time out, lost
-				t.conns.Remove(e)
-				go conn.Close() // nolint: errcheck
-			} else if now-lastSend > interval { // long idle
-				go conn.sendKeepAlive()
-			}
-			e = next
+		select {
+		case now := <-ticker.C:
+			t.checkSessions(now.UnixNano())
+		case <-t.closed:
+			return
 		}
-		t.connsMtx.Unlock()
 	}
 }
 
+// Close stops the keep-alive manager of a transport no longer used, after
+// which the sessions left (if any) are no longer kept alive or checked.
+func (t *KCPTransport) Close() error {
+	t.closeOnce.Do(func() { close(t.closed) })
+	return nil
+}
+
 type kcpConnWrapper struct {
 	*kcp.UDPSession
 	rdMtx      sync.Mutex
@@ -200,12 +446,25 @@ type kcpConnWrapper struct {
 	lastReadStart int64
 	// UNIX ns time of the start time of last write operation.
 	lastWriteStart int64
+
+	// the transport tracking the session, guarded by its connsMtx
+	transport *KCPTransport
+	nextCheck int64 // UNIX ns time
+	heapIndex int   // -1 if not tracked
+	// ns of idleness before the next keep-alive signal, guarded by connsMtx
+	keepAliveIdle int64
+
+	// of sending the kcpClose signal and lingering after it, see KCPConfig
+	closeSendTimeout time.Duration
+	closeLinger      time.Duration
 }
 
 const (
 	kcpDataPacket = 0
 	kcpClose      = 1
 	kcpKeepAlive  = 2
+	// followed by the length (a byte) and the bytes of the padding
+	kcpPaddedKeepAlive = 3
 )
 
 func (t *KCPTransport) wrapKCPConn(kcpConn *kcp.UDPSession) *kcpConnWrapper {
@@ -218,11 +477,12 @@ func (t *KCPTransport) wrapKCPConn(kcpConn *kcp.UDPSession) *kcpConnWrapper {
 	wrapped.lastSend = time.Now().UnixNano()
 	wrapped.lastReadStart = 0
 	wrapped.lastWriteStart = 0
+	wrapped.heapIndex = -1
+	wrapped.closeSendTimeout = t.closeSendTimeout
+	wrapped.closeLinger = t.closeLinger
 
-	if t.conns != nil {
-		t.connsMtx.Lock()
-		defer t.connsMtx.Unlock()
-		t.conns.PushBack(wrapped)
+	if t.keepAliveInterval > 0 {
+		t.track(wrapped, wrapped.lastSend)
 	}
 	return wrapped
 }
@@ -247,6 +507,13 @@ func (c *kcpConnWrapper) Read(b []byte) (int, error) {
 			c.rdDataLeft = binary.BigEndian.Uint32(header[:])
 		case kcpKeepAlive:
 			continue
+		case kcpPaddedKeepAlive:
+			if _, err := c.read(header[:1]); err != nil {
+				return 0, err
+			}
+			if err := c.discard(int(header[0])); err != nil {
+				return 0, err
+			}
 		default:
 			return 0, errors.Errorf("invalid KCP header %x", header[0])
 		}
@@ -263,10 +530,26 @@ func (c *kcpConnWrapper) Read(b []byte) (int, error) {
 	return n, nil
 }
 
+// Write sends the data in one or more kcpDataPacket frames, and returns the
+// number of the bytes of the data sent.
 func (c *kcpConnWrapper) Write(b []byte) (int, error) {
-	if len(b) > 0xffffffff {
-		return 0, errors.New("send buffer size exceeds limitation")
+	written := 0
+	for len(b) > 0 {
+		chunk := b
+		if len(chunk) > kcpMaxFrameSize {
+			chunk = chunk[:kcpMaxFrameSize]
+		}
+		n, err := c.writeFrame(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		b = b[len(chunk):]
 	}
+	return written, nil
+}
+
+func (c *kcpConnWrapper) writeFrame(b []byte) (int, error) {
 	n := uint32(len(b))
 	buf := GlobalBufPool.Get(uint(n + 5))
 	defer GlobalBufPool.Free(buf)
@@ -277,23 +560,36 @@ func (c *kcpConnWrapper) Write(b []byte) (int, error) {
 	atomic.StoreInt64(&c.lastSend, time.Now().UnixNano())
 	atomic.StoreInt64(&c.lastWriteStart, time.Now().UnixNano())
 	defer atomic.StoreInt64(&c.lastWriteStart, 0)
-	return c.UDPSession.Write(buf)
+	written, err := c.UDPSession.Write(buf)
+	if written -= 5; written < 0 { // the header isn't counted
+		written = 0
+	}
+	return written, err
 }
 
 func (c *kcpConnWrapper) Close() error {
 	atomic.StoreInt64(&c.lastSend, 0) // indicate the conn is closed
-	_ = c.UDPSession.SetWriteDeadline(time.Now().Add(kcpCloseSendTimeout))
+	if c.transport != nil {
+		c.transport.untrack(c)
+	}
+	_ = c.UDPSession.SetWriteDeadline(time.Now().Add(c.closeSendTimeout))
 	_, _ = c.UDPSession.Write([]byte{kcpClose})
-	go func() {
-		time.Sleep(kcpCloseLingerTimeout)
-		c.UDPSession.Close()
-	}()
+	time.AfterFunc(c.closeLinger, func() { _ = c.UDPSession.Close() })
 	return nil
 }
 
-func (c *kcpConnWrapper) sendKeepAlive() {
+// sendKeepAlive sends a keep-alive signal, which is padded with up to
+// maxPadding random bytes if it's positive.
+func (c *kcpConnWrapper) sendKeepAlive(maxPadding int) {
+	frame := []byte{kcpKeepAlive}
+	if maxPadding > 0 {
+		n := rand.Intn(maxPadding + 1)
+		frame = make([]byte, 2+n)
+		frame[0], frame[1] = kcpPaddedKeepAlive, byte(n)
+		_, _ = rand.Read(frame[2:])
+	}
 	atomic.StoreInt64(&c.lastSend, time.Now().UnixNano())
-	if _, err := c.UDPSession.Write([]byte{kcpKeepAlive}); err != nil {
+	if _, err := c.UDPSession.Write(frame); err != nil {
 		_ = c.Close()
 	}
 }
@@ -304,12 +600,30 @@ func (c *kcpConnWrapper) read(b []byte) (int, error) {
 	return c.UDPSession.Read(b)
 }
 
+// discard reads and drops n bytes, e.g. the padding of a keep-alive signal.
+func (c *kcpConnWrapper) discard(n int) error {
+	var buf [255]byte
+	for n > 0 {
+		read, err := c.read(buf[:n])
+		if err != nil {
+			return err
+		}
+		n -= read
+	}
+	return nil
+}
+
 type kcpListenerWrapper struct {
 	*kcp.Listener
 	kcpTransport *KCPTransport
+	closed       bool // guarded by connsMtx of the transport
 }
 
+// Accept waits for and returns the next session. If max_sessions is set, it
+// doesn't accept new sessions until there is room for them, so that the
+// extra ones are left in the backlog of kcp-go and then dropped.
 func (l *kcpListenerWrapper) Accept() (net.Conn, error) {
+	l.kcpTransport.waitForRoom(l)
 	conn, err := l.Listener.AcceptKCP()
 	if err != nil {
 		return nil, err
@@ -323,5 +637,9 @@ func (l *kcpListenerWrapper) AcceptKCP() (*kcp.UDPSession, error) {
 
 func (l *kcpListenerWrapper) Close() error {
 	err := l.Listener.Close()
+	l.kcpTransport.connsMtx.Lock()
+	l.closed = true
+	l.kcpTransport.connsCond.Broadcast()
+	l.kcpTransport.connsMtx.Unlock()
 	return err
 }
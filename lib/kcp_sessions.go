@@ -0,0 +1,140 @@
+package lib
+
+import (
+	"container/heap"
+	"math/rand"
+	"sync/atomic"
+)
+
+// kcpSessionHeap is a min-heap of the sessions tracked by a KCPTransport,
+// keyed by the time they should be checked next, so that each tick of the
+// keep-alive manager only visits the sessions due.
+type kcpSessionHeap []*kcpConnWrapper
+
+func (h kcpSessionHeap) Len() int { return len(h) }
+
+func (h kcpSessionHeap) Less(i, j int) bool {
+	return h[i].nextCheck < h[j].nextCheck
+}
+
+func (h kcpSessionHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].heapIndex = i
+	h[j].heapIndex = j
+}
+
+func (h *kcpSessionHeap) Push(x interface{}) {
+	conn := x.(*kcpConnWrapper)
+	conn.heapIndex = len(*h)
+	*h = append(*h, conn)
+}
+
+func (h *kcpSessionHeap) Pop() interface{} {
+	old := *h
+	conn := old[len(old)-1]
+	old[len(old)-1] = nil
+	conn.heapIndex = -1
+	*h = old[:len(old)-1]
+	return conn
+}
+
+// track starts tracking a session, which is checked first after a tick.
+func (t *KCPTransport) track(conn *kcpConnWrapper, now int64) {
+	t.connsMtx.Lock()
+	defer t.connsMtx.Unlock()
+	conn.transport = t
+	conn.nextCheck = now + t.keepAliveCheck.Nanoseconds()
+	conn.keepAliveIdle = t.nextKeepAliveIdle()
+	heap.Push(&t.sessions, conn)
+}
+
+// nextKeepAliveIdle returns the idle time in ns before the next keep-alive
+// signal of a session, i.e. the keep_alive_interval randomized by the jitter.
+func (t *KCPTransport) nextKeepAliveIdle() int64 {
+	interval := t.keepAliveInterval.Nanoseconds()
+	delta := int64(float64(interval) * t.keepAliveJitter)
+	if delta <= 0 {
+		return interval
+	}
+	return interval - delta + rand.Int63n(2*delta+1)
+}
+
+// untrack stops tracking a session if it's still tracked, and wakes up the
+// listeners waiting for room.
+func (t *KCPTransport) untrack(conn *kcpConnWrapper) {
+	t.connsMtx.Lock()
+	defer t.connsMtx.Unlock()
+	t.untrackLocked(conn)
+}
+
+func (t *KCPTransport) untrackLocked(conn *kcpConnWrapper) {
+	if conn.heapIndex >= 0 {
+		heap.Remove(&t.sessions, conn.heapIndex)
+		t.connsCond.Broadcast()
+	}
+}
+
+// waitForRoom blocks until fewer than max_sessions sessions are tracked, or
+// the listener is closed.
+func (t *KCPTransport) waitForRoom(l *kcpListenerWrapper) {
+	if t.maxSessions == 0 {
+		return
+	}
+	t.connsMtx.Lock()
+	defer t.connsMtx.Unlock()
+	for len(t.sessions) >= t.maxSessions && !l.closed {
+		t.connsCond.Wait()
+	}
+}
+
+// checkSessions checks the sessions due at the given UNIX ns time. The lost
+// ones are closed and the long idle ones are sent keep-alive signals. The
+// time of the next check of a session is decided by the activities so far,
+// which is no later than any of the timeouts can happen.
+func (t *KCPTransport) checkSessions(now int64) {
+	tick := t.keepAliveCheck.Nanoseconds()
+	timeout := t.keepAliveTimeout.Nanoseconds()
+	t.connsMtx.Lock()
+	defer t.connsMtx.Unlock()
+	for len(t.sessions) > 0 && t.sessions[0].nextCheck <= now {
+		conn := t.sessions[0]
+		lastSend := atomic.LoadInt64(&conn.lastSend)
+		lastReadStart := atomic.LoadInt64(&conn.lastReadStart)
+		lastWriteStart := atomic.LoadInt64(&conn.lastWriteStart)
+		if lastSend == 0 { // closed
+			t.untrackLocked(conn)
+			continue
+		} else if lastReadStart > 0 && now-lastReadStart > timeout {
+			// read time out, lost
+			t.untrackLocked(conn)
+			go conn.Close() // nolint: errcheck
+			continue
+		} else if lastWriteStart > 0 && now-lastWriteStart > timeout {
+			// write time out, lost
+			t.untrackLocked(conn)
+			go conn.Close() // nolint: errcheck
+			continue
+		}
+
+		next := lastSend + conn.keepAliveIdle
+		if now-lastSend > conn.keepAliveIdle { // long idle
+			go conn.sendKeepAlive(t.keepAlivePadding)
+			conn.keepAliveIdle = t.nextKeepAliveIdle()
+			next = now + conn.keepAliveIdle
+		}
+		// operations not started yet can't time out before now + timeout
+		for _, start := range []int64{lastReadStart, lastWriteStart} {
+			if start == 0 {
+				start = now
+			}
+			if start+timeout < next {
+				next = start + timeout
+			}
+		}
+		if next < now+tick {
+			next = now + tick
+		}
+		conn.nextCheck = next
+		heap.Fix(&t.sessions, 0)
+	}
+}
@@ -0,0 +1,30 @@
+// +build !windows
+
+package lib
+
+import (
+	"net"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// getSockBufSizes returns the actual read & write buffer sizes of a socket.
+func getSockBufSizes(conn *net.UDPConn) (rd int, wr int, err error) {
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return 0, 0, errors.WithStack(err)
+	}
+	cErr := rawConn.Control(func(fd uintptr) {
+		rd, err = syscall.GetsockoptInt(
+			int(fd), syscall.SOL_SOCKET, syscall.SO_RCVBUF)
+		if err == nil {
+			wr, err = syscall.GetsockoptInt(
+				int(fd), syscall.SOL_SOCKET, syscall.SO_SNDBUF)
+		}
+	})
+	if cErr != nil {
+		err = cErr
+	}
+	return rd, wr, errors.WithStack(err)
+}
@@ -0,0 +1,12 @@
+package lib
+
+import (
+	"net"
+
+	"github.com/pkg/errors"
+)
+
+// getSockBufSizes is not supported on Windows.
+func getSockBufSizes(conn *net.UDPConn) (rd int, wr int, err error) {
+	return 0, 0, errors.New("not supported on windows")
+}
@@ -2,15 +2,24 @@ package lib
 
 import (
 	"context"
+	"crypto/subtle"
 	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"net"
 	"net/http"
+	"os"
+	"path/filepath"
 	"runtime"
 	"sort"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
+
+	"github.com/pkg/errors"
+	"github.com/richardtsai/thestral2/db"
 )
 
 // monitorUpdateInterval is the interval at which the monitor update its
@@ -20,11 +29,23 @@ var monitorUpdateInterval = time.Second * 1
 
 const connLatencyEmaAlpha = 0.8
 
+// monitorUnixPrefix marks a monitor_path which is a Unix domain socket.
+const monitorUnixPrefix = "unix:"
+
 // AppMonitor records and reports runtime statistics of an thestral app.
 type AppMonitor struct {
 	transferMeter    transferMeter
+	dnsResolver      atomic.Value
 	tunnelMonitors   sync.Map // ReqID (string) -> *TunnelMonitor
 	upstreamMonitors sync.Map // upstream (string) -> *UpstreamMonitor
+	requestCounts    sync.Map // downstream (string) -> *uint64
+	downstreamConns  sync.Map // downstream (string) -> *int32
+	downstreamQueue  sync.Map // downstream (string) -> *int32
+	ruleTraffic      sync.Map // ruleTrafficKey -> *ruleTrafficCounter
+	closeCounts      sync.Map // TunnelCloseReason -> *uint64
+	unixServer       *http.Server
+	unixSockPath     string
+	auth             *MonitorAuthConfig // see SetAuth
 }
 
 // AppMonitorReport is the statistics report generated by AppMonitor.
@@ -43,10 +64,48 @@ type AppMonitorReport struct {
 	Tunnels []*TunnelMonitorReport
 	// per-upstream report
 	Upstreams []*UpstreamMonitorReport
+	// number of requests being processed by each downstream
+	DownstreamConns map[string]int32
+	// number of requests waiting for max_conns of each downstream
+	DownstreamQueued map[string]int32
+	// bytes transferred by each pair of rule and upstream
+	RuleTraffic []*RuleTrafficReport
+	// number of tunnels closed for each reason
+	ClosedTunnels map[TunnelCloseReason]uint64
+	// DNS cache statistics, nil if domains are not resolved locally
+	DNSCache *DNSCacheStats `json:",omitempty"`
+	// KCP statistics, nil if KCP is not used
+	KCP *KCPStats `json:",omitempty"`
+	// statistics of the GlobalBufPool
+	BufPool BufPoolStats
+	// auth lookup cache statistics, nil if the user database is not used
+	AuthCache *db.AuthCacheStats `json:",omitempty"`
 }
 
-// Start the AppMonitor.
-func (m *AppMonitor) Start(path string) {
+// Start the AppMonitor. The reports are served under /debug/monitor/<path>/
+// by the default HTTP server (see debug_addr), or if the path is
+// "unix:<socket path>", under /debug/monitor/ by a dedicated server listening
+// on the Unix domain socket only, which is accessible to the owner only.
+func (m *AppMonitor) Start(path string) error {
+	mux := http.DefaultServeMux
+	if strings.HasPrefix(path, monitorUnixPrefix) {
+		mux = http.NewServeMux()
+		err := m.listenUnix(strings.TrimPrefix(path, monitorUnixPrefix), mux)
+		if err != nil {
+			return err
+		}
+		path = "/"
+	} else if len(path) == 0 {
+		path = "/"
+	} else {
+		if path[0] != '/' {
+			path = "/" + path
+		}
+		if path[len(path)-1] != '/' {
+			path += "/"
+		}
+	}
+
 	go func() {
 		tickCh := time.Tick(monitorUpdateInterval)
 		for {
@@ -54,23 +113,112 @@ func (m *AppMonitor) Start(path string) {
 			m.updateEpoch()
 		}
 	}()
+	m.registerRPCHandlers(mux, path)
+	return nil
+}
 
-	if len(path) == 0 {
-		path = "/"
-	} else {
-		if path[0] != '/' {
-			path = "/" + path
+// listenUnix serves the handlers of mux on a Unix domain socket. A stale
+// socket file left by a previous process is replaced.
+//
+// The socket is created and restricted in a private (0700) directory first,
+// and then moved into place, so that it's never accessible to the others, even
+// before the chmod.
+func (m *AppMonitor) listenUnix(sockPath string, mux *http.ServeMux) error {
+	if sockPath == "" {
+		return errors.New("empty socket path for the monitor")
+	}
+	if fi, err := os.Lstat(sockPath); err == nil &&
+		fi.Mode()&os.ModeSocket == 0 {
+		return errors.Errorf("not a socket for the monitor: %s", sockPath)
+	}
+	tmpDir, err := ioutil.TempDir(filepath.Dir(sockPath), ".monitor")
+	if err != nil {
+		return errors.Wrap(err, "failed to listen for the monitor")
+	}
+	defer func() { _ = os.RemoveAll(tmpDir) }()
+	tmpPath := filepath.Join(tmpDir, "monitor.sock")
+	listener, err := net.Listen("unix", tmpPath)
+	if err != nil {
+		return errors.Wrap(err, "failed to listen for the monitor")
+	}
+	// the socket file is moved, and thus removed by Stop instead
+	listener.(*net.UnixListener).SetUnlinkOnClose(false)
+	if err = os.Chmod(tmpPath, 0600); err != nil {
+		_ = listener.Close()
+		return errors.Wrap(err, "failed to restrict the monitor socket")
+	}
+	if err = os.Rename(tmpPath, sockPath); err != nil {
+		_ = listener.Close()
+		return errors.Wrap(err, "failed to listen for the monitor")
+	}
+	m.unixSockPath = sockPath
+	m.unixServer = &http.Server{Handler: mux}
+	go func() { _ = m.unixServer.Serve(listener) }()
+	return nil
+}
+
+// SetAuth requires the credentials of the configuration for all the handlers
+// of the monitor, including the metrics, either of which is accepted. This
+// must be called before Start.
+func (m *AppMonitor) SetAuth(config MonitorAuthConfig) error {
+	if config.Username == "" && config.Password == "" && config.Token == "" {
+		return errors.New("no credentials in 'monitor_auth'")
+	} else if (config.Username == "") != (config.Password == "") {
+		return errors.New(
+			"'username' and 'password' of 'monitor_auth' go together")
+	}
+	m.auth = &config
+	return nil
+}
+
+// authorized wraps a handler of the monitor to require the credentials set by
+// SetAuth, if any, which are compared in constant time.
+func (m *AppMonitor) authorized(handler http.Handler) http.Handler {
+	auth := m.auth
+	if auth == nil {
+		return handler
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ok := false
+		if user, pass, basic := r.BasicAuth(); basic && auth.Username != "" {
+			userOK := subtle.ConstantTimeCompare(
+				[]byte(user), []byte(auth.Username))
+			passOK := subtle.ConstantTimeCompare(
+				[]byte(pass), []byte(auth.Password))
+			ok = userOK&passOK == 1
+		} else if auth.Token != "" {
+			ok = subtle.ConstantTimeCompare(
+				[]byte(r.Header.Get("Authorization")),
+				[]byte("Bearer "+auth.Token)) == 1
 		}
-		if path[len(path)-1] != '/' {
-			path += "/"
+		if ok {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		if auth.Username != "" {
+			w.Header().Set("WWW-Authenticate", `Basic realm="thestral"`)
+		} else {
+			w.Header().Set("WWW-Authenticate", "Bearer")
 		}
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	})
+}
+
+// Stop stops serving the monitor on the Unix domain socket if any, whose file
+// is removed.
+func (m *AppMonitor) Stop() {
+	if m.unixServer != nil {
+		_ = m.unixServer.Close()
+		_ = os.Remove(m.unixSockPath)
 	}
-	m.registerRPCHandlers(path)
 }
 
-func (m *AppMonitor) registerRPCHandlers(path string) {
+func (m *AppMonitor) registerRPCHandlers(mux *http.ServeMux, path string) {
+	handleFunc := func(pattern string, handler http.HandlerFunc) {
+		mux.Handle(pattern, m.authorized(handler))
+	}
 	// full report
-	http.HandleFunc("/debug/monitor"+path,
+	handleFunc("/debug/monitor"+path,
 		func(w http.ResponseWriter, r *http.Request) {
 			if reportJSONBytes, err :=
 				json.MarshalIndent(m.Report(), "", "  "); err != nil {
@@ -82,12 +230,18 @@ func (m *AppMonitor) registerRPCHandlers(path string) {
 				_, _ = w.Write(reportJSONBytes)
 			}
 		})
+	// machine-readable APIs
+	handleFunc("/debug/monitor"+path+"vars", m.serveVars)
+	handleFunc("/debug/monitor"+path+"api/tunnels", m.serveTunnelsAPI)
+	closeAPIPrefix := "/debug/monitor" + path + "api/tunnels/"
+	mux.Handle(closeAPIPrefix, m.authorized(http.StripPrefix(
+		closeAPIPrefix, http.HandlerFunc(m.serveCloseTunnelAPI))))
 	// single tunnel
 	// HTTP DELETE: kill the tunnel
 	// Other methods: report the tunnel report
 	tunnelMonitorBaseURI := "/debug/monitor" + path + "tunnel/"
 	tunnelMonitorBaseURILen := len(tunnelMonitorBaseURI)
-	http.HandleFunc(tunnelMonitorBaseURI,
+	handleFunc(tunnelMonitorBaseURI,
 		func(w http.ResponseWriter, r *http.Request) {
 			if len(r.URL.Path) <= tunnelMonitorBaseURILen {
 				w.WriteHeader(http.StatusNotFound)
@@ -99,7 +253,7 @@ func (m *AppMonitor) registerRPCHandlers(path string) {
 				_, _ = w.Write(
 					[]byte(fmt.Sprintf("Tunnel %s not found", reqID)))
 			} else if r.Method == http.MethodDelete {
-				tunnel.ForceKillTunnel()
+				tunnel.closeByAdmin()
 			} else if reportJSONBytes, err :=
 				json.MarshalIndent(tunnel.Report(), "", "  "); err != nil {
 				w.WriteHeader(http.StatusInternalServerError)
@@ -124,27 +278,116 @@ func (m *AppMonitor) getUpstreamMonitor(upstream string) (um *UpstreamMonitor) {
 }
 
 // OpenTunnelMonitor creates a tunnel monitor. The TunnelMonitor must be Closed
-// when the tunnel ends.
+// when the tunnel ends. The timings are the breakdown of the connLatency, as
+// recorded by the upstream.
 func (m *AppMonitor) OpenTunnelMonitor(
-	req ProxyRequest, rule string, downstream string,
+	req ProxyRequest, rule string, tags []string, downstream string,
 	upstream string, serverIDs []*PeerIdentifier, boundAddr string,
-	connLatency time.Duration, cancelFunc context.CancelFunc) *TunnelMonitor {
+	connLatency time.Duration, timings ConnTimings,
+	cancelFunc context.CancelFunc) *TunnelMonitor {
 	um := m.getUpstreamMonitor(upstream)
-	tm := newTunnelMonitor(
-		m, um, req, rule, downstream, upstream, serverIDs, boundAddr, cancelFunc)
+	tm := newTunnelMonitor(m, um, req, rule, tags, downstream, upstream,
+		serverIDs, boundAddr, cancelFunc)
+	tm.connTimings = timings
 	tm.transferMeter.AddConnLatency(connLatency)
 	um.transferMeter.AddConnLatency(connLatency)
+	um.latency.Add(connLatency)
 	m.transferMeter.AddConnLatency(connLatency)
+	tm.ruleTraffic = m.getRuleTraffic(rule, upstream)
 	m.tunnelMonitors.Store(req.ID(), tm)
 	return tm
 }
 
-// AddError increases the error count of the monitor.
+func (m *AppMonitor) getRuleTraffic(
+	rule, upstream string) *ruleTrafficCounter {
+	key := ruleTrafficKey{rule, upstream}
+	value, ok := m.ruleTraffic.Load(key)
+	if !ok {
+		value, _ = m.ruleTraffic.LoadOrStore(key, new(ruleTrafficCounter))
+	}
+	return value.(*ruleTrafficCounter)
+}
+
+// SetUpstreamHealth records the health state of an upstream.
+func (m *AppMonitor) SetUpstreamHealth(upstream string, healthy bool) {
+	state := upstreamUnhealthy
+	if healthy {
+		state = upstreamHealthy
+	}
+	atomic.StoreUint32(&m.getUpstreamMonitor(upstream).health, state)
+}
+
+// AddUpstreamConns adds delta to the number of connections in use on an
+// upstream.
+func (m *AppMonitor) AddUpstreamConns(upstream string, delta int32) {
+	atomic.AddInt32(&m.getUpstreamMonitor(upstream).connsInUse, delta)
+}
+
+// AddDownstreamConns adds delta to the number of requests being processed by
+// a downstream.
+func (m *AppMonitor) AddDownstreamConns(downstream string, delta int32) {
+	value, ok := m.downstreamConns.Load(downstream)
+	if !ok {
+		value, _ = m.downstreamConns.LoadOrStore(downstream, new(int32))
+	}
+	atomic.AddInt32(value.(*int32), delta)
+}
+
+// AddDownstreamQueued adds delta to the number of requests queued by a
+// downstream, which wait for the max_conns to be processed.
+func (m *AppMonitor) AddDownstreamQueued(downstream string, delta int32) {
+	value, ok := m.downstreamQueue.Load(downstream)
+	if !ok {
+		value, _ = m.downstreamQueue.LoadOrStore(downstream, new(int32))
+	}
+	atomic.AddInt32(value.(*int32), delta)
+}
+
+// SetDNSResolver sets the resolver whose cache statistics are reported. A
+// nil one means domains are not resolved locally.
+func (m *AppMonitor) SetDNSResolver(resolver *CachingResolver) {
+	m.dnsResolver.Store(resolver)
+}
+
+func (m *AppMonitor) getDNSResolver() *CachingResolver {
+	resolver, _ := m.dnsResolver.Load().(*CachingResolver)
+	return resolver
+}
+
+// AddError increases the error count of the monitor, i.e. a failure of
+// connecting via the upstream.
 func (m *AppMonitor) AddError(upstream string) {
-	m.getUpstreamMonitor(upstream).transferMeter.AddError()
+	um := m.getUpstreamMonitor(upstream)
+	um.transferMeter.AddError()
+	um.outcomes.Add(time.Now(), false)
 	m.transferMeter.AddError()
 }
 
+// AddSuccess records a connection established via the upstream.
+func (m *AppMonitor) AddSuccess(upstream string) {
+	um := m.getUpstreamMonitor(upstream)
+	atomic.AddUint32(&um.successCount, 1)
+	um.outcomes.Add(time.Now(), true)
+}
+
+// SetUpstreamDegraded records whether an upstream is degraded, i.e. it's
+// healthy by the health checks, but recently fails too often.
+func (m *AppMonitor) SetUpstreamDegraded(upstream string, degraded bool) {
+	var value uint32
+	if degraded {
+		value = 1
+	}
+	atomic.StoreUint32(&m.getUpstreamMonitor(upstream).degraded, value)
+}
+
+// upstreamOutcomes returns the numbers of the successes and the failures of
+// connecting via an upstream within the window before now.
+func (m *AppMonitor) upstreamOutcomes(
+	upstream string, now time.Time, window time.Duration) (
+	successes, failures uint32) {
+	return m.getUpstreamMonitor(upstream).outcomes.Count(now, window)
+}
+
 func (m *AppMonitor) updateEpoch() {
 	m.transferMeter.PushHistory()
 	m.tunnelMonitors.Range(func(key interface{}, value interface{}) bool {
@@ -159,21 +402,13 @@ func (m *AppMonitor) Report() (report AppMonitorReport) {
 	report.Runtime = fmt.Sprintf("%s on %s/%s",
 		runtime.Version(), runtime.GOOS, runtime.GOARCH)
 
-	report.AvgConnLatencyMs = m.transferMeter.emaConnLatencyMs
-	report.ErrorCount = m.transferMeter.errorCount
+	report.AvgConnLatencyMs = m.transferMeter.ConnLatencyMs()
+	report.ErrorCount = atomic.LoadUint32(&m.transferMeter.errorCount)
 	report.UploadSpeed, report.DownloadSpeed = m.transferMeter.Speed()
 	report.BytesUploaded, report.BytesDownloaded =
 		m.transferMeter.BytesTransferred()
 
-	m.tunnelMonitors.Range(func(key interface{}, value interface{}) bool {
-		tunnelReport := value.(*TunnelMonitor).Report()
-		report.Tunnels = append(report.Tunnels, &tunnelReport)
-		return true
-	})
-	sort.Slice(report.Tunnels, func(i, j int) bool {
-		return report.Tunnels[i].EstablishedSince.After(
-			report.Tunnels[j].EstablishedSince)
-	})
+	report.Tunnels = m.TunnelReports()
 
 	m.upstreamMonitors.Range(func(key interface{}, value interface{}) bool {
 		upReport := value.(*UpstreamMonitor).Report()
@@ -183,9 +418,119 @@ func (m *AppMonitor) Report() (report AppMonitorReport) {
 	sort.Slice(report.Upstreams, func(i, j int) bool {
 		return report.Upstreams[i].Name < report.Upstreams[j].Name
 	})
+
+	report.DownstreamConns = make(map[string]int32)
+	m.downstreamConns.Range(func(key interface{}, value interface{}) bool {
+		report.DownstreamConns[key.(string)] = atomic.LoadInt32(value.(*int32))
+		return true
+	})
+	report.DownstreamQueued = make(map[string]int32)
+	m.downstreamQueue.Range(func(key interface{}, value interface{}) bool {
+		report.DownstreamQueued[key.(string)] = atomic.LoadInt32(value.(*int32))
+		return true
+	})
+
+	m.ruleTraffic.Range(func(key interface{}, value interface{}) bool {
+		k, counter := key.(ruleTrafficKey), value.(*ruleTrafficCounter)
+		report.RuleTraffic = append(report.RuleTraffic, &RuleTrafficReport{
+			Rule:            k.rule,
+			Upstream:        k.upstream,
+			BytesUploaded:   atomic.LoadUint64(&counter.uploaded),
+			BytesDownloaded: atomic.LoadUint64(&counter.downloaded),
+		})
+		return true
+	})
+	sort.Slice(report.RuleTraffic, func(i, j int) bool {
+		a, b := report.RuleTraffic[i], report.RuleTraffic[j]
+		return a.Rule < b.Rule || a.Rule == b.Rule && a.Upstream < b.Upstream
+	})
+
+	report.ClosedTunnels = make(map[TunnelCloseReason]uint64)
+	m.closeCounts.Range(func(key interface{}, value interface{}) bool {
+		report.ClosedTunnels[key.(TunnelCloseReason)] =
+			atomic.LoadUint64(value.(*uint64))
+		return true
+	})
+
+	if resolver := m.getDNSResolver(); resolver != nil {
+		stats := resolver.Stats()
+		report.DNSCache = &stats
+	}
+	if atomic.LoadUint32(&kcpInUse) != 0 {
+		report.KCP = getKCPStats()
+	}
+	report.BufPool = GlobalBufPool.Stats()
+	if db.Inited {
+		stats := db.GetAuthCacheStats()
+		report.AuthCache = &stats
+	}
+	return
+}
+
+// TunnelReports reports all the active tunnels, the latest first.
+func (m *AppMonitor) TunnelReports() (reports []*TunnelMonitorReport) {
+	m.tunnelMonitors.Range(func(key interface{}, value interface{}) bool {
+		tunnelReport := value.(*TunnelMonitor).Report()
+		reports = append(reports, &tunnelReport)
+		return true
+	})
+	sort.Slice(reports, func(i, j int) bool {
+		return reports[i].EstablishedSince.After(reports[j].EstablishedSince)
+	})
 	return
 }
 
+// serveTunnelsAPI lists the active tunnels in JSON.
+func (m *AppMonitor) serveTunnelsAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	tunnels := m.TunnelReports()
+	if tunnels == nil {
+		tunnels = []*TunnelMonitorReport{}
+	}
+	if jsonBytes, err := json.Marshal(tunnels); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = w.Write([]byte(fmt.Sprintf(
+			"Failed to generate tunnel list: %s", err.Error())))
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(jsonBytes)
+	}
+}
+
+// serveCloseTunnelAPI closes the tunnel at "{reqID}/close" on POST.
+func (m *AppMonitor) serveCloseTunnelAPI(
+	w http.ResponseWriter, r *http.Request) {
+	if !strings.HasSuffix(r.URL.Path, "/close") {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	reqID := strings.TrimSuffix(r.URL.Path, "/close")
+	if !m.CloseTunnel(reqID) {
+		w.WriteHeader(http.StatusNotFound)
+		_, _ = w.Write([]byte(fmt.Sprintf("Tunnel %s not found", reqID)))
+	} else {
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// CloseTunnel closes an active tunnel by an admin. It returns false if the
+// tunnel is not found.
+func (m *AppMonitor) CloseTunnel(requestID string) bool {
+	tunnel := m.getTunnelMonitor(requestID)
+	if tunnel != nil {
+		tunnel.closeByAdmin()
+	}
+	return tunnel != nil
+}
+
 func (m *AppMonitor) getTunnelMonitor(requestID string) *TunnelMonitor {
 	if value, ok := m.tunnelMonitors.Load(requestID); ok {
 		return value.(*TunnelMonitor)
@@ -199,20 +544,46 @@ type TunnelMonitor struct {
 	upstreamMonitor  *UpstreamMonitor
 	request          ProxyRequest
 	rule             string
+	tags             []string // of the rule, not to be modified
 	downstream       string
 	upstream         string
 	serverIDs        []*PeerIdentifier
 	boundAddr        string
+	connTimings      ConnTimings
 	establishedSince time.Time
 	transferMeter    transferMeter
+	ruleTraffic      *ruleTrafficCounter
 	cancelFunc       context.CancelFunc
+	closeReason      atomic.Value // TunnelCloseReason, the first one set
+	rates            rateSampler
 }
 
+// TunnelCloseReason is the reason why a tunnel is closed.
+type TunnelCloseReason string
+
+// The reasons why tunnels are closed.
+const (
+	TunnelClientClosed     TunnelCloseReason = "client_closed"
+	TunnelServerClosed     TunnelCloseReason = "server_closed"
+	TunnelError            TunnelCloseReason = "error"
+	TunnelIdleTimeout      TunnelCloseReason = "idle_timeout"
+	TunnelFirstByteTimeout TunnelCloseReason = "first_byte_timeout"
+	TunnelIOTimeout        TunnelCloseReason = "io_timeout" // read/write
+	TunnelAdminKilled      TunnelCloseReason = "admin_killed"
+	TunnelCanceled         TunnelCloseReason = "canceled" // e.g. shutting down
+
+	// the data from a compressed connection is corrupted
+	TunnelDecompressionError TunnelCloseReason = "decompression_error"
+	// ended by a sinkhole upstream, see SinkholeClient
+	TunnelSinkholed TunnelCloseReason = "sinkholed"
+)
+
 // TunnelMonitorReport is the report generated by TunnelMonitor.
 type TunnelMonitorReport struct {
 	// basic
 	RequestID        string
 	Rule             string
+	Tags             []string `json:",omitempty"` // of the rule
 	EstablishedSince time.Time
 	ElapsedTimeSecs  float64
 	// downstream info
@@ -230,24 +601,38 @@ type TunnelMonitorReport struct {
 	DownloadSpeed   float32
 	BytesUploaded   uint64
 	BytesDownloaded uint64
+	// bytes/s since the previous report of the tunnel, which is sampled on
+	// reporting (see rateSampler), and the seconds the rates are over
+	CurrentUploadRate   float32
+	CurrentDownloadRate float32
+	RateWindowSecs      float32
+	// the breakdown of the connecting latency (see ConnTimings)
+	ResolveLatencyMs   float32
+	DialLatencyMs      float32
+	HandshakeLatencyMs float32
+	// empty until the tunnel is being closed
+	CloseReason TunnelCloseReason `json:",omitempty"`
 }
 
 func newTunnelMonitor(
 	appMonitor *AppMonitor, upstreamMonitor *UpstreamMonitor, req ProxyRequest,
-	rule string, downstream string, upstream string,
+	rule string, tags []string, downstream string, upstream string,
 	serverIDs []*PeerIdentifier, boundAddr string,
 	cancelFunc context.CancelFunc) *TunnelMonitor {
+	now := time.Now()
 	return &TunnelMonitor{
 		appMonitor:       appMonitor,
 		upstreamMonitor:  upstreamMonitor,
 		request:          req,
 		rule:             rule,
+		tags:             tags,
 		downstream:       downstream,
 		upstream:         upstream,
 		serverIDs:        serverIDs,
 		boundAddr:        boundAddr,
-		establishedSince: time.Now(),
+		establishedSince: now,
 		cancelFunc:       cancelFunc,
+		rates:            rateSampler{time: now},
 	}
 }
 
@@ -255,11 +640,16 @@ func (m *TunnelMonitor) updateEpoch() {
 	m.transferMeter.PushHistory()
 }
 
+func (m *TunnelMonitor) labels() tunnelLabels {
+	return tunnelLabels{m.downstream, m.upstream, m.rule}
+}
+
 // IncBytesUploaded records the number of bytes in a trunk uploaded.
 func (m *TunnelMonitor) IncBytesUploaded(n uint32) {
 	m.appMonitor.transferMeter.IncUploaded(n)
 	m.upstreamMonitor.transferMeter.IncUploaded(n)
 	m.transferMeter.IncUploaded(n)
+	atomic.AddUint64(&m.ruleTraffic.uploaded, uint64(n))
 }
 
 // IncBytesDownloaded records the number of bytes in a trunk downloaded.
@@ -267,6 +657,7 @@ func (m *TunnelMonitor) IncBytesDownloaded(n uint32) {
 	m.appMonitor.transferMeter.IncDownloaded(n)
 	m.upstreamMonitor.transferMeter.IncDownloaded(n)
 	m.transferMeter.IncDownloaded(n)
+	atomic.AddUint64(&m.ruleTraffic.downloaded, uint64(n))
 }
 
 // ForceKillTunnel forcely kill the tunnel.
@@ -274,15 +665,51 @@ func (m *TunnelMonitor) ForceKillTunnel() {
 	m.cancelFunc()
 }
 
+func (m *TunnelMonitor) closeByAdmin() {
+	m.request.Logger().Warnw("tunnel closed by administrator",
+		"addr", m.request.TargetAddr(), "upstream", m.upstream)
+	m.SetCloseReason(TunnelAdminKilled)
+	m.ForceKillTunnel()
+}
+
+// SetCloseReason records why the tunnel is closed. Only the first reason set
+// is kept, as the others are usually the consequences of it.
+func (m *TunnelMonitor) SetCloseReason(reason TunnelCloseReason) {
+	m.closeReason.CompareAndSwap(nil, reason)
+}
+
 // Close the tunnel monitor. This must be called at the end of the tunnel.
 func (m *TunnelMonitor) Close() {
+	m.SetCloseReason(TunnelCanceled) // if no reason was set
+	reason := m.closeReason.Load().(TunnelCloseReason)
+	value, ok := m.appMonitor.closeCounts.Load(reason)
+	if !ok {
+		value, _ = m.appMonitor.closeCounts.LoadOrStore(reason, new(uint64))
+	}
+	atomic.AddUint64(value.(*uint64), 1)
 	m.appMonitor.tunnelMonitors.Delete(m.request.ID())
 }
 
+// HasTag tells whether the tunnel is tagged so by its rule.
+func (m *TunnelMonitor) HasTag(tag string) bool {
+	for _, t := range m.tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// BytesTransferred returns the bytes uploaded and downloaded so far.
+func (m *TunnelMonitor) BytesTransferred() (up, down uint64) {
+	return m.transferMeter.BytesTransferred()
+}
+
 // Report the statistics of the tunnel.
 func (m *TunnelMonitor) Report() (report TunnelMonitorReport) {
 	report.RequestID = m.request.ID()
 	report.Rule = m.rule
+	report.Tags = m.tags
 	report.EstablishedSince = m.establishedSince
 	report.ElapsedTimeSecs = time.Since(m.establishedSince).Seconds()
 	report.Downstream = m.downstream
@@ -292,10 +719,17 @@ func (m *TunnelMonitor) Report() (report TunnelMonitorReport) {
 	report.Upstream = m.upstream
 	report.ServerIDs = m.serverIDs
 	report.BoundAddr = m.boundAddr
-	report.ConnLatencyMs = m.transferMeter.emaConnLatencyMs
+	report.ConnLatencyMs = m.transferMeter.ConnLatencyMs()
+	report.ResolveLatencyMs = toMs(m.connTimings.Resolve)
+	report.DialLatencyMs = toMs(m.connTimings.Dial)
+	report.HandshakeLatencyMs = toMs(m.connTimings.Handshake)
 	report.UploadSpeed, report.DownloadSpeed = m.transferMeter.Speed()
 	report.BytesUploaded, report.BytesDownloaded =
 		m.transferMeter.BytesTransferred()
+	report.CurrentUploadRate, report.CurrentDownloadRate,
+		report.RateWindowSecs = m.rates.Sample(
+		time.Now(), report.BytesUploaded, report.BytesDownloaded)
+	report.CloseReason, _ = m.closeReason.Load().(TunnelCloseReason)
 	return
 }
 
@@ -306,6 +740,9 @@ func (r TunnelMonitorReport) Format(f fmt.State, c rune) {
 	}
 	_, _ = fmt.Fprintf(f, "RequestID: %s\n", r.RequestID)
 	_, _ = fmt.Fprintf(f, "Rule: %s\n", r.Rule)
+	if len(r.Tags) > 0 {
+		_, _ = fmt.Fprintf(f, "Tags: %s\n", strings.Join(r.Tags, ", "))
+	}
 	_, _ = fmt.Fprintf(f, "EstablishedSince: %s\n",
 		r.EstablishedSince.Local().Format(time.RFC1123))
 	elspsed := time.Duration(int64(r.ElapsedTimeSecs) * int64(time.Second))
@@ -324,6 +761,9 @@ func (r TunnelMonitorReport) Format(f fmt.State, c rune) {
 	}
 	_, _ = fmt.Fprintf(f, "BoundAddr: %s\n", r.BoundAddr)
 	_, _ = fmt.Fprintf(f, "ConnLatency: %.2f ms\n", r.ConnLatencyMs)
+	_, _ = fmt.Fprintf(f,
+		"  Resolve: %.2f ms, Dial: %.2f ms, Handshake: %.2f ms\n",
+		r.ResolveLatencyMs, r.DialLatencyMs, r.HandshakeLatencyMs)
 	_, _ = fmt.Fprintf(f, "UploadSpeed: %s/s\n",
 		BytesHumanized(uint64(r.UploadSpeed)))
 	_, _ = fmt.Fprintf(f, "DownloadSpeed: %s/s\n",
@@ -332,36 +772,204 @@ func (r TunnelMonitorReport) Format(f fmt.State, c rune) {
 		BytesHumanized(r.BytesUploaded))
 	_, _ = fmt.Fprintf(f, "BytesDownloaded: %s\n",
 		BytesHumanized(r.BytesDownloaded))
+	_, _ = fmt.Fprintf(f, "CurrentRate: %s/s up, %s/s down (%.1f s)\n",
+		BytesHumanized(uint64(r.CurrentUploadRate)),
+		BytesHumanized(uint64(r.CurrentDownloadRate)), r.RateWindowSecs)
+	if r.CloseReason != "" {
+		_, _ = fmt.Fprintf(f, "CloseReason: %s\n", r.CloseReason)
+	}
 }
 
+// tunnelRateMinWindow is the shortest time the current rates of a tunnel are
+// sampled over. The reports within it share the same rates.
+const tunnelRateMinWindow = time.Second
+
+// rateSampler measures the current rates of a tunnel by the bytes transferred
+// since the previous sample, which is taken on reporting rather than by a
+// timer, so that the idle tunnels cost nothing. Thus the rates are over the
+// time between the reports, e.g. the polling interval of the API.
+type rateSampler struct {
+	mtx              sync.Mutex
+	time             time.Time // of the previous sample
+	up, down         uint64
+	upRate, downRate float32
+	windowSecs       float32
+}
+
+// Sample returns the rates since the previous sample and the seconds they
+// are over, or the last ones if it's within the tunnelRateMinWindow.
+func (s *rateSampler) Sample(now time.Time, up, down uint64) (
+	upRate, downRate, windowSecs float32) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if elapsed := now.Sub(s.time); elapsed >= tunnelRateMinWindow {
+		secs := elapsed.Seconds()
+		s.upRate = float32(float64(up-s.up) / secs)
+		s.downRate = float32(float64(down-s.down) / secs)
+		s.windowSecs = float32(secs)
+		s.time, s.up, s.down = now, up, down
+	}
+	return s.upRate, s.downRate, s.windowSecs
+}
+
+type ruleTrafficKey struct {
+	rule     string
+	upstream string
+}
+
+// ruleTrafficCounter counts the bytes transferred by the tunnels of a pair of
+// rule and upstream.
+type ruleTrafficCounter struct {
+	uploaded   uint64 // accessed atomically
+	downloaded uint64 // accessed atomically
+}
+
+// RuleTrafficReport is the number of bytes transferred by the tunnels of a
+// pair of rule and upstream.
+type RuleTrafficReport struct {
+	Rule            string
+	Upstream        string
+	BytesUploaded   uint64
+	BytesDownloaded uint64
+}
+
+// Health states of upstreams.
+const (
+	upstreamHealthUnknown uint32 = iota
+	upstreamHealthy
+	upstreamUnhealthy
+)
+
+// upstreamRecentWindow is the window of the recent success rates reported.
+const upstreamRecentWindow = time.Minute
+
 // UpstreamMonitor records statistics of an upstream.
 type UpstreamMonitor struct {
 	name          string
+	health        uint32 // accessed atomically
+	degraded      uint32 // accessed atomically
+	connsInUse    int32  // accessed atomically
+	successCount  uint32 // accessed atomically
 	transferMeter transferMeter
+	latency       latencyHistogram
+	outcomes      outcomeWindow
 }
 
 // UpstreamMonitorReport is the report of an UpstreamMonitor.
 type UpstreamMonitorReport struct {
-	Name             string
+	Name string
+	// "healthy", "degraded" or "unhealthy", empty if health checking is
+	// disabled
+	Health           string `json:",omitempty"`
+	ConnsInUse       int32
 	AvgConnLatencyMs float32
+	ConnLatencyP50Ms float32
+	ConnLatencyP90Ms float32
+	ConnLatencyP99Ms float32
 	ErrorCount       uint32
+	SuccessCount     uint32
 	UploadSpeed      float32
 	DownloadSpeed    float32
 	BytesUploaded    uint64
 	BytesDownloaded  uint64
+	// connections attempted in the last minute, and the ratio of the
+	// successful ones (0 if none)
+	RecentConns       uint32
+	RecentSuccessRate float32
 }
 
 // Report generates a report for the UpstreamMonitor.
 func (m *UpstreamMonitor) Report() (report UpstreamMonitorReport) {
 	report.Name = m.name
-	report.AvgConnLatencyMs = m.transferMeter.emaConnLatencyMs
-	report.ErrorCount = m.transferMeter.errorCount
+	switch atomic.LoadUint32(&m.health) {
+	case upstreamHealthy:
+		report.Health = "healthy"
+		if atomic.LoadUint32(&m.degraded) != 0 {
+			report.Health = "degraded"
+		}
+	case upstreamUnhealthy:
+		report.Health = "unhealthy"
+	}
+	report.ConnsInUse = atomic.LoadInt32(&m.connsInUse)
+	report.AvgConnLatencyMs = m.transferMeter.ConnLatencyMs()
+	report.ConnLatencyP50Ms = toMs(m.latency.Quantile(0.5))
+	report.ConnLatencyP90Ms = toMs(m.latency.Quantile(0.9))
+	report.ConnLatencyP99Ms = toMs(m.latency.Quantile(0.99))
+	report.ErrorCount = atomic.LoadUint32(&m.transferMeter.errorCount)
+	report.SuccessCount = atomic.LoadUint32(&m.successCount)
 	report.UploadSpeed, report.DownloadSpeed = m.transferMeter.Speed()
 	report.BytesUploaded, report.BytesDownloaded =
 		m.transferMeter.BytesTransferred()
+	report.RecentConns, report.RecentSuccessRate = m.recentSuccessRate()
+	return
+}
+
+// recentSuccessRate returns the number of the connections attempted within
+// the upstreamRecentWindow, and the ratio of the successful ones.
+func (m *UpstreamMonitor) recentSuccessRate() (uint32, float32) {
+	successes, failures := m.outcomes.Count(time.Now(), upstreamRecentWindow)
+	if successes+failures == 0 {
+		return 0, 0
+	}
+	return successes + failures,
+		float32(successes) / float32(successes+failures)
+}
+
+// outcomeWindowSlots is the number of the seconds whose outcomes of
+// connecting are kept, i.e. the longest window that can be counted.
+const outcomeWindowSlots = 600
+
+// outcomeWindow counts the successes and the failures of connecting in each of
+// the recent seconds, so that the rates over a sliding window are available.
+type outcomeWindow struct {
+	mtx   sync.Mutex
+	slots [outcomeWindowSlots]outcomeSlot
+}
+
+type outcomeSlot struct {
+	sec       int64 // UNIX time of the counts
+	successes uint32
+	failures  uint32
+}
+
+// Add records an outcome at the given time.
+func (w *outcomeWindow) Add(now time.Time, success bool) {
+	sec := now.Unix()
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	slot := &w.slots[sec%outcomeWindowSlots]
+	if slot.sec != sec { // a stale one
+		*slot = outcomeSlot{sec: sec}
+	}
+	if success {
+		slot.successes++
+	} else {
+		slot.failures++
+	}
+}
+
+// Count returns the numbers of the outcomes within the window (in seconds)
+// before now.
+func (w *outcomeWindow) Count(now time.Time, window time.Duration) (
+	successes, failures uint32) {
+	sec := now.Unix()
+	since := sec - int64(window/time.Second)
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	for i := range w.slots {
+		if slot := &w.slots[i]; slot.sec > since && slot.sec <= sec {
+			successes += slot.successes
+			failures += slot.failures
+		}
+	}
 	return
 }
 
+// toMs converts a duration to milliseconds for the reports.
+func toMs(d time.Duration) float32 {
+	return float32(d.Seconds() * 1e3)
+}
+
 func printPeerID(w io.Writer, indent string, i *PeerIdentifier) {
 	_, _ = fmt.Fprintf(w, "%s%s/%s\n", indent, i.Scope, i.Name)
 	_, _ = fmt.Fprintf(w, "%s%sUniqueID: %s\n", indent, indent, i.UniqueID)
@@ -412,6 +1020,13 @@ func (m *transferMeter) AddConnLatency(connLatency time.Duration) {
 	}
 }
 
+// ConnLatencyMs returns the EMA of the connection latencies in milliseconds.
+func (m *transferMeter) ConnLatencyMs() float32 {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	return m.emaConnLatencyMs
+}
+
 func (m *transferMeter) AddError() {
 	atomic.AddUint32(&m.errorCount, 1)
 }
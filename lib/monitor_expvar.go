@@ -0,0 +1,50 @@
+package lib
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"runtime"
+	"sync/atomic"
+)
+
+// monitorVars are the statistics of the monitor in the format of expvar, i.e.
+// the "cmdline" and the "memstats" variables along with the "thestral" one.
+//
+// The expvar package itself is not used, as importing it registers
+// /debug/vars on http.DefaultServeMux, which is exposed by the debug server
+// regardless of the monitor path and its credentials.
+type monitorVars struct {
+	Cmdline  []string          `json:"cmdline"`
+	MemStats *runtime.MemStats `json:"memstats"`
+	Thestral struct {
+		ActiveTunnels   int               `json:"active_tunnels"`
+		BytesUploaded   uint64            `json:"bytes_uploaded"`
+		BytesDownloaded uint64            `json:"bytes_downloaded"`
+		UpstreamErrors  map[string]uint32 `json:"upstream_errors"`
+		Goroutines      int               `json:"goroutines"`
+	} `json:"thestral"`
+}
+
+// serveVars serves the monitorVars, which are evaluated on reading.
+func (m *AppMonitor) serveVars(w http.ResponseWriter, r *http.Request) {
+	vars := monitorVars{Cmdline: os.Args, MemStats: new(runtime.MemStats)}
+	runtime.ReadMemStats(vars.MemStats)
+	m.tunnelMonitors.Range(func(key, value interface{}) bool {
+		vars.Thestral.ActiveTunnels++
+		return true
+	})
+	vars.Thestral.BytesUploaded, vars.Thestral.BytesDownloaded =
+		m.transferMeter.BytesTransferred()
+	vars.Thestral.UpstreamErrors = make(map[string]uint32)
+	m.upstreamMonitors.Range(func(key, value interface{}) bool {
+		um := value.(*UpstreamMonitor)
+		vars.Thestral.UpstreamErrors[um.name] = atomic.LoadUint32(
+			&um.transferMeter.errorCount)
+		return true
+	})
+	vars.Thestral.Goroutines = runtime.NumGoroutine()
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	_ = json.NewEncoder(w).Encode(&vars)
+}
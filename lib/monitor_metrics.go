@@ -0,0 +1,313 @@
+package lib
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// latencyBuckets are the upper bounds of the buckets of latency histograms.
+var latencyBuckets = [...]time.Duration{
+	time.Millisecond * 5, time.Millisecond * 10, time.Millisecond * 25,
+	time.Millisecond * 50, time.Millisecond * 100, time.Millisecond * 250,
+	time.Millisecond * 500, time.Second, time.Millisecond * 2500,
+	time.Second * 5, time.Second * 10,
+}
+
+// latencyHistogram is a histogram of latencies, which can be updated
+// concurrently without locking.
+type latencyHistogram struct {
+	counts [len(latencyBuckets) + 1]uint64 // the last one is for +Inf
+	sumNs  uint64
+}
+
+func (h *latencyHistogram) Add(latency time.Duration) {
+	idx := sort.Search(len(latencyBuckets), func(i int) bool {
+		return latency <= latencyBuckets[i]
+	})
+	atomic.AddUint64(&h.counts[idx], 1)
+	atomic.AddUint64(&h.sumNs, uint64(latency.Nanoseconds()))
+}
+
+// Snapshot returns the (non-cumulative) count of each bucket and the sum of
+// all the latencies.
+func (h *latencyHistogram) Snapshot() (
+	counts [len(latencyBuckets) + 1]uint64, sum time.Duration) {
+	for i := range h.counts {
+		counts[i] = atomic.LoadUint64(&h.counts[i])
+	}
+	sum = time.Duration(atomic.LoadUint64(&h.sumNs))
+	return
+}
+
+// Quantile estimates the q-quantile (0 <= q <= 1) of the latencies, assuming
+// that they are evenly distributed within each bucket. It returns 0 if there
+// is no latency recorded.
+func (h *latencyHistogram) Quantile(q float64) time.Duration {
+	counts, _ := h.Snapshot()
+	var total uint64
+	for _, count := range counts {
+		total += count
+	}
+	if total == 0 {
+		return 0
+	}
+
+	rank := q * float64(total)
+	var cumulative uint64
+	var lower time.Duration
+	for i, count := range counts {
+		if i == len(latencyBuckets) { // +Inf
+			return lower
+		}
+		upper := latencyBuckets[i]
+		if count > 0 && float64(cumulative+count) >= rank {
+			fraction := (rank - float64(cumulative)) / float64(count)
+			return lower + time.Duration(fraction*float64(upper-lower))
+		}
+		cumulative += count
+		lower = upper
+	}
+	return lower
+}
+
+// tunnelLabels identifies a kind of tunnels in the metrics.
+type tunnelLabels struct {
+	downstream string
+	upstream   string
+	rule       string
+}
+
+func (l tunnelLabels) String() string {
+	return fmt.Sprintf(`downstream="%s",rule="%s",upstream="%s"`,
+		escapeLabelValue(l.downstream), escapeLabelValue(l.rule),
+		escapeLabelValue(l.upstream))
+}
+
+// IncRequests counts a request accepted by a downstream, whether or not it
+// ends up in a tunnel.
+func (m *AppMonitor) IncRequests(downstream string) {
+	value, ok := m.requestCounts.Load(downstream)
+	if !ok {
+		value, _ = m.requestCounts.LoadOrStore(downstream, new(uint64))
+	}
+	atomic.AddUint64(value.(*uint64), 1)
+}
+
+// MetricsHandler returns an HTTP handler reporting the metrics in the text
+// format of Prometheus, which requires the credentials set by SetAuth if any.
+func (m *AppMonitor) MetricsHandler() http.Handler {
+	return m.authorized(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+			bw := bufio.NewWriter(w)
+			m.writeMetrics(bw)
+			_ = bw.Flush()
+		}))
+}
+
+func (m *AppMonitor) writeMetrics(w io.Writer) {
+	writeHeader := func(name, typ, help string) {
+		_, _ = fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n",
+			name, help, name, typ)
+	}
+
+	// per-tunnel-kind metrics
+	activeTunnels := make(map[tunnelLabels]uint64)
+	m.tunnelMonitors.Range(func(key, value interface{}) bool {
+		activeTunnels[value.(*TunnelMonitor).labels()]++
+		return true
+	})
+	writeHeader("thestral_active_tunnels", "gauge",
+		"Number of active tunnels.")
+	writeLabeledValues(w, "thestral_active_tunnels", activeTunnels)
+	var reasons []string
+	closeCounts := make(map[string]uint64)
+	m.closeCounts.Range(func(key, value interface{}) bool {
+		reason := string(key.(TunnelCloseReason))
+		reasons = append(reasons, reason)
+		closeCounts[reason] = atomic.LoadUint64(value.(*uint64))
+		return true
+	})
+	sort.Strings(reasons)
+	writeHeader("thestral_tunnels_closed_total", "counter",
+		"Total number of tunnels closed for each reason.")
+	for _, reason := range reasons {
+		_, _ = fmt.Fprintf(w, "thestral_tunnels_closed_total"+
+			"{reason=\"%s\"} %d\n", reason, closeCounts[reason])
+	}
+
+	// per-downstream metrics
+	var downstreams []string
+	downstreamConns := make(map[string]int32)
+	m.downstreamConns.Range(func(key, value interface{}) bool {
+		downstreams = append(downstreams, key.(string))
+		downstreamConns[key.(string)] = atomic.LoadInt32(value.(*int32))
+		return true
+	})
+	sort.Strings(downstreams)
+	writeHeader("thestral_downstream_connections", "gauge",
+		"Number of requests being processed by each downstream.")
+	for _, ds := range downstreams {
+		_, _ = fmt.Fprintf(w, "thestral_downstream_connections"+
+			"{downstream=\"%s\"} %d\n",
+			escapeLabelValue(ds), downstreamConns[ds])
+	}
+	var queuedDownstreams []string
+	downstreamQueued := make(map[string]int32)
+	m.downstreamQueue.Range(func(key, value interface{}) bool {
+		queuedDownstreams = append(queuedDownstreams, key.(string))
+		downstreamQueued[key.(string)] = atomic.LoadInt32(value.(*int32))
+		return true
+	})
+	sort.Strings(queuedDownstreams)
+	writeHeader("thestral_downstream_queued_requests", "gauge",
+		"Number of requests waiting for max_conns of each downstream.")
+	for _, ds := range queuedDownstreams {
+		_, _ = fmt.Fprintf(w, "thestral_downstream_queued_requests"+
+			"{downstream=\"%s\"} %d\n",
+			escapeLabelValue(ds), downstreamQueued[ds])
+	}
+	var requestDownstreams []string
+	requestCounts := make(map[string]uint64)
+	m.requestCounts.Range(func(key, value interface{}) bool {
+		requestDownstreams = append(requestDownstreams, key.(string))
+		requestCounts[key.(string)] = atomic.LoadUint64(value.(*uint64))
+		return true
+	})
+	sort.Strings(requestDownstreams)
+	writeHeader("thestral_requests_total", "counter",
+		"Total number of requests accepted by each downstream.")
+	for _, ds := range requestDownstreams {
+		_, _ = fmt.Fprintf(w, "thestral_requests_total"+
+			"{downstream=\"%s\"} %d\n",
+			escapeLabelValue(ds), requestCounts[ds])
+	}
+
+	// DNS cache metrics
+	if resolver := m.getDNSResolver(); resolver != nil {
+		stats := resolver.Stats()
+		writeHeader("thestral_dns_cache_hits_total", "counter",
+			"Total number of DNS lookups served by the cache.")
+		_, _ = fmt.Fprintf(w, "thestral_dns_cache_hits_total %d\n", stats.Hits)
+		writeHeader("thestral_dns_cache_misses_total", "counter",
+			"Total number of DNS lookups missing the cache.")
+		_, _ = fmt.Fprintf(w, "thestral_dns_cache_misses_total %d\n",
+			stats.Misses)
+		writeHeader("thestral_dns_cache_entries", "gauge",
+			"Number of entries in the DNS cache.")
+		_, _ = fmt.Fprintf(w, "thestral_dns_cache_entries %d\n", stats.Entries)
+	}
+
+	// buffer pool metrics
+	bufStats := GlobalBufPool.Stats()
+	writeHeader("thestral_buf_pool_gets_total", "counter",
+		"Total number of buffers got from the buffer pool.")
+	_, _ = fmt.Fprintf(w, "thestral_buf_pool_gets_total %d\n", bufStats.Gets)
+	writeHeader("thestral_buf_pool_puts_total", "counter",
+		"Total number of buffers put back to the buffer pool.")
+	_, _ = fmt.Fprintf(w, "thestral_buf_pool_puts_total %d\n", bufStats.Puts)
+	writeHeader("thestral_buf_pool_misses_total", "counter",
+		"Total number of buffers allocated by the buffer pool.")
+	_, _ = fmt.Fprintf(w, "thestral_buf_pool_misses_total %d\n",
+		bufStats.Misses)
+
+	// per-upstream metrics
+	var upstreams []*UpstreamMonitor
+	m.upstreamMonitors.Range(func(key, value interface{}) bool {
+		upstreams = append(upstreams, value.(*UpstreamMonitor))
+		return true
+	})
+	sort.Slice(upstreams, func(i, j int) bool {
+		return upstreams[i].name < upstreams[j].name
+	})
+	counters := []struct {
+		name, help string
+		get        func(um *UpstreamMonitor) uint64
+	}{
+		{"thestral_errors_total", "Total number of errors.",
+			func(um *UpstreamMonitor) uint64 {
+				return uint64(atomic.LoadUint32(&um.transferMeter.errorCount))
+			}},
+		{"thestral_successes_total",
+			"Total number of connections established.",
+			func(um *UpstreamMonitor) uint64 {
+				return uint64(atomic.LoadUint32(&um.successCount))
+			}},
+		{"thestral_uploaded_bytes_total", "Total number of bytes uploaded.",
+			func(um *UpstreamMonitor) uint64 {
+				up, _ := um.transferMeter.BytesTransferred()
+				return up
+			}},
+		{"thestral_downloaded_bytes_total", "Total number of bytes downloaded.",
+			func(um *UpstreamMonitor) uint64 {
+				_, down := um.transferMeter.BytesTransferred()
+				return down
+			}},
+	}
+	for _, c := range counters {
+		writeHeader(c.name, "counter", c.help)
+		for _, um := range upstreams {
+			_, _ = fmt.Fprintf(w, "%s{upstream=\"%s\"} %d\n",
+				c.name, escapeLabelValue(um.name), c.get(um))
+		}
+	}
+
+	writeHeader("thestral_recent_success_ratio", "gauge",
+		"Ratio of connections established in the last minute, "+
+			"if any was attempted.")
+	for _, um := range upstreams {
+		if conns, rate := um.recentSuccessRate(); conns > 0 {
+			_, _ = fmt.Fprintf(w,
+				"thestral_recent_success_ratio{upstream=\"%s\"} %g\n",
+				escapeLabelValue(um.name), rate)
+		}
+	}
+
+	const latencyName = "thestral_connect_latency_seconds"
+	writeHeader(latencyName, "histogram",
+		"Latency of connecting to the targets via upstreams.")
+	for _, um := range upstreams {
+		counts, sum := um.latency.Snapshot()
+		label := escapeLabelValue(um.name)
+		var cumulative uint64
+		for i, count := range counts {
+			cumulative += count
+			le := "+Inf"
+			if i < len(latencyBuckets) {
+				le = fmt.Sprint(latencyBuckets[i].Seconds())
+			}
+			_, _ = fmt.Fprintf(w, "%s_bucket{upstream=\"%s\",le=\"%s\"} %d\n",
+				latencyName, label, le, cumulative)
+		}
+		_, _ = fmt.Fprintf(w, "%s_sum{upstream=\"%s\"} %g\n",
+			latencyName, label, sum.Seconds())
+		_, _ = fmt.Fprintf(w, "%s_count{upstream=\"%s\"} %d\n",
+			latencyName, label, cumulative)
+	}
+}
+
+func writeLabeledValues(
+	w io.Writer, name string, values map[tunnelLabels]uint64) {
+	lines := make([]string, 0, len(values))
+	for labels, value := range values {
+		lines = append(lines,
+			fmt.Sprintf("%s{%s} %d\n", name, labels.String(), value))
+	}
+	sort.Strings(lines)
+	for _, line := range lines {
+		_, _ = io.WriteString(w, line)
+	}
+}
+
+var labelValueEscaper = strings.NewReplacer(
+	`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabelValue(value string) string {
+	return labelValueEscaper.Replace(value)
+}
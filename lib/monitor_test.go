@@ -1,8 +1,16 @@
 package lib
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"strconv"
 	"sync"
 	"testing"
@@ -44,8 +52,9 @@ func TestMonitor(t *testing.T) {
 			name := func(pfx string) string { return pfx + strconv.Itoa(i) }
 			latency := time.Millisecond * time.Duration(i)
 			tunnelMonitor := monitor.OpenTunnelMonitor(
-				testProxyRequest(i), name("Rule"), name("Downstream"),
-				name("Upstream"), nil, name("BoundAddr"), latency, cancelFuncs[i])
+				testProxyRequest(i), name("Rule"), nil, name("Downstream"),
+				name("Upstream"), nil, name("BoundAddr"), latency,
+				ConnTimings{}, cancelFuncs[i])
 			defer tunnelMonitor.Close()
 			tunnelStartWg.Done()
 			for {
@@ -139,8 +148,9 @@ func TestAppMonitorAvgLatErrCnt(t *testing.T) {
 		name := func(pfx string) string { return pfx + strconv.Itoa(i) }
 		latency := time.Millisecond * time.Duration(i)
 		tunnelMonitor := monitor.OpenTunnelMonitor(
-			testProxyRequest(i), name("Rule"), name("Downstream"),
-			name("Upstream"), nil, name("BoundAddr"), latency, func() {})
+			testProxyRequest(i), name("Rule"), nil, name("Downstream"),
+			name("Upstream"), nil, name("BoundAddr"), latency, ConnTimings{},
+			func() {})
 		defer tunnelMonitor.Close()
 	}
 	report := monitor.Report()
@@ -168,8 +178,9 @@ func TestUpstreamMonitor(t *testing.T) {
 		name := func(pfx string) string { return pfx + strconv.Itoa(i) }
 		latency := time.Millisecond * time.Duration(i)
 		tunnelMonitor := monitor.OpenTunnelMonitor(
-			testProxyRequest(i), name("Rule"), name("Downstream"),
-			upstream, nil, name("BoundAddr"), latency, func() {})
+			testProxyRequest(i), name("Rule"), nil, name("Downstream"),
+			upstream, nil, name("BoundAddr"), latency, ConnTimings{},
+			func() {})
 		defer tunnelMonitor.Close()
 	}
 	expectedErrCnts := map[string]uint32{
@@ -194,6 +205,416 @@ func TestUpstreamMonitor(t *testing.T) {
 	}
 }
 
+func TestUpstreamMonitorSuccessRate(t *testing.T) {
+	var monitor AppMonitor
+	monitor.AddSuccess("up")
+	monitor.AddSuccess("up")
+	monitor.AddError("up")
+	monitor.AddError("up")
+	monitor.SetUpstreamHealth("up", true)
+	monitor.SetUpstreamDegraded("up", true)
+	report := monitor.Report().Upstreams[0]
+	assert.Equal(t, uint32(2), report.SuccessCount)
+	assert.Equal(t, uint32(2), report.ErrorCount)
+	assert.Equal(t, uint32(4), report.RecentConns)
+	assert.Equal(t, float32(0.5), report.RecentSuccessRate)
+	assert.Equal(t, "degraded", report.Health)
+	monitor.SetUpstreamHealth("up", false)
+	assert.Equal(t, "unhealthy", monitor.Report().Upstreams[0].Health)
+}
+
+func TestOutcomeWindow(t *testing.T) {
+	var w outcomeWindow
+	start := time.Unix(1000, 0)
+	for i := 0; i < 10; i++ {
+		now := start.Add(time.Second * time.Duration(i))
+		w.Add(now, true)
+		w.Add(now, i%2 == 0)
+	}
+	end := start.Add(time.Second * 9)
+	successes, failures := w.Count(end, time.Second*4)
+	assert.Equal(t, uint32(6), successes) // the 6th to the 9th second
+	assert.Equal(t, uint32(2), failures)
+	successes, failures = w.Count(end, time.Minute)
+	assert.Equal(t, uint32(15), successes)
+	assert.Equal(t, uint32(5), failures)
+	successes, failures = w.Count(end.Add(time.Minute), time.Minute)
+	assert.Zero(t, successes+failures)
+
+	// the slots are reused once the outcomes in them are stale
+	w.Add(start.Add(time.Second*outcomeWindowSlots), false)
+	successes, failures = w.Count(
+		start.Add(time.Second*outcomeWindowSlots), time.Second)
+	assert.Equal(t, uint32(0), successes)
+	assert.Equal(t, uint32(1), failures)
+}
+
+func TestAppMonitorRuleTraffic(t *testing.T) {
+	var monitor AppMonitor
+	for i, labels := range [][2]string{
+		{"rule2", "up1"}, {"rule1", "up2"}, {"rule1", "up1"}, {"rule2", "up1"},
+	} {
+		tunnelMonitor := monitor.OpenTunnelMonitor(
+			testProxyRequest(i), labels[0], nil, "down", labels[1], nil, "",
+			time.Millisecond, ConnTimings{}, func() {})
+		tunnelMonitor.IncBytesUploaded(uint32(100 * (i + 1)))
+		tunnelMonitor.IncBytesDownloaded(uint32(1000 * (i + 1)))
+		tunnelMonitor.Close()
+	}
+
+	report := monitor.Report()
+	assert.Equal(t, []*RuleTrafficReport{
+		{"rule1", "up1", 300, 3000},
+		{"rule1", "up2", 200, 2000},
+		{"rule2", "up1", 500, 5000},
+	}, report.RuleTraffic)
+}
+
+func TestAppMonitorMetrics(t *testing.T) {
+	var monitor AppMonitor
+	resolver, err := NewCachingResolver(DNSConfig{})
+	require.NoError(t, err)
+	monitor.SetDNSResolver(resolver)
+	for i := 0; i < 4; i++ {
+		monitor.IncRequests("down")
+	}
+	monitor.AddError("up\"1")
+	for i := 0; i < 3; i++ {
+		monitor.AddSuccess("up\"1")
+	}
+	for i, latency := range []time.Duration{
+		time.Millisecond * 3, time.Millisecond * 30, time.Second * 30} {
+		tunnelMonitor := monitor.OpenTunnelMonitor(
+			testProxyRequest(i), "rule", nil, "down", "up\"1", nil, "",
+			latency, ConnTimings{}, func() {})
+		tunnelMonitor.IncBytesUploaded(100)
+		tunnelMonitor.IncBytesDownloaded(200)
+		if i == 0 {
+			tunnelMonitor.Close()
+		} else {
+			defer tunnelMonitor.Close()
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	monitor.MetricsHandler().ServeHTTP(
+		rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	metrics := rec.Body.String()
+	labels := `downstream="down",rule="rule",upstream="up\"1"`
+	for _, line := range []string{
+		"# TYPE thestral_requests_total counter",
+		`thestral_requests_total{downstream="down"} 4`,
+		"thestral_active_tunnels{" + labels + "} 2",
+		`thestral_tunnels_closed_total{reason="canceled"} 1`,
+		`thestral_errors_total{upstream="up\"1"} 1`,
+		`thestral_successes_total{upstream="up\"1"} 3`,
+		`thestral_recent_success_ratio{upstream="up\"1"} 0.75`,
+		`thestral_uploaded_bytes_total{upstream="up\"1"} 300`,
+		`thestral_downloaded_bytes_total{upstream="up\"1"} 600`,
+		"# TYPE thestral_connect_latency_seconds histogram",
+		`thestral_connect_latency_seconds_bucket{upstream="up\"1",le="0.005"} 1`,
+		`thestral_connect_latency_seconds_bucket{upstream="up\"1",le="0.05"} 2`,
+		`thestral_connect_latency_seconds_bucket{upstream="up\"1",le="10"} 2`,
+		`thestral_connect_latency_seconds_bucket{upstream="up\"1",le="+Inf"} 3`,
+		`thestral_connect_latency_seconds_sum{upstream="up\"1"} 30.033`,
+		`thestral_connect_latency_seconds_count{upstream="up\"1"} 3`,
+		"thestral_dns_cache_misses_total 0",
+		"# TYPE thestral_buf_pool_misses_total counter",
+	} {
+		assert.Contains(t, metrics, line+"\n")
+	}
+}
+
+func TestAppMonitorExpvar(t *testing.T) {
+	type vars struct {
+		Thestral struct {
+			ActiveTunnels   int               `json:"active_tunnels"`
+			BytesUploaded   uint64            `json:"bytes_uploaded"`
+			BytesDownloaded uint64            `json:"bytes_downloaded"`
+			UpstreamErrors  map[string]uint32 `json:"upstream_errors"`
+			Goroutines      int               `json:"goroutines"`
+		} `json:"thestral"`
+		MemStats map[string]interface{} `json:"memstats"`
+	}
+	getVars := func(path string) (v vars) {
+		rec := httptest.NewRecorder()
+		http.DefaultServeMux.ServeHTTP(rec, httptest.NewRequest(
+			http.MethodGet, "/debug/monitor/"+path+"/vars", nil))
+		require.Equal(t, http.StatusOK, rec.Code)
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &v))
+		return
+	}
+
+	var monitor AppMonitor
+	monitor.Start("test_monitor_TestAppMonitorExpvar")
+	monitor.AddError("up")
+	tunnelMonitor := monitor.OpenTunnelMonitor(
+		testProxyRequest(0), "rule", nil, "down", "up", nil, "", 0,
+		ConnTimings{}, func() {})
+	defer tunnelMonitor.Close()
+	tunnelMonitor.IncBytesUploaded(100)
+	tunnelMonitor.IncBytesDownloaded(200)
+
+	v := getVars("test_monitor_TestAppMonitorExpvar")
+	assert.Equal(t, 1, v.Thestral.ActiveTunnels)
+	assert.EqualValues(t, 100, v.Thestral.BytesUploaded)
+	assert.EqualValues(t, 200, v.Thestral.BytesDownloaded)
+	assert.Equal(t, map[string]uint32{"up": 1}, v.Thestral.UpstreamErrors)
+	assert.True(t, v.Thestral.Goroutines > 0)
+	assert.NotEmpty(t, v.MemStats)
+
+	// each monitor serves its own variables
+	var monitor2 AppMonitor
+	monitor2.Start("test_monitor_TestAppMonitorExpvar2")
+	v = getVars("test_monitor_TestAppMonitorExpvar2")
+	assert.Equal(t, 0, v.Thestral.ActiveTunnels)
+	assert.Empty(t, v.Thestral.UpstreamErrors)
+	v = getVars("test_monitor_TestAppMonitorExpvar")
+	assert.Equal(t, 1, v.Thestral.ActiveTunnels)
+
+	// not exposed by the default HTTP server outside of the monitor path
+	rec := httptest.NewRecorder()
+	http.DefaultServeMux.ServeHTTP(rec, httptest.NewRequest(
+		http.MethodGet, "/debug/vars", nil))
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+func TestLatencyHistogramQuantile(t *testing.T) {
+	var h latencyHistogram
+	assert.Equal(t, time.Duration(0), h.Quantile(0.5))
+	for i := 0; i < 90; i++ {
+		h.Add(time.Millisecond * 60) // (50ms, 100ms]
+	}
+	for i := 0; i < 9; i++ {
+		h.Add(time.Millisecond * 300) // (250ms, 500ms]
+	}
+	h.Add(time.Minute) // +Inf
+
+	assert.Equal(t, time.Millisecond*75, h.Quantile(0.45))
+	assert.Equal(t, time.Millisecond*100, h.Quantile(0.9))
+	assert.Equal(t, time.Millisecond*500, h.Quantile(0.99))
+	assert.Equal(t, time.Second*10, h.Quantile(1))
+
+	var monitor AppMonitor
+	for i := 0; i < 10; i++ {
+		monitor.OpenTunnelMonitor(
+			testProxyRequest(i), "", nil, "", "up", nil, "",
+			time.Millisecond*20, ConnTimings{}, func() {}).Close()
+	}
+	report := monitor.Report().Upstreams[0]
+	assert.InEpsilon(t, 17.5, report.ConnLatencyP50Ms, 1e-3)
+	assert.InEpsilon(t, 24.85, report.ConnLatencyP99Ms, 1e-3)
+}
+
+func TestAppMonitorTunnelsAPI(t *testing.T) {
+	var monitor AppMonitor
+	serve := func(method string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		monitor.serveTunnelsAPI(rec, httptest.NewRequest(
+			method, "/debug/monitor/api/tunnels", nil))
+		return rec
+	}
+	assert.Equal(t, "[]", serve(http.MethodGet).Body.String())
+
+	for i := 0; i < 2; i++ {
+		tunnelMonitor := monitor.OpenTunnelMonitor(
+			testProxyRequest(i), "rule", nil, "down", "up"+strconv.Itoa(i), nil,
+			"", time.Millisecond*time.Duration(i+1), ConnTimings{},
+			func() {})
+		tunnelMonitor.IncBytesUploaded(uint32(i + 10))
+		defer tunnelMonitor.Close()
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	rec := serve(http.MethodGet)
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+	var tunnels []TunnelMonitorReport
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &tunnels))
+	require.Len(t, tunnels, 2)
+	assert.Equal(t, "1", tunnels[0].RequestID) // the latest first
+	assert.Equal(t, "up1", tunnels[0].Upstream)
+	assert.Equal(t, "rule", tunnels[0].Rule)
+	assert.Equal(t, testProxyRequest(1).PeerAddr(), tunnels[0].ClientAddr)
+	assert.Equal(t,
+		testProxyRequest(1).TargetAddr().String(), tunnels[0].TargetAddr)
+	assert.Equal(t, uint64(11), tunnels[0].BytesUploaded)
+	assert.InEpsilon(t, 2, tunnels[0].ConnLatencyMs, 1e-3)
+	assert.True(t, tunnels[1].ElapsedTimeSecs > tunnels[0].ElapsedTimeSecs)
+
+	assert.Equal(t,
+		http.StatusMethodNotAllowed, serve(http.MethodPost).Code)
+}
+
+func TestAppMonitorAuth(t *testing.T) {
+	var monitor AppMonitor
+	assert.Error(t, monitor.SetAuth(MonitorAuthConfig{}))
+	assert.Error(t, monitor.SetAuth(MonitorAuthConfig{Username: "admin"}))
+	require.NoError(t, monitor.SetAuth(MonitorAuthConfig{
+		Username: "admin", Password: "secret", Token: "token"}))
+	mux := http.NewServeMux()
+	monitor.registerRPCHandlers(mux, "/")
+	mux.Handle("/metrics", monitor.MetricsHandler())
+
+	serve := func(path string, setAuth func(r *http.Request)) int {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		if setAuth != nil {
+			setAuth(req)
+		}
+		mux.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	basic := func(user, pass string) func(r *http.Request) {
+		return func(r *http.Request) { r.SetBasicAuth(user, pass) }
+	}
+	bearer := func(token string) func(r *http.Request) {
+		return func(r *http.Request) {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+	}
+	for _, path := range []string{"/debug/monitor/", "/debug/monitor/vars",
+		"/debug/monitor/api/tunnels", "/metrics"} {
+		assert.Equal(t, http.StatusUnauthorized, serve(path, nil), path)
+		assert.Equal(t, http.StatusUnauthorized,
+			serve(path, basic("admin", "wrong")), path)
+		assert.Equal(t, http.StatusUnauthorized,
+			serve(path, bearer("wrong")), path)
+		assert.Equal(t, http.StatusOK,
+			serve(path, basic("admin", "secret")), path)
+		assert.Equal(t, http.StatusOK, serve(path, bearer("token")), path)
+	}
+	assert.Equal(t, http.StatusUnauthorized,
+		serve("/debug/monitor/tunnel/1", nil))
+	assert.Equal(t, http.StatusNotFound,
+		serve("/debug/monitor/tunnel/1", bearer("token")))
+}
+
+func TestAppMonitorCloseTunnelAPI(t *testing.T) {
+	var monitor AppMonitor
+	closed := make(chan struct{})
+	tunnelMonitor := monitor.OpenTunnelMonitor(
+		testProxyRequest(42), "", nil, "", "", nil, "", 0, ConnTimings{},
+		func() { close(closed) })
+	defer tunnelMonitor.Close()
+
+	handler := http.StripPrefix(
+		"/api/tunnels/", http.HandlerFunc(monitor.serveCloseTunnelAPI))
+	serve := func(method, path string) int {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(method, path, nil))
+		return rec.Code
+	}
+	assert.Equal(t, http.StatusNotFound,
+		serve(http.MethodPost, "/api/tunnels/43/close"))
+	assert.Equal(t, http.StatusNotFound,
+		serve(http.MethodPost, "/api/tunnels/42/open"))
+	assert.Equal(t, http.StatusMethodNotAllowed,
+		serve(http.MethodGet, "/api/tunnels/42/close"))
+	select {
+	case <-closed:
+		t.Fatal("tunnel closed unexpectedly")
+	default:
+	}
+
+	assert.Equal(t, http.StatusNoContent,
+		serve(http.MethodPost, "/api/tunnels/42/close"))
+	select {
+	case <-closed:
+	default:
+		t.Fatal("tunnel not closed")
+	}
+	assert.Equal(t, TunnelAdminKilled, tunnelMonitor.Report().CloseReason)
+}
+
+func TestAppMonitorClosedTunnels(t *testing.T) {
+	var monitor AppMonitor
+	for i, reasons := range [][]TunnelCloseReason{
+		{TunnelClientClosed},
+		{TunnelIdleTimeout, TunnelError}, // only the first one is kept
+		{TunnelClientClosed, TunnelServerClosed},
+		nil,
+	} {
+		tunnelMonitor := monitor.OpenTunnelMonitor(
+			testProxyRequest(i), "", nil, "", "", nil, "", 0, ConnTimings{},
+			func() {})
+		assert.Empty(t, tunnelMonitor.Report().CloseReason)
+		for _, reason := range reasons {
+			tunnelMonitor.SetCloseReason(reason)
+		}
+		tunnelMonitor.Close()
+	}
+	assert.Equal(t, map[TunnelCloseReason]uint64{
+		TunnelClientClosed: 2,
+		TunnelIdleTimeout:  1,
+		TunnelCanceled:     1,
+	}, monitor.Report().ClosedTunnels)
+}
+
+func TestTunnelMonitorTags(t *testing.T) {
+	var monitor AppMonitor
+	tunnelMonitor := monitor.OpenTunnelMonitor(testProxyRequest(0), "rule",
+		[]string{"metered", "logged"}, "", "", nil, "", 0, ConnTimings{},
+		func() {})
+	defer tunnelMonitor.Close()
+	assert.True(t, tunnelMonitor.HasTag("logged"))
+	assert.False(t, tunnelMonitor.HasTag("qos"))
+	report := tunnelMonitor.Report()
+	assert.Equal(t, []string{"metered", "logged"}, report.Tags)
+	assert.Contains(t, fmt.Sprintf("%v", report), "Tags: metered, logged\n")
+}
+
+func TestTunnelMonitorConnTimings(t *testing.T) {
+	var monitor AppMonitor
+	tunnelMonitor := monitor.OpenTunnelMonitor(testProxyRequest(0), "rule",
+		nil, "", "", nil, "", time.Millisecond*35, ConnTimings{
+			Resolve:   time.Millisecond * 10,
+			Dial:      time.Millisecond * 5,
+			Handshake: time.Millisecond * 20,
+		}, func() {})
+	defer tunnelMonitor.Close()
+	report := tunnelMonitor.Report()
+	assert.EqualValues(t, 35, report.ConnLatencyMs)
+	assert.EqualValues(t, 10, report.ResolveLatencyMs)
+	assert.EqualValues(t, 5, report.DialLatencyMs)
+	assert.EqualValues(t, 20, report.HandshakeLatencyMs)
+	assert.Contains(t, fmt.Sprintf("%v", report),
+		"  Resolve: 10.00 ms, Dial: 5.00 ms, Handshake: 20.00 ms\n")
+}
+
+func TestTunnelRateSampler(t *testing.T) {
+	start := time.Now()
+	sampler := rateSampler{time: start}
+	up, down, secs := sampler.Sample(start.Add(time.Millisecond*500), 10, 20)
+	assert.Zero(t, up)
+	assert.Zero(t, down)
+	assert.Zero(t, secs)
+
+	up, down, secs = sampler.Sample(start.Add(time.Second*2), 2000, 4000)
+	assert.EqualValues(t, 1000, up)
+	assert.EqualValues(t, 2000, down)
+	assert.EqualValues(t, 2, secs)
+	// the same rates within the tunnelRateMinWindow
+	up, down, _ = sampler.Sample(start.Add(time.Millisecond*2500), 9000, 9000)
+	assert.EqualValues(t, 1000, up)
+	assert.EqualValues(t, 2000, down)
+	up, down, secs = sampler.Sample(start.Add(time.Second*6), 6000, 4000)
+	assert.EqualValues(t, 1000, up)
+	assert.EqualValues(t, 0, down)
+	assert.EqualValues(t, 4, secs)
+
+	var monitor AppMonitor
+	tunnelMonitor := monitor.OpenTunnelMonitor(testProxyRequest(0), "rule",
+		nil, "", "", nil, "", 0, ConnTimings{}, func() {})
+	defer tunnelMonitor.Close()
+	tunnelMonitor.rates.time = start.Add(-time.Second * 2)
+	tunnelMonitor.IncBytesUploaded(4096)
+	report := tunnelMonitor.Report()
+	assert.InEpsilon(t, 2048, report.CurrentUploadRate, 0.1)
+	assert.Zero(t, report.CurrentDownloadRate)
+	assert.Contains(t, fmt.Sprintf("%v", report), "CurrentRate: ")
+}
+
 type testProxyRequest int
 
 func (r testProxyRequest) GetPeerIdentifiers() ([]*PeerIdentifier, error) {
@@ -221,5 +642,65 @@ func (r testProxyRequest) ID() string {
 }
 
 func (r testProxyRequest) Logger() *zap.SugaredLogger {
-	panic("not implemented")
+	return zap.NewNop().Sugar()
+}
+
+func TestAppMonitorKCPStats(t *testing.T) {
+	_, err := NewKCPTransport(KCPConfig{})
+	require.NoError(t, err)
+
+	var monitor AppMonitor
+	report := monitor.Report()
+	require.NotNil(t, report.KCP)
+	assert.True(t, report.KCP.RetransmitRate >= 0)
+	assert.True(t, report.KCP.LossRate >= 0)
+}
+
+func TestAppMonitorUnixSocket(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "thestral2_TestAppMonitorUnixSocket")
+	require.NoError(t, err)
+	defer func() { _ = os.RemoveAll(tmpDir) }()
+	sockPath := filepath.Join(tmpDir, "monitor.sock")
+	// a stale socket left by a previous process
+	stale, err := net.Listen("unix", sockPath)
+	require.NoError(t, err)
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	require.NoError(t, stale.Close())
+
+	var monitor AppMonitor
+	require.NoError(t, monitor.Start("unix:"+sockPath))
+	fi, err := os.Stat(sockPath)
+	require.NoError(t, err)
+	assert.NotZero(t, fi.Mode()&os.ModeSocket)
+	assert.Equal(t, os.FileMode(0600), fi.Mode().Perm())
+	entries, err := ioutil.ReadDir(tmpDir) // the private directory is removed
+	require.NoError(t, err)
+	assert.Len(t, entries, 1)
+
+	cli := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", sockPath)
+		}}}
+	resp, err := cli.Get("http://monitor/debug/monitor/")
+	require.NoError(t, err)
+	var report AppMonitorReport
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&report))
+	_ = resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	// not exposed by the default HTTP server
+	rec := httptest.NewRecorder()
+	http.DefaultServeMux.ServeHTTP(rec, httptest.NewRequest(
+		http.MethodGet, "/debug/monitor/api/tunnels", nil))
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+
+	monitor.Stop()
+	_, err = os.Stat(sockPath)
+	assert.True(t, os.IsNotExist(err))
+
+	assert.Error(t, (&AppMonitor{}).Start("unix:"))
+	notSocket := filepath.Join(tmpDir, "file")
+	require.NoError(t, ioutil.WriteFile(notSocket, nil, 0600))
+	assert.Error(t, (&AppMonitor{}).Start("unix:"+notSocket))
+	assert.Error(t, (&AppMonitor{}).Start(
+		"unix:"+filepath.Join(tmpDir, "nonexistent", "monitor.sock")))
 }
@@ -0,0 +1,165 @@
+package lib
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+const (
+	minAcceptRetryDelay = time.Millisecond * 5
+	maxAcceptRetryDelay = time.Second
+)
+
+// parseListenAddrs parses the 'address' setting of a proxy server, which is
+// either an address or a list of them.
+func parseListenAddrs(v interface{}) ([]string, error) {
+	switch value := v.(type) {
+	case string:
+		return []string{value}, nil
+	case []interface{}:
+		addrs := make([]string, len(value))
+		for i, item := range value {
+			addr, ok := item.(string)
+			if !ok || addr == "" {
+				return nil, errors.Errorf("invalid value for 'address': %v", v)
+			}
+			addrs[i] = addr
+		}
+		return addrs, nil
+	default:
+		return nil, errors.Errorf("invalid value for 'address': %v", v)
+	}
+}
+
+// listenAll listens on all the given addresses with the transport, and merges
+// the connections accepted into a single listener.
+func listenAll(transport Transport, addrs []string) (net.Listener, error) {
+	if len(addrs) == 1 {
+		return transport.Listen(addrs[0])
+	}
+	var listeners []net.Listener
+	for _, addr := range addrs {
+		listener, err := transport.Listen(addr)
+		if err != nil {
+			for _, l := range listeners {
+				_ = l.Close()
+			}
+			return nil, err
+		}
+		listeners = append(listeners, listener)
+	}
+	return newMultiListener(listeners), nil
+}
+
+// isTemporaryError tells whether an error (possibly wrapped) is a temporary
+// one, e.g. running out of file descriptors, after which the operation may
+// succeed if retried.
+func isTemporaryError(err error) bool {
+	te, ok := errors.Cause(err).(interface{ Temporary() bool })
+	return ok && te.Temporary()
+}
+
+// errorClass returns the type of the cause of an error for logging.
+func errorClass(err error) string {
+	return fmt.Sprintf("%T", errors.Cause(err))
+}
+
+// acceptRetrying accepts a connection from the listener. It backs off and
+// retries on temporary errors so that they neither spin the accept loop nor
+// stop it, and returns the permanent ones only, e.g. the listener is closed.
+func acceptRetrying(
+	listener net.Listener, log *zap.SugaredLogger) (net.Conn, error) {
+	var delay time.Duration
+	for {
+		conn, err := listener.Accept()
+		if err == nil || !isTemporaryError(err) {
+			return conn, err
+		}
+		if delay *= 2; delay == 0 {
+			delay = minAcceptRetryDelay
+		} else if delay > maxAcceptRetryDelay {
+			delay = maxAcceptRetryDelay
+		}
+		log.Warnw("temporary accept error, retrying",
+			"error", err, "class", errorClass(err), "delay", delay)
+		time.Sleep(delay)
+	}
+}
+
+// newMultiListener merges the connections accepted by the listeners.
+func newMultiListener(listeners []net.Listener) *multiListener {
+	m := &multiListener{
+		listeners: listeners,
+		acceptCh:  make(chan acceptResult),
+		closed:    make(chan struct{}),
+	}
+	for _, listener := range m.listeners {
+		go m.acceptLoop(listener)
+	}
+	return m
+}
+
+// multiListener is a net.Listener accepting connections from multiple ones.
+// An error from any of them is returned by Accept, and the one failed keeps
+// accepting if the error is a temporary one.
+type multiListener struct {
+	listeners []net.Listener
+	acceptCh  chan acceptResult
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+type acceptResult struct {
+	conn net.Conn
+	err  error
+}
+
+func (m *multiListener) acceptLoop(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		select {
+		case m.acceptCh <- acceptResult{conn, err}:
+		case <-m.closed:
+			if conn != nil {
+				_ = conn.Close()
+			}
+			return
+		}
+		if err != nil && !isTemporaryError(err) {
+			return
+		}
+	}
+}
+
+// Accept waits for and returns the next connection from any of the listeners.
+func (m *multiListener) Accept() (net.Conn, error) {
+	select {
+	case result := <-m.acceptCh:
+		return result.conn, result.err
+	case <-m.closed:
+		return nil, errors.New("listener closed")
+	}
+}
+
+// Close closes all the listeners.
+func (m *multiListener) Close() (err error) {
+	m.closeOnce.Do(func() {
+		close(m.closed)
+		for _, listener := range m.listeners {
+			if e := listener.Close(); e != nil && err == nil {
+				err = e
+			}
+		}
+	})
+	return
+}
+
+// Addr returns the address of the first listener.
+func (m *multiListener) Addr() net.Addr {
+	return m.listeners[0].Addr()
+}
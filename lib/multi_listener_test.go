@@ -0,0 +1,165 @@
+package lib
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+type tempAcceptError struct{}
+
+func (tempAcceptError) Error() string   { return "too many open files" }
+func (tempAcceptError) Temporary() bool { return true }
+func (tempAcceptError) Timeout() bool   { return false }
+
+// scriptedListener returns the errors in order from Accept, and the last one
+// repeatedly afterwards.
+type scriptedListener struct {
+	errs  []error
+	calls int
+}
+
+func (l *scriptedListener) Accept() (net.Conn, error) {
+	err := l.errs[len(l.errs)-1]
+	if l.calls < len(l.errs) {
+		err = l.errs[l.calls]
+	}
+	l.calls++
+	return nil, err
+}
+
+func (l *scriptedListener) Close() error   { return nil }
+func (l *scriptedListener) Addr() net.Addr { return &net.TCPAddr{} }
+
+type scriptedTransport struct {
+	listener net.Listener
+}
+
+func (t scriptedTransport) Dial(
+	ctx context.Context, address string) (net.Conn, error) {
+	return nil, errors.New("not supported")
+}
+
+func (t scriptedTransport) Listen(address string) (net.Listener, error) {
+	return t.listener, nil
+}
+
+func TestParseListenAddrs(t *testing.T) {
+	addrs, err := parseListenAddrs("127.0.0.1:1080")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"127.0.0.1:1080"}, addrs)
+	addrs, err = parseListenAddrs(
+		[]interface{}{"127.0.0.1:1080", "[::1]:1080"})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"127.0.0.1:1080", "[::1]:1080"}, addrs)
+
+	for _, v := range []interface{}{
+		1080, []interface{}{"127.0.0.1:1080", 1080}, []interface{}{""},
+	} {
+		_, err = parseListenAddrs(v)
+		assert.Error(t, err, "%v", v)
+	}
+}
+
+func TestListenAll(t *testing.T) {
+	listener, err := listenAll(
+		TCPTransport{}, []string{"127.0.0.1:0", "127.0.0.1:0"})
+	require.NoError(t, err)
+	m := listener.(*multiListener)
+	require.Len(t, m.listeners, 2)
+	assert.Equal(t, m.listeners[0].Addr(), m.Addr())
+
+	for _, l := range m.listeners {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		require.NoError(t, err)
+		_, err = conn.Write([]byte("x"))
+		require.NoError(t, err)
+		accepted, err := m.Accept()
+		require.NoError(t, err)
+		buf := make([]byte, 1)
+		_, err = io.ReadFull(accepted, buf)
+		assert.NoError(t, err)
+		assert.Equal(t, conn.LocalAddr().String(),
+			accepted.RemoteAddr().String())
+		_ = accepted.Close()
+		_ = conn.Close()
+	}
+
+	assert.NoError(t, m.Close())
+	_, err = m.Accept()
+	assert.Error(t, err)
+	for _, l := range m.listeners {
+		_, err = net.Dial("tcp", l.Addr().String())
+		assert.Error(t, err)
+	}
+
+	// fails if any of the addresses is unavailable
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close() // nolint: errcheck
+	_, err = listenAll(
+		TCPTransport{}, []string{"127.0.0.1:0", l.Addr().String()})
+	assert.Error(t, err)
+}
+
+func TestAcceptRetrying(t *testing.T) {
+	core, logs := observer.New(zap.WarnLevel)
+	l := &scriptedListener{errs: []error{
+		tempAcceptError{}, errors.Wrap(tempAcceptError{}, "wrapped"),
+		io.ErrClosedPipe}}
+	start := time.Now()
+	_, err := acceptRetrying(l, zap.New(core).Sugar())
+	assert.Equal(t, io.ErrClosedPipe, err)
+	assert.Equal(t, 3, l.calls)
+	assert.True(t, time.Since(start) >= minAcceptRetryDelay*3)
+
+	entries := logs.FilterMessage("temporary accept error, retrying").All()
+	if assert.Len(t, entries, 2) {
+		assert.Equal(t, "lib.tempAcceptError", entries[0].ContextMap()["class"])
+		assert.Equal(t, minAcceptRetryDelay*2,
+			entries[1].ContextMap()["delay"])
+	}
+}
+
+func TestMultiListenerTemporaryError(t *testing.T) {
+	m := newMultiListener([]net.Listener{&scriptedListener{
+		errs: []error{tempAcceptError{}, io.ErrClosedPipe}}})
+	defer m.Close() // nolint: errcheck
+	_, err := m.Accept()
+	assert.Equal(t, tempAcceptError{}, err)
+	// still accepting after the temporary error
+	_, err = m.Accept()
+	assert.Equal(t, io.ErrClosedPipe, err)
+}
+
+func TestServerAcceptErrors(t *testing.T) {
+	core, logs := observer.New(zap.InfoLevel)
+	l := &scriptedListener{errs: []error{
+		tempAcceptError{}, tempAcceptError{}, io.ErrClosedPipe}}
+	svr, err := newSOCKS5Server(zap.New(core).Sugar(),
+		scriptedTransport{l}, []string{"scripted"}, false, nil, time.Second)
+	require.NoError(t, err)
+	_, err = svr.Start()
+	require.NoError(t, err)
+
+	for i := 0; i < 100 && logs.FilterMessage(
+		"SOCKS5 server exited").Len() == 0; i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+	assert.Equal(t, 1, logs.FilterMessage("SOCKS5 server exited").Len())
+	assert.Equal(t, 2,
+		logs.FilterMessage("temporary accept error, retrying").Len())
+	entries := logs.FilterMessage("permanent accept error").All()
+	if assert.Len(t, entries, 1) {
+		assert.Equal(t, "*errors.errorString", entries[0].ContextMap()["class"])
+	}
+	svr.Stop()
+}
@@ -0,0 +1,301 @@
+package lib
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultObfsMaxPadding = 255
+	maxObfsHTTPHeaderSize = 8 * 1024
+	obfsHTTPUserAgent     = "Mozilla/5.0 (Windows NT 10.0; Win64; x64) " +
+		"AppleWebKit/537.36 (KHTML, like Gecko) " +
+		"Chrome/73.0.3683.86 Safari/537.36"
+)
+
+// WrapTransObfs wraps a Transport with an obfuscation layer, which makes the
+// traffic look less like a proxy to the DPI. The supported modes are:
+//
+// http_simple: the streams start with a fake HTTP request and response.
+//
+// random_padding: each Write is sent as a frame along with some random bytes.
+func WrapTransObfs(inner Transport, config ObfsConfig) (Transport, error) {
+	w := &obfsTransWrapper{inner: inner, mode: config.Mode, host: config.Host}
+	switch config.Mode {
+	case "http_simple":
+		if config.MinPadding != 0 || config.MaxPadding != 0 {
+			return nil, errors.New(
+				"'http_simple' obfs does not support padding")
+		}
+	case "random_padding":
+		if config.Host != "" {
+			return nil, errors.New(
+				"'random_padding' obfs does not support 'host'")
+		}
+		w.minPad, w.maxPad = config.MinPadding, config.MaxPadding
+		if w.maxPad == 0 {
+			w.maxPad = defaultObfsMaxPadding
+		}
+		if w.minPad < 0 || w.maxPad < w.minPad {
+			return nil, errors.New(
+				"obfs padding should satisfy 0 <= min_padding <= max_padding")
+		}
+	default:
+		return nil, errors.New("unknown obfs mode: " + config.Mode)
+	}
+	return w, nil
+}
+
+type obfsTransWrapper struct {
+	inner          Transport
+	mode           string
+	host           string // overrides the address in the Host header
+	minPad, maxPad int
+}
+
+// Close closes the inner transport, see closeTransport.
+func (w *obfsTransWrapper) Close() error {
+	return closeTransport(w.inner)
+}
+
+func (w *obfsTransWrapper) Dial(
+	ctx context.Context, address string) (net.Conn, error) {
+	conn, err := w.inner.Dial(ctx, address)
+	if err == nil {
+		host := address
+		if w.host != "" {
+			host = w.host
+		}
+		conn = w.wrapConn(conn, true, host)
+	}
+	return conn, err
+}
+
+func (w *obfsTransWrapper) Listen(address string) (net.Listener, error) {
+	listener, err := w.inner.Listen(address)
+	if err == nil {
+		listener = &obfsListenerWrapper{listener, w}
+	}
+	return listener, err
+}
+
+func (w *obfsTransWrapper) wrapConn(
+	inner net.Conn, client bool, host string) net.Conn {
+	var conn net.Conn
+	switch w.mode {
+	case "http_simple":
+		conn = newHTTPSimpleConn(inner, client, host)
+	default: // random_padding
+		conn = &paddingConn{
+			Conn:   inner,
+			reader: bufio.NewReader(inner),
+			minPad: w.minPad,
+			maxPad: w.maxPad,
+		}
+	}
+	if withPIDs, ok := inner.(WithPeerIdentifiers); ok {
+		return &obfsConnWithPeerIDs{conn, withPIDs}
+	}
+	return conn
+}
+
+type obfsListenerWrapper struct {
+	net.Listener
+	trans *obfsTransWrapper
+}
+
+func (w *obfsListenerWrapper) Accept() (net.Conn, error) {
+	conn, err := w.Listener.Accept()
+	if err == nil {
+		conn = w.trans.wrapConn(conn, false, "")
+	}
+	return conn, err
+}
+
+type obfsConnWithPeerIDs struct {
+	net.Conn
+	inner WithPeerIdentifiers
+}
+
+func (w *obfsConnWithPeerIDs) GetPeerIdentifiers() (
+	[]*PeerIdentifier, error) {
+	return w.inner.GetPeerIdentifiers()
+}
+
+// httpSimpleConn sends a fake HTTP header along with the first Write, and
+// skips the one sent by the peer before the first Read. The client sends a
+// GET request, and the server responds with 200.
+type httpSimpleConn struct {
+	net.Conn
+	client     bool
+	reader     *bufio.Reader
+	header     []byte // to be sent, nil if already sent
+	headerRead bool
+}
+
+func newHTTPSimpleConn(
+	inner net.Conn, client bool, host string) *httpSimpleConn {
+	var buf bytes.Buffer
+	if client {
+		path := make([]byte, 8)
+		_, _ = rand.Read(path)
+		_, _ = fmt.Fprintf(&buf, "GET /%s HTTP/1.1\r\nHost: %s\r\n"+
+			"User-Agent: %s\r\nAccept: */*\r\n"+
+			"Accept-Encoding: gzip, deflate\r\nConnection: keep-alive\r\n\r\n",
+			hex.EncodeToString(path), host, obfsHTTPUserAgent)
+	} else {
+		_, _ = fmt.Fprintf(&buf, "HTTP/1.1 200 OK\r\nServer: nginx\r\n"+
+			"Date: %s\r\nContent-Type: application/octet-stream\r\n"+
+			"Connection: keep-alive\r\n\r\n",
+			time.Now().UTC().Format(http.TimeFormat))
+	}
+	return &httpSimpleConn{
+		Conn:   inner,
+		client: client,
+		reader: bufio.NewReader(inner),
+		header: buf.Bytes(),
+	}
+}
+
+func (c *httpSimpleConn) Read(b []byte) (int, error) {
+	if !c.headerRead {
+		if err := c.readHeader(); err != nil {
+			return 0, err
+		}
+		c.headerRead = true
+	}
+	return c.reader.Read(b)
+}
+
+func (c *httpSimpleConn) readHeader() error {
+	size := 0
+	for lineNo := 0; ; lineNo++ {
+		line, err := c.reader.ReadSlice('\n')
+		if err == bufio.ErrBufferFull {
+			return errors.New("obfs header line too long")
+		} else if err != nil {
+			if err == io.EOF && (lineNo > 0 || len(line) > 0) {
+				err = io.ErrUnexpectedEOF
+			}
+			return err // a clean EOF is only allowed before the header
+		}
+		if size += len(line); size > maxObfsHTTPHeaderSize {
+			return errors.New("obfs header too large")
+		}
+		if lineNo == 0 {
+			valid := bytes.HasSuffix(line, []byte(" HTTP/1.1\r\n"))
+			if c.client {
+				valid = bytes.HasPrefix(line, []byte("HTTP/1.1 "))
+			}
+			if !valid {
+				return errors.Errorf("invalid obfs header: %q", line)
+			}
+		} else if len(line) == 2 && line[0] == '\r' {
+			return nil // end of the header
+		}
+	}
+}
+
+func (c *httpSimpleConn) Write(b []byte) (int, error) {
+	if c.header == nil {
+		return c.Conn.Write(b)
+	}
+	if _, err := c.Conn.Write(append(c.header, b...)); err != nil {
+		return 0, err
+	}
+	c.header = nil
+	return len(b), nil
+}
+
+// paddingConn sends each Write as a frame, which starts with the length of
+// the payload and that of the padding as uvarints, followed by the payload
+// and the random padding bytes.
+type paddingConn struct {
+	net.Conn
+	reader         *bufio.Reader
+	minPad, maxPad int
+	frameBuf       []byte
+	dataLeft       uint64 // remaining bytes of the current payload
+	padLeft        uint64 // remaining bytes of the current padding
+}
+
+func (c *paddingConn) Read(b []byte) (n int, err error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+	for {
+		switch {
+		case c.dataLeft > 0:
+			if uint64(len(b)) > c.dataLeft {
+				b = b[:c.dataLeft]
+			}
+			n, err = c.reader.Read(b)
+			c.dataLeft -= uint64(n)
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return
+		case c.padLeft > 0:
+			var skipped int64
+			skipped, err = io.CopyN(ioutil.Discard, c.reader, int64(c.padLeft))
+			c.padLeft -= uint64(skipped)
+			if err != nil {
+				if err == io.EOF {
+					err = io.ErrUnexpectedEOF
+				}
+				return
+			}
+		default:
+			if err = c.readFrameHeader(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (c *paddingConn) readFrameHeader() error {
+	if _, err := c.reader.Peek(1); err != nil {
+		return err // a clean EOF is only allowed here
+	}
+	var err error
+	if c.dataLeft, err = binary.ReadUvarint(c.reader); err == nil {
+		c.padLeft, err = binary.ReadUvarint(c.reader)
+	}
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+func (c *paddingConn) Write(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+
+	padLen := c.minPad + rand.Intn(c.maxPad-c.minPad+1)
+	var hdr [2 * binary.MaxVarintLen64]byte
+	hdrLen := binary.PutUvarint(hdr[:], uint64(len(b)))
+	hdrLen += binary.PutUvarint(hdr[hdrLen:], uint64(padLen))
+	c.frameBuf = append(append(c.frameBuf[:0], hdr[:hdrLen]...), b...)
+	frameLen := len(c.frameBuf)
+	for i := 0; i < padLen; i++ {
+		c.frameBuf = append(c.frameBuf, 0)
+	}
+	_, _ = rand.Read(c.frameBuf[frameLen:])
+	if _, err := c.Conn.Write(c.frameBuf); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
@@ -0,0 +1,82 @@
+package lib
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestObfsTransport(t *testing.T) {
+	obfsConfigs := []*ObfsConfig{
+		{Mode: "http_simple", Host: "www.example.com"},
+		{Mode: "random_padding"},
+		{Mode: "random_padding", MinPadding: 100, MaxPadding: 100},
+	}
+	for _, obfs := range obfsConfigs {
+		for _, kcp := range []bool{false, true} {
+			name := fmt.Sprintf("mode-%s/kcp-%v", obfs.Mode, kcp)
+			t.Run(name, func(t *testing.T) {
+				svrConfig := &TransportConfig{
+					Obfs: obfs, Compression: "snappy", TLS: gTLSServerConfig}
+				cliConfig := &TransportConfig{
+					Obfs: obfs, Compression: "snappy", TLS: gTLSClientConfig}
+				if kcp {
+					svrConfig.KCP = gKCPServerConfig
+					cliConfig.KCP = gKCPClientConfig
+				}
+				doTestWithTransConf(t, svrConfig, cliConfig)
+			})
+		}
+	}
+}
+
+func TestObfsPartialReads(t *testing.T) {
+	for _, config := range []ObfsConfig{
+		{Mode: "http_simple"}, {Mode: "random_padding"},
+	} {
+		trans, err := WrapTransObfs(TCPTransport{}, config)
+		require.NoError(t, err)
+		w := trans.(*obfsTransWrapper)
+		cliRaw, svrRaw := net.Pipe()
+		cli := w.wrapConn(cliRaw, true, "example.com")
+		svr := w.wrapConn(svrRaw, false, "")
+
+		data := getRandomData(8)
+		go func() {
+			for _, d := range data {
+				_, _ = cli.Write(d)
+			}
+			_ = cli.Close()
+		}()
+		expected := bytes.Join(data, nil)
+		var actual []byte
+		buf := make([]byte, 7)
+		for {
+			n, err := svr.Read(buf)
+			actual = append(actual, buf[:n]...)
+			if err != nil {
+				assert.Equal(t, io.EOF, err, config.Mode)
+				break
+			}
+		}
+		assert.True(t, bytes.Equal(expected, actual), config.Mode)
+	}
+}
+
+func TestObfsConfig(t *testing.T) {
+	for _, config := range []ObfsConfig{
+		{Mode: "unknown"},
+		{Mode: "http_simple", MaxPadding: 10},
+		{Mode: "random_padding", Host: "example.com"},
+		{Mode: "random_padding", MinPadding: 10, MaxPadding: 5},
+		{Mode: "random_padding", MinPadding: -1},
+	} {
+		_, err := WrapTransObfs(TCPTransport{}, config)
+		assert.Error(t, err, "%+v", config)
+	}
+}
@@ -24,7 +24,10 @@ type PreConnTransWrapper struct {
 	transport       Transport
 	preConnMgrs     sync.Map
 	maxPoolSize     int
+	idlePoolSize    int
 	preConnLifetime time.Duration
+	closed          chan struct{} // closed once the wrapper is closed
+	closeOnce       sync.Once
 }
 
 // WrapAsPreConnTransport wraps a transport into a PreConnTransWrapper.
@@ -32,6 +35,7 @@ func WrapAsPreConnTransport(
 	transport Transport, config PreConnConfig) (*PreConnTransWrapper, error) {
 	w := &PreConnTransWrapper{
 		transport: transport,
+		closed:    make(chan struct{}),
 	}
 
 	if config.MaxPoolSize == 0 {
@@ -42,6 +46,18 @@ func WrapAsPreConnTransport(
 		return nil, errors.New("max_pool_size must be greater than 0")
 	}
 
+	if config.IdleSize == 0 {
+		w.idlePoolSize = idlePreConnPoolSize
+		if w.idlePoolSize > w.maxPoolSize {
+			w.idlePoolSize = w.maxPoolSize
+		}
+	} else if config.IdleSize > 0 && config.IdleSize <= w.maxPoolSize {
+		w.idlePoolSize = config.IdleSize
+	} else {
+		return nil, errors.New(
+			"idle_size must be greater than 0 and not exceed max_pool_size")
+	}
+
 	if config.Lifetime == "" {
 		w.preConnLifetime = defaultPreConnLifetime
 	} else if d, err := time.ParseDuration(config.Lifetime); err != nil {
@@ -57,8 +73,14 @@ func WrapAsPreConnTransport(
 		epochInterval = maxPreConnEpochInterval
 	}
 	go func() {
-		ticker := time.Tick(epochInterval)
-		for range ticker {
+		ticker := time.NewTicker(epochInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-w.closed:
+				return
+			}
 			w.preConnMgrs.Range(func(_ interface{}, value interface{}) bool {
 				value.(*preConnMgr).Epoch(w.preConnLifetime)
 				return true
@@ -69,6 +91,29 @@ func WrapAsPreConnTransport(
 	return w, nil
 }
 
+// Close drops the preliminary connections and stops making new ones, while
+// Dial still works by delegating to the wrapped transport, which is closed
+// as well (see closeTransport).
+func (t *PreConnTransWrapper) Close() error {
+	t.closeOnce.Do(func() {
+		close(t.closed)
+		t.preConnMgrs.Range(func(_ interface{}, value interface{}) bool {
+			value.(*preConnMgr).drop()
+			return true
+		})
+	})
+	return closeTransport(t.transport)
+}
+
+func (t *PreConnTransWrapper) isClosed() bool {
+	select {
+	case <-t.closed:
+		return true
+	default:
+		return false
+	}
+}
+
 // Dial retrieves a connection to the target host if there are any in the
 // pre-connect pool, otherwise delegates the call to the wrapped transport.
 func (t *PreConnTransWrapper) Dial(
@@ -137,6 +182,9 @@ func (m *preConnMgr) runPreConn(expectedPoolSize int) {
 	// guarded by preConnMtx, this is the only goroutine pushing elements
 	// into the ring buffer, so we won't accidentally overflow
 	for i := poolSize; i < expectedPoolSize; i++ {
+		if m.wrapper.isClosed() {
+			break
+		}
 		ctx, cancel := context.WithTimeout(
 			context.Background(), preConnTimeout)
 		conn, err := m.wrapper.transport.Dial(ctx, m.target)
@@ -145,6 +193,11 @@ func (m *preConnMgr) runPreConn(expectedPoolSize int) {
 			break
 		}
 		m.poolMtx.Lock()
+		if m.wrapper.isClosed() { // dropped already
+			m.poolMtx.Unlock()
+			_ = conn.Close()
+			break
+		}
 		m.pool[m.poolNext] = &preConn{
 			conn:            conn,
 			establishedTime: time.Now(),
@@ -156,7 +209,7 @@ func (m *preConnMgr) runPreConn(expectedPoolSize int) {
 
 // Epoch cleanups the preConnMgr asynchronously.
 // Preliminary connections that last longer than preConnLifetime are dropped,
-// and the pool size is increased to at least idlePreConnPoolSize.
+// and the pool size is increased to at least the idle pool size.
 func (m *preConnMgr) Epoch(preConnLifetime time.Duration) {
 	// pop expired connections
 	shouldAfter := time.Now().Add(-preConnLifetime)
@@ -181,9 +234,23 @@ func (m *preConnMgr) Epoch(preConnLifetime time.Duration) {
 		}()
 	}
 	// increase pool size if needed
-	// note that poolSize might be less than idlePreConnPoolSize
-	if poolSize < idlePreConnPoolSize && poolSize < m.poolCap {
-		go m.runPreConn(idlePreConnPoolSize)
+	if poolSize < m.wrapper.idlePoolSize {
+		go m.runPreConn(m.wrapper.idlePoolSize)
+	}
+}
+
+// drop closes all the preliminary connections in the pool.
+func (m *preConnMgr) drop() {
+	var connsToDrop []net.Conn
+	m.poolMtx.Lock()
+	for m.poolBegin != m.poolNext {
+		connsToDrop = append(connsToDrop, m.pool[m.poolBegin].conn)
+		m.pool[m.poolBegin] = nil
+		m.poolBegin = (m.poolBegin + 1) % cap(m.pool)
+	}
+	m.poolMtx.Unlock()
+	for _, conn := range connsToDrop {
+		_ = conn.Close()
 	}
 }
 
@@ -194,11 +261,14 @@ func (m *preConnMgr) Dial(ctx context.Context) (conn net.Conn, err error) {
 		m.pool[m.poolBegin] = nil
 		m.poolBegin = (m.poolBegin + 1) % cap(m.pool)
 	}
+	poolSize := m.poolSizeUnsafe()
 	m.poolMtx.Unlock()
 	// starved, trigger a runPreConn and delegate to the underlying transport
 	if conn == nil {
 		go m.runPreConn(m.poolCap)
 		conn, err = m.wrapper.transport.Dial(ctx, m.target)
+	} else if poolSize < m.wrapper.idlePoolSize {
+		go m.runPreConn(m.wrapper.idlePoolSize) // replace the one taken
 	}
 	return
 }
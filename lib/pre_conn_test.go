@@ -70,6 +70,32 @@ func TestPreConnInvalidConfig(t *testing.T) {
 	assert.Error(t, err)
 	_, _, err = makePreConnWithMock(1, "-1s")
 	assert.Error(t, err)
+	for _, idleSize := range []int{-1, 3} {
+		_, err = WrapAsPreConnTransport(newMockTransForPreConn(),
+			PreConnConfig{MaxPoolSize: 2, IdleSize: idleSize})
+		assert.Error(t, err)
+	}
+}
+
+func TestPreConnIdleSize(t *testing.T) {
+	mockTrans := newMockTransForPreConn()
+	preConnTrans, err := WrapAsPreConnTransport(
+		mockTrans, PreConnConfig{MaxPoolSize: 5, IdleSize: 3})
+	require.NoError(t, err)
+	// the first dial starves and fills the pool
+	_, err = preConnTrans.Dial(context.Background(), "addr")
+	require.NoError(t, err)
+	for i := 0; i < 1+5; i++ {
+		<-mockTrans.mockDialCh
+	}
+
+	// taken connections are replaced asynchronously to keep 3 idle ones
+	for i := 0; i < 3; i++ {
+		_, err = preConnTrans.Dial(context.Background(), "addr")
+		require.NoError(t, err)
+		time.Sleep(50 * time.Millisecond)
+	}
+	assert.Len(t, mockTrans.mockDialCh, 1)
 }
 
 func TestPreConnStarvationTriggerPreConn(t *testing.T) {
@@ -148,3 +174,32 @@ func TestPreConnLifetime(t *testing.T) {
 		require.True(t, isStillOpen(dial))
 	}
 }
+
+func TestPreConnClose(t *testing.T) {
+	const maxPoolSize = 3
+	preConnTrans, mockTrans, err := makePreConnWithMock(maxPoolSize, "")
+	require.NoError(t, err)
+	_, err = preConnTrans.Dial(context.Background(), "addr")
+	require.NoError(t, err)
+	<-mockTrans.mockDialCh
+	var dials [maxPoolSize]*mockDial
+	for i := 0; i < maxPoolSize; i++ {
+		dials[i] = <-mockTrans.mockDialCh
+	}
+
+	// the preliminary connections are dropped
+	require.NoError(t, preConnTrans.Close())
+	for _, dial := range dials {
+		var buf [1]byte
+		_, err := dial.svrConn.Read(buf[:])
+		assert.Error(t, err)
+		_ = dial.svrConn.Close()
+	}
+	// and no more are made, while dialing still works
+	_, err = preConnTrans.Dial(context.Background(), "addr")
+	require.NoError(t, err)
+	<-mockTrans.mockDialCh
+	time.Sleep(50 * time.Millisecond)
+	assert.Empty(t, mockTrans.mockDialCh)
+	assert.NoError(t, preConnTrans.Close())
+}
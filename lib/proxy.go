@@ -3,9 +3,13 @@ package lib
 import (
 	"context"
 	"io"
+	"net"
+	"os"
+	"reflect"
 	"strconv"
 	"strings"
 	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/pkg/errors"
@@ -13,16 +17,25 @@ import (
 )
 
 // ProxyErrorType is the type of a proxy error. Its value is identical to those
-// of SOCKS protocol.
+// of SOCKS protocol, except for the thestral-specific ones (>= 0x80), which are
+// reported as ProxyNotAllowed by SOCKS servers by default.
 type ProxyErrorType byte
 
 // nolint: golint
 const (
 	ProxyGeneralErr      ProxyErrorType = 0x01
 	ProxyNotAllowed      ProxyErrorType = 0x02
-	ProxyConnectFailed   ProxyErrorType = 0x05
+	ProxyNetUnreachable  ProxyErrorType = 0x03
+	ProxyHostUnreachable ProxyErrorType = 0x04
+	ProxyConnectFailed   ProxyErrorType = 0x05 // also used on refusals
+	ProxyTTLExpired      ProxyErrorType = 0x06 // also used on timeouts
 	ProxyCmdUnsupported  ProxyErrorType = 0x07
 	ProxyAddrUnsupported ProxyErrorType = 0x08
+	ProxyQuotaExceeded   ProxyErrorType = 0x80
+	ProxyBlocked         ProxyErrorType = 0x81 // rejected by rules
+	ProxyRelayLoop       ProxyErrorType = 0x82 // see CheckRelayHops
+	ProxyAuthFailed      ProxyErrorType = 0x83 // rejected by upstream proxies
+	ProxyUpstreamBusy    ProxyErrorType = 0x84 // see UpstreamConfig.MaxConns
 )
 
 //go:generate stringer -type=ProxyErrorType
@@ -60,6 +73,9 @@ type ProxyRequest interface {
 	TargetAddr() Address
 	Success(addr Address) io.ReadWriteCloser
 	Fail(err *ProxyError)
+	// ID identifies the request in the logs and the monitor. All the entries
+	// logged with Logger carry it as the "reqID" field, so that the lines of
+	// a tunnel can be correlated with each other and with the monitor.
 	ID() string
 	Logger() *zap.SugaredLogger
 }
@@ -70,24 +86,142 @@ type ProxyServer interface {
 	Stop()
 }
 
-// ProxyClient is the client of some proxy protocol.
+// ProxyClient is the client of some proxy protocol. The address of the
+// original client, if any, is carried by the context (see WithClientAddr).
 type ProxyClient interface {
 	Request(ctx context.Context, addr Address) (
 		io.ReadWriteCloser, Address, *ProxyError)
 }
 
+// BindRequest is a ProxyRequest of the BIND command of SOCKS5, i.e. the client
+// waits for a connection from the target (e.g. the data connection of active
+// FTP) rather than connecting to it. Bound is called with the address listened
+// on for the connection, and then Success with the address of its peer.
+type BindRequest interface {
+	ProxyRequest
+	Bound(addr Address) error
+}
+
+// ProxyBinder is a ProxyClient capable of the BindRequests. Bind listens for a
+// connection from the target, and returns the address listened on and a
+// function waiting for the connection, which returns it along with the
+// address of its peer. The listening stops once the connection is accepted or
+// the context is done.
+type ProxyBinder interface {
+	ProxyClient
+	Bind(ctx context.Context, addr Address) (
+		Address, func() (io.ReadWriteCloser, Address, *ProxyError), *ProxyError)
+}
+
+type clientAddrKey struct{}
+
+// WithClientAddr returns a context carrying the address of the client on
+// whose behalf the requests are made.
+func WithClientAddr(ctx context.Context, addr string) context.Context {
+	return context.WithValue(ctx, clientAddrKey{}, addr)
+}
+
+// ClientAddrOf returns the address of the client carried by the context, or
+// an empty string if there is none.
+func ClientAddrOf(ctx context.Context) string {
+	addr, _ := ctx.Value(clientAddrKey{}).(string)
+	return addr
+}
+
+type connTimingsKey struct{}
+
+// ConnTimings is the breakdown of the time a ProxyClient takes to connect to
+// a target, in the phases of resolving the domain name, dialing and the
+// handshakes of the proxy protocol. The phases a client can't tell apart are
+// counted into the latter one, e.g. the resolving done by the dialer is a
+// part of Dial, and so are the handshakes of the transport (e.g. TLS) of the
+// proxy clients.
+type ConnTimings struct {
+	Resolve   time.Duration
+	Dial      time.Duration
+	Handshake time.Duration
+}
+
+// WithConnTimings returns a context carrying the timings, into which the
+// ProxyClients record the breakdown of their successful requests.
+func WithConnTimings(
+	ctx context.Context, timings *ConnTimings) context.Context {
+	return context.WithValue(ctx, connTimingsKey{}, timings)
+}
+
+// recordConnTimings records the timings into the ones carried by the context,
+// if any. The ones recorded last win, e.g. those of a chained client rather
+// than its upstream.
+func recordConnTimings(ctx context.Context, timings ConnTimings) {
+	if t, ok := ctx.Value(connTimingsKey{}).(*ConnTimings); ok && t != nil {
+		*t = timings
+	}
+}
+
+const defaultHappyEyeballsDelay = time.Millisecond * 300
+
 // DirectTCPClient is a ProxyClient without any proxy protocol.
-type DirectTCPClient struct{}
+//
+// Connections to domain names are made in the Happy Eyeballs (RFC 6555) way.
+// The addresses are resolved and sorted per RFC 6724, which usually puts IPv6
+// first, and the other address family is raced after a head start of
+// FallbackDelay. A zero FallbackDelay means 300ms, while a negative one
+// disables the racing.
+//
+// If a Resolver is given, the domains are resolved by it instead, and the IPs
+// are tried in order without racing.
+//
+// ResolveVia names another upstream, through which the domains are resolved
+// by querying the ResolveServer (see NewProxiedResolver) instead of locally,
+// e.g. to keep the lookups from a restrictive network. The app sets up the
+// Resolver accordingly. Note that the domains may still be resolved locally
+// by the rules (see DNSConfig).
+//
+// AddressFamily restricts or reorders the address families to connect with.
+// With a preferred family, the domains are resolved by the system resolver
+// (if no Resolver is given) so that the preferred family goes first and the
+// other one is raced as above. With a single family, only its addresses are
+// dialed, so there's no racing at all.
+//
+// The connections are made from BindAddr and/or via BindInterface (Linux
+// only) if specified, so that they egress as the policy routing requires.
+//
+// If SendProxyProtocol is set, a PROXY protocol v2 header carrying the address
+// of the client (see ClientAddrOf) is sent first on each connection, for the
+// targets behind which want the original client, e.g. another thestral or
+// HAProxy. The header also carries the relay hops (see WithRelayHops) in a
+// custom TLV, which is ignored by the others.
+//
+// If TCPFastOpen is set (Linux only, see TCPFastOpenSupported), the data of
+// the first write is sent along with the SYN once the kernel has cached a
+// cookie of the target. The dialing then completes before the handshake, so
+// an unreachable target is only reported on the first read or write, and the
+// Happy Eyeballs racing can't fall back from an unreachable address family.
+type DirectTCPClient struct {
+	FallbackDelay time.Duration
+	Resolver      DomainResolver
+	BindAddr      net.IP
+	BindZone      string // the zone of BindAddr if it's scoped
+	BindInterface string
+	AddressFamily AddressFamily
+	TCPOptions    *TCPOptions // the defaults if nil
+	ResolveVia    string
+	ResolveServer string // "8.8.8.8:53" by default
+	// sends a PROXY protocol header before anything else
+	SendProxyProtocol bool
+	TCPFastOpen       bool
+}
 
 // Request establishes a direct connection to the given address.
-func (DirectTCPClient) Request(ctx context.Context, addr Address) (
+func (c DirectTCPClient) Request(ctx context.Context, addr Address) (
 	io.ReadWriteCloser, Address, *ProxyError) {
 	var reqAddr string
+	var reqIP net.IP
 	switch a := addr.(type) {
 	case *TCP4Addr:
-		reqAddr = a.String()
+		reqAddr, reqIP = a.String(), a.IP
 	case *TCP6Addr:
-		reqAddr = a.String()
+		reqAddr, reqIP = a.String(), a.IP
 	case *DomainNameAddr:
 		reqAddr = a.String()
 	default:
@@ -95,24 +229,160 @@ func (DirectTCPClient) Request(ctx context.Context, addr Address) (
 			errors.Errorf("unsupported address for DirectTCPClient: %s", addr),
 			ProxyAddrUnsupported)
 	}
+	if reqIP != nil && !c.AddressFamily.allows(reqIP) {
+		return nil, nil, wrapAsProxyError(errors.Errorf(
+			"address not allowed by '%s': %s", c.AddressFamily, addr),
+			ProxyAddrUnsupported)
+	}
 
-	conn, err := TCPTransport{}.Dial(ctx, reqAddr)
-	var boundAddr Address
-	if err == nil {
-		boundAddr, err = FromNetAddr(conn.LocalAddr())
+	dialer := c.TCPOptions.Dialer()
+	dialer.FallbackDelay = c.FallbackDelay
+	if dialer.FallbackDelay == 0 {
+		dialer.FallbackDelay = defaultHappyEyeballsDelay
+	}
+	if c.BindAddr != nil {
+		dialer.LocalAddr = &net.TCPAddr{IP: c.BindAddr, Zone: c.BindZone}
+	}
+	if c.BindInterface != "" {
+		var err error
+		if dialer.Control, err = bindToDevice(c.BindInterface); err != nil {
+			return nil, nil, wrapAsProxyError(err, ProxyGeneralErr)
+		}
+	}
+	if c.TCPFastOpen {
+		dialer.Control = chainDialerControls(dialer.Control, enableTCPFastOpen)
+	}
+	var conn net.Conn
+	var err error
+	var timings ConnTimings
+	startTime := time.Now()
+	if a, ok := addr.(*DomainNameAddr); ok &&
+		(c.Resolver != nil || c.AddressFamily.isPreference()) {
+		conn, err = c.dialResolved(ctx, dialer, a, &timings.Resolve)
+	} else {
+		conn, err = dialer.DialContext(ctx, c.AddressFamily.network(), reqAddr)
+	}
+	timings.Dial = time.Since(startTime) - timings.Resolve
+	if err != nil {
+		return nil, nil, wrapAsProxyError(
+			errors.WithStack(err), dialErrorType(err))
 	}
+	if err = c.TCPOptions.Apply(conn); err != nil {
+		_ = conn.Close()
+		return nil, nil, wrapAsProxyError(err, ProxyGeneralErr)
+	}
+	if c.SendProxyProtocol {
+		startTime = time.Now()
+		if err = writeProxyProtoHeader(ctx, conn); err != nil {
+			_ = conn.Close()
+			return nil, nil, wrapAsProxyError(err, ProxyGeneralErr)
+		}
+		timings.Handshake = time.Since(startTime)
+	}
+	recordConnTimings(ctx, timings)
+	boundAddr, err := FromNetAddr(conn.LocalAddr())
 	pErr := wrapAsProxyError(errors.WithStack(err), ProxyConnectFailed)
 	return conn, boundAddr, pErr
 }
 
+// dialResolved resolves the domain name before dialing, and sets the time of
+// resolving.
+func (c DirectTCPClient) dialResolved(ctx context.Context, dialer *net.Dialer,
+	addr *DomainNameAddr, resolveTime *time.Duration) (net.Conn, error) {
+	var ips []net.IP
+	var err error
+	startTime := time.Now()
+	if c.Resolver != nil {
+		ips, err = c.Resolver.LookupIP(ctx, addr.DomainName)
+	} else {
+		ips, err = net.DefaultResolver.LookupIP(ctx, "ip", addr.DomainName)
+	}
+	*resolveTime = time.Since(startTime)
+	if err != nil {
+		return nil, err
+	}
+	primaries, fallbacks := c.AddressFamily.sortIPs(ips)
+	if len(primaries) == 0 && len(fallbacks) == 0 {
+		return nil, &net.DNSError{Err: "no such host", Name: addr.DomainName}
+	}
+	port := strconv.Itoa(int(addr.Port))
+	if c.Resolver != nil {
+		return dialSerial(ctx, dialer, append(primaries, fallbacks...), port)
+	}
+	return dialHappyEyeballs(ctx, dialer, primaries, fallbacks, port)
+}
+
+// chainDialerControls returns a dialer control function calling the given
+// ones (nil for none) in order.
+func chainDialerControls(first, second func(string, string,
+	syscall.RawConn) error) func(string, string, syscall.RawConn) error {
+	if first == nil {
+		return second
+	}
+	return func(network, address string, c syscall.RawConn) error {
+		if err := first(network, address, c); err != nil {
+			return err
+		}
+		return second(network, address, c)
+	}
+}
+
+// dialErrnoTypes maps the errnos of dialing to the error types.
+var dialErrnoTypes = map[syscall.Errno]ProxyErrorType{
+	syscall.ECONNREFUSED: ProxyConnectFailed,
+	syscall.ECONNRESET:   ProxyConnectFailed,
+	syscall.ENETUNREACH:  ProxyNetUnreachable,
+	syscall.ENETDOWN:     ProxyNetUnreachable,
+	syscall.EHOSTUNREACH: ProxyHostUnreachable,
+	syscall.EHOSTDOWN:    ProxyHostUnreachable,
+	syscall.ETIMEDOUT:    ProxyTTLExpired,
+}
+
+// dialErrorType derives the error type to report to the clients from an
+// error of dialing to the target.
+func dialErrorType(err error) ProxyErrorType {
+	err = errors.Cause(err)
+	if err == context.DeadlineExceeded {
+		return ProxyTTLExpired
+	} else if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return ProxyTTLExpired
+	}
+	for {
+		switch e := err.(type) {
+		case *net.OpError:
+			err = e.Err
+		case *os.SyscallError:
+			err = e.Err
+		case *net.DNSError:
+			return ProxyHostUnreachable
+		case syscall.Errno:
+			if errType, ok := dialErrnoTypes[e]; ok {
+				return errType
+			}
+			return ProxyConnectFailed
+		default:
+			return ProxyConnectFailed
+		}
+	}
+}
+
 // CreateProxyServer creates a ProxyServer from the given configuration.
 func CreateProxyServer(
 	logger *zap.SugaredLogger, config ProxyConfig) (ProxyServer, error) {
+	if config.Transport != nil && config.Transport.PreConn != nil {
+		return nil, errors.New("'pre_conn' is not supported by proxy servers")
+	}
 	switch config.Protocol {
 	case "socks5":
 		return NewSOCKS5Server(logger, config)
+	case "http":
+		return NewHTTPProxyServer(logger, config)
+	case "transparent":
+		return NewTransparentServer(logger, config)
 	case "direct":
 		return nil, errors.New("'direct' cannot be used as a proxy server")
+	case "sinkhole":
+		return nil, errors.New("'sinkhole' cannot be used as a proxy server")
 	default:
 		return nil, errors.New("unknown proxy protocol: " + config.Protocol)
 	}
@@ -122,35 +392,105 @@ func CreateProxyServer(
 func CreateProxyClient(config ProxyConfig) (ProxyClient, error) {
 	switch config.Protocol {
 	case "direct":
+		var client DirectTCPClient
 		if config.Transport != nil {
-			return nil, errors.New(
-				"'direct' protocol should not have any transport setting")
+			if !reflect.DeepEqual(*config.Transport,
+				TransportConfig{TCP: config.Transport.TCP}) {
+				return nil, errors.New("'direct' protocol should not have " +
+					"any transport setting other than 'tcp'")
+			}
+			var err error
+			if client.TCPOptions, err = NewTCPOptions(
+				*config.Transport.TCP); err != nil {
+				return nil, err
+			}
+		}
+		for k, v := range config.Settings {
+			switch k {
+			case "fallback_delay":
+				delayStr, ok := v.(string)
+				if !ok {
+					return nil, errors.New("'fallback_delay' should be a string")
+				}
+				delay, err := time.ParseDuration(delayStr)
+				if err != nil {
+					return nil, errors.WithStack(err)
+				}
+				client.FallbackDelay = delay
+			case "bind_address":
+				addrStr, _ := v.(string)
+				client.BindAddr, client.BindZone = ParseIPZone(addrStr)
+				if client.BindAddr == nil {
+					return nil, errors.Errorf("invalid 'bind_address': %v", v)
+				}
+			case "bind_interface":
+				iface, ok := v.(string)
+				if !ok {
+					return nil, errors.New("'bind_interface' should be a string")
+				}
+				if _, err := net.InterfaceByName(iface); err != nil {
+					return nil, errors.Wrap(err, "invalid 'bind_interface'")
+				}
+				if _, err := bindToDevice(iface); err != nil {
+					return nil, err
+				}
+				client.BindInterface = iface
+			case "address_family":
+				family, err := parseAddressFamily(v)
+				if err != nil {
+					return nil, err
+				}
+				client.AddressFamily = family
+			case "tcp_fast_open":
+				var ok bool
+				if client.TCPFastOpen, ok = v.(bool); !ok {
+					return nil, errors.New("invalid value for 'tcp_fast_open'")
+				}
+			case "send_proxy_protocol":
+				var ok bool
+				if client.SendProxyProtocol, ok = v.(bool); !ok {
+					return nil, errors.New(
+						"invalid value for 'send_proxy_protocol'")
+				}
+			case "resolve_via":
+				var ok bool
+				if client.ResolveVia, ok = v.(string); !ok ||
+					client.ResolveVia == "" {
+					return nil, errors.Errorf(
+						"invalid value for 'resolve_via': %v", v)
+				}
+			case "resolve_server":
+				var ok bool
+				if client.ResolveServer, ok = v.(string); !ok ||
+					client.ResolveServer == "" {
+					return nil, errors.Errorf(
+						"invalid value for 'resolve_server': %v", v)
+				}
+			default:
+				return nil, errors.New(
+					"unknown setting of 'direct' protocol: " + k)
+			}
 		}
-		if len(config.Settings) > 0 {
-			return nil, errors.New(
-				"'direct' protocol should not have any extra setting")
+		if client.ResolveServer != "" && client.ResolveVia == "" {
+			return nil, errors.New("'resolve_server' requires 'resolve_via'")
 		}
-		return DirectTCPClient{}, nil
+		return client, nil
 
 	case "http":
-		if config.Transport != nil {
-			return nil, errors.New(
-				"'http' protocol should not have any transport setting")
-		}
-		addr, ok := config.Settings["address"]
-		if !ok || len(config.Settings) != 1 {
-			return nil, errors.New(
-				"'http' protocol should have one and only one" +
-					" extra setting 'address'")
-		}
-		if addrStr, ok := addr.(string); ok {
-			return HTTPTunnelClient{addrStr}, nil
-		}
-		return nil, errors.New("a valid 'address' must be supplied")
+		return NewHTTPTunnelClient(config)
 
 	case "socks5":
 		return NewSOCKS5Client(config)
 
+	case "transparent":
+		return nil, errors.New("'transparent' cannot be used as a proxy client")
+
+	case "trojan":
+		return NewTrojanClient(config)
+
+	case "sinkhole":
+		return NewSinkholeClient(config)
+
 	default:
 		return nil, errors.New("unknown proxy protocol: " + config.Protocol)
 	}
@@ -0,0 +1,327 @@
+package lib
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	proxyProtoHeaderTimeout = time.Second * 10
+	proxyProtoV1MaxLen      = 107
+	proxyProtoV2HeaderLen   = 16
+	proxyProtoReadBufSize   = 256
+)
+
+var proxyProtoV2Sig = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// WrapTransProxyProtocol wraps a Transport so that the accepted connections
+// must start with a PROXY protocol (v1 or v2) header, which is stripped and
+// provides the remote address of the connections. It only affects servers.
+//
+// Headers are read concurrently, and the connections without a valid one in
+// time are closed without being returned by Accept.
+func WrapTransProxyProtocol(inner Transport) Transport {
+	return &proxyProtoTransWrapper{inner}
+}
+
+type proxyProtoTransWrapper struct {
+	inner Transport
+}
+
+// Close closes the inner transport, see closeTransport.
+func (w *proxyProtoTransWrapper) Close() error {
+	return closeTransport(w.inner)
+}
+
+func (w *proxyProtoTransWrapper) Dial(
+	ctx context.Context, address string) (net.Conn, error) {
+	return w.inner.Dial(ctx, address)
+}
+
+func (w *proxyProtoTransWrapper) Listen(address string) (net.Listener, error) {
+	listener, err := w.inner.Listen(address)
+	if err != nil {
+		return nil, err
+	}
+	l := &proxyProtoListener{
+		Listener: listener,
+		acceptCh: make(chan acceptResult),
+		closed:   make(chan struct{}),
+	}
+	go l.acceptLoop()
+	return l, nil
+}
+
+type proxyProtoListener struct {
+	net.Listener
+	acceptCh  chan acceptResult
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (l *proxyProtoListener) acceptLoop() {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			select {
+			case l.acceptCh <- acceptResult{nil, err}:
+			case <-l.closed:
+				return
+			}
+			if isTemporaryError(err) {
+				continue
+			}
+			return
+		}
+		go func() {
+			ppConn, err := readProxyProtoHeader(conn, proxyProtoHeaderTimeout)
+			if err != nil {
+				_ = conn.Close()
+				return
+			}
+			select {
+			case l.acceptCh <- acceptResult{ppConn, nil}:
+			case <-l.closed:
+				_ = conn.Close()
+			}
+		}()
+	}
+}
+
+func (l *proxyProtoListener) Accept() (net.Conn, error) {
+	select {
+	case result := <-l.acceptCh:
+		return result.conn, result.err
+	case <-l.closed:
+		return nil, errors.New("listener closed")
+	}
+}
+
+func (l *proxyProtoListener) Close() (err error) {
+	l.closeOnce.Do(func() {
+		close(l.closed)
+		err = l.Listener.Close()
+	})
+	return
+}
+
+// proxyProtoConn is a connection whose PROXY protocol header has been read.
+type proxyProtoConn struct {
+	net.Conn
+	r          *bufio.Reader
+	remoteAddr net.Addr // nil if the header carries no address
+	relayHops  []string // nil if the header carries none
+}
+
+func (c *proxyProtoConn) Read(p []byte) (int, error) {
+	if c.r.Buffered() > 0 { // read beyond the header
+		return c.r.Read(p)
+	}
+	return c.Conn.Read(p)
+}
+
+func (c *proxyProtoConn) RemoteAddr() net.Addr {
+	if c.remoteAddr != nil {
+		return c.remoteAddr
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// GetPeerIdentifiers returns the relay hops carried by the header, if any.
+func (c *proxyProtoConn) GetPeerIdentifiers() ([]*PeerIdentifier, error) {
+	if c.relayHops == nil {
+		return nil, nil
+	}
+	return []*PeerIdentifier{{
+		Scope:     RelayHopsScope,
+		UniqueID:  strings.Join(c.relayHops, ","),
+		ExtraInfo: map[string]interface{}{"hops": len(c.relayHops)},
+	}}, nil
+}
+
+// writeProxyProtoHeader sends a PROXY protocol v2 header on a connection just
+// established, carrying the address of the client (see ClientAddrOf) and the
+// remote address of the connection, along with the relay hops (see
+// WithRelayHops). A LOCAL header is sent if the address of the client is
+// unknown or not an IP one.
+func writeProxyProtoHeader(ctx context.Context, conn net.Conn) error {
+	header := append([]byte{}, proxyProtoV2Sig...)
+	var body []byte
+	src := parseTCPAddr(ClientAddrOf(ctx))
+	dst, ok := conn.RemoteAddr().(*net.TCPAddr)
+	switch {
+	case src == nil || !ok:
+		header = append(header, 0x20, 0x00) // LOCAL, UNSPEC
+	case src.IP.To4() != nil && dst.IP.To4() != nil:
+		header = append(header, 0x21, 0x11) // PROXY, TCP over IPv4
+		body = append(append(body, src.IP.To4()...), dst.IP.To4()...)
+	default:
+		header = append(header, 0x21, 0x21) // PROXY, TCP over IPv6
+		body = append(append(body, src.IP.To16()...), dst.IP.To16()...)
+	}
+	if body != nil {
+		body = append(body, 0, 0, 0, 0)
+		binary.BigEndian.PutUint16(body[len(body)-4:], uint16(src.Port))
+		binary.BigEndian.PutUint16(body[len(body)-2:], uint16(dst.Port))
+	}
+	body = appendRelayHopsTLV(body, relayHopsOf(ctx))
+	header = append(header, 0, 0)
+	binary.BigEndian.PutUint16(header[len(header)-2:], uint16(len(body)))
+
+	if ddl, ok := ctx.Deadline(); ok {
+		_ = conn.SetWriteDeadline(ddl)
+		defer conn.SetWriteDeadline(time.Time{}) // nolint: errcheck
+	}
+	_, err := conn.Write(append(header, body...))
+	return errors.Wrap(err, "failed to send PROXY protocol header")
+}
+
+// parseTCPAddr parses an "ip:port" address, or returns nil if it's invalid.
+func parseTCPAddr(addr string) *net.TCPAddr {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil
+	}
+	ip := net.ParseIP(host)
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if ip == nil || err != nil {
+		return nil
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}
+}
+
+// readProxyProtoHeader reads the PROXY protocol header from the connection
+// within the given timeout.
+func readProxyProtoHeader(
+	conn net.Conn, timeout time.Duration) (*proxyProtoConn, error) {
+	_ = conn.SetReadDeadline(time.Now().Add(timeout))
+	defer conn.SetReadDeadline(time.Time{}) // nolint: errcheck
+
+	ppConn := &proxyProtoConn{
+		Conn: conn, r: bufio.NewReaderSize(conn, proxyProtoReadBufSize)}
+	// the signature of v2 (12 bytes) is shorter than any header, e.g. the
+	// shortest v1 one "PROXY UNKNOWN\r\n" (15 bytes), so peeking it never
+	// waits for bytes beyond a header sent without any payload
+	sig, err := ppConn.r.Peek(len(proxyProtoV2Sig))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read PROXY protocol header")
+	}
+	if bytes.Equal(sig, proxyProtoV2Sig) {
+		ppConn.remoteAddr, ppConn.relayHops, err = readProxyProtoV2(ppConn.r)
+	} else if bytes.HasPrefix(sig, []byte("PROXY ")) {
+		ppConn.remoteAddr, err = readProxyProtoV1(ppConn.r)
+	} else {
+		err = errors.New("PROXY protocol header is missing")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return ppConn, nil
+}
+
+// readProxyProtoV1 reads a header in the human-readable format, e.g.
+// "PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\r\n".
+func readProxyProtoV1(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for len(line) < proxyProtoV1MaxLen {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read PROXY protocol header")
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errors.New("invalid PROXY protocol v1 header")
+	}
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil // e.g. health checks of the load balancer
+	} else if len(fields) != 6 ||
+		(fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, errors.New("invalid PROXY protocol v1 header")
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil || (ip.To4() != nil) != (fields[1] == "TCP4") {
+		return nil, errors.New("invalid address in PROXY protocol v1 header")
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readProxyProtoV2 reads a header in the binary format, along with the relay
+// hops in its TLVs.
+func readProxyProtoV2(r *bufio.Reader) (net.Addr, []string, error) {
+	header := make([]byte, proxyProtoV2HeaderLen)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, nil, errors.Wrap(
+			err, "failed to read PROXY protocol header")
+	}
+	verCmd, family := header[12], header[13]
+	body := make([]byte, binary.BigEndian.Uint16(header[14:]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, nil, errors.Wrap(
+			err, "failed to read PROXY protocol header")
+	}
+	if verCmd>>4 != 2 {
+		return nil, nil, errors.New("unsupported PROXY protocol version")
+	}
+	local := false
+	switch verCmd & 0x0f {
+	case 0: // LOCAL, e.g. health checks of the load balancer
+		local = true
+	case 1: // PROXY
+	default:
+		return nil, nil, errors.New("unsupported PROXY protocol command")
+	}
+
+	// the addresses are followed by optional TLVs, where only the relay hops
+	// are read
+	var addr *net.TCPAddr
+	var tlvs []byte
+	switch family {
+	case 0x11: // TCP over IPv4
+		if len(body) >= 2*net.IPv4len+4 {
+			addr = &net.TCPAddr{
+				IP:   net.IP(body[:net.IPv4len]),
+				Port: int(binary.BigEndian.Uint16(body[2*net.IPv4len:])),
+			}
+			tlvs = body[2*net.IPv4len+4:]
+		}
+	case 0x21: // TCP over IPv6
+		if len(body) >= 2*net.IPv6len+4 {
+			addr = &net.TCPAddr{
+				IP:   net.IP(body[:net.IPv6len]),
+				Port: int(binary.BigEndian.Uint16(body[2*net.IPv6len:])),
+			}
+			tlvs = body[2*net.IPv6len+4:]
+		}
+	case 0x00: // UNSPEC
+		tlvs = body
+	default:
+		if !local {
+			return nil, nil, errors.Errorf(
+				"unsupported address family in PROXY protocol: %#x", family)
+		}
+	}
+	hops := parseRelayHopsTLV(tlvs)
+	if local || family == 0x00 {
+		return nil, hops, nil
+	} else if addr == nil {
+		return nil, nil, errors.New(
+			"invalid address in PROXY protocol v2 header")
+	}
+	return addr, hops, nil
+}
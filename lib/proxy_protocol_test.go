@@ -0,0 +1,184 @@
+package lib
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func proxyProtoV2Header(
+	cmd, family byte, addrs []byte, srcPort uint16) []byte {
+	body := append(append([]byte{}, addrs...), 0, 0, 0, 0)
+	binary.BigEndian.PutUint16(body[len(addrs):], srcPort)
+	header := append(append([]byte{}, proxyProtoV2Sig...), 0x20|cmd, family)
+	header = append(header, 0, 0)
+	binary.BigEndian.PutUint16(header[14:], uint16(len(body)))
+	return append(header, body...)
+}
+
+func TestReadProxyProtoHeader(t *testing.T) {
+	ipv6 := net.ParseIP("2001:db8::1")
+	for _, c := range []struct {
+		header string
+		addr   string // empty for the actual one
+		ok     bool
+	}{
+		{"PROXY TCP4 1.2.3.4 5.6.7.8 1234 443\r\n", "1.2.3.4:1234", true},
+		{"PROXY TCP6 2001:db8::1 ::1 1234 443\r\n", "[2001:db8::1]:1234", true},
+		{"PROXY UNKNOWN\r\n", "", true},
+		{"PROXY TCP4 2001:db8::1 ::1 1234 443\r\n", "", false},
+		{"PROXY TCP4 1.2.3.4 5.6.7.8 123456 443\r\n", "", false},
+		{"PROXY TCP4 1.2.3.4 5.6.7.8 1234\r\n", "", false},
+		{"PROXY TCP4 1.2.3.4 5.6.7.8 1234 443\n", "", false},
+		{"GET / HTTP/1.1\r\n\r\n", "", false},
+		{string(proxyProtoV2Header(1, 0x11,
+			[]byte{1, 2, 3, 4, 5, 6, 7, 8}, 1234)), "1.2.3.4:1234", true},
+		{string(proxyProtoV2Header(1, 0x21,
+			append(append([]byte{}, ipv6...), net.IPv6loopback...), 1234)),
+			"[2001:db8::1]:1234", true},
+		{string(proxyProtoV2Header(0, 0x00, nil, 0)), "", true},
+		{string(proxyProtoV2Header(1, 0x11, []byte{1, 2, 3, 4}, 1234)),
+			"", false},
+		{string(proxyProtoV2Header(1, 0x31, make([]byte, 216), 0)), "", false},
+		{string(proxyProtoV2Header(2, 0x11,
+			[]byte{1, 2, 3, 4, 5, 6, 7, 8}, 1234)), "", false},
+	} {
+		cli, svr := net.Pipe()
+		go func() {
+			_, _ = io.WriteString(cli, c.header+"payload")
+			_ = cli.Close()
+		}()
+		conn, err := readProxyProtoHeader(svr, time.Second)
+		if !c.ok {
+			assert.Error(t, err, "%q", c.header)
+			_ = svr.Close()
+			continue
+		}
+		if !assert.NoError(t, err, "%q", c.header) {
+			_ = svr.Close()
+			continue
+		}
+		if c.addr == "" {
+			assert.Equal(t, svr.RemoteAddr(), conn.RemoteAddr())
+		} else {
+			assert.Equal(t, c.addr, conn.RemoteAddr().String())
+		}
+		payload, err := ioutil.ReadAll(conn)
+		assert.NoError(t, err)
+		assert.Equal(t, "payload", string(payload), "%q", c.header)
+		_ = conn.Close()
+	}
+
+	// the header is read without waiting for any payload
+	for _, header := range []string{"PROXY UNKNOWN\r\n",
+		string(proxyProtoV2Header(0, 0x00, nil, 0))} {
+		cli, svr := net.Pipe()
+		go func() { _, _ = io.WriteString(cli, header) }()
+		conn, err := readProxyProtoHeader(svr, time.Second)
+		if assert.NoError(t, err, "%q", header) {
+			assert.Equal(t, svr.RemoteAddr(), conn.RemoteAddr())
+		}
+		_ = cli.Close()
+		_ = svr.Close()
+	}
+}
+
+func TestProxyProtocolTransport(t *testing.T) {
+	_, err := CreateTransport(&TransportConfig{
+		ProxyProtocol: true, KCP: &KCPConfig{}})
+	assert.Error(t, err)
+
+	trans, err := CreateTransport(&TransportConfig{ProxyProtocol: true})
+	require.NoError(t, err)
+	listener, err := trans.Listen("127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close() // nolint: errcheck
+	address := listener.Addr().String()
+
+	// the connections without the header are closed
+	noHeader, err := net.Dial("tcp", address)
+	require.NoError(t, err)
+	defer noHeader.Close() // nolint: errcheck
+	_, err = io.WriteString(noHeader, "GET / HTTP/1.1\r\n\r\n")
+	require.NoError(t, err)
+	_ = noHeader.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = noHeader.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+
+	conn, err := net.Dial("tcp", address)
+	require.NoError(t, err)
+	defer conn.Close() // nolint: errcheck
+	_, err = io.WriteString(
+		conn, "PROXY TCP4 1.2.3.4 5.6.7.8 1234 443\r\nhello")
+	require.NoError(t, err)
+	accepted, err := listener.Accept()
+	require.NoError(t, err)
+	defer accepted.Close() // nolint: errcheck
+	assert.Equal(t, "1.2.3.4:1234", accepted.RemoteAddr().String())
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(accepted, buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(buf))
+
+	require.NoError(t, listener.Close())
+	_, err = listener.Accept()
+	assert.Error(t, err)
+}
+
+func TestDirectTCPClientSendProxyProtocol(t *testing.T) {
+	trans, err := CreateTransport(&TransportConfig{ProxyProtocol: true})
+	require.NoError(t, err)
+	listener, err := trans.Listen("127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close() // nolint: errcheck
+	target, err := FromNetAddr(listener.Addr())
+	require.NoError(t, err)
+
+	client, err := CreateProxyClient(ProxyConfig{
+		Protocol: "direct",
+		Settings: map[string]interface{}{"send_proxy_protocol": true},
+	})
+	require.NoError(t, err)
+	for _, clientAddr := range []string{
+		"1.2.3.4:1234", "[2001:db8::1]:1234", "", "pipe"} {
+		ctx := context.Background()
+		if clientAddr != "" {
+			ctx = WithClientAddr(ctx, clientAddr)
+		}
+		rwc, _, pErr := client.Request(ctx, target)
+		require.Nil(t, pErr)
+		_, err = io.WriteString(rwc, "hello")
+		require.NoError(t, err)
+
+		conn, err := listener.Accept()
+		require.NoError(t, err)
+		if parseTCPAddr(clientAddr) != nil {
+			assert.Equal(t, clientAddr, conn.RemoteAddr().String())
+		} else {
+			assert.Equal(t, rwc.(net.Conn).LocalAddr().String(),
+				conn.RemoteAddr().String())
+		}
+		peerIDs, err := conn.(WithPeerIdentifiers).GetPeerIdentifiers()
+		assert.NoError(t, err)
+		assert.Equal(t, []string{relayInstanceID}, RelayHopsOf(peerIDs))
+		buf := make([]byte, 5)
+		_, err = io.ReadFull(conn, buf)
+		assert.NoError(t, err)
+		assert.Equal(t, "hello", string(buf))
+		_ = conn.Close()
+		_ = rwc.Close()
+	}
+
+	_, err = CreateProxyClient(ProxyConfig{
+		Protocol: "direct",
+		Settings: map[string]interface{}{"send_proxy_protocol": "yes"},
+	})
+	assert.Error(t, err)
+}
@@ -0,0 +1,554 @@
+package lib
+
+import (
+	"context"
+	"io"
+	"net"
+	"os"
+	"runtime"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestDirectTCPClient(t *testing.T) {
+	cli, err := CreateProxyClient(ProxyConfig{
+		Protocol: "direct",
+		Settings: map[string]interface{}{"fallback_delay": "100ms"},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, time.Millisecond*100, cli.(DirectTCPClient).FallbackDelay)
+
+	cli2, err := CreateProxyClient(ProxyConfig{
+		Protocol:  "direct",
+		Transport: &TransportConfig{TCP: &TCPConfig{KeepAlive: "30s"}},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, &TCPOptions{NoDelay: true, KeepAlive: time.Second * 30},
+		cli2.(DirectTCPClient).TCPOptions)
+	_, err = CreateProxyClient(ProxyConfig{
+		Protocol:  "direct",
+		Transport: &TransportConfig{TLS: &TLSConfig{}},
+	})
+	assert.Error(t, err)
+
+	for _, settings := range []map[string]interface{}{
+		{"fallback_delay": "x"},
+		{"fallback_delay": 100},
+		{"address": "127.0.0.1:80"},
+		{"bind_address": "x"},
+		{"bind_interface": "does-not-exist"},
+		{"tcp_fast_open": "yes"},
+		{"address_family": "ipv5_only"},
+		{"address_family": 4},
+	} {
+		_, err = CreateProxyClient(
+			ProxyConfig{Protocol: "direct", Settings: settings})
+		assert.Error(t, err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer func() { _ = listener.Close() }()
+	go func() {
+		if conn, err := listener.Accept(); err == nil {
+			_ = conn.Close()
+		}
+	}()
+	_, port, err := net.SplitHostPort(listener.Addr().String())
+	require.NoError(t, err)
+	addr, err := ParseAddress("localhost:" + port)
+	require.NoError(t, err)
+	conn, boundAddr, pErr := cli.Request(context.Background(), addr)
+	require.Nil(t, pErr)
+	assert.NotNil(t, boundAddr)
+	assert.NoError(t, conn.Close())
+}
+
+type fakeResolver map[string][]net.IP
+
+func (r fakeResolver) LookupIP(
+	ctx context.Context, domain string) ([]net.IP, error) {
+	if ips, ok := r[domain]; ok {
+		return ips, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: domain}
+}
+
+func TestDirectTCPClientBindAddr(t *testing.T) {
+	cli, err := CreateProxyClient(ProxyConfig{
+		Protocol: "direct",
+		Settings: map[string]interface{}{"bind_address": "127.0.0.2"},
+	})
+	require.NoError(t, err)
+
+	listener, err := net.Listen("tcp", "0.0.0.0:0")
+	require.NoError(t, err)
+	defer func() { _ = listener.Close() }()
+	go func() {
+		if conn, err := listener.Accept(); err == nil {
+			_ = conn.Close()
+		}
+	}()
+	port := uint16(listener.Addr().(*net.TCPAddr).Port)
+	conn, boundAddr, pErr := cli.Request(
+		context.Background(), &TCP4Addr{net.IPv4(127, 0, 0, 1), port})
+	if runtime.GOOS != "linux" && pErr != nil {
+		t.Skip("127.0.0.2 is unavailable: ", pErr.Error)
+	}
+	require.Nil(t, pErr)
+	assert.Equal(t, "127.0.0.2", boundAddr.(*TCP4Addr).IP.String())
+	assert.NoError(t, conn.Close())
+}
+
+func TestDirectTCPClientBind(t *testing.T) {
+	cli := DirectTCPClient{}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	boundAddr, accept, pErr := cli.Bind(
+		ctx, &TCP4Addr{net.IPv4(127, 0, 0, 1), 0})
+	require.Nil(t, pErr)
+	bound := boundAddr.(*TCP4Addr)
+	assert.Equal(t, "127.0.0.1", bound.IP.String())
+	conn, err := net.Dial("tcp", bound.String())
+	require.NoError(t, err)
+	defer conn.Close() // nolint: errcheck
+	peerConn, peerAddr, pErr := accept()
+	require.Nil(t, pErr)
+	assert.Equal(t, conn.LocalAddr().String(), peerAddr.String())
+	_, err = conn.Write([]byte("hello"))
+	require.NoError(t, err)
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(peerConn, buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(buf))
+	assert.NoError(t, peerConn.Close())
+	_, err = net.Dial("tcp", bound.String())
+	assert.Error(t, err) // no longer listening
+
+	// the connections from other than the target are rejected
+	cli.BindAddr = net.IPv4(127, 0, 0, 1)
+	ctx, cancel = context.WithTimeout(
+		context.Background(), time.Millisecond*200)
+	defer cancel()
+	boundAddr, accept, pErr = cli.Bind(
+		ctx, &TCP4Addr{net.IPv4(192, 0, 2, 1), 0})
+	require.Nil(t, pErr)
+	conn, err = net.Dial("tcp", boundAddr.String())
+	require.NoError(t, err)
+	defer conn.Close() // nolint: errcheck
+	_, _, pErr = accept()
+	assert.NotNil(t, pErr)
+
+	// and so are the unspecified targets, which anyone would match
+	_, _, pErr = cli.Bind(context.Background(), &TCP4Addr{net.IPv4zero, 0})
+	if assert.NotNil(t, pErr) {
+		assert.Equal(t, ProxyNotAllowed, pErr.ErrType)
+	}
+}
+
+func TestDirectTCPClientFastOpen(t *testing.T) {
+	cli, err := CreateProxyClient(ProxyConfig{
+		Protocol: "direct",
+		Settings: map[string]interface{}{"tcp_fast_open": true},
+	})
+	require.NoError(t, err)
+	require.True(t, cli.(DirectTCPClient).TCPFastOpen)
+
+	// the data is echoed whether the server supports it or not
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer func() { _ = listener.Close() }()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_, _ = io.Copy(conn, conn)
+				_ = conn.Close()
+			}()
+		}
+	}()
+	addr, err := FromNetAddr(listener.Addr())
+	require.NoError(t, err)
+	for i := 0; i < 2; i++ { // with the cookie cached by the first one
+		conn, _, pErr := cli.Request(context.Background(), addr)
+		require.Nil(t, pErr)
+		_, err = conn.Write([]byte("thestral"))
+		require.NoError(t, err)
+		buf := make([]byte, 8)
+		_, err = io.ReadFull(conn, buf)
+		assert.NoError(t, err)
+		assert.Equal(t, "thestral", string(buf))
+		assert.NoError(t, conn.Close())
+	}
+
+	// an unreachable target is reported by dialing or the first write
+	_ = listener.Close()
+	conn, _, pErr := cli.Request(context.Background(), addr)
+	if pErr == nil {
+		_, err = conn.Write([]byte("thestral"))
+		if err == nil {
+			_, err = conn.Read(make([]byte, 1))
+		}
+		assert.Error(t, err)
+		_ = conn.Close()
+	}
+}
+
+func TestChainDialerControls(t *testing.T) {
+	var calls []string
+	control := func(name string, err error) func(
+		string, string, syscall.RawConn) error {
+		return func(string, string, syscall.RawConn) error {
+			calls = append(calls, name)
+			return err
+		}
+	}
+	chained := chainDialerControls(nil, control("a", nil))
+	assert.NoError(t, chained("tcp", "", nil))
+	chained = chainDialerControls(control("b", nil), control("c", nil))
+	assert.NoError(t, chained("tcp", "", nil))
+	chained = chainDialerControls(
+		control("d", errors.New("failed")), control("e", nil))
+	assert.Error(t, chained("tcp", "", nil))
+	assert.Equal(t, []string{"a", "b", "c", "d"}, calls)
+}
+
+// linkLocalIPv6 finds a link-local IPv6 address with its zone.
+func linkLocalIPv6() (net.IP, string) {
+	ifaces, _ := net.Interfaces()
+	for _, iface := range ifaces {
+		addrs, _ := iface.Addrs()
+		for _, addr := range addrs {
+			ipNet, ok := addr.(*net.IPNet)
+			if ok && ipNet.IP.To4() == nil && ipNet.IP.IsLinkLocalUnicast() {
+				return ipNet.IP, iface.Name
+			}
+		}
+	}
+	return nil, ""
+}
+
+func TestDirectTCPClientZone(t *testing.T) {
+	ip, zone := linkLocalIPv6()
+	if ip == nil {
+		t.Skip("no link-local IPv6 address available")
+	}
+	host := ip.String() + "%" + zone
+	cli, err := CreateProxyClient(ProxyConfig{
+		Protocol: "direct",
+		Settings: map[string]interface{}{"bind_address": host},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, zone, cli.(DirectTCPClient).BindZone)
+
+	listener, err := net.Listen("tcp", net.JoinHostPort(host, "0"))
+	require.NoError(t, err)
+	defer func() { _ = listener.Close() }()
+	go func() {
+		if conn, err := listener.Accept(); err == nil {
+			_ = conn.Close()
+		}
+	}()
+	port := listener.Addr().(*net.TCPAddr).Port
+	hostPort := net.JoinHostPort(host, strconv.Itoa(port))
+	addr, err := ParseAddress(hostPort)
+	require.NoError(t, err)
+	require.Equal(t, &TCP6Addr{ip, uint16(port), zone}, addr)
+	assert.Equal(t, hostPort, addr.String())
+
+	conn, boundAddr, pErr := cli.Request(context.Background(), addr)
+	require.Nil(t, pErr)
+	if assert.IsType(t, &TCP6Addr{}, boundAddr) {
+		assert.True(t, ip.Equal(boundAddr.(*TCP6Addr).IP))
+		assert.Equal(t, zone, boundAddr.(*TCP6Addr).Zone)
+	}
+	assert.NoError(t, conn.Close())
+}
+
+func TestDirectTCPClientResolver(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer func() { _ = listener.Close() }()
+	go func() {
+		if conn, err := listener.Accept(); err == nil {
+			_ = conn.Close()
+		}
+	}()
+	port := uint16(listener.Addr().(*net.TCPAddr).Port)
+
+	cli := DirectTCPClient{Resolver: fakeResolver{
+		"fake.domain": {net.ParseIP("127.0.0.1")}}}
+	conn, _, pErr := cli.Request(
+		context.Background(), &DomainNameAddr{"fake.domain", port})
+	require.Nil(t, pErr)
+	assert.Equal(t, listener.Addr().String(),
+		conn.(net.Conn).RemoteAddr().String())
+	assert.NoError(t, conn.Close())
+
+	_, _, pErr = cli.Request(
+		context.Background(), &DomainNameAddr{"localhost", port})
+	if assert.NotNil(t, pErr) {
+		assert.Equal(t, ProxyHostUnreachable, pErr.ErrType)
+	}
+}
+
+type slowResolver struct {
+	fakeResolver
+	delay time.Duration
+}
+
+func (r slowResolver) LookupIP(
+	ctx context.Context, domain string) ([]net.IP, error) {
+	time.Sleep(r.delay)
+	return r.fakeResolver.LookupIP(ctx, domain)
+}
+
+func TestDirectTCPClientConnTimings(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer func() { _ = listener.Close() }()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			_ = conn.Close()
+		}
+	}()
+	port := uint16(listener.Addr().(*net.TCPAddr).Port)
+
+	cli := DirectTCPClient{Resolver: slowResolver{fakeResolver{
+		"fake.domain": {net.ParseIP("127.0.0.1")}}, time.Millisecond * 20}}
+	var timings ConnTimings
+	conn, _, pErr := cli.Request(WithConnTimings(context.Background(),
+		&timings), &DomainNameAddr{"fake.domain", port})
+	require.Nil(t, pErr)
+	assert.NoError(t, conn.Close())
+	assert.True(t, timings.Resolve >= time.Millisecond*20)
+	assert.True(t, timings.Dial > 0)
+	assert.Zero(t, timings.Handshake)
+
+	// the resolving is a part of the dialing if done by the dialer
+	timings = ConnTimings{Resolve: time.Hour}
+	cli = DirectTCPClient{SendProxyProtocol: true}
+	conn, _, pErr = cli.Request(WithConnTimings(context.Background(),
+		&timings), &TCP4Addr{net.IPv4(127, 0, 0, 1), port})
+	require.Nil(t, pErr)
+	assert.NoError(t, conn.Close())
+	assert.Zero(t, timings.Resolve)
+	assert.True(t, timings.Dial > 0)
+	assert.True(t, timings.Handshake > 0)
+
+	// no timings to record into
+	conn, _, pErr = cli.Request(
+		context.Background(), &TCP4Addr{net.IPv4(127, 0, 0, 1), port})
+	require.Nil(t, pErr)
+	assert.NoError(t, conn.Close())
+}
+
+// listenDualStack listens on the same port of both 127.0.0.1 and ::1.
+func listenDualStack(t *testing.T) (l4, l6 net.Listener, port uint16) {
+	for i := 0; i < 10; i++ {
+		var err error
+		l4, err = net.Listen("tcp4", "127.0.0.1:0")
+		require.NoError(t, err)
+		port = uint16(l4.Addr().(*net.TCPAddr).Port)
+		l6, err = net.Listen(
+			"tcp6", net.JoinHostPort("::1", strconv.Itoa(int(port))))
+		if err == nil {
+			return
+		}
+		_ = l4.Close()
+	}
+	t.Skip("no port available on both families")
+	return
+}
+
+func TestDirectTCPClientAddressFamily(t *testing.T) {
+	cli, err := CreateProxyClient(ProxyConfig{
+		Protocol: "direct",
+		Settings: map[string]interface{}{"address_family": "prefer_ipv4"},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, AddrFamilyPreferIPv4, cli.(DirectTCPClient).AddressFamily)
+
+	l4, l6, port := listenDualStack(t)
+	defer func() { _ = l4.Close() }()
+	defer func() { _ = l6.Close() }()
+	for _, l := range []net.Listener{l4, l6} {
+		go func(l net.Listener) {
+			for {
+				conn, err := l.Accept()
+				if err != nil {
+					return
+				}
+				_ = conn.Close()
+			}
+		}(l)
+	}
+
+	resolver := fakeResolver{
+		"both.domain": {net.ParseIP("::1"), net.ParseIP("127.0.0.1")},
+		"v6.domain":   {net.ParseIP("::1")},
+	}
+	remoteIP := func(family AddressFamily, addr Address) (net.IP, *ProxyError) {
+		cli := DirectTCPClient{Resolver: resolver, AddressFamily: family}
+		conn, _, pErr := cli.Request(context.Background(), addr)
+		if pErr != nil {
+			return nil, pErr
+		}
+		defer func() { _ = conn.Close() }()
+		return conn.(net.Conn).RemoteAddr().(*net.TCPAddr).IP, nil
+	}
+	both := &DomainNameAddr{"both.domain", port}
+	for family, expected := range map[AddressFamily]string{
+		"":                   "::1",
+		AddrFamilyAuto:       "::1",
+		AddrFamilyPreferIPv4: "127.0.0.1",
+		AddrFamilyPreferIPv6: "::1",
+		AddrFamilyIPv4Only:   "127.0.0.1",
+		AddrFamilyIPv6Only:   "::1",
+	} {
+		ip, pErr := remoteIP(family, both)
+		if assert.Nil(t, pErr, family) {
+			assert.Equal(t, expected, ip.String(), family)
+		}
+	}
+
+	// falls back to the other family
+	v6 := &DomainNameAddr{"v6.domain", port}
+	ip, pErr := remoteIP(AddrFamilyPreferIPv4, v6)
+	if assert.Nil(t, pErr) {
+		assert.Equal(t, "::1", ip.String())
+	}
+	// no address of the allowed family
+	_, pErr = remoteIP(AddrFamilyIPv4Only, v6)
+	if assert.NotNil(t, pErr) {
+		assert.Equal(t, ProxyHostUnreachable, pErr.ErrType)
+	}
+	_, pErr = remoteIP(
+		AddrFamilyIPv4Only, &TCP6Addr{IP: net.ParseIP("::1"), Port: port})
+	if assert.NotNil(t, pErr) {
+		assert.Equal(t, ProxyAddrUnsupported, pErr.ErrType)
+	}
+	// resolved by the system resolver
+	cli = DirectTCPClient{AddressFamily: AddrFamilyPreferIPv4}
+	conn, _, pErr := cli.Request(
+		context.Background(), &DomainNameAddr{"localhost", port})
+	if assert.Nil(t, pErr) {
+		assert.Equal(t, "127.0.0.1",
+			conn.(net.Conn).RemoteAddr().(*net.TCPAddr).IP.String())
+		assert.NoError(t, conn.Close())
+	}
+}
+
+func TestDialHappyEyeballs(t *testing.T) {
+	l4, l6, port := listenDualStack(t)
+	defer func() { _ = l6.Close() }()
+	require.NoError(t, l4.Close()) // refused
+	go func() {
+		if conn, err := l6.Accept(); err == nil {
+			_ = conn.Close()
+		}
+	}()
+
+	// the fallback starts as soon as the primary ones fail
+	start := time.Now()
+	conn, err := dialHappyEyeballs(context.Background(),
+		&net.Dialer{FallbackDelay: time.Hour},
+		[]net.IP{net.ParseIP("127.0.0.1")}, []net.IP{net.ParseIP("::1")},
+		strconv.Itoa(int(port)))
+	require.NoError(t, err)
+	assert.True(t, time.Since(start) < time.Second)
+	assert.Equal(t, "::1", conn.RemoteAddr().(*net.TCPAddr).IP.String())
+	assert.NoError(t, conn.Close())
+
+	// the error of the primary ones is reported
+	require.NoError(t, l6.Close())
+	_, err = dialHappyEyeballs(context.Background(),
+		&net.Dialer{FallbackDelay: time.Millisecond},
+		[]net.IP{net.ParseIP("127.0.0.1")}, []net.IP{net.ParseIP("::1")},
+		strconv.Itoa(int(port)))
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "127.0.0.1")
+	}
+}
+
+func TestPartialDeadline(t *testing.T) {
+	now := time.Unix(1000, 0)
+	for _, c := range []struct {
+		timeLeft  time.Duration
+		addrsLeft int
+		expected  time.Duration
+	}{
+		{time.Second * 30, 1, time.Second * 30},
+		{time.Second * 30, 3, time.Second * 10},
+		{time.Second * 5, 5, minDialAttemptTimeout},
+		{time.Second, 2, time.Second},
+		{-time.Second, 2, -time.Second},
+	} {
+		assert.Equal(t, now.Add(c.expected),
+			partialDeadline(now, now.Add(c.timeLeft), c.addrsLeft),
+			"%v / %d", c.timeLeft, c.addrsLeft)
+	}
+}
+
+func TestDialErrorType(t *testing.T) {
+	opErr := func(err error) error {
+		return &net.OpError{Op: "dial", Net: "tcp", Err: err}
+	}
+	for _, c := range []struct {
+		err     error
+		errType ProxyErrorType
+	}{
+		{opErr(os.NewSyscallError("connect", syscall.ECONNREFUSED)),
+			ProxyConnectFailed},
+		{opErr(os.NewSyscallError("connect", syscall.ENETUNREACH)),
+			ProxyNetUnreachable},
+		{opErr(os.NewSyscallError("connect", syscall.EHOSTUNREACH)),
+			ProxyHostUnreachable},
+		{opErr(os.NewSyscallError("connect", syscall.ETIMEDOUT)),
+			ProxyTTLExpired},
+		{opErr(os.NewSyscallError("connect", syscall.EACCES)),
+			ProxyConnectFailed},
+		{opErr(&net.DNSError{Err: "no such host", Name: "a.b"}),
+			ProxyHostUnreachable},
+		{opErr(&net.DNSError{Err: "timeout", Name: "a.b", IsTimeout: true}),
+			ProxyTTLExpired},
+		{errors.WithStack(context.DeadlineExceeded), ProxyTTLExpired},
+		{errors.New("unknown"), ProxyConnectFailed},
+	} {
+		assert.Equal(t, c.errType, dialErrorType(c.err), "%v", c.err)
+	}
+
+	// connection refused by a real port
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr, err := ParseAddress(listener.Addr().String())
+	require.NoError(t, err)
+	require.NoError(t, listener.Close())
+	_, _, pErr := DirectTCPClient{}.Request(context.Background(), addr)
+	if assert.NotNil(t, pErr) {
+		assert.Equal(t, ProxyConnectFailed, pErr.ErrType)
+	}
+}
+
+func TestCreateProxyServerPreConn(t *testing.T) {
+	_, err := CreateProxyServer(zap.NewNop().Sugar(), ProxyConfig{
+		Protocol:  "socks5",
+		Settings:  map[string]interface{}{"address": "127.0.0.1:1080"},
+		Transport: &TransportConfig{PreConn: &PreConnConfig{}},
+	})
+	assert.Error(t, err)
+}
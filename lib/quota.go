@@ -0,0 +1,126 @@
+package lib
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/richardtsai/thestral2/db"
+	"go.uber.org/zap"
+)
+
+const defaultQuotaFlushInterval = time.Minute
+
+// QuotaUser identifies a user in the database.
+type QuotaUser struct {
+	Scope string
+	Name  string
+}
+
+// QuotaTracker enforces the traffic quotas of users. The usage is accumulated
+// in memory and persisted to the database periodically.
+type QuotaTracker struct {
+	log      *zap.SugaredLogger
+	interval time.Duration
+
+	lock    sync.Mutex
+	pending map[QuotaUser]uint64 // usage not yet persisted
+}
+
+// NewQuotaTracker creates a QuotaTracker which persists the usage at the given
+// interval. It requires the database to be initialized.
+func NewQuotaTracker(
+	log *zap.SugaredLogger, interval time.Duration) *QuotaTracker {
+	if interval <= 0 {
+		interval = defaultQuotaFlushInterval
+	}
+	return &QuotaTracker{
+		log:      log,
+		interval: interval,
+		pending:  make(map[QuotaUser]uint64),
+	}
+}
+
+// UserOf finds the first user in the database that matches one of the given
+// peer identifiers.
+func (q *QuotaTracker) UserOf(
+	peerIDs []*PeerIdentifier) (*QuotaUser, error) {
+	dao, err := db.NewUserDAO()
+	if err != nil {
+		return nil, err
+	}
+	defer dao.Close() // nolint: errcheck
+	for _, pid := range peerIDs {
+		if dao.CheckExists(pid.Scope, pid.UniqueID) {
+			return &QuotaUser{pid.Scope, pid.UniqueID}, nil
+		}
+	}
+	return nil, nil
+}
+
+// OverQuota checks if a user has used up the quota.
+func (q *QuotaTracker) OverQuota(user QuotaUser) (bool, error) {
+	dao, err := db.NewUserDAO()
+	if err != nil {
+		return false, err
+	}
+	defer dao.Close() // nolint: errcheck
+	u, err := dao.Get(user.Scope, user.Name)
+	if err != nil {
+		return false, err
+	}
+	q.lock.Lock()
+	pending := q.pending[user]
+	q.lock.Unlock()
+	return u.Quota > 0 && u.Usage()+pending >= u.Quota, nil
+}
+
+// AddUsage records the bytes transferred by a user.
+func (q *QuotaTracker) AddUsage(user QuotaUser, bytes uint32) {
+	q.lock.Lock()
+	q.pending[user] += uint64(bytes)
+	q.lock.Unlock()
+}
+
+// Run persists the usage periodically until the context is done.
+func (q *QuotaTracker) Run(ctx context.Context) {
+	ticker := time.NewTicker(q.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			q.flush()
+		case <-ctx.Done():
+			q.flush()
+			return
+		}
+	}
+}
+
+func (q *QuotaTracker) flush() {
+	q.lock.Lock()
+	pending := q.pending
+	q.pending = make(map[QuotaUser]uint64)
+	q.lock.Unlock()
+	if len(pending) == 0 {
+		return
+	}
+
+	dao, err := db.NewUserDAO()
+	if err != nil {
+		q.log.Warnw("failed to open user database", "error", err)
+		q.lock.Lock()
+		for user, bytes := range pending { // retry on the next flush
+			q.pending[user] += bytes
+		}
+		q.lock.Unlock()
+		return
+	}
+	defer dao.Close() // nolint: errcheck
+	for user, bytes := range pending {
+		if err = dao.AddUsage(user.Scope, user.Name, bytes); err != nil {
+			q.log.Warnw("failed to persist usage", "scope", user.Scope,
+				"user", user.Name, "bytes", bytes, "error", err)
+		}
+	}
+}
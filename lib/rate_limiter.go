@@ -0,0 +1,99 @@
+package lib
+
+import (
+	"container/list"
+	"math"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const defaultRateLimitMaxClients = 4096
+
+// ClientRateLimiter limits the rate of new connections from each client IP
+// with token buckets. Only the buckets of the most recent clients are kept so
+// that the memory usage is bounded, and a client evicted starts over with a
+// full bucket. A nil ClientRateLimiter imposes no limit.
+type ClientRateLimiter struct {
+	rate       float64 // tokens per second
+	burst      float64
+	maxClients int
+
+	lock    sync.Mutex
+	buckets map[string]*list.Element // IP -> element of *tokenBucket in lru
+	lru     *list.List               // the most recently used first
+}
+
+type tokenBucket struct {
+	key    string
+	tokens float64
+	last   time.Time
+}
+
+// NewClientRateLimiter creates a ClientRateLimiter from the given
+// configuration.
+func NewClientRateLimiter(config RateLimitConfig) (*ClientRateLimiter, error) {
+	if !(config.Rate > 0) || math.IsInf(config.Rate, 0) { // NaN included
+		return nil, errors.New("'rate' must be a positive number")
+	} else if config.Burst < 0 {
+		return nil, errors.New("'burst' must be >= 0")
+	} else if config.MaxClients < 0 {
+		return nil, errors.New("'max_clients' must be >= 0")
+	}
+	l := &ClientRateLimiter{
+		rate:       config.Rate,
+		burst:      float64(config.Burst),
+		maxClients: config.MaxClients,
+		buckets:    make(map[string]*list.Element),
+		lru:        list.New(),
+	}
+	if l.burst == 0 {
+		l.burst = math.Max(math.Ceil(l.rate), 1)
+	}
+	if l.maxClients == 0 {
+		l.maxClients = defaultRateLimitMaxClients
+	}
+	return l, nil
+}
+
+// Allow takes a token from the bucket of the client with the given address
+// (an IP with or without a port). It returns false if the bucket is empty.
+func (l *ClientRateLimiter) Allow(addr string) bool {
+	if l == nil {
+		return true
+	}
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	return l.allow(addr, time.Now())
+}
+
+func (l *ClientRateLimiter) allow(key string, now time.Time) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	var bucket *tokenBucket
+	if elem, ok := l.buckets[key]; ok {
+		l.lru.MoveToFront(elem)
+		bucket = elem.Value.(*tokenBucket)
+		elapsed := now.Sub(bucket.last).Seconds()
+		if elapsed > 0 {
+			bucket.tokens = math.Min(l.burst, bucket.tokens+elapsed*l.rate)
+		}
+	} else {
+		if l.lru.Len() >= l.maxClients {
+			oldest := l.lru.Back()
+			l.lru.Remove(oldest)
+			delete(l.buckets, oldest.Value.(*tokenBucket).key)
+		}
+		bucket = &tokenBucket{key: key, tokens: l.burst}
+		l.buckets[key] = l.lru.PushFront(bucket)
+	}
+	bucket.last = now
+	if bucket.tokens < 1 {
+		return false
+	}
+	bucket.tokens--
+	return true
+}
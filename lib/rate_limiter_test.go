@@ -0,0 +1,61 @@
+package lib
+
+import (
+	"math"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientRateLimiter(t *testing.T) {
+	var unlimited *ClientRateLimiter
+	for i := 0; i < 10; i++ {
+		assert.True(t, unlimited.Allow("127.0.0.1:1234"))
+	}
+
+	limiter, err := NewClientRateLimiter(
+		RateLimitConfig{Rate: 2, Burst: 3, MaxClients: 2})
+	require.NoError(t, err)
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		assert.True(t, limiter.allow("a", now))
+	}
+	assert.False(t, limiter.allow("a", now))
+	assert.True(t, limiter.allow("b", now))
+	// refilled at the rate
+	assert.True(t, limiter.allow("a", now.Add(time.Millisecond*500)))
+	assert.False(t, limiter.allow("a", now.Add(time.Millisecond*500)))
+	// never more than the burst
+	later := now.Add(time.Hour)
+	for i := 0; i < 3; i++ {
+		assert.True(t, limiter.allow("a", later))
+	}
+	assert.False(t, limiter.allow("a", later))
+
+	// the least recently used client is evicted
+	assert.True(t, limiter.allow("c", later))
+	assert.Len(t, limiter.buckets, 2)
+	assert.NotContains(t, limiter.buckets, "b")
+	assert.False(t, limiter.allow("a", later))
+
+	// the port is ignored
+	limiter, err = NewClientRateLimiter(RateLimitConfig{Rate: 0.001})
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, i == 0,
+			limiter.Allow("127.0.0.1:"+strconv.Itoa(1234+i)))
+	}
+}
+
+func TestClientRateLimiterConfig(t *testing.T) {
+	for _, config := range []RateLimitConfig{
+		{}, {Rate: -1}, {Rate: math.NaN()}, {Rate: math.Inf(1)},
+		{Rate: 1, Burst: -1}, {Rate: 1, MaxClients: -1},
+	} {
+		_, err := NewClientRateLimiter(config)
+		assert.Error(t, err, "%+v", config)
+	}
+}
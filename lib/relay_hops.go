@@ -0,0 +1,123 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// RelayHopsScope is the scope of the PeerIdentifier carrying the relay
+	// hops of a client, see RelayHopsOf.
+	RelayHopsScope = "proxy_protocol.relay_hops"
+
+	proxyProtoTypeRelayHops = 0xe0 // the first type for the custom TLVs
+	relayHopIDLen           = 8
+)
+
+// the prefix of the value of the TLV, in case the type is used by others
+var proxyProtoRelayHopsMagic = []byte("THS2")
+
+// relayInstanceID identifies this process in the relay hops. It's random so
+// that the instances on the same host are told apart.
+var relayInstanceID = newRelayInstanceID()
+
+func newRelayInstanceID() string {
+	id := make([]byte, relayHopIDLen)
+	_, _ = rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+type relayHopsKey struct{}
+
+// WithRelayHops returns a context carrying the relay hops a request has been
+// through before this instance. The DirectTCPClients sending PROXY protocol
+// headers pass them on along with this instance, so that the next instance
+// (of thestral) can tell if the request loops back. Without them, the header
+// carries this instance only.
+func WithRelayHops(ctx context.Context, hops []string) context.Context {
+	return context.WithValue(ctx, relayHopsKey{}, hops)
+}
+
+func relayHopsOf(ctx context.Context) []string {
+	hops, _ := ctx.Value(relayHopsKey{}).([]string)
+	return hops
+}
+
+// RelayHopsOf returns the relay hops of a client, which are read from the
+// PROXY protocol header sent by another instance, or nil if the header has
+// none, e.g. it's sent by a third party.
+func RelayHopsOf(peerIDs []*PeerIdentifier) []string {
+	for _, id := range peerIDs {
+		if id != nil && id.Scope == RelayHopsScope {
+			return strings.Split(id.UniqueID, ",")
+		}
+	}
+	return nil
+}
+
+// CheckRelayHops returns an error if a request having been through the relay
+// hops is in a loop, i.e. it has been through this instance, or there are
+// more than maxHops hops (unlimited if 0).
+func CheckRelayHops(hops []string, maxHops int) error {
+	for _, hop := range hops {
+		if hop == relayInstanceID {
+			return errors.Errorf(
+				"relay loop detected: %s", strings.Join(hops, " -> "))
+		}
+	}
+	if maxHops > 0 && len(hops) > maxHops {
+		return errors.Errorf(
+			"too many relay hops (%d > %d)", len(hops), maxHops)
+	}
+	return nil
+}
+
+// appendRelayHopsTLV appends the TLV of the relay hops followed by this
+// instance to the body of a PROXY protocol v2 header.
+func appendRelayHopsTLV(body []byte, hops []string) []byte {
+	value := append([]byte{}, proxyProtoRelayHopsMagic...)
+	for _, hop := range hops {
+		if id, err := hex.DecodeString(hop); err == nil &&
+			len(id) == relayHopIDLen {
+			value = append(value, id...)
+		}
+	}
+	id, _ := hex.DecodeString(relayInstanceID)
+	value = append(value, id...)
+	body = append(body, proxyProtoTypeRelayHops, 0, 0)
+	binary.BigEndian.PutUint16(body[len(body)-2:], uint16(len(value)))
+	return append(body, value...)
+}
+
+// parseRelayHopsTLV finds the relay hops in the TLVs of a PROXY protocol v2
+// header. The malformed TLVs are ignored like the unknown ones.
+func parseRelayHopsTLV(tlvs []byte) []string {
+	for len(tlvs) >= 3 {
+		typ, n := tlvs[0], int(binary.BigEndian.Uint16(tlvs[1:]))
+		if len(tlvs) < 3+n {
+			break
+		}
+		value := tlvs[3 : 3+n]
+		tlvs = tlvs[3+n:]
+		if typ != proxyProtoTypeRelayHops ||
+			!bytes.HasPrefix(value, proxyProtoRelayHopsMagic) {
+			continue
+		}
+		value = value[len(proxyProtoRelayHopsMagic):]
+		if len(value) == 0 || len(value)%relayHopIDLen != 0 {
+			break
+		}
+		var hops []string
+		for ; len(value) > 0; value = value[relayHopIDLen:] {
+			hops = append(hops, hex.EncodeToString(value[:relayHopIDLen]))
+		}
+		return hops
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+package lib
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRelayHopsHeader(t *testing.T) {
+	other := "0102030405060708"
+	for _, hops := range [][]string{nil, {other}, {other, "invalid"}} {
+		cli, svr := net.Pipe()
+		go func() {
+			ctx := WithClientAddr(context.Background(), "1.2.3.4:1234")
+			_ = writeProxyProtoHeader(WithRelayHops(ctx, hops), cli)
+		}()
+		conn, err := readProxyProtoHeader(svr, time.Second)
+		require.NoError(t, err)
+		expected := []string{relayInstanceID}
+		if len(hops) > 0 {
+			expected = []string{other, relayInstanceID}
+		}
+		assert.Equal(t, expected, conn.relayHops)
+		peerIDs, err := conn.GetPeerIdentifiers()
+		assert.NoError(t, err)
+		assert.Equal(t, expected, RelayHopsOf(peerIDs))
+		_ = cli.Close()
+		_ = svr.Close()
+	}
+
+	// the TLVs of the others are ignored
+	for _, tlvs := range [][]byte{
+		nil,
+		{0x01, 0x00, 0x02, 'h', '2'},
+		{0xe0, 0x00, 0x04, 'a', 'b', 'c', 'd'},
+		{0xe0, 0x00, 0x10},
+		append([]byte{0xe0, 0x00, 0x05}, append(
+			proxyProtoRelayHopsMagic, 0x01)...),
+	} {
+		assert.Nil(t, parseRelayHopsTLV(tlvs), "%v", tlvs)
+	}
+	assert.Equal(t, []string{other}, parseRelayHopsTLV(append(
+		[]byte{0x01, 0x00, 0x02, 'h', '2', 0xe0, 0x00, 0x0c}, append(
+			proxyProtoRelayHopsMagic, 1, 2, 3, 4, 5, 6, 7, 8)...)))
+}
+
+func TestCheckRelayHops(t *testing.T) {
+	assert.NoError(t, CheckRelayHops(nil, 1))
+	assert.NoError(t, CheckRelayHops([]string{"a", "b"}, 2))
+	assert.NoError(t, CheckRelayHops([]string{"a", "b", "c"}, 0))
+	assert.Error(t, CheckRelayHops([]string{"a", "b", "c"}, 2))
+	assert.Error(t, CheckRelayHops([]string{"a", relayInstanceID}, 0))
+	assert.Nil(t, RelayHopsOf([]*PeerIdentifier{
+		nil, {Scope: "transport.tls", UniqueID: "x"}}))
+}
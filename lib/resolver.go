@@ -0,0 +1,232 @@
+package lib
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultDNSCacheTTL        = time.Minute * 5
+	defaultDNSCacheMaxEntries = 4096
+	defaultProxiedDNSServer   = "8.8.8.8:53"
+)
+
+// DomainResolver resolves domain names into IPs.
+type DomainResolver interface {
+	LookupIP(ctx context.Context, domain string) ([]net.IP, error)
+}
+
+// CachingResolver is a DomainResolver which caches the results for a fixed
+// TTL, as the TTLs of the DNS records are not available. Failures are cached
+// for a separate TTL.
+type CachingResolver struct {
+	hits        uint64 // accessed atomically
+	misses      uint64 // accessed atomically
+	lookup      func(ctx context.Context, host string) ([]net.IPAddr, error)
+	ttl         time.Duration
+	negativeTTL time.Duration
+	maxEntries  int
+
+	lock  sync.Mutex
+	cache map[string]dnsCacheEntry
+}
+
+type dnsCacheEntry struct {
+	ips    []net.IP
+	err    error
+	expiry time.Time
+}
+
+// DNSCacheStats is the statistics of a CachingResolver.
+type DNSCacheStats struct {
+	Entries int
+	Hits    uint64
+	Misses  uint64
+}
+
+// NewCachingResolver creates a CachingResolver from the given configuration.
+// The system resolver is used if neither a server nor DoH is specified.
+func NewCachingResolver(config DNSConfig) (*CachingResolver, error) {
+	r := &CachingResolver{
+		lookup:     net.DefaultResolver.LookupIPAddr,
+		ttl:        defaultDNSCacheTTL,
+		maxEntries: defaultDNSCacheMaxEntries,
+		cache:      make(map[string]dnsCacheEntry),
+	}
+	if config.Server != "" {
+		server := config.Server
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			server = net.JoinHostPort(server, "53")
+		}
+		resolver := &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (
+				net.Conn, error) {
+				return new(net.Dialer).DialContext(ctx, network, server)
+			},
+		}
+		r.lookup = resolver.LookupIPAddr
+	}
+	if config.DoH != nil {
+		if config.Server != "" {
+			return nil, errors.New("'doh' cannot be used along with 'server'")
+		}
+		doh, err := NewDoHResolver(*config.DoH)
+		if err != nil {
+			return nil, err
+		}
+		r.lookup = func(ctx context.Context, host string) (
+			[]net.IPAddr, error) {
+			ips, err := doh.LookupIP(ctx, host)
+			addrs := make([]net.IPAddr, len(ips))
+			for i := range ips {
+				addrs[i].IP = ips[i]
+			}
+			return addrs, err
+		}
+	}
+	for _, ttl := range []struct {
+		name  string
+		value string
+		dst   *time.Duration
+	}{
+		{"cache_ttl", config.CacheTTL, &r.ttl},
+		{"negative_ttl", config.NegativeTTL, &r.negativeTTL},
+	} {
+		if ttl.value == "" {
+			continue
+		}
+		d, err := time.ParseDuration(ttl.value)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid value for '%s'", ttl.name)
+		} else if d < 0 {
+			return nil, errors.Errorf("'%s' must be >= 0", ttl.name)
+		}
+		*ttl.dst = d
+	}
+	if config.MaxEntries < 0 {
+		return nil, errors.New("'max_entries' must be >= 0")
+	} else if config.MaxEntries > 0 {
+		r.maxEntries = config.MaxEntries
+	}
+	return r, nil
+}
+
+// NewProxiedResolver creates a CachingResolver querying the DNS server (8.8.8.8
+// by default) over TCP through the upstream, so that the lookups don't leak to
+// the local network (while the hosts file is still consulted). The cache is
+// set up by the given configuration, whose server and DoH are ignored.
+func NewProxiedResolver(
+	config DNSConfig, upstream ProxyClient, server string) (
+	*CachingResolver, error) {
+	if server == "" {
+		server = defaultProxiedDNSServer
+	} else if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, "53")
+	}
+	if _, err := ParseAddress(server); err != nil {
+		return nil, errors.WithMessage(err, "invalid DNS server")
+	}
+	config.Server, config.DoH = "", nil
+	r, err := NewCachingResolver(config)
+	if err != nil {
+		return nil, err
+	}
+	transport := &ProxiedTransport{upstream}
+	resolver := &net.Resolver{
+		PreferGo: true,
+		// a connection other than a PacketConn is queried as a TCP one
+		Dial: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			conn, err := transport.Dial(ctx, server)
+			if err != nil {
+				return nil, err
+			}
+			// the deadlines may be unsupported via the upstream, while the
+			// context is done once the query is over
+			go func() {
+				<-ctx.Done()
+				_ = conn.Close()
+			}()
+			return conn, nil
+		},
+	}
+	r.lookup = resolver.LookupIPAddr
+	return r, nil
+}
+
+// LookupIP resolves a domain name, or returns the cached result if any. The
+// lookup on a cache miss is bounded by the context.
+func (r *CachingResolver) LookupIP(
+	ctx context.Context, domain string) ([]net.IP, error) {
+	domain = normalizeDomain(domain)
+	now := time.Now()
+	r.lock.Lock()
+	entry, ok := r.cache[domain]
+	r.lock.Unlock()
+	if ok && now.Before(entry.expiry) {
+		atomic.AddUint64(&r.hits, 1)
+		return entry.ips, entry.err
+	}
+	atomic.AddUint64(&r.misses, 1)
+
+	var ips []net.IP
+	addrs, err := r.lookup(ctx, domain)
+	if err == nil {
+		ips = make([]net.IP, len(addrs))
+		for i := range addrs {
+			ips[i] = addrs[i].IP
+		}
+	} else {
+		err = errors.WithStack(err)
+	}
+	ttl := r.ttl
+	if err != nil {
+		ttl = r.negativeTTL
+		if ctx.Err() != nil {
+			ttl = 0 // not a failure of the domain itself
+		}
+	}
+	if ttl > 0 {
+		r.lock.Lock()
+		r.makeRoom(now)
+		r.cache[domain] = dnsCacheEntry{ips, err, now.Add(ttl)}
+		r.lock.Unlock()
+	}
+	return ips, err
+}
+
+// makeRoom removes the expired entries if the cache is full, and then some
+// arbitrary ones if it's still full. The lock must be held.
+func (r *CachingResolver) makeRoom(now time.Time) {
+	if len(r.cache) < r.maxEntries {
+		return
+	}
+	for k, v := range r.cache {
+		if !now.Before(v.expiry) {
+			delete(r.cache, k)
+		}
+	}
+	for k := range r.cache {
+		if len(r.cache) < r.maxEntries {
+			break
+		}
+		delete(r.cache, k)
+	}
+}
+
+// Stats returns the statistics of the cache.
+func (r *CachingResolver) Stats() DNSCacheStats {
+	r.lock.Lock()
+	entries := len(r.cache)
+	r.lock.Unlock()
+	return DNSCacheStats{
+		Entries: entries,
+		Hits:    atomic.LoadUint64(&r.hits),
+		Misses:  atomic.LoadUint64(&r.misses),
+	}
+}
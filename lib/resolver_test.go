@@ -0,0 +1,185 @@
+package lib
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCachingResolver(t *testing.T) {
+	r, err := NewCachingResolver(DNSConfig{CacheTTL: "100ms"})
+	require.NoError(t, err)
+	lookups := 0
+	r.lookup = func(ctx context.Context, host string) ([]net.IPAddr, error) {
+		lookups++
+		if host == "example.com" {
+			return []net.IPAddr{{IP: net.ParseIP("1.2.3.4")}}, nil
+		}
+		return nil, &net.DNSError{Err: "no such host", Name: host}
+	}
+
+	for _, domain := range []string{"example.com", "EXAMPLE.com."} {
+		ips, err := r.LookupIP(context.Background(), domain)
+		assert.NoError(t, err)
+		assert.Equal(t, []net.IP{net.ParseIP("1.2.3.4")}, ips)
+	}
+	assert.Equal(t, 1, lookups)
+	time.Sleep(time.Millisecond * 150) // expired
+	_, _ = r.LookupIP(context.Background(), "example.com")
+	assert.Equal(t, 2, lookups)
+
+	// failures are not cached
+	for i := 0; i < 2; i++ {
+		_, err = r.LookupIP(context.Background(), "invalid.invalid")
+		assert.Error(t, err)
+	}
+	assert.Equal(t, 4, lookups)
+	assert.Equal(t, DNSCacheStats{Entries: 1, Hits: 1, Misses: 4}, r.Stats())
+
+	for _, config := range []DNSConfig{
+		{CacheTTL: "-1s"}, {NegativeTTL: "x"}, {MaxEntries: -1},
+	} {
+		_, err = NewCachingResolver(config)
+		assert.Error(t, err, "%+v", config)
+	}
+	r, err = NewCachingResolver(DNSConfig{Server: "127.0.0.1"})
+	assert.NoError(t, err)
+}
+
+func TestCachingResolverLimits(t *testing.T) {
+	r, err := NewCachingResolver(
+		DNSConfig{NegativeTTL: "1m", MaxEntries: 2})
+	require.NoError(t, err)
+	lookups := 0
+	r.lookup = func(ctx context.Context, host string) ([]net.IPAddr, error) {
+		lookups++
+		if host == "slow.com" {
+			<-ctx.Done()
+			return nil, ctx.Err()
+		}
+		return nil, &net.DNSError{Err: "no such host", Name: host}
+	}
+
+	// failures are cached for the negative TTL
+	for i := 0; i < 2; i++ {
+		_, err = r.LookupIP(context.Background(), "invalid.invalid")
+		assert.Error(t, err)
+	}
+	assert.Equal(t, 1, lookups)
+
+	// but not those due to the context
+	ctx, cancel := context.WithTimeout(
+		context.Background(), time.Millisecond*10)
+	defer cancel()
+	_, err = r.LookupIP(ctx, "slow.com")
+	assert.Error(t, err)
+	assert.Equal(t, 1, r.Stats().Entries)
+
+	// the size of the cache is limited
+	for _, domain := range []string{"a.invalid", "b.invalid", "c.invalid"} {
+		_, _ = r.LookupIP(context.Background(), domain)
+	}
+	assert.Equal(t, 2, r.Stats().Entries)
+}
+
+// dnsProxyClient is a ProxyClient serving the DNS queries over TCP to any
+// address by mockDNSResponse.
+type dnsProxyClient struct {
+	t       *testing.T
+	mtx     sync.Mutex
+	targets []string
+}
+
+func (c *dnsProxyClient) Request(_ context.Context, addr Address) (
+	io.ReadWriteCloser, Address, *ProxyError) {
+	c.mtx.Lock()
+	c.targets = append(c.targets, addr.String())
+	c.mtx.Unlock()
+	conn, peer := net.Pipe()
+	go func() {
+		defer func() { _ = peer.Close() }()
+		for {
+			var size uint16
+			if binary.Read(peer, binary.BigEndian, &size) != nil {
+				return
+			}
+			query := make([]byte, size)
+			if _, err := io.ReadFull(peer, query); err != nil {
+				return
+			}
+			resp := mockDNSResponse(c.t, query)
+			if binary.Write(peer, binary.BigEndian, uint16(len(resp))) != nil {
+				return
+			} else if _, err := peer.Write(resp); err != nil {
+				return
+			}
+		}
+	}()
+	return conn, addr, nil
+}
+
+func TestProxiedResolver(t *testing.T) {
+	upstream := &dnsProxyClient{t: t}
+	r, err := NewProxiedResolver(
+		DNSConfig{Server: "192.0.2.1", CacheTTL: "0"}, upstream, "127.0.0.2")
+	require.NoError(t, err)
+	ips, err := r.LookupIP(context.Background(), "example.com")
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []net.IP{
+		net.IPv4(1, 2, 3, 4).To4(), net.ParseIP("2001:db8::1")}, ips)
+	_, err = r.LookupIP(context.Background(), "not.found")
+	assert.Error(t, err)
+	upstream.mtx.Lock()
+	for _, target := range upstream.targets {
+		assert.Equal(t, "127.0.0.2:53", target)
+	}
+	upstream.mtx.Unlock()
+
+	r, err = NewProxiedResolver(DNSConfig{}, upstream, "")
+	require.NoError(t, err)
+	_, err = r.LookupIP(context.Background(), "example.com")
+	require.NoError(t, err)
+	upstream.mtx.Lock()
+	assert.Equal(t, "8.8.8.8:53", upstream.targets[len(upstream.targets)-1])
+	upstream.mtx.Unlock()
+
+	_, err = NewProxiedResolver(DNSConfig{}, upstream, "[bad")
+	assert.Error(t, err)
+}
+
+func TestRuleMatcherResolver(t *testing.T) {
+	m, err := NewRuleMatcher(map[string]RuleConfig{
+		"lan":     {Upstreams: []string{"l"}, IPs: []string{"10.0.0.0/8"}},
+		"blocked": {Domains: []string{"blocked.com"}},
+		"default": {Upstreams: []string{"o"}},
+	})
+	require.NoError(t, err)
+	r, err := NewCachingResolver(DNSConfig{})
+	require.NoError(t, err)
+	r.lookup = func(ctx context.Context, host string) ([]net.IPAddr, error) {
+		if host == "internal.com" || host == "blocked.com" {
+			return []net.IPAddr{{IP: net.ParseIP("10.1.2.3")}}, nil
+		}
+		return nil, &net.DNSError{Err: "no such host", Name: host}
+	}
+	m.SetResolver(r)
+
+	name, _, ip := m.MatchResolvedDomain(context.Background(), "internal.com")
+	assert.Equal(t, "lan", name)
+	assert.Equal(t, net.ParseIP("10.1.2.3"), ip)
+	// domain rules go first
+	name, _, ip = m.MatchResolvedDomain(context.Background(), "blocked.com")
+	assert.Equal(t, "blocked", name)
+	assert.Nil(t, ip)
+	// fall back to domain rules on failures
+	name, _, ip = m.MatchResolvedDomain(context.Background(), "unknown.com")
+	assert.Equal(t, "default", name)
+	assert.Nil(t, ip)
+}
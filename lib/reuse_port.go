@@ -0,0 +1,19 @@
+// +build !linux
+
+package lib
+
+import (
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// reusePortSupported tells if multiple listeners can be opened on the same
+// address (see TCPOptions.Listeners) on this platform.
+const reusePortSupported = false
+
+// setReusePort fails as SO_REUSEPORT balancing the connections among the
+// listeners is only supported on Linux.
+func setReusePort(_, _ string, _ syscall.RawConn) error {
+	return errors.New("SO_REUSEPORT is only supported on Linux")
+}
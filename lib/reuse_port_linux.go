@@ -0,0 +1,26 @@
+package lib
+
+import (
+	"syscall"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// reusePortSupported tells if multiple listeners can be opened on the same
+// address (see TCPOptions.Listeners) on this platform.
+const reusePortSupported = true
+
+// setReusePort is a listener control function setting SO_REUSEPORT, so that
+// the sockets of the listeners can be bound to the same address.
+func setReusePort(_, _ string, c syscall.RawConn) error {
+	var err error
+	cErr := c.Control(func(fd uintptr) {
+		err = unix.SetsockoptInt(
+			int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+	})
+	if cErr != nil {
+		err = cErr
+	}
+	return errors.Wrap(err, "failed to set SO_REUSEPORT")
+}
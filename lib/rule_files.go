@@ -0,0 +1,108 @@
+package lib
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+const ruleFileFetchTimeout = time.Second * 30
+
+// LoadRuleFiles reads the rule files referenced by the given rules and returns
+// a copy of the rules with the entries in those files merged into their
+// domains and IPs.
+//
+// Each file contains one domain name or IP/CIDR per line, and texts after a
+// '#' are comments. Unlike the domains in the configuration, the domain names
+// in the files must be plain names (see plainDomainRe) rather than regular
+// expressions. Malformed lines are skipped with a warning. A file is referenced
+// by a path, a glob pattern, or an http(s) URL.
+func LoadRuleFiles(
+	log *zap.SugaredLogger,
+	rules map[string]RuleConfig) (map[string]RuleConfig, error) {
+	result := make(map[string]RuleConfig, len(rules))
+	for name, rule := range rules {
+		if len(rule.Files) > 0 {
+			rule.IPs = append([]string{}, rule.IPs...)
+			rule.Domains = append([]string{}, rule.Domains...)
+		}
+		for _, file := range rule.Files {
+			if err := loadRuleFile(log, file, &rule); err != nil {
+				return nil, errors.WithMessage(
+					err, "failed to load rule file of rule: "+name)
+			}
+		}
+		result[name] = rule
+	}
+	return result, nil
+}
+
+func loadRuleFile(log *zap.SugaredLogger, file string, rule *RuleConfig) error {
+	if strings.HasPrefix(file, "http://") ||
+		strings.HasPrefix(file, "https://") {
+		client := http.Client{Timeout: ruleFileFetchTimeout}
+		resp, err := client.Get(file)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		defer func() { _ = resp.Body.Close() }()
+		if resp.StatusCode != http.StatusOK {
+			return errors.Errorf(
+				"failed to fetch %s: %s", file, resp.Status)
+		}
+		return parseRuleFile(log, file, resp.Body, rule)
+	}
+
+	paths, err := filepath.Glob(file)
+	if err != nil {
+		return errors.WithStack(err)
+	} else if len(paths) == 0 {
+		return errors.New("no such rule file: " + file)
+	}
+	for _, path := range paths {
+		f, err := os.Open(path)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		err = parseRuleFile(log, path, f, rule)
+		_ = f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func parseRuleFile(
+	log *zap.SugaredLogger, file string, r io.Reader, rule *RuleConfig) error {
+	scanner := bufio.NewScanner(r)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := scanner.Text()
+		if idx := strings.IndexByte(line, '#'); idx >= 0 {
+			line = line[:idx]
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		if _, _, err := net.ParseCIDR(line); err == nil ||
+			net.ParseIP(line) != nil {
+			rule.IPs = append(rule.IPs, line)
+		} else if plainDomainRe.MatchString(line) {
+			rule.Domains = append(rule.Domains, line)
+		} else {
+			log.Warnw("malformed line in rule file skipped",
+				"file", file, "line", lineNo, "content", line)
+		}
+	}
+	return errors.WithStack(scanner.Err())
+}
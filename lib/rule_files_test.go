@@ -0,0 +1,77 @@
+package lib
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestLoadRuleFiles(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "thestral2_TestLoadRuleFiles")
+	require.NoError(t, err)
+	defer func() { _ = os.RemoveAll(tmpDir) }()
+
+	files := map[string]string{
+		"a.list": "# comment\nexample.com\n\n  sub.example.org  # trailing\n",
+		"b.list": "10.0.0.0/8\n::1\nbad domain\n",
+	}
+	for name, content := range files {
+		require.NoError(t, ioutil.WriteFile(
+			filepath.Join(tmpDir, name), []byte(content), 0600))
+	}
+	svr := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/remote.list" {
+				_, _ = w.Write([]byte("remote.net\n192.168.0.0/16\n"))
+			} else {
+				http.NotFound(w, r)
+			}
+		}))
+	defer svr.Close()
+
+	log := zap.NewNop().Sugar()
+	rules := map[string]RuleConfig{
+		"local": {
+			Upstreams: []string{"u"},
+			Domains:   []string{`inline\.com`},
+			Files:     []string{filepath.Join(tmpDir, "*.list")},
+		},
+		"remote": {
+			Upstreams: []string{"u"},
+			Files:     []string{svr.URL + "/remote.list"},
+		},
+	}
+	loaded, err := LoadRuleFiles(log, rules)
+	require.NoError(t, err)
+	assert.Equal(t, []string{`inline\.com`}, rules["local"].Domains)
+	assert.Equal(t,
+		[]string{`inline\.com`, "example.com", "sub.example.org"},
+		loaded["local"].Domains)
+	assert.Equal(t, []string{"10.0.0.0/8", "::1"}, loaded["local"].IPs)
+	assert.Equal(t, []string{"remote.net"}, loaded["remote"].Domains)
+	assert.Equal(t, []string{"192.168.0.0/16"}, loaded["remote"].IPs)
+
+	m, err := NewRuleMatcher(loaded)
+	require.NoError(t, err)
+	name, _ := m.MatchDomain("sub.example.org")
+	assert.Equal(t, "local", name)
+	name, _ = m.MatchDomain("examplexcom")
+	assert.Equal(t, "", name)
+	name, _ = m.MatchIP(net.ParseIP("192.168.1.1"))
+	assert.Equal(t, "remote", name)
+
+	_, err = LoadRuleFiles(log, map[string]RuleConfig{
+		"r": {Files: []string{filepath.Join(tmpDir, "none.list")}}})
+	assert.Error(t, err)
+	_, err = LoadRuleFiles(log, map[string]RuleConfig{
+		"r": {Files: []string{svr.URL + "/none.list"}}})
+	assert.Error(t, err)
+}
@@ -1,21 +1,57 @@
 package lib
 
 import (
-	"bytes"
+	"context"
 	"fmt"
 	"net"
 	"regexp"
+	"regexp/syntax"
+	"sort"
+	"strings"
+	"time"
 
 	"github.com/pkg/errors"
 )
 
-const defaultRuleName = "default"
+// DefaultRuleName is the name of the rule matching the requests unmatched by
+// any other rule.
+const DefaultRuleName = "default"
+
+// UnhealthyPolicy is what to do with the requests matching a rule if all of
+// its upstreams are unhealthy.
+type UnhealthyPolicy string
+
+// nolint: golint
+const (
+	UnhealthyFailFast UnhealthyPolicy = "fail_fast" // the default
+	// use the upstreams of the default rule, or all of them if there's none
+	UnhealthyFallbackDefault UnhealthyPolicy = "default"
+	// try the one whose health check failed least recently anyway
+	UnhealthyLeastRecentlyFailed UnhealthyPolicy = "least_recently_failed"
+)
+
+// RuleAction is what to do with the requests matching a rule.
+type RuleAction string
+
+// nolint: golint
+const (
+	RuleProxy RuleAction = "proxy" // via the upstreams of the rule
+	RuleDeny  RuleAction = "deny"  // rejected as blocked, without upstreams
+)
 
 // RuleMatcher match an address (IP or domain name) against a set of rules.
 type RuleMatcher struct {
 	domainMatcher   *domainMatcher
 	ipMatcher       *ipMatcher
+	countryToRule   map[string]string
+	countryLookup   CountryLookup // country rules are skipped if nil
+	resolver        DomainResolver
 	ruleToUpstreams map[string][]string
+	ruleBandwidth   map[string]uint64 // bytes per second, unlimited if absent
+	ruleTimeout     map[string]time.Duration
+	ruleTags        map[string][]string
+	rulePolicy      map[string]UnhealthyPolicy // fail-fast if absent
+	ruleDenied      map[string]bool
 
 	AllUpstreams []string
 }
@@ -24,12 +60,18 @@ type RuleMatcher struct {
 func NewRuleMatcher(config map[string]RuleConfig) (*RuleMatcher, error) {
 	m := &RuleMatcher{}
 	m.ruleToUpstreams = make(map[string][]string)
+	m.ruleBandwidth = make(map[string]uint64)
+	m.ruleTimeout = make(map[string]time.Duration)
+	m.ruleTags = make(map[string][]string)
+	m.rulePolicy = make(map[string]UnhealthyPolicy)
+	m.ruleDenied = make(map[string]bool)
 	domainRules := make(map[string][]string)
 	ipRules := make(map[string][]string)
+	m.countryToRule = make(map[string]string)
 
 	for name, c := range config {
-		if name == defaultRuleName {
-			if len(c.Domains) > 0 || len(c.IPs) > 0 {
+		if name == DefaultRuleName {
+			if len(c.Domains) > 0 || len(c.IPs) > 0 || len(c.Countries) > 0 {
 				return nil, errors.Errorf(
 					"default rule '%s' should not have actual rules", name)
 			}
@@ -37,8 +79,72 @@ func NewRuleMatcher(config map[string]RuleConfig) (*RuleMatcher, error) {
 			domainRules[name] = append([]string{}, c.Domains...)
 			ipRules[name] = append([]string{}, c.IPs...)
 		}
+		for _, country := range c.Countries {
+			country = strings.ToUpper(country)
+			if country == "" {
+				return nil, errors.Errorf("empty country in rule '%s'", name)
+			} else if _, dup := m.countryToRule[country]; dup {
+				return nil, errors.New("duplicated country: " + country)
+			}
+			m.countryToRule[country] = name
+		}
+		switch RuleAction(c.Action) {
+		case "": // rejecting if there's no upstream, which is deprecated
+		case RuleProxy:
+			if len(c.Upstreams) == 0 {
+				return nil, errors.Errorf(
+					"rule '%s' to proxy has no upstream", name)
+			}
+		case RuleDeny:
+			if len(c.Upstreams) > 0 {
+				return nil, errors.Errorf(
+					"rule '%s' to deny should not have upstreams", name)
+			}
+			m.ruleDenied[name] = true
+		default:
+			return nil, errors.Errorf(
+				"invalid action of rule '%s': %s", name, c.Action)
+		}
 		m.ruleToUpstreams[name] = append([]string{}, c.Upstreams...)
 		m.AllUpstreams = append(m.AllUpstreams, c.Upstreams...)
+		if c.Bandwidth != "" {
+			bandwidth, err := ParseByteSize(c.Bandwidth)
+			if err != nil {
+				return nil, errors.WithMessage(
+					err, "invalid bandwidth of rule: "+name)
+			} else if bandwidth == 0 {
+				return nil, errors.Errorf(
+					"bandwidth of rule '%s' should be greater than 0", name)
+			}
+			m.ruleBandwidth[name] = bandwidth
+		}
+		if c.ConnectTimeout != "" {
+			timeout, err := time.ParseDuration(c.ConnectTimeout)
+			if err != nil {
+				return nil, errors.WithMessage(
+					err, "invalid connect_timeout of rule: "+name)
+			} else if timeout <= 0 {
+				return nil, errors.Errorf(
+					"connect_timeout of rule '%s' should be positive", name)
+			}
+			m.ruleTimeout[name] = timeout
+		}
+		for _, tag := range c.Tags {
+			if tag == "" {
+				return nil, errors.Errorf("empty tag in rule '%s'", name)
+			}
+		}
+		if len(c.Tags) > 0 {
+			m.ruleTags[name] = append([]string{}, c.Tags...)
+		}
+		switch policy := UnhealthyPolicy(c.UnhealthyPolicy); policy {
+		case "", UnhealthyFailFast:
+		case UnhealthyFallbackDefault, UnhealthyLeastRecentlyFailed:
+			m.rulePolicy[name] = policy
+		default:
+			return nil, errors.Errorf(
+				"invalid unhealthy_policy of rule '%s': %s", name, policy)
+		}
 	}
 
 	var err error
@@ -49,80 +155,250 @@ func NewRuleMatcher(config map[string]RuleConfig) (*RuleMatcher, error) {
 	return m, err
 }
 
+// SetCountryLookup enables the country rules with the given lookup. The
+// country rules are skipped until this is called.
+func (m *RuleMatcher) SetCountryLookup(lookup CountryLookup) {
+	m.countryLookup = lookup
+}
+
+// SetResolver makes the domains not matching any domain rule always resolved
+// with the given resolver and matched like IPs. Without a resolver, they are
+// resolved with the system resolver only if there are country rules in effect.
+func (m *RuleMatcher) SetResolver(resolver DomainResolver) {
+	m.resolver = resolver
+}
+
+// HasCountryRules reports whether any country rule is in effect.
+func (m *RuleMatcher) HasCountryRules() bool {
+	return m.countryLookup != nil && len(m.countryToRule) > 0
+}
+
 // MatchDomain returns the matching rule and associated upstreams of a domain.
+// See domainMatcher for the precedence of domain patterns.
 func (m *RuleMatcher) MatchDomain(domain string) (string, []string) {
 	rule, matched := m.domainMatcher.Match(domain)
-	if matched { // match
-		return rule, m.ruleToUpstreams[rule]
-	} else if ups, ok := m.ruleToUpstreams[defaultRuleName]; ok { // has default
-		return defaultRuleName, ups
-	} else { // no default
-		return "", nil
+	return m.result(rule, matched)
+}
+
+// MatchResolvedDomain is like MatchDomain, except that if no domain rule
+// matches, the domain may be resolved (see SetResolver) and its first address
+// is matched like MatchIP. The address is also returned in that case. Domain
+// rules are used if the resolution fails.
+func (m *RuleMatcher) MatchResolvedDomain(
+	ctx context.Context, domain string) (string, []string, net.IP) {
+	rule, matched := m.domainMatcher.Match(domain)
+	if !matched && (m.resolver != nil || m.HasCountryRules()) {
+		var ips []net.IP
+		var err error
+		if m.resolver != nil {
+			ips, err = m.resolver.LookupIP(ctx, domain)
+		} else {
+			ips, err = net.DefaultResolver.LookupIP(ctx, "ip", domain)
+		}
+		if err == nil && len(ips) > 0 {
+			rule, ups := m.MatchIP(ips[0])
+			return rule, ups, ips[0]
+		}
 	}
+	rule, ups := m.result(rule, matched)
+	return rule, ups, nil
 }
 
 // MatchIP returns the matching rule and associated upstreams of an IP.
 func (m *RuleMatcher) MatchIP(ip net.IP) (string, []string) {
 	rule, matched := m.ipMatcher.Match(ip)
+	if !matched && m.HasCountryRules() {
+		rule, matched = m.countryToRule[m.countryLookup.Country(ip)]
+	}
+	return m.result(rule, matched)
+}
+
+// Bandwidth returns the bandwidth limit in bytes per second of each direction
+// of the tunnels matching the given rule, or 0 if they are unlimited.
+func (m *RuleMatcher) Bandwidth(rule string) uint64 {
+	return m.ruleBandwidth[rule]
+}
+
+// ConnectTimeout returns the connect timeout of the requests matching the
+// given rule, or 0 if the global one applies.
+func (m *RuleMatcher) ConnectTimeout(rule string) time.Duration {
+	return m.ruleTimeout[rule]
+}
+
+// Tags returns the tags of the tunnels matching the given rule. The returned
+// slice should not be modified.
+func (m *RuleMatcher) Tags(rule string) []string {
+	return m.ruleTags[rule]
+}
+
+// UnhealthyPolicy returns the policy of the requests matching the given rule
+// if all of its upstreams are unhealthy.
+func (m *RuleMatcher) UnhealthyPolicy(rule string) UnhealthyPolicy {
+	if policy, ok := m.rulePolicy[rule]; ok {
+		return policy
+	}
+	return UnhealthyFailFast
+}
+
+// Denies tells whether the requests matching the given rule are denied by
+// its action, as opposed to a rule which has no upstream by mistake.
+func (m *RuleMatcher) Denies(rule string) bool {
+	return m.ruleDenied[rule]
+}
+
+// DefaultUpstreams returns the upstreams of the default rule, or false if
+// there's no default rule.
+func (m *RuleMatcher) DefaultUpstreams() ([]string, bool) {
+	ups, ok := m.ruleToUpstreams[DefaultRuleName]
+	return ups, ok
+}
+
+func (m *RuleMatcher) result(rule string, matched bool) (string, []string) {
 	if matched { // match
 		return rule, m.ruleToUpstreams[rule]
-	} else if ups, ok := m.ruleToUpstreams[defaultRuleName]; ok { // has default
-		return defaultRuleName, ups
+	} else if ups, ok := m.ruleToUpstreams[DefaultRuleName]; ok { // has default
+		return DefaultRuleName, ups
 	} else { // no default
 		return "", nil
 	}
 }
 
+// plainDomainRe matches the domain patterns that are treated as plain names
+// instead of regular expressions, i.e. "a.com" (exact), ".a.com" (any
+// subdomain of a.com, but not a.com itself) and "*.a.com" (exactly one label
+// before a.com).
+var plainDomainRe = regexp.MustCompile(
+	`^(\*?\.)?[0-9A-Za-z_-]+(\.[0-9A-Za-z_-]+)*\.?$`)
+
+// domainMatcher matches domains against domain patterns, which are either
+// plain names (see plainDomainRe) or regular expressions. Matching is
+// case-insensitive, and trailing dots of domains are ignored. The precedence
+// is as follows, and the first match wins:
+//  1. exact names, including regular expressions that are plain literals
+//     (e.g. `a\.com`)
+//  2. wildcards ("*.a.com")
+//  3. suffixes (".a.com" or `.*\.a\.com`), the longest one first
+//  4. the other regular expressions, in the order of the rule names and the
+//     order in which they are listed
 type domainMatcher struct {
-	pattern         *regexp.Regexp
-	ruleSubmatchIDs map[string]int
+	exact     map[string]string // domain -> rule
+	wildcards map[string]string // parent domain -> rule
+	suffixes  map[string]string // suffix (starts with a dot) -> rule
+	regexps   []domainRegexp
+}
+
+type domainRegexp struct {
+	rule    string
+	pattern *regexp.Regexp
 }
 
 func newDomainMatcher(rules map[string][]string) (*domainMatcher, error) {
-	m := &domainMatcher{}
+	m := &domainMatcher{
+		exact:     make(map[string]string),
+		wildcards: make(map[string]string),
+		suffixes:  make(map[string]string),
+	}
 
-	if len(rules) == 0 {
-		m.pattern = regexp.MustCompile("^$")
-		return m, nil
+	names := make([]string, 0, len(rules))
+	for name := range rules {
+		names = append(names, name)
 	}
+	sort.Strings(names)
 
-	buf := bytes.NewBufferString("(?i)")
-	for name, patterns := range rules {
-		if len(patterns) > 0 {
-			fmt.Fprintf(buf, "(?P<%s>", name)
-			for _, pattern := range patterns {
-				fmt.Fprintf(buf, "(^%s$)|", pattern)
+	for _, name := range names {
+		for _, pattern := range rules[name] {
+			table, key, err := m.classify(pattern)
+			if err != nil {
+				return nil, errors.Wrapf(
+					err, "invalid domain pattern in rule '%s': %s",
+					name, pattern)
+			}
+			if table == nil {
+				m.regexps = append(m.regexps, domainRegexp{
+					name, regexp.MustCompile("(?i)^(?:" + pattern + ")$")})
+				continue
 			}
-			buf.Truncate(buf.Len() - 1)
-			buf.WriteString(")|")
+			key = normalizeDomain(key)
+			if prev, ok := table[key]; ok && prev != name {
+				return nil, errors.Errorf(
+					"domain pattern in both rule '%s' and '%s': %s",
+					prev, name, pattern)
+			}
+			table[key] = name
 		}
 	}
-	buf.Truncate(buf.Len() - 1)
-	var err error
-	m.pattern, err = regexp.Compile(buf.String())
+	return m, nil
+}
+
+// classify finds the table that a pattern should be put into, or returns a nil
+// table if the pattern has to be evaluated as a regular expression.
+func (m *domainMatcher) classify(
+	pattern string) (map[string]string, string, error) {
+	if plainDomainRe.MatchString(pattern) {
+		if strings.HasPrefix(pattern, "*.") {
+			return m.wildcards, pattern[2:], nil
+		} else if strings.HasPrefix(pattern, ".") {
+			return m.suffixes, pattern, nil
+		}
+		return m.exact, pattern, nil
+	}
+
+	re, err := syntax.Parse(pattern, syntax.Perl)
 	if err != nil {
-		return nil, err
+		return nil, "", err
+	}
+	re = re.Simplify()
+	if re.Op == syntax.OpLiteral {
+		return m.exact, string(re.Rune), nil
+	} else if suffix, ok := literalSuffix(re); ok {
+		return m.suffixes, suffix, nil
 	}
+	return nil, "", nil
+}
 
-	m.ruleSubmatchIDs = make(map[string]int)
-	for idx, name := range m.pattern.SubexpNames() {
-		if _, isRuleName := rules[name]; isRuleName {
-			m.ruleSubmatchIDs[name] = idx
-		}
+// literalSuffix checks if re is in the form of `.*\.literal`.
+func literalSuffix(re *syntax.Regexp) (string, bool) {
+	if re.Op != syntax.OpConcat || len(re.Sub) != 2 {
+		return "", false
 	}
-	return m, nil
+	star, lit := re.Sub[0], re.Sub[1]
+	if star.Op != syntax.OpStar || (star.Sub[0].Op != syntax.OpAnyCharNotNL &&
+		star.Sub[0].Op != syntax.OpAnyChar) {
+		return "", false
+	}
+	if lit.Op != syntax.OpLiteral || len(lit.Rune) == 0 || lit.Rune[0] != '.' {
+		return "", false
+	}
+	return string(lit.Rune), true
+}
+
+func normalizeDomain(domain string) string {
+	return strings.TrimSuffix(strings.ToLower(domain), ".")
 }
 
 func (m *domainMatcher) Match(domain string) (string, bool) {
-	matches := m.pattern.FindStringSubmatchIndex(domain)
-	if matches == nil {
-		return "", false
+	domain = normalizeDomain(domain)
+	if rule, ok := m.exact[domain]; ok {
+		return rule, true
 	}
-	for rule, submatchID := range m.ruleSubmatchIDs {
-		if matches[submatchID*2] == 0 {
+	if idx := strings.IndexByte(domain, '.'); idx > 0 {
+		if rule, ok := m.wildcards[domain[idx+1:]]; ok {
 			return rule, true
 		}
 	}
+	// the longest suffix first
+	for i := 0; i < len(domain); i++ {
+		if domain[i] == '.' {
+			if rule, ok := m.suffixes[domain[i:]]; ok {
+				return rule, true
+			}
+		}
+	}
+	for _, r := range m.regexps {
+		if r.pattern.MatchString(domain) {
+			return r.rule, true
+		}
+	}
 	return "", false
 }
 
@@ -132,6 +408,7 @@ type ipMatcher struct {
 
 func newIPMatcher(rules map[string][]string) (*ipMatcher, error) {
 	m := &ipMatcher{}
+	seen := make(map[string]bool)
 	for name, patterns := range rules {
 		for _, pattern := range patterns {
 			_, ipNet, err := net.ParseCIDR(pattern)
@@ -148,6 +425,11 @@ func newIPMatcher(rules map[string][]string) (*ipMatcher, error) {
 			if bits < 128 {
 				patternLen += 128 - bits
 			}
+			key := fmt.Sprintf("%s/%d", ipNet.IP.To16(), patternLen)
+			if seen[key] {
+				return nil, errors.New("duplicated ip pattern: " + pattern)
+			}
+			seen[key] = true
 			m.brt.Insert(
 				bitStrFromBytes(ipNet.IP.To16(), uint(patternLen)), name)
 		}
@@ -1,8 +1,12 @@
 package lib
 
 import (
+	"context"
+	"fmt"
+	"math/rand"
 	"net"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -103,6 +107,14 @@ func TestIPMatcher(t *testing.T) {
 	}
 }
 
+func TestIPMatcherDuplicated(t *testing.T) {
+	_, err := newIPMatcher(map[string][]string{
+		"r1": {"10.0.0.0/8"}, "r2": {"10.1.2.3/8"}})
+	assert.Error(t, err)
+	_, err = newIPMatcher(map[string][]string{"r1": {"::1", "::1/128"}})
+	assert.Error(t, err)
+}
+
 func TestRuleMatcher(t *testing.T) {
 	m, err := NewRuleMatcher(config)
 	require.NoError(t, err)
@@ -141,3 +153,247 @@ func TestRuleMatcher(t *testing.T) {
 			"%s mismatch, expected %s got %s(%v)", q[0], exp, name, upstreams)
 	}
 }
+
+func BenchmarkIPMatcher(b *testing.B) {
+	// 50k random prefixes, half IPv4 and half IPv6, over 10 rules
+	r := rand.New(rand.NewSource(0))
+	rules := make(map[string][]string)
+	seen := make(map[string]bool)
+	for i := 0; len(seen) < 50000; i++ {
+		ip, bits := make(net.IP, net.IPv4len), 32
+		if i%2 == 1 {
+			ip, bits = make(net.IP, net.IPv6len), 128
+		}
+		_, _ = r.Read(ip)
+		mask := net.CIDRMask(8+r.Intn(bits-7), bits)
+		prefix := (&net.IPNet{IP: ip.Mask(mask), Mask: mask}).String()
+		if seen[prefix] {
+			continue
+		}
+		seen[prefix] = true
+		name := fmt.Sprintf("r%d", i%10)
+		rules[name] = append(rules[name], prefix)
+	}
+	m, err := newIPMatcher(rules)
+	require.NoError(b, err)
+
+	queries := make([]net.IP, 1024)
+	for i := range queries {
+		if i%2 == 0 {
+			queries[i] = make(net.IP, net.IPv4len)
+		} else {
+			queries[i] = make(net.IP, net.IPv6len)
+		}
+		_, _ = r.Read(queries[i])
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		m.Match(queries[i%len(queries)])
+	}
+}
+
+type stubCountryLookup map[string]string
+
+func (l stubCountryLookup) Country(ip net.IP) string {
+	return l[ip.String()]
+}
+
+func TestRuleMatcherCountries(t *testing.T) {
+	m, err := NewRuleMatcher(map[string]RuleConfig{
+		"domestic": {Upstreams: []string{"d"}, Countries: []string{"cn"}},
+		"lan":      {Upstreams: []string{"l"}, IPs: []string{"10.0.0.0/8"}},
+		"default":  {Upstreams: []string{"o"}},
+	})
+	require.NoError(t, err)
+
+	// skipped without a lookup
+	assert.False(t, m.HasCountryRules())
+	name, _ := m.MatchIP(net.ParseIP("1.2.3.4"))
+	assert.Equal(t, "default", name)
+
+	m.SetCountryLookup(stubCountryLookup{
+		"1.2.3.4": "CN", "10.1.1.1": "CN", "127.0.0.1": "CN"})
+	assert.True(t, m.HasCountryRules())
+	name, ups := m.MatchIP(net.ParseIP("1.2.3.4"))
+	assert.Equal(t, "domestic", name)
+	assert.Equal(t, []string{"d"}, ups)
+	name, _ = m.MatchIP(net.ParseIP("10.1.1.1")) // ip rules go first
+	assert.Equal(t, "lan", name)
+	name, _ = m.MatchIP(net.ParseIP("5.6.7.8"))
+	assert.Equal(t, "default", name)
+
+	name, _ = m.MatchDomain("localhost")
+	assert.Equal(t, "default", name)
+	name, _, _ = m.MatchResolvedDomain(context.Background(), "localhost")
+	assert.Equal(t, "domestic", name)
+	name, _, _ = m.MatchResolvedDomain(context.Background(), "invalid.invalid")
+	assert.Equal(t, "default", name)
+
+	_, err = NewRuleMatcher(map[string]RuleConfig{
+		"r1": {Countries: []string{"US"}}, "r2": {Countries: []string{"us"}}})
+	assert.Error(t, err)
+	_, err = NewRuleMatcher(map[string]RuleConfig{
+		"default": {Countries: []string{"US"}}})
+	assert.Error(t, err)
+}
+
+func TestRuleMatcherBandwidth(t *testing.T) {
+	m, err := NewRuleMatcher(map[string]RuleConfig{
+		"video":   {Upstreams: []string{"v"}, Bandwidth: "640KB"},
+		"default": {Upstreams: []string{"o"}},
+	})
+	require.NoError(t, err)
+	assert.EqualValues(t, 640*1024, m.Bandwidth("video"))
+	assert.Zero(t, m.Bandwidth("default"))
+
+	for _, bandwidth := range []string{"0", "-1KB", "fast"} {
+		_, err = NewRuleMatcher(map[string]RuleConfig{
+			"video": {Upstreams: []string{"v"}, Bandwidth: bandwidth}})
+		assert.Error(t, err, bandwidth)
+	}
+}
+
+func TestRuleMatcherConnectTimeout(t *testing.T) {
+	m, err := NewRuleMatcher(map[string]RuleConfig{
+		"satellite": {Upstreams: []string{"s"}, ConnectTimeout: "3m"},
+		"default":   {Upstreams: []string{"o"}},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, time.Minute*3, m.ConnectTimeout("satellite"))
+	assert.Zero(t, m.ConnectTimeout("default"))
+
+	for _, timeout := range []string{"0", "-1s", "slow"} {
+		_, err = NewRuleMatcher(map[string]RuleConfig{
+			"satellite": {Upstreams: []string{"s"}, ConnectTimeout: timeout}})
+		assert.Error(t, err, timeout)
+	}
+}
+
+func TestRuleMatcherTags(t *testing.T) {
+	m, err := NewRuleMatcher(map[string]RuleConfig{
+		"video":   {Upstreams: []string{"v"}, Tags: []string{"metered", "qos"}},
+		"default": {Upstreams: []string{"o"}},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"metered", "qos"}, m.Tags("video"))
+	assert.Empty(t, m.Tags("default"))
+
+	_, err = NewRuleMatcher(map[string]RuleConfig{
+		"video": {Upstreams: []string{"v"}, Tags: []string{"metered", ""}}})
+	assert.Error(t, err)
+}
+
+func TestRuleMatcherUnhealthyPolicy(t *testing.T) {
+	m, err := NewRuleMatcher(map[string]RuleConfig{
+		"video": {Upstreams: []string{"v"}, UnhealthyPolicy: "default"},
+		"other": {Upstreams: []string{"o"}, UnhealthyPolicy: "fail_fast"},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, UnhealthyFallbackDefault, m.UnhealthyPolicy("video"))
+	assert.Equal(t, UnhealthyFailFast, m.UnhealthyPolicy("other"))
+	assert.Equal(t, UnhealthyFailFast, m.UnhealthyPolicy(""))
+	_, ok := m.DefaultUpstreams()
+	assert.False(t, ok)
+
+	_, err = NewRuleMatcher(map[string]RuleConfig{
+		"video": {Upstreams: []string{"v"}, UnhealthyPolicy: "retry"}})
+	assert.Error(t, err)
+}
+
+func TestRuleMatcherAction(t *testing.T) {
+	m, err := NewRuleMatcher(map[string]RuleConfig{
+		"ads":    {Domains: []string{"ads.example"}, Action: "deny"},
+		"legacy": {Domains: []string{"legacy.example"}},
+		"proxy":  {Upstreams: []string{"p"}, Action: "proxy"},
+	})
+	require.NoError(t, err)
+	rule, upstreams := m.MatchDomain("ads.example")
+	assert.Equal(t, "ads", rule)
+	assert.Empty(t, upstreams)
+	assert.True(t, m.Denies(rule))
+	rule, upstreams = m.MatchDomain("legacy.example")
+	assert.Equal(t, "legacy", rule)
+	assert.Empty(t, upstreams)
+	assert.False(t, m.Denies(rule)) // rejected, but not by the action
+	assert.False(t, m.Denies("proxy"))
+	assert.False(t, m.Denies(""))
+
+	for _, rule := range []RuleConfig{
+		{Upstreams: []string{"p"}, Action: "deny"},
+		{Action: "proxy"},
+		{Upstreams: []string{"p"}, Action: "block"},
+	} {
+		_, err = NewRuleMatcher(map[string]RuleConfig{"rule": rule})
+		assert.Error(t, err, "%+v", rule)
+	}
+}
+
+func TestOpenGeoIPDBMissing(t *testing.T) {
+	_, err := OpenGeoIPDB("/nonexistent/GeoLite2-Country.mmdb")
+	assert.Error(t, err)
+}
+
+func TestDomainMatcherKinds(t *testing.T) {
+	m, err := newDomainMatcher(map[string][]string{
+		"exact":  {`a\.example\.com`},
+		"suffix": {`.*\.example\.com`},
+		"regex":  {`ads?\d*\..*`, `.*example\.com`},
+	})
+	require.NoError(t, err)
+	assert.Len(t, m.exact, 1)
+	assert.Len(t, m.suffixes, 1)
+	assert.Len(t, m.regexps, 2)
+
+	for _, q := range [][2]string{
+		{"a.example.com", "exact"},
+		{"A.Example.COM", "exact"},
+		{"b.example.com", "suffix"},
+		{"ads.example.com", "suffix"}, // suffix rules go before regex ones
+		{"ad1.other.com", "regex"},
+		{"myexample.com", "regex"},
+	} {
+		rule, matched := m.Match(q[0])
+		assert.True(t, matched, q[0])
+		assert.Equal(t, q[1], rule, q[0])
+	}
+
+	_, err = newDomainMatcher(map[string][]string{"bad": {`ads?(`}})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), `ads?(`)
+	_, err = newDomainMatcher(map[string][]string{
+		"r1": {`a\.com`}, "r2": {`a\.com`}})
+	assert.Error(t, err)
+}
+
+func TestDomainMatcherPlainNames(t *testing.T) {
+	m, err := newDomainMatcher(map[string][]string{
+		"exact":    {"Example.COM.", "a.b.example.com"},
+		"wildcard": {"*.example.com", "*.b.example.com"},
+		"suffix":   {".example.com", ".example.org"},
+	})
+	require.NoError(t, err)
+	assert.Empty(t, m.regexps)
+
+	for _, q := range []struct {
+		domain string
+		rule   string
+	}{
+		{"example.com", "exact"},
+		{"EXAMPLE.com.", "exact"},
+		{"a.b.example.com", "exact"},
+		{"www.example.com", "wildcard"},
+		{"x.b.example.com", "wildcard"},
+		{"x.y.example.com", "suffix"},
+		{"x.y.z.example.com", "suffix"},
+		{"example.org", ""},
+		{"www.example.org", "suffix"},
+		{"a.b.example.org.", "suffix"},
+		{"examplexcom", ""},
+		{"www.example.net", ""},
+	} {
+		rule, matched := m.Match(q.domain)
+		assert.Equal(t, q.rule != "", matched, q.domain)
+		assert.Equal(t, q.rule, rule, q.domain)
+	}
+}
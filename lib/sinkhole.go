@@ -0,0 +1,161 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+const sinkholeMaxHeadSize = 8192 // of the requests searched for the end
+
+var sinkholeHTTP204 = []byte("HTTP/1.1 204 No Content\r\n" +
+	"Content-Length: 0\r\nConnection: close\r\n\r\n")
+
+// SinkholeResponse is how a SinkholeClient ends the connections.
+type SinkholeResponse string
+
+// nolint: golint
+const (
+	SinkholeEmpty   SinkholeResponse = "empty"    // closed at once
+	SinkholeHTTP204 SinkholeResponse = "http_204" // 204 to HTTP requests
+	SinkholeReset   SinkholeResponse = "reset"    // the clients are reset
+)
+
+// SinkholeClient is a ProxyClient connecting nowhere, e.g. for the rules of
+// blocklists. The requests succeed at once, so that the clients see a clean
+// close (or reset) rather than a failure or timeout, which may make them
+// retry. The connections end according to the Response:
+//
+//   - "empty": closed without any data.
+//   - "http_204": a "204 No Content" response to an HTTP request, after the
+//     request head is received. The ones not looking like HTTP (e.g. TLS) are
+//     closed without any data.
+//   - "reset": the connections of the clients are reset (TCP only, otherwise
+//     closed as "empty").
+type SinkholeClient struct {
+	Response SinkholeResponse
+}
+
+// NewSinkholeClient creates a SinkholeClient from the given configuration.
+func NewSinkholeClient(config ProxyConfig) (*SinkholeClient, error) {
+	if config.Transport != nil {
+		return nil, errors.New("'sinkhole' protocol has no transport")
+	}
+	client := &SinkholeClient{Response: SinkholeEmpty}
+	for k, v := range config.Settings {
+		switch k {
+		case "response":
+			s, _ := v.(string)
+			switch r := SinkholeResponse(s); r {
+			case SinkholeEmpty, SinkholeHTTP204, SinkholeReset:
+				client.Response = r
+			default:
+				return nil, errors.Errorf("invalid value for 'response': %v", v)
+			}
+		default:
+			return nil, errors.New(
+				"unknown setting of 'sinkhole' protocol: " + k)
+		}
+	}
+	return client, nil
+}
+
+// Request returns a SinkholeConn at once.
+func (c *SinkholeClient) Request(context.Context, Address) (
+	io.ReadWriteCloser, Address, *ProxyError) {
+	conn := &SinkholeConn{
+		response: c.Response,
+		ready:    make(chan struct{}),
+		closed:   make(chan struct{}),
+	}
+	if c.Response != SinkholeHTTP204 {
+		close(conn.ready)
+	}
+	return conn, &TCP4Addr{net.IPv4zero, 0}, nil
+}
+
+// SinkholeConn is the connection of a SinkholeClient. Whatever written to it
+// is discarded.
+type SinkholeConn struct {
+	response  SinkholeResponse
+	head      []byte // of the request, until the response is ready
+	reply     []byte // the rest to be read
+	mtx       sync.Mutex
+	ready     chan struct{} // closed once the reply is decided
+	readyOnce sync.Once
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// Resets tells whether the connection of the client should be reset.
+func (c *SinkholeConn) Resets() bool {
+	return c.response == SinkholeReset
+}
+
+// Read blocks until the reply is decided, then reads the reply followed by
+// an EOF.
+func (c *SinkholeConn) Read(p []byte) (int, error) {
+	select {
+	case <-c.ready:
+	case <-c.closed:
+		return 0, errors.New("sinkhole connection closed")
+	}
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if len(c.reply) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, c.reply)
+	c.reply = c.reply[n:]
+	return n, nil
+}
+
+// Write discards the data, which decides the reply if it's still pending.
+func (c *SinkholeConn) Write(p []byte) (int, error) {
+	select {
+	case <-c.closed:
+		return 0, errors.New("sinkhole connection closed")
+	default:
+	}
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	select {
+	case <-c.ready:
+		return len(p), nil
+	default:
+	}
+	c.head = append(c.head, p...)
+	if len(c.head) == 0 {
+		return 0, nil
+	} else if !isHTTPMethodByte(c.head[0]) {
+		c.setReply(nil)
+	} else if bytes.Contains(c.head, []byte("\r\n\r\n")) {
+		c.setReply(sinkholeHTTP204)
+	} else if len(c.head) > sinkholeMaxHeadSize {
+		c.setReply(nil)
+	}
+	return len(p), nil
+}
+
+func (c *SinkholeConn) setReply(reply []byte) {
+	c.readyOnce.Do(func() {
+		c.head, c.reply = nil, reply
+		close(c.ready)
+	})
+}
+
+// Close unblocks the pending reads.
+func (c *SinkholeConn) Close() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+	return nil
+}
+
+// isHTTPMethodByte tells whether a request may start with the byte, i.e. the
+// methods of HTTP are all in uppercase letters.
+func isHTTPMethodByte(b byte) bool {
+	return b >= 'A' && b <= 'Z'
+}
@@ -0,0 +1,96 @@
+package lib
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newSinkholeConn(
+	t *testing.T, settings map[string]interface{}) *SinkholeConn {
+	cli, err := CreateProxyClient(
+		ProxyConfig{Protocol: "sinkhole", Settings: settings})
+	require.NoError(t, err)
+	rwc, boundAddr, pErr := cli.Request(
+		context.Background(), &DomainNameAddr{"ads.example", 443})
+	require.Nil(t, pErr)
+	assert.NotNil(t, boundAddr)
+	return rwc.(*SinkholeConn)
+}
+
+func TestSinkholeClientConfig(t *testing.T) {
+	for _, settings := range []map[string]interface{}{
+		{"response": "404"}, {"response": 204}, {"address": "127.0.0.1:80"},
+	} {
+		_, err := NewSinkholeClient(
+			ProxyConfig{Protocol: "sinkhole", Settings: settings})
+		assert.Error(t, err, "%v", settings)
+	}
+	_, err := NewSinkholeClient(ProxyConfig{
+		Protocol: "sinkhole", Transport: &TransportConfig{}})
+	assert.Error(t, err)
+	_, err = CreateProxyServer(nil, ProxyConfig{Protocol: "sinkhole"})
+	assert.Error(t, err)
+}
+
+func TestSinkholeConnEmpty(t *testing.T) {
+	conn := newSinkholeConn(t, nil)
+	assert.False(t, conn.Resets())
+	n, err := conn.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, 18, n)
+	data, err := ioutil.ReadAll(conn)
+	assert.NoError(t, err)
+	assert.Empty(t, data)
+	assert.NoError(t, conn.Close())
+	_, err = conn.Write([]byte("more"))
+	assert.Error(t, err)
+
+	conn = newSinkholeConn(t, map[string]interface{}{"response": "reset"})
+	assert.True(t, conn.Resets())
+	_, err = conn.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestSinkholeConnHTTP204(t *testing.T) {
+	conn := newSinkholeConn(t, map[string]interface{}{"response": "http_204"})
+	readCh := make(chan []byte, 1)
+	go func() {
+		data, _ := ioutil.ReadAll(conn)
+		readCh <- data
+	}()
+	// not replied until the end of the request head
+	_, err := conn.Write([]byte("GET / HTTP/1.1\r\nHost: ads.example\r\n"))
+	assert.NoError(t, err)
+	select {
+	case <-readCh:
+		t.Fatal("replied before the request is received")
+	case <-time.After(time.Millisecond * 50):
+	}
+	_, err = conn.Write([]byte("\r\nbody"))
+	assert.NoError(t, err)
+	assert.Equal(t, sinkholeHTTP204, <-readCh)
+
+	// the ones not in HTTP are closed at once
+	conn = newSinkholeConn(t, map[string]interface{}{"response": "http_204"})
+	_, err = conn.Write([]byte{0x16, 0x03, 0x01})
+	assert.NoError(t, err)
+	data, err := ioutil.ReadAll(conn)
+	assert.NoError(t, err)
+	assert.Empty(t, data)
+
+	// or unblocked by closing
+	conn = newSinkholeConn(t, map[string]interface{}{"response": "http_204"})
+	go func() {
+		time.Sleep(time.Millisecond * 10)
+		_ = conn.Close()
+	}()
+	_, err = conn.Read(make([]byte, 1))
+	assert.Error(t, err)
+	assert.NotEqual(t, io.EOF, err)
+}
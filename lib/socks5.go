@@ -21,10 +21,12 @@ const (
 // CheckUserFunc is the type of user checking callback function.
 type CheckUserFunc func(user, password string) bool
 
-// SOCKS5Server is a proxy server on SOCKS5 protocol.
+// SOCKS5Server is a proxy server on SOCKS5 protocol. The BIND command is
+// rejected unless 'bind' is set, with which it's served by the upstreams
+// capable of it (see BindRequest).
 type SOCKS5Server struct {
 	transport  Transport
-	addr       string
+	addrs      []string
 	checkUser  CheckUserFunc
 	simplified bool
 	isRunning  uint32 // should be used with atomic operations
@@ -32,10 +34,12 @@ type SOCKS5Server struct {
 	reqCh      chan ProxyRequest
 	log        *zap.SugaredLogger
 	hsTimeout  time.Duration
+	blocked    ProxyErrorType // replied on rejection by rules
+	allowBind  bool           // the BIND command, see BindRequest
 }
 
 func parseSOCKS5Config(config ProxyConfig) (
-	address string, simplified bool, hsTimeout time.Duration, err error) {
+	addrs []string, simplified bool, hsTimeout time.Duration, err error) {
 	if config.Protocol != "socks5" {
 		panic("protocol should be 'socks5' rather than: " + config.Protocol)
 	}
@@ -44,8 +48,9 @@ func parseSOCKS5Config(config ProxyConfig) (
 	for k, v := range config.Settings {
 		switch k {
 		case "address":
-			if address, ok = v.(string); !ok {
-				err = errors.Errorf("invalid value for 'address': %v", v)
+			var e error
+			if addrs, e = parseListenAddrs(v); e != nil {
+				err = e
 			}
 		case "simplified":
 			if simplified, ok = v.(bool); !ok {
@@ -63,7 +68,7 @@ func parseSOCKS5Config(config ProxyConfig) (
 		}
 	}
 
-	if address == "" {
+	if len(addrs) == 0 || addrs[0] == "" {
 		err = errors.New(
 			"a valid 'address' must be specified for socks5 protocol")
 	}
@@ -77,7 +82,7 @@ func parseSOCKS5Config(config ProxyConfig) (
 func NewSOCKS5Server(
 	logger *zap.SugaredLogger,
 	config ProxyConfig) (*SOCKS5Server, error) {
-	address, simplified, hsTimeout, err := parseSOCKS5Config(config)
+	addrs, simplified, hsTimeout, err := parseSOCKS5Config(config)
 	if err != nil {
 		return nil, errors.WithMessage(err, "failed to create SOCKS5 server")
 	}
@@ -86,15 +91,35 @@ func NewSOCKS5Server(
 	if c, ok := config.Settings["check_users"]; ok {
 		if checkUser, ok = c.(bool); !ok {
 			return nil, errors.New("invalid value for 'check_users'")
-		} else if checkUser && !db.Inited {
+		} else if checkUser && !db.Configured() {
 			return nil, errors.New("user checking requires a database specified")
 		}
 	}
+	allowBind := false
+	if b, ok := config.Settings["bind"]; ok {
+		if allowBind, ok = b.(bool); !ok {
+			return nil, errors.New("invalid value for 'bind'")
+		}
+	}
+	blocked := ProxyNotAllowed
+	if config.Blocked != nil && config.Blocked.Reply != 0 {
+		reply := config.Blocked.Reply
+		if reply < int(ProxyGeneralErr) || reply > int(ProxyAddrUnsupported) {
+			return nil, errors.New("'reply' of 'blocked' must be within [1, 8]")
+		}
+		blocked = ProxyErrorType(reply)
+	}
 
 	transport, err := CreateTransport(config.Transport)
 	if err != nil {
 		return nil, errors.WithMessage(err, "failed to create SOCKS5 server")
 	}
+	if config.ACL != nil {
+		transport, err = WrapTransACL(logger, transport, *config.ACL)
+		if err != nil {
+			return nil, errors.WithMessage(err, "failed to create SOCKS5 server")
+		}
+	}
 
 	var checkUserFunc CheckUserFunc
 	if checkUser {
@@ -104,18 +129,25 @@ func NewSOCKS5Server(
 				return false
 			} else { // nolint: golint
 				defer dao.Close() // nolint: errcheck
-				return dao.CheckPassword(socks5Scope, user, password)
+				// an API token is accepted in place of the password
+				return dao.CheckAPIToken(socks5Scope, user, password) ||
+					dao.CheckPassword(socks5Scope, user, password)
 			}
 		}
 	}
-	return newSOCKS5Server(
-		logger, transport, address, simplified, checkUserFunc, hsTimeout)
+	server, err := newSOCKS5Server(
+		logger, transport, addrs, simplified, checkUserFunc, hsTimeout)
+	if err == nil {
+		server.blocked = blocked
+		server.allowBind = allowBind
+	}
+	return server, err
 }
 
 // newSOCKS5Server creates a SOCKS5Server. It is used internally.
 func newSOCKS5Server(
 	logger *zap.SugaredLogger,
-	transport Transport, addr string, simplified bool,
+	transport Transport, addrs []string, simplified bool,
 	checkUser CheckUserFunc, hsTimeout time.Duration) (*SOCKS5Server, error) {
 	if simplified && checkUser != nil {
 		return nil, errors.New(
@@ -123,11 +155,12 @@ func newSOCKS5Server(
 	}
 	return &SOCKS5Server{
 		transport:  transport,
-		addr:       addr,
+		addrs:      addrs,
 		simplified: simplified,
 		checkUser:  checkUser,
 		log:        logger,
 		hsTimeout:  hsTimeout,
+		blocked:    ProxyNotAllowed,
 	}, nil
 }
 
@@ -136,21 +169,22 @@ func (s *SOCKS5Server) Start() (<-chan ProxyRequest, error) {
 	s.reqCh = make(chan ProxyRequest, 1)
 
 	var err error
-	if s.listener, err = s.transport.Listen(s.addr); err != nil {
+	if s.listener, err = listenAll(s.transport, s.addrs); err != nil {
 		s.log.Errorw(
-			"failed to start SOCKS5 server", "addr", s.addr, "error", err)
+			"failed to start SOCKS5 server", "addrs", s.addrs, "error", err)
 		return nil, errors.WithMessage(err, "failed to start SOCKS5 server")
 	}
 	s.log.Infow(
-		"SOCKS5 server started", "addr", s.addr, "simplified", s.simplified)
+		"SOCKS5 server started", "addrs", s.addrs, "simplified", s.simplified)
 
 	atomic.StoreUint32(&s.isRunning, 1)
 	go func() {
 		for {
-			conn, err := s.listener.Accept()
+			conn, err := acceptRetrying(s.listener, s.log)
 			if err != nil {
 				if atomic.LoadUint32(&s.isRunning) > 0 { // still running
-					s.log.Warnw("accept error", "error", err)
+					s.log.Errorw("permanent accept error",
+						"error", err, "class", errorClass(err))
 				}
 				break
 			}
@@ -159,7 +193,8 @@ func (s *SOCKS5Server) Start() (<-chan ProxyRequest, error) {
 			cliLogger := s.log.With("reqID", reqID).Named("client")
 			cliLogger.Debugw(
 				"client connection accepted", "addr", conn.RemoteAddr())
-			req := &socks5Request{id: reqID, conn: conn, log: cliLogger}
+			req := &socks5Request{
+				id: reqID, conn: conn, log: cliLogger, blocked: s.blocked}
 
 			go s.handshake(req)
 		}
@@ -212,10 +247,15 @@ func (s *SOCKS5Server) handshake(cli *socks5Request) {
 		err = reqPkt.ReadPacket(cli.conn)
 	}
 
+	var req ProxyRequest = cli
 	if err == nil {
 		if reqPkt.Type == socksConnect {
 			// the response packet will be sent by cli.Success()
 			cli.targetAddr = reqPkt.Addr
+		} else if reqPkt.Type == socksBind && s.allowBind {
+			// both of the responses are sent by the BindRequest
+			cli.targetAddr = reqPkt.Addr
+			req = &socks5BindRequest{cli}
 		} else {
 			err = errors.Errorf("client sent unsupported cmd: %d", reqPkt.Type)
 			reqPkt.Type = byte(ProxyCmdUnsupported)
@@ -234,8 +274,9 @@ func (s *SOCKS5Server) handshake(cli *socks5Request) {
 	if err == nil {
 		cli.log.Debugw(
 			"handshake with SOCKS5 client succeeded",
-			"target", cli.targetAddr, "userIDs", peerIDs)
-		s.reqCh <- cli
+			"target", cli.targetAddr, "userIDs", peerIDs,
+			"cmd", reqPkt.Type)
+		s.reqCh <- req
 	} else {
 		cli.log.Warnw(
 			"handshake with SOCKS5 client failed",
@@ -272,6 +313,7 @@ type socks5Request struct {
 	conn       net.Conn
 	user       string
 	targetAddr Address
+	blocked    ProxyErrorType
 }
 
 // GetPeerIdentifiers returns a list of peer identifiers of this client.
@@ -317,8 +359,16 @@ func (r *socks5Request) Success(addr Address) io.ReadWriteCloser {
 
 // Fail notifies the client that the connection is not able to be established.
 func (r *socks5Request) Fail(proxyErr *ProxyError) {
+	errType := proxyErr.ErrType
+	if errType == ProxyBlocked {
+		errType = r.blocked
+	} else if errType == ProxyUpstreamBusy {
+		errType = ProxyGeneralErr
+	} else if errType >= 0x80 { // not defined by SOCKS
+		errType = ProxyNotAllowed
+	}
 	respPkt := &socksReqResp{
-		Type: byte(proxyErr.ErrType), Addr: &TCP4Addr{net.IPv4zero, 0}}
+		Type: byte(errType), Addr: &TCP4Addr{net.IPv4zero, 0}}
 	if err := respPkt.WritePacket(r.conn); err != nil {
 		r.log.Warnw("failed to write error response packet", "error", err)
 	}
@@ -327,6 +377,19 @@ func (r *socks5Request) Fail(proxyErr *ProxyError) {
 	}
 }
 
+// socks5BindRequest is a socks5Request of the BIND command, whose Success
+// sends the second response.
+type socks5BindRequest struct {
+	*socks5Request
+}
+
+// Bound sends the first response, i.e. the address listened on.
+func (r *socks5BindRequest) Bound(addr Address) error {
+	respPkt := &socksReqResp{Type: socksSuccess, Addr: addr}
+	return errors.WithMessage(
+		respPkt.WritePacket(r.conn), "failed to write response packet")
+}
+
 // Logger returns a logger of this client.
 func (r *socks5Request) Logger() *zap.SugaredLogger {
 	return r.log
@@ -337,7 +400,9 @@ func (r *socks5Request) ID() string {
 	return r.id
 }
 
-// SOCKS5Client is a ProxyClient using SOCKS5 protocol.
+// SOCKS5Client is a ProxyClient using SOCKS5 protocol. The Username and
+// Password are offered (by RFC 1929) if set, and a rejection of them by the
+// server fails the requests with ProxyAuthFailed.
 type SOCKS5Client struct {
 	Transport  Transport
 	Addr       string
@@ -348,7 +413,10 @@ type SOCKS5Client struct {
 
 // NewSOCKS5Client creates a SOCKS5 client from the given configuration.
 func NewSOCKS5Client(config ProxyConfig) (*SOCKS5Client, error) {
-	address, simplified, _, err := parseSOCKS5Config(config)
+	addrs, simplified, _, err := parseSOCKS5Config(config)
+	if err == nil && len(addrs) > 1 {
+		err = errors.New("only one 'address' is allowed for socks5 client")
+	}
 	if err != nil {
 		return nil, errors.WithMessage(err, "failed to create SOCKS5 client")
 	}
@@ -365,6 +433,11 @@ func NewSOCKS5Client(config ProxyConfig) (*SOCKS5Client, error) {
 	}
 	if username == "" && password != "" {
 		return nil, errors.New("a password must be used with a username")
+	} else if username != "" && password == "" {
+		return nil, errors.New("a username must be used with a password")
+	} else if len(username) > 255 || len(password) > 255 {
+		return nil, errors.New(
+			"'username' and 'password' should not exceed 255 bytes")
 	}
 
 	transport, err := CreateTransport(config.Transport)
@@ -373,20 +446,27 @@ func NewSOCKS5Client(config ProxyConfig) (*SOCKS5Client, error) {
 	}
 
 	return &SOCKS5Client{
-		Transport: transport, Addr: address, Simplified: simplified,
+		Transport: transport, Addr: addrs[0], Simplified: simplified,
 		Username: username, Password: password,
 	}, nil
 }
 
+// Close closes the transport of the client, see closeTransport.
+func (c *SOCKS5Client) Close() error {
+	return closeTransport(c.Transport)
+}
+
 // Request send a connection request to the proxy server.
 func (c *SOCKS5Client) Request(ctx context.Context, addr Address) (
 	io.ReadWriteCloser, Address, *ProxyError) {
+	startTime := time.Now()
 	conn, err := c.Transport.Dial(ctx, c.Addr)
 	if err != nil {
 		return nil, nil, wrapAsProxyError(
 			errors.WithMessage(err, "failed to dial to proxy server"),
 			ProxyGeneralErr)
 	}
+	timings := ConnTimings{Dial: time.Since(startTime)}
 	if ddl, hasDDL := ctx.Deadline(); hasDDL {
 		// so that the underlying IO will propagate the timeout error upwards
 		_ = conn.SetDeadline(ddl.Add(-time.Millisecond))
@@ -407,6 +487,8 @@ func (c *SOCKS5Client) Request(ctx context.Context, addr Address) (
 			return nil, nil, err
 		}
 		_ = conn.SetDeadline(time.Time{})
+		timings.Handshake = time.Since(startTime) - timings.Dial
+		recordConnTimings(ctx, timings)
 		return conn, boundAddr, nil
 	case <-ctx.Done():
 		_ = conn.Close()
@@ -420,7 +502,10 @@ func (c *SOCKS5Client) doRequest(
 	var err error
 	errType := ProxyGeneralErr
 	if !c.Simplified {
-		err = c.authenticate(conn)
+		var authFailed bool
+		if authFailed, err = c.authenticate(conn); authFailed {
+			errType = ProxyAuthFailed
+		}
 	}
 
 	// send connect request
@@ -448,7 +533,11 @@ func (c *SOCKS5Client) doRequest(
 		errType)
 }
 
-func (c *SOCKS5Client) authenticate(conn io.ReadWriter) (err error) {
+// authenticate negotiates the method of authentication (RFC 1929 if the
+// server requires it), and tells whether it's rejected by the server rather
+// than failed because of the connection.
+func (c *SOCKS5Client) authenticate(
+	conn io.ReadWriter) (authFailed bool, err error) {
 	// send HELLO and authenticate if required
 	helloPkt := &socksHello{[]byte{socksNoAuth}}
 	selectPkt := &socksSelect{}
@@ -470,10 +559,12 @@ func (c *SOCKS5Client) authenticate(conn io.ReadWriter) (err error) {
 			err = authRespPkt.ReadPacket(conn)
 		}
 		if err == nil && !authRespPkt.Status {
+			authFailed = true
 			err = errors.New("authentication to SOCKS server failed")
 		}
 	case socksNoAuth: // no-op
-	case socksNoValidAuth:
+	case socksNoValidAuth: // e.g. the credentials are required but missing
+		authFailed = true
 		err = errors.New("no valid authentication supported by the server")
 	default:
 		err = errors.Errorf("SOCKS server require unknown authentication: %v",
@@ -488,6 +579,7 @@ const (
 	socksNoValidAuth = 0xff
 	socksUserPass    = 0x02
 	socksConnect     = 0x01
+	socksBind        = 0x02
 	socksIPv4        = 0x01
 	socksDomainName  = 0x03
 	socksIPv6        = 0x04
@@ -5,9 +5,11 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"math/rand"
 	"net"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 
@@ -15,6 +17,7 @@ import (
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
 )
 
 var packetTestCases = []struct {
@@ -131,7 +134,8 @@ func doTestSOCKS5Request(
 
 	logger := zap.NewNop().Sugar()
 	svr, err := newSOCKS5Server(
-		logger, trans, address, simplified, checkUserFunc, time.Second*10)
+		logger, trans, []string{address}, simplified, checkUserFunc,
+		time.Second*10)
 	require.NoError(t, err)
 
 	reqCh, err := svr.Start()
@@ -175,6 +179,35 @@ func doTestSOCKS5Request(
 	svr.Stop()
 }
 
+func TestSOCKS5RequestLogger(t *testing.T) {
+	address := "127.0.0.1:" + strconv.Itoa(52048+(rand.Intn(2048)))
+	core, logs := observer.New(zap.InfoLevel)
+	svr, err := newSOCKS5Server(zap.New(core).Sugar(), &TCPTransport{},
+		[]string{address}, false, nil, time.Second*10)
+	require.NoError(t, err)
+	reqCh, err := svr.Start()
+	require.NoError(t, err)
+	defer svr.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+	go func() {
+		cli := &SOCKS5Client{Transport: &TCPTransport{}, Addr: address}
+		_, _, _ = cli.Request(ctx, &TCP4Addr{net.IPv4(1, 2, 3, 4), 80})
+	}()
+	select {
+	case req := <-reqCh:
+		req.Logger().Info("test entry")
+		req.Fail(&ProxyError{ErrType: ProxyNotAllowed})
+		entries := logs.FilterMessage("test entry").All()
+		if assert.Len(t, entries, 1) {
+			assert.Equal(t, req.ID(), entries[0].ContextMap()["reqID"])
+		}
+	case <-ctx.Done():
+		t.Fatal("no request received")
+	}
+}
+
 func TestSOCKS5RequestIPv4(t *testing.T) {
 	addr := &TCP4Addr{IP: net.ParseIP("123.45.67.89"), Port: 23333}
 	doTestSOCKS5Request(t, addr, false, nil, false, false)
@@ -216,7 +249,214 @@ func TestSOCKS5RequestWrongUserPass(t *testing.T) {
 	}, true, true)
 }
 
+func TestSOCKS5ClientAuthFailed(t *testing.T) {
+	address := "127.0.0.1:" + strconv.Itoa(52048+(rand.Intn(2048)))
+	svr, err := newSOCKS5Server(zap.NewNop().Sugar(), &TCPTransport{},
+		[]string{address}, false, func(user, pass string) bool {
+			return user == "USERNAME" && pass == "PASSWORD"
+		}, time.Second*10)
+	require.NoError(t, err)
+	reqCh, err := svr.Start()
+	require.NoError(t, err)
+	defer svr.Stop()
+	go func() {
+		for req := range reqCh {
+			req.Fail(&ProxyError{ErrType: ProxyNotAllowed})
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	addr := &TCP4Addr{net.IPv4(1, 2, 3, 4), 80}
+	for _, c := range []struct {
+		username, password string
+		errType            ProxyErrorType
+	}{
+		{"", "", ProxyAuthFailed}, // no credentials offered
+		{"USERNAME", "WRONG", ProxyAuthFailed},
+		{"USERNAME", "PASSWORD", ProxyNotAllowed}, // replied by the server
+	} {
+		cli, err := NewSOCKS5Client(ProxyConfig{
+			Protocol: "socks5",
+			Settings: map[string]interface{}{
+				"address": address, "username": c.username,
+				"password": c.password,
+			},
+		})
+		require.NoError(t, err)
+		_, _, pErr := cli.Request(ctx, addr)
+		if assert.NotNil(t, pErr, c.username+":"+c.password) {
+			assert.Equal(t, c.errType, pErr.ErrType, pErr.Error)
+		}
+	}
+
+	for _, settings := range []map[string]interface{}{
+		{"username": "USERNAME"},
+		{"password": "PASSWORD"},
+		{"username": "USERNAME", "password": strings.Repeat("x", 256)},
+	} {
+		settings["address"] = address
+		_, err := NewSOCKS5Client(
+			ProxyConfig{Protocol: "socks5", Settings: settings})
+		assert.Error(t, err, "%v", settings)
+	}
+}
+
 func TestSOCKS5RequestSimplifiedProtocol(t *testing.T) {
 	addr := &DomainNameAddr{DomainName: "www.gov.cn", Port: 12345}
 	doTestSOCKS5Request(t, addr, true, nil, false, false)
 }
+
+func TestSOCKS5RequestBlocked(t *testing.T) {
+	doRequest := func(blocked *BlockedConfig) *ProxyError {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		address := l.Addr().String()
+		_ = l.Close()
+		svr, err := NewSOCKS5Server(zap.NewNop().Sugar(), ProxyConfig{
+			Protocol: "socks5",
+			Settings: map[string]interface{}{"address": address},
+			Blocked:  blocked,
+		})
+		require.NoError(t, err)
+		reqCh, err := svr.Start()
+		require.NoError(t, err)
+		defer svr.Stop()
+		go func() {
+			if req, ok := <-reqCh; ok {
+				req.Fail(&ProxyError{ErrType: ProxyBlocked})
+			}
+		}()
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		cli := &SOCKS5Client{Transport: &TCPTransport{}, Addr: address}
+		_, _, pErr := cli.Request(ctx, &TCP4Addr{net.IPv4(1, 2, 3, 4), 80})
+		return pErr
+	}
+
+	if pErr := doRequest(nil); assert.NotNil(t, pErr) {
+		assert.Equal(t, ProxyNotAllowed, pErr.ErrType)
+	}
+	pErr := doRequest(&BlockedConfig{Reply: int(ProxyConnectFailed)})
+	if assert.NotNil(t, pErr) {
+		assert.Equal(t, ProxyConnectFailed, pErr.ErrType)
+	}
+
+	_, err := NewSOCKS5Server(zap.NewNop().Sugar(), ProxyConfig{
+		Protocol: "socks5",
+		Settings: map[string]interface{}{"address": "127.0.0.1:0"},
+		Blocked:  &BlockedConfig{Reply: int(ProxyQuotaExceeded)},
+	})
+	assert.Error(t, err)
+}
+
+func TestSOCKS5ServerBind(t *testing.T) {
+	doBind := func(allowBind bool) (*SOCKS5Server, net.Conn) {
+		address := "127.0.0.1:" + strconv.Itoa(52048+(rand.Intn(2048)))
+		svr, err := newSOCKS5Server(zap.NewNop().Sugar(), &TCPTransport{},
+			[]string{address}, false, nil, time.Second*10)
+		require.NoError(t, err)
+		svr.allowBind = allowBind
+		reqCh, err := svr.Start()
+		require.NoError(t, err)
+		go func() {
+			req, ok := <-reqCh
+			if !ok {
+				return
+			}
+			bindReq, ok := req.(BindRequest)
+			if !assert.True(t, ok) {
+				req.Fail(&ProxyError{ErrType: ProxyGeneralErr})
+				return
+			}
+			assert.Equal(t, "127.0.0.1:0", req.TargetAddr().String())
+			bound := &TCP4Addr{net.IPv4(1, 2, 3, 4), 80}
+			assert.NoError(t, bindReq.Bound(bound))
+			conn := req.Success(&TCP4Addr{net.IPv4(127, 0, 0, 1), 1234})
+			_, _ = conn.Write([]byte("hello"))
+			_ = conn.Close()
+		}()
+
+		conn, err := net.Dial("tcp", address)
+		require.NoError(t, err)
+		_, err = conn.Write([]byte{5, 1, 0, 5, 2, 0, 1, 127, 0, 0, 1, 0, 0})
+		require.NoError(t, err)
+		hello := make([]byte, 2)
+		_, err = io.ReadFull(conn, hello)
+		require.NoError(t, err)
+		assert.Equal(t, []byte{5, 0}, hello)
+		return svr, conn
+	}
+
+	svr, conn := doBind(true)
+	defer svr.Stop()
+	defer conn.Close() // nolint: errcheck
+	resp := &socksReqResp{}
+	require.NoError(t, resp.ReadPacket(conn))
+	assert.EqualValues(t, socksSuccess, resp.Type)
+	assert.Equal(t, "1.2.3.4:80", resp.Addr.String())
+	require.NoError(t, resp.ReadPacket(conn))
+	assert.EqualValues(t, socksSuccess, resp.Type)
+	assert.Equal(t, "127.0.0.1:1234", resp.Addr.String())
+	data, err := ioutil.ReadAll(conn)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(data))
+
+	svr, conn = doBind(false)
+	defer svr.Stop()
+	defer conn.Close() // nolint: errcheck
+	require.NoError(t, resp.ReadPacket(conn))
+	assert.EqualValues(t, ProxyCmdUnsupported, resp.Type)
+
+	_, err = NewSOCKS5Server(zap.NewNop().Sugar(), ProxyConfig{
+		Protocol: "socks5",
+		Settings: map[string]interface{}{
+			"address": "127.0.0.1:0", "bind": "yes"},
+	})
+	assert.Error(t, err)
+}
+
+func TestSOCKS5ServerMultiAddrs(t *testing.T) {
+	var addrs []interface{}
+	for i := 0; i < 2; i++ {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		addrs = append(addrs, l.Addr().String())
+		_ = l.Close()
+	}
+	svr, err := NewSOCKS5Server(zap.NewNop().Sugar(), ProxyConfig{
+		Protocol: "socks5",
+		Settings: map[string]interface{}{"address": addrs},
+	})
+	require.NoError(t, err)
+	reqCh, err := svr.Start()
+	require.NoError(t, err)
+	go func() {
+		for req := range reqCh {
+			req.Fail(&ProxyError{ErrType: ProxyConnectFailed})
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	for _, addr := range addrs {
+		cli := &SOCKS5Client{Transport: &TCPTransport{}, Addr: addr.(string)}
+		_, _, pErr := cli.Request(ctx, &TCP4Addr{net.IPv4(1, 2, 3, 4), 80})
+		if assert.NotNil(t, pErr) {
+			assert.Equal(t, ProxyConnectFailed, pErr.ErrType)
+		}
+	}
+
+	svr.Stop()
+	for _, addr := range addrs {
+		_, err = net.Dial("tcp", addr.(string))
+		assert.Error(t, err)
+	}
+
+	_, err = NewSOCKS5Client(ProxyConfig{
+		Protocol: "socks5",
+		Settings: map[string]interface{}{"address": addrs},
+	})
+	assert.Error(t, err)
+}
@@ -0,0 +1,134 @@
+// +build !windows
+
+package lib
+
+import (
+	"fmt"
+	"log/syslog"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap/zapcore"
+)
+
+const defaultSyslogTag = "thestral2"
+
+var syslogFacilities = map[string]syslog.Priority{
+	"kern": syslog.LOG_KERN, "user": syslog.LOG_USER,
+	"mail": syslog.LOG_MAIL, "daemon": syslog.LOG_DAEMON,
+	"auth": syslog.LOG_AUTH, "syslog": syslog.LOG_SYSLOG,
+	"lpr": syslog.LOG_LPR, "news": syslog.LOG_NEWS,
+	"uucp": syslog.LOG_UUCP, "cron": syslog.LOG_CRON,
+	"authpriv": syslog.LOG_AUTHPRIV, "ftp": syslog.LOG_FTP,
+	"local0": syslog.LOG_LOCAL0, "local1": syslog.LOG_LOCAL1,
+	"local2": syslog.LOG_LOCAL2, "local3": syslog.LOG_LOCAL3,
+	"local4": syslog.LOG_LOCAL4, "local5": syslog.LOG_LOCAL5,
+	"local6": syslog.LOG_LOCAL6, "local7": syslog.LOG_LOCAL7,
+}
+
+// syslogCore is a zapcore.Core writing to syslog, with the fields formatted as
+// key=value pairs following the message.
+type syslogCore struct {
+	zapcore.LevelEnabler
+	writer *syslog.Writer
+	fields []zapcore.Field
+}
+
+func newSyslogCore(
+	config SyslogConfig, level zapcore.LevelEnabler) (zapcore.Core, error) {
+	facility := syslog.LOG_USER
+	if config.Facility != "" {
+		var ok bool
+		if facility, ok = syslogFacilities[config.Facility]; !ok {
+			return nil, errors.New(
+				"unknown syslog facility: " + config.Facility)
+		}
+	}
+	tag := config.Tag
+	if tag == "" {
+		tag = defaultSyslogTag
+	}
+	if (config.Network == "") != (config.Address == "") {
+		return nil, errors.New(
+			"syslog 'network' and 'address' must be specified together")
+	}
+
+	writer, err := syslog.Dial(
+		config.Network, config.Address, facility|syslog.LOG_INFO, tag)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to connect to syslog")
+	}
+	return &syslogCore{LevelEnabler: level, writer: writer}, nil
+}
+
+func (c *syslogCore) With(fields []zapcore.Field) zapcore.Core {
+	clone := *c
+	clone.fields = make([]zapcore.Field, 0, len(c.fields)+len(fields))
+	clone.fields = append(append(clone.fields, c.fields...), fields...)
+	return &clone
+}
+
+func (c *syslogCore) Check(
+	ent zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if c.Enabled(ent.Level) {
+		return ce.AddCore(ent, c)
+	}
+	return ce
+}
+
+func (c *syslogCore) Write(ent zapcore.Entry, fields []zapcore.Field) error {
+	var sb strings.Builder
+	if ent.LoggerName != "" {
+		sb.WriteString(ent.LoggerName)
+		sb.WriteString(": ")
+	}
+	sb.WriteString(ent.Message)
+	if ent.Caller.Defined {
+		writeSyslogKeyValue(&sb, "caller", ent.Caller.TrimmedPath())
+	}
+	for _, fs := range [][]zapcore.Field{c.fields, fields} {
+		for _, f := range fs {
+			enc := zapcore.NewMapObjectEncoder()
+			f.AddTo(enc)
+			keys := make([]string, 0, len(enc.Fields))
+			for k := range enc.Fields {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			for _, k := range keys {
+				writeSyslogKeyValue(&sb, k, enc.Fields[k])
+			}
+		}
+	}
+
+	msg := sb.String()
+	switch ent.Level {
+	case zapcore.DebugLevel:
+		return c.writer.Debug(msg)
+	case zapcore.InfoLevel:
+		return c.writer.Info(msg)
+	case zapcore.WarnLevel:
+		return c.writer.Warning(msg)
+	case zapcore.ErrorLevel:
+		return c.writer.Err(msg)
+	default: // panic & fatal
+		return c.writer.Crit(msg)
+	}
+}
+
+func (c *syslogCore) Sync() error {
+	return nil
+}
+
+func writeSyslogKeyValue(sb *strings.Builder, key string, value interface{}) {
+	str := fmt.Sprint(value)
+	if str == "" || strings.ContainsAny(str, " =\"\n") {
+		str = strconv.Quote(str)
+	}
+	sb.WriteByte(' ')
+	sb.WriteString(key)
+	sb.WriteByte('=')
+	sb.WriteString(str)
+}
@@ -0,0 +1,44 @@
+// +build !windows
+
+package lib
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSyslogLogger(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer func() { _ = conn.Close() }()
+
+	_, err = CreateLogger(LoggingConfig{Syslog: &SyslogConfig{
+		Network: "udp", Address: conn.LocalAddr().String(),
+		Facility: "unknown"}})
+	assert.Error(t, err)
+	_, err = CreateLogger(LoggingConfig{Syslog: &SyslogConfig{
+		Network: "tcp", Address: "127.0.0.1:1"}}) // unreachable
+	assert.Error(t, err)
+
+	logger, err := CreateLogger(LoggingConfig{Syslog: &SyslogConfig{
+		Network: "udp", Address: conn.LocalAddr().String(),
+		Facility: "local3", Tag: "test"}})
+	require.NoError(t, err)
+	logger.Named("sub").With("id", 42).Warnw(
+		"hello world", "addr", "a b", "ok", true)
+
+	buf := make([]byte, 4096)
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+	n, _, err := conn.ReadFrom(buf)
+	require.NoError(t, err)
+	msg := string(buf[:n])
+	assert.True(t, strings.HasPrefix(msg, "<156>"), msg) // local3.warning
+	assert.Contains(t, msg, " test[")
+	assert.Contains(t, msg, `sub: hello world caller=`)
+	assert.Contains(t, msg, ` id=42 addr="a b" ok=true`)
+}
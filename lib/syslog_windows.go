@@ -0,0 +1,12 @@
+package lib
+
+import (
+	"github.com/pkg/errors"
+	"go.uber.org/zap/zapcore"
+)
+
+// newSyslogCore is not supported on Windows.
+func newSyslogCore(
+	config SyslogConfig, level zapcore.LevelEnabler) (zapcore.Core, error) {
+	return nil, errors.New("syslog is not supported on windows")
+}
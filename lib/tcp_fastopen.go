@@ -0,0 +1,16 @@
+// +build !linux
+
+package lib
+
+import (
+	"syscall"
+)
+
+// TCPFastOpenSupported tells if TCP Fast Open is supported by DirectTCPClient
+// on this platform.
+const TCPFastOpenSupported = false
+
+// enableTCPFastOpen does nothing as TCP Fast Open is only supported on Linux.
+func enableTCPFastOpen(_, _ string, _ syscall.RawConn) error {
+	return nil
+}
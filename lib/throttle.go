@@ -0,0 +1,78 @@
+package lib
+
+import (
+	"context"
+	"io"
+	"math"
+	"time"
+)
+
+// minThrottleBurst is the minimum number of bytes a throttled reader may read
+// at once.
+const minThrottleBurst = 1024
+
+// NewThrottledReader wraps a reader so that data is read from it at no more
+// than the given rate (bytes per second) on average. Reading blocks until the
+// rate allows, instead of dropping any data, or fails when the context is
+// done. The returned reader is not safe for concurrent use.
+func NewThrottledReader(
+	ctx context.Context, r io.Reader, rate uint64) io.Reader {
+	// a burst of 100ms, so that the rate is smooth in short periods
+	burst := math.Max(float64(rate)/10, minThrottleBurst)
+	return &throttledReader{
+		ctx:    ctx,
+		r:      r,
+		rate:   float64(rate),
+		burst:  burst,
+		tokens: burst,
+		last:   time.Now(),
+	}
+}
+
+// throttledReader limits the rate of reading with a token bucket, which may
+// run into debt by the last read.
+type throttledReader struct {
+	ctx    context.Context
+	r      io.Reader
+	rate   float64 // bytes per second
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	for {
+		now := time.Now()
+		t.tokens = math.Min(
+			t.burst, t.tokens+now.Sub(t.last).Seconds()*t.rate)
+		t.last = now
+		if t.tokens >= 0 {
+			break
+		}
+		wait := time.Duration(-t.tokens / t.rate * float64(time.Second))
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-t.ctx.Done():
+			timer.Stop()
+			return 0, t.ctx.Err()
+		}
+	}
+
+	if len(p) > int(t.burst) {
+		p = p[:int(t.burst)]
+	}
+	n, err := t.r.Read(p)
+	t.tokens -= float64(n)
+	return n, err
+}
+
+// SetReadDeadline sets the read deadline of the underlying reader if it's
+// supported. The deadline includes the time waiting for the rate, which is
+// at most that of a burst.
+func (t *throttledReader) SetReadDeadline(d time.Time) error {
+	if r, ok := t.r.(interface{ SetReadDeadline(time.Time) error }); ok {
+		return r.SetReadDeadline(d)
+	}
+	return nil
+}
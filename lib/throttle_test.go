@@ -0,0 +1,62 @@
+package lib
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+func TestThrottledReader(t *testing.T) {
+	const rate = 128 * 1024
+	r := NewThrottledReader(context.Background(), zeroReader{}, rate)
+	start := time.Now()
+	n, err := io.CopyN(ioutil.Discard, r, rate)
+	require.NoError(t, err)
+	assert.EqualValues(t, rate, n)
+	// the burst and the debt of the next read cover 200ms, and only the lower
+	// bound is checked, as a loaded machine can take much longer
+	assert.True(t, time.Since(start) >= time.Millisecond*750,
+		"%v", time.Since(start))
+
+	// the reader keeps the rate after the burst
+	start = time.Now()
+	n, err = io.CopyN(ioutil.Discard, r, rate/2)
+	require.NoError(t, err)
+	assert.EqualValues(t, rate/2, n)
+	assert.True(t, time.Since(start) >= time.Millisecond*450,
+		"%v", time.Since(start))
+}
+
+func TestThrottledReaderCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	r := NewThrottledReader(ctx, zeroReader{}, 1)
+	buf := make([]byte, minThrottleBurst)
+	for i := 0; i < 2; i++ { // the burst, and then into debt
+		n, err := r.Read(buf)
+		require.NoError(t, err)
+		assert.Equal(t, minThrottleBurst, n)
+	}
+
+	go func() {
+		time.Sleep(time.Millisecond * 100)
+		cancel()
+	}()
+	start := time.Now()
+	_, err := r.Read(buf)
+	assert.Equal(t, context.Canceled, err)
+	assert.True(t, time.Since(start) < time.Second)
+}
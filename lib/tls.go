@@ -1,14 +1,17 @@
 package lib
 
 import (
+	"bytes"
 	"context"
 	"crypto/sha1"
+	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/hex"
 	"io/ioutil"
 	"net"
 	"runtime"
+	"strings"
 	"sync"
 	"time"
 
@@ -21,19 +24,25 @@ const defaultTLSHandshakeTimeout = time.Minute * 1
 type TLSTransport struct {
 	inner            Transport
 	tlsConfig        tls.Config
+	serverName       string // overrides the host of the address if not empty
 	handshakeTimeout time.Duration
 }
 
 // NewTLSTransport create a TLSTransport on top of a given inner Transport.
+// The certificate is optional for clients if the server doesn't verify them.
 func NewTLSTransport(config TLSConfig, inner Transport) (*TLSTransport, error) {
-	transport := &TLSTransport{inner: inner}
+	transport := &TLSTransport{inner: inner, serverName: config.ServerName}
 	tc := &transport.tlsConfig
 
-	cert, err := tls.LoadX509KeyPair(config.Cert, config.Key)
-	if err != nil {
-		return nil, errors.Wrap(err, "failed to load key pair")
+	var err error
+	if config.Cert != "" || config.Key != "" {
+		var cert tls.Certificate
+		if cert, err = tls.LoadX509KeyPair(config.Cert, config.Key); err != nil {
+			return nil, errors.Wrap(err, "failed to load key pair")
+		}
+		tc.Certificates = append(tc.Certificates, cert)
 	}
-	tc.Certificates = append(tc.Certificates, cert)
+	tc.NextProtos = config.ALPN
 
 	if len(config.CAs) == 0 {
 		if runtime.GOOS == "windows" {
@@ -58,6 +67,14 @@ func NewTLSTransport(config TLSConfig, inner Transport) (*TLSTransport, error) {
 		}
 	}
 
+	if len(config.PinnedCerts) > 0 {
+		pins, err := parseCertPins(config.PinnedCerts)
+		if err != nil {
+			return nil, err
+		}
+		tc.VerifyPeerCertificate = verifyCertPins(pins)
+	}
+
 	if config.VerifyClient {
 		tc.ClientAuth = tls.RequireAndVerifyClientCert
 	}
@@ -105,8 +122,15 @@ func NewTLSTransport(config TLSConfig, inner Transport) (*TLSTransport, error) {
 	return transport, nil
 }
 
+// Close closes the inner transport if it holds any resource.
+func (t *TLSTransport) Close() error {
+	return closeTransport(t.inner)
+}
+
 // Dial creates a TLS connection to the given address. The hostname part
-// of the address will be verified against the peer certificate.
+// of the address (or the server name if specified) will be sent as SNI and
+// verified against the peer certificate. If ALPN protocols are specified,
+// the server must agree on one of them.
 func (t *TLSTransport) Dial(
 	ctx context.Context, address string) (net.Conn, error) {
 	inner, err := t.inner.Dial(ctx, address)
@@ -120,6 +144,9 @@ func (t *TLSTransport) Dial(
 		return nil, errors.Wrap(err, "invalid address for TLS: "+address)
 	}
 	cfg.ServerName = host
+	if t.serverName != "" {
+		cfg.ServerName = t.serverName
+	}
 	tlsConn := tls.Client(inner, cfg)
 
 	// the channel must be buffered to prevent the hanshaking goroutine from
@@ -129,6 +156,12 @@ func (t *TLSTransport) Dial(
 		_ = tlsConn.SetDeadline(time.Now().Add(t.handshakeTimeout))
 		err := tlsConn.Handshake()
 		_ = tlsConn.SetDeadline(time.Time{})
+		if err == nil && len(cfg.NextProtos) > 0 &&
+			tlsConn.ConnectionState().NegotiatedProtocol == "" {
+			err = errors.Errorf(
+				"server doesn't support any of the ALPN protocols %v",
+				cfg.NextProtos)
+		}
 		resultCh <- err
 	}()
 
@@ -147,6 +180,9 @@ func (t *TLSTransport) Dial(
 
 // Listen creates a TLS server listening on the given address.
 func (t *TLSTransport) Listen(address string) (net.Listener, error) {
+	if len(t.tlsConfig.Certificates) == 0 {
+		return nil, errors.New("a certificate is required for TLS servers")
+	}
 	innerListener, err := t.inner.Listen(address)
 	if err != nil {
 		return nil, errors.WithMessage(err, "failed to accept client")
@@ -194,7 +230,14 @@ func (c *tlsConnWrapper) GetPeerIdentifiers() ([]*PeerIdentifier, error) {
 		}
 		c.peerID = makePeerIdentifier(state)
 	})
-	return []*PeerIdentifier{c.peerID}, errors.WithStack(err)
+	ids := []*PeerIdentifier{c.peerID}
+	// e.g. the relay hops of a PROXY protocol header
+	if inner, ok := c.NetConn().(WithPeerIdentifiers); ok && err == nil {
+		var innerIDs []*PeerIdentifier
+		innerIDs, err = inner.GetPeerIdentifiers()
+		ids = append(ids, innerIDs...)
+	}
+	return ids, errors.WithStack(err)
 }
 
 func makePeerIdentifier(connState tls.ConnectionState) *PeerIdentifier {
@@ -206,6 +249,7 @@ func makePeerIdentifier(connState tls.ConnectionState) *PeerIdentifier {
 			UniqueID: hex.EncodeToString(fingerprint[:]),
 			Name:     cert.Subject.CommonName,
 			ExtraInfo: map[string]interface{}{
+				"subject":    cert.Subject.String(),
 				"issuedBy":   cert.Issuer.CommonName,
 				"validFrom":  cert.NotBefore,
 				"validUntil": cert.NotAfter,
@@ -216,6 +260,39 @@ func makePeerIdentifier(connState tls.ConnectionState) *PeerIdentifier {
 	return nil
 }
 
+// parseCertPins parses the SHA-256 fingerprints of the pinned certificates.
+func parseCertPins(pinned []string) ([][]byte, error) {
+	pins := make([][]byte, len(pinned))
+	for i, s := range pinned {
+		pin, err := hex.DecodeString(strings.Replace(s, ":", "", -1))
+		if err != nil || len(pin) != sha256.Size {
+			return nil, errors.Errorf("invalid SHA-256 fingerprint: %s", s)
+		}
+		pins[i] = pin
+	}
+	return pins, nil
+}
+
+// verifyCertPins returns a VerifyPeerCertificate callback accepting only the
+// peers whose certificates match one of the pins. It's called after the
+// normal verification (if not skipped) succeeds.
+func verifyCertPins(pins [][]byte) func([][]byte, [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return errors.New("no certificate to check against the pins")
+		}
+		fingerprint := sha256.Sum256(rawCerts[0])
+		for _, pin := range pins {
+			if bytes.Equal(pin, fingerprint[:]) {
+				return nil
+			}
+		}
+		return errors.Errorf("certificate pin mismatch: the server "+
+			"certificate (SHA-256 %s) is not pinned",
+			hex.EncodeToString(fingerprint[:]))
+	}
+}
+
 func addCA(cas *x509.CertPool, file string) error {
 	pemData, err := ioutil.ReadFile(file)
 	if err != nil {
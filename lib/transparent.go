@@ -0,0 +1,258 @@
+package lib
+
+import (
+	"context"
+	"io"
+	"net"
+	"reflect"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// TransparentServer is a proxy server accepting the TCP connections redirected
+// to it by the firewall (Linux only). There is no handshake at all, and the
+// target of a connection is the destination the client originally connected
+// to, which is found by one of the following methods:
+//
+// With the REDIRECT target of iptables (the default), the destination is
+// rewritten by NAT and the original one is read by SO_ORIGINAL_DST, e.g.
+//
+//	iptables -t nat -N THESTRAL
+//	iptables -t nat -A THESTRAL -d 192.168.0.0/16 -j RETURN
+//	iptables -t nat -A THESTRAL -p tcp -j REDIRECT --to-ports 1080
+//	iptables -t nat -A PREROUTING -p tcp -j THESTRAL
+//
+// (ip6tables works the same way for IPv6.) The connections from the host
+// itself are redirected by the OUTPUT chain instead of PREROUTING, in which
+// case the ones made by the upstreams must be excluded (e.g. by "-m owner
+// --uid-owner") to avoid loops.
+//
+// With the TPROXY target ('tproxy' set to true), the destination is left
+// intact and becomes the local address of the connection, which requires the
+// listening socket to be transparent (CAP_NET_ADMIN), e.g.
+//
+//	iptables -t mangle -A PREROUTING -p tcp -j TPROXY \
+//	    --on-port 1080 --on-ip 127.0.0.1 --tproxy-mark 0x1/0x1
+//	ip rule add fwmark 0x1/0x1 lookup 100
+//	ip route add local 0.0.0.0/0 dev lo table 100
+//
+// Only the 'tcp' transport (and the 'acl') is supported, since the options are
+// read from the sockets accepted.
+type TransparentServer struct {
+	transport Transport
+	addrs     []string
+	tproxy    bool
+	isRunning uint32 // should be used with atomic operations
+	listener  net.Listener
+	reqCh     chan ProxyRequest
+	log       *zap.SugaredLogger
+}
+
+// NewTransparentServer creates a TransparentServer from the given
+// configuration.
+func NewTransparentServer(
+	logger *zap.SugaredLogger,
+	config ProxyConfig) (*TransparentServer, error) {
+	if !transparentSupported {
+		return nil, errors.New(
+			"'transparent' protocol is only supported on Linux")
+	}
+	var addrs []string
+	var tproxy bool
+	var ok bool
+	var err error
+	for k, v := range config.Settings {
+		switch k {
+		case "address":
+			var e error
+			if addrs, e = parseListenAddrs(v); e != nil {
+				err = e
+			}
+		case "tproxy":
+			if tproxy, ok = v.(bool); !ok {
+				err = errors.Errorf("invalid value for 'tproxy': %v", v)
+			}
+		default:
+			err = errors.New("unknown setting of 'transparent' protocol: " + k)
+		}
+	}
+	if err == nil && (len(addrs) == 0 || addrs[0] == "") {
+		err = errors.New(
+			"a valid 'address' must be specified for transparent protocol")
+	}
+	if err == nil && config.Transport != nil && !reflect.DeepEqual(
+		*config.Transport, TransportConfig{TCP: config.Transport.TCP}) {
+		err = errors.New("'transparent' protocol should not have " +
+			"any transport setting other than 'tcp'")
+	}
+	if err != nil {
+		return nil, errors.WithMessage(
+			err, "failed to create transparent proxy server")
+	}
+
+	tcpTransport := TCPTransport{}
+	if config.Transport != nil && config.Transport.TCP != nil {
+		if tcpTransport.Options, err = NewTCPOptions(
+			*config.Transport.TCP); err != nil {
+			return nil, errors.WithMessage(
+				err, "failed to create transparent proxy server")
+		}
+	}
+	var transport Transport = tcpTransport
+	if tproxy {
+		transport = tproxyTransport{tcpTransport}
+	}
+	if config.ACL != nil {
+		transport, err = WrapTransACL(logger, transport, *config.ACL)
+		if err != nil {
+			return nil, errors.WithMessage(
+				err, "failed to create transparent proxy server")
+		}
+	}
+	return &TransparentServer{
+		transport: transport,
+		addrs:     addrs,
+		tproxy:    tproxy,
+		log:       logger,
+	}, nil
+}
+
+// Start fires up the TransparentServer and returns a channel of client
+// requests.
+func (s *TransparentServer) Start() (<-chan ProxyRequest, error) {
+	s.reqCh = make(chan ProxyRequest, 1)
+
+	var err error
+	if s.listener, err = listenAll(s.transport, s.addrs); err != nil {
+		s.log.Errorw("failed to start transparent proxy server",
+			"addrs", s.addrs, "error", err)
+		return nil, errors.WithMessage(
+			err, "failed to start transparent proxy server")
+	}
+	s.log.Infow("transparent proxy server started",
+		"addrs", s.addrs, "tproxy", s.tproxy)
+
+	atomic.StoreUint32(&s.isRunning, 1)
+	go func() {
+		for {
+			conn, err := acceptRetrying(s.listener, s.log)
+			if err != nil {
+				if atomic.LoadUint32(&s.isRunning) > 0 { // still running
+					s.log.Errorw("permanent accept error",
+						"error", err, "class", errorClass(err))
+				}
+				break
+			}
+
+			reqID := GetNextRequestID()
+			cliLogger := s.log.With("reqID", reqID).Named("client")
+			cliLogger.Debugw(
+				"client connection accepted", "addr", conn.RemoteAddr())
+			go s.handle(&transparentRequest{
+				id: reqID, conn: conn, log: cliLogger})
+		}
+		s.log.Infow("transparent proxy server exited")
+	}()
+
+	return s.reqCh, nil
+}
+
+// Stop kills the server.
+func (s *TransparentServer) Stop() {
+	s.log.Infow("stopping transparent proxy server")
+	atomic.StoreUint32(&s.isRunning, 0)
+	err := s.listener.Close()
+	if err != nil {
+		s.log.Warnw("error occurred when closing listener", "error", err)
+	}
+}
+
+func (s *TransparentServer) handle(cli *transparentRequest) {
+	var dst *net.TCPAddr
+	var err error
+	if tcpConn, ok := cli.conn.(*net.TCPConn); !ok {
+		err = errors.Errorf("unexpected connection type: %T", cli.conn)
+	} else if s.tproxy {
+		dst = tcpConn.LocalAddr().(*net.TCPAddr)
+	} else if dst, err = getOriginalDst(tcpConn); err == nil &&
+		dst.String() == tcpConn.LocalAddr().String() {
+		// connected to the server directly, which would otherwise loop
+		err = errors.New("connection is not redirected")
+	}
+	if err != nil {
+		cli.log.Infow("failed to get original destination", "error", err)
+		_ = cli.conn.Close()
+		return
+	}
+
+	if ip4 := dst.IP.To4(); ip4 != nil {
+		cli.targetAddr = &TCP4Addr{IP: ip4, Port: uint16(dst.Port)}
+	} else {
+		cli.targetAddr = &TCP6Addr{
+			IP: dst.IP, Port: uint16(dst.Port), Zone: dst.Zone}
+	}
+	cli.log.Debugw("original destination read", "target", cli.targetAddr)
+	s.reqCh <- cli
+}
+
+// tproxyTransport is a TCPTransport listening on transparent sockets, which
+// accept the connections to any address routed to them by TPROXY.
+type tproxyTransport struct {
+	TCPTransport
+}
+
+func (t tproxyTransport) Listen(address string) (net.Listener, error) {
+	lc := net.ListenConfig{Control: setTransparent}
+	listener, err := lc.Listen(context.Background(), "tcp", address)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return tcpListener{listener.(*net.TCPListener), t.Options}, nil
+}
+
+type transparentRequest struct {
+	id         string
+	log        *zap.SugaredLogger
+	conn       net.Conn
+	targetAddr Address
+}
+
+// GetPeerIdentifiers returns a list of peer identifiers of this client.
+func (r *transparentRequest) GetPeerIdentifiers() (
+	[]*PeerIdentifier, error) {
+	return nil, nil // anonymous
+}
+
+// PeerAddr returns the address of the client.
+func (r *transparentRequest) PeerAddr() string {
+	return r.conn.RemoteAddr().String()
+}
+
+// TargetAddr returns the address the client originally connected to.
+func (r *transparentRequest) TargetAddr() Address {
+	return r.targetAddr
+}
+
+// Success returns the connection, as there's nothing to reply.
+func (r *transparentRequest) Success(Address) io.ReadWriteCloser {
+	return r.conn
+}
+
+// Fail closes the connection, which is all the client can be told.
+func (r *transparentRequest) Fail(*ProxyError) {
+	if err := r.conn.Close(); err != nil {
+		r.log.Warnw("failed to close client connection", "error", err)
+	}
+}
+
+// Logger returns a logger of this client.
+func (r *transparentRequest) Logger() *zap.SugaredLogger {
+	return r.log
+}
+
+// ID returns the identifier of this client.
+func (r *transparentRequest) ID() string {
+	return r.id
+}
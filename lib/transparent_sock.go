@@ -0,0 +1,22 @@
+// +build !linux
+
+package lib
+
+import (
+	"net"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+const transparentSupported = false
+
+// getOriginalDst is only supported on Linux.
+func getOriginalDst(*net.TCPConn) (*net.TCPAddr, error) {
+	return nil, errors.New("SO_ORIGINAL_DST is only supported on Linux")
+}
+
+// setTransparent is only supported on Linux.
+func setTransparent(string, string, syscall.RawConn) error {
+	return errors.New("IP_TRANSPARENT is only supported on Linux")
+}
@@ -0,0 +1,81 @@
+package lib
+
+import (
+	"encoding/binary"
+	"net"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+const transparentSupported = true
+
+const (
+	soOriginalDst   = 80 // SO_ORIGINAL_DST, IP6T_SO_ORIGINAL_DST as well
+	ipv6Transparent = 75 // IPV6_TRANSPARENT
+)
+
+// getOriginalDst reads the destination of a connection before being
+// redirected by NAT.
+func getOriginalDst(conn *net.TCPConn) (*net.TCPAddr, error) {
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	// IPv4 ones (including the mapped ones) are tracked by iptables
+	ipv4 := conn.LocalAddr().(*net.TCPAddr).IP.To4() != nil
+	var addr *net.TCPAddr
+	cErr := rawConn.Control(func(fd uintptr) {
+		if ipv4 {
+			// sockaddr_in fits in the result of any getsockopt of >= 16 bytes
+			var mreq *syscall.IPv6Mreq
+			mreq, err = syscall.GetsockoptIPv6Mreq(
+				int(fd), syscall.SOL_IP, soOriginalDst)
+			if err == nil {
+				sa := mreq.Multiaddr[:] // family, port, address
+				addr = &net.TCPAddr{
+					IP:   net.IP(append([]byte{}, sa[4:8]...)),
+					Port: int(binary.BigEndian.Uint16(sa[2:4])),
+				}
+			}
+		} else {
+			var info *syscall.IPv6MTUInfo // sockaddr_in6 followed by the MTU
+			info, err = syscall.GetsockoptIPv6MTUInfo(
+				int(fd), syscall.SOL_IPV6, soOriginalDst)
+			if err == nil {
+				var port [2]byte // in the network byte order
+				binary.NativeEndian.PutUint16(port[:], info.Addr.Port)
+				addr = &net.TCPAddr{
+					IP:   net.IP(append([]byte{}, info.Addr.Addr[:]...)),
+					Port: int(binary.BigEndian.Uint16(port[:])),
+				}
+			}
+		}
+	})
+	if cErr != nil {
+		err = cErr
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get SO_ORIGINAL_DST")
+	}
+	return addr, nil
+}
+
+// setTransparent is a listener control function making the socket
+// transparent (IP_TRANSPARENT), which requires CAP_NET_ADMIN.
+func setTransparent(network, _ string, c syscall.RawConn) error {
+	var err error
+	cErr := c.Control(func(fd uintptr) {
+		if network == "tcp4" {
+			err = syscall.SetsockoptInt(
+				int(fd), syscall.SOL_IP, syscall.IP_TRANSPARENT, 1)
+		} else {
+			err = syscall.SetsockoptInt(
+				int(fd), syscall.SOL_IPV6, ipv6Transparent, 1)
+		}
+	})
+	if cErr != nil {
+		err = cErr
+	}
+	return errors.Wrap(err, "failed to set IP_TRANSPARENT")
+}
@@ -0,0 +1,104 @@
+// +build linux
+
+package lib
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func newTransparentServer(
+	settings map[string]interface{}) (*TransparentServer, error) {
+	return NewTransparentServer(zap.NewNop().Sugar(), ProxyConfig{
+		Protocol: "transparent", Settings: settings})
+}
+
+func TestTransparentServerConfig(t *testing.T) {
+	_, err := newTransparentServer(map[string]interface{}{})
+	assert.Error(t, err)
+	_, err = newTransparentServer(map[string]interface{}{
+		"address": "127.0.0.1:0", "tproxy": "yes"})
+	assert.Error(t, err)
+	_, err = newTransparentServer(map[string]interface{}{
+		"address": "127.0.0.1:0", "simplified": true})
+	assert.Error(t, err)
+	_, err = NewTransparentServer(zap.NewNop().Sugar(), ProxyConfig{
+		Protocol:  "transparent",
+		Transport: &TransportConfig{KCP: &KCPConfig{}},
+		Settings:  map[string]interface{}{"address": "127.0.0.1:0"},
+	})
+	assert.Error(t, err)
+
+	svr, err := newTransparentServer(map[string]interface{}{
+		"address": []interface{}{"127.0.0.1:0", "[::1]:0"}, "tproxy": true})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"127.0.0.1:0", "[::1]:0"}, svr.addrs)
+	assert.True(t, svr.tproxy)
+}
+
+func TestTransparentServerNotRedirected(t *testing.T) {
+	svr, err := newTransparentServer(
+		map[string]interface{}{"address": "127.0.0.1:0"})
+	require.NoError(t, err)
+	reqCh, err := svr.Start()
+	require.NoError(t, err)
+	defer svr.Stop()
+
+	// a direct connection has no original destination other than the server
+	conn, err := net.Dial("tcp", svr.listener.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close() // nolint: errcheck
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+	_, err = ioutil.ReadAll(conn)
+	assert.NoError(t, err, "should be closed by the server")
+	select {
+	case req := <-reqCh:
+		t.Errorf("unexpected request to %s", req.TargetAddr())
+	default:
+	}
+}
+
+func TestTransparentServerTProxy(t *testing.T) {
+	svr, err := newTransparentServer(map[string]interface{}{
+		"address": "127.0.0.1:0", "tproxy": true})
+	require.NoError(t, err)
+	reqCh, err := svr.Start()
+	if errors.Cause(err) == syscall.EPERM {
+		t.Skip("CAP_NET_ADMIN is required for IP_TRANSPARENT")
+	}
+	require.NoError(t, err)
+	defer svr.Stop()
+
+	// the local address is the original destination with TPROXY
+	address := svr.listener.Addr().String()
+	conn, err := net.Dial("tcp", address)
+	require.NoError(t, err)
+	defer conn.Close() // nolint: errcheck
+	var req ProxyRequest
+	select {
+	case req = <-reqCh:
+	case <-time.After(time.Second * 5):
+		require.FailNow(t, "request not received")
+	}
+	assert.Equal(t, address, req.TargetAddr().String())
+	assert.Equal(t, conn.LocalAddr().String(), req.PeerAddr())
+
+	svrConn := req.Success(&TCP4Addr{net.IPv4zero, 0})
+	defer svrConn.Close()                            // nolint: errcheck
+	go func() { _, _ = io.Copy(svrConn, svrConn) }() // echo
+	_, err = conn.Write([]byte("hello"))
+	require.NoError(t, err)
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(conn, buf)
+	assert.NoError(t, err)
+	assert.EqualValues(t, "hello", buf)
+}
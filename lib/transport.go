@@ -2,7 +2,11 @@ package lib
 
 import (
 	"context"
+	"io"
 	"net"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/pkg/errors"
 )
@@ -16,28 +20,209 @@ type Transport interface {
 	Listen(address string) (net.Listener, error)
 }
 
+// closeTransport releases the resources held by a transport no longer used,
+// e.g. the pre-connected connections, if it's an io.Closer. The transports
+// wrapping another one close the inner one likewise.
+func closeTransport(transport Transport) error {
+	if closer, ok := transport.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
 // TCPTransport is a Transport on the TCP protocol.
-type TCPTransport struct{}
+type TCPTransport struct {
+	Options *TCPOptions // the defaults if nil
+}
+
+// TCPOptions are the socket options of TCP connections.
+type TCPOptions struct {
+	NoDelay   bool
+	KeepAlive time.Duration // the OS default if 0, disabled if negative
+	Family    string        // of the wildcard listeners, see below
+	Listeners int           // per address (and family), see below
+}
+
+// The families of the listeners on wildcard addresses (e.g. ":1080"):
+//   - "": the OS default, which is usually dual-stack, while some platforms
+//     (e.g. OpenBSD, or Linux with net.ipv6.bindv6only=1) listen on IPv6 only
+//   - "dual_stack": an IPv4 listener and an IPv6 one with IPV6_V6ONLY set,
+//     so that the behavior is the same everywhere
+//   - "ipv4"/"ipv6": the single family, and IPV6_V6ONLY is set for IPv6
+//
+// Listeners on specific addresses are of the families of the addresses.
+//
+// With more than one Listeners (Linux only), the sockets are bound to the same
+// address with SO_REUSEPORT, each of which is accepted by its own goroutine,
+// so that a high rate of accepting is spread across the cores. The kernel
+// balances the incoming connections among the sockets by the hash of their
+// addresses and ports, rather than by which one is idle, so a slow accepting
+// goroutine still gets its share. Moreover, the connections pending in the
+// backlog of a socket are reset when it's closed, rather than taken over by
+// the others.
+var listenFamilies = map[string]bool{
+	"": true, "dual_stack": true, "ipv4": true, "ipv6": true}
 
 type tcpListener struct {
 	*net.TCPListener
+	options *TCPOptions
+}
+
+// NewTCPOptions parses TCPOptions from the given configuration.
+func NewTCPOptions(config TCPConfig) (*TCPOptions, error) {
+	options := &TCPOptions{NoDelay: true}
+	if config.NoDelay != nil {
+		options.NoDelay = *config.NoDelay
+	}
+	if config.KeepAlive != "" {
+		d, err := time.ParseDuration(config.KeepAlive)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid value for 'keep_alive'")
+		} else if d < 0 {
+			return nil, errors.New("'keep_alive' must be >= 0")
+		} else if d == 0 {
+			d = -1 // disabled
+		}
+		options.KeepAlive = d
+	}
+	if !listenFamilies[config.Family] {
+		return nil, errors.New("unknown listen_family: " + config.Family)
+	}
+	options.Family = config.Family
+	if config.Listeners < 0 {
+		return nil, errors.New("'listeners' must be >= 0")
+	} else if config.Listeners > 1 && !reusePortSupported {
+		return nil, errors.New(
+			"multiple 'listeners' are only supported on Linux")
+	}
+	options.Listeners = config.Listeners
+	return options, nil
+}
+
+// Dialer returns a net.Dialer applying the keep-alive option.
+func (o *TCPOptions) Dialer() *net.Dialer {
+	dialer := new(net.Dialer)
+	if o != nil {
+		dialer.KeepAlive = o.KeepAlive
+	}
+	return dialer
+}
+
+// Apply sets the options on a connection, which is ignored if it's not a
+// TCP one.
+func (o *TCPOptions) Apply(conn net.Conn) error {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok || o == nil {
+		return nil
+	}
+	err := tcpConn.SetNoDelay(o.NoDelay)
+	if err == nil && o.KeepAlive < 0 {
+		err = tcpConn.SetKeepAlive(false)
+	} else if err == nil && o.KeepAlive > 0 {
+		if err = tcpConn.SetKeepAlive(true); err == nil {
+			err = tcpConn.SetKeepAlivePeriod(o.KeepAlive)
+		}
+	}
+	return errors.WithStack(err)
 }
 
 // Dial creates a connection to a TCP server.
-func (TCPTransport) Dial(
+func (t TCPTransport) Dial(
 	ctx context.Context, address string) (net.Conn, error) {
-	conn, err := new(net.Dialer).DialContext(ctx, "tcp", address)
+	conn, err := t.Options.Dialer().DialContext(ctx, "tcp", address)
+	if err == nil {
+		if err = t.Options.Apply(conn); err != nil {
+			_ = conn.Close()
+			conn = nil
+		}
+	}
 	return conn, errors.WithStack(err)
 }
 
-// Listen creates a TCP listener on a given address.
-func (TCPTransport) Listen(address string) (net.Listener, error) {
-	if addr, err := net.ResolveTCPAddr("tcp", address); err != nil {
+// Listen creates a TCP listener on a given address. The listener on a
+// wildcard address is created according to the Family of the options. The
+// inherited listeners (see IsInheritedAddr) are used as they are.
+func (t TCPTransport) Listen(address string) (net.Listener, error) {
+	if IsInheritedAddr(address) {
+		listener, err := inheritListener(address)
+		if err != nil {
+			return nil, err
+		}
+		return tcpListener{listener, t.Options}, nil
+	}
+	addr, err := net.ResolveTCPAddr("tcp", address)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	family := ""
+	if t.Options != nil && (addr.IP == nil || addr.IP.IsUnspecified()) {
+		family = t.Options.Family
+	}
+	ipv4 := &net.TCPAddr{IP: net.IPv4zero, Port: addr.Port}
+	ipv6 := &net.TCPAddr{IP: net.IPv6unspecified, Port: addr.Port}
+	switch family {
+	case "ipv4":
+		return t.listen("tcp4", ipv4)
+	case "ipv6":
+		return t.listen("tcp6", ipv6)
+	case "dual_stack":
+		l4, err := t.listen("tcp4", ipv4)
+		if err != nil {
+			return nil, err
+		}
+		ipv6.Port = l4.Addr().(*net.TCPAddr).Port // in case of port 0
+		l6, err := t.listen("tcp6", ipv6)
+		if err != nil {
+			_ = l4.Close()
+			return nil, err
+		}
+		return newMultiListener([]net.Listener{l4, l6}), nil
+	default:
+		return t.listen("tcp", addr)
+	}
+}
+
+// listen creates the Listeners of the options on an address, which are merged
+// if there are more than one.
+func (t TCPTransport) listen(
+	network string, addr *net.TCPAddr) (net.Listener, error) {
+	if t.Options == nil || t.Options.Listeners <= 1 {
+		return t.listenOne(network, addr, false)
+	}
+	listeners := make([]net.Listener, 0, t.Options.Listeners)
+	for len(listeners) < t.Options.Listeners {
+		listener, err := t.listenOne(network, addr, true)
+		if err != nil {
+			for _, l := range listeners {
+				_ = l.Close()
+			}
+			return nil, err
+		}
+		listeners = append(listeners, listener)
+		addr = listener.Addr().(*net.TCPAddr) // in case of port 0
+	}
+	return newMultiListener(listeners), nil
+}
+
+func (t TCPTransport) listenOne(network string, addr *net.TCPAddr,
+	reusePort bool) (net.Listener, error) {
+	ipv6Only := network == "tcp6" // not the dual-stack "tcp" on IPv6
+	lc := net.ListenConfig{Control: func(
+		network, address string, c syscall.RawConn) error {
+		var err error
+		if ipv6Only {
+			err = setIPv6Only(network, address, c)
+		}
+		if err == nil && reusePort {
+			err = setReusePort(network, address, c)
+		}
+		return err
+	}}
+	listener, err := lc.Listen(context.Background(), network, addr.String())
+	if err != nil {
 		return nil, errors.WithStack(err)
-	} else {
-		listener, err := net.ListenTCP("tcp", addr)
-		return tcpListener{listener}, errors.WithStack(err)
 	}
+	return tcpListener{listener.(*net.TCPListener), t.Options}, nil
 }
 
 func (l tcpListener) Accept() (net.Conn, error) {
@@ -46,6 +231,9 @@ func (l tcpListener) Accept() (net.Conn, error) {
 	} else if err = conn.SetKeepAlive(true); err != nil {
 		_ = conn.Close()
 		return nil, errors.WithStack(err)
+	} else if err = l.options.Apply(conn); err != nil {
+		_ = conn.Close()
+		return nil, err
 	} else {
 		return conn, nil
 	}
@@ -62,22 +250,76 @@ func CreateTransport(
 	// Proxied/KCP/TCP is should be the inner most layer
 	if config.KCP != nil && config.Proxied != nil {
 		err = errors.New("'kcp' cannot be used along with 'proxied'")
+	} else if config.TCP != nil && (config.KCP != nil || config.Proxied != nil) {
+		err = errors.New("'tcp' cannot be used along with 'kcp' or 'proxied'")
 	} else if config.KCP != nil {
 		transport, err = NewKCPTransport(*config.KCP)
 	} else if config.Proxied != nil {
 		transport, err = NewProxiedTransport(*config.Proxied)
+	} else if config.TCP != nil {
+		var options *TCPOptions
+		if options, err = NewTCPOptions(*config.TCP); err == nil {
+			transport = TCPTransport{options}
+		}
 	} else {
 		transport = TCPTransport{}
 	}
 
+	// the PROXY protocol header precedes anything else on the TCP connection
+	if err == nil && config.ProxyProtocol {
+		if config.KCP != nil || config.Proxied != nil {
+			err = errors.New("'proxy_protocol' is only supported over TCP")
+		} else {
+			transport = WrapTransProxyProtocol(transport)
+		}
+	}
+
+	// obfuscation works directly on the inner most layer
+	if err == nil && config.Obfs != nil {
+		transport, err = WrapTransObfs(transport, *config.Obfs)
+	}
+
 	// encryption wraps around the inner
 	if err == nil && config.TLS != nil {
 		transport, err = NewTLSTransport(*config.TLS, transport)
 	}
 
+	// WebSocket works on top of TCP or TLS
+	if err == nil && config.WebSocket != nil {
+		transport, err = NewWebSocketTransport(*config.WebSocket, transport)
+	}
+
 	// compression & pre_conn should be the outer most layer
-	if err == nil && config.Compression != "" {
-		transport, err = WrapTransCompression(transport, config.Compression)
+	compressed := config.Compression != "" ||
+		config.CompressionUp != "" || config.CompressionDown != ""
+	if err == nil && compressed {
+		threshold := DefaultCompressionThreshold
+		if config.CompressionThreshold != nil {
+			threshold = *config.CompressionThreshold
+		}
+		if config.CompressionNegotiation &&
+			(config.CompressionUp != "" || config.CompressionDown != "") {
+			err = errors.New("'compression_negotiation' can't be used with " +
+				"'compression_up' or 'compression_down'")
+		} else if config.CompressionNegotiation {
+			methods := strings.Split(config.Compression, ",")
+			transport, err = WrapTransNegotiatedCompression(
+				transport, methods, threshold)
+		} else {
+			// the static methods are framed only if the threshold is set, to
+			// be compatible with the peers not supporting it by default
+			if config.CompressionThreshold == nil {
+				threshold = LegacyCompressionThreshold
+			}
+			methods := CompressionMethods{config.Compression, config.Compression}
+			if config.CompressionUp != "" {
+				methods.Up = config.CompressionUp
+			}
+			if config.CompressionDown != "" {
+				methods.Down = config.CompressionDown
+			}
+			transport, err = WrapTransCompression(transport, methods, threshold)
+		}
 	}
 	if err == nil && config.PreConn != nil {
 		transport, err = WrapAsPreConnTransport(transport, *config.PreConn)
@@ -3,19 +3,34 @@ package lib
 import (
 	"bytes"
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"math/big"
 	"math/rand"
 	"net"
+	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"github.com/stretchr/testify/suite"
+	"github.com/xtaci/kcp-go"
 )
 
 var gKCPServerConfig = &KCPConfig{
@@ -45,8 +60,108 @@ func TestTransportDefault(t *testing.T) {
 	doTestWithTransConf(t, nil, nil)
 }
 
+func TestTransportTCPOptions(t *testing.T) {
+	noDelay := false
+	tcpConfig := &TCPConfig{NoDelay: &noDelay, KeepAlive: "10s"}
+	doTestWithTransConf(t,
+		&TransportConfig{TCP: tcpConfig}, &TransportConfig{TCP: tcpConfig})
+
+	options, err := NewTCPOptions(TCPConfig{KeepAlive: "0"})
+	require.NoError(t, err)
+	assert.Equal(t, &TCPOptions{NoDelay: true, KeepAlive: -1}, options)
+	cliConn, svrConn := net.Pipe()
+	assert.NoError(t, options.Apply(cliConn)) // ignored
+	_, _ = cliConn.Close(), svrConn.Close()
+
+	for _, config := range []*TransportConfig{
+		{TCP: &TCPConfig{KeepAlive: "-1s"}},
+		{TCP: &TCPConfig{Family: "ipx"}},
+		{TCP: &TCPConfig{Listeners: -1}},
+		{TCP: &TCPConfig{}, KCP: &KCPConfig{}},
+	} {
+		_, err = CreateTransport(config)
+		assert.Error(t, err)
+	}
+}
+
+func TestTCPTransportListenFamily(t *testing.T) {
+	if l, err := net.Listen("tcp6", "[::1]:0"); err != nil {
+		t.Skip("IPv6 is unavailable: ", err)
+	} else {
+		_ = l.Close()
+	}
+	accepts := func(family, addr string) (v4, v6 bool) {
+		transport := TCPTransport{&TCPOptions{Family: family}}
+		listener, err := transport.Listen(addr)
+		require.NoError(t, err)
+		defer func() { _ = listener.Close() }()
+		go func() {
+			for {
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				_ = conn.Close()
+			}
+		}()
+		port := strconv.Itoa(listener.Addr().(*net.TCPAddr).Port)
+		dial := func(host string) bool {
+			conn, err := net.Dial("tcp", net.JoinHostPort(host, port))
+			if err == nil {
+				_ = conn.Close()
+			}
+			return err == nil
+		}
+		return dial("127.0.0.1"), dial("::1")
+	}
+
+	v4, v6 := accepts("dual_stack", ":0")
+	assert.True(t, v4 && v6)
+	v4, v6 = accepts("ipv4", ":0")
+	assert.True(t, v4 && !v6)
+	v4, v6 = accepts("ipv6", "[::]:0")
+	assert.True(t, !v4 && v6)
+	v4, v6 = accepts("ipv6", "127.0.0.1:0") // not a wildcard address
+	assert.True(t, v4 && !v6)
+}
+
+func TestTCPTransportListeners(t *testing.T) {
+	if !reusePortSupported {
+		_, err := NewTCPOptions(TCPConfig{Listeners: 2})
+		assert.Error(t, err)
+		t.Skip("SO_REUSEPORT is unsupported")
+	}
+	options, err := NewTCPOptions(TCPConfig{Listeners: 4})
+	require.NoError(t, err)
+	listener, err := TCPTransport{options}.Listen("127.0.0.1:0")
+	require.NoError(t, err)
+	defer func() { _ = listener.Close() }()
+	require.IsType(t, &multiListener{}, listener)
+	listeners := listener.(*multiListener).listeners
+	require.Len(t, listeners, 4)
+	for _, l := range listeners {
+		assert.Equal(t, listener.Addr().String(), l.Addr().String())
+	}
+
+	const conns = 32
+	go func() {
+		for i := 0; i < conns; i++ {
+			conn, err := net.Dial("tcp", listener.Addr().String())
+			if err != nil {
+				return
+			}
+			defer func() { _ = conn.Close() }()
+		}
+	}()
+	for i := 0; i < conns; i++ {
+		conn, err := listener.Accept()
+		require.NoError(t, err)
+		_ = conn.Close()
+	}
+}
+
 func TestTransport(t *testing.T) {
-	for _, compMethod := range []string{"", "snappy", "deflate"} {
+	for _, compMethod := range []string{"", "snappy", "deflate", "gzip", "zstd"} {
 		for _, tls := range []bool{false, true} {
 			for _, kcp := range []bool{false, true} {
 				for _, preConn := range []bool{false, true} {
@@ -170,17 +285,7 @@ func runEchoServer(
 
 type KCPKeepAliveTestSuite struct {
 	suite.Suite
-	svrTrans, cliTrans   *KCPTransport
-	origCloseSendTimeout time.Duration
-}
-
-func (s *KCPKeepAliveTestSuite) SetupSuite() {
-	s.origCloseSendTimeout = kcpCloseSendTimeout
-	kcpCloseSendTimeout = 50 * time.Millisecond
-}
-
-func (s *KCPKeepAliveTestSuite) TearDownSuite() {
-	kcpCloseSendTimeout = s.origCloseSendTimeout
+	svrTrans, cliTrans *KCPTransport
 }
 
 func (s *KCPKeepAliveTestSuite) SetupTest() {
@@ -192,6 +297,7 @@ func (s *KCPKeepAliveTestSuite) SetupTest() {
 		FECDist:           "10, 2",
 		KeepAliveInterval: "50ms",
 		KeepAliveTimeout:  "150ms",
+		CloseSendTimeout:  "50ms",
 	})
 	s.Require().NoError(err)
 	s.cliTrans, err = NewKCPTransport(KCPConfig{
@@ -201,6 +307,7 @@ func (s *KCPKeepAliveTestSuite) SetupTest() {
 		FECDist:           "10, 2",
 		KeepAliveInterval: "50ms",
 		KeepAliveTimeout:  "150ms",
+		CloseSendTimeout:  "50ms",
 	})
 	s.Require().NoError(err)
 }
@@ -209,10 +316,10 @@ func (s *KCPKeepAliveTestSuite) TearDownTest() {
 	// check if the connection lists are correctly emptied
 	s.svrTrans.connsMtx.Lock()
 	defer s.svrTrans.connsMtx.Unlock()
-	s.Equal(0, s.svrTrans.conns.Len())
+	s.Equal(0, s.svrTrans.sessions.Len())
 	s.cliTrans.connsMtx.Lock()
 	defer s.cliTrans.connsMtx.Unlock()
-	s.Equal(0, s.cliTrans.conns.Len())
+	s.Equal(0, s.cliTrans.sessions.Len())
 }
 
 func (s *KCPKeepAliveTestSuite) startServer(
@@ -288,6 +395,37 @@ func (s *KCPKeepAliveTestSuite) TestNormalLongIdle() {
 	time.Sleep(100 * time.Millisecond) // ensure the conn lists are cleaned-up
 }
 
+func (s *KCPKeepAliveTestSuite) TestJitteredPaddedLongIdle() {
+	for _, trans := range []*KCPTransport{s.svrTrans, s.cliTrans} {
+		trans.connsMtx.Lock()
+		trans.keepAliveJitter, trans.keepAlivePadding = 0.5, 255
+		trans.connsMtx.Unlock()
+	}
+	listener, err := s.svrTrans.Listen("127.0.0.1:0")
+	s.Require().NoError(err)
+	svrWg := sync.WaitGroup{}
+	s.startServer(&svrWg, listener, false, false)
+
+	cli, err := s.cliTrans.Dial(
+		context.Background(), listener.Addr().String())
+	s.Require().NoError(err)
+	for _, data := range getRandomData(3) {
+		time.Sleep(500 * time.Millisecond) // > KeepAliveTimeout
+		_, err := cli.Write(data)
+		s.Require().NoError(err)
+		buf := make([]byte, len(data))
+		_, err = io.ReadFull(cli, buf)
+		s.Require().NoError(err)
+		s.Equal(data, buf)
+	}
+	s.NoError(cli.Close())
+
+	time.Sleep(100 * time.Millisecond) // let the svr conns close normally
+	_ = listener.Close()
+	svrWg.Wait()
+	time.Sleep(100 * time.Millisecond) // ensure the conn lists are cleaned-up
+}
+
 func (s *KCPKeepAliveTestSuite) TestServerConnLost() {
 	listener, err := s.svrTrans.Listen("127.0.0.1:0")
 	s.Require().NoError(err)
@@ -374,3 +512,476 @@ func (s *KCPKeepAliveTestSuite) TestClientConnLost() {
 func TestKCPTestSuite(t *testing.T) {
 	suite.Run(t, new(KCPKeepAliveTestSuite))
 }
+
+func TestKCPTransportDialRetries(t *testing.T) {
+	// the first dials fail
+	errTransient := errors.New("transient error")
+	var failures int32
+	defer func() { kcpNewConn = kcp.NewConn }()
+	kcpNewConn = func(raddr string, block kcp.BlockCrypt, dataShards,
+		parityShards int, conn net.PacketConn) (*kcp.UDPSession, error) {
+		if atomic.AddInt32(&failures, -1) >= 0 {
+			return nil, errTransient
+		}
+		return kcp.NewConn(raddr, block, dataShards, parityShards, conn)
+	}
+
+	for _, config := range []KCPConfig{
+		{DialRetries: -1},
+		{DialRetryDelay: "0s"},
+		{DialRetryDelay: "x"},
+	} {
+		_, err := NewKCPTransport(config)
+		assert.Error(t, err, "%+v", config)
+	}
+	trans, err := NewKCPTransport(
+		KCPConfig{DialRetries: 2, DialRetryDelay: "50ms"})
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	atomic.StoreInt32(&failures, 2)
+	start := time.Now()
+	conn, err := trans.Dial(ctx, "127.0.0.1:1")
+	require.NoError(t, err)
+	_ = conn.Close()
+	assert.InDelta(t, 0.15, time.Since(start).Seconds(), 0.05) // 50ms + 100ms
+
+	atomic.StoreInt32(&failures, 3)
+	_, err = trans.Dial(ctx, "127.0.0.1:1")
+	assert.Equal(t, errTransient, errors.Cause(err))
+
+	// invalid addresses are not retried
+	atomic.StoreInt32(&failures, 0)
+	start = time.Now()
+	_, err = trans.Dial(ctx, "127.0.0.1")
+	assert.Error(t, err)
+	assert.True(t, time.Since(start) < time.Millisecond*50)
+
+	// the context stops the retries
+	atomic.StoreInt32(&failures, 3)
+	ctx, cancel := context.WithTimeout(ctx, time.Millisecond*75)
+	defer cancel()
+	_, err = trans.Dial(ctx, "127.0.0.1:1")
+	assert.Equal(t, context.DeadlineExceeded, errors.Cause(err))
+}
+
+func TestKCPTransportKeepAliveCheck(t *testing.T) {
+	for _, check := range []string{"0s", "-1s", "4s", "x"} {
+		_, err := NewKCPTransport(KCPConfig{KeepAliveInterval: "1s",
+			KeepAliveTimeout: "3s", KeepAliveCheck: check})
+		assert.Error(t, err, check)
+	}
+	_, err := NewKCPTransport(KCPConfig{KeepAliveCheck: "1s"})
+	assert.Error(t, err)
+
+	trans, err := NewKCPTransport(
+		KCPConfig{KeepAliveInterval: "1s", KeepAliveTimeout: "3s"})
+	require.NoError(t, err)
+	assert.Equal(t, time.Millisecond*250, trans.keepAliveCheck)
+	trans, err = NewKCPTransport(KCPConfig{KeepAliveInterval: "1s",
+		KeepAliveTimeout: "3s", KeepAliveCheck: "3s"})
+	require.NoError(t, err)
+	assert.Equal(t, time.Second*3, trans.keepAliveCheck)
+}
+
+func TestKCPTransportKeepAliveJitter(t *testing.T) {
+	for _, config := range []KCPConfig{
+		{KeepAliveJitter: 10},
+		{KeepAlivePadding: 10},
+		{KeepAliveInterval: "1s", KeepAliveTimeout: "3s", KeepAliveJitter: -1},
+		{KeepAliveInterval: "1s", KeepAliveTimeout: "3s", KeepAliveJitter: 100},
+		{KeepAliveInterval: "1s", KeepAliveTimeout: "3s",
+			KeepAlivePadding: 256},
+	} {
+		_, err := NewKCPTransport(config)
+		assert.Error(t, err, "%+v", config)
+	}
+
+	trans, err := NewKCPTransport(
+		KCPConfig{KeepAliveInterval: "1s", KeepAliveTimeout: "3s"})
+	require.NoError(t, err)
+	assert.EqualValues(t, time.Second, trans.nextKeepAliveIdle())
+	trans, err = NewKCPTransport(KCPConfig{KeepAliveInterval: "1s",
+		KeepAliveTimeout: "3s", KeepAliveJitter: 20})
+	require.NoError(t, err)
+	varied := false
+	for i := 0; i < 100; i++ {
+		idle := time.Duration(trans.nextKeepAliveIdle())
+		assert.True(t, idle >= time.Millisecond*800 &&
+			idle <= time.Millisecond*1200, idle)
+		varied = varied || idle != time.Second
+	}
+	assert.True(t, varied)
+}
+
+func TestKCPTransportCloseTimeouts(t *testing.T) {
+	for _, config := range []KCPConfig{
+		{CloseSendTimeout: "-1s"},
+		{CloseSendTimeout: "x"},
+		{CloseLinger: "-1s"},
+	} {
+		_, err := NewKCPTransport(config)
+		assert.Error(t, err, "%+v", config)
+	}
+	trans, err := NewKCPTransport(KCPConfig{})
+	require.NoError(t, err)
+	assert.Equal(t, time.Second*10, trans.closeSendTimeout)
+	assert.Equal(t, time.Second*10, trans.closeLinger)
+
+	trans, err = NewKCPTransport(
+		KCPConfig{CloseSendTimeout: "0s", CloseLinger: "50ms"})
+	require.NoError(t, err)
+	assert.Equal(t, time.Duration(0), trans.closeSendTimeout)
+	conn, err := trans.Dial(context.Background(), "127.0.0.1:1")
+	require.NoError(t, err)
+	session := conn.(*kcpConnWrapper).UDPSession
+	require.NoError(t, conn.Close())
+	_, err = session.Write([]byte{kcpKeepAlive})
+	assert.NoError(t, err) // still lingering
+	time.Sleep(time.Millisecond * 100)
+	_, err = session.Write([]byte{kcpKeepAlive})
+	assert.Error(t, err)
+}
+
+func TestKCPTransportMaxSessions(t *testing.T) {
+	for _, config := range []KCPConfig{
+		{MaxSessions: -1},
+		{MaxSessions: 1}, // without keep-alive
+	} {
+		_, err := NewKCPTransport(config)
+		assert.Error(t, err, "%+v", config)
+	}
+	svrTrans, err := NewKCPTransport(KCPConfig{
+		KeepAliveInterval: "1s", KeepAliveTimeout: "3s", MaxSessions: 2})
+	require.NoError(t, err)
+	cliTrans, err := NewKCPTransport(KCPConfig{})
+	require.NoError(t, err)
+	listener, err := svrTrans.Listen("127.0.0.1:0")
+	require.NoError(t, err)
+
+	accepted := make(chan net.Conn)
+	acceptDone := make(chan struct{})
+	go func() {
+		defer close(acceptDone)
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+		}
+	}()
+	for i := 0; i < 3; i++ {
+		conn, err := cliTrans.Dial(
+			context.Background(), listener.Addr().String())
+		require.NoError(t, err)
+		defer conn.Close() // nolint: errcheck
+		_, err = conn.Write([]byte{1})
+		require.NoError(t, err)
+	}
+	var conns []net.Conn
+	for i := 0; i < 2; i++ {
+		select {
+		case conn := <-accepted:
+			conns = append(conns, conn)
+		case <-time.After(time.Second):
+			require.FailNow(t, "session not accepted")
+		}
+	}
+	select {
+	case <-accepted:
+		require.FailNow(t, "too many sessions accepted")
+	case <-time.After(time.Millisecond * 300):
+	}
+
+	// room is made by closing a session
+	_ = conns[0].Close()
+	select {
+	case conn := <-accepted:
+		conns[0] = conn
+	case <-time.After(time.Second):
+		require.FailNow(t, "session not accepted after closing one")
+	}
+	for _, conn := range conns {
+		_ = conn.Close()
+	}
+	_ = listener.Close()
+	select {
+	case <-acceptDone:
+	case <-time.After(time.Second):
+		assert.Fail(t, "Accept not stopped by closing the listener")
+	}
+}
+
+func BenchmarkKCPKeepAliveManager(b *testing.B) {
+	// 10k sessions not idle, each of which should be checked once per
+	// keep_alive_timeout, i.e. every 12 ticks
+	t := &KCPTransport{
+		keepAliveInterval: time.Second,
+		keepAliveTimeout:  time.Second * 3,
+		keepAliveCheck:    time.Second / 4,
+	}
+	t.connsCond = sync.NewCond(&t.connsMtx)
+	now := time.Now().UnixNano()
+	lastSend := now + time.Hour.Nanoseconds() // no keep-alive signal sent
+	for i := 0; i < 10000; i++ {
+		conn := &kcpConnWrapper{lastSend: lastSend, heapIndex: -1}
+		t.track(conn, now-int64(i)*t.keepAliveTimeout.Nanoseconds()/10000)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		now += t.keepAliveCheck.Nanoseconds()
+		t.checkSessions(now)
+	}
+}
+
+func TestTLSTransportSNIAndALPN(t *testing.T) {
+	svrConfig := *gTLSServerConfig
+	svrConfig.ALPN = []string{"h2", "http/1.1"}
+	svrTrans, err := NewTLSTransport(svrConfig, TCPTransport{})
+	require.NoError(t, err)
+	address := "127.0.0.1:" + strconv.Itoa(50000+(rand.Intn(2048)))
+	listener, err := svrTrans.Listen(address)
+	require.NoError(t, err)
+	defer func() { _ = listener.Close() }()
+	peerIDCh := make(chan *PeerIdentifier, 1)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			ids, err := conn.(WithPeerIdentifiers).GetPeerIdentifiers()
+			if err == nil {
+				peerIDCh <- ids[0]
+			}
+			_ = conn.Close()
+		}
+	}()
+
+	dial := func(config TLSConfig) (net.Conn, error) {
+		trans, err := NewTLSTransport(config, TCPTransport{})
+		require.NoError(t, err)
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		return trans.Dial(ctx, address)
+	}
+
+	cliConfig := *gTLSClientConfig
+	cliConfig.ServerName = "localhost"
+	cliConfig.ALPN = []string{"h2"}
+	conn, err := dial(cliConfig)
+	if assert.NoError(t, err) {
+		state := conn.(*tlsConnWrapper).ConnectionState()
+		assert.Equal(t, "localhost", state.ServerName)
+		assert.Equal(t, "h2", state.NegotiatedProtocol)
+		_ = conn.Close()
+		peerID := <-peerIDCh
+		if assert.NotNil(t, peerID) {
+			assert.Equal(t, "CN=TEST CLIENT (DON'T USE IN PRODUCTION)",
+				peerID.ExtraInfo["subject"])
+		}
+	}
+
+	cliConfig.ServerName = "not.the.server"
+	_, err = dial(cliConfig)
+	assert.Error(t, err)
+
+	cliConfig.ServerName = ""
+	cliConfig.ALPN = []string{"unknown"}
+	_, err = dial(cliConfig)
+	assert.Error(t, err)
+
+	// client certificate required, which fails the handshake on the server
+	// side only in TLS 1.3
+	conn, err = dial(TLSConfig{CAs: gTLSClientConfig.CAs})
+	if err == nil {
+		_ = conn.Close()
+		select {
+		case <-peerIDCh:
+			t.Error("client without a certificate is accepted")
+		case <-time.After(time.Millisecond * 200):
+		}
+	}
+	noCertTrans, err := NewTLSTransport(TLSConfig{}, TCPTransport{})
+	require.NoError(t, err)
+	_, err = noCertTrans.Listen("127.0.0.1:0")
+	assert.Error(t, err)
+}
+
+// writeSelfSignedCert generates a self-signed certificate of 127.0.0.1 in
+// the directory, and returns the paths and the DER of the certificate.
+func writeSelfSignedCert(
+	t *testing.T, dir string) (certFile, keyFile string, der []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), crand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "self-signed"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	der, err = x509.CreateCertificate(
+		crand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	certFile = filepath.Join(dir, "cert.pem")
+	keyFile = filepath.Join(dir, "key.pem")
+	require.NoError(t, ioutil.WriteFile(certFile, pem.EncodeToMemory(
+		&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	require.NoError(t, ioutil.WriteFile(keyFile, pem.EncodeToMemory(
+		&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600))
+	return
+}
+
+func TestTLSTransportCertPins(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "thestral2_TestTLSTransportCertPins")
+	require.NoError(t, err)
+	defer func() { _ = os.RemoveAll(tmpDir) }()
+	certFile, keyFile, der := writeSelfSignedCert(t, tmpDir)
+
+	svrTrans, err := NewTLSTransport(
+		TLSConfig{Cert: certFile, Key: keyFile}, TCPTransport{})
+	require.NoError(t, err)
+	listener, err := svrTrans.Listen("127.0.0.1:0")
+	require.NoError(t, err)
+	defer func() { _ = listener.Close() }()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_, _ = conn.(WithPeerIdentifiers).GetPeerIdentifiers()
+				_ = conn.Close()
+			}()
+		}
+	}()
+
+	dial := func(pins ...string) error {
+		trans, err := NewTLSTransport(
+			TLSConfig{CAs: []string{certFile}, PinnedCerts: pins},
+			TCPTransport{})
+		require.NoError(t, err)
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		conn, err := trans.Dial(ctx, listener.Addr().String())
+		if err == nil {
+			_ = conn.Close()
+		}
+		return err
+	}
+	fingerprint := sha256.Sum256(der)
+	pin := hex.EncodeToString(fingerprint[:])
+	var colonPin []string
+	for i := 0; i < len(pin); i += 2 {
+		colonPin = append(colonPin, strings.ToUpper(pin[i:i+2]))
+	}
+	wrongPin := strings.Repeat("00", sha256.Size)
+
+	assert.NoError(t, dial()) // trusted as a CA
+	assert.NoError(t, dial(pin))
+	assert.NoError(t, dial(wrongPin, strings.Join(colonPin, ":")))
+	err = dial(wrongPin)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "certificate pin mismatch")
+		assert.Contains(t, err.Error(), pin)
+	}
+
+	// the pins don't replace the verification against the CAs
+	trans, err := NewTLSTransport(
+		TLSConfig{CAs: gTLSClientConfig.CAs, PinnedCerts: []string{pin}},
+		TCPTransport{})
+	require.NoError(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	_, err = trans.Dial(ctx, listener.Addr().String())
+	assert.Error(t, err)
+
+	for _, invalid := range []string{"xyz", pin[2:], pin + "00"} {
+		_, err = NewTLSTransport(
+			TLSConfig{PinnedCerts: []string{invalid}}, TCPTransport{})
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestWebSocketTransport(t *testing.T) {
+	wsConfig := &WebSocketConfig{Path: "/ws", Host: "example.com"}
+	doTestWithTransConf(t,
+		&TransportConfig{WebSocket: wsConfig},
+		&TransportConfig{WebSocket: wsConfig})
+	doTestWithTransConf(t,
+		&TransportConfig{
+			WebSocket: wsConfig, TLS: gTLSServerConfig, Compression: "snappy"},
+		&TransportConfig{
+			WebSocket: wsConfig, TLS: gTLSClientConfig, Compression: "snappy"})
+
+	svrTrans, err := NewWebSocketTransport(*wsConfig, TCPTransport{})
+	require.NoError(t, err)
+	listener, err := svrTrans.Listen("127.0.0.1:0")
+	require.NoError(t, err)
+	defer func() { _ = listener.Close() }()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			_ = conn.Close()
+		}
+	}()
+	for _, config := range []WebSocketConfig{
+		{Path: "/other", Host: wsConfig.Host},
+		{Path: wsConfig.Path, Host: "other.com"},
+	} {
+		cliTrans, err := NewWebSocketTransport(config, TCPTransport{})
+		require.NoError(t, err)
+		_, err = cliTrans.Dial(
+			context.Background(), listener.Addr().String())
+		assert.Error(t, err, "%+v", config)
+	}
+
+	_, err = NewWebSocketTransport(WebSocketConfig{Path: "ws"}, TCPTransport{})
+	assert.Error(t, err)
+}
+
+func TestKCPLargeWrite(t *testing.T) {
+	if testing.Short() {
+		t.Skip("slow through a small window")
+	}
+	config := KCPConfig{Mode: "fast2", Optimize: "_test_small"}
+	svrTrans, err := NewKCPTransport(config)
+	require.NoError(t, err)
+	cliTrans, err := NewKCPTransport(config)
+	require.NoError(t, err)
+	listener, err := svrTrans.Listen("127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close() // nolint: errcheck
+
+	data := make([]byte, 100*1024*1024) // split into multiple frames
+	rand.Read(data)                     // nolint: gosec
+	received := make(chan []byte, 1)
+	go func() {
+		buf := new(bytes.Buffer)
+		if conn, err := listener.Accept(); err == nil {
+			_, _ = io.Copy(buf, conn)
+			_ = conn.Close()
+		}
+		received <- buf.Bytes()
+	}()
+
+	conn, err := cliTrans.Dial(context.Background(), listener.Addr().String())
+	require.NoError(t, err)
+	n, err := conn.Write(data)
+	assert.NoError(t, err)
+	assert.Equal(t, len(data), n)
+	_ = conn.Close()
+	assert.True(t, bytes.Equal(data, <-received))
+}
@@ -0,0 +1,184 @@
+package lib
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// TrojanClient is a ProxyClient using the Trojan protocol, which works on top
+// of TLS and doesn't have any response to the request.
+//
+// A Trojan server forwards the streams failing the authentication to a
+// fallback (usually HTTP) server. Since nothing is sent back on success, such
+// a failure is only detected if FallbackCheck is positive, in which case the
+// client waits for that long for any unexpected response after the request,
+// which also fails the requests to the targets speaking first.
+type TrojanClient struct {
+	Transport     Transport
+	Addr          string
+	PasswordHash  string // hex encoded SHA-224 of the password
+	FallbackCheck time.Duration
+}
+
+// NewTrojanClient creates a Trojan client from the given configuration. TLS
+// is used by default if the transport is not specified.
+func NewTrojanClient(config ProxyConfig) (*TrojanClient, error) {
+	client := &TrojanClient{}
+	var password, sni string
+	var ok bool
+	for k, v := range config.Settings {
+		switch k {
+		case "address":
+			if client.Addr, ok = v.(string); !ok {
+				return nil, errors.Errorf("invalid value for 'address': %v", v)
+			}
+		case "password":
+			if password, ok = v.(string); !ok {
+				return nil, errors.New("a string is required for 'password'")
+			}
+		case "sni":
+			if sni, ok = v.(string); !ok {
+				return nil, errors.New("a string is required for 'sni'")
+			}
+		case "fallback_check":
+			s, ok := v.(string)
+			if !ok {
+				return nil, errors.New("invalid value for 'fallback_check'")
+			}
+			d, err := time.ParseDuration(s)
+			if err != nil {
+				return nil, errors.Wrap(err, "invalid value for 'fallback_check'")
+			} else if d < 0 {
+				return nil, errors.New("'fallback_check' must be >= 0")
+			}
+			client.FallbackCheck = d
+		default:
+			return nil, errors.New("unknown setting of 'trojan' protocol: " + k)
+		}
+	}
+	if client.Addr == "" {
+		return nil, errors.New(
+			"a valid 'address' must be specified for trojan protocol")
+	}
+	if password == "" {
+		return nil, errors.New("a 'password' is required for trojan protocol")
+	}
+	hash := sha256.Sum224([]byte(password))
+	client.PasswordHash = hex.EncodeToString(hash[:])
+
+	transConfig := TransportConfig{TLS: &TLSConfig{}}
+	if config.Transport != nil {
+		transConfig = *config.Transport
+		if transConfig.TLS == nil {
+			return nil, errors.New("trojan protocol requires TLS")
+		}
+	}
+	if sni != "" {
+		tlsConfig := *transConfig.TLS
+		tlsConfig.ServerName = sni
+		transConfig.TLS = &tlsConfig
+	}
+	var err error
+	if client.Transport, err = CreateTransport(&transConfig); err != nil {
+		return nil, errors.WithMessage(err, "failed to create Trojan client")
+	}
+	return client, nil
+}
+
+// Close closes the transport of the client, see closeTransport.
+func (c *TrojanClient) Close() error {
+	return closeTransport(c.Transport)
+}
+
+// Request sends a connection request to the Trojan server.
+func (c *TrojanClient) Request(ctx context.Context, addr Address) (
+	io.ReadWriteCloser, Address, *ProxyError) {
+	// the request is a SOCKS5 request without the version and the reserved
+	// byte, following the password hash
+	reqPkt := &socksReqResp{Type: socksConnect, Addr: addr}
+	var pktBuf bytes.Buffer
+	if err := reqPkt.WritePacket(&pktBuf); err != nil {
+		errType := ProxyGeneralErr
+		if addrErr, isAddrErr := err.(addrError); isAddrErr {
+			err, errType = addrErr.error, ProxyAddrUnsupported
+		}
+		return nil, nil, wrapAsProxyError(err, errType)
+	}
+	pkt := pktBuf.Bytes()
+	req := make([]byte, 0, len(c.PasswordHash)+len(pkt)+2)
+	req = append(append(req, c.PasswordHash...), '\r', '\n', pkt[1])
+	req = append(append(req, pkt[3:]...), '\r', '\n')
+
+	startTime := time.Now()
+	conn, err := c.Transport.Dial(ctx, c.Addr)
+	if err != nil {
+		return nil, nil, wrapAsProxyError(
+			errors.WithMessage(err, "failed to dial to Trojan server"),
+			ProxyGeneralErr)
+	}
+	timings := ConnTimings{Dial: time.Since(startTime)}
+	if ddl, hasDDL := ctx.Deadline(); hasDDL {
+		// so that the underlying IO will propagate the timeout error upwards
+		_ = conn.SetDeadline(ddl.Add(-time.Millisecond))
+	}
+
+	brc := &bufReadRWC{conn, bufio.NewReader(conn)}
+	errCh := make(chan *ProxyError, 1)
+	go func() {
+		_, err := conn.Write(req)
+		if err != nil {
+			errCh <- wrapAsProxyError(errors.WithMessage(
+				err, "failed to send Trojan request"), ProxyGeneralErr)
+		} else {
+			errCh <- c.checkFallback(brc)
+		}
+	}()
+
+	select {
+	case err := <-errCh:
+		if err != nil {
+			_ = conn.Close()
+			return nil, nil, err
+		}
+		_ = conn.SetDeadline(time.Time{})
+		timings.Handshake = time.Since(startTime) - timings.Dial
+		recordConnTimings(ctx, timings)
+		return brc, &TCP4Addr{net.IPv4zero, 0}, nil
+	case <-ctx.Done():
+		_ = conn.Close()
+		return nil, nil, wrapAsProxyError(
+			errors.WithStack(ctx.Err()), ProxyGeneralErr)
+	}
+}
+
+// checkFallback waits for any response from the server, which is from the
+// fallback server if the authentication failed.
+func (c *TrojanClient) checkFallback(brc *bufReadRWC) *ProxyError {
+	if c.FallbackCheck <= 0 {
+		return nil
+	}
+	_ = brc.SetReadDeadline(time.Now().Add(c.FallbackCheck))
+	head, err := brc.b.Peek(5)
+	if ne, ok := errors.Cause(err).(net.Error); ok && ne.Timeout() &&
+		len(head) == 0 {
+		return nil // nothing responded as expected
+	}
+	if bytes.HasPrefix(head, []byte("HTTP/")) {
+		return wrapAsProxyError(errors.New(
+			"Trojan server responded in HTTP, probably due to a wrong password"),
+			ProxyNotAllowed)
+	} else if err != nil && len(head) == 0 {
+		return wrapAsProxyError(errors.WithMessage(
+			err, "failed to read from Trojan server"), ProxyGeneralErr)
+	}
+	return wrapAsProxyError(errors.New(
+		"unexpected response from Trojan server"), ProxyGeneralErr)
+}
@@ -0,0 +1,106 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func startMockTrojanServer(
+	t *testing.T, password string, expReq []byte) net.Listener {
+	svrConfig := *gTLSServerConfig
+	svrConfig.VerifyClient = false
+	svrTrans, err := NewTLSTransport(svrConfig, TCPTransport{})
+	require.NoError(t, err)
+	listener, err := svrTrans.Listen("127.0.0.1:0")
+	require.NoError(t, err)
+
+	hash := sha256.Sum224([]byte(password))
+	expected := append([]byte(hex.EncodeToString(hash[:])+"\r\n"), expReq...)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close() // nolint: errcheck
+				buf := make([]byte, len(expected))
+				if _, err := io.ReadFull(conn, buf); err != nil {
+					return
+				}
+				if bytes.Equal(buf, expected) {
+					_, _ = io.Copy(conn, conn) // echo
+				} else { // fallback
+					_, _ = io.WriteString(conn,
+						"HTTP/1.1 400 Bad Request\r\nContent-Length: 0\r\n\r\n")
+				}
+			}()
+		}
+	}()
+	return listener
+}
+
+func TestTrojanClient(t *testing.T) {
+	addr := &DomainNameAddr{"target.server", 443}
+	expReq := append([]byte{socksConnect, socksDomainName, 13},
+		"target.server\x01\xbb\r\n"...)
+	listener := startMockTrojanServer(t, "PASSWORD", expReq)
+	defer listener.Close() // nolint: errcheck
+
+	newClient := func(password string) ProxyClient {
+		cli, err := CreateProxyClient(ProxyConfig{
+			Protocol: "trojan",
+			Settings: map[string]interface{}{
+				"address":        listener.Addr().String(),
+				"password":       password,
+				"sni":            "localhost",
+				"fallback_check": "200ms",
+			},
+			Transport: &TransportConfig{
+				TLS: &TLSConfig{CAs: gTLSClientConfig.CAs}},
+		})
+		require.NoError(t, err)
+		return cli
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	rwc, _, pErr := newClient("PASSWORD").Request(ctx, addr)
+	require.Nil(t, pErr)
+	defer rwc.Close() // nolint: errcheck
+	_, err := rwc.Write([]byte("hello"))
+	require.NoError(t, err)
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(rwc, buf)
+	assert.NoError(t, err)
+	assert.EqualValues(t, "hello", buf)
+
+	_, _, pErr = newClient("WRONG").Request(ctx, addr)
+	if assert.NotNil(t, pErr) {
+		assert.Equal(t, ProxyNotAllowed, pErr.ErrType)
+	}
+}
+
+func TestTrojanClientConfig(t *testing.T) {
+	for _, config := range []ProxyConfig{
+		{Protocol: "trojan", Settings: map[string]interface{}{
+			"address": "127.0.0.1:443"}},
+		{Protocol: "trojan", Settings: map[string]interface{}{
+			"password": "PASSWORD"}},
+		{Protocol: "trojan", Settings: map[string]interface{}{
+			"address": "127.0.0.1:443", "password": "PASSWORD"},
+			Transport: &TransportConfig{}},
+	} {
+		_, err := CreateProxyClient(config)
+		assert.Error(t, err, "%+v", config)
+	}
+}
@@ -0,0 +1,132 @@
+package lib
+
+import (
+	"hash/fnv"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+)
+
+// UpstreamSelector decides which upstream to use for a request.
+type UpstreamSelector interface {
+	// Select picks one of the given upstream names for a request matched by
+	// the given rule. The key identifies the request for the selectors with
+	// affinity. The candidates must not be empty.
+	Select(rule, key string, candidates []string) string
+}
+
+// LockedRand is a pseudo-random number generator safe for concurrent use.
+// Unlike the global source of math/rand, it can be seeded for reproducible
+// results without affecting others.
+type LockedRand struct {
+	lock sync.Mutex
+	rand *rand.Rand
+}
+
+// NewLockedRand creates a LockedRand with the given seed.
+func NewLockedRand(seed int64) *LockedRand {
+	return &LockedRand{rand: rand.New(rand.NewSource(seed))}
+}
+
+// Intn returns a pseudo-random number in [0, n). A nil LockedRand uses the
+// global source of math/rand.
+func (r *LockedRand) Intn(n int) int {
+	if r == nil {
+		return rand.Intn(n)
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.rand.Intn(n)
+}
+
+// RandomSelector selects upstreams uniformly at random.
+type RandomSelector struct {
+	Rand *LockedRand // the global source of math/rand if nil
+}
+
+// Select picks an upstream uniformly at random.
+func (s RandomSelector) Select(rule, key string, candidates []string) string {
+	return candidates[s.Rand.Intn(len(candidates))]
+}
+
+// WeightedSelector selects upstreams randomly in proportion to their weights.
+// Upstreams without a weight are weighted 1.
+type WeightedSelector struct {
+	Weights map[string]int
+	Rand    *LockedRand // the global source of math/rand if nil
+}
+
+// Select picks an upstream randomly in proportion to the weights.
+func (s WeightedSelector) Select(
+	rule, key string, candidates []string) string {
+	total := 0
+	for _, c := range candidates {
+		total += s.weightOf(c)
+	}
+	if total <= 0 {
+		return RandomSelector{s.Rand}.Select(rule, key, candidates)
+	}
+	r := s.Rand.Intn(total)
+	for _, c := range candidates {
+		if r -= s.weightOf(c); r < 0 {
+			return c
+		}
+	}
+	panic("should not reach here")
+}
+
+func (s WeightedSelector) weightOf(upstream string) int {
+	if w, ok := s.Weights[upstream]; ok {
+		return w
+	}
+	return 1
+}
+
+// RoundRobinSelector cycles through the upstreams of each rule.
+type RoundRobinSelector struct {
+	counters sync.Map // rule (string) -> *uint32
+}
+
+// Select picks the next upstream of the rule.
+func (s *RoundRobinSelector) Select(
+	rule, key string, candidates []string) string {
+	value, ok := s.counters.Load(rule)
+	if !ok {
+		value, _ = s.counters.LoadOrStore(rule, new(uint32))
+	}
+	n := atomic.AddUint32(value.(*uint32), 1) - 1
+	return candidates[n%uint32(len(candidates))]
+}
+
+// StickySelector maps the same key to the same upstream by rendezvous
+// hashing, so that only the keys mapped to an added or removed upstream are
+// moved. If the chosen upstream is removed from the candidates, e.g. as it's
+// unhealthy or failed, the next choice of the key is picked.
+type StickySelector struct{}
+
+// Select picks the upstream with the highest hash of the key.
+func (StickySelector) Select(rule, key string, candidates []string) string {
+	var selected string
+	var maxScore uint64
+	for i, c := range candidates {
+		if score := stickyScore(key, c); i == 0 || score > maxScore {
+			selected, maxScore = c, score
+		}
+	}
+	return selected
+}
+
+func stickyScore(key, upstream string) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(key))
+	_, _ = h.Write([]byte{0})
+	_, _ = h.Write([]byte(upstream))
+	// mix the bits, as FNV hashes of similar inputs are close to each other
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
@@ -0,0 +1,138 @@
+package lib
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRandomSelector(t *testing.T) {
+	candidates := []string{"a", "b", "c", "d"}
+	counts := make(map[string]int)
+	var selector UpstreamSelector = RandomSelector{}
+	const n = 10000
+	for i := 0; i < n; i++ {
+		counts[selector.Select("rule", "", candidates)]++
+	}
+	for _, c := range candidates {
+		assert.InDelta(t, n/len(candidates), counts[c], n*0.05, c)
+	}
+}
+
+func TestWeightedSelector(t *testing.T) {
+	candidates := []string{"a", "b", "c"}
+	selector := WeightedSelector{
+		Weights: map[string]int{"a": 80, "b": 20, "c": 0}}
+	counts := make(map[string]int)
+	const n = 10000
+	for i := 0; i < n; i++ {
+		counts[selector.Select("rule", "", candidates)]++
+	}
+	assert.InDelta(t, n*0.8, counts["a"], n*0.02)
+	assert.InDelta(t, n*0.2, counts["b"], n*0.02)
+	assert.Equal(t, 0, counts["c"])
+
+	// unspecified weights default to 1
+	selector = WeightedSelector{Weights: map[string]int{"a": 3}}
+	counts = make(map[string]int)
+	for i := 0; i < n; i++ {
+		counts[selector.Select("rule", "", candidates[:2])]++
+	}
+	assert.InDelta(t, n*0.75, counts["a"], n*0.02)
+}
+
+func TestSelectorsWithRand(t *testing.T) {
+	candidates := []string{"a", "b", "c", "d"}
+	weights := map[string]int{"a": 5, "b": 3}
+	selectAll := func(seed int64) (selected []string) {
+		rnd := NewLockedRand(seed)
+		for _, selector := range []UpstreamSelector{
+			RandomSelector{Rand: rnd},
+			WeightedSelector{Weights: weights, Rand: rnd},
+		} {
+			for i := 0; i < 100; i++ {
+				selected = append(
+					selected, selector.Select("rule", "", candidates))
+			}
+		}
+		return
+	}
+	// reproducible with the same seed
+	assert.Equal(t, selectAll(1), selectAll(1))
+	assert.NotEqual(t, selectAll(1), selectAll(2))
+
+	// safe for concurrent use
+	rnd := NewLockedRand(1)
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				assert.True(t, rnd.Intn(10) < 10)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestRoundRobinSelector(t *testing.T) {
+	candidates := []string{"a", "b", "c"}
+	var selector UpstreamSelector = &RoundRobinSelector{}
+	for i := 0; i < 6; i++ {
+		assert.Equal(t, candidates[i%3], selector.Select("rule1", "", candidates))
+	}
+	// rules are counted separately
+	assert.Equal(t, "a", selector.Select("rule2", "", candidates))
+
+	counts := make([]map[string]int, 4)
+	var wg sync.WaitGroup
+	for i := range counts {
+		counts[i] = make(map[string]int)
+		wg.Add(1)
+		go func(counts map[string]int) {
+			defer wg.Done()
+			for j := 0; j < 300; j++ {
+				counts[selector.Select("rule3", "", candidates)]++
+			}
+		}(counts[i])
+	}
+	wg.Wait()
+	for _, c := range candidates {
+		total := 0
+		for i := range counts {
+			total += counts[i][c]
+		}
+		assert.Equal(t, 400, total, c)
+	}
+}
+
+func TestStickySelector(t *testing.T) {
+	candidates := []string{"a", "b", "c", "d"}
+	var selector UpstreamSelector = StickySelector{}
+	selected := make(map[string]string)
+	counts := make(map[string]int)
+	const n = 10000
+	for i := 0; i < n; i++ {
+		key := fmt.Sprintf("10.0.%d.%d", i/256, i%256)
+		selected[key] = selector.Select("rule", key, candidates)
+		assert.Equal(t, selected[key],
+			selector.Select("rule", key, []string{"d", "c", "b", "a"}))
+		counts[selected[key]]++
+	}
+	for _, c := range candidates {
+		assert.InDelta(t, n/len(candidates), counts[c], n*0.05, c)
+	}
+
+	// only the keys of the removed upstream are moved
+	for key, upstream := range selected {
+		moved := selector.Select("rule", key, candidates[1:])
+		if upstream == "a" {
+			assert.NotEqual(t, "a", moved)
+		} else {
+			assert.Equal(t, upstream, moved)
+		}
+	}
+}
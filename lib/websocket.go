@@ -0,0 +1,206 @@
+package lib
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/websocket"
+)
+
+// WebSocketTransport is a Transport which tunnels the streams in WebSocket
+// connections, so that they can traverse middleboxes only passing HTTP. It
+// works on top of an inner Transport, which is typically TCP or TLS (wss).
+type WebSocketTransport struct {
+	inner Transport
+	path  string
+	host  string // overrides the address in the Host header if not empty
+}
+
+// NewWebSocketTransport creates a WebSocketTransport on top of a given inner
+// Transport.
+func NewWebSocketTransport(
+	config WebSocketConfig, inner Transport) (*WebSocketTransport, error) {
+	path := config.Path
+	if path == "" {
+		path = "/"
+	} else if path[0] != '/' {
+		return nil, errors.New("websocket path should start with '/'")
+	}
+	return &WebSocketTransport{inner: inner, path: path, host: config.Host}, nil
+}
+
+// Close closes the inner transport if it holds any resource.
+func (t *WebSocketTransport) Close() error {
+	return closeTransport(t.inner)
+}
+
+// Dial creates a WebSocket connection to the given address.
+func (t *WebSocketTransport) Dial(
+	ctx context.Context, address string) (net.Conn, error) {
+	inner, err := t.inner.Dial(ctx, address)
+	if err != nil {
+		return nil, errors.WithMessage(err, "failed to dial to WebSocket host")
+	}
+
+	host := address
+	if t.host != "" {
+		host = t.host
+	}
+	location := &url.URL{Scheme: "ws", Host: host, Path: t.path}
+	origin := &url.URL{Scheme: "http", Host: host}
+	config, err := websocket.NewConfig(location.String(), origin.String())
+	if err != nil {
+		_ = inner.Close()
+		return nil, errors.WithStack(err)
+	}
+
+	// the channel must be buffered to prevent the hanshaking goroutine from
+	// blocking forever if the context is cancelled or timeout.
+	type result struct {
+		conn *websocket.Conn
+		err  error
+	}
+	resultCh := make(chan result, 1)
+	go func() {
+		conn, err := websocket.NewClient(config, inner)
+		resultCh <- result{conn, err}
+	}()
+
+	select {
+	case r := <-resultCh:
+		if r.err != nil {
+			_ = inner.Close()
+			return nil, errors.Wrap(r.err, "WebSocket handshake failed")
+		}
+		return wrapWebSocketConn(r.conn, inner), nil
+	case <-ctx.Done():
+		_ = inner.Close()
+		return nil, errors.WithStack(ctx.Err())
+	}
+}
+
+// Listen creates a WebSocket server listening on the given address. Requests
+// not matching the path (or the host if specified) are responded with 404.
+func (t *WebSocketTransport) Listen(address string) (net.Listener, error) {
+	innerListener, err := t.inner.Listen(address)
+	if err != nil {
+		return nil, errors.WithMessage(err, "failed to listen for WebSocket")
+	}
+	l := &wsListener{
+		Listener: innerListener,
+		connCh:   make(chan net.Conn),
+		closed:   make(chan struct{}),
+	}
+	wsServer := websocket.Server{
+		// the origin is not checked since the clients are not browsers
+		Handshake: func(*websocket.Config, *http.Request) error { return nil },
+		Handler:   l.handle,
+	}
+	l.server = &http.Server{
+		Handler: http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != t.path || (t.host != "" && r.Host != t.host) {
+					http.NotFound(w, r)
+					return
+				}
+				wsServer.ServeHTTP(w, r)
+			}),
+		ConnContext: func(ctx context.Context, c net.Conn) context.Context {
+			return context.WithValue(ctx, wsInnerConnKey{}, c)
+		},
+	}
+	go func() {
+		err := l.server.Serve(innerListener)
+		l.closeOnce.Do(func() {
+			l.err = err
+			close(l.closed)
+		})
+	}()
+	return l, nil
+}
+
+type wsInnerConnKey struct{}
+
+type wsListener struct {
+	net.Listener
+	server    *http.Server
+	connCh    chan net.Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+	err       error
+}
+
+// handle hands the connection over to Accept. The connection is closed by the
+// WebSocket server as soon as it returns, so it waits until the connection is
+// closed by the user.
+func (l *wsListener) handle(conn *websocket.Conn) {
+	inner, _ := conn.Request().Context().Value(wsInnerConnKey{}).(net.Conn)
+	wrapper := wrapWebSocketConn(conn, inner)
+	select {
+	case l.connCh <- wrapper:
+		<-wrapper.done
+	case <-l.closed:
+	}
+}
+
+func (l *wsListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.connCh:
+		return conn, nil
+	case <-l.closed:
+		if l.err != nil && l.err != http.ErrServerClosed {
+			return nil, errors.WithStack(l.err)
+		}
+		return nil, errors.New("WebSocket listener closed")
+	}
+}
+
+func (l *wsListener) Close() error {
+	l.closeOnce.Do(func() { close(l.closed) })
+	return errors.WithStack(l.server.Close())
+}
+
+// wsConnWrapper reports the addresses and the peer identifiers of the inner
+// connection instead of those of the WebSocket.
+type wsConnWrapper struct {
+	*websocket.Conn
+	inner     net.Conn
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func wrapWebSocketConn(conn *websocket.Conn, inner net.Conn) *wsConnWrapper {
+	conn.PayloadType = websocket.BinaryFrame
+	return &wsConnWrapper{Conn: conn, inner: inner, done: make(chan struct{})}
+}
+
+func (c *wsConnWrapper) Close() error {
+	err := c.Conn.Close()
+	c.closeOnce.Do(func() { close(c.done) })
+	return err
+}
+
+func (c *wsConnWrapper) LocalAddr() net.Addr {
+	if c.inner != nil {
+		return c.inner.LocalAddr()
+	}
+	return c.Conn.LocalAddr()
+}
+
+func (c *wsConnWrapper) RemoteAddr() net.Addr {
+	if c.inner != nil {
+		return c.inner.RemoteAddr()
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *wsConnWrapper) GetPeerIdentifiers() ([]*PeerIdentifier, error) {
+	if withIDs, ok := c.inner.(WithPeerIdentifiers); ok {
+		return withIDs.GetPeerIdentifiers()
+	}
+	return nil, nil
+}
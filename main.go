@@ -8,6 +8,8 @@ import (
 	"net/http"
 	_ "net/http/pprof"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/richardtsai/thestral2/lib"
@@ -29,6 +31,7 @@ func printUsage() {
 func main() {
 	flag.Usage = printUsage
 	tools.Init()
+	tools.ValidateConfig = ValidateConfig
 	if len(os.Args) > 1 && os.Args[1][0] != '-' { // run tools
 		tools.Run(os.Args[1], os.Args[1:])
 		return
@@ -70,7 +73,21 @@ func main() {
 		}()
 	}
 
+	app.SetConfigFile(*configFile)
+	go reloadOnSignal(app, *configFile)
+
 	if err = app.Run(context.Background()); err != nil {
 		panic(err)
 	}
 }
+
+// reloadOnSignal reloads the configuration file on receiving SIGHUP.
+func reloadOnSignal(app *Thestral, configFile string) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	for range ch {
+		if err := app.Reload(configFile); err != nil {
+			app.log.Errorw("failed to reload configuration", "error", err)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"io"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	. "github.com/richardtsai/thestral2/lib"
+)
+
+// relayBuffered is relayHalf with the reads and the writes in their own
+// goroutines, decoupled by a relayBuffer of relay_watermark bytes. Thus a
+// burst from src is absorbed while dst is slow to take it, rather than
+// stalling the reads, and the reads stop (i.e. the backpressure applies) only
+// once the buffer is filled up to the watermark.
+func (t *Thestral) relayBuffered(
+	dst io.Writer, src io.Reader, timeouts relayTimeouts,
+	reportBytesTransfered func(uint32)) (n int64, err error) {
+	rdDeadliner, wrDeadliner := relayDeadliners(dst, src, timeouts)
+	buffer := newRelayBuffer(t.relayWatermark)
+	defer buffer.Close()
+	go func() {
+		for {
+			buf := GlobalBufPool.Get(t.relayBufSize)
+			if rdDeadliner != nil {
+				_ = rdDeadliner.SetReadDeadline(time.Now().Add(timeouts.read))
+			}
+			nr, err := src.Read(buf)
+			if err != nil { // EOF or error occurred
+				GlobalBufPool.Free(buf)
+				buffer.End(relayReadError(err, rdDeadliner != nil))
+				return
+			} else if !buffer.Push(buf[:nr]) { // the writes have failed
+				GlobalBufPool.Free(buf)
+				return
+			}
+		}
+	}()
+
+	for {
+		chunk, rdErr := buffer.Pop()
+		if chunk == nil { // all written
+			err = rdErr
+			break
+		}
+		var nw int64
+		nw, err = relayWrite(dst, wrDeadliner, timeouts.write, chunk,
+			reportBytesTransfered)
+		GlobalBufPool.Free(chunk)
+		n += nw
+		if err != nil { // write failed
+			break
+		}
+	}
+
+	err = errors.WithStack(err)
+	return
+}
+
+// relayBuffer is a FIFO of the chunks read by a relay, which are buffers of
+// GlobalBufPool. It's filled up once the chunks take up the watermark bytes,
+// and then a Push blocks until they are drained below it. The chunks are
+// counted by their capacities, i.e. the memory held, so that small reads do
+// not pile up far more buffers than the watermark allows.
+type relayBuffer struct {
+	mtx       sync.Mutex
+	cond      *sync.Cond
+	chunks    [][]byte
+	size      uint // the capacities of the chunks
+	watermark uint
+	ended     bool  // no more chunks from the source
+	err       error // of the source once ended, nil if it's an EOF
+	closed    bool  // the chunks are no longer taken
+}
+
+func newRelayBuffer(watermark uint) *relayBuffer {
+	b := &relayBuffer{watermark: watermark}
+	b.cond = sync.NewCond(&b.mtx)
+	return b
+}
+
+// Push appends a chunk after waiting for the buffer to be below the
+// watermark, or returns false if it's closed, in which case the chunk is
+// still owned by the caller.
+func (b *relayBuffer) Push(chunk []byte) bool {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	for b.size >= b.watermark && !b.closed {
+		b.cond.Wait()
+	}
+	if b.closed {
+		return false
+	}
+	b.chunks = append(b.chunks, chunk)
+	b.size += uint(cap(chunk))
+	b.cond.Broadcast()
+	return true
+}
+
+// End marks the end of the source with its error (nil if it's an EOF).
+func (b *relayBuffer) End(err error) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	b.ended, b.err = true, err
+	b.cond.Broadcast()
+}
+
+// Pop waits for and removes the first chunk, which is then owned by the
+// caller. It returns a nil chunk along with the error of the source once all
+// the chunks are taken and the source has ended.
+func (b *relayBuffer) Pop() ([]byte, error) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	for len(b.chunks) == 0 && !b.ended {
+		b.cond.Wait()
+	}
+	if len(b.chunks) == 0 {
+		return nil, b.err
+	}
+	chunk := b.chunks[0]
+	b.chunks[0] = nil
+	b.chunks = b.chunks[1:]
+	b.size -= uint(cap(chunk))
+	b.cond.Broadcast()
+	return chunk, nil
+}
+
+// Close drops the chunks left, and makes the pending and the later Pushes
+// return false.
+func (b *relayBuffer) Close() {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	for _, chunk := range b.chunks {
+		GlobalBufPool.Free(chunk)
+	}
+	b.chunks, b.size, b.closed = nil, 0, true
+	b.cond.Broadcast()
+}
@@ -0,0 +1,655 @@
+package main
+
+import (
+	"context"
+	"io"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	. "github.com/richardtsai/thestral2/lib"
+)
+
+// builtinDirectUpstream is the name of the direct upstream available to the
+// rules and the scopes without being configured.
+const builtinDirectUpstream = "direct"
+
+// routing contains the settings about how requests are routed to the
+// upstreams. It is replaced as a whole on reloading, and requests keep using
+// the one they started with.
+type routing struct {
+	// the requests using the routing (see acquireRouting), which is shared by
+	// the copies of it using the same upstream clients
+	inUse           *sync.WaitGroup
+	upstreams       map[string]ProxyClient
+	upstreamConfigs map[string]ProxyConfig
+	upstreamNames   []string
+	upstreamLimits  map[string]*ConnLimiter
+	disabled        map[string]bool            // names of the disabled upstreams
+	scopeUpstreams  map[string]map[string]bool // upstreams allowed by scope
+	dsDefaults      map[string][]string        // by downstream, if specified
+	selector        UpstreamSelector
+	stickyKey       string // "client" or "target" for the sticky selector
+	healthChecker   *HealthChecker
+	ruleMatcher     *RuleMatcher
+	dnsConfig       *DNSConfig
+	resolver        *CachingResolver // domains are not resolved locally if nil
+	connectTimeout  time.Duration
+	attemptTimeout  time.Duration
+	idleTimeout     time.Duration // no idle timeout if 0
+	// no first-byte timeout if 0
+	firstByteTimeout time.Duration
+	// no progress logs if 0
+	progressInterval time.Duration
+	// of each single read/write of the relays, none if 0
+	ioTimeouts relayTimeouts
+}
+
+// newRouting creates the routing settings from the given configuration. The
+// upstream clients (and their connection limits and health states) of the
+// current routing are reused if their configuration is unchanged.
+func (t *Thestral) newRouting(config Config) (r *routing, err error) {
+	r = &routing{
+		inUse:           new(sync.WaitGroup),
+		upstreams:       make(map[string]ProxyClient),
+		upstreamConfigs: make(map[string]ProxyConfig),
+		upstreamLimits:  make(map[string]*ConnLimiter),
+		disabled:        make(map[string]bool),
+		selector:        RandomSelector{Rand: t.rand},
+		healthChecker: NewHealthChecker(
+			t.log.Named("health_check"), &t.monitor),
+	}
+	current := t.getRouting()
+
+	// create resolver, whose cache is kept if unchanged
+	if config.DNS != nil {
+		r.dnsConfig = config.DNS
+		if current != nil && reflect.DeepEqual(current.dnsConfig, config.DNS) {
+			r.resolver = current.resolver
+		} else if r.resolver, err = NewCachingResolver(*config.DNS); err != nil {
+			return nil, errors.WithMessage(err, "invalid dns config")
+		}
+	}
+
+	// create upstream clients
+	weights := make(map[string]int)
+	for k, v := range config.Upstreams {
+		if !v.IsEnabled() {
+			r.disabled[k] = true
+			continue
+		}
+		reused := current != nil &&
+			reflect.DeepEqual(current.upstreamConfigs[k], v)
+		if reused {
+			r.upstreams[k] = current.upstreams[k]
+			if limiter, ok := current.upstreamLimits[k]; ok {
+				r.upstreamLimits[k] = limiter
+			}
+		} else {
+			if r.upstreams[k], err = CreateProxyClient(v); err != nil {
+				return nil, errors.WithMessage(
+					err, "failed to create upstream client: "+k)
+			}
+			// logged only once the upstream is (re)configured, rather than on
+			// every reload
+			if direct, ok := r.upstreams[k].(DirectTCPClient); ok &&
+				direct.TCPFastOpen && !TCPFastOpenSupported {
+				t.log.Infow("TCP Fast Open is unsupported on this platform",
+					"upstream", k)
+			}
+		}
+		// the direct upstreams share the resolver of the rules, if any
+		if direct, ok := r.upstreams[k].(DirectTCPClient); ok {
+			direct.Resolver = nil
+			if r.resolver != nil {
+				direct.Resolver = r.resolver
+			}
+			r.upstreams[k] = direct
+		}
+		r.upstreamConfigs[k] = v
+		r.upstreamNames = append(r.upstreamNames, k)
+		if v.Weight != nil && *v.Weight < 0 {
+			return nil, errors.Errorf("negative weight of upstream: %s", k)
+		} else if v.Weight != nil { // 0 drains the upstream
+			weights[k] = *v.Weight
+		}
+		if v.MaxConns < 0 {
+			return nil, errors.Errorf("negative max_conns of upstream: %s", k)
+		} else if v.MaxConns > 0 && r.upstreamLimits[k] == nil {
+			r.upstreamLimits[k] = NewConnLimiter(v.MaxConns)
+		}
+		if v.HealthCheck != nil {
+			err = r.healthChecker.AddUpstream(
+				k, r.upstreams[k], *v.HealthCheck)
+			if err != nil {
+				return nil, errors.WithMessage(
+					err, "invalid health check of upstream: "+k)
+			}
+			if reused {
+				r.healthChecker.InheritState(k, current.healthChecker)
+			}
+		}
+	}
+	if len(r.upstreamNames) == 0 {
+		return nil, errors.New("no upstream server enabled")
+	}
+	// the direct upstreams resolving the domains via another upstream
+	for k, client := range r.upstreams {
+		direct, ok := client.(DirectTCPClient)
+		if !ok || direct.ResolveVia == "" {
+			continue
+		}
+		via, ok := r.upstreams[direct.ResolveVia]
+		if !ok {
+			return nil, errors.Errorf(
+				"upstream %s resolves via undefined or disabled upstream: %s",
+				k, direct.ResolveVia)
+		} else if d, ok := via.(DirectTCPClient); ok && d.ResolveVia != "" {
+			return nil, errors.Errorf(
+				"upstream %s resolves via %s, which resolves via another",
+				k, direct.ResolveVia)
+		}
+		var dnsConfig DNSConfig // for the cache
+		if r.dnsConfig != nil {
+			dnsConfig = *r.dnsConfig
+		}
+		if direct.Resolver, err = NewProxiedResolver(
+			dnsConfig, via, direct.ResolveServer); err != nil {
+			return nil, errors.WithMessage(
+				err, "invalid resolve_server of upstream: "+k)
+		}
+		r.upstreams[k] = direct
+		t.log.Infow("domains resolved via another upstream",
+			"upstream", k, "via", direct.ResolveVia)
+	}
+	// the built-in direct upstream is not used for the requests matching no
+	// rule, and is shadowed by a configured one of the same name
+	if _, defined := config.Upstreams[builtinDirectUpstream]; !defined {
+		direct := DirectTCPClient{}
+		if r.resolver != nil {
+			direct.Resolver = r.resolver
+		}
+		r.upstreams[builtinDirectUpstream] = direct
+	}
+	switch config.Misc.UpstreamStrategy {
+	case "", "random":
+		if len(weights) > 0 {
+			r.selector = WeightedSelector{Weights: weights, Rand: t.rand}
+		}
+	case "round_robin":
+		if len(weights) > 0 {
+			return nil, errors.New(
+				"weights are only supported by the 'random' strategy")
+		}
+		r.selector = &RoundRobinSelector{}
+	case "sticky":
+		if len(weights) > 0 {
+			return nil, errors.New(
+				"weights are only supported by the 'random' strategy")
+		}
+		r.selector = StickySelector{}
+		switch config.Misc.StickyKey {
+		case "", "client":
+			r.stickyKey = "client"
+		case "target":
+			r.stickyKey = "target"
+		default:
+			return nil, errors.New(
+				"unknown sticky key: " + config.Misc.StickyKey)
+		}
+	default:
+		return nil, errors.New(
+			"unknown upstream strategy: " + config.Misc.UpstreamStrategy)
+	}
+
+	// upstreams allowed for the users of each scope, regardless of the rules
+	r.scopeUpstreams = make(map[string]map[string]bool)
+	for scope, upstreams := range config.Scopes {
+		allowed := make(map[string]bool)
+		for _, upstream := range upstreams {
+			if _, ok := r.upstreams[upstream]; !ok && !r.disabled[upstream] {
+				return nil, errors.Errorf(
+					"undefined upstream '%s' used in scope: %s", upstream, scope)
+			}
+			allowed[upstream] = true
+		}
+		r.scopeUpstreams[scope] = allowed
+	}
+
+	// upstreams of the unmatched requests of each downstream, if specified
+	r.dsDefaults = make(map[string][]string)
+	for ds, dsConfig := range config.Downstreams {
+		var enabled []string
+		for _, upstream := range dsConfig.DefaultUpstreams {
+			if _, ok := r.upstreams[upstream]; ok {
+				enabled = append(enabled, upstream)
+			} else if !r.disabled[upstream] {
+				return nil, errors.Errorf(
+					"undefined upstream '%s' used in default_upstreams of "+
+						"downstream: %s", upstream, ds)
+			}
+		}
+		if len(enabled) == 0 && len(dsConfig.DefaultUpstreams) > 0 {
+			return nil, errors.Errorf("all the default_upstreams of "+
+				"downstream '%s' are disabled", ds)
+		}
+		if len(enabled) > 0 {
+			r.dsDefaults[ds] = enabled
+		}
+	}
+
+	// create rule matcher
+	r.ruleMatcher, err = t.newRuleMatcher(
+		config.Rules, r.upstreams, r.disabled, r.resolver)
+	if err != nil {
+		return nil, err
+	}
+
+	// parse timeouts
+	r.connectTimeout = defaultConnectTimeout
+	if config.Misc.ConnectTimeout != "" {
+		r.connectTimeout, err = time.ParseDuration(config.Misc.ConnectTimeout)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		} else if r.connectTimeout <= 0 {
+			return nil, errors.New("'connect_timeout' should be greater than 0")
+		}
+	}
+	if config.Misc.ConnectAttemptTimeout != "" {
+		r.attemptTimeout, err = time.ParseDuration(
+			config.Misc.ConnectAttemptTimeout)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		} else if r.attemptTimeout <= 0 {
+			return nil, errors.New(
+				"'connect_attempt_timeout' should be greater than 0")
+		}
+	}
+	if config.Misc.IdleTimeout != "" {
+		r.idleTimeout, err = time.ParseDuration(config.Misc.IdleTimeout)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		} else if r.idleTimeout <= 0 {
+			return nil, errors.New("'idle_timeout' should be greater than 0")
+		}
+	}
+	if config.Misc.FirstByteTimeout != "" {
+		r.firstByteTimeout, err = time.ParseDuration(
+			config.Misc.FirstByteTimeout)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		} else if r.firstByteTimeout <= 0 {
+			return nil, errors.New(
+				"'first_byte_timeout' should be greater than 0")
+		}
+	}
+	if config.Misc.ReadTimeout != "" {
+		r.ioTimeouts.read, err = time.ParseDuration(config.Misc.ReadTimeout)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		} else if r.ioTimeouts.read <= 0 {
+			return nil, errors.New("'read_timeout' should be greater than 0")
+		}
+	}
+	if config.Misc.WriteTimeout != "" {
+		r.ioTimeouts.write, err = time.ParseDuration(config.Misc.WriteTimeout)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		} else if r.ioTimeouts.write <= 0 {
+			return nil, errors.New("'write_timeout' should be greater than 0")
+		}
+	}
+	if config.Misc.ProgressLogInterval != "" {
+		r.progressInterval, err = time.ParseDuration(
+			config.Misc.ProgressLogInterval)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		} else if r.progressInterval <= 0 {
+			return nil, errors.New(
+				"'progress_log_interval' should be greater than 0")
+		}
+	}
+	return r, nil
+}
+
+// allowedUpstreams filters the candidate upstreams by the scopes of the
+// client. Each scope with allowed upstreams configured restricts the
+// candidates further, while the other scopes impose no restriction.
+func (r *routing) allowedUpstreams(
+	peerIDs []*PeerIdentifier, upstreams []string) []string {
+	for _, id := range peerIDs {
+		allowed, ok := r.scopeUpstreams[id.Scope]
+		if !ok {
+			continue
+		}
+		filtered := make([]string, 0, len(upstreams))
+		for _, upstream := range upstreams {
+			if allowed[upstream] {
+				filtered = append(filtered, upstream)
+			}
+		}
+		upstreams = filtered
+	}
+	return upstreams
+}
+
+// healthyUpstreams filters out the unhealthy ones of the candidate upstreams
+// of a request. If all of them are unhealthy, the unhealthy_policy of the
+// rule applies, which is returned as well.
+func (r *routing) healthyUpstreams(req ProxyRequest, rule string,
+	upstreams []string) (healthy []string, policy UnhealthyPolicy) {
+	filter := func(upstreams []string) (filtered []string) {
+		for _, upstream := range upstreams {
+			if r.healthChecker.IsHealthy(upstream) {
+				filtered = append(filtered, upstream)
+			}
+		}
+		return
+	}
+	if healthy = filter(upstreams); len(healthy) > 0 {
+		return healthy, ""
+	}
+
+	switch policy = r.ruleMatcher.UnhealthyPolicy(rule); policy {
+	case UnhealthyFallbackDefault:
+		fallback, ok := r.ruleMatcher.DefaultUpstreams()
+		if !ok { // allow all
+			fallback = r.upstreamNames
+		}
+		if len(r.scopeUpstreams) > 0 {
+			if peerIDs, err := req.GetPeerIdentifiers(); err == nil {
+				fallback = r.allowedUpstreams(peerIDs, fallback)
+			} else { // the scopes are unknown
+				fallback = nil
+			}
+		}
+		healthy = filter(fallback)
+	case UnhealthyLeastRecentlyFailed:
+		healthy = []string{r.healthChecker.LeastRecentlyFailed(upstreams)}
+	}
+	return healthy, policy
+}
+
+func (t *Thestral) newRuleMatcher(rules map[string]RuleConfig,
+	upstreams map[string]ProxyClient, disabled map[string]bool,
+	resolver *CachingResolver) (*RuleMatcher, error) {
+	rules, err := LoadRuleFiles(t.log.Named("rules"), rules)
+	if err != nil {
+		return nil, err
+	}
+	// the disabled upstreams are removed from the rules, each of which must
+	// still have an enabled one unless it has none at all (denying)
+	enabledRules := make(map[string]RuleConfig, len(rules))
+	for name, rule := range rules {
+		var enabled []string
+		for _, upstream := range rule.Upstreams {
+			if _, ok := upstreams[upstream]; ok {
+				enabled = append(enabled, upstream)
+			} else if !disabled[upstream] {
+				return nil, errors.Errorf(
+					"undefined upstream '%s' used in the rule set", upstream)
+			}
+		}
+		if len(enabled) == 0 && len(rule.Upstreams) > 0 {
+			return nil, errors.Errorf(
+				"all the upstreams of rule '%s' are disabled", name)
+		} else if len(rule.Upstreams) == 0 && rule.Action == "" {
+			t.log.Warnw("rejecting by a rule without upstreams is "+
+				"deprecated, set its action to 'deny' instead", "rule", name)
+		}
+		rule.Upstreams = enabled
+		enabledRules[name] = rule
+	}
+	matcher, err := NewRuleMatcher(enabledRules)
+	if err != nil {
+		return nil, errors.WithMessage(err, "failed to create rule matcher")
+	}
+	if t.geoIP != nil {
+		matcher.SetCountryLookup(t.geoIP)
+	}
+	if resolver != nil {
+		matcher.SetResolver(resolver)
+	}
+	return matcher, nil
+}
+
+func (t *Thestral) getRouting() *routing {
+	t.routingLock.RLock()
+	defer t.routingLock.RUnlock()
+	return t.routing
+}
+
+// acquireRouting returns the current routing for a request, which must be
+// released by r.inUse.Done() once the request (and its tunnel) is done.
+func (t *Thestral) acquireRouting() *routing {
+	t.routingLock.RLock()
+	defer t.routingLock.RUnlock()
+	t.routing.inUse.Add(1)
+	return t.routing
+}
+
+// setRouting replaces the current routing. The upstream clients of the
+// current one not used by the new one are closed (see closeStaleUpstreams).
+func (t *Thestral) setRouting(r *routing) {
+	t.routingLock.Lock()
+	current := t.routing
+	t.routing = r
+	t.routingLock.Unlock()
+	if current != nil {
+		go t.closeStaleUpstreams(current, r)
+	}
+	t.monitor.SetDNSResolver(r.resolver)
+	select { // restart the health checker
+	case t.routingChanged <- struct{}{}:
+	default: // already notified
+	}
+}
+
+// closeStaleUpstreams closes the upstream clients of a replaced routing that
+// are not used by the new one, e.g. removed or reconfigured, once all the
+// requests using the replaced routing are done. Only the clients holding
+// resources, i.e. io.Closers, need to be closed.
+func (t *Thestral) closeStaleUpstreams(replaced, current *routing) {
+	stale := make(map[string]io.Closer)
+	for k, client := range replaced.upstreams {
+		closer, ok := client.(io.Closer)
+		if ok && current.upstreams[k] != client {
+			stale[k] = closer
+		}
+	}
+	if len(stale) == 0 {
+		return
+	}
+	replaced.inUse.Wait()
+	for k, closer := range stale {
+		if err := closer.Close(); err != nil {
+			t.log.Warnw("failed to close upstream client",
+				"upstream", k, "error", err)
+		} else {
+			t.log.Debugw("upstream client closed", "upstream", k)
+		}
+	}
+}
+
+// resolvePathOf tells how the domain of a target is resolved when connecting
+// via the upstream, for logging: "local", "remote" (by the upstream) or
+// "via:<upstream>", or empty if the target is an IP.
+func (r *routing) resolvePathOf(upstream string, target Address) string {
+	if _, ok := target.(*DomainNameAddr); !ok {
+		return ""
+	}
+	direct, ok := r.upstreams[upstream].(DirectTCPClient)
+	switch {
+	case !ok:
+		return "remote"
+	case direct.ResolveVia != "":
+		return "via:" + direct.ResolveVia
+	default:
+		return "local"
+	}
+}
+
+// runHealthCheckers runs the health checker of the current routing, and
+// switches to the new one whenever the routing is replaced.
+func (t *Thestral) runHealthCheckers(ctx context.Context) {
+	for {
+		checkerCtx, cancelFunc := context.WithCancel(ctx)
+		done := make(chan struct{})
+		go func(checker *HealthChecker) {
+			checker.Run(checkerCtx) // blocks
+			close(done)
+		}(t.getRouting().healthChecker)
+
+		select {
+		case <-t.routingChanged:
+			cancelFunc()
+			<-done
+		case <-ctx.Done():
+			cancelFunc()
+			<-done
+			return
+		}
+	}
+}
+
+// ReloadRules replaces the rule set with the given one. Requests already being
+// processed are not affected. The current rule set is kept if the new one is
+// invalid.
+func (t *Thestral) ReloadRules(rules map[string]RuleConfig) error {
+	t.reloadLock.Lock()
+	defer t.reloadLock.Unlock()
+	current := t.getRouting()
+	matcher, err := t.newRuleMatcher(
+		rules, current.upstreams, current.disabled, current.resolver)
+	if err != nil {
+		return err
+	}
+	r := *current
+	r.ruleMatcher = matcher
+	t.setRouting(&r)
+	t.config.Rules = rules
+	t.log.Info("rule set reloaded")
+	return nil
+}
+
+// SetUpstreamEnabled enables or disables a configured upstream, until the
+// configuration is reloaded. Requests already being processed are not
+// affected. Nothing is changed if no upstream would be enabled for a rule.
+func (t *Thestral) SetUpstreamEnabled(name string, enabled bool) error {
+	t.reloadLock.Lock()
+	defer t.reloadLock.Unlock()
+	upstream, ok := t.config.Upstreams[name]
+	if !ok {
+		return errors.Errorf("upstream '%s' is not configured", name)
+	}
+	upstream.Enabled = &enabled
+	config := t.config
+	config.Upstreams = make(map[string]ProxyConfig)
+	for k, v := range t.config.Upstreams {
+		config.Upstreams[k] = v
+	}
+	config.Upstreams[name] = upstream
+	r, err := t.newRouting(config)
+	if err != nil {
+		return err
+	}
+	t.setRouting(r)
+	t.config.Upstreams = config.Upstreams
+	t.log.Infow("upstream toggled", "upstream", name, "enabled", enabled)
+	return nil
+}
+
+// Reload re-reads the configuration file and applies the changes to the
+// upstreams, the rule set, the scopes, the dns, the upstream strategy and the
+// timeouts, without affecting the existing tunnels. Other changes are logged
+// as requiring a restart. The current configuration is kept if the new one is
+// invalid.
+func (t *Thestral) Reload(configFile string) error {
+	config, err := ParseConfigFile(configFile)
+	if err != nil {
+		return err
+	}
+
+	t.reloadLock.Lock()
+	defer t.reloadLock.Unlock()
+	var restartRequired []string
+	if !reflect.DeepEqual(config.DB, t.config.DB) {
+		// the database is only set up on start
+		restartRequired = append(restartRequired, "db")
+		config.DB = t.config.DB
+	}
+	if err = ValidateConfig(*config); err != nil {
+		return err
+	}
+	r, err := t.newRouting(*config)
+	if err != nil {
+		return err
+	}
+	t.setRouting(r)
+
+	liveMisc := func(c Config) MiscConfig {
+		misc := c.Misc
+		misc.ConnectTimeout = ""
+		misc.ConnectAttemptTimeout = ""
+		misc.IdleTimeout = ""
+		misc.FirstByteTimeout = ""
+		misc.ReadTimeout = ""
+		misc.WriteTimeout = ""
+		misc.ProgressLogInterval = ""
+		misc.UpstreamStrategy = ""
+		misc.StickyKey = ""
+		return misc
+	}
+	// the default upstreams are part of the routing
+	liveDownstreams := func(c Config) map[string]ProxyConfig {
+		downstreams := make(map[string]ProxyConfig, len(c.Downstreams))
+		for k, v := range c.Downstreams {
+			v.DefaultUpstreams = nil
+			downstreams[k] = v
+		}
+		return downstreams
+	}
+	sections := []struct {
+		name             string
+		current, updated interface{}
+	}{
+		{"downstreams", liveDownstreams(t.config), liveDownstreams(*config)},
+		{"logging", t.config.Logging, config.Logging},
+		{"geoip", t.config.GeoIP, config.GeoIP},
+		{"misc", liveMisc(t.config), liveMisc(*config)},
+	}
+	for _, section := range sections {
+		if !reflect.DeepEqual(section.current, section.updated) {
+			restartRequired = append(restartRequired, section.name)
+		}
+	}
+	for _, name := range restartRequired {
+		t.log.Warnw("configuration change requires a restart to apply",
+			"section", name)
+	}
+
+	// record the applied parts only, so that the others are still reported
+	// as changed on the next reload
+	t.config.Upstreams = config.Upstreams
+	t.config.Rules = config.Rules
+	t.config.Scopes = config.Scopes
+	downstreams := make(map[string]ProxyConfig, len(t.config.Downstreams))
+	for k, v := range t.config.Downstreams {
+		v.DefaultUpstreams = config.Downstreams[k].DefaultUpstreams
+		downstreams[k] = v
+	}
+	t.config.Downstreams = downstreams
+	t.config.DNS = config.DNS
+	t.config.Misc.ConnectTimeout = config.Misc.ConnectTimeout
+	t.config.Misc.ConnectAttemptTimeout = config.Misc.ConnectAttemptTimeout
+	t.config.Misc.IdleTimeout = config.Misc.IdleTimeout
+	t.config.Misc.FirstByteTimeout = config.Misc.FirstByteTimeout
+	t.config.Misc.ReadTimeout = config.Misc.ReadTimeout
+	t.config.Misc.WriteTimeout = config.Misc.WriteTimeout
+	t.config.Misc.ProgressLogInterval = config.Misc.ProgressLogInterval
+	t.config.Misc.UpstreamStrategy = config.Misc.UpstreamStrategy
+	t.config.Misc.StickyKey = config.Misc.StickyKey
+	t.log.Info("configuration reloaded")
+	return nil
+}
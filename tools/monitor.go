@@ -12,8 +12,6 @@ import (
 	"text/tabwriter"
 	"time"
 
-	"golang.org/x/crypto/ssh/terminal"
-
 	"github.com/richardtsai/thestral2/lib"
 )
 
@@ -84,7 +82,7 @@ func (t *monitorTool) Run(args []string) {
 	t.runLoop()
 }
 
-func (t *monitorTool) ls(term *terminal.Terminal, args []string) bool {
+func (t *monitorTool) ls(term consoleIO, args []string) bool {
 	if len(args) != 0 {
 		fmt.Fprintln(term, "'ls' doesn't take any argument")
 		return true
@@ -103,7 +101,7 @@ func (t *monitorTool) ls(term *terminal.Terminal, args []string) bool {
 	upstreamTunnelCount := make(map[string]int)
 	for i, r := range report.Tunnels {
 		t.lastListedReqIDs[i] = r.RequestID
-		upstreamTunnelCount[r.Upstream] += upstreamTunnelCount[r.Upstream]
+		upstreamTunnelCount[r.Upstream]++
 		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%s/s\t%s/s\t%s\t\n",
 			i, r.RequestID, r.ClientAddr, r.TargetAddr, r.Upstream,
 			lib.BytesHumanized(uint64(r.UploadSpeed)),
@@ -111,18 +109,32 @@ func (t *monitorTool) ls(term *terminal.Terminal, args []string) bool {
 			t.formatSeconds(r.ElapsedTimeSecs))
 	}
 	fmt.Fprintln(w, "Upstreams")
-	fmt.Fprintln(w,
-		"Name\tTunnels\t\tUpload\t\tDownload\tLatencyMs\tErrors\t")
+	fmt.Fprintln(w, "Name\tTunnels\tConns\t\tUpload\t\tDownload"+
+		"\tLatency\tP50/P90/P99\tErrors\tHealth\t")
 	for _, r := range report.Upstreams {
-		fmt.Fprintf(w, "%s\t%d\t%s/s\t(%s)\t%s/s\t(%s)\t%.2f ms\t%d\t\n",
-			r.Name, upstreamTunnelCount[r.Name],
+		health := r.Health
+		if health == "" {
+			health = "-"
+		}
+		fmt.Fprintf(w,
+			"%s\t%d\t%d\t%s/s\t(%s)\t%s/s\t(%s)\t%.2f ms"+
+				"\t%.0f/%.0f/%.0f ms\t%d\t%s\t\n",
+			r.Name, upstreamTunnelCount[r.Name], r.ConnsInUse,
 			lib.BytesHumanized(uint64(r.UploadSpeed)),
 			lib.BytesHumanized(r.BytesUploaded),
 			lib.BytesHumanized(uint64(r.DownloadSpeed)),
 			lib.BytesHumanized(r.BytesDownloaded),
-			r.AvgConnLatencyMs, r.ErrorCount,
+			r.AvgConnLatencyMs, r.ConnLatencyP50Ms, r.ConnLatencyP90Ms,
+			r.ConnLatencyP99Ms, r.ErrorCount, health,
 		)
 	}
+	fmt.Fprintln(w, "Rules")
+	fmt.Fprintln(w, "Rule\tUpstream\tUploaded\tDownloaded\t")
+	for _, r := range report.RuleTraffic {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t\n", r.Rule, r.Upstream,
+			lib.BytesHumanized(r.BytesUploaded),
+			lib.BytesHumanized(r.BytesDownloaded))
+	}
 	_ = w.Flush()
 
 	w = tabwriter.NewWriter(term, 2, 0, 2, ' ', 0)
@@ -136,11 +148,26 @@ func (t *monitorTool) ls(term *terminal.Terminal, args []string) bool {
 	fmt.Fprintf(w, "Download:\t%s/s\t(%s)\t\n",
 		lib.BytesHumanized(uint64(report.DownloadSpeed)),
 		lib.BytesHumanized(report.BytesDownloaded))
+	if report.KCP != nil {
+		fmt.Fprintf(w, "KCPSessions:\t%d\n", report.KCP.CurrEstab)
+		fmt.Fprintf(w, "KCPRetransmitRate:\t%.2f%%\t(%d/%d segs)\t\n",
+			report.KCP.RetransmitRate*100,
+			report.KCP.RetransSegs, report.KCP.OutSegs)
+		fmt.Fprintf(w, "KCPLossRate:\t%.2f%%\t(%d segs)\t\n",
+			report.KCP.LossRate*100, report.KCP.LostSegs)
+	}
+	fmt.Fprintf(w, "BufPool:\t%d gets\t%d puts\t(%d misses)\t\n",
+		report.BufPool.Gets, report.BufPool.Puts, report.BufPool.Misses)
+	if report.AuthCache != nil {
+		fmt.Fprintf(w, "AuthCache:\t%d hits\t%d misses\t(%d entries)\t\n",
+			report.AuthCache.Hits, report.AuthCache.Misses,
+			report.AuthCache.Entries)
+	}
 	_ = w.Flush()
 	return true
 }
 
-func (t *monitorTool) show(term *terminal.Terminal, args []string) bool {
+func (t *monitorTool) show(term consoleIO, args []string) bool {
 	if len(args) != 1 {
 		fmt.Fprintln(term, "'show' takes exactly one argument")
 		return true
@@ -157,7 +184,7 @@ func (t *monitorTool) show(term *terminal.Terminal, args []string) bool {
 	return t.showreq(term, []string{t.lastListedReqIDs[idx]})
 }
 
-func (t *monitorTool) kill(term *terminal.Terminal, args []string) bool {
+func (t *monitorTool) kill(term consoleIO, args []string) bool {
 	if len(args) != 1 {
 		fmt.Fprintln(term, "'kill' takes exactly one argument")
 		return true
@@ -174,7 +201,7 @@ func (t *monitorTool) kill(term *terminal.Terminal, args []string) bool {
 	return t.killreq(term, []string{t.lastListedReqIDs[idx]})
 }
 
-func (t *monitorTool) showreq(term *terminal.Terminal, args []string) bool {
+func (t *monitorTool) showreq(term consoleIO, args []string) bool {
 	if len(args) != 1 {
 		fmt.Fprintln(term, "'showreq' takes exactly one argument")
 		return true
@@ -189,7 +216,7 @@ func (t *monitorTool) showreq(term *terminal.Terminal, args []string) bool {
 	return true
 }
 
-func (t *monitorTool) killreq(term *terminal.Terminal, args []string) bool {
+func (t *monitorTool) killreq(term consoleIO, args []string) bool {
 	if len(args) != 1 {
 		fmt.Fprintln(term, "'killreq' takes exactly one argument")
 		return true
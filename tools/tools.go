@@ -1,6 +1,7 @@
 package tools
 
 import (
+	"bufio"
 	"fmt"
 	"io"
 	"os"
@@ -59,7 +60,14 @@ type consoleTool struct {
 	cmds    []consoleToolCmd
 }
 
-type consoleToolFunc func(term *terminal.Terminal, args []string) (cont bool)
+// consoleIO is how the cmds interact with the user, which is either the
+// interactive terminal or the standard streams for running a single cmd.
+type consoleIO interface {
+	io.Writer
+	ReadPassword(prompt string) (string, error)
+}
+
+type consoleToolFunc func(term consoleIO, args []string) (cont bool)
 
 type consoleToolCmd struct {
 	name  string
@@ -93,17 +101,34 @@ func (t *consoleTool) addCmd(name, usage string, f consoleToolFunc) {
 func (t *consoleTool) printCmdUsage() {
 	t.term.SetPrompt("")
 	defer t.term.SetPrompt(t.prompt)
-	_, _ = fmt.Fprintln(t.term, "Available cmds:")
-	hasQuit := false
+	t.writeCmdUsage(t.term, true)
+}
+
+func (t *consoleTool) writeCmdUsage(w io.Writer, withQuit bool) {
+	_, _ = fmt.Fprintln(w, "Available cmds:")
 	for _, cmd := range t.cmds {
 		if cmd.name == "quit" {
-			hasQuit = true
+			withQuit = false
 		}
-		_, _ = fmt.Fprintf(t.term, "  %s\n", cmd.usage)
+		_, _ = fmt.Fprintf(w, "  %s\n", cmd.usage)
+	}
+	if withQuit {
+		_, _ = fmt.Fprintln(w, "  quit")
 	}
-	if !hasQuit {
-		_, _ = fmt.Fprintln(t.term, "  quit")
+}
+
+// runCmd runs a single cmd with the standard streams instead of the
+// interactive loop, and exits with status 2 if the cmd is not found.
+func (t *consoleTool) runCmd(args []string, passwordStdin bool) {
+	for _, cmd := range t.cmds {
+		if cmd.name == args[0] {
+			cmd.f(&stdIO{os.Stdout, passwordStdin, nil}, args[1:])
+			return
+		}
 	}
+	_, _ = fmt.Fprintf(os.Stderr, "'%s' not found\n\n", args[0])
+	t.writeCmdUsage(os.Stderr, false)
+	os.Exit(2)
 }
 
 func (t *consoleTool) runLoop() {
@@ -138,6 +163,37 @@ cmdLoop:
 	}
 }
 
+// stdIO is the consoleIO of running a single cmd. Passwords are read without
+// echo from the terminal, or as lines from stdin if passwordStdin is set.
+type stdIO struct {
+	io.Writer
+	passwordStdin bool
+	stdin         *bufio.Reader
+}
+
+func (s *stdIO) ReadPassword(prompt string) (string, error) {
+	if s.passwordStdin {
+		if s.stdin == nil {
+			s.stdin = bufio.NewReader(os.Stdin)
+		}
+		line, err := s.stdin.ReadString('\n')
+		if err == io.EOF {
+			err = nil // an empty password if nothing is left
+		}
+		return strings.TrimRight(line, "\r\n"), errors.WithStack(err)
+	}
+
+	// syscall.Stdin is a uintptr on Windows
+	if !terminal.IsTerminal(int(syscall.Stdin)) {
+		return "", errors.New(
+			"stdin is not a terminal, use -password-stdin instead")
+	}
+	_, _ = fmt.Fprint(os.Stderr, prompt)
+	pw, err := terminal.ReadPassword(int(syscall.Stdin))
+	_, _ = fmt.Fprintln(os.Stderr)
+	return string(pw), errors.WithStack(err)
+}
+
 // stdConsole is a wrapper around io.Stdin and os.Stdout. It sets the stdin to
 // raw mode on creation, and reset on Close.
 type stdConsole struct {
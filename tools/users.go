@@ -1,12 +1,19 @@
 package tools
 
 import (
+	"encoding/csv"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
+	"os"
+	"os/user"
+	"strconv"
 	"strings"
 	"text/tabwriter"
 	"time"
 
+	"golang.org/x/crypto/bcrypt"
 	"golang.org/x/crypto/ssh/terminal"
 
 	"github.com/pkg/errors"
@@ -37,7 +44,28 @@ func (t *usersTool) Run(args []string) {
 	driver := fs.String("driver", "",
 		"database driver. Can't be used with -c. Available drivers: "+
 			strings.Join(db.EnabledDrivers, ", "))
-	dsn := fs.String("dsn", "", "database source. Must be used with -driver.")
+	dsn := fs.String("dsn", "",
+		"database source. Must be used with -driver, e.g. "+db.DSNHelp+".")
+	importFile := fs.String("import", "",
+		"import users from a CSV file non-interactively. See the 'import' "+
+			"command for the format.")
+	exportFile := fs.String("export", "",
+		"export users to a file non-interactively, in JSON if the file "+
+			"name ends with '.json', or in CSV otherwise. '-' for stdout.")
+	exportScope := fs.String("export-scope", "",
+		"export only the users in this scope. Must be used with -export.")
+	withHashes := fs.Bool("with-hashes", false,
+		"include password hashes in the export. Must be used with -export.")
+	operator := fs.String("operator", currentOSUser(),
+		"who makes the changes, recorded in the audit log.")
+	passwordStdin := fs.Bool("password-stdin", false,
+		"read the passwords as lines from stdin when running a single cmd, "+
+			"which may also follow the cmd.")
+	fs.Usage = func() {
+		_, _ = fmt.Fprintf(fs.Output(), "Usage: users [FLAGS] [CMD ARGS...]\n"+
+			"Runs the CMD and exits if given, or starts the console.\n")
+		fs.PrintDefaults()
+	}
 
 	var dbConfig db.Config
 	_ = fs.Parse(args)
@@ -63,19 +91,53 @@ func (t *usersTool) Run(args []string) {
 		panic(err)
 	}
 	defer t.dao.Close() // nolint: errcheck
+	t.dao.SetOperator(*operator)
 
-	if err := t.setupConsole("users> "); err != nil {
-		panic(err)
+	if *importFile != "" {
+		t.importUsers(os.Stdout, *importFile)
+		return
+	} else if *exportFile != "" {
+		t.exportUsers(os.Stdout, *exportFile, *exportScope, *withHashes)
+		return
 	}
-	defer t.teardownConsole()
+
 	t.addCmd("add", "add SCOPE/NAME", t.addUser)
 	t.addCmd("delete", "delete SCOPE/NAME", t.deleteUser)
-	t.addCmd("list", "list [SCOPE]", t.listUsers)
+	t.addCmd("move", "move SCOPE/NAME NEWSCOPE/NEWNAME", t.moveUser)
+	t.addCmd("list", "list [SCOPE] [-name SUBSTR] [-password yes|no] "+
+		"[-sort id|name|created_at]", t.listUsers)
 	t.addCmd("passwd", "passwd SCOPE/NAME", t.changePasswd)
+	t.addCmd("token", "token SCOPE/NAME [revoke]", t.manageToken)
+	t.addCmd("rehash", "rehash [SCOPE]", t.rehashUsers)
+	t.addCmd("quota", "quota SCOPE/NAME SIZE|reset", t.setQuota)
+	t.addCmd("audit", "audit [SCOPE/NAME] [-n COUNT]", t.listAudit)
+	t.addCmd("import", "import CSV_FILE", t.importUsersCmd)
+	t.addCmd("export", "export [--with-hashes] FILE [SCOPE]",
+		t.exportUsersCmd)
+
+	if fs.NArg() > 0 {
+		var cmdArgs []string
+		for _, arg := range fs.Args() {
+			if arg == "-password-stdin" || arg == "--password-stdin" {
+				*passwordStdin = true
+			} else {
+				cmdArgs = append(cmdArgs, arg)
+			}
+		}
+		if len(cmdArgs) > 0 {
+			t.runCmd(cmdArgs, *passwordStdin)
+			return
+		}
+	}
+
+	if err := t.setupConsole("users> "); err != nil {
+		panic(err)
+	}
+	defer t.teardownConsole()
 	t.runLoop()
 }
 
-func (t *usersTool) addUser(term *terminal.Terminal, args []string) bool {
+func (t *usersTool) addUser(term consoleIO, args []string) bool {
 	if len(args) != 1 {
 		_, _ = fmt.Fprintln(term, "exactly one argument is required")
 		return true
@@ -88,8 +150,7 @@ func (t *usersTool) addUser(term *terminal.Terminal, args []string) bool {
 	}
 
 	u := db.User{Scope: us.Scope, Name: us.Name}
-	if pw, err := term.ReadPassword("Password (optional): "); err != nil {
-		_, _ = fmt.Fprintf(term, "failed to read password: %s\n", err)
+	if pw, ok := readNewPassword(term, "Password (optional): ", true); !ok {
 		return true
 	} else if len(pw) > 0 {
 		hash := db.HashUserPass(pw)
@@ -104,7 +165,7 @@ func (t *usersTool) addUser(term *terminal.Terminal, args []string) bool {
 	return true
 }
 
-func (t *usersTool) deleteUser(term *terminal.Terminal, args []string) bool {
+func (t *usersTool) deleteUser(term consoleIO, args []string) bool {
 	if len(args) != 1 {
 		_, _ = fmt.Fprintln(term, "exactly one argument is required")
 		return true
@@ -124,35 +185,87 @@ func (t *usersTool) deleteUser(term *terminal.Terminal, args []string) bool {
 	return true
 }
 
-func (t *usersTool) listUsers(term *terminal.Terminal, args []string) bool {
-	var users []*db.User
-	var err error
-	switch len(args) {
-	case 0:
-		users, err = t.dao.ListAll()
-	case 1:
-		users, err = t.dao.List(args[0])
+func (t *usersTool) moveUser(term consoleIO, args []string) bool {
+	if len(args) != 2 {
+		_, _ = fmt.Fprintln(term, "exactly two arguments are required")
+		return true
+	}
+
+	var from, to userSpec
+	if err := from.FromString(args[0]); err != nil {
+		_, _ = fmt.Fprintf(term, "invalid user '%s': %s\n", args[0], err)
+		return true
+	} else if err = to.FromString(args[1]); err != nil {
+		_, _ = fmt.Fprintf(term, "invalid user '%s': %s\n", args[1], err)
+		return true
+	}
+
+	err := t.dao.Rename(from.Scope, from.Name, to.Scope, to.Name)
+	if err != nil {
+		_, _ = fmt.Fprintf(term, "failed to move user '%s': %v\n", from, err)
+	} else {
+		_, _ = fmt.Fprintf(term, "user '%s' moved to '%s'\n", from, to)
+	}
+	return true
+}
+
+// listUsers lists the users in a scope or all the scopes, which may be
+// filtered and sorted by the flags given before or after the scope.
+func (t *usersTool) listUsers(term consoleIO, args []string) bool {
+	fs := flag.NewFlagSet("list", flag.ContinueOnError)
+	fs.SetOutput(term)
+	name := fs.String("name", "", "only the users whose names contain it.")
+	password := fs.String("password", "",
+		"'yes' or 'no', only the users with or without passwords.")
+	sortBy := fs.String("sort", "",
+		"'id', 'name' or 'created_at'. By scope and name if not specified.")
+	var q db.UserQuery
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		q.Scope, args = args[0], args[1:]
+	}
+	if fs.Parse(args) != nil { // the error and the usage are printed
+		return true
+	} else if fs.NArg() > 1 || (fs.NArg() == 1 && q.Scope != "") {
+		_, _ = fmt.Fprintln(term, "no more than one scope is accepted")
+		return true
+	} else if fs.NArg() == 1 {
+		q.Scope = fs.Arg(0)
+	}
+	q.NameContains, q.OrderBy = *name, *sortBy
+	switch *password {
+	case "":
+	case "yes", "no":
+		hasPassword := *password == "yes"
+		q.HasPassword = &hasPassword
 	default:
-		_, _ = fmt.Fprintln(term, "no more than one argument is accepted")
+		_, _ = fmt.Fprintf(term, "invalid value for -password: %s\n", *password)
 		return true
 	}
 
+	users, err := t.dao.Query(q)
 	if err != nil {
 		_, _ = fmt.Fprintf(term, "failed to list users: %v\n", err)
 		return true
 	}
 	w := tabwriter.NewWriter(term, 4, 0, 2, ' ', 0)
-	_, _ = fmt.Fprintln(w, "ID\tScope\tName\tPassword\tCreated At")
+	_, _ = fmt.Fprintln(
+		w, "ID\tScope\tName\tPassword\tToken\tQuota\tUsed\tCreated At")
 	for _, user := range users {
-		_, _ = fmt.Fprintf(w, "%d\t%s\t%s\t%t\t%s\n",
+		quota := "unlimited"
+		if user.Quota > 0 {
+			quota = lib.BytesHumanized(user.Quota)
+		}
+		_, _ = fmt.Fprintf(w, "%d\t%s\t%s\t%t\t%t\t%s\t%s\t%s\n",
 			user.ID, user.Scope, user.Name, user.PWHash != nil,
+			user.TokenHash != nil, quota,
+			lib.BytesHumanized(user.Usage()),
 			user.CreatedAt.Format(time.RFC822))
 	}
 	_ = w.Flush()
 	return true
 }
 
-func (t *usersTool) changePasswd(term *terminal.Terminal, args []string) bool {
+func (t *usersTool) changePasswd(term consoleIO, args []string) bool {
 	if len(args) != 1 {
 		_, _ = fmt.Fprintln(term, "exactly one argument is required")
 		return true
@@ -170,12 +283,8 @@ func (t *usersTool) changePasswd(term *terminal.Terminal, args []string) bool {
 		return true
 	}
 
-	pw, err := term.ReadPassword("Password: ")
-	if err != nil {
-		_, _ = fmt.Fprintf(term, "failed to read password: %s\n", err)
-		return true
-	} else if pw == "" {
-		_, _ = fmt.Fprintf(term, "a valid password is required\n")
+	pw, ok := readNewPassword(term, "Password: ", false)
+	if !ok {
 		return true
 	}
 
@@ -190,6 +299,427 @@ func (t *usersTool) changePasswd(term *terminal.Terminal, args []string) bool {
 	return true
 }
 
+// readNewPassword reads a password to be set, which must comply with the
+// password policy. It re-prompts in the interactive console until a valid one
+// is given.
+func readNewPassword(
+	term consoleIO, prompt string, optional bool) (string, bool) {
+	_, interactive := term.(*terminal.Terminal)
+	for {
+		pw, err := term.ReadPassword(prompt)
+		if err != nil {
+			_, _ = fmt.Fprintf(term, "failed to read password: %s\n", err)
+			return "", false
+		} else if pw == "" && optional {
+			return "", true
+		} else if pw == "" {
+			_, _ = fmt.Fprintf(term, "a valid password is required\n")
+		} else if err = db.CheckNewPassword(pw); err != nil {
+			_, _ = fmt.Fprintf(term, "%s\n", err)
+		} else {
+			return pw, true
+		}
+		if !interactive {
+			return "", false
+		}
+	}
+}
+
+// manageToken generates (or rotates) the API token of a user, or revokes it.
+// A new token is printed only once as it is stored hashed.
+func (t *usersTool) manageToken(term consoleIO, args []string) bool {
+	if len(args) != 1 && (len(args) != 2 || args[1] != "revoke") {
+		_, _ = fmt.Fprintln(term, "usage: token SCOPE/NAME [revoke]")
+		return true
+	}
+
+	us := userSpec{}
+	if err := us.FromString(args[0]); err != nil {
+		_, _ = fmt.Fprintf(term, "invalid user '%s': %s\n", args[0], err)
+		return true
+	}
+
+	u, err := t.dao.Get(us.Scope, us.Name)
+	if err != nil {
+		_, _ = fmt.Fprintf(term, "failed to get user '%s': %v\n", us, err)
+		return true
+	}
+
+	var token string
+	if len(args) == 2 {
+		u.TokenHash = nil
+	} else {
+		var hash []byte
+		if token, hash, err = db.GenerateAPIToken(); err != nil {
+			_, _ = fmt.Fprintln(term, err)
+			return true
+		}
+		u.TokenHash = &hash
+	}
+
+	if err = t.dao.Update(u); err != nil {
+		_, _ = fmt.Fprintf(
+			term, "failed to update token for '%s': %v\n", us, err)
+	} else if token == "" {
+		_, _ = fmt.Fprintln(term, "token revoked")
+	} else {
+		_, _ = fmt.Fprintf(term, "new token (shown only once): %s\n", token)
+	}
+	return true
+}
+
+// listAudit shows the latest changes of all the users or a user.
+func (t *usersTool) listAudit(term consoleIO, args []string) bool {
+	fs := flag.NewFlagSet("audit", flag.ContinueOnError)
+	fs.SetOutput(term)
+	count := fs.Int("n", 20, "number of the entries to show.")
+	us := userSpec{}
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		if err := us.FromString(args[0]); err != nil {
+			_, _ = fmt.Fprintf(term, "invalid user '%s': %s\n", args[0], err)
+			return true
+		}
+		args = args[1:]
+	}
+	if fs.Parse(args) != nil { // the error and the usage are printed
+		return true
+	} else if fs.NArg() > 0 || *count <= 0 {
+		fs.Usage()
+		return true
+	}
+
+	entries, err := t.dao.ListAudit(us.Scope, us.Name, *count)
+	if err != nil {
+		_, _ = fmt.Fprintf(term, "failed to list audit log: %v\n", err)
+		return true
+	}
+	w := tabwriter.NewWriter(term, 4, 0, 2, ' ', 0)
+	_, _ = fmt.Fprintln(w, "Time\tOperator\tOperation\tUser\tDetail")
+	for _, e := range entries {
+		_, _ = fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n",
+			e.CreatedAt.Format(time.RFC3339), e.Operator, e.Operation,
+			userSpec{Scope: e.Scope, Name: e.Name}, e.Detail)
+	}
+	_ = w.Flush()
+	return true
+}
+
+// rehashUsers finds the users whose password hashes were generated with an
+// outdated scheme or cost. As the passwords are needed to regenerate the
+// hashes, they are migrated on the next successful login of the users, or by
+// changing their passwords.
+func (t *usersTool) rehashUsers(term consoleIO, args []string) bool {
+	var users []*db.User
+	var err error
+	switch len(args) {
+	case 0:
+		users, err = t.dao.ListAll()
+	case 1:
+		users, err = t.dao.List(args[0])
+	default:
+		_, _ = fmt.Fprintln(term, "no more than one argument is accepted")
+		return true
+	}
+	if err != nil {
+		_, _ = fmt.Fprintf(term, "failed to list users: %v\n", err)
+		return true
+	}
+
+	outdated := 0
+	for _, user := range users {
+		if user.PWHash != nil && db.PWHashOutdated(*user.PWHash) {
+			_, _ = fmt.Fprintf(term, "outdated: %s\n",
+				userSpec{Scope: user.Scope, Name: user.Name})
+			outdated++
+		}
+	}
+	_, _ = fmt.Fprintf(term, "%d of %d users have outdated password hashes, "+
+		"which will be migrated on their next login or 'passwd'\n",
+		outdated, len(users))
+	return true
+}
+
+// setQuota sets the monthly traffic quota of a user ("0" for unlimited), or
+// resets the usage of the current month.
+func (t *usersTool) setQuota(term consoleIO, args []string) bool {
+	if len(args) != 2 {
+		_, _ = fmt.Fprintln(term, "exactly two arguments are required")
+		return true
+	}
+
+	us := userSpec{}
+	if err := us.FromString(args[0]); err != nil {
+		_, _ = fmt.Fprintf(term, "invalid user '%s': %s\n", args[0], err)
+		return true
+	}
+
+	var err error
+	msg := "usage reset"
+	if args[1] == "reset" {
+		err = t.dao.ResetUsage(us.Scope, us.Name)
+	} else if quota, pErr := lib.ParseByteSize(args[1]); pErr != nil {
+		_, _ = fmt.Fprintf(term, "invalid size '%s': %v\n", args[1], pErr)
+		return true
+	} else {
+		if quota == 0 {
+			msg = "quota removed"
+		} else {
+			msg = "quota set to " + lib.BytesHumanized(quota)
+		}
+		err = t.dao.SetQuota(us.Scope, us.Name, quota)
+	}
+
+	if err != nil {
+		_, _ = fmt.Fprintf(
+			term, "failed to update quota for '%s': %v\n", us, err)
+	} else {
+		_, _ = fmt.Fprintln(term, msg)
+	}
+	return true
+}
+
+// importUsersCmd imports users from a CSV file, whose columns are scope, name
+// and an optional password. The passwords must comply with the password
+// policy. If the first row is a header starting with scope and name, the
+// columns are found by it instead, in which case a 'pw_hash' column (e.g. of
+// an export with the hashes) is imported as is, and the unknown ones (e.g.
+// 'id') are ignored.
+func (t *usersTool) importUsersCmd(
+	term consoleIO, args []string) bool {
+	if len(args) != 1 {
+		_, _ = fmt.Fprintln(term, "exactly one argument is required")
+		return true
+	}
+	t.importUsers(term, args[0])
+	return true
+}
+
+func (t *usersTool) importUsers(w io.Writer, file string) {
+	f, err := os.Open(file)
+	if err != nil {
+		_, _ = fmt.Fprintf(w, "failed to open '%s': %s\n", file, err)
+		return
+	}
+	defer f.Close() // nolint: errcheck
+
+	r := csv.NewReader(f)
+	r.FieldsPerRecord = -1
+	r.TrimLeadingSpace = true
+	var added, failed int
+	cols := defaultUsersCSVColumns
+	for row := 1; ; row++ {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			if _, isParseErr := err.(*csv.ParseError); !isParseErr {
+				_, _ = fmt.Fprintf(w, "failed to read '%s': %s\n", file, err)
+				break
+			}
+			_, _ = fmt.Fprintf(w, "row %d: %s\n", row, err)
+			failed++
+			continue
+		}
+		if row == 1 && len(record) >= 2 &&
+			strings.EqualFold(record[0], "scope") &&
+			strings.EqualFold(record[1], "name") { // header
+			cols = parseUsersCSVHeader(record)
+			continue
+		}
+
+		if err = t.importUser(record, cols); err != nil {
+			_, _ = fmt.Fprintf(w, "row %d: %s\n", row, err)
+			failed++
+		} else {
+			_, _ = fmt.Fprintf(w, "row %d: user '%s/%s' added\n",
+				row, record[0], record[1])
+			added++
+		}
+	}
+	_, _ = fmt.Fprintf(w, "%d user(s) added, %d failed\n", added, failed)
+}
+
+// usersCSVColumns are the indexes of the columns imported, -1 if absent.
+type usersCSVColumns struct {
+	count    int // of each row, 0 for 2 or 3 (i.e. without a header)
+	password int
+	pwHash   int
+}
+
+// the columns without a header, i.e. scope, name and an optional password
+var defaultUsersCSVColumns = usersCSVColumns{password: 2, pwHash: -1}
+
+func parseUsersCSVHeader(header []string) usersCSVColumns {
+	cols := usersCSVColumns{count: len(header), password: -1, pwHash: -1}
+	for i, name := range header {
+		switch strings.ToLower(name) {
+		case "password":
+			cols.password = i
+		case "pw_hash":
+			cols.pwHash = i
+		}
+	}
+	return cols
+}
+
+func (t *usersTool) importUser(record []string, cols usersCSVColumns) error {
+	if cols.count == 0 && len(record) != 2 && len(record) != 3 {
+		return errors.New("expecting columns: scope,name[,password]")
+	} else if cols.count != 0 && len(record) != cols.count {
+		return errors.Errorf(
+			"expecting %d columns as the header", cols.count)
+	}
+	field := func(i int) string {
+		if i >= 0 && i < len(record) {
+			return record[i]
+		}
+		return ""
+	}
+	password, pwHash := field(cols.password), field(cols.pwHash)
+	if password != "" && pwHash != "" {
+		return errors.New("both password and pw_hash are set")
+	}
+	us := userSpec{}
+	if err := us.FromString(record[0] + "/" + record[1]); err != nil {
+		return err
+	}
+	if t.dao.CheckExists(us.Scope, us.Name) {
+		return errors.Errorf("user '%s' already exists", us)
+	}
+
+	u := db.User{Scope: us.Scope, Name: us.Name}
+	if password != "" {
+		if err := db.CheckNewPassword(password); err != nil {
+			return err
+		}
+		hash := db.HashUserPass(password)
+		u.PWHash = &hash
+	} else if pwHash != "" {
+		if _, err := bcrypt.Cost([]byte(pwHash)); err != nil {
+			return errors.Wrap(err, "invalid pw_hash")
+		}
+		hash := []byte(pwHash)
+		u.PWHash = &hash
+	}
+	return t.dao.Add(&u)
+}
+
+// exportedUser is the format of a user in an export.
+type exportedUser struct {
+	ID          uint      `json:"id"`
+	Scope       string    `json:"scope"`
+	Name        string    `json:"name"`
+	HasPassword bool      `json:"has_password"`
+	CreatedAt   time.Time `json:"created_at"`
+	PWHash      string    `json:"pw_hash,omitempty"`
+}
+
+// exportUsersCmd exports users to a file, in JSON if the file name ends with
+// '.json', or in CSV otherwise, which can be imported again (see
+// importUsersCmd). Password hashes are not exported unless --with-hashes is
+// given, without which the users are imported without passwords.
+func (t *usersTool) exportUsersCmd(
+	term consoleIO, args []string) bool {
+	withHashes := false
+	if len(args) > 0 && args[0] == "--with-hashes" {
+		withHashes = true
+		args = args[1:]
+	}
+	if len(args) != 1 && len(args) != 2 {
+		_, _ = fmt.Fprintln(term, "one or two arguments are required")
+		return true
+	}
+	scope := ""
+	if len(args) == 2 {
+		scope = args[1]
+	}
+	t.exportUsers(term, args[0], scope, withHashes)
+	return true
+}
+
+func (t *usersTool) exportUsers(
+	w io.Writer, file, scope string, withHashes bool) {
+	var users []*db.User
+	var err error
+	if scope == "" {
+		users, err = t.dao.ListAll()
+	} else {
+		users, err = t.dao.List(scope)
+	}
+	if err != nil {
+		_, _ = fmt.Fprintf(w, "failed to list users: %v\n", err)
+		return
+	}
+
+	exported := make([]exportedUser, len(users))
+	for i, u := range users {
+		exported[i] = exportedUser{
+			ID:          u.ID,
+			Scope:       u.Scope,
+			Name:        u.Name,
+			HasPassword: u.PWHash != nil,
+			CreatedAt:   u.CreatedAt,
+		}
+		if withHashes && u.PWHash != nil {
+			exported[i].PWHash = string(*u.PWHash)
+		}
+	}
+
+	out := w
+	if file != "-" {
+		f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			_, _ = fmt.Fprintf(w, "failed to create '%s': %s\n", file, err)
+			return
+		}
+		defer f.Close() // nolint: errcheck
+		out = f
+	}
+	if strings.HasSuffix(strings.ToLower(file), ".json") {
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(exported)
+	} else {
+		err = writeUsersCSV(out, exported, withHashes)
+	}
+	if err != nil {
+		_, _ = fmt.Fprintf(w, "failed to export users: %s\n", err)
+	} else if file != "-" {
+		_, _ = fmt.Fprintf(w, "%d user(s) exported\n", len(exported))
+	}
+}
+
+func writeUsersCSV(w io.Writer, users []exportedUser, withHashes bool) error {
+	cw := csv.NewWriter(w)
+	header := []string{"scope", "name", "id", "has_password", "created_at"}
+	if withHashes {
+		header = append(header, "pw_hash")
+	}
+	_ = cw.Write(header)
+	for _, u := range users {
+		record := []string{
+			u.Scope, u.Name, strconv.FormatUint(uint64(u.ID), 10),
+			strconv.FormatBool(u.HasPassword),
+			u.CreatedAt.Format(time.RFC3339),
+		}
+		if withHashes {
+			record = append(record, u.PWHash)
+		}
+		_ = cw.Write(record)
+	}
+	cw.Flush()
+	return errors.WithStack(cw.Error())
+}
+
+// currentOSUser returns the name of the OS user running the tool, or an empty
+// string if it's unknown.
+func currentOSUser() string {
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+	return os.Getenv("USER")
+}
+
 type userSpec struct {
 	Scope string
 	Name  string
@@ -0,0 +1,57 @@
+package tools
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"testing"
+
+	"github.com/richardtsai/thestral2/db"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUsersExportImportRoundTrip(t *testing.T) {
+	if !db.CheckDriver("sqlite3") {
+		t.Skip("database driver 'sqlite3' is not enabled")
+	}
+	tmpDir, err := ioutil.TempDir("", "thestral2_TestUsersExportImport")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir) // nolint: errcheck
+	dbCount := 0
+	newTool := func() *usersTool {
+		dbCount++
+		require.NoError(t, db.InitDB(db.Config{Driver: "sqlite3",
+			DSN: path.Join(tmpDir, strconv.Itoa(dbCount)+".db")}))
+		dao, err := db.NewUserDAO()
+		require.NoError(t, err)
+		return &usersTool{dao: dao}
+	}
+
+	for _, withHashes := range []bool{true, false} {
+		tool := newTool()
+		hash := db.HashUserPass("Passw0rd!")
+		require.NoError(t, tool.dao.Add(&db.User{
+			Scope: "scope", Name: "alice", PWHash: &hash}))
+		require.NoError(t, tool.dao.Add(&db.User{Scope: "scope", Name: "bob"}))
+		file := path.Join(tmpDir, "users.csv")
+		var out bytes.Buffer
+		tool.exportUsers(&out, file, "", withHashes)
+		require.Contains(t, out.String(), "2 user(s) exported")
+		require.NoError(t, tool.dao.Close())
+
+		tool = newTool()
+		out.Reset()
+		tool.importUsers(&out, file)
+		assert.Contains(t, out.String(), "2 user(s) added, 0 failed")
+		assert.Equal(t, withHashes, tool.dao.CheckPassword(
+			"scope", "alice", "Passw0rd!"), "withHashes: %v", withHashes)
+		u, err := tool.dao.Get("scope", "bob")
+		if assert.NoError(t, err) {
+			assert.Nil(t, u.PWHash)
+		}
+		require.NoError(t, tool.dao.Close())
+	}
+}
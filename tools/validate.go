@@ -0,0 +1,43 @@
+package tools
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/richardtsai/thestral2/lib"
+)
+
+// ValidateConfig checks a configuration as the app would do on creation. It
+// is set by the main package, which is not importable by the tools.
+var ValidateConfig func(config lib.Config) error
+
+func init() {
+	allTools = append(allTools, validateTool{})
+}
+
+type validateTool struct{}
+
+func (validateTool) Name() string {
+	return "validate"
+}
+
+func (validateTool) Description() string {
+	return "Check a configuration file without starting the service"
+}
+
+func (validateTool) Run(args []string) {
+	fs := flag.NewFlagSet("validate", flag.ExitOnError)
+	configFile := fs.String("c", "", "thestral2 configuration file.")
+	_ = fs.Parse(args)
+
+	config, err := lib.ParseConfigFile(*configFile)
+	if err == nil {
+		err = ValidateConfig(*config)
+	}
+	if err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "invalid configuration: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Println("OK")
+}